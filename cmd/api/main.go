@@ -2,17 +2,24 @@ package main
 
 import (
     "context"
+    "flag"
+    "fmt"
     "log"
     "os"
     "os/signal"
     "syscall"
+    "time"
 
     "diagnostic-client/internal/api"
     "diagnostic-client/internal/config"
     "diagnostic-client/internal/db"
+    "diagnostic-client/internal/tracing"
 )
 
 func main() {
+    checkConfig := flag.Bool("check-config", false, "validate the configuration, print the effective limits and exit")
+    flag.Parse()
+
     log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
     
     // Load configuration
@@ -21,6 +28,28 @@ func main() {
         log.Fatalf("Failed to load config: %v", err)
     }
 
+    if *checkConfig {
+        fmt.Print("Effective limits:\n" + cfg.Limits())
+        for _, w := range cfg.Warnings() {
+            fmt.Println("warning:", w)
+        }
+        return
+    }
+
+    // verify [-deep] [-repair] checks the log archive and exits
+    if flag.Arg(0) == "verify" {
+        os.Exit(runVerify(cfg, flag.Args()[1:]))
+    }
+    // replay -database URL FILE replays an agent capture and exits
+    if flag.Arg(0) == "replay" {
+        os.Exit(runReplay(cfg, flag.Args()[1:]))
+    }
+
+    log.Printf("Effective limits:\n%s", cfg.Limits())
+    for _, w := range cfg.Warnings() {
+        log.Printf("Config warning: %s", w)
+    }
+
     // Create context with cancellation
     ctx, cancel := context.WithCancel(context.Background())
     
@@ -33,8 +62,21 @@ func main() {
         cancel()
     }()
 
+    // Tracing is a no-op unless an OTLP endpoint is configured
+    shutdownTracing, err := tracing.Setup(ctx, cfg)
+    if err != nil {
+        log.Fatalf("Failed to initialize tracing: %v", err)
+    }
+    defer func() {
+        flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancelFlush()
+        if err := shutdownTracing(flushCtx); err != nil {
+            log.Printf("Error flushing traces: %v", err)
+        }
+    }()
+
     // Initialize database
-    database, err := db.New(ctx, cfg.DatabaseURL)
+    database, err := db.New(ctx, cfg)
     if err != nil {
         log.Fatalf("Failed to initialize database: %v", err)
     }
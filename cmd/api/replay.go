@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/tunnel"
+)
+
+// runReplay feeds a capture back through the tunnel handler against a
+// throwaway database and returns the process exit code
+func runReplay(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	databaseURL := fs.String("database", "", "URL of the throwaway database to replay into; missing tables are created")
+	force := fs.Bool("force", false, "replay files with more than MAX_FILE_QUERY_ROWS lines")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *databaseURL == "" {
+		fmt.Fprintln(os.Stderr, "usage: api replay [-force] -database URL capture.jsonl.gz")
+		return 2
+	}
+	// Replaying stores everything again, so never into the live database
+	for _, url := range append([]string{cfg.DatabaseURL}, cfg.DatabaseURLs...) {
+		if url == *databaseURL {
+			fmt.Fprintln(os.Stderr, "replay: -database must not be a configured database")
+			return 2
+		}
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	// A runaway file would take the replay as long as its ingest did
+	if !*force && cfg.MaxFileQueryRows > 0 {
+		counts, err := tunnel.CaptureLineCounts(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+		large := 0
+		for path, n := range counts {
+			if n > cfg.MaxFileQueryRows {
+				fmt.Fprintf(os.Stderr, "replay: %s has %d lines, more than MAX_FILE_QUERY_ROWS (%d)\n", path, n, cfg.MaxFileQueryRows)
+				large++
+			}
+		}
+		if large > 0 {
+			fmt.Fprintln(os.Stderr, "replay: pass -force to replay them anyway")
+			return 1
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+			return 1
+		}
+	}
+
+	replayCfg := *cfg
+	replayCfg.DatabaseURL = *databaseURL
+	replayCfg.DatabaseURLs = nil
+	replayCfg.ReadOnly = false
+	replayCfg.AgentIdleTimeout = 0
+
+	ctx := context.Background()
+	database, err := db.New(ctx, &replayCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: connect to database: %v\n", err)
+		return 1
+	}
+	defer database.Close()
+
+	handler := tunnel.NewHandler(&replayCfg, database, clock.Real{})
+	header, err := handler.Replay(ctx, file)
+	// Store what is still batched before reporting
+	handler.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("replayed capture of %s started %s\n", header.AgentID, header.StartedAt.Format("2006-01-02T15:04:05Z07:00"))
+	return 0
+}
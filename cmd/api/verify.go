@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+)
+
+// Exit codes of the verify subcommand
+const (
+	verifyClean         = 0
+	verifyDiscrepancies = 1
+	verifyFailed        = 2
+)
+
+// runVerify checks archived log lines against the manifests written when
+// they were archived and returns the process exit code
+func runVerify(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	deep := fs.Bool("deep", false, "check every manifest instead of an ARCHIVE_VERIFY_SAMPLE sample")
+	repair := fs.Bool("repair", false, "re-archive or quarantine the file generations that don't match")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	database, err := db.New(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: connect to database: %v\n", err)
+		return verifyFailed
+	}
+	defer database.Close()
+
+	sample := cfg.ArchiveVerifySample
+	if *deep {
+		sample = 0
+	}
+	report, err := database.VerifyArchive(ctx, sample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", err)
+		return verifyFailed
+	}
+
+	fmt.Printf("checked %d archived file generations, %d mismatched\n", report.Checked, len(report.Discrepancies))
+	for _, d := range report.Discrepancies {
+		fmt.Println("mismatch:", d)
+		if !*repair {
+			continue
+		}
+		action, err := database.RepairArchive(ctx, d)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "verify: repair %s: %v\n", d.Manifest.FilePath, err)
+			return verifyFailed
+		}
+		fmt.Printf("  %s\n", action)
+	}
+
+	if len(report.Discrepancies) > 0 {
+		return verifyDiscrepancies
+	}
+	return verifyClean
+}
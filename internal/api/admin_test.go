@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/jobs"
+)
+
+func TestJobsEndpoints(t *testing.T) {
+	s := jobs.New(clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)))
+	release := make(chan struct{})
+	s.Register(jobs.Job{Name: "retention", Interval: time.Hour, Run: func(ctx context.Context) error {
+		<-release
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	defer s.Wait()
+	defer cancel()
+	defer close(release)
+
+	h := &Handler{cfg: &config.Config{AdminToken: "secret"}, jobs: s}
+	serve := func(method, path string, token string) *httptest.ResponseRecorder {
+		var handler http.HandlerFunc
+		for _, rt := range h.routes() {
+			if rt.path == "/api/admin/jobs" && path == rt.path || rt.path == "/api/admin/jobs/" && path != "/api/admin/jobs" {
+				handler = rt.serve(h)
+			}
+		}
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodPost, "/api/admin/jobs/retention/run", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("trigger without the admin token: status %d, want 401", w.Code)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"/api/admin/jobs/retention/run", http.StatusAccepted},
+		{"/api/admin/jobs/retention/run", http.StatusConflict},
+		{"/api/admin/jobs/missing/run", http.StatusNotFound},
+		{"/api/admin/jobs/retention/stop", http.StatusNotFound},
+	} {
+		if w := serve(http.MethodPost, tc.path, "secret"); w.Code != tc.want {
+			t.Errorf("POST %s: status %d, want %d: %s", tc.path, w.Code, tc.want, w.Body)
+		}
+	}
+
+	w := serve(http.MethodGet, "/api/admin/jobs", "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list jobs: status %d: %s", w.Code, w.Body)
+	}
+	var statuses []jobs.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "retention" || !statuses[0].Running {
+		t.Errorf("jobs = %+v, want retention running", statuses)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// Limits on agent configs, so one bad profile can't stall every agent
+const (
+	maxAgentScanPaths       = 100
+	maxAgentScanInterval    = 86400
+	maxAgentCaptureFilter   = 1024
+	maxAgentIDLength        = 255
+	maxAgentConfigBodyBytes = 64 << 10
+)
+
+// validateAgentConfig checks a config against what agents accept
+func validateAgentConfig(c models.AgentConfig) error {
+	if len(c.ScanPaths) == 0 || len(c.ScanPaths) > maxAgentScanPaths {
+		return fmt.Errorf("scan_paths must list 1 to %d paths", maxAgentScanPaths)
+	}
+	for _, p := range c.ScanPaths {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("scan path %q is not absolute", p)
+		}
+	}
+	if err := paths.ValidatePatterns(c.ScanPaths); err != nil {
+		return err
+	}
+	if c.ScanIntervalSeconds < 0 || c.ScanIntervalSeconds > maxAgentScanInterval {
+		return fmt.Errorf("scan_interval_seconds must be between 0 and %d", maxAgentScanInterval)
+	}
+	if len(c.CaptureFilter) > maxAgentCaptureFilter {
+		return fmt.Errorf("capture_filter must be at most %d bytes", maxAgentCaptureFilter)
+	}
+	if strings.IndexFunc(c.CaptureFilter, unicode.IsControl) >= 0 {
+		return errors.New("capture_filter contains control characters")
+	}
+	return nil
+}
+
+// AgentConfig serves /api/agents/{id}/config. The ID "default" names the
+// profile of agents without their own. Changes are pushed to connected
+// agents at once.
+func (h *Handler) AgentConfig(w http.ResponseWriter, r *http.Request) {
+	agentID, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/agents/"), "/config")
+	if !ok || agentID == "" || len(agentID) > maxAgentIDLength || strings.Contains(agentID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.getAgentConfig(w, r, agentID)
+	case http.MethodPut:
+		h.requireAdmin(func(w http.ResponseWriter, r *http.Request) { h.putAgentConfig(w, r, agentID) })(w, r)
+	case http.MethodDelete:
+		h.requireAdmin(func(w http.ResponseWriter, r *http.Request) { h.deleteAgentConfig(w, r, agentID) })(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) getAgentConfig(w http.ResponseWriter, r *http.Request, agentID string) {
+	profile, err := h.db.GetAgentConfig(r.Context(), agentID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "agent config not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, profile)
+}
+
+type agentConfigUpdate struct {
+	models.AgentConfigProfile
+	// Connected agents the new config was sent to
+	PushedTo int `json:"pushed_to"`
+}
+
+func (h *Handler) putAgentConfig(w http.ResponseWriter, r *http.Request, agentID string) {
+	var config models.AgentConfig
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAgentConfigBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateAgentConfig(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	profile, err := h.db.PutAgentConfig(r.Context(), agentID, config)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pushed := h.tunnel.PushAgentConfig(r.Context(), agentID)
+	log.Printf("[API] Config of %s set to version %d, pushed to %d agents", agentID, profile.Version, pushed)
+	writeJSON(w, http.StatusOK, agentConfigUpdate{*profile, pushed})
+}
+
+// deleteAgentConfig removes a profile. Its agents fall back to the default
+// profile, which is pushed to them; deleting the default leaves agents
+// without their own profile running the config they last applied.
+func (h *Handler) deleteAgentConfig(w http.ResponseWriter, r *http.Request, agentID string) {
+	err := h.db.DeleteAgentConfig(r.Context(), agentID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "agent config not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	pushed := h.tunnel.PushAgentConfig(r.Context(), agentID)
+	log.Printf("[API] Config of %s deleted, fallback pushed to %d agents", agentID, pushed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// agentStatus is an agent known from a connection, a registration, a
+// profile or an ack
+type agentStatus struct {
+	ID          string `json:"id"`
+	Connections int    `json:"connections"`
+	// How the agent last registered; omitted for agents that never did
+	Registration *models.Agent `json:"registration,omitempty"`
+	// Profile and version the agent should run; omitted when neither its
+	// own nor the default profile exists
+	Profile string `json:"profile,omitempty"`
+	Version int64  `json:"version,omitempty"`
+	// The config the agent last reported applying
+	Applied *models.AgentConfigAck `json:"applied,omitempty"`
+	// The agent isn't confirmed to run the version it should
+	Drift bool `json:"drift"`
+	// Ingest rates of the last 30 minutes, one sample a minute, oldest first
+	Recent []models.AgentMetric `json:"recent"`
+	// Why the server last dropped the agent's connections, newest first
+	Events []models.AgentEvent `json:"events"`
+}
+
+// GetAgents lists agents with their registration, the config version each
+// should run and the one it reported running, their recent ingest rates and
+// why their connections were last dropped. Agents still on another version,
+// or that failed to apply theirs, are flagged as drifted.
+func (h *Handler) GetAgents(w http.ResponseWriter, r *http.Request) {
+	profiles, err := h.db.GetAgentConfigs(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	acks, err := h.db.GetAgentConfigAcks(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	registered, err := h.db.GetAgents(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	agents := make(map[string]*agentStatus)
+	status := func(id string) *agentStatus {
+		if agents[id] == nil {
+			agents[id] = &agentStatus{ID: id}
+		}
+		return agents[id]
+	}
+	for id, n := range h.tunnel.ConnectedAgentIDs() {
+		status(id).Connections = n
+	}
+	// Connected agents' registrations are fresher than the stored ones,
+	// which only get their last seen time on disconnect
+	for i := range registered {
+		status(registered[i].ID).Registration = &registered[i]
+	}
+	for _, a := range h.tunnel.RegisteredAgents() {
+		a := a
+		status(a.ID).Registration = &a
+	}
+	var fallback *models.AgentConfigProfile
+	for i, p := range profiles {
+		if p.AgentID == models.DefaultAgentProfile {
+			fallback = &profiles[i]
+			continue
+		}
+		a := status(p.AgentID)
+		a.Profile, a.Version = p.AgentID, p.Version
+	}
+	for i := range acks {
+		status(acks[i].AgentID).Applied = &acks[i]
+	}
+	recent, err := h.db.GetRecentAgentMetrics(r.Context(), time.Now().Add(-agentSparklineWindow))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for id, samples := range recent {
+		status(id).Recent = samples
+	}
+	events, err := h.db.GetLatestAgentEvents(r.Context(), agentListEvents)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for id, e := range events {
+		status(id).Events = e
+	}
+
+	list := make([]agentStatus, 0, len(agents))
+	for _, a := range agents {
+		if a.Profile == "" && fallback != nil {
+			a.Profile, a.Version = fallback.AgentID, fallback.Version
+		}
+		if a.Profile != "" {
+			a.Drift = a.Applied == nil || a.Applied.Version != a.Version || a.Applied.Error != ""
+		}
+		if a.Recent == nil {
+			a.Recent = []models.AgentMetric{}
+		}
+		if a.Events == nil {
+			a.Events = []models.AgentEvent{}
+		}
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	writeJSON(w, http.StatusOK, list)
+}
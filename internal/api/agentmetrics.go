@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	defaultAgentMetricsWindow = 24 * time.Hour
+	maxAgentMetricsWindow     = 31 * 24 * time.Hour
+	// Span of the recent series in the agent list
+	agentSparklineWindow = 30 * time.Minute
+	// Newest events of each agent in the agent list
+	agentListEvents = 5
+)
+
+type agentMetricsResponse struct {
+	AgentID string               `json:"agent_id"`
+	Start   time.Time            `json:"start"`
+	End     time.Time            `json:"end"`
+	Samples []models.AgentMetric `json:"samples"`
+}
+
+// Agent serves the per-agent endpoints under /api/agents/{id}/
+func (h *Handler) Agent(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/metrics") {
+		h.AgentMetrics(w, r)
+		return
+	}
+	h.AgentConfig(w, r)
+}
+
+// AgentMetrics returns an agent's recorded ingest rates between start and
+// end, defaulting to the last 24 hours
+func (h *Handler) AgentMetrics(w http.ResponseWriter, r *http.Request) {
+	agentID, _ := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/agents/"), "/metrics")
+	if agentID == "" || len(agentID) > maxAgentIDLength || strings.Contains(agentID, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	end := time.Now().UTC()
+	if es := q.Get("end"); es != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-defaultAgentMetricsWindow)
+	if ss := q.Get("start"); ss != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "invalid start time", http.StatusBadRequest)
+			return
+		}
+	}
+	if !start.Before(end) || end.Sub(start) > maxAgentMetricsWindow {
+		http.Error(w, "start must be before end and at most 31 days earlier", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := h.db.GetAgentMetrics(r.Context(), agentID, start, end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if samples == nil {
+		samples = []models.AgentMetric{}
+	}
+
+	writeJSON(w, http.StatusOK, agentMetricsResponse{
+		AgentID: agentID,
+		Start:   start,
+		End:     end,
+		Samples: samples,
+	})
+}
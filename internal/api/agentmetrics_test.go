@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestAgentMetricsRejectsBadRequests(t *testing.T) {
+	h := &Handler{}
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/api/agents//metrics", http.StatusNotFound},
+		{http.MethodGet, "/api/agents/a/b/metrics", http.StatusNotFound},
+		{http.MethodPost, "/api/agents/a/metrics", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/agents/a/metrics?start=yesterday", http.StatusBadRequest},
+		{http.MethodGet, "/api/agents/a/metrics?end=now", http.StatusBadRequest},
+		{http.MethodGet, "/api/agents/a/metrics?start=2024-01-02T00:00:00Z&end=2024-01-01T00:00:00Z", http.StatusBadRequest},
+		{http.MethodGet, "/api/agents/a/metrics?start=2024-01-01T00:00:00Z&end=2024-01-01T00:00:00Z", http.StatusBadRequest},
+		{http.MethodGet, "/api/agents/a/metrics?start=2024-01-01T00:00:00Z&end=2024-03-01T00:00:00Z", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.Agent(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAgentMetricsEndpoint(t *testing.T) {
+	h, _ := newTestHandler(t, "agent_metrics")
+	ctx := context.Background()
+	at := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	if err := h.db.SaveAgentMetrics(ctx, map[string]models.AgentMetric{"web-1": {Time: at, LinesPerSecond: 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) agentMetricsResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.Agent(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d %s", path, w.Code, w.Body)
+		}
+		var resp agentMetricsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/api/agents/web-1/metrics?start=2024-01-01T00:00:00Z&end=2024-01-01T01:00:00Z")
+	if resp.AgentID != "web-1" || len(resp.Samples) != 1 || resp.Samples[0].LinesPerSecond != 4 {
+		t.Errorf("metrics = %+v, want the one sample", resp)
+	}
+	// The default window is the 24 hours before end
+	resp = get("/api/agents/web-1/metrics?end=2024-01-01T12:00:00Z")
+	if !resp.Start.Equal(time.Date(2023, 12, 31, 12, 0, 0, 0, time.UTC)) || len(resp.Samples) != 1 {
+		t.Errorf("default window = %+v, want the 24 hours before end", resp)
+	}
+	if resp := get("/api/agents/web-2/metrics"); resp.Samples == nil || len(resp.Samples) != 0 {
+		t.Errorf("metrics of an unsampled agent = %+v, want an empty list", resp.Samples)
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	defaultAnnotationsWindow = 7 * 24 * time.Hour
+	maxAnnotationTextLen     = 1000
+	maxAnnotationTags        = 20
+)
+
+// Annotations handles /api/annotations (list a time range and create)
+func (h *Handler) Annotations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getAnnotations(w, r)
+
+	case http.MethodPost:
+		annotation, err := decodeAnnotation(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.db.CreateAnnotation(r.Context(), annotation); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, annotation)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getAnnotations lists annotations between start and end, defaulting to the
+// last 7 days
+func (h *Handler) getAnnotations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	end := time.Now().UTC()
+	if es := q.Get("end"); es != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-defaultAnnotationsWindow)
+	if ss := q.Get("start"); ss != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "invalid start time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	annotations, err := h.db.GetAnnotations(r.Context(), start, end)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if annotations == nil {
+		annotations = []models.Annotation{}
+	}
+
+	writeJSON(w, http.StatusOK, annotations)
+}
+
+// Annotation handles /api/annotations/{id}
+func (h *Handler) Annotation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/annotations/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid annotation id", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err = h.db.DeleteAnnotation(r.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "annotation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAnnotation reads and validates an annotation; the timestamp
+// defaults to now
+func decodeAnnotation(r *http.Request) (*models.Annotation, error) {
+	var a models.Annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return nil, err
+	}
+	a.ID = 0
+	a.CreatedAt = time.Time{}
+
+	a.Text = strings.TrimSpace(a.Text)
+	if a.Text == "" {
+		return nil, errors.New("text is required")
+	}
+	if len(a.Text) > maxAnnotationTextLen {
+		return nil, errors.New("text must be at most 1000 bytes")
+	}
+	if len(a.Tags) > maxAnnotationTags {
+		return nil, errors.New("at most 20 tags are allowed")
+	}
+	for _, tag := range a.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return nil, errors.New("tags must not be empty")
+		}
+	}
+	if a.Timestamp.IsZero() {
+		a.Timestamp = time.Now().UTC()
+	}
+
+	return &a, nil
+}
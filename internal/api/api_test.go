@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/tunnel"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// openTestDB loads the configuration with the database TEST_DATABASE_URL
+// names, connects to it, which migrates it, and empties the given tables.
+// Tests needing it are skipped when the variable isn't set.
+func openTestDB(tb testing.TB, tables ...string) (*config.Config, *db.DB) {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	defer conn.Close(ctx)
+	for _, table := range tables {
+		if _, err := conn.Exec(ctx, "TRUNCATE "+table+" CASCADE"); err != nil {
+			tb.Fatalf("truncate %s: %v", table, err)
+		}
+	}
+
+	tb.Setenv("DATABASE_URL", url)
+	cfg, err := config.Load()
+	if err != nil {
+		tb.Fatalf("load config: %v", err)
+	}
+	d, err := db.New(ctx, cfg)
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	tb.Cleanup(d.Close)
+	return cfg, d
+}
+
+// newTestHandler returns a handler with a live tunnel on the test database
+func newTestHandler(tb testing.TB, tables ...string) (*Handler, *tunnel.Handler) {
+	tb.Helper()
+	cfg, d := openTestDB(tb, tables...)
+	tun := tunnel.NewHandler(cfg, d, clock.Real{})
+	tb.Cleanup(tun.Close)
+	return NewHandler(cfg, d, tun, nil, nil, nil, nil, clock.Real{}), tun
+}
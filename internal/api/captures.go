@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/tunnel"
+)
+
+// Bounds of a capture, so a forgotten one can't fill the disk
+const (
+	defaultCaptureDuration = 10 * time.Minute
+	maxCaptureDuration     = 24 * time.Hour
+	defaultCaptureMB       = 50
+	maxCaptureMB           = 1024
+)
+
+type captureRequest struct {
+	AgentID string `json:"agent_id"`
+	// Go duration; default 10m, at most 24h
+	Duration string `json:"duration,omitempty"`
+	// Uncompressed megabytes of messages; default 50, at most 1024
+	MaxMB int `json:"max_mb,omitempty"`
+}
+
+// Captures serves /api/admin/captures: GET lists capture files, POST starts
+// capturing an agent's messages and DELETE with agent_id stops it early
+func (h *Handler) Captures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		captures, err := h.tunnel.Captures()
+		if err != nil {
+			h.captureError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, captures)
+	case http.MethodPost:
+		h.startCapture(w, r)
+	case http.MethodDelete:
+		agentID := r.URL.Query().Get("agent_id")
+		if agentID == "" {
+			http.Error(w, "agent_id parameter required", http.StatusBadRequest)
+			return
+		}
+		info, ok := h.tunnel.StopCapture(agentID)
+		if !ok {
+			http.Error(w, "no capture running for agent", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) startCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AgentID == "" {
+		http.Error(w, "agent_id required", http.StatusBadRequest)
+		return
+	}
+
+	d := defaultCaptureDuration
+	if req.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxCaptureDuration {
+			http.Error(w, fmt.Sprintf("duration must be a positive duration up to %v", maxCaptureDuration), http.StatusBadRequest)
+			return
+		}
+	}
+	mb := req.MaxMB
+	if mb == 0 {
+		mb = defaultCaptureMB
+	}
+	if mb < 0 || mb > maxCaptureMB {
+		http.Error(w, fmt.Sprintf("max_mb must be between 1 and %d", maxCaptureMB), http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.tunnel.StartCapture(req.AgentID, d, int64(mb)<<20)
+	if err != nil {
+		h.captureError(w, err)
+		return
+	}
+	log.Printf("[API] Started capture of %s [%s]", req.AgentID, w.Header().Get("X-Request-ID"))
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (h *Handler) captureError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, tunnel.ErrCaptureDisabled):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, tunnel.ErrAgentNotConnected):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, tunnel.ErrCaptureActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeError(w, err)
+	}
+}
+
+// Capture downloads one capture file from /api/admin/captures/{file}
+func (h *Handler) Capture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/admin/captures/")
+	path, ok := h.tunnel.CapturePath(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, path)
+}
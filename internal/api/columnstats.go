@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	// columnStatsTTL bounds how long stats are served from cache. Lines
+	// with a line number invalidate them sooner, through the file's ingest
+	// watermark; lines without one only age them out.
+	columnStatsTTL     = 30 * time.Second
+	columnStatsTimeout = 10 * time.Second
+	// maxColumnStatsEntries caps the files kept in the cache
+	maxColumnStatsEntries = 1000
+)
+
+type columnStatsResponse struct {
+	*models.LogColumnStats
+	CacheAgeMs int64 `json:"cache_age_ms"`
+}
+
+// columnStatsEntry is one file's cached or in-flight stats; done is closed
+// once result and err are set
+type columnStatsEntry struct {
+	done   chan struct{}
+	result *models.LogColumnStats
+	err    error
+	at     time.Time
+	// The file's ingest watermark when the stats were computed
+	mark   db.IngestWatermark
+	marked bool
+}
+
+// columnStatsCache holds recent column stats by file. Concurrent requests
+// for the same file wait for a single computation.
+type columnStatsCache struct {
+	mu      sync.Mutex
+	entries map[string]*columnStatsEntry
+}
+
+func newColumnStatsCache() *columnStatsCache {
+	return &columnStatsCache{entries: make(map[string]*columnStatsEntry)}
+}
+
+func (c *columnStatsCache) get(path string, mark db.IngestWatermark, marked bool, compute func() (*models.LogColumnStats, error)) (*models.LogColumnStats, time.Time, error) {
+	c.mu.Lock()
+	e := c.entries[path]
+	if e != nil {
+		select {
+		case <-e.done:
+			if e.err != nil || time.Since(e.at) >= columnStatsTTL || e.mark != mark || e.marked != marked {
+				e = nil
+			}
+		default:
+		}
+	}
+	if e == nil {
+		c.evict()
+		e = &columnStatsEntry{done: make(chan struct{}), mark: mark, marked: marked}
+		c.entries[path] = e
+		c.mu.Unlock()
+
+		e.result, e.err = compute()
+		e.at = time.Now()
+		close(e.done)
+		return e.result, e.at, e.err
+	}
+	c.mu.Unlock()
+
+	<-e.done
+	return e.result, e.at, e.err
+}
+
+// evict makes room for a new entry, dropping expired entries first and
+// everything finished if that isn't enough. Callers hold mu.
+func (c *columnStatsCache) evict() {
+	if len(c.entries) < maxColumnStatsEntries {
+		return
+	}
+	for path, e := range c.entries {
+		select {
+		case <-e.done:
+			if time.Since(e.at) >= columnStatsTTL {
+				delete(c.entries, path)
+			}
+		default:
+		}
+	}
+	if len(c.entries) < maxColumnStatsEntries {
+		return
+	}
+	for path, e := range c.entries {
+		select {
+		case <-e.done:
+			delete(c.entries, path)
+		default:
+		}
+	}
+}
+
+// GetColumnStats returns aggregates of a file's current generation that a
+// log view uses to pick its columns: the highest line number, levels seen,
+// the first and newest timestamps, and the share of JSON lines and lines
+// with durations. Stats are cached until the file ingests new lines.
+func (h *Handler) GetColumnStats(w http.ResponseWriter, r *http.Request) {
+	filePath := paths.FromQuery(r, "file")
+	if filePath == "" {
+		http.Error(w, "file parameter required", http.StatusBadRequest)
+		return
+	}
+	filePath = paths.Normalize(filePath)
+
+	mark, marked := h.tunnel.IngestWatermark(filePath)
+	stats, at, err := h.columnStats.get(filePath, mark, marked, func() (*models.LogColumnStats, error) {
+		// Detached from the request, since the result is shared by every
+		// request waiting on the cache
+		ctx, cancel := context.WithTimeout(context.Background(), columnStatsTimeout)
+		defer cancel()
+		return h.db.LogColumnStats(ctx, filePath)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, columnStatsResponse{stats, time.Since(at).Milliseconds()})
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+func TestColumnStatsCacheSharesComputation(t *testing.T) {
+	c := newColumnStatsCache()
+	mark := db.IngestWatermark{Generation: 1, Line: 10}
+	release := make(chan struct{})
+	var computed atomic.Int32
+	compute := func() (*models.LogColumnStats, error) {
+		computed.Add(1)
+		<-release
+		return &models.LogColumnStats{MaxLineNumber: 10}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stats, _, err := c.get("/var/log/app.log", mark, true, compute)
+			if err != nil || stats.MaxLineNumber != 10 {
+				t.Errorf("stats = %+v, %v", stats, err)
+			}
+		}()
+	}
+	// Let every request reach the cache before the computation ends
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := computed.Load(); n != 1 {
+		t.Errorf("computed %d times for concurrent requests, want once", n)
+	}
+}
+
+func TestColumnStatsCacheInvalidation(t *testing.T) {
+	c := newColumnStatsCache()
+	var computed int
+	compute := func() (*models.LogColumnStats, error) {
+		computed++
+		return &models.LogColumnStats{MaxLineNumber: computed}, nil
+	}
+	const path = "/var/log/app.log"
+	mark := db.IngestWatermark{Generation: 1, Line: 10}
+
+	c.get(path, mark, true, compute)
+	if stats, _, _ := c.get(path, mark, true, compute); stats.MaxLineNumber != 1 || computed != 1 {
+		t.Fatalf("unchanged file recomputed %d times", computed)
+	}
+
+	// New lines move the watermark
+	mark.Line = 20
+	if stats, _, _ := c.get(path, mark, true, compute); stats.MaxLineNumber != 2 {
+		t.Errorf("stats after new lines = %+v, want recomputed", stats)
+	}
+	// As does truncation
+	mark = db.IngestWatermark{Generation: 2}
+	if stats, _, _ := c.get(path, mark, true, compute); stats.MaxLineNumber != 3 {
+		t.Errorf("stats after truncation = %+v, want recomputed", stats)
+	}
+
+	// Without a watermark the entry ages out
+	c.get(path, db.IngestWatermark{}, false, compute)
+	c.mu.Lock()
+	c.entries[path].at = time.Now().Add(-columnStatsTTL)
+	c.mu.Unlock()
+	if stats, _, _ := c.get(path, db.IngestWatermark{}, false, compute); stats.MaxLineNumber != 5 {
+		t.Errorf("stats past the TTL = %+v, want recomputed", stats)
+	}
+}
+
+func TestColumnStatsCacheDoesNotKeepErrors(t *testing.T) {
+	c := newColumnStatsCache()
+	fail := true
+	compute := func() (*models.LogColumnStats, error) {
+		if fail {
+			return nil, errors.New("database unavailable")
+		}
+		return &models.LogColumnStats{}, nil
+	}
+
+	if _, _, err := c.get("/var/log/app.log", db.IngestWatermark{}, false, compute); err == nil {
+		t.Fatal("no error from a failed computation")
+	}
+	fail = false
+	if _, _, err := c.get("/var/log/app.log", db.IngestWatermark{}, false, compute); err != nil {
+		t.Errorf("error kept after the database recovered: %v", err)
+	}
+}
+
+func TestColumnStatsCacheEvicts(t *testing.T) {
+	c := newColumnStatsCache()
+	compute := func() (*models.LogColumnStats, error) { return &models.LogColumnStats{}, nil }
+	for i := 0; i < 3*maxColumnStatsEntries; i++ {
+		c.get(fmt.Sprintf("/var/log/%d.log", i), db.IngestWatermark{}, false, compute)
+	}
+	if n := len(c.entries); n > maxColumnStatsEntries {
+		t.Errorf("cache holds %d files, want at most %d", n, maxColumnStatsEntries)
+	}
+}
+
+func TestGetColumnStatsRequiresFile(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Handler{}).GetColumnStats(w, httptest.NewRequest(http.MethodGet, "/api/logs/column-stats", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d without a file, want 400", w.Code)
+	}
+}
+
+func TestGetColumnStats(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	const path = "/var/log/columns.log"
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "columns.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.SaveLogs(ctx, []models.LogEntry{
+		{Filename: path, Line: "served in 5ms", LineNum: 1, Level: "INFO", Timestamp: now},
+		{Filename: path, Line: "served in 7ms", LineNum: 2, Level: "WARN", Timestamp: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetColumnStats(w, httptest.NewRequest(http.MethodGet, "/api/logs/column-stats?file="+path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var stats models.LogColumnStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.MaxLineNumber != 2 || len(stats.Levels) != 2 || stats.DurationShare != 1 {
+		t.Errorf("stats = %+v, want 2 lines at two levels, all with durations", stats)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetColumnStats(w, httptest.NewRequest(http.MethodGet, "/api/logs/column-stats?file=/var/log/missing.log", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown file: status %d, want 404", w.Code)
+	}
+}
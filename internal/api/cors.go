@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Headers browsers may send and read on cross-origin requests, besides the
+// ones CORS always allows
+const (
+	corsAllowHeaders  = "Authorization, Content-Type, X-Request-ID, X-Search-Session, traceparent, tracestate"
+	corsExposeHeaders = "X-Request-ID, X-Results-Truncated, X-Log-Sampling, X-Selected-Files"
+	corsMaxAge        = "600"
+)
+
+// corsPolicy is the set of origins a route answers cross-origin requests
+// from, with the methods they may use
+type corsPolicy struct {
+	any     bool
+	origins map[string]bool
+	methods map[string]bool
+	allow   string // methods, for Access-Control-Allow-Methods
+}
+
+// corsPolicy returns the route's policy, from CORS_ROUTES or else
+// CORS_ORIGINS, or nil when it sends no CORS headers. Operations that
+// require the admin token are never allowed cross-origin.
+func (h *Handler) corsPolicy(rt route) *corsPolicy {
+	origins := h.cfg.CORSOriginsFor(rt.path)
+	if len(origins) == 0 || rt.admin {
+		return nil
+	}
+
+	p := &corsPolicy{origins: make(map[string]bool), methods: make(map[string]bool)}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.any = true
+		}
+		p.origins[origin] = true
+	}
+	var allow []string
+	for _, op := range rt.ops {
+		if op.admin || p.methods[op.method] {
+			continue
+		}
+		p.methods[op.method] = true
+		allow = append(allow, op.method)
+	}
+	p.allow = strings.Join(allow, ", ")
+	return p
+}
+
+// withCORS answers preflight requests for the route and adds CORS headers
+// to responses for allowed origins. Other requests are served unchanged, so
+// browsers block reading them.
+func (p *corsPolicy) withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if origin != "" && (p.any || p.origins[origin]) {
+				p.setOrigin(w, origin)
+				w.Header().Set("Access-Control-Allow-Methods", p.allow)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if origin != "" && (p.any || p.origins[origin]) && p.methods[r.Method] {
+			p.setOrigin(w, origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next(w, r)
+	}
+}
+
+func (p *corsPolicy) setOrigin(w http.ResponseWriter, origin string) {
+	if p.any {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+}
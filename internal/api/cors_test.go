@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"diagnostic-client/internal/config"
+)
+
+func TestCORS(t *testing.T) {
+	rt := route{path: "/api/logs/search", handler: func(w http.ResponseWriter, r *http.Request) {}, ops: []apiOperation{
+		{method: http.MethodGet},
+		{method: http.MethodPost},
+		{method: http.MethodDelete, admin: true},
+	}}
+	tests := []struct {
+		name    string
+		origins []string
+		method  string
+		header  map[string]string
+		status  int
+		origin  string // Access-Control-Allow-Origin
+		methods string // Access-Control-Allow-Methods
+	}{
+		{name: "allowed origin echoed", origins: []string{"https://a.example"}, method: http.MethodGet,
+			header: map[string]string{"Origin": "https://a.example"}, status: http.StatusOK, origin: "https://a.example"},
+		{name: "other origin", origins: []string{"https://a.example"}, method: http.MethodGet,
+			header: map[string]string{"Origin": "https://b.example"}, status: http.StatusOK},
+		{name: "wildcard", origins: []string{"*"}, method: http.MethodGet,
+			header: map[string]string{"Origin": "https://b.example"}, status: http.StatusOK, origin: "*"},
+		{name: "preflight", origins: []string{"https://a.example"}, method: http.MethodOptions,
+			header: map[string]string{"Origin": "https://a.example", "Access-Control-Request-Method": "POST"},
+			status: http.StatusNoContent, origin: "https://a.example", methods: "GET, POST"},
+		{name: "preflight from other origin", origins: []string{"https://a.example"}, method: http.MethodOptions,
+			header: map[string]string{"Origin": "https://b.example", "Access-Control-Request-Method": "POST"}, status: http.StatusNoContent},
+		{name: "admin operation", origins: []string{"*"}, method: http.MethodDelete,
+			header: map[string]string{"Origin": "https://a.example"}, status: http.StatusOK},
+		{name: "not configured", method: http.MethodGet,
+			header: map[string]string{"Origin": "https://a.example"}, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{cfg: &config.Config{CORSOrigins: tt.origins}}
+			r := httptest.NewRequest(tt.method, rt.path, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			rt.serve(h)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.origin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tt.methods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.methods)
+			}
+			if tt.methods != "" && w.Header().Get("Access-Control-Allow-Headers") == "" {
+				t.Error("preflight without Access-Control-Allow-Headers")
+			}
+		})
+	}
+}
+
+func TestCORSOriginsForRoute(t *testing.T) {
+	rules, err := config.ParseCORSRules([]string{"/api/files=https://a.example|https://b.example", "/api/reports="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{CORSOrigins: []string{"*"}, CORSRoutes: rules}
+
+	if got := cfg.CORSOriginsFor("/api/files/pins"); len(got) != 2 {
+		t.Errorf("/api/files/pins origins = %v, want the rule's two", got)
+	}
+	if got := cfg.CORSOriginsFor("/api/reports"); len(got) != 0 {
+		t.Errorf("/api/reports origins = %v, want none", got)
+	}
+	if got := cfg.CORSOriginsFor("/api/logs/search"); len(got) != 1 || got[0] != "*" {
+		t.Errorf("/api/logs/search origins = %v, want CORS_ORIGINS", got)
+	}
+	if _, err := config.ParseCORSRules([]string{"/api/admin=*"}); err == nil {
+		t.Error("rule for admin endpoints accepted")
+	}
+}
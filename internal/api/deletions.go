@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type massDeletionAction struct {
+	Action string `json:"action"`
+}
+
+// MassDeletion shows (GET) or resolves (POST) file deletions held back
+// because one file list dropped an unusual number of files
+func (h *Handler) MassDeletion(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		pending := h.tunnel.PendingMassDeletion()
+		if pending == nil {
+			http.Error(w, "no deletion is held", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, pending)
+
+	case http.MethodPost:
+		var req massDeletionAction
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Action != "approve" && req.Action != "cancel" {
+			http.Error(w, "action must be approve or cancel", http.StatusBadRequest)
+			return
+		}
+
+		resolved, err := h.tunnel.ResolveMassDeletion(r.Context(), req.Action == "approve")
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if resolved == nil {
+			http.Error(w, "no deletion is held", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, resolved)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
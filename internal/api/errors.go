@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"diagnostic-client/internal/db"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Error codes of JSON error responses
+const (
+	codeNotFound            = "NOT_FOUND"
+	codeInvalidArgument     = "INVALID_ARGUMENT"
+	codeTooManyRows         = "TOO_MANY_ROWS"
+	codeTimeout             = "TIMEOUT"
+	codeDatabaseUnavailable = "DATABASE_UNAVAILABLE"
+	codeDatabaseError       = "DATABASE_ERROR"
+	codeInternalError       = "INTERNAL_ERROR"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorStatus maps an error from the db layer, or anything else a handler
+// failed with, to a status and error code
+func errorStatus(err error) (int, string) {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, db.ErrInvalidQuery):
+		return http.StatusBadRequest, codeInvalidArgument
+	case errors.Is(err, db.ErrTooManyRows):
+		return http.StatusUnprocessableEntity, codeTooManyRows
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, codeTimeout
+	case db.Unavailable(err):
+		return http.StatusServiceUnavailable, codeDatabaseUnavailable
+	case errors.As(err, &pgErr):
+		return http.StatusInternalServerError, codeDatabaseError
+	default:
+		return http.StatusInternalServerError, codeInternalError
+	}
+}
+
+// writeError responds with the status and code errorStatus maps err to
+func writeError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	if status >= http.StatusInternalServerError {
+		log.Printf("[API] %s: %v", code, err)
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error(), Code: code})
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"diagnostic-client/internal/db"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// refusedAddr returns an address nothing listens on
+func refusedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"not found", fmt.Errorf("get report 7: %w", db.ErrNotFound), http.StatusNotFound, codeNotFound},
+		{"invalid query", fmt.Errorf("%w: unknown sort key", db.ErrInvalidQuery), http.StatusBadRequest, codeInvalidArgument},
+		{"too many rows", fmt.Errorf("%w: 1000 files", db.ErrTooManyRows), http.StatusUnprocessableEntity, codeTooManyRows},
+		{"deadline", fmt.Errorf("search logs: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, codeTimeout},
+		{"failover gave up", fmt.Errorf("save logs: %w for 1m0s: %w", db.ErrUnavailable, errors.New("dial tcp: connection refused")), http.StatusServiceUnavailable, codeDatabaseUnavailable},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, http.StatusServiceUnavailable, codeDatabaseUnavailable},
+		{"constraint", fmt.Errorf("save annotation: %w", &pgconn.PgError{Code: "23505"}), http.StatusInternalServerError, codeDatabaseError},
+		{"other", errors.New("encode response"), http.StatusInternalServerError, codeInternalError},
+		// The client going away isn't the database's fault
+		{"cancelled", fmt.Errorf("query: %w", context.Canceled), http.StatusInternalServerError, codeInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code := errorStatus(tt.err)
+			if status != tt.status || code != tt.code {
+				t.Errorf("errorStatus(%v) = %d %s, want %d %s", tt.err, status, code, tt.status, tt.code)
+			}
+		})
+	}
+}
+
+func TestConnectionRefusedIsUnavailable(t *testing.T) {
+	ctx := context.Background()
+	url := "postgres://user:pass@" + refusedAddr(t) + "/diagnostics?connect_timeout=2"
+
+	_, connErr := pgx.Connect(ctx, url)
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	// A read through the pool, as handlers do, wrapped as db methods wrap it
+	_, queryErr := pool.Exec(ctx, "SELECT 1")
+
+	for _, err := range []error{connErr, fmt.Errorf("query file tree: %w", queryErr)} {
+		if err == nil {
+			t.Fatal("reached a database on a closed port")
+		}
+		if status, code := errorStatus(err); status != http.StatusServiceUnavailable || code != codeDatabaseUnavailable {
+			t.Errorf("errorStatus(%v) = %d %s, want 503 %s", err, status, code, codeDatabaseUnavailable)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, fmt.Errorf("save logs: %w", db.ErrUnavailable))
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || body.Code != codeDatabaseUnavailable {
+		t.Errorf("response = %d %v %+v, want 503 with Retry-After", w.Code, w.Header(), body)
+	}
+	if body.Error != "save logs: database unavailable" {
+		t.Errorf("error message = %q", body.Error)
+	}
+
+	w = httptest.NewRecorder()
+	writeError(w, db.ErrNotFound)
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNotFound || w.Header().Get("Retry-After") != "" || body.Code != codeNotFound {
+		t.Errorf("response = %d %v %+v, want a plain 404", w.Code, w.Header(), body)
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+// fileTreeAt is the file tree as it was at a past time
+type fileTreeAt struct {
+	AsOf time.Time `json:"as_of"`
+	// When file history starts; files last changed before then are missing.
+	// Omitted when nothing has been recorded yet.
+	HistorySince *time.Time `json:"history_since,omitempty"`
+	// Fields of files that are approximated or not known, with how
+	Approximations map[string]string `json:"approximations"`
+	Files          []models.FileNode `json:"files"`
+}
+
+var fileTreeApproximations = map[string]string{
+	"size":         "last recorded size; sizes are recorded when they change by 10% or more",
+	"mod_time":     "as of the last recorded size",
+	"last_seen":    "time of the last recorded change",
+	"is_scraped":   "not recorded",
+	"scrape_state": "not recorded",
+}
+
+// getFileTreeAt serves GetFiles with as_of, rebuilding the tree from file
+// history
+func (h *Handler) getFileTreeAt(w http.ResponseWriter, r *http.Request, path string, depth int, order db.FileOrder, asOf time.Time) {
+	files, err := h.db.GetFileTreeAt(r.Context(), path, depth, order, asOf)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	since, err := h.db.FileHistoryStart(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if files == nil {
+		files = []models.FileNode{}
+	}
+	writeJSON(w, http.StatusOK, fileTreeAt{
+		AsOf:           asOf,
+		HistorySince:   since,
+		Approximations: fileTreeApproximations,
+		Files:          files,
+	})
+}
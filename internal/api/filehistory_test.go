@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestGetFilesRejectsBadAsOf(t *testing.T) {
+	h := &Handler{}
+	for _, query := range []string{"as_of=yesterday", "as_of=2024-03-01", "as_of=2024-03-01T10:00:00Z&log_counts=true"} {
+		w := httptest.NewRecorder()
+		h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log&"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestGetFilesAsOfLabelsApproximations(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "file_history")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err := h.db.SaveFiles(ctx, []models.FileNode{
+		{Path: "/var/log", ParentPath: "/var", Name: "log", IsDirectory: true, ModTime: now, LastSeen: now, Generation: 1},
+		{Path: "/var/log/app.log", ParentPath: "/var/log", Name: "app.log", Size: 100, ModTime: now, LastSeen: now, Generation: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log&as_of="+now.Add(time.Minute).Format(time.RFC3339), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got fileTreeAt
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.HistorySince == nil || got.Approximations["size"] == "" || got.Approximations["is_scraped"] == "" {
+		t.Errorf("meta = since %v, approximations %v; want both", got.HistorySince, got.Approximations)
+	}
+	var found bool
+	for _, f := range got.Files {
+		found = found || (f.Path == "/var/log/app.log" && f.Size == 100)
+	}
+	if !found {
+		t.Errorf("files = %+v, want app.log at 100 bytes", got.Files)
+	}
+
+	// Before anything was recorded the tree is empty, not null
+	w = httptest.NewRecorder()
+	h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log&as_of=2000-01-01T00:00:00Z", nil))
+	var empty map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &empty); err != nil {
+		t.Fatal(err)
+	}
+	if string(empty["files"]) != "[]" {
+		t.Errorf("files before history = %s, want []", empty["files"])
+	}
+}
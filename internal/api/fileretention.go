@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+)
+
+type filePatch struct {
+	// Written like LOG_RETENTION; empty removes the override
+	Retention *string `json:"retention,omitempty"`
+	LegalHold *bool   `json:"legal_hold,omitempty"`
+}
+
+type filePatchResponse struct {
+	Path      string `json:"path"`
+	Retention string `json:"retention"`
+	LegalHold bool   `json:"legal_hold"`
+}
+
+// patchFile changes per-file settings: the log retention override and the
+// legal hold. Each change is logged with the request ID, which ties it to
+// the request log line naming the client.
+func (h *Handler) patchFile(w http.ResponseWriter, r *http.Request) {
+	path := paths.FromQuery(r, "path")
+	if path == "" {
+		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return
+	}
+	path = paths.Normalize(path)
+
+	var req filePatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Retention == nil && req.LegalHold == nil {
+		http.Error(w, "retention or legal_hold required", http.StatusBadRequest)
+		return
+	}
+
+	var retention time.Duration
+	if req.Retention != nil {
+		var err error
+		if retention, err = config.ParseRetention(*req.Retention); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	requestID := w.Header().Get("X-Request-ID")
+	if req.Retention != nil {
+		if !h.applyFilePatch(w, h.db.SetFileRetention(r.Context(), path, retention)) {
+			return
+		}
+		log.Printf("[API] Log retention of %s set to %q [%s]", path, config.FormatRetention(retention), requestID)
+	}
+	if req.LegalHold != nil {
+		if !h.applyFilePatch(w, h.db.SetFileLegalHold(r.Context(), path, *req.LegalHold)) {
+			return
+		}
+		if *req.LegalHold {
+			log.Printf("[API] Legal hold placed on %s [%s]", path, requestID)
+		} else {
+			log.Printf("[API] Legal hold lifted from %s [%s]", path, requestID)
+		}
+	}
+
+	settings, err := h.db.GetFileSettings(r.Context(), path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, filePatchResponse{
+		Path:      path,
+		Retention: config.FormatRetention(settings.Retention),
+		LegalHold: settings.LegalHold,
+	})
+}
+
+// applyFilePatch reports a failed settings change, returning whether it
+// succeeded
+func (h *Handler) applyFilePatch(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
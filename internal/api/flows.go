@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	defaultFlowsWindow    = time.Hour
+	defaultFlowsLimit     = 100
+	maxFlowsLimit         = 1000
+	defaultFlowsTolerance = 2 * time.Second
+	maxFlowsTolerance     = time.Minute
+)
+
+// GetNetworkFlows aggregates stored packets into flows by 5-tuple, combined
+// across agents, per agent, or with captures of one flow by both ends merged
+func (h *Handler) GetNetworkFlows(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	end := time.Now().UTC()
+	if es := q.Get("end"); es != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-defaultFlowsWindow)
+	if ss := q.Get("start"); ss != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "invalid start time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mode := db.FlowsCombined
+	switch q.Get("group_by") {
+	case "":
+	case "agent":
+		mode = db.FlowsByAgent
+	default:
+		http.Error(w, "group_by must be agent", http.StatusBadRequest)
+		return
+	}
+	if q.Get("dedup") == "true" {
+		if mode == db.FlowsByAgent {
+			http.Error(w, "dedup combines agents and can't be used with group_by=agent", http.StatusBadRequest)
+			return
+		}
+		mode = db.FlowsDedup
+	}
+
+	tolerance := defaultFlowsTolerance
+	if ts := q.Get("tolerance"); ts != "" {
+		var err error
+		tolerance, err = time.ParseDuration(ts)
+		if err != nil || tolerance < 0 || tolerance > maxFlowsTolerance {
+			http.Error(w, "tolerance must be a duration between 0 and 1m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultFlowsLimit
+	if ls := q.Get("limit"); ls != "" {
+		var err error
+		limit, err = strconv.Atoi(ls)
+		if err != nil || limit < 1 || limit > maxFlowsLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	flows, err := h.db.GetNetworkFlows(r.Context(), start, end, q["protocol"], mode, tolerance, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if flows == nil {
+		flows = []models.NetworkFlow{}
+	}
+
+	writeJSON(w, http.StatusOK, flows)
+}
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,38 +11,79 @@ import (
 	"strings"
 	"time"
 
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
 	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/jobs"
+	"diagnostic-client/internal/membudget"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/scheduler"
+	"diagnostic-client/internal/selector"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Handler struct {
-	db *db.DB
-}
-
-func NewHandler(db *db.DB) *Handler {
-	return &Handler{db: db}
+	cfg       *config.Config
+	db        *db.DB
+	tunnel    *tunnel.Handler
+	reports   *scheduler.CronRunner
+	budget    *membudget.Budget
+	searches  *searchRegistry
+	overviews *overviewCache
+	// Column stats of recently viewed files
+	columnStats *columnStatsCache
+	retention   *scheduler.Retention
+	jobs        *jobs.Scheduler
+	// OpenAPI document of the routes, generated by NewServer
+	openAPI []byte
+	clock   clock.Clock
 }
 
-func normalizePath(path string) string {
-	// Ensure path starts with /
-	if !strings.HasPrefix(path, "/") {
-		path = "/" + path
+func NewHandler(cfg *config.Config, db *db.DB, tunnel *tunnel.Handler, reports *scheduler.CronRunner, budget *membudget.Budget, retention *scheduler.Retention, jobs *jobs.Scheduler, clk clock.Clock) *Handler {
+	return &Handler{
+		cfg:         cfg,
+		db:          db,
+		tunnel:      tunnel,
+		reports:     reports,
+		budget:      budget,
+		searches:    newSearchRegistry(),
+		overviews:   newOverviewCache(),
+		columnStats: newColumnStatsCache(),
+		retention:   retention,
+		jobs:        jobs,
+		clock:       clk,
 	}
+}
 
-	// Remove trailing slash unless it's the root path
-	if path != "/" && strings.HasSuffix(path, "/") {
-		path = path[:len(path)-1]
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[API] Error encoding response: %v", err)
 	}
-
-	return path
 }
 
 // internal/api/handler.go
 func (h *Handler) GetFiles(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
+	if r.Method == http.MethodPatch {
+		h.requireAdmin(h.patchFile)(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("view") == "pinned" {
+		h.getPinnedRoots(w, r)
+		return
+	}
+
+	path := paths.FromQuery(r, "path")
 	if path == "" {
 		path = "/"
 	} else {
-		path = normalizePath(path)
+		path = paths.Normalize(path)
 	}
 
 	// Get depth from query params, default to 1 if not specified
@@ -56,81 +99,545 @@ func (h *Handler) GetFiles(w http.ResponseWriter, r *http.Request) {
 		depth = 10
 	}
 
+	order, err := parseFileOrder(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s := r.URL.Query().Get("as_of"); s != "" {
+		asOf, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid as_of time", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("log_counts") == "true" {
+			http.Error(w, "log_counts can't be combined with as_of", http.StatusBadRequest)
+			return
+		}
+		h.getFileTreeAt(w, r, path, depth, order, asOf)
+		return
+	}
+
 	log.Printf("[API] Getting file tree for path: %s with depth: %d", path, depth)
 
-	files, err := h.db.GetFileTree(r.Context(), path, depth)
+	// The tree is written as it is read. The first chunk is read before
+	// anything is sent, so failures up to there, such as a bad sort key or
+	// an unreachable database, are answered as usual. With log_counts the
+	// whole tree, limited to MaxLogCountPaths files, is counted first.
+	logCounts := r.URL.Query().Get("log_counts") == "true"
+	out := newJSONArrayWriter(w)
+	send := func(files []models.FileNode) error {
+		for _, f := range files {
+			if err := out.write(f); err != nil {
+				return err
+			}
+		}
+		return out.flush()
+	}
+	var counted []models.FileNode
+	err = h.db.StreamFileTree(r.Context(), path, depth, order, func(files []models.FileNode) error {
+		h.annotateSampling(files)
+		if logCounts {
+			counted = append(counted, files...)
+			return nil
+		}
+		return send(files)
+	})
+	if err == nil && logCounts {
+		if err = h.annotateLogCounts(r.Context(), counted); err == nil {
+			err = send(counted)
+		}
+	}
 	if err != nil {
-		log.Printf("[API] Error getting file tree: %v", err)
-		http.Error(w, fmt.Sprintf("Error getting file tree: %v", err), http.StatusInternalServerError)
+		if !out.started() {
+			writeError(w, fmt.Errorf("get file tree: %w", err))
+			return
+		}
+		// Part of the array is out. Cutting the connection leaves the client
+		// with invalid JSON rather than a tree that looks complete.
+		log.Printf("[API] Aborting file tree for path %s after %d files: %v", path, out.n, err)
+		panic(http.ErrAbortHandler)
+	}
+	if err := out.close(); err != nil {
+		log.Printf("[API] Error encoding response: %v", err)
 		return
 	}
 
-	if len(files) == 0 {
-		// Return empty array instead of null
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte("[]"))
+	log.Printf("[API] Found %d files at path: %s", out.n, path)
+}
+
+// annotateLogCounts sets the stored line count of every file in the tree in
+// one query; directories are left without one
+func (h *Handler) annotateLogCounts(ctx context.Context, files []models.FileNode) error {
+	var leaves []string
+	for _, f := range files {
+		if !f.IsDirectory {
+			leaves = append(leaves, f.Path)
+		}
+	}
+
+	counts, err := h.db.GetLogCountsByFile(ctx, leaves)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if !files[i].IsDirectory {
+			n := counts[files[i].Path]
+			files[i].LogCount = &n
+		}
+	}
+	return nil
+}
+
+// parseFileOrder reads the sort, order, dirs_first, limit and offset
+// parameters of a file listing. Sort keys are checked by the database.
+func parseFileOrder(r *http.Request) (db.FileOrder, error) {
+	q := r.URL.Query()
+	order := db.FileOrder{Sort: q.Get("sort"), DirsFirst: true}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		order.Desc = true
+	default:
+		return order, errors.New("order must be asc or desc")
+	}
+
+	if v := q.Get("dirs_first"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return order, errors.New("dirs_first must be true or false")
+		}
+		order.DirsFirst = b
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"limit", &order.Limit}, {"offset", &order.Offset}} {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return order, fmt.Errorf("%s must be an integer", p.name)
+			}
+			*p.dst = n
+		}
+	}
+
+	return order, nil
+}
+
+// getPinnedRoots returns the pinned paths as a virtual top level
+func (h *Handler) getPinnedRoots(w http.ResponseWriter, r *http.Request) {
+	roots, err := h.db.GetPinnedRoots(r.Context(), h.cfg.PinnedPaths)
+	if err != nil {
+		log.Printf("[API] Error getting pinned roots: %v", err)
+		http.Error(w, fmt.Sprintf("Error getting pinned roots: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if roots == nil {
+		roots = []models.PinnedRoot{}
+	}
 
-	log.Printf("[API] Found %d files at path: %s", len(files), path)
+	writeJSON(w, http.StatusOK, roots)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(files); err != nil {
-		log.Printf("[API] Error encoding response: %v", err)
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+// FilePins lists (GET) or replaces (PUT) the pinned paths. Pins from the
+// PINNED_PATHS config are always included and can't be removed here.
+func (h *Handler) FilePins(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stored, err := h.db.GetFilePins(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeFilePins(w, h.cfg.PinnedPaths, stored)
+
+	case http.MethodPut:
+		var pins []string
+		if err := json.NewDecoder(r.Body).Decode(&pins); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stored := make([]string, 0, len(pins))
+		for _, p := range pins {
+			if p = strings.TrimSpace(p); p != "" {
+				stored = append(stored, paths.Normalize(p))
+			}
+		}
+
+		if err := h.db.SetFilePins(r.Context(), stored); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeFilePins(w, h.cfg.PinnedPaths, stored)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeFilePins(w http.ResponseWriter, configured, stored []string) {
+	if configured == nil {
+		configured = []string{}
+	}
+	if stored == nil {
+		stored = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"configured": configured,
+		"pinned":     stored,
+	})
+}
+
+type scrapeRequest struct {
+	Path            string `json:"path"`
+	ForceDecompress bool   `json:"force_decompress"`
+}
+
+// ScrapeFile asks connected agents to scrape a file. Gzipped files may be
+// forced to decompress up to the configured size cap.
+func (h *Handler) ScrapeFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req scrapeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "path required", http.StatusBadRequest)
+		return
+	}
+	req.Path = paths.Normalize(req.Path)
+
+	file, err := h.db.GetFileByPath(r.Context(), req.Path)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if req.ForceDecompress && file.IsGzipped && file.Size > h.cfg.MaxDecompressSize {
+		http.Error(w, fmt.Sprintf("file size %d exceeds decompression cap of %d bytes",
+			file.Size, h.cfg.MaxDecompressSize), http.StatusConflict)
+		return
+	}
+
+	cmd := tunnel.ScrapeCommand{Path: file.Path, AfterLine: h.tunnel.IngestedLine(file.Path, file.Generation)}
+	if req.ForceDecompress && file.IsGzipped {
+		cmd.ForceDecompress = true
+		cmd.MaxSize = h.cfg.MaxDecompressSize
+	}
+
+	sent, err := h.tunnel.SendCommand(tunnel.TypeScrape, cmd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if sent == 0 {
+		http.Error(w, "no agents connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	if cmd.ForceDecompress {
+		if err := h.db.UpdateScrapeState(r.Context(), file.Path, models.ScrapeStatePendingDecompress); err != nil {
+			log.Printf("[API] Error updating scrape state of %s: %v", file.Path, err)
+		}
+	}
+
+	op := h.tunnel.StartOperation("scrape", file.Path, sent)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":       "requested",
+		"agents":       sent,
+		"operation_id": op.ID,
+	})
+}
+
+// GetOperation reports the progress of a command such as a scrape, from
+// pending through ingesting to complete
+func (h *Handler) GetOperation(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/operations/")
+	if id == "" {
+		http.Error(w, "operation id required", http.StatusBadRequest)
 		return
 	}
+
+	op, ok := h.tunnel.Operation(id)
+	if !ok {
+		http.Error(w, "operation not found or expired", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, op)
+}
+
+// defaultLogsLimit is the page size of GET /api/logs without limit
+const defaultLogsLimit = 100
+
+// parseLogsLimit reads the page size of GET /api/logs, up to
+// db.MaxFilterLimit, and writes a 400 when it's invalid
+func parseLogsLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	ls := r.URL.Query().Get("limit")
+	if ls == "" {
+		return defaultLogsLimit, true
+	}
+	limit, err := strconv.Atoi(ls)
+	if err != nil || limit < 1 || limit > db.MaxFilterLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", db.MaxFilterLimit), http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
 }
 
 func (h *Handler) GetLogs(w http.ResponseWriter, r *http.Request) {
-	filePath := r.URL.Query().Get("file")
+	filePath := paths.FromQuery(r, "file")
 	if filePath == "" {
 		http.Error(w, "file parameter required", http.StatusBadRequest)
 		return
 	}
+	limit, ok := parseLogsLimit(w, r)
+	if !ok {
+		return
+	}
+	sel, err := selector.Parse(filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sel.Kind() != selector.Exact {
+		h.getSelectedLogs(w, r, sel, limit)
+		return
+	}
+	filePath = paths.Normalize(sel.Literal())
 
-	beforeStr := r.URL.Query().Get("before")
-	before := time.Now()
-	if beforeStr != "" {
-		var err error
-		before, err = time.Parse(time.RFC3339, beforeStr)
+	// Lines from before the file was last truncated are hidden unless asked
+	// for, since their line numbers overlap the current ones
+	generation := db.AllGenerations
+	file, err := h.db.GetFileByPath(r.Context(), filePath)
+	if err == nil {
+		generation = file.Generation
+
+		// Gzipped files skipped by the agent have no logs; say why instead of
+		// returning an empty page
+		if file.ScrapeState == models.ScrapeStateSkippedTooLarge {
+			http.Error(w, fmt.Sprintf(
+				"file not scraped: gzipped file too large to decompress (%d bytes); request a forced scrape via POST /api/files/scrape",
+				file.Size), http.StatusConflict)
+			return
+		}
+	}
+	switch g := r.URL.Query().Get("generation"); g {
+	case "":
+	case "all":
+		generation = db.AllGenerations
+	default:
+		generation, err = strconv.Atoi(g)
+		if err != nil || generation < 0 {
+			http.Error(w, "invalid generation", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.db.GetLogs(r.Context(), filePath, r.URL.Query().Get("cursor"), limit, generation)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// GetLogEntry returns a single log entry by ID for permalinks, with up to
+// `context` surrounding lines from the same file
+func (h *Handler) GetLogEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/logs/entry/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid log entry id", http.StatusBadRequest)
+		return
+	}
+
+	contextLines := 0
+	if contextStr := r.URL.Query().Get("context"); contextStr != "" {
+		contextLines, err = strconv.Atoi(contextStr)
+		if err != nil || contextLines < 0 {
+			http.Error(w, "invalid context", http.StatusBadRequest)
+			return
+		}
+	}
+	if contextLines > 100 {
+		contextLines = 100
+	}
+
+	entry, err := h.db.GetLogEntry(r.Context(), id)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "log entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result := models.LogContext{
+		Entry:  *entry,
+		Before: []models.LogEntry{},
+		After:  []models.LogEntry{},
+	}
+	if contextLines > 0 {
+		allGenerations := r.URL.Query().Get("generation") == "all"
+		before, after, err := h.db.GetLogContext(r.Context(), entry, contextLines, allGenerations)
 		if err != nil {
-			http.Error(w, "invalid before time", http.StatusBadRequest)
+			writeError(w, err)
+			return
+		}
+		if before != nil {
+			result.Before = before
+		}
+		if after != nil {
+			result.After = after
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GetStaleLogs lists files that stopped logging, since a silent source can
+// matter as much as one full of errors
+func (h *Handler) GetStaleLogs(w http.ResponseWriter, r *http.Request) {
+	olderThan := 10 * time.Minute
+	if s := r.URL.Query().Get("older_than"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid older_than duration", http.StatusBadRequest)
 			return
 		}
+		olderThan = d
 	}
 
-	logs, err := h.db.GetLogs(r.Context(), filePath, before, 100)
+	stale, err := h.db.GetStaleLogFiles(r.Context(), olderThan, 1000)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(logs)
+	writeJSON(w, http.StatusOK, stale)
+}
+
+type searchRequest struct {
+	RequestID     string    `json:"request_id"`
+	SearchSession string    `json:"search_session"`
+	Query         string    `json:"query"`
+	Files         []string  `json:"files"`
+	StartTime     time.Time `json:"start_time"`
+	EndTime       time.Time `json:"end_time"`
 }
 
 func (h *Handler) SearchLogs(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Query     string    `json:"query"`
-		Files     []string  `json:"files"`
-		StartTime time.Time `json:"start_time"`
-		EndTime   time.Time `json:"end_time"`
-	}
+	var req searchRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	logs, err := h.db.SearchLogs(r.Context(), req.Query, req.Files, req.StartTime, req.EndTime)
+	ctx := r.Context()
+	// A newer search in the same session supersedes this one, so searches
+	// fired while typing don't pile up in the database
+	if req.SearchSession == "" {
+		req.SearchSession = r.Header.Get("X-Search-Session")
+	}
+	if req.RequestID != "" || req.SearchSession != "" {
+		var done func()
+		ctx, done = h.searches.register(ctx, req.RequestID, req.SearchSession)
+		defer done()
+		span := trace.SpanFromContext(ctx)
+		if req.RequestID != "" {
+			span.SetAttributes(attribute.String("search.request_id", req.RequestID))
+		}
+		if req.SearchSession != "" {
+			span.SetAttributes(attribute.String("search.session", req.SearchSession))
+		}
+	}
+
+	files, err := h.resolveFiles(ctx, req.Files)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.searchFailed(ctx, w, r, err)
+		return
+	}
+	setSelectedFiles(w, files)
+	if files != nil && len(files) == 0 {
+		writeJSON(w, http.StatusOK, []models.LogEntry{})
 		return
 	}
 
+	logs, truncated, err := h.db.SearchLogs(ctx, req.Query, files, req.StartTime, req.EndTime)
+	if err != nil {
+		h.searchFailed(ctx, w, r, err)
+		return
+	}
+
+	// A file had more lines in the window than MAX_FILE_QUERY_ROWS, so only
+	// its newest ones were searched
+	if truncated {
+		w.Header().Set("X-Results-Truncated", "true")
+	}
+	if sampling := h.resultSampling(logs); sampling != "" {
+		w.Header().Set("X-Log-Sampling", sampling)
+	}
 	json.NewEncoder(w).Encode(logs)
 }
 
+// searchFailed reports a failed search, as 499 when it was cancelled or
+// superseded rather than abandoned by the client, else like writeError
+func (h *Handler) searchFailed(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(ctx.Err(), context.Canceled) && r.Context().Err() == nil {
+		http.Error(w, "search cancelled", statusClientClosedRequest)
+		return
+	}
+	writeError(w, err)
+}
+
+type cancelSearchRequest struct {
+	RequestID string `json:"request_id"`
+}
+
+// CancelSearch aborts an in-flight search started with the given request_id
+func (h *Handler) CancelSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req cancelSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RequestID == "" {
+		http.Error(w, "request_id required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.searches.cancel(req.RequestID) {
+		http.Error(w, "no search in progress for request_id", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[API] Cancelled search %s", req.RequestID)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled"})
+}
+
 func (h *Handler) GetNetworkMetrics(w http.ResponseWriter, r *http.Request) {
 	var startTime, endTime time.Time
 	var err error
@@ -157,9 +664,242 @@ func (h *Handler) GetNetworkMetrics(w http.ResponseWriter, r *http.Request) {
 
 	packets, err := h.db.GetNetworkPackets(r.Context(), startTime, endTime, protocols)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	json.NewEncoder(w).Encode(packets)
 }
+
+// Defaults and bounds of the network statistics endpoints
+const (
+	defaultNetworkStatsWindow = time.Hour
+	defaultTopNetworkLimit    = 10
+	maxTopNetworkLimit        = 100
+)
+
+// parseNetworkRange reads start and end, defaulting to the hour before now,
+// and writes a 400 when they're invalid
+func parseNetworkRange(w http.ResponseWriter, r *http.Request, now time.Time) (time.Time, time.Time, bool) {
+	q := r.URL.Query()
+
+	end := now.UTC()
+	if es := q.Get("end"); es != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	start := end.Add(-defaultNetworkStatsWindow)
+	if ss := q.Get("start"); ss != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "invalid start time", http.StatusBadRequest)
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	if !start.Before(end) {
+		http.Error(w, "start must be before end", http.StatusBadRequest)
+		return time.Time{}, time.Time{}, false
+	}
+	return start, end, true
+}
+
+// GetNetworkStats returns packet, byte and protocol totals of stored packets
+// between start and end, with the newest packets
+func (h *Handler) GetNetworkStats(w http.ResponseWriter, r *http.Request) {
+	start, end, ok := parseNetworkRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
+
+	stats, err := h.db.GetNetworkPacketsWithStats(r.Context(), start, end, r.URL.Query()["protocol"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if stats.Packets == nil {
+		stats.Packets = []models.NetworkPacket{}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// GetTopNetworkStats ranks the busiest sources, destinations, protocols and
+// ports between start and end by packet count
+func (h *Handler) GetTopNetworkStats(w http.ResponseWriter, r *http.Request) {
+	start, end, ok := parseNetworkRange(w, r, h.clock.Now())
+	if !ok {
+		return
+	}
+
+	limit := defaultTopNetworkLimit
+	if ls := r.URL.Query().Get("limit"); ls != "" {
+		var err error
+		limit, err = strconv.Atoi(ls)
+		if err != nil || limit < 1 || limit > maxTopNetworkLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxTopNetworkLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats, err := h.db.GetTopNetworkStats(r.Context(), start, end, r.URL.Query()["protocol"], limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// GetPacketRate returns packets and bytes per second. The live rate over the
+// last `window` comes from memory and is cheap to poll; an explicit start and
+// end are answered from the database.
+func (h *Handler) GetPacketRate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	byAgent := false
+	switch q.Get("group_by") {
+	case "":
+	case "agent":
+		byAgent = true
+	default:
+		http.Error(w, "group_by must be agent", http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("start") == "" && q.Get("end") == "" {
+		if byAgent {
+			http.Error(w, "group_by=agent requires start", http.StatusBadRequest)
+			return
+		}
+		window := 10 * time.Second
+		if ws := q.Get("window"); ws != "" {
+			var err error
+			window, err = time.ParseDuration(ws)
+			if err != nil || window < time.Second || window > 5*time.Minute {
+				http.Error(w, "window must be a duration between 1s and 5m", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, h.tunnel.PacketRate(window))
+		return
+	}
+
+	start, err := time.Parse(time.RFC3339, q.Get("start"))
+	if err != nil {
+		http.Error(w, "invalid start time", http.StatusBadRequest)
+		return
+	}
+	end := h.clock.Now()
+	if es := q.Get("end"); es != "" {
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rate, err := h.db.GetPacketRate(r.Context(), start, end, byAgent)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rate)
+}
+
+// GetThroughput returns agent message and byte rates by message type and by
+// agent over the last `window`, from memory
+func (h *Handler) GetThroughput(w http.ResponseWriter, r *http.Request) {
+	window := 10 * time.Second
+	if ws := r.URL.Query().Get("window"); ws != "" {
+		var err error
+		window, err = time.ParseDuration(ws)
+		if err != nil || window < time.Second || window > 5*time.Minute {
+			http.Error(w, "window must be a duration between 1s and 5m", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, h.tunnel.MessageThroughput(window))
+}
+
+type agentSummary struct {
+	Mode      string     `json:"mode"`
+	Connected int        `json:"connected"`
+	Reported  int        `json:"reported"`
+	Since     *time.Time `json:"since,omitempty"`
+}
+
+// GetAgentSummary contrasts the agents currently connected with the agents
+// that have reported data since an optional start time (default: ever)
+func (h *Handler) GetAgentSummary(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid since time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	reported, err := h.db.CountDistinctAgents(r.Context(), since)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	summary := agentSummary{Mode: h.mode(), Connected: h.tunnel.ConnectedAgents(), Reported: reported}
+	if !since.IsZero() {
+		summary.Since = &since
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// GetIngestStats reports counters for adjustments made to ingested data and
+// for database failovers that held ingest back
+func (h *Handler) GetIngestStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ingestStats{h.mode(), h.tunnel.IngestStats(), h.db.FailoverStats()})
+}
+
+type ingestStats struct {
+	// A read-only server ingests nothing, so its counters stay zero
+	Mode string `json:"mode"`
+	tunnel.IngestStats
+	Failover db.FailoverStats `json:"failover"`
+}
+
+// GetMemoryStats reports estimated ingest buffer usage against the memory
+// ceiling along with shed counters per buffer
+func (h *Handler) GetMemoryStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.budget.Stats())
+}
+
+// healthTimeout bounds the database check of a health probe
+const healthTimeout = 2 * time.Second
+
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health answers liveness and readiness probes: 200 while every database
+// shard answers a ping, else 503 with the error
+func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	if err := h.db.Ping(ctx); err != nil {
+		log.Printf("[API] Health check failed: %v", err)
+		writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
@@ -0,0 +1,720 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+func TestParseNetworkRange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		query      string
+		start, end time.Time
+		status     int
+	}{
+		{name: "default", start: now.Add(-time.Hour), end: now, status: http.StatusOK},
+		{name: "end only", query: "end=2024-01-01T06:00:00Z", start: now.Add(-7 * time.Hour), end: now.Add(-6 * time.Hour), status: http.StatusOK},
+		{name: "both", query: "start=2024-01-01T00:00:00Z&end=2024-01-01T01:00:00Z", start: now.Add(-12 * time.Hour), end: now.Add(-11 * time.Hour), status: http.StatusOK},
+		{name: "bad start", query: "start=yesterday", status: http.StatusBadRequest},
+		{name: "bad end", query: "end=now", status: http.StatusBadRequest},
+		{name: "reversed", query: "start=2024-01-01T02:00:00Z&end=2024-01-01T01:00:00Z", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/network/stats?"+tt.query, nil)
+			start, end, ok := parseNetworkRange(w, r, now)
+			if ok != (tt.status == http.StatusOK) || w.Code != tt.status {
+				t.Fatalf("ok = %v, status %d; want status %d", ok, w.Code, tt.status)
+			}
+			if ok && (!start.Equal(tt.start) || !end.Equal(tt.end)) {
+				t.Errorf("range = %v to %v, want %v to %v", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestGetTopNetworkStatsFiltersProtocol(t *testing.T) {
+	h, _ := newTestHandler(t, "network_packets")
+	now := time.Now().UTC().Truncate(time.Second)
+	h.clock = clock.NewFake(now)
+
+	var packets []models.NetworkPacket
+	for i, protocol := range []string{"TCP", "TCP", "UDP"} {
+		packets = append(packets, models.NetworkPacket{
+			Timestamp: now.Add(-time.Duration(i+1) * time.Minute),
+			Protocol:  protocol,
+			SrcIP:     "10.0.0.1",
+			DstIP:     "10.0.0.2",
+			DstPort:   53,
+		})
+	}
+	// Outside the default hour before the clock's now
+	packets = append(packets, models.NetworkPacket{Timestamp: now.Add(-2 * time.Hour), Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2"})
+	if err := h.db.SaveNetworkPackets(context.Background(), packets); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetTopNetworkStats(w, httptest.NewRequest(http.MethodGet, "/api/network/top?protocol=UDP", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var stats models.TopNetworkStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.TopProtocols) != 1 || stats.TopProtocols["UDP"] != 1 {
+		t.Errorf("top protocols = %v, want UDP: 1", stats.TopProtocols)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetTopNetworkStats(w, httptest.NewRequest(http.MethodGet, "/api/network/top", nil))
+	stats = models.TopNetworkStats{}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.TopProtocols["TCP"] != 2 || stats.TopProtocols["UDP"] != 1 {
+		t.Errorf("top protocols = %v, want TCP: 2, UDP: 1", stats.TopProtocols)
+	}
+}
+
+func TestGetNetworkStats(t *testing.T) {
+	h, _ := newTestHandler(t, "network_packets")
+	now := time.Now().UTC().Truncate(time.Second)
+	h.clock = clock.NewFake(now)
+
+	get := func(target string) models.NetworkStats {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.GetNetworkStats(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d %s", target, w.Code, w.Body)
+		}
+		var stats models.NetworkStats
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	// Nothing captured yet is zeroed stats rather than an error
+	stats := get("/api/network/stats")
+	if stats.PacketCount != 0 || stats.TotalBytes != 0 || stats.AvgPacketSize != 0 {
+		t.Errorf("stats of no packets = %+v, want zeroes", stats)
+	}
+	if stats.ProtocolStats == nil || len(stats.ProtocolStats) != 0 || stats.Packets == nil || len(stats.Packets) != 0 {
+		t.Errorf("stats of no packets = %+v, want empty protocols and packets", stats)
+	}
+
+	var packets []models.NetworkPacket
+	for i, protocol := range []string{"TCP", "TCP", "TCP", "UDP", "ICMP"} {
+		packets = append(packets, models.NetworkPacket{
+			Timestamp: now.Add(-time.Duration(i+1) * time.Minute),
+			Protocol:  protocol,
+			SrcIP:     "10.0.0." + strconv.Itoa(i%2+1),
+			DstIP:     "10.0.1.1",
+			Length:    100,
+		})
+	}
+	// Outside the default hour before now
+	packets = append(packets, models.NetworkPacket{Timestamp: now.Add(-2 * time.Hour), Protocol: "TCP", SrcIP: "10.0.0.9", DstIP: "10.0.1.1", Length: 100})
+	if err := h.db.SaveNetworkPackets(context.Background(), packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// Per-protocol counts don't multiply the totals
+	stats = get("/api/network/stats")
+	if stats.PacketCount != 5 || stats.TotalBytes != 500 || stats.AvgPacketSize != 100 {
+		t.Errorf("totals = %d packets, %d bytes, %v average; want 5, 500, 100", stats.PacketCount, stats.TotalBytes, stats.AvgPacketSize)
+	}
+	if stats.UniqueSources != 2 || stats.UniqueDestinations != 1 || stats.ProtocolCount != 3 {
+		t.Errorf("stats = %+v, want 2 sources, 1 destination, 3 protocols", stats)
+	}
+	if stats.ProtocolStats["TCP"] != 3 || stats.ProtocolStats["UDP"] != 1 || stats.ProtocolStats["ICMP"] != 1 {
+		t.Errorf("protocol stats = %v, want TCP: 3, UDP: 1, ICMP: 1", stats.ProtocolStats)
+	}
+
+	stats = get("/api/network/stats?protocol=UDP&protocol=ICMP")
+	if stats.PacketCount != 2 || len(stats.ProtocolStats) != 2 || stats.ProtocolStats["TCP"] != 0 {
+		t.Errorf("UDP and ICMP stats = %+v, want their 2 packets", stats)
+	}
+
+	start := now.Add(-3 * time.Hour).Format(time.RFC3339)
+	stats = get("/api/network/stats?start=" + url.QueryEscape(start) + "&end=" + url.QueryEscape(now.Format(time.RFC3339)))
+	if stats.PacketCount != 6 || stats.ProtocolStats["TCP"] != 4 {
+		t.Errorf("stats over 3 hours = %+v, want all 6 packets", stats)
+	}
+}
+
+func TestGetLogEntryRejectsBadRequests(t *testing.T) {
+	h := &Handler{}
+	for _, target := range []string{"/api/logs/entry/abc", "/api/logs/entry/", "/api/logs/entry/12?context=-1", "/api/logs/entry/12?context=x"} {
+		w := httptest.NewRecorder()
+		h.GetLogEntry(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestLogEntryPermalinkRoundTrip(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	const path = "/var/log/permalink.log"
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "permalink.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	var logs []models.LogEntry
+	for i, line := range []string{"starting worker", "worker crashed with code 3", "restarting worker"} {
+		logs = append(logs, models.LogEntry{Filename: path, Line: line, LineNum: i + 1, Timestamp: now.Add(time.Duration(i-3) * time.Second)})
+	}
+	if err := h.db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.SearchLogs(w, httptest.NewRequest(http.MethodPost, "/api/logs/search",
+		strings.NewReader(`{"query": "crashed", "files": ["`+path+`"]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("search status %d: %s", w.Code, w.Body)
+	}
+	var found []models.LogEntry
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID == 0 {
+		t.Fatalf("search found %+v, want one line with an id", found)
+	}
+	permalink := "/api/logs/entry/" + strconv.FormatInt(found[0].ID, 10)
+
+	w = httptest.NewRecorder()
+	h.GetLogEntry(w, httptest.NewRequest(http.MethodGet, permalink+"?context=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("entry status %d: %s", w.Code, w.Body)
+	}
+	var entry models.LogContext
+	if err := json.NewDecoder(w.Body).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Entry.ID != found[0].ID || entry.Entry.Line != "worker crashed with code 3" {
+		t.Errorf("entry = %+v, want the searched line", entry.Entry)
+	}
+	if len(entry.Before) != 1 || entry.Before[0].LineNum != 1 || len(entry.After) != 1 || entry.After[0].LineNum != 3 {
+		t.Errorf("context = %+v before, %+v after; want lines 1 and 3", entry.Before, entry.After)
+	}
+
+	// Deleting the file takes its lines with it
+	if err := h.db.DeleteFiles(ctx, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.GetLogEntry(w, httptest.NewRequest(http.MethodGet, permalink, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleted entry: status %d, want 404", w.Code)
+	}
+}
+
+func TestGzippedFileResponses(t *testing.T) {
+	h, tun := newTestHandler(t, "files", "logs")
+	h.cfg.MaxDecompressSize = 1 << 20
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	files := []models.FileNode{
+		{Path: "/var/log/small.log.gz", ParentPath: "/var/log", Name: "small.log.gz", Size: 1 << 10, ModTime: now, IsGzipped: true, ScrapeState: models.ScrapeStateSkippedTooLarge},
+		{Path: "/var/log/huge.log.gz", ParentPath: "/var/log", Name: "huge.log.gz", Size: 1 << 30, ModTime: now, IsGzipped: true, ScrapeState: models.ScrapeStateSkippedTooLarge},
+	}
+	if err := h.db.SaveFiles(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log", nil))
+	if !strings.Contains(w.Body.String(), `"scrape_state":"skipped_too_large"`) {
+		t.Errorf("file tree lacks the scrape state: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetLogs(w, httptest.NewRequest(http.MethodGet, "/api/logs?file=/var/log/small.log.gz", nil))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "too large to decompress") {
+		t.Errorf("logs of a skipped file: status %d %q, want 409 with the reason", w.Code, w.Body)
+	}
+
+	scrape := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ScrapeFile(w, httptest.NewRequest(http.MethodPost, "/api/files/scrape", strings.NewReader(body)))
+		return w
+	}
+	if w := scrape(`{"path": "/var/log/huge.log.gz", "force_decompress": true}`); w.Code != http.StatusConflict {
+		t.Errorf("forced scrape over the cap: status %d, want 409", w.Code)
+	}
+	if w := scrape(`{"path": "/var/log/missing.log.gz", "force_decompress": true}`); w.Code != http.StatusNotFound {
+		t.Errorf("scrape of an unknown file: status %d, want 404", w.Code)
+	}
+	if w := scrape(`{"path": "/var/log/small.log.gz", "force_decompress": true}`); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("scrape without agents: status %d, want 503", w.Code)
+	}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go tun.HandleConnection(connCtx, server)
+	commands := make(chan tunnel.Message, 1)
+	go func() {
+		decoder := json.NewDecoder(agent)
+		for {
+			var msg tunnel.Message
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+			if msg.Type == tunnel.TypeScrape {
+				commands <- msg
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for tun.ConnectedAgents() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := scrape(`{"path": "/var/log/small.log.gz", "force_decompress": true}`); w.Code != http.StatusAccepted {
+		t.Fatalf("forced scrape: status %d %q, want 202", w.Code, w.Body)
+	}
+	select {
+	case msg := <-commands:
+		var cmd tunnel.ScrapeCommand
+		if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if !cmd.ForceDecompress || cmd.MaxSize != 1<<20 {
+			t.Errorf("scrape command = %+v, want forced decompression up to 1 MiB", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no scrape command sent")
+	}
+	file, err := h.db.GetFileByPath(ctx, "/var/log/small.log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ScrapeState != models.ScrapeStatePendingDecompress {
+		t.Errorf("scrape state after a forced scrape = %q, want %q", file.ScrapeState, models.ScrapeStatePendingDecompress)
+	}
+}
+
+func TestScrapeOperationThroughFakeAgent(t *testing.T) {
+	h, tun := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: "/var/log/op.log", ParentPath: "/var/log", Name: "op.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go tun.HandleConnection(connCtx, server)
+	commands := make(chan tunnel.Message, 1)
+	go func() {
+		decoder := json.NewDecoder(agent)
+		for {
+			var msg tunnel.Message
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+			if msg.Type == tunnel.TypeScrape {
+				commands <- msg
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for tun.ConnectedAgents() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.ScrapeFile(w, httptest.NewRequest(http.MethodPost, "/api/files/scrape", strings.NewReader(`{"path": "/var/log/op.log"}`)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("scrape: status %d %q, want 202", w.Code, w.Body)
+	}
+	var accepted struct {
+		OperationID string `json:"operation_id"`
+		Agents      int    `json:"agents"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted.OperationID == "" || accepted.Agents != 1 {
+		t.Fatalf("scrape response = %s, want an operation for one agent", w.Body)
+	}
+
+	operation := func() models.Operation {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.GetOperation(w, httptest.NewRequest(http.MethodGet, "/api/operations/"+accepted.OperationID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("operation: status %d %q, want 200", w.Code, w.Body)
+		}
+		var op models.Operation
+		if err := json.Unmarshal(w.Body.Bytes(), &op); err != nil {
+			t.Fatal(err)
+		}
+		return op
+	}
+	waitForState := func(state string) models.Operation {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			op := operation()
+			if op.State == state {
+				return op
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("operation = %+v, want %s", op, state)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if op := operation(); op.State != models.OperationPending || op.Path != "/var/log/op.log" {
+		t.Fatalf("operation before any data = %+v, want pending on /var/log/op.log", op)
+	}
+	select {
+	case msg := <-commands:
+		var cmd tunnel.ScrapeCommand
+		if err := json.Unmarshal(msg.Payload, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if cmd.Path != "/var/log/op.log" {
+			t.Errorf("scrape command = %+v, want /var/log/op.log", cmd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent received no scrape command")
+	}
+
+	sendAgentMessage(t, agent, tunnel.TypeLogData, []models.LogEntry{
+		{Filename: "/var/log/op.log", Line: "one", LineNum: 1, Timestamp: now},
+		{Filename: "/var/log/op.log", Line: "two", LineNum: 2, Timestamp: now},
+	})
+	op := waitForState(models.OperationIngesting)
+	if op.Lines != 2 || op.Batches != 1 {
+		t.Errorf("ingesting operation = %+v, want one batch of 2 lines", op)
+	}
+	// Completes once the file has been quiet for a couple of seconds
+	op = waitForState(models.OperationComplete)
+	if op.Lines != 2 {
+		t.Errorf("completed operation = %+v, want 2 lines", op)
+	}
+
+	w = httptest.NewRecorder()
+	h.GetOperation(w, httptest.NewRequest(http.MethodGet, "/api/operations/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown operation: status %d, want 404", w.Code)
+	}
+}
+
+func TestUnusualPathsAcrossEndpoints(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	names := []string{
+		"/var/log/my app/weird#file (1).log",
+		"/var/log/100%.log",
+		"/var/log/a+b&c=d.log",
+		"/var/log/журнал/ошибки.log",
+		"/var/log/日本語 ログ.log",
+	}
+	for i, name := range names {
+		dir, base, _ := strings.Cut(name[len("/var/log/"):], "/")
+		parent := "/var/log"
+		if base != "" {
+			parent += "/" + dir
+		} else {
+			base = dir
+		}
+		if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: name, ParentPath: parent, Name: base, ModTime: now}}); err != nil {
+			t.Fatal(err)
+		}
+		line := "line of file " + strconv.Itoa(i)
+		if err := h.db.SaveLogs(ctx, []models.LogEntry{{Filename: name, Line: line, LineNum: 1, Timestamp: now}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, name := range names {
+		want := "line of file " + strconv.Itoa(i)
+		q := url.Values{"file": {name}}.Encode()
+
+		w := httptest.NewRecorder()
+		h.GetLogs(w, httptest.NewRequest(http.MethodGet, "/api/logs?"+q, nil))
+		var page models.LogPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: logs status %d %q", name, w.Code, w.Body)
+		}
+		if len(page.Entries) != 1 || page.Entries[0].Line != want || page.Entries[0].Filename != name {
+			t.Errorf("%s: logs = %+v, want %q", name, page.Entries, want)
+		}
+
+		search, _ := json.Marshal(map[string]interface{}{"query": "line", "files": []string{name}})
+		w = httptest.NewRecorder()
+		h.SearchLogs(w, httptest.NewRequest(http.MethodPost, "/api/logs/search", strings.NewReader(string(search))))
+		var found []models.LogEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &found); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s: search status %d %q", name, w.Code, w.Body)
+		}
+		if len(found) != 1 || found[0].Line != want {
+			t.Errorf("%s: search = %+v, want %q", name, found, want)
+		}
+
+		w = httptest.NewRecorder()
+		h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?"+url.Values{"path": {paths.Parent(name)}}.Encode(), nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), mustJSON(t, name)) {
+			t.Errorf("%s: file tree status %d %q, want the file", name, w.Code, w.Body)
+		}
+
+		// Found, so the scrape gets as far as the missing agents
+		scrape, _ := json.Marshal(map[string]string{"path": name})
+		w = httptest.NewRecorder()
+		h.ScrapeFile(w, httptest.NewRequest(http.MethodPost, "/api/files/scrape", strings.NewReader(string(scrape))))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: scrape status %d %q, want 503 for no agents", name, w.Code, w.Body)
+		}
+	}
+}
+
+// mustJSON returns v as JSON, as it appears inside a response body
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestParseFileOrder(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  db.FileOrder
+	}{
+		{"", db.FileOrder{DirsFirst: true}},
+		{"sort=size&order=desc", db.FileOrder{Sort: "size", Desc: true, DirsFirst: true}},
+		{"sort=mod_time&order=asc&dirs_first=false&limit=50&offset=100", db.FileOrder{Sort: "mod_time", Limit: 50, Offset: 100}},
+	} {
+		got, err := parseFileOrder(httptest.NewRequest(http.MethodGet, "/api/files?"+tc.query, nil))
+		if err != nil || got != tc.want {
+			t.Errorf("%q: parseFileOrder = %+v, %v; want %+v", tc.query, got, err, tc.want)
+		}
+	}
+
+	for _, query := range []string{"order=up", "dirs_first=maybe", "limit=ten", "offset=1.5"} {
+		if _, err := parseFileOrder(httptest.NewRequest(http.MethodGet, "/api/files?"+query, nil)); err == nil {
+			t.Errorf("%q: parsed, want an error", query)
+		}
+	}
+}
+
+func TestGetFilesRejectsBadOrder(t *testing.T) {
+	h, _ := newTestHandler(t, "files")
+	for _, query := range []string{"sort=owner", "sort=size;drop", "order=sideways", "limit=-1", "limit=100000", "offset=-5"} {
+		w := httptest.NewRecorder()
+		h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log&"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestGroupByAgentRejectsBadParams(t *testing.T) {
+	h := &Handler{}
+	for _, tc := range []struct {
+		serve  http.HandlerFunc
+		target string
+	}{
+		{h.GetNetworkFlows, "/api/network/flows?group_by=host"},
+		{h.GetNetworkFlows, "/api/network/flows?group_by=agent&dedup=true"},
+		{h.GetNetworkFlows, "/api/network/flows?dedup=true&tolerance=2m"},
+		{h.GetNetworkFlows, "/api/network/flows?dedup=true&tolerance=-1s"},
+		{h.GetPacketRate, "/api/network/pps?group_by=host"},
+		{h.GetPacketRate, "/api/network/pps?group_by=agent"},
+	} {
+		w := httptest.NewRecorder()
+		tc.serve(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tc.target, w.Code)
+		}
+	}
+}
+
+// TestGetLogsPages follows next_cursor through lines that all share one
+// timestamp
+func TestGetLogsPages(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	const file = "/var/log/paged.log"
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: file, ParentPath: "/var/log", Name: "paged.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	logs := make([]models.LogEntry, 250)
+	for i := range logs {
+		logs[i] = models.LogEntry{Filename: file, Line: "same instant", LineNum: i + 1, Timestamp: now}
+	}
+	if err := h.db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int]bool)
+	query := url.Values{"file": {file}}
+	for pages := 1; ; pages++ {
+		w := httptest.NewRecorder()
+		h.GetLogs(w, httptest.NewRequest(http.MethodGet, "/api/logs?"+query.Encode(), nil))
+		var page models.LogPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("page %d: status %d %q", pages, w.Code, w.Body)
+		}
+		for _, l := range page.Entries {
+			if seen[l.LineNum] {
+				t.Fatalf("line %d on two pages", l.LineNum)
+			}
+			seen[l.LineNum] = true
+		}
+		if !page.HasMore {
+			if pages != 3 {
+				t.Errorf("got %d pages of 250 lines, want 3", pages)
+			}
+			break
+		}
+		query.Set("cursor", page.NextCursor)
+	}
+	if len(seen) != len(logs) {
+		t.Errorf("paged through %d lines, want %d", len(seen), len(logs))
+	}
+
+	query.Set("cursor", "not a cursor")
+	w := httptest.NewRecorder()
+	h.GetLogs(w, httptest.NewRequest(http.MethodGet, "/api/logs?"+query.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed cursor: status %d, want 400", w.Code)
+	}
+}
+
+func TestParseLogsLimit(t *testing.T) {
+	tests := []struct {
+		query string
+		limit int
+		ok    bool
+	}{
+		{"", defaultLogsLimit, true},
+		{"limit=1", 1, true},
+		{"limit=1000", 1000, true},
+		{"limit=0", 0, false},
+		{"limit=1001", 0, false},
+		{"limit=-5", 0, false},
+		{"limit=ten", 0, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		limit, ok := parseLogsLimit(w, httptest.NewRequest(http.MethodGet, "/api/logs?"+tt.query, nil))
+		if ok != tt.ok || limit != tt.limit {
+			t.Errorf("%q = %d, %v; want %d, %v", tt.query, limit, ok, tt.limit, tt.ok)
+		}
+		if !ok && w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", tt.query, w.Code)
+		}
+	}
+}
+
+// TestGetLogsLimitSplitsSharedTimestamp pages with limits that put page
+// boundaries among ten lines sharing one timestamp
+func TestGetLogsLimitSplitsSharedTimestamp(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	const file = "/var/log/burst.log"
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: file, ParentPath: "/var/log", Name: "burst.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	// Lines 3 to 12 are one burst; the others have timestamps of their own
+	var logs []models.LogEntry
+	for n := 1; n <= 15; n++ {
+		ts := now
+		switch {
+		case n < 3:
+			ts = now.Add(-time.Duration(3-n) * time.Second)
+		case n > 12:
+			ts = now.Add(time.Duration(n-12) * time.Second)
+		}
+		logs = append(logs, models.LogEntry{Filename: file, Line: "line " + strconv.Itoa(n), LineNum: n, Timestamp: ts})
+	}
+	if err := h.db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	pageThrough := func(limits ...int) [][]int {
+		t.Helper()
+		var pages [][]int
+		query := url.Values{"file": {file}}
+		for _, limit := range limits {
+			query.Set("limit", strconv.Itoa(limit))
+			w := httptest.NewRecorder()
+			h.GetLogs(w, httptest.NewRequest(http.MethodGet, "/api/logs?"+query.Encode(), nil))
+			var page models.LogPage
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("limit %d: status %d %q", limit, w.Code, w.Body)
+			}
+			var lines []int
+			for _, l := range page.Entries {
+				lines = append(lines, l.LineNum)
+			}
+			pages = append(pages, lines)
+			if !page.HasMore {
+				break
+			}
+			query.Set("cursor", page.NextCursor)
+		}
+		return pages
+	}
+
+	tests := []struct {
+		limits []int
+		want   string
+	}{
+		{[]int{5, 5, 5}, "[[15 14 13 12 11] [10 9 8 7 6] [5 4 3 2 1]]"},
+		// The page size may change between requests
+		{[]int{4, 7, 100}, "[[15 14 13 12] [11 10 9 8 7 6 5] [4 3 2 1]]"},
+		{[]int{1000}, "[[15 14 13 12 11 10 9 8 7 6 5 4 3 2 1]]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(pageThrough(tt.limits...)); got != tt.want {
+			t.Errorf("pages of %v = %s, want %s", tt.limits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// jsonArrayWriter writes a JSON array an element at a time, in the form
+// json.Encoder gives a slice, for responses too large to build in memory.
+// Headers and status are sent with the first element, so errors found
+// before it can still be answered normally.
+type jsonArrayWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	n  int
+}
+
+func newJSONArrayWriter(w http.ResponseWriter) *jsonArrayWriter {
+	return &jsonArrayWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+// started reports whether anything was written, after which the status
+// can't change
+func (a *jsonArrayWriter) started() bool {
+	return a.n > 0
+}
+
+func (a *jsonArrayWriter) write(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	sep := ","
+	if a.n == 0 {
+		a.w.Header().Set("Content-Type", "application/json")
+		a.w.WriteHeader(http.StatusOK)
+		sep = "["
+	}
+	a.n++
+	if _, err := a.w.Write([]byte(sep)); err != nil {
+		return err
+	}
+	_, err = a.w.Write(b)
+	return err
+}
+
+// flush sends what was written so far to the client
+func (a *jsonArrayWriter) flush() error {
+	if err := a.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// close ends the array. An empty one is written as the legacy endpoints
+// always have, without the trailing newline.
+func (a *jsonArrayWriter) close() error {
+	if a.n == 0 {
+		a.w.Header().Set("Content-Type", "application/json")
+		_, err := a.w.Write([]byte("[]"))
+		return err
+	}
+	_, err := a.w.Write([]byte("]\n"))
+	return err
+}
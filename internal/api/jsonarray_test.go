@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+func treeNodes(from, n int) []models.FileNode {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	nodes := make([]models.FileNode, n)
+	for i := range nodes {
+		name := fmt.Sprintf("app-%06d.log", from+i)
+		nodes[i] = models.FileNode{Path: "/var/log/apps/" + name, ParentPath: "/var/log/apps", Name: name, Size: int64(i), ModTime: now, LastSeen: now}
+	}
+	return nodes
+}
+
+func TestJSONArrayWriterMatchesEncoder(t *testing.T) {
+	for _, n := range []int{1, 2, 2500} {
+		nodes := treeNodes(0, n)
+		var want bytes.Buffer
+		if err := json.NewEncoder(&want).Encode(nodes); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		out := newJSONArrayWriter(w)
+		for _, f := range nodes {
+			if err := out.write(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := out.close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+			t.Errorf("%d nodes streamed differ from the encoded slice", n)
+		}
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%d nodes: status %d, content type %q", n, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestJSONArrayWriterEmpty(t *testing.T) {
+	w := httptest.NewRecorder()
+	out := newJSONArrayWriter(w)
+	if out.started() {
+		t.Fatal("started before anything was written")
+	}
+	// Nothing is committed yet, so an error can still set the status
+	writeError(w, db.ErrNotFound)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("error before the first node: status %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	if err := newJSONArrayWriter(w).close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "[]" {
+		t.Errorf("empty array = %q, want []", w.Body)
+	}
+}
+
+func TestGetFilesStreamsAcrossChunks(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	nodes := treeNodes(0, 2500)
+	if err := h.db.SaveFiles(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetFiles(w, httptest.NewRequest(http.MethodGet, "/api/files?path=/var/log/apps&depth=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got []models.FileNode
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("streamed tree isn't one JSON array: %v", err)
+	}
+	// The directory itself may be listed along with its files
+	files := 0
+	for _, f := range got {
+		if f.ParentPath == "/var/log/apps" {
+			files++
+		}
+	}
+	if files != len(nodes) {
+		t.Errorf("got %d files of %d across the chunks", files, len(nodes))
+	}
+}
+
+// heapWriter is a response writer that discards the body, sampling the
+// heap every so often and on large writes to find the peak of a response
+type heapWriter struct {
+	header http.Header
+	writes int
+	peak   uint64
+}
+
+func (w *heapWriter) Header() http.Header { return w.header }
+func (w *heapWriter) WriteHeader(int)     {}
+
+func (w *heapWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writes%1000 == 0 || len(p) > 1<<20 {
+		w.sample()
+	}
+	return len(p), nil
+}
+
+func (w *heapWriter) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	w.peak = max(w.peak, m.HeapAlloc)
+}
+
+// fileTreeChunkSize matches the chunks db.StreamFileTree hands over
+const fileTreeChunkSize = 1000
+
+// BenchmarkFileTreeResponse writes a 200k-node tree as GET /api/files did
+// before, from one slice through json.Encoder, and as it does now, from
+// 1000-node chunks, reporting the peak heap of each
+func BenchmarkFileTreeResponse(b *testing.B) {
+	const total = 200_000
+
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			w := &heapWriter{header: make(http.Header)}
+			var files []models.FileNode
+			for from := 0; from < total; from += fileTreeChunkSize {
+				files = append(files, treeNodes(from, fileTreeChunkSize)...)
+			}
+			if err := json.NewEncoder(w).Encode(files); err != nil {
+				b.Fatal(err)
+			}
+			w.sample()
+			peak = max(peak, w.peak)
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			w := &heapWriter{header: make(http.Header)}
+			out := newJSONArrayWriter(w)
+			for from := 0; from < total; from += fileTreeChunkSize {
+				for _, f := range treeNodes(from, fileTreeChunkSize) {
+					if err := out.write(f); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			if err := out.close(); err != nil {
+				b.Fatal(err)
+			}
+			w.sample()
+			peak = max(peak, w.peak)
+		}
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	})
+}
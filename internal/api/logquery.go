@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+type logQuery struct {
+	// File selectors: exact paths, prefixes ending in / or globs
+	Files    []string  `json:"files"`
+	Levels   []string  `json:"levels"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Contains string    `json:"contains"`
+	LineFrom int       `json:"line_from"`
+	LineTo   int       `json:"line_to"`
+	Limit    int       `json:"limit"`
+	Cursor   string    `json:"cursor"`
+	Count    bool      `json:"count"`
+}
+
+type logQueryPage struct {
+	Entries    []models.LogEntry `json:"entries"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+	Count      *int64            `json:"count,omitempty"`
+	// The files the request's selectors expanded to
+	Files []string `json:"files,omitempty"`
+}
+
+// QueryLogs answers POST /api/logs/query, combining any of the log filters
+// in one request with keyset pagination and an optional total count
+func (h *Handler) QueryLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req logQuery
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	if req.Limit < 0 || req.Limit > db.MaxFilterLimit {
+		http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+		return
+	}
+	if req.LineTo > 0 && req.LineFrom > req.LineTo {
+		http.Error(w, "line_from must not exceed line_to", http.StatusBadRequest)
+		return
+	}
+	files, err := h.resolveFiles(r.Context(), req.Files)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setSelectedFiles(w, files)
+	if files != nil && len(files) == 0 {
+		resp := logQueryPage{Entries: []models.LogEntry{}, Files: files}
+		if req.Count {
+			resp.Count = new(int64)
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	var cursor *db.LogCursor
+	if req.Cursor != "" {
+		var err error
+		if cursor, err = db.ParseLogCursor(req.Cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := db.LogFilter{
+		Files:    files,
+		Levels:   req.Levels,
+		Start:    req.Start,
+		End:      req.End,
+		Contains: req.Contains,
+		LineFrom: req.LineFrom,
+		LineTo:   req.LineTo,
+	}
+
+	entries, next, err := h.db.FilterLogs(r.Context(), filter, cursor, req.Limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := logQueryPage{Entries: entries, Files: files}
+	if resp.Entries == nil {
+		resp.Entries = []models.LogEntry{}
+	}
+	if next != nil {
+		resp.NextCursor = next.String()
+	}
+
+	// The count ignores the cursor, so clients only need it on the first page
+	if req.Count {
+		count, err := h.db.CountLogs(r.Context(), filter)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp.Count = &count
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
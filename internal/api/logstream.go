@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/selector"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	// Lines one poll of a read-only server sends per shard; the rest follow
+	// on the next poll
+	maxStreamPolledLines = 1000
+	streamPollTimeout    = 5 * time.Second
+)
+
+// StreamLogs streams the lines of a file, or of the files a selector
+// matches, as server-sent events once they are stored. Each line is a data
+// frame of the default message event. A client whose buffer fills misses
+// lines instead of holding up ingest, and lines aren't replayed on
+// reconnect; GET /api/logs fills the gap. A read-only server has no agents
+// and polls the database instead, for a single file only.
+func (h *Handler) StreamLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath := paths.FromQuery(r, "file")
+	if filePath == "" {
+		http.Error(w, "file parameter required", http.StatusBadRequest)
+		return
+	}
+	sel, err := selector.Parse(filePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	match := sel.Match
+	if sel.Kind() == selector.Exact {
+		filePath = paths.Normalize(sel.Literal())
+		match = func(path string) bool { return path == filePath }
+	} else if h.cfg.ReadOnly {
+		http.Error(w, "a read-only server streams a single file", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("[API] Error clearing write deadline of log stream: %v", err)
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before the headers go out, so no line stored after the
+	// client sees the response is missed
+	var (
+		lines  <-chan models.LogEntry
+		poll   <-chan time.Time
+		cursor db.TailCursor
+	)
+	if h.cfg.ReadOnly {
+		if cursor, err = h.db.TailCursorNow(r.Context()); err != nil {
+			log.Printf("[API] Error starting log stream: %v", err)
+			http.Error(w, "failed to start log stream", http.StatusInternalServerError)
+			return
+		}
+		ticker := h.clock.NewTicker(h.cfg.ReadOnlyPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C()
+	} else {
+		lines = h.tunnel.SubscribeLogs(match)
+		defer h.tunnel.UnsubscribeLogs(lines)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := h.clock.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case entry, ok := <-lines:
+			// Closed on shutdown
+			if !ok {
+				return
+			}
+			if err := writeLogEvent(w, entry); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-poll:
+			var polled []models.LogEntry
+			polled, cursor, err = h.pollStreamedLogs(r.Context(), filePath, cursor)
+			if err != nil {
+				if r.Context().Err() == nil {
+					log.Printf("[API] Error polling log stream of %s: %v", filePath, err)
+				}
+				continue
+			}
+			for _, entry := range polled {
+				if err := writeLogEvent(w, entry); err != nil {
+					return
+				}
+			}
+			if len(polled) > 0 {
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		case <-keepAlive.C():
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// pollStreamedLogs returns the file's lines stored after the cursor and the
+// cursor past them. On error the cursor is returned unchanged, so the next
+// poll retries.
+func (h *Handler) pollStreamedLogs(ctx context.Context, filePath string, cursor db.TailCursor) ([]models.LogEntry, db.TailCursor, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamPollTimeout)
+	defer cancel()
+
+	lines, next, err := h.db.GetLogsAfter(ctx, filePath, cursor, maxStreamPolledLines)
+	if err != nil {
+		return nil, cursor, err
+	}
+	return lines, next, nil
+}
+
+// writeLogEvent writes a line as a data frame
+func writeLogEvent(w http.ResponseWriter, entry models.LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("[API] Error encoding log event: %v", err)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+func TestStreamLogsRejectsBadRequests(t *testing.T) {
+	h := &Handler{cfg: &config.Config{ReadOnly: true}}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		query  string
+		want   int
+	}{
+		{"post", http.MethodPost, "?file=/var/log/app.log", http.StatusMethodNotAllowed},
+		{"no file", http.MethodGet, "", http.StatusBadRequest},
+		{"selector on read-only server", http.MethodGet, "?file=/var/log/*.log", http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.StreamLogs(rec, httptest.NewRequest(tc.method, "/api/logs/stream"+tc.query, nil))
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+// sendAgentMessage writes one tunnel message as an agent would
+func sendAgentMessage(t *testing.T, conn net.Conn, typ tunnel.MessageType, payload interface{}) {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(conn).Encode(tunnel.Message{Type: typ, Payload: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamLogsDeliversLinesOfTheFile(t *testing.T) {
+	h, tun := newTestHandler(t, "files", "logs")
+	srv := httptest.NewServer(http.HandlerFunc(h.StreamLogs))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?file=/var/log/sse.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type = %q, want text/event-stream", ct)
+	}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.HandleConnection(ctx, server)
+	// Agents never read here, so discard what the server sends
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := agent.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	now := time.Now().UTC()
+	sendAgentMessage(t, agent, tunnel.TypeLogList, []models.FileNode{
+		{Path: "/var/log/sse.log", ParentPath: "/var/log", Name: "sse.log", ModTime: now},
+		{Path: "/var/log/other.log", ParentPath: "/var/log", Name: "other.log", ModTime: now},
+	})
+	sendAgentMessage(t, agent, tunnel.TypeLogData, []models.LogEntry{
+		{Filename: "/var/log/other.log", Line: "elsewhere", LineNum: 1, Timestamp: now},
+		{Filename: "/var/log/sse.log", Line: "hello", LineNum: 1, Timestamp: now},
+	})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				lines <- data
+			}
+		}
+	}()
+
+	select {
+	case data := <-lines:
+		var entry models.LogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Filename != "/var/log/sse.log" || entry.Line != "hello" {
+			t.Fatalf("streamed %+v, want the line of /var/log/sse.log", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no line streamed")
+	}
+}
+
+func TestStreamLogsKeepAlive(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	clk := clock.NewFake(time.Now())
+	h.clock = clk
+	srv := httptest.NewServer(http.HandlerFunc(h.StreamLogs))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?file=/var/log/idle.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	comments := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), ":") {
+				comments <- scanner.Text()
+			}
+		}
+	}()
+
+	// The keep-alive ticker starts once the headers are out
+	deadline := time.Now().Add(5 * time.Second)
+	for clk.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream never started its keep-alive ticker")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case c := <-comments:
+		t.Fatalf("sent %q before the keep-alive interval", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(streamKeepAlive)
+	select {
+	case c := <-comments:
+		if c != ": keepalive" {
+			t.Fatalf("comment = %q, want keepalive", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no keep-alive after the interval")
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/realip"
+	"diagnostic-client/internal/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logRequests traces and logs each request. The client address is resolved
+// through trusted proxies, so log lines name the real client rather than the
+// ingress. Every response carries an X-Request-ID: the caller's own if sent,
+// else the trace ID, so a request can be found in both logs and traces.
+func logRequests(proxies *realip.Resolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Start(ctx, r.Method+" "+r.URL.Path,
+			attribute.String("http.method", r.Method),
+			attribute.String("http.path", r.URL.Path),
+			attribute.String("client.address", proxies.ClientIP(r)),
+		)
+		defer span.End()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID(span.SpanContext())
+		}
+		span.SetAttributes(attribute.String("request.id", requestID))
+		w.Header().Set("X-Request-ID", requestID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+		log.Printf("[API] %s %s from %s (%s) in %v [%s]",
+			r.Method, r.URL.Path, proxies.ClientIP(r), proxies.Scheme(r), time.Since(start), requestID)
+	})
+}
+
+func newRequestID(sc trace.SpanContext) string {
+	if sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// authMiddleware rejects requests without one of keys in an
+// Authorization: Bearer header. Browsers can't set headers on websocket
+// upgrades or EventSource streams, so those may pass the key in the api_key
+// query parameter instead. Without keys every request is allowed.
+func authMiddleware(keys []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok && browserStream(r) {
+				key = r.URL.Query().Get("api_key")
+			}
+			if key == "" || !validAPIKey(keys, key) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// browserStream reports whether r is a websocket upgrade or an event stream
+// request, which browsers send without custom headers
+func browserStream(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return true
+	}
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// validAPIKey compares key with every configured key in constant time
+func validAPIKey(keys []string, key string) bool {
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return valid == 1
+}
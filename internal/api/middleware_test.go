@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := []string{"k1", "k2"}
+	tests := []struct {
+		name   string
+		keys   []string
+		target string
+		header map[string]string
+		status int
+	}{
+		{name: "valid key", keys: keys, target: "/api/files", header: map[string]string{"Authorization": "Bearer k2"}, status: http.StatusOK},
+		{name: "wrong key", keys: keys, target: "/api/files", header: map[string]string{"Authorization": "Bearer k3"}, status: http.StatusUnauthorized},
+		{name: "not bearer", keys: keys, target: "/api/files", header: map[string]string{"Authorization": "Basic k1"}, status: http.StatusUnauthorized},
+		{name: "missing header", keys: keys, target: "/api/files", status: http.StatusUnauthorized},
+		{name: "query on websocket upgrade", keys: keys, target: "/ws?api_key=k1", header: map[string]string{"Upgrade": "websocket"}, status: http.StatusOK},
+		{name: "query on event stream", keys: keys, target: "/api/logs/stream?api_key=k1", header: map[string]string{"Accept": "text/event-stream"}, status: http.StatusOK},
+		{name: "wrong query key", keys: keys, target: "/ws?api_key=k3", header: map[string]string{"Upgrade": "websocket"}, status: http.StatusUnauthorized},
+		{name: "query on plain request", keys: keys, target: "/api/files?api_key=k1", status: http.StatusUnauthorized},
+		{name: "no keys configured", target: "/api/files", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := authMiddleware(tt.keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
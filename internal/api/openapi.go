@@ -0,0 +1,322 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// schema is an OpenAPI 3.0 schema object
+type schema map[string]interface{}
+
+// Parameter schemas. Bounds a handler enforces on durations are recorded as
+// x-minimum and x-maximum, since OpenAPI has no duration type.
+func stringSchema() schema   { return schema{"type": "string"} }
+func booleanSchema() schema  { return schema{"type": "boolean"} }
+func dateTimeSchema() schema { return schema{"type": "string", "format": "date-time"} }
+
+func integerSchema(min, max int) schema {
+	return schema{"type": "integer", "minimum": min, "maximum": max}
+}
+
+func enumSchema(values ...string) schema {
+	return schema{"type": "string", "enum": values}
+}
+
+func durationSchema(min, max string) schema {
+	s := schema{"type": "string", "format": "duration"}
+	if min != "" {
+		s["x-minimum"] = min
+	}
+	if max != "" {
+		s["x-maximum"] = max
+	}
+	return s
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaRegistry derives schemas from Go types the way encoding/json
+// marshals them. Named structs become components referenced by name.
+type schemaRegistry struct {
+	components map[string]schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{
+		components: make(map[string]schema),
+		names:      make(map[reflect.Type]string),
+	}
+}
+
+func (s *schemaRegistry) schemaOf(t reflect.Type) schema {
+	switch t {
+	case timeType:
+		return dateTimeSchema()
+	case rawMessageType:
+		return schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		inner := s.schemaOf(t.Elem())
+		if _, ok := inner["$ref"]; ok {
+			return schema{"allOf": []schema{inner}, "nullable": true}
+		}
+		inner["nullable"] = true
+		return inner
+	case reflect.Interface:
+		return schema{}
+	case reflect.Bool:
+		return booleanSchema()
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return schema{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return schema{"type": "integer", "minimum": 0}
+	case reflect.Float32:
+		return schema{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return schema{"type": "number", "format": "double"}
+	case reflect.String:
+		return stringSchema()
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "format": "byte"}
+		}
+		return schema{"type": "array", "items": s.schemaOf(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": s.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		return s.ref(t)
+	}
+	return schema{}
+}
+
+// ref registers t as a component on first use. The name is reserved before
+// the schema is built, so self-referencing types terminate.
+func (s *schemaRegistry) ref(t reflect.Type) schema {
+	name, ok := s.names[t]
+	if !ok {
+		name = exportedName(t.Name())
+		if _, taken := s.components[name]; taken {
+			name = exportedName(t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]) + name
+		}
+		s.names[t] = name
+		s.components[name] = nil
+		s.components[name] = s.structSchema(t)
+	}
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func (s *schemaRegistry) structSchema(t reflect.Type) schema {
+	properties := make(map[string]schema)
+	var required []string
+	s.addFields(t, properties, &required)
+
+	out := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
+
+// addFields collects the JSON fields of t, including those promoted from
+// untagged embedded structs. Fields without omitempty are always present
+// in responses, so they are listed as required.
+func (s *schemaRegistry) addFields(t reflect.Type, properties map[string]schema, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s.addFields(ft, properties, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		if strings.Contains(","+opts+",", ",string,") {
+			properties[name] = stringSchema()
+		} else {
+			properties[name] = s.schemaOf(f.Type)
+		}
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func exportedName(name string) string {
+	if name == "" {
+		return name
+	}
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// openAPIDocument describes the routes as an OpenAPI 3.0 document
+func openAPIDocument(routes []route) map[string]interface{} {
+	schemas := newSchemaRegistry()
+	paths := make(map[string]map[string]interface{})
+
+	for _, rt := range routes {
+		for _, op := range rt.ops {
+			path := op.path
+			if path == "" {
+				path = rt.path
+			}
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(op.method)] = op.describe(path, rt.admin, schemas)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Diagnostic Client API",
+			"version": "1.0",
+		},
+		"paths": paths,
+		// API keys are only required when API_KEYS is set
+		"security": []map[string][]string{{"apiKey": {}}, {}},
+		"components": map[string]interface{}{
+			"schemas": schemas.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]string{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-Admin-Token",
+				},
+				"apiKey": map[string]string{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+func (op apiOperation) describe(path string, admin bool, schemas *schemaRegistry) map[string]interface{} {
+	out := map[string]interface{}{
+		"operationId": operationID(op.method, path),
+		"summary":     op.summary,
+	}
+
+	if len(op.params) > 0 {
+		params := make([]map[string]interface{}, 0, len(op.params))
+		for _, p := range op.params {
+			in := "query"
+			if strings.Contains(path, "{"+p.name+"}") {
+				in = "path"
+			}
+			param := map[string]interface{}{
+				"name":     p.name,
+				"in":       in,
+				"required": p.required || in == "path",
+				"schema":   p.schema,
+			}
+			if p.description != "" {
+				param["description"] = p.description
+			}
+			params = append(params, param)
+		}
+		out["parameters"] = params
+	}
+
+	if op.request != nil {
+		out["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content(op.requestType, op.request, schemas),
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		success["content"] = content(op.responseType, op.response, schemas)
+	}
+	out["responses"] = map[string]interface{}{
+		strconv.Itoa(status): success,
+		"default": map[string]interface{}{
+			"description": "Error, with the reason as plain text",
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": stringSchema()},
+			},
+		},
+	}
+
+	if admin || op.admin {
+		out["security"] = []map[string][]string{{"adminToken": {}, "apiKey": {}}, {"adminToken": {}}}
+	}
+	return out
+}
+
+func content(mediaType string, sample interface{}, schemas *schemaRegistry) map[string]interface{} {
+	if mediaType == "" {
+		mediaType = "application/json"
+	}
+	return map[string]interface{}{
+		mediaType: map[string]interface{}{"schema": schemas.schemaOf(reflect.TypeOf(sample))},
+	}
+}
+
+// operationID names an operation after its method and path, such as
+// getLogsPeaks for GET /api/logs/peaks
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.Split(strings.TrimPrefix(path, "/api"), "/") {
+		seg = strings.Trim(seg, "{}")
+		for _, word := range strings.FieldsFunc(seg, func(r rune) bool { return r == '_' || r == '.' }) {
+			b.WriteString(exportedName(word))
+		}
+	}
+	return b.String()
+}
+
+// GetOpenAPI serves the OpenAPI document for the REST endpoints, generated
+// from the route table at startup
+func (h *Handler) GetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if h.openAPI == nil {
+		http.Error(w, "OpenAPI document unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.openAPI)
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// generatedDocument returns the OpenAPI document as a client decodes it
+func generatedDocument(t *testing.T) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(openAPIDocument((&Handler{}).routes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+var (
+	pathParam   = regexp.MustCompile(`\{([^}]+)\}`)
+	statusCode  = regexp.MustCompile(`^[1-5]\d\d$`)
+	httpMethods = map[string]bool{"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true}
+	schemaTypes = map[string]bool{"string": true, "integer": true, "number": true, "boolean": true, "array": true, "object": true}
+)
+
+// TestOpenAPIDocumentIsValid checks the generated document against the
+// rules of the OpenAPI 3.0 schema that a generator could break
+func TestOpenAPIDocumentIsValid(t *testing.T) {
+	doc := generatedDocument(t)
+
+	if v, _ := doc["openapi"].(string); !strings.HasPrefix(v, "3.0.") {
+		t.Errorf("openapi = %q, want 3.0.x", v)
+	}
+	info, _ := doc["info"].(map[string]interface{})
+	if info["title"] == "" || info["title"] == nil || info["version"] == "" || info["version"] == nil {
+		t.Errorf("info = %v, want a title and version", info)
+	}
+
+	components, _ := doc["components"].(map[string]interface{})
+	schemas, _ := components["schemas"].(map[string]interface{})
+	securitySchemes, _ := components["securitySchemes"].(map[string]interface{})
+	checkSecurity := func(where string, v interface{}) {
+		reqs, _ := v.([]interface{})
+		for _, req := range reqs {
+			for name := range req.(map[string]interface{}) {
+				if securitySchemes[name] == nil {
+					t.Errorf("%s: security requirement names unknown scheme %q", where, name)
+				}
+			}
+		}
+	}
+	checkSecurity("document", doc["security"])
+
+	operationIDs := make(map[string]string)
+	paths, _ := doc["paths"].(map[string]interface{})
+	if len(paths) == 0 {
+		t.Fatal("document has no paths")
+	}
+	for path, item := range paths {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("path %q doesn't start with /", path)
+		}
+		for method, v := range item.(map[string]interface{}) {
+			where := strings.ToUpper(method) + " " + path
+			if !httpMethods[method] {
+				t.Errorf("%s: not an HTTP method", where)
+				continue
+			}
+			op := v.(map[string]interface{})
+
+			id, _ := op["operationId"].(string)
+			if id == "" {
+				t.Errorf("%s: no operationId", where)
+			} else if other, dup := operationIDs[id]; dup {
+				t.Errorf("%s: operationId %q also used by %s", where, id, other)
+			}
+			operationIDs[id] = where
+
+			declared := make(map[string]bool)
+			params, _ := op["parameters"].([]interface{})
+			for _, p := range params {
+				param := p.(map[string]interface{})
+				name, _ := param["name"].(string)
+				in, _ := param["in"].(string)
+				if in != "query" && in != "path" {
+					t.Errorf("%s: parameter %q is in %q", where, name, in)
+				}
+				if in == "path" && param["required"] != true {
+					t.Errorf("%s: path parameter %q isn't required", where, name)
+				}
+				if param["schema"] == nil {
+					t.Errorf("%s: parameter %q has no schema", where, name)
+				}
+				if declared[in+" "+name] {
+					t.Errorf("%s: parameter %q declared twice", where, name)
+				}
+				declared[in+" "+name] = true
+			}
+			for _, m := range pathParam.FindAllStringSubmatch(path, -1) {
+				if !declared["path "+m[1]] {
+					t.Errorf("%s: path parameter %q isn't declared", where, m[1])
+				}
+			}
+
+			responses, _ := op["responses"].(map[string]interface{})
+			if len(responses) == 0 {
+				t.Errorf("%s: no responses", where)
+			}
+			for code, r := range responses {
+				if code != "default" && !statusCode.MatchString(code) {
+					t.Errorf("%s: response key %q isn't a status code", where, code)
+				}
+				if d, _ := r.(map[string]interface{})["description"].(string); d == "" {
+					t.Errorf("%s: response %s has no description", where, code)
+				}
+			}
+			checkSecurity(where, op["security"])
+		}
+	}
+
+	// Every reference resolves and every schema is well formed
+	var walk func(where string, v interface{})
+	walk = func(where string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if name == ref || schemas[name] == nil {
+					t.Errorf("%s: unresolved reference %q", where, ref)
+				}
+			}
+			if typ, ok := v["type"].(string); ok && v["in"] == nil {
+				if !schemaTypes[typ] && !(typ == "http" || typ == "apiKey") {
+					t.Errorf("%s: unknown schema type %q", where, typ)
+				}
+				if typ == "array" && v["items"] == nil {
+					t.Errorf("%s: array schema without items", where)
+				}
+			}
+			for k, child := range v {
+				walk(where+"."+k, child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(where, child)
+			}
+		}
+	}
+	walk("document", doc)
+}
+
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	routes := (&Handler{}).routes()
+	doc := generatedDocument(t)
+	paths, _ := doc["paths"].(map[string]interface{})
+
+	operations := 0
+	for _, rt := range routes {
+		if len(rt.ops) == 0 {
+			t.Errorf("route %s has no operations to document", rt.path)
+		}
+		for _, op := range rt.ops {
+			path := op.path
+			if path == "" {
+				path = rt.path
+			}
+			if !strings.HasPrefix(path, strings.TrimSuffix(rt.path, "/")) {
+				t.Errorf("operation path %s isn't served by route %s", path, rt.path)
+			}
+			item, _ := paths[path].(map[string]interface{})
+			if item[strings.ToLower(op.method)] == nil {
+				t.Errorf("%s %s isn't documented", op.method, path)
+			}
+			operations++
+		}
+	}
+
+	documented := 0
+	for _, item := range paths {
+		documented += len(item.(map[string]interface{}))
+	}
+	if documented != operations {
+		t.Errorf("document has %d operations, routes have %d", documented, operations)
+	}
+	if item, _ := paths["/api/openapi.json"].(map[string]interface{}); item["get"] == nil {
+		t.Error("the document doesn't describe itself")
+	}
+}
+
+func TestGetOpenAPIServesDocument(t *testing.T) {
+	cfg, d := openTestDB(t)
+	s := NewServer(cfg, d)
+	t.Cleanup(s.tunnel.Close)
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type %q", ct)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	paths, _ := doc["paths"].(map[string]interface{})
+	for _, rt := range s.http.routes() {
+		if len(rt.ops) > 0 && rt.ops[0].path == "" && paths[rt.path] == nil {
+			t.Errorf("served document lacks %s", rt.path)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	// overviewTTL is how long an assembled overview is served from cache;
+	// dashboards opening at the same moment share one set of queries
+	overviewTTL     = 5 * time.Second
+	overviewTimeout = 10 * time.Second
+	overviewTopN    = 5
+)
+
+type logOverview struct {
+	Start         time.Time               `json:"-"`
+	End           time.Time               `json:"-"`
+	TotalLines    int64                   `json:"total_lines"`
+	Levels        map[string]int64        `json:"levels"`
+	TopErrorFiles []models.FileErrorCount `json:"top_error_files"`
+	LatestError   *models.LogEntry        `json:"latest_error"`
+	PerMinute     []models.MinuteCount    `json:"per_minute"`
+}
+
+// overviewMeta describes the window an overview covers and how stale it is
+type overviewMeta struct {
+	Window     string    `json:"window"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	CacheAgeMs int64     `json:"cache_age_ms"`
+	// Keep-1-in-N of each LOG_SAMPLING pattern; counts of matching files
+	// cover only the stored sample
+	Sampling map[string]int `json:"sampling,omitempty"`
+}
+
+type overviewResponse struct {
+	*logOverview
+	Meta overviewMeta `json:"meta"`
+}
+
+// overviewEntry is one cached or in-flight overview; done is closed once
+// result and err are set
+type overviewEntry struct {
+	done   chan struct{}
+	result *logOverview
+	err    error
+	at     time.Time
+}
+
+// overviewCache holds recent overviews by window. Concurrent requests for
+// the same window wait for a single computation instead of each running it.
+type overviewCache struct {
+	mu      sync.Mutex
+	entries map[time.Duration]*overviewEntry
+}
+
+func newOverviewCache() *overviewCache {
+	return &overviewCache{entries: make(map[time.Duration]*overviewEntry)}
+}
+
+func (c *overviewCache) get(window time.Duration, compute func() (*logOverview, error)) (*logOverview, time.Time, error) {
+	c.mu.Lock()
+	e := c.entries[window]
+	if e != nil {
+		select {
+		case <-e.done:
+			if e.err != nil || time.Since(e.at) >= overviewTTL {
+				e = nil
+			}
+		default:
+		}
+	}
+	if e == nil {
+		e = &overviewEntry{done: make(chan struct{})}
+		c.entries[window] = e
+		c.mu.Unlock()
+
+		e.result, e.err = compute()
+		e.at = time.Now()
+		close(e.done)
+		return e.result, e.at, e.err
+	}
+	c.mu.Unlock()
+
+	<-e.done
+	return e.result, e.at, e.err
+}
+
+// GetOverview summarizes log activity across all files over the last window
+// (default 1h) for dashboard landing pages
+func (h *Handler) GetOverview(w http.ResponseWriter, r *http.Request) {
+	window := time.Hour
+	if ws := r.URL.Query().Get("window"); ws != "" {
+		var err error
+		window, err = time.ParseDuration(ws)
+		if err != nil || window < time.Minute || window > 24*time.Hour {
+			http.Error(w, "window must be a duration between 1m and 24h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	overview, at, err := h.overviews.get(window, func() (*logOverview, error) {
+		return h.computeOverview(window)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, overviewResponse{overview, overviewMeta{
+		Window:     window.String(),
+		Start:      overview.Start,
+		End:        overview.End,
+		CacheAgeMs: time.Since(at).Milliseconds(),
+		Sampling:   h.samplingRules(),
+	}})
+}
+
+// computeOverview runs the overview queries concurrently under one deadline.
+// It is detached from any request, since its result is shared by every
+// request waiting on the cache.
+func (h *Handler) computeOverview(window time.Duration) (*logOverview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), overviewTimeout)
+	defer cancel()
+
+	end := time.Now().UTC()
+	o := &logOverview{Start: end.Add(-window), End: end}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	run := func(fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	run(func() (err error) {
+		o.Levels, err = h.db.CountLogsByLevel(ctx, o.Start, end)
+		return err
+	})
+	run(func() (err error) {
+		o.TopErrorFiles, err = h.db.TopErrorFiles(ctx, o.Start, end, overviewTopN)
+		return err
+	})
+	run(func() error {
+		latest, err := h.db.LatestError(ctx, o.Start, end)
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		o.LatestError = latest
+		return err
+	})
+	run(func() (err error) {
+		o.PerMinute, err = h.db.LogsPerMinute(ctx, o.Start, end)
+		return err
+	})
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	for _, n := range o.Levels {
+		o.TotalLines += n
+	}
+	return o, nil
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestOverviewCacheSharesComputation(t *testing.T) {
+	c := newOverviewCache()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	compute := func() (*logOverview, error) {
+		calls.Add(1)
+		<-release
+		return &logOverview{TotalLines: 42}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*logOverview, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = c.get(time.Hour, compute)
+		}(i)
+	}
+	// Every request is waiting on the first one's computation
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("computed %d times for concurrent requests, want once", n)
+	}
+	for i, r := range results {
+		if r != results[0] || r.TotalLines != 42 {
+			t.Fatalf("request %d got %+v, want the shared result", i, r)
+		}
+	}
+}
+
+func TestOverviewCacheExpiry(t *testing.T) {
+	c := newOverviewCache()
+	var calls int
+	compute := func() (*logOverview, error) {
+		calls++
+		return &logOverview{TotalLines: int64(calls)}, nil
+	}
+
+	first, at, _ := c.get(time.Hour, compute)
+	if second, secondAt, _ := c.get(time.Hour, compute); second != first || !secondAt.Equal(at) {
+		t.Fatalf("fresh entry recomputed: %+v", second)
+	}
+	// Windows are cached separately
+	if other, _, _ := c.get(time.Minute, compute); other == first {
+		t.Fatal("different window served the cached overview")
+	}
+	if calls != 2 {
+		t.Fatalf("computed %d times, want 2", calls)
+	}
+
+	c.entries[time.Hour].at = time.Now().Add(-overviewTTL)
+	if third, _, _ := c.get(time.Hour, compute); third == first || third.TotalLines != 3 {
+		t.Fatalf("expired entry served: %+v", third)
+	}
+}
+
+func TestOverviewCacheDoesNotKeepErrors(t *testing.T) {
+	c := newOverviewCache()
+	boom := errors.New("boom")
+	if _, _, err := c.get(time.Hour, func() (*logOverview, error) { return nil, boom }); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+	got, _, err := c.get(time.Hour, func() (*logOverview, error) { return &logOverview{TotalLines: 1}, nil })
+	if err != nil || got.TotalLines != 1 {
+		t.Fatalf("after a failure got %+v, %v; want a fresh result", got, err)
+	}
+}
+
+func TestGetOverviewWindow(t *testing.T) {
+	h := &Handler{cfg: &config.Config{}, overviews: newOverviewCache()}
+	for _, q := range []string{"window=30s", "window=25h", "window=soon", "window=-1h"} {
+		w := httptest.NewRecorder()
+		h.GetOverview(w, httptest.NewRequest(http.MethodGet, "/api/overview?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+
+	// Served from the cache, which reports its age and the window
+	end := time.Now().UTC()
+	for _, window := range []time.Duration{time.Hour, 15 * time.Minute} {
+		done := make(chan struct{})
+		close(done)
+		h.overviews.entries[window] = &overviewEntry{
+			done:   done,
+			result: &logOverview{Start: end.Add(-window), End: end, TotalLines: 7},
+			at:     time.Now().Add(-2 * time.Second),
+		}
+	}
+	for _, tc := range []struct{ query, window string }{{"", "1h0m0s"}, {"?window=15m", "15m0s"}} {
+		w := httptest.NewRecorder()
+		h.GetOverview(w, httptest.NewRequest(http.MethodGet, "/api/overview"+tc.query, nil))
+		var resp struct {
+			TotalLines int64        `json:"total_lines"`
+			Meta       overviewMeta `json:"meta"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%q: status %d %q", tc.query, w.Code, w.Body)
+		}
+		if resp.TotalLines != 7 || resp.Meta.Window != tc.window || resp.Meta.CacheAgeMs < 2000 || !resp.Meta.End.Equal(end) {
+			t.Errorf("%q: response %+v, want the cached overview for %s about 2s old", tc.query, resp, tc.window)
+		}
+	}
+}
+
+func TestOverviewNumbers(t *testing.T) {
+	h, _ := newTestHandler(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	var logs []models.LogEntry
+	add := func(file, level string, ago time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			logs = append(logs, models.LogEntry{Filename: file, Line: fmt.Sprintf("%s %s %d", file, level, i), LineNum: len(logs) + 1, Level: level, Timestamp: now.Add(-ago)})
+		}
+	}
+	add("/var/log/a.log", "ERROR", 10*time.Minute, 4)
+	add("/var/log/b.log", "error", 20*time.Minute, 2)
+	add("/var/log/b.log", "FATAL", 5*time.Minute, 1)
+	add("/var/log/c.log", "INFO", 30*time.Minute, 10)
+	add("/var/log/c.log", "WARN", 30*time.Minute, 3)
+	// Outside the window
+	add("/var/log/old.log", "ERROR", 2*time.Hour, 50)
+	var files []models.FileNode
+	for _, name := range []string{"a.log", "b.log", "c.log", "old.log"} {
+		files = append(files, models.FileNode{Path: "/var/log/" + name, ParentPath: "/var/log", Name: name, ModTime: now})
+	}
+	if err := h.db.SaveFiles(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.GetOverview(w, httptest.NewRequest(http.MethodGet, "/api/overview?window=1h", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var o struct {
+		logOverview
+		Meta overviewMeta `json:"meta"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.TotalLines != 20 {
+		t.Errorf("total lines = %d, want 20", o.TotalLines)
+	}
+	if o.Levels["ERROR"] != 6 || o.Levels["FATAL"] != 1 || o.Levels["INFO"] != 10 || o.Levels["WARN"] != 3 {
+		t.Errorf("levels = %v", o.Levels)
+	}
+	want := []models.FileErrorCount{{Path: "/var/log/a.log", Errors: 4}, {Path: "/var/log/b.log", Errors: 3}}
+	if len(o.TopErrorFiles) != len(want) || o.TopErrorFiles[0] != want[0] || o.TopErrorFiles[1] != want[1] {
+		t.Errorf("top error files = %+v, want %+v", o.TopErrorFiles, want)
+	}
+	if o.LatestError == nil || o.LatestError.Filename != "/var/log/b.log" || o.LatestError.Level != "FATAL" {
+		t.Errorf("latest error = %+v, want the FATAL line of b.log", o.LatestError)
+	}
+	var perMinute int64
+	for _, m := range o.PerMinute {
+		perMinute += m.Lines
+	}
+	if perMinute != 20 {
+		t.Errorf("per-minute series sums to %d, want 20", perMinute)
+	}
+	if o.Meta.Window != "1h0m0s" || o.Meta.End.Sub(o.Meta.Start) != time.Hour {
+		t.Errorf("meta = %+v, want a 1h window", o.Meta)
+	}
+}
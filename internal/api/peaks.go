@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	defaultPeaksWindow = 7 * 24 * time.Hour
+	defaultPeaksBucket = time.Hour
+	defaultPeaksLimit  = 10
+	maxPeaksLimit      = 100
+	// Bounds the per-bucket totals held while ranking
+	maxPeaksBuckets = 100000
+)
+
+type peaksResponse struct {
+	Metric string               `json:"metric"`
+	Bucket string               `json:"bucket"`
+	Start  time.Time            `json:"start"`
+	End    time.Time            `json:"end"`
+	Peaks  []models.PeriodTotal `json:"peaks"`
+}
+
+// GetNetworkPeaks ranks the busiest periods of network traffic by packet
+// count or byte volume
+func (h *Handler) GetNetworkPeaks(w http.ResponseWriter, r *http.Request) {
+	metric := r.URL.Query().Get("metric")
+	switch metric {
+	case "":
+		metric = db.MetricPackets
+	case db.MetricPackets, db.MetricBytes:
+	default:
+		http.Error(w, "metric must be packets or bytes", http.StatusBadRequest)
+		return
+	}
+	h.getPeaks(w, r, metric)
+}
+
+// GetLogPeaks ranks the busiest periods of log lines
+func (h *Handler) GetLogPeaks(w http.ResponseWriter, r *http.Request) {
+	if metric := r.URL.Query().Get("metric"); metric != "" && metric != db.MetricLogs {
+		http.Error(w, "metric must be logs", http.StatusBadRequest)
+		return
+	}
+	h.getPeaks(w, r, db.MetricLogs)
+}
+
+// getPeaks parses the window, bucket size and limit shared by the peaks
+// endpoints. The window defaults to the last 7 days in 1h buckets.
+func (h *Handler) getPeaks(w http.ResponseWriter, r *http.Request, metric string) {
+	q := r.URL.Query()
+
+	end := time.Now().UTC()
+	if es := q.Get("end"); es != "" {
+		var err error
+		end, err = time.Parse(time.RFC3339, es)
+		if err != nil {
+			http.Error(w, "invalid end time", http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-defaultPeaksWindow)
+	if ss := q.Get("start"); ss != "" {
+		var err error
+		start, err = time.Parse(time.RFC3339, ss)
+		if err != nil {
+			http.Error(w, "invalid start time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	bucket := defaultPeaksBucket
+	if bs := q.Get("bucket"); bs != "" {
+		var err error
+		bucket, err = time.ParseDuration(bs)
+		if err != nil || bucket < time.Minute || bucket%time.Second != 0 {
+			http.Error(w, "bucket must be a whole number of seconds, at least 1m", http.StatusBadRequest)
+			return
+		}
+	}
+	if end.Sub(start)/bucket > maxPeaksBuckets {
+		http.Error(w, "window holds too many buckets; use a larger bucket", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultPeaksLimit
+	if ls := q.Get("limit"); ls != "" {
+		var err error
+		limit, err = strconv.Atoi(ls)
+		if err != nil || limit < 1 || limit > maxPeaksLimit {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+	}
+
+	peaks, err := h.db.GetBusiestPeriods(r.Context(), start, end, bucket, metric, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, peaksResponse{
+		Metric: metric,
+		Bucket: bucket.String(),
+		Start:  start,
+		End:    end,
+		Peaks:  peaks,
+	})
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"diagnostic-client/internal/db"
+)
+
+// Server modes reported by the status endpoints
+const (
+	modePrimary  = "primary"
+	modeReadOnly = "read_only"
+)
+
+func (h *Handler) mode() string {
+	if h.cfg.ReadOnly {
+		return modeReadOnly
+	}
+	return modePrimary
+}
+
+// rejectWrites answers requests that would change stored data with 503, for
+// a read-only server. Requests the route has no operation for are passed
+// on, so the handler can reject the method.
+func (h *Handler) rejectWrites(rt route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rt.writes(r.Method) {
+			http.Error(w, "server is read-only; send changes to the primary", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writes reports whether the route has an operation for method that may
+// change stored data
+func (rt route) writes(method string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return false
+	}
+	for _, op := range rt.ops {
+		if op.method == method && !op.reads {
+			return true
+		}
+	}
+	return false
+}
+
+type serverStatus struct {
+	Mode string `json:"mode"`
+	// Where agents are redirected; read-only servers only
+	PrimaryAgentAddr string           `json:"primary_agent_addr,omitempty"`
+	ConnectedAgents  int              `json:"connected_agents"`
+	Database         db.ReplicaStatus `json:"database"`
+}
+
+// GetStatus reports whether the server is the primary or a read-only
+// standby, and how far behind the database it reads is
+func (h *Handler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	replica, err := h.db.GetReplicaStatus(r.Context())
+	if err != nil {
+		log.Printf("[API] Error getting replica status: %v", err)
+		http.Error(w, "failed to get database status", http.StatusInternalServerError)
+		return
+	}
+
+	status := serverStatus{
+		Mode:            h.mode(),
+		ConnectedAgents: h.tunnel.ConnectedAgents(),
+		Database:        replica,
+	}
+	if h.cfg.ReadOnly {
+		status.PrimaryAgentAddr = h.cfg.PrimaryAgentAddr
+	}
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"diagnostic-client/internal/config"
+)
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	h := &Handler{cfg: &config.Config{ReadOnly: true, AdminToken: "secret"}}
+
+	writes := 0
+	for _, rt := range h.routes() {
+		handler := rt.serve(h)
+		for _, op := range rt.ops {
+			if op.method == http.MethodGet || op.reads {
+				if rt.writes(op.method) {
+					t.Errorf("%s %s only reads but is rejected", op.method, rt.path)
+				}
+				continue
+			}
+			writes++
+			path := op.path
+			if path == "" {
+				path = rt.path
+			}
+			path = pathParam.ReplaceAllString(path, "1")
+			req := httptest.NewRequest(op.method, path, strings.NewReader("{}"))
+			req.Header.Set("X-Admin-Token", "secret")
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s %s on a read-only server: status %d, want 503", op.method, path, w.Code)
+			}
+		}
+	}
+	if writes == 0 {
+		t.Fatal("no write operations found")
+	}
+}
+
+func TestRouteWrites(t *testing.T) {
+	rt := route{ops: []apiOperation{
+		{method: http.MethodGet},
+		{method: http.MethodPost, reads: true},
+		{method: http.MethodDelete},
+	}}
+	for method, want := range map[string]bool{
+		http.MethodGet:    false,
+		http.MethodHead:   false,
+		http.MethodPost:   false,
+		http.MethodDelete: true,
+		// No operation: the handler rejects the method itself
+		http.MethodPut: false,
+	} {
+		if got := rt.writes(method); got != want {
+			t.Errorf("writes(%s) = %v, want %v", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/scheduler"
+	"diagnostic-client/pkg/models"
+)
+
+// Reports handles /api/reports (list and create)
+func (h *Handler) Reports(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		reports, err := h.db.GetReports(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if reports == nil {
+			reports = []models.Report{}
+		}
+		writeJSON(w, http.StatusOK, reports)
+
+	case http.MethodPost:
+		report, err := decodeReport(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.db.CreateReport(r.Context(), report); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := h.reports.Schedule(*report); err != nil {
+			log.Printf("[API] Error scheduling report %d: %v", report.ID, err)
+		}
+
+		writeJSON(w, http.StatusCreated, report)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Report handles /api/reports/{id} and /api/reports/{id}/run
+func (h *Handler) Report(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/reports/")
+	idStr, action, _ := strings.Cut(rest, "/")
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid report id", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "run" && r.Method == http.MethodPost:
+		h.runReport(w, r, id)
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		h.getReport(w, r, id)
+	case r.Method == http.MethodPut:
+		h.updateReport(w, r, id)
+	case r.Method == http.MethodDelete:
+		h.deleteReport(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) getReport(w http.ResponseWriter, r *http.Request, id int64) {
+	report, err := h.db.GetReport(r.Context(), id)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (h *Handler) updateReport(w http.ResponseWriter, r *http.Request, id int64) {
+	report, err := decodeReport(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.ID = id
+
+	if err := h.db.UpdateReport(r.Context(), report); err != nil {
+		writeReportError(w, err)
+		return
+	}
+	if err := h.reports.Schedule(*report); err != nil {
+		log.Printf("[API] Error rescheduling report %d: %v", report.ID, err)
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (h *Handler) deleteReport(w http.ResponseWriter, r *http.Request, id int64) {
+	if err := h.db.DeleteReport(r.Context(), id); err != nil {
+		writeReportError(w, err)
+		return
+	}
+	h.reports.Remove(id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) runReport(w http.ResponseWriter, r *http.Request, id int64) {
+	report, err := h.db.GetReport(r.Context(), id)
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+
+	// force sends an export cut short by MAX_FILE_QUERY_ROWS for this run
+	if r.URL.Query().Get("force") == "true" {
+		params := make(map[string]string, len(report.Params)+1)
+		for k, v := range report.Params {
+			params[k] = v
+		}
+		params["force"] = "true"
+		report.Params = params
+	}
+
+	// Detach from the request so a client disconnect doesn't abort delivery
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	sent, err := h.reports.Run(ctx, report)
+	if errors.Is(err, db.ErrTooManyRows) {
+		writeError(w, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[API] Error running report %d: %v", id, err)
+		http.Error(w, fmt.Sprintf("Error running report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	status := "sent"
+	if !sent {
+		status = "not_sent"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+func decodeReport(r *http.Request) (*models.Report, error) {
+	var report models.Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		return nil, err
+	}
+
+	if report.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if len(report.RecipientEmails) == 0 {
+		return nil, errors.New("at least one recipient email is required")
+	}
+	if report.Format == "" {
+		report.Format = scheduler.FormatJSON
+	}
+	if err := scheduler.ValidateFormat(report.Format); err != nil {
+		return nil, err
+	}
+	if err := scheduler.ValidateQuery(report.Query); err != nil {
+		return nil, err
+	}
+	if err := scheduler.ValidateSchedule(report.Schedule); err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+func writeReportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	}
+	writeError(w, err)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+)
+
+type retentionPreviewResponse struct {
+	Policy string                `json:"policy"`
+	At     time.Time             `json:"at"`
+	Tables []db.RetentionPreview `json:"tables"`
+}
+
+// PreviewRetention counts what a retention pass would delete right now,
+// without deleting anything. With a window it previews deleting every line
+// older than that instead of the configured policy, still sparing held files.
+func (h *Handler) PreviewRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	var cutoffs db.RetentionCutoffs
+	policy := "configured"
+	if ws := r.URL.Query().Get("window"); ws != "" {
+		window, err := config.ParseRetention(ws)
+		if err != nil || window == 0 {
+			http.Error(w, "window must be a positive duration such as 36h or 30d", http.StatusBadRequest)
+			return
+		}
+		cutoffs.Default = now.Add(-window)
+		policy = config.FormatRetention(window)
+		// Legal holds apply whatever the policy
+		if cutoffs.Held, err = h.db.GetHeldFiles(r.Context()); err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		var err error
+		if cutoffs, err = h.retention.Cutoffs(r.Context(), h.db, now); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	tables, err := h.db.PreviewExpiredLogs(r.Context(), cutoffs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, retentionPreviewResponse{Policy: policy, At: now, Tables: tables})
+}
+
+type retentionUsageResponse struct {
+	At time.Time `json:"at"`
+	db.RetentionUsage
+}
+
+// GetRetentionUsage reports how much log storage files on legal hold and
+// files with their own retention window take up
+func (h *Handler) GetRetentionUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	cutoffs, err := h.retention.Cutoffs(r.Context(), h.db, now)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	usage, err := h.db.GetRetentionUsage(r.Context(), cutoffs)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, retentionUsageResponse{At: now, RetentionUsage: usage})
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"net/http"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/jobs"
+	"diagnostic-client/internal/membudget"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+// route is a REST endpoint: the mux pattern and handler it is served by,
+// and the operations it answers, which the OpenAPI document is built from.
+// A pattern ending in a slash serves a subtree, so its operations name the
+// concrete path with {parameters}.
+type route struct {
+	path    string
+	handler http.HandlerFunc
+	// Every operation requires X-Admin-Token
+	admin bool
+	ops   []apiOperation
+}
+
+type apiOperation struct {
+	method  string
+	path    string // Defaults to the route's path
+	summary string
+	params  []apiParam
+	// Zero values of the request and success response bodies; nil for none
+	request  interface{}
+	response interface{}
+	// Media types, default application/json
+	requestType  string
+	responseType string
+	// Success status, default 200
+	status int
+	// Requires X-Admin-Token on a route that is otherwise open
+	admin bool
+	// Doesn't change stored data despite its method, so a read-only server
+	// serves it
+	reads bool
+}
+
+// apiParam is a query parameter, or a path parameter when its name appears
+// in braces in the operation's path. The schema records the constraints
+// the handler enforces.
+type apiParam struct {
+	name        string
+	schema      schema
+	required    bool
+	description string
+}
+
+// serve returns the handler to register for the route
+func (rt route) serve(h *Handler) http.HandlerFunc {
+	handler := rt.handler
+	if h.cfg.ReadOnly {
+		handler = h.rejectWrites(rt, handler)
+	}
+	if rt.admin {
+		handler = h.requireAdmin(handler)
+	}
+	handler = authMiddleware(h.cfg.APIKeys)(handler).ServeHTTP
+	// Outermost, so preflight requests are answered before any other check
+	if cors := h.corsPolicy(rt); cors != nil {
+		handler = cors.withCORS(handler)
+	}
+	return handler
+}
+
+var (
+	startParam   = apiParam{name: "start", schema: dateTimeSchema()}
+	endParam     = apiParam{name: "end", schema: dateTimeSchema(), description: "Default: now"}
+	agentIDParam = apiParam{name: "id", schema: stringSchema(), description: "An agent ID, or default for agents without their own profile"}
+)
+
+// routes lists the REST endpoints. NewServer registers them and describes
+// them in the OpenAPI document, so an endpoint missing here is neither
+// served nor documented.
+func (h *Handler) routes() []route {
+	fileOrder := []apiParam{
+		{name: "sort", schema: enumSchema("name", "size", "mod_time", "last_seen"), description: "Order of siblings. Default: name"},
+		{name: "order", schema: enumSchema("asc", "desc")},
+		{name: "dirs_first", schema: booleanSchema(), description: "Default: true"},
+		{name: "limit", schema: integerSchema(0, db.MaxFileListLimit), description: "Children per directory; 0 is unlimited"},
+		{name: "offset", schema: integerSchema(0, 1<<31-1)},
+	}
+	peaks := []apiParam{
+		{name: "start", schema: dateTimeSchema(), description: "Default: 7 days before end"},
+		endParam,
+		{name: "bucket", schema: durationSchema("1m", ""), description: "Whole seconds. Default: 1h"},
+		{name: "limit", schema: integerSchema(1, maxPeaksLimit), description: "Default: 10"},
+	}
+
+	return []route{
+		{path: "/api/files", handler: h.GetFiles, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the file tree below a path", response: []models.FileNode{}, params: append([]apiParam{
+				{name: "path", schema: stringSchema(), description: "Default: /"},
+				{name: "depth", schema: integerSchema(1, 10), description: "Default: 1"},
+				{name: "view", schema: enumSchema("pinned"), description: "Return the pinned roots instead, as PinnedRoot objects"},
+				{name: "log_counts", schema: booleanSchema(), description: "Set log_count on files, for up to 1000 files. Default: false"},
+				{name: "as_of", schema: dateTimeSchema(), description: "Rebuild the tree as it was then from file history; the files are then wrapped in an object noting approximated fields"},
+			}, fileOrder...)},
+			{method: http.MethodPatch, summary: "Change per-file settings", admin: true, request: filePatch{}, response: filePatchResponse{}, params: []apiParam{
+				{name: "path", schema: stringSchema(), required: true},
+			}},
+		}},
+		{path: "/api/files/pins", handler: h.FilePins, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List pinned paths", response: map[string][]string{}},
+			{method: http.MethodPut, summary: "Replace pinned paths", request: []string{}, response: map[string][]string{}},
+		}},
+		{path: "/api/files/scrape", handler: h.ScrapeFile, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Ask agents to scrape a file", request: scrapeRequest{}, response: map[string]interface{}{}, status: http.StatusAccepted},
+		}},
+		{path: "/api/operations/", handler: h.GetOperation, ops: []apiOperation{
+			{method: http.MethodGet, path: "/api/operations/{id}", summary: "Get the progress of a command", response: models.Operation{}, params: []apiParam{
+				{name: "id", schema: stringSchema()},
+			}},
+		}},
+		{path: "/api/logs", handler: h.GetLogs, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the newest lines of a file", response: models.LogPage{}, params: []apiParam{
+				{name: "file", schema: stringSchema(), required: true},
+				{name: "cursor", schema: stringSchema(), description: "next_cursor of the previous page. Default: the newest lines"},
+				{name: "limit", schema: integerSchema(1, 1000), description: "Lines per page. Default: 100"},
+				{name: "generation", schema: stringSchema(), description: "A generation number or all. Default: the current generation"},
+			}},
+		}},
+		{path: "/api/logs/stream", handler: h.StreamLogs, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Stream a file's lines as they are stored, as server-sent events", response: models.LogEntry{}, responseType: "text/event-stream", params: []apiParam{
+				{name: "file", schema: stringSchema(), required: true, description: "A file path or selector; a read-only server streams a single file"},
+			}},
+		}},
+		{path: "/api/logs/query", handler: h.QueryLogs, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Filter log lines with keyset pagination", request: logQuery{}, response: logQueryPage{}, reads: true},
+		}},
+		{path: "/api/logs/search", handler: h.SearchLogs, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Search log lines across files", request: searchRequest{}, response: []models.LogEntry{}, reads: true},
+		}},
+		{path: "/api/logs/search/cancel", handler: h.CancelSearch, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Cancel a running search", request: cancelSearchRequest{}, response: map[string]string{}, reads: true},
+		}},
+		{path: "/api/logs/entry/", handler: h.GetLogEntry, ops: []apiOperation{
+			{method: http.MethodGet, path: "/api/logs/entry/{id}", summary: "Get a log line with surrounding lines", response: models.LogContext{}, params: []apiParam{
+				{name: "id", schema: schema{"type": "integer", "format": "int64"}},
+				{name: "context", schema: integerSchema(0, 100), description: "Lines before and after. Default: 0"},
+				{name: "generation", schema: enumSchema("all"), description: "Include context from earlier generations"},
+			}},
+		}},
+		{path: "/api/logs/stale", handler: h.GetStaleLogs, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List files that stopped logging", response: models.StaleLogFiles{}, params: []apiParam{
+				{name: "older_than", schema: durationSchema("1ns", ""), description: "Default: 10m"},
+			}},
+		}},
+		{path: "/api/logs/column-stats", handler: h.GetColumnStats, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Summarize a file's lines for choosing log columns", response: columnStatsResponse{}, params: []apiParam{
+				{name: "file", schema: stringSchema(), required: true},
+			}},
+		}},
+		{path: "/api/logs/peaks", handler: h.GetLogPeaks, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Rank the busiest periods of log lines", response: peaksResponse{}, params: append([]apiParam{
+				{name: "metric", schema: enumSchema(db.MetricLogs)},
+			}, peaks...)},
+		}},
+		{path: "/api/network/metrics", handler: h.GetNetworkMetrics, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get stored network packets", response: []models.NetworkPacket{}, params: []apiParam{
+				startParam,
+				{name: "end", schema: dateTimeSchema()},
+				{name: "protocol", schema: stringSchema(), description: "Repeat to match any of several"},
+			}},
+		}},
+		{path: "/api/network/stats", handler: h.GetNetworkStats, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Summarize stored packets", response: models.NetworkStats{}, params: []apiParam{
+				{name: "start", schema: dateTimeSchema(), description: "Default: 1 hour before end"},
+				endParam,
+				{name: "protocol", schema: stringSchema(), description: "Repeat to match any of several"},
+			}},
+		}},
+		{path: "/api/network/top", handler: h.GetTopNetworkStats, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Rank the busiest sources, destinations, protocols and ports", response: models.TopNetworkStats{}, params: []apiParam{
+				{name: "start", schema: dateTimeSchema(), description: "Default: 1 hour before end"},
+				endParam,
+				{name: "protocol", schema: stringSchema(), description: "Repeat to match any of several"},
+				{name: "limit", schema: integerSchema(1, 100), description: "Entries per ranking. Default: 10"},
+			}},
+		}},
+		{path: "/api/network/pps", handler: h.GetPacketRate, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get packet and byte rates", response: models.PacketRate{}, params: []apiParam{
+				{name: "window", schema: durationSchema("1s", "5m"), description: "Live averaging window. Default: 10s"},
+				{name: "start", schema: dateTimeSchema(), description: "Switches to the rate of stored packets"},
+				endParam,
+				{name: "group_by", schema: enumSchema("agent"), description: "Also return the rate of each agent; requires start"},
+			}},
+		}},
+		{path: "/api/network/flows", handler: h.GetNetworkFlows, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Aggregate stored packets into flows", response: []models.NetworkFlow{}, params: []apiParam{
+				{name: "start", schema: dateTimeSchema(), description: "Default: 1 hour before end"},
+				endParam,
+				{name: "protocol", schema: stringSchema(), description: "Repeat to match any of several"},
+				{name: "group_by", schema: enumSchema("agent"), description: "Return each agent's flows separately"},
+				{name: "dedup", schema: booleanSchema(), description: "Merge captures of one flow by several agents"},
+				{name: "tolerance", schema: durationSchema("0s", "1m"), description: "How far apart captures merged by dedup may be. Default: 2s"},
+				{name: "limit", schema: integerSchema(1, maxFlowsLimit), description: "Default: 100"},
+			}},
+		}},
+		{path: "/api/network/stream", handler: h.StreamNetwork, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Stream packets as they are stored, as server-sent events", response: []models.NetworkPacket{}, responseType: "text/event-stream", params: []apiParam{
+				{name: "protocol", schema: stringSchema(), description: "Repeat to match any of several"},
+			}},
+		}},
+		{path: "/api/network/peaks", handler: h.GetNetworkPeaks, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Rank the busiest periods of network traffic", response: peaksResponse{}, params: append([]apiParam{
+				{name: "metric", schema: enumSchema(db.MetricPackets, db.MetricBytes), description: "Default: packets"},
+			}, peaks...)},
+		}},
+		{path: "/api/reports", handler: h.Reports, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List reports", response: []models.Report{}},
+			{method: http.MethodPost, summary: "Create a report", request: models.Report{}, response: models.Report{}, status: http.StatusCreated},
+		}},
+		{path: "/api/reports/", handler: h.Report, ops: []apiOperation{
+			{method: http.MethodGet, path: "/api/reports/{id}", summary: "Get a report", response: models.Report{}, params: reportID},
+			{method: http.MethodPut, path: "/api/reports/{id}", summary: "Update a report", request: models.Report{}, response: models.Report{}, params: reportID},
+			{method: http.MethodDelete, path: "/api/reports/{id}", summary: "Delete a report", status: http.StatusNoContent, params: reportID},
+			{method: http.MethodPost, path: "/api/reports/{id}/run", summary: "Run a report now", response: map[string]string{}, params: []apiParam{
+				reportID[0],
+				{name: "force", schema: booleanSchema(), description: "Send a log_search export cut short by MAX_FILE_QUERY_ROWS"},
+			}},
+		}},
+		{path: "/api/annotations", handler: h.Annotations, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List annotations in a time range", response: []models.Annotation{}, params: []apiParam{
+				{name: "start", schema: dateTimeSchema(), description: "Default: 7 days before end"},
+				endParam,
+			}},
+			{method: http.MethodPost, summary: "Annotate a point in time", request: models.Annotation{}, response: models.Annotation{}, status: http.StatusCreated},
+		}},
+		{path: "/api/annotations/", handler: h.Annotation, ops: []apiOperation{
+			{method: http.MethodDelete, path: "/api/annotations/{id}", summary: "Delete an annotation", status: http.StatusNoContent, params: []apiParam{
+				{name: "id", schema: schema{"type": "integer", "format": "int64"}},
+			}},
+		}},
+		{path: "/api/agents", handler: h.GetAgents, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List agents with their registrations, config versions and drift", response: []agentStatus{}},
+		}},
+		{path: "/api/agents/", handler: h.Agent, ops: []apiOperation{
+			{method: http.MethodGet, path: "/api/agents/{id}/config", summary: "Get an agent's config profile", response: models.AgentConfigProfile{}, params: []apiParam{agentIDParam}},
+			{method: http.MethodPut, path: "/api/agents/{id}/config", summary: "Set an agent's config profile and push it", admin: true, request: models.AgentConfig{}, response: agentConfigUpdate{}, params: []apiParam{agentIDParam}},
+			{method: http.MethodDelete, path: "/api/agents/{id}/config", summary: "Delete an agent's config profile", admin: true, status: http.StatusNoContent, params: []apiParam{agentIDParam}},
+			{method: http.MethodGet, path: "/api/agents/{id}/metrics", summary: "Get an agent's ingest rates over time", response: agentMetricsResponse{}, params: []apiParam{
+				{name: "id", schema: stringSchema()},
+				{name: "start", schema: dateTimeSchema(), description: "Default: 24 hours before end"},
+				endParam,
+			}},
+		}},
+		{path: "/api/agents/summary", handler: h.GetAgentSummary, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Count connected and reporting agents", response: agentSummary{}, params: []apiParam{
+				{name: "since", schema: dateTimeSchema(), description: "Default: ever"},
+			}},
+		}},
+		{path: "/api/overview", handler: h.GetOverview, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Summarize recent log activity", response: overviewResponse{}, params: []apiParam{
+				{name: "window", schema: durationSchema("1m", "24h"), description: "Default: 1h"},
+			}},
+		}},
+		{path: "/api/memory", handler: h.GetMemoryStats, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get ingest buffer memory usage", response: membudget.Stats{}},
+		}},
+		{path: "/api/ingest/stats", handler: h.GetIngestStats, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get ingest counters", response: ingestStats{}},
+		}},
+		{path: "/api/ingest/throughput", handler: h.GetThroughput, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get agent message rates by type and agent", response: tunnel.Throughput{}, params: []apiParam{
+				{name: "window", schema: durationSchema("1s", "5m"), description: "Default: 10s"},
+			}},
+		}},
+		{path: "/api/status", handler: h.GetStatus, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the server mode and database replication status", response: serverStatus{}},
+		}},
+		{path: "/api/openapi.json", handler: h.GetOpenAPI, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get this document", response: map[string]interface{}{}},
+		}},
+
+		// Admin endpoints
+		{path: "/api/admin/explain", handler: h.Explain, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List captured slow query plans", response: []models.QueryPlan{}, params: []apiParam{
+				{name: "limit", schema: integerSchema(1, 500), description: "Default: 50"},
+			}},
+			{method: http.MethodPost, summary: "Explain a named query", request: explainRequest{}, response: map[string]string{}, reads: true},
+		}},
+		{path: "/api/admin/config", handler: h.GetConfig, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the effective configuration, secrets redacted", response: map[string]interface{}{}},
+		}},
+		{path: "/api/admin/jobs", handler: h.GetJobs, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List background jobs", response: []jobs.Status{}},
+		}},
+		{path: "/api/admin/jobs/", handler: h.RunJob, admin: true, ops: []apiOperation{
+			{method: http.MethodPost, path: "/api/admin/jobs/{name}/run", summary: "Run a background job now", status: http.StatusAccepted, response: map[string]string{}, params: []apiParam{
+				{name: "name", schema: stringSchema()},
+			}},
+		}},
+		{path: "/api/admin/settings", handler: h.Settings, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get runtime settings", response: runtimeSettings{}},
+			{method: http.MethodPut, summary: "Change runtime settings", request: runtimeSettings{}, response: runtimeSettings{}},
+		}},
+		{path: "/api/admin/retention/preview", handler: h.PreviewRetention, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Count what a retention pass would delete", response: retentionPreviewResponse{}, params: []apiParam{
+				{name: "window", schema: durationSchema("1ns", ""), description: "Preview deleting every line older than this instead, e.g. 36h or 30d"},
+			}},
+		}},
+		{path: "/api/admin/retention/usage", handler: h.GetRetentionUsage, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the log storage of held and overridden files", response: retentionUsageResponse{}},
+		}},
+		{path: "/api/admin/files/export", handler: h.ExportFiles, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Export the file tree as JSON lines", response: models.FileNode{}, responseType: "application/x-ndjson"},
+		}},
+		{path: "/api/admin/files/import", handler: h.ImportFiles, admin: true, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Import a file tree export", request: models.FileNode{}, requestType: "application/x-ndjson", response: map[string]int{}},
+		}},
+		{path: "/api/admin/files/verify", handler: h.VerifyFiles, admin: true, ops: []apiOperation{
+			{method: http.MethodPost, summary: "Compare the file cache with the database", reads: true, response: tunnel.FileCacheReport{}, params: []apiParam{
+				{name: "repair", schema: booleanSchema(), description: "Reload the cache from the database when they disagree. Default: false"},
+			}},
+		}},
+		{path: "/api/admin/captures", handler: h.Captures, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "List agent message captures", response: []tunnel.CaptureInfo{}},
+			{method: http.MethodPost, summary: "Capture an agent's messages for a while", request: captureRequest{}, response: tunnel.CaptureInfo{}, status: http.StatusCreated},
+			{method: http.MethodDelete, summary: "Stop an agent's running capture", response: tunnel.CaptureInfo{}, params: []apiParam{
+				{name: "agent_id", schema: stringSchema(), required: true},
+			}},
+		}},
+		{path: "/api/admin/captures/", handler: h.Capture, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, path: "/api/admin/captures/{file}", summary: "Download a capture", response: "", responseType: "application/gzip", params: []apiParam{
+				{name: "file", schema: stringSchema()},
+			}},
+		}},
+		{path: "/api/admin/stream-policy", handler: h.StreamPolicy, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the live stream policy", response: tunnel.StreamPolicy{}},
+			{method: http.MethodPut, summary: "Change the live stream policy, optionally for a while", request: streamPolicyRequest{}, response: tunnel.StreamPolicy{}},
+			{method: http.MethodDelete, summary: "Reset the live stream policy to the configured one", response: tunnel.StreamPolicy{}},
+		}},
+		{path: "/api/admin/files/deletion", handler: h.MassDeletion, admin: true, ops: []apiOperation{
+			{method: http.MethodGet, summary: "Get the held mass deletion", response: tunnel.MassDeletion{}},
+			{method: http.MethodPost, summary: "Approve or cancel the held mass deletion", request: massDeletionAction{}, response: tunnel.MassDeletion{}},
+		}},
+	}
+}
+
+var reportID = []apiParam{{name: "id", schema: schema{"type": "integer", "format": "int64"}}}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"diagnostic-client/pkg/models"
+)
+
+// annotateSampling marks files of which only a sample of lines is stored
+func (h *Handler) annotateSampling(files []models.FileNode) {
+	for i := range files {
+		if files[i].IsDirectory {
+			continue
+		}
+		if n := h.tunnel.LogSampling(files[i].Path); n > 1 {
+			files[i].Sampling = n
+		}
+	}
+}
+
+// resultSampling lists the sampled files among logs as file=N pairs, so
+// clients can scale counts; it is empty when none is sampled
+func (h *Handler) resultSampling(logs []models.LogEntry) string {
+	seen := make(map[string]bool)
+	var pairs []string
+	for _, l := range logs {
+		if seen[l.Filename] {
+			continue
+		}
+		seen[l.Filename] = true
+		if n := h.tunnel.LogSampling(l.Filename); n > 1 {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", l.Filename, n))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// samplingRules returns the configured sampling rules by pattern
+func (h *Handler) samplingRules() map[string]int {
+	if len(h.cfg.LogSampling) == 0 {
+		return nil
+	}
+
+	rules := make(map[string]int, len(h.cfg.LogSampling))
+	for _, r := range h.cfg.LogSampling {
+		if _, ok := rules[r.Pattern]; !ok {
+			rules[r.Pattern] = r.KeepOneIn
+		}
+	}
+	return rules
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+// statusClientClosedRequest is the nginx convention for a request abandoned
+// by the client; used when a search is cancelled through the cancel endpoint
+// or superseded by a newer search in its session.
+const statusClientClosedRequest = 499
+
+// searchRegistry tracks in-flight searches by client-supplied request ID and
+// search session so they can be cancelled, which makes pgx cancel the
+// running query.
+type searchRegistry struct {
+	mu       sync.Mutex
+	searches map[string]*inflightSearch
+	sessions map[string]*inflightSearch // newest search of each session
+}
+
+type inflightSearch struct {
+	cancel context.CancelFunc
+}
+
+func newSearchRegistry() *searchRegistry {
+	return &searchRegistry{
+		searches: make(map[string]*inflightSearch),
+		sessions: make(map[string]*inflightSearch),
+	}
+}
+
+// register derives a cancelable context for the search. A search already
+// registered under the same ID, or still running in the same session, is
+// cancelled and replaced. Either key may be empty. The returned func must be
+// called when the search completes.
+func (r *searchRegistry) register(ctx context.Context, requestID, session string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	search := &inflightSearch{cancel: cancel}
+
+	r.mu.Lock()
+	if requestID != "" {
+		if prev, ok := r.searches[requestID]; ok {
+			prev.cancel()
+		}
+		r.searches[requestID] = search
+	}
+	if session != "" {
+		if prev, ok := r.sessions[session]; ok {
+			prev.cancel()
+		}
+		r.sessions[session] = search
+	}
+	r.mu.Unlock()
+
+	return ctx, func() {
+		r.mu.Lock()
+		if requestID != "" && r.searches[requestID] == search {
+			delete(r.searches, requestID)
+		}
+		if session != "" && r.sessions[session] == search {
+			delete(r.sessions, session)
+		}
+		r.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel aborts the search registered under requestID, reporting whether
+// one was found
+func (r *searchRegistry) cancel(requestID string) bool {
+	r.mu.Lock()
+	search, ok := r.searches[requestID]
+	if ok {
+		delete(r.searches, requestID)
+	}
+	r.mu.Unlock()
+
+	if ok {
+		search.cancel()
+	}
+	return ok
+}
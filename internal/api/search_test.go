@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSearchRegistrySessionSupersedes(t *testing.T) {
+	r := newSearchRegistry()
+	ctx := context.Background()
+
+	first, doneFirst := r.register(ctx, "", "tab-1")
+	other, doneOther := r.register(ctx, "", "tab-2")
+	second, doneSecond := r.register(ctx, "", "tab-1")
+	defer doneOther()
+
+	if !errors.Is(first.Err(), context.Canceled) {
+		t.Error("earlier search of the session still running")
+	}
+	if second.Err() != nil || other.Err() != nil {
+		t.Error("newest search or another session's search cancelled")
+	}
+
+	// The superseded search finishing mustn't unregister its successor
+	doneFirst()
+	third, doneThird := r.register(ctx, "", "tab-1")
+	defer doneThird()
+	if !errors.Is(second.Err(), context.Canceled) {
+		t.Error("search not cancelled by the next one after its predecessor finished")
+	}
+	doneSecond()
+	if third.Err() != nil {
+		t.Error("newest search cancelled when an older one finished")
+	}
+}
+
+func TestSearchRegistryRequestIDs(t *testing.T) {
+	r := newSearchRegistry()
+	ctx := context.Background()
+
+	search, done := r.register(ctx, "req-1", "tab-1")
+	if !r.cancel("req-1") {
+		t.Fatal("registered search not found by its request ID")
+	}
+	if !errors.Is(search.Err(), context.Canceled) {
+		t.Error("search still running after cancel")
+	}
+	done()
+	if r.cancel("req-1") {
+		t.Error("finished search found by its request ID")
+	}
+
+	// A search without a request ID can't be cancelled by an empty one
+	_, done = r.register(ctx, "", "tab-1")
+	defer done()
+	if r.cancel("") {
+		t.Error("empty request ID cancelled a search")
+	}
+	if len(r.searches) != 0 || len(r.sessions) != 1 {
+		t.Errorf("%d searches and %d sessions registered, want 0 and 1", len(r.searches), len(r.sessions))
+	}
+}
+
+func TestSearchFailedStatus(t *testing.T) {
+	h := &Handler{}
+	failure := errors.New("query failed")
+
+	// Cancelled on the server, by the cancel endpoint or a newer search
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	h.searchFailed(ctx, w, httptest.NewRequest(http.MethodPost, "/api/logs/search", nil), failure)
+	if w.Code != statusClientClosedRequest {
+		t.Errorf("superseded search: status %d, want %d", w.Code, statusClientClosedRequest)
+	}
+
+	w = httptest.NewRecorder()
+	h.searchFailed(context.Background(), w, httptest.NewRequest(http.MethodPost, "/api/logs/search", nil), failure)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("failed search: status %d, want 500", w.Code)
+	}
+}
+
+func TestOverlappingSearchesInSessionCancelEarlier(t *testing.T) {
+	h, _ := newTestHandler(t, "files")
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	const path = "/var/log/search.log"
+	if err := h.db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "search.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.db.SaveLogs(ctx, []models.LogEntry{{Filename: path, Line: "worker crashed", LineNum: 1, Timestamp: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the logs table so searches block in the database until released
+	conn, err := pgx.Connect(ctx, os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "LOCK TABLE logs IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(query string) chan *httptest.ResponseRecorder {
+		result := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/logs/search",
+				strings.NewReader(`{"query": "`+query+`", "files": ["`+path+`"]}`))
+			r.Header.Set("X-Search-Session", "tab-1")
+			h.SearchLogs(w, r)
+			result <- w
+		}()
+		return result
+	}
+
+	earlier := search("crash")
+	// Let the first search reach the database before the next keystroke
+	time.Sleep(100 * time.Millisecond)
+	later := search("crashed")
+
+	select {
+	case w := <-earlier:
+		if w.Code != statusClientClosedRequest {
+			t.Errorf("earlier search: status %d, want %d", w.Code, statusClientClosedRequest)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("earlier search still running after a newer one started")
+	}
+	select {
+	case w := <-later:
+		t.Fatalf("later search finished while the table was held: %d %s", w.Code, w.Body)
+	default:
+	}
+
+	tx.Rollback(ctx)
+	select {
+	case w := <-later:
+		if w.Code != http.StatusOK {
+			t.Errorf("later search: status %d: %s", w.Code, w.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("later search didn't finish")
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/selector"
+	"diagnostic-client/pkg/models"
+)
+
+// resolveFiles expands the file selectors of a request to file paths. Parse
+// errors wrap db.ErrInvalidQuery, and selectors matching too many files
+// db.ErrTooManyRows. The
+// result is empty, not nil, when selectors were given but match nothing, so
+// callers can tell it apart from "no file filter".
+func (h *Handler) resolveFiles(ctx context.Context, raw []string) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	sels, err := selector.ParseAll(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", db.ErrInvalidQuery, err)
+	}
+	if selector.AllExact(sels) {
+		files := make([]string, len(sels))
+		for i, s := range sels {
+			files[i] = paths.Normalize(s.Literal())
+		}
+		return files, nil
+	}
+	return h.db.ResolveFileSelectors(ctx, sels, selector.MaxFiles)
+}
+
+// setSelectedFiles reports how many files the request's selectors expanded to
+func setSelectedFiles(w http.ResponseWriter, files []string) {
+	if files != nil {
+		w.Header().Set("X-Selected-Files", strconv.Itoa(len(files)))
+	}
+}
+
+// getSelectedLogs serves GetLogs for a prefix or glob: the newest lines
+// across the selected files, in every generation, since generation numbers
+// differ from file to file. Its cursors come from FilterLogs, which orders
+// lines by timestamp and ID.
+func (h *Handler) getSelectedLogs(w http.ResponseWriter, r *http.Request, sel selector.Selector, limit int) {
+	if r.URL.Query().Get("generation") != "" {
+		http.Error(w, "generation requires an exact file path", http.StatusBadRequest)
+		return
+	}
+	var cursor *db.LogCursor
+	if s := r.URL.Query().Get("cursor"); s != "" {
+		var err error
+		if cursor, err = db.ParseLogCursor(s); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	files, err := h.db.ResolveFileSelectors(r.Context(), []selector.Selector{sel}, selector.MaxFiles)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	setSelectedFiles(w, files)
+	if len(files) == 0 {
+		writeJSON(w, http.StatusOK, models.LogPage{Entries: []models.LogEntry{}})
+		return
+	}
+
+	logs, next, err := h.db.FilterLogs(r.Context(), db.LogFilter{Files: files}, cursor, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	page := models.LogPage{Entries: logs}
+	if page.Entries == nil {
+		page.Entries = []models.LogEntry{}
+	}
+	if next != nil {
+		page.NextCursor, page.HasMore = next.String(), true
+	}
+	if sampling := h.resultSampling(page.Entries); sampling != "" {
+		w.Header().Set("X-Log-Sampling", sampling)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
@@ -2,74 +2,210 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
+	"diagnostic-client/internal/clock"
 	"diagnostic-client/internal/config"
 	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/jobs"
+	"diagnostic-client/internal/membudget"
+	"diagnostic-client/internal/realip"
+	"diagnostic-client/internal/scheduler"
 	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/internal/ui"
 	"diagnostic-client/internal/websocket"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type Server struct {
-	cfg    *config.Config
-	db     *db.DB
-	tunnel *tunnel.Handler
-	ws     *websocket.Handler
-	http   *Handler
-	server *http.Server
+	cfg       *config.Config
+	db        *db.DB
+	tunnel    *tunnel.Handler
+	ws        *websocket.Handler
+	http      *Handler
+	reports   *scheduler.CronRunner
+	budget    *membudget.Budget
+	retention *scheduler.Retention
+	jobs      *jobs.Scheduler
+	server    *http.Server
+	// Set when agents connect through the HTTP server (AGENT_ADDR=shared)
+	agentIngress *tunnel.WSIngress
 }
 
 func NewServer(cfg *config.Config, db *db.DB) *Server {
 	// Initialize components
-	tunnelHandler := tunnel.NewHandler(cfg, db)
-	wsHandler := websocket.NewHandler(cfg, tunnelHandler)
-	httpHandler := NewHandler(db)
+	clk := clock.Real{}
+	proxies := realip.New(cfg.TrustedProxies)
+	tunnelHandler := tunnel.NewHandler(cfg, db, clk)
+	wsHandler := websocket.NewHandler(cfg, tunnelHandler, db, proxies, clk)
+	reportRunner := scheduler.NewCronRunner(cfg, db, clk)
+
+	budget := membudget.New(cfg.MemoryCeiling)
+	for _, c := range tunnelHandler.MemoryComponents() {
+		budget.Register(c)
+	}
+
+	retention := scheduler.NewRetention(cfg, clk)
+
+	// Background jobs. They all write, so a read-only server runs none.
+	jobRunner := jobs.New(clk)
+	if !cfg.ReadOnly {
+		for _, j := range tunnelHandler.Jobs() {
+			jobRunner.Register(j)
+		}
+		// Delete log lines past their retention window
+		jobRunner.Register(jobs.Job{Name: "retention", Interval: cfg.RetentionInterval, Run: func(ctx context.Context) error {
+			return retention.Apply(ctx, db)
+		}})
+		// Drop or archive logs from before files were truncated
+		if scheduler.GenerationCompactionEnabled(cfg) {
+			jobRunner.Register(jobs.Job{Name: "generation_compaction", Interval: cfg.GenerationCompactInterval, Run: func(ctx context.Context) error {
+				return scheduler.CompactGenerations(ctx, cfg, db)
+			}})
+		}
+		// Check archived generations against the manifests compaction wrote
+		if cfg.OldGenerations == scheduler.GenerationsArchive {
+			jobRunner.Register(jobs.Job{Name: "archive_verification", Interval: cfg.ArchiveVerifyInterval, Run: func(ctx context.Context) error {
+				return scheduler.VerifyArchive(ctx, cfg, db)
+			}})
+		}
+	}
+
+	httpHandler := NewHandler(cfg, db, tunnelHandler, reportRunner, budget, retention, jobRunner, clk)
+	if len(cfg.APIKeys) == 0 {
+		log.Printf("[API] API_KEYS is not set: the REST API and websocket accept unauthenticated requests")
+	}
 
 	// Create server with routing
 	mux := http.NewServeMux()
 
+	// Probes for orchestrators and load balancers, which carry no API key
+	mux.HandleFunc("/healthz", httpHandler.Health)
+
+	// Prometheus scrapes, which can send an API key as a bearer token
+	if cfg.MetricsEnabled {
+		mux.Handle("/metrics", authMiddleware(cfg.APIKeys)(metricsHandler(tunnelHandler.Collector())))
+	}
+
 	// WebSocket endpoint
-	mux.HandleFunc("/ws", wsHandler.ServeWS)
+	mux.Handle("/ws", authMiddleware(cfg.APIKeys)(http.HandlerFunc(wsHandler.ServeWS)))
+
+	// Agents share the HTTP port instead of having their own
+	var agentIngress *tunnel.WSIngress
+	if cfg.AgentAddr == config.AgentAddrShared && acceptsAgents(cfg) {
+		agentIngress = tunnel.NewWSIngress(proxies.ClientIP)
+		mux.Handle("/agent/ws", agentIngress)
+	}
 
 	// REST endpoints
-	mux.HandleFunc("/api/files", httpHandler.GetFiles)
-	mux.HandleFunc("/api/logs", httpHandler.GetLogs)
-	mux.HandleFunc("/api/logs/search", httpHandler.SearchLogs)
-	mux.HandleFunc("/api/network/metrics", httpHandler.GetNetworkMetrics)
+	routes := httpHandler.routes()
+	for _, rt := range routes {
+		mux.HandleFunc(rt.path, rt.serve(httpHandler))
+	}
+	doc, err := json.Marshal(openAPIDocument(routes))
+	if err != nil {
+		log.Printf("[API] Error generating OpenAPI document: %v", err)
+	}
+	httpHandler.openAPI = doc
+
+	// Embedded web UI, the catch-all for paths no other route matches
+	if cfg.UIEnabled {
+		mux.Handle("/", ui.Handler())
+	}
 
 	// Create HTTP server with timeouts
 	server := &http.Server{
 		Addr:         cfg.ServerAddr,
-		Handler:      mux,
+		Handler:      logRequests(proxies, mux),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	// End event streams, which Shutdown would otherwise wait out
+	server.RegisterOnShutdown(tunnelHandler.CloseNetworkSubscriptions)
 
 	return &Server{
-		cfg:    cfg,
-		db:     db,
-		tunnel: tunnelHandler,
-		ws:     wsHandler,
-		http:   httpHandler,
-		server: server,
+		cfg:       cfg,
+		db:        db,
+		tunnel:    tunnelHandler,
+		ws:        wsHandler,
+		http:      httpHandler,
+		reports:   reportRunner,
+		budget:    budget,
+		retention: retention,
+		jobs:      jobRunner,
+		server:    server,
+
+		agentIngress: agentIngress,
 	}
 }
 
+// metricsHandler serves the metrics packages register on the default
+// registry, along with collectors belonging to this server
+func metricsHandler(collectors ...prometheus.Collector) http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors...)
+	return promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{})
+}
+
+// acceptsAgents reports whether the server takes agent connections. A
+// read-only server only does to redirect agents to the primary, when it
+// knows where that is.
+func acceptsAgents(cfg *config.Config) bool {
+	return !cfg.ReadOnly || cfg.PrimaryAgentAddr != ""
+}
+
 func (s *Server) Run(ctx context.Context) error {
-	// Start tunnel server in background
-	tunnelServer, err := tunnel.NewServer(s.cfg, s.tunnel)
-	if err != nil {
-		log.Printf("Tunnel server error: %v", err)
+	// Settings changed through the API override the environment
+	if err := s.http.loadSettings(ctx); err != nil {
+		log.Printf("Settings error: %v", err)
 		return err
 	}
-	go func() {
-		if err := tunnelServer.Run(ctx); err != nil {
-			log.Printf("Tunnel server error: %v", err)
+
+	// Start tunnel server in background
+	tunnelDone := make(chan struct{})
+	if !acceptsAgents(s.cfg) {
+		log.Printf("Read-only mode: not accepting agents")
+		close(tunnelDone)
+	} else {
+		var ingress tunnel.Ingress = s.agentIngress
+		if s.agentIngress == nil {
+			l, err := tunnel.Listen(ctx, s.cfg)
+			if err != nil {
+				log.Printf("Tunnel server error: %v", err)
+				return fmt.Errorf("failed to create listener: %w", err)
+			}
+			ingress = l
 		}
-	}()
+		tunnelServer := tunnel.NewServer(s.cfg, s.tunnel, ingress)
+		go func() {
+			defer close(tunnelDone)
+			if err := tunnelServer.Run(ctx); err != nil {
+				log.Printf("Tunnel server error: %v", err)
+			}
+		}()
+	}
+
+	// Enforce the memory ceiling on ingest buffers
+	go s.budget.Run(ctx, 500*time.Millisecond)
+
+	// Run background jobs
+	s.jobs.Start(ctx)
+
+	// Start report scheduler. The primary mails reports, so a read-only
+	// server doesn't send them a second time.
+	if !s.cfg.ReadOnly {
+		if err := s.reports.Start(ctx); err != nil {
+			log.Printf("Report scheduler error: %v", err)
+		}
+		defer s.reports.Stop()
+	}
 
 	// Start HTTP server
 	go func() {
@@ -88,5 +224,12 @@ func (s *Server) Run(ctx context.Context) error {
 	defer cancel()
 
 	// Graceful shutdown
-	return s.server.Shutdown(shutdownCtx)
+	err := s.server.Shutdown(shutdownCtx)
+
+	// Store buffered agent data once agents are disconnected and jobs
+	// no longer flush it
+	<-tunnelDone
+	s.jobs.Wait()
+	s.tunnel.Close()
+	return err
 }
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	srv := httptest.NewServer(authMiddleware([]string{"k1"})(metricsHandler()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("scrape without a key: status %d, want 401", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Authorization", "Bearer k1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, name := range []string{
+		`tunnel_messages_received_total{type="log_data"}`,
+		"tunnel_active_connections",
+		`db_batch_insert_duration_seconds_count{table="logs"}`,
+		"log_entries_ingested_total",
+		"network_packets_ingested_total",
+		"websocket_active_connections",
+		"file_cache_size",
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("scrape lacks %s", name)
+		}
+	}
+}
+
+func TestUIEnabledConfig(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg, d := openTestDB(t)
+		cfg.UIEnabled = enabled
+		s := NewServer(cfg, d)
+		t.Cleanup(s.tunnel.Close)
+		w := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		served := w.Code == http.StatusOK && strings.Contains(w.Body.String(), "<html")
+		if served != enabled {
+			t.Errorf("UIEnabled %v: status %d, page served %v", enabled, w.Code, served)
+		}
+
+		w = httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/unknown", nil))
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "<html") {
+			t.Errorf("UIEnabled %v: unknown API path status %d, want a plain 404", enabled, w.Code)
+		}
+	}
+}
+
+func TestFakeAgentThroughSharedPort(t *testing.T) {
+	cfg, d := openTestDB(t, "files")
+	cfg.AgentAddr = config.AgentAddrShared
+	s := NewServer(cfg, d)
+	t.Cleanup(s.tunnel.Close)
+	if s.agentIngress == nil {
+		t.Fatal("shared mode without an agent ingress")
+	}
+	srv := httptest.NewServer(s.server.Handler)
+	defer srv.Close()
+
+	// What Run starts for agents, without the dedicated listener
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnelDone := make(chan error, 1)
+	go func() { tunnelDone <- tunnel.NewServer(cfg, s.tunnel, s.agentIngress).Run(ctx) }()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/agent/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	send := func(typ tunnel.MessageType, payload interface{}) {
+		t.Helper()
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := json.Marshal(tunnel.Message{Type: typ, Payload: data})
+		if err := ws.WriteMessage(websocket.TextMessage, append(msg, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	const path = "/var/log/shared.log"
+	send(tunnel.TypeLogList, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "shared.log", ModTime: now}})
+	send(tunnel.TypeLogData, []models.LogEntry{
+		{Filename: path, Line: "over the shared port", LineNum: 1, Timestamp: now},
+		{Filename: path, Line: "and stored", LineNum: 2, Timestamp: now},
+	})
+
+	// Lines are batched, so wait for them to be stored
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		page, err := d.GetLogs(context.Background(), path, "", 10, db.AllGenerations)
+		if err == nil && len(page.Entries) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lines not stored: %+v, %v", page, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The API answers on the same port
+	resp, err := http.Get(srv.URL + "/api/files?path=/var/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), path) {
+		t.Errorf("file tree over the shared port: %d %s", resp.StatusCode, body)
+	}
+
+	// Shutting down closes the agent's connection and stops accepting
+	cancel()
+	select {
+	case <-tunnelDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel server didn't stop")
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/agent/ws", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("agent upgrade after shutdown: status %d, want 503", w.Code)
+	}
+}
+
+func TestDedicatedAgentPortLeavesHTTPAlone(t *testing.T) {
+	cfg, d := openTestDB(t)
+	cfg.AgentAddr = "127.0.0.1:0"
+	// The UI would answer unknown paths with its page
+	cfg.UIEnabled = false
+	s := NewServer(cfg, d)
+	t.Cleanup(s.tunnel.Close)
+
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/agent/ws", nil))
+	if s.agentIngress != nil || w.Code != http.StatusNotFound {
+		t.Errorf("dedicated mode: ingress %v, /agent/ws status %d; want none and 404", s.agentIngress, w.Code)
+	}
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/scheduler"
+)
+
+// Keys of the persisted settings in the settings table
+const (
+	settingIgnorePaths  = "ignore_paths"
+	settingLogRetention = "log_retention"
+	settingMinPayload   = "min_payload_size"
+)
+
+// runtimeSettings are the settings that can be changed without a restart.
+// Fields left out of a PUT body keep their current values.
+type runtimeSettings struct {
+	IgnorePaths    *[]string          `json:"ignore_paths,omitempty"`
+	LogRetention   *retentionSettings `json:"log_retention,omitempty"`
+	MinPayloadSize *int               `json:"min_payload_size,omitempty"`
+}
+
+// retentionSettings is the wire form of a retention policy, with windows
+// written like LOG_RETENTION; an empty window keeps lines forever
+type retentionSettings struct {
+	Default string            `json:"default"`
+	Levels  map[string]string `json:"levels"`
+}
+
+func (s retentionSettings) policy() (scheduler.RetentionPolicy, error) {
+	var p scheduler.RetentionPolicy
+	var err error
+	if p.Default, err = config.ParseRetention(s.Default); err != nil {
+		return p, err
+	}
+
+	p.Levels = make(map[string]time.Duration, len(s.Levels))
+	for level, window := range s.Levels {
+		if level == "" {
+			return p, fmt.Errorf("empty level in retention rules")
+		}
+		if p.Levels[level], err = config.ParseRetention(window); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func retentionSettingsOf(p scheduler.RetentionPolicy) retentionSettings {
+	s := retentionSettings{
+		Default: config.FormatRetention(p.Default),
+		Levels:  make(map[string]string, len(p.Levels)),
+	}
+	for level, d := range p.Levels {
+		s.Levels[level] = config.FormatRetention(d)
+	}
+	return s
+}
+
+// Settings returns (GET) or changes (PUT) the runtime settings. Changes are
+// persisted and override the environment on later starts.
+func (h *Handler) Settings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req runtimeSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Validate everything before applying anything
+		if req.IgnorePaths != nil {
+			if err := paths.ValidatePatterns(*req.IgnorePaths); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.MinPayloadSize != nil && *req.MinPayloadSize < 0 {
+			http.Error(w, "min_payload_size must not be negative", http.StatusBadRequest)
+			return
+		}
+		var retention scheduler.RetentionPolicy
+		if req.LogRetention != nil {
+			var err error
+			if retention, err = req.LogRetention.policy(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if req.IgnorePaths != nil {
+			if err := h.db.SetSetting(r.Context(), settingIgnorePaths, *req.IgnorePaths); err != nil {
+				writeError(w, err)
+				return
+			}
+			if err := h.tunnel.SetIgnorePaths(r.Context(), *req.IgnorePaths); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		if req.LogRetention != nil {
+			if err := h.db.SetSetting(r.Context(), settingLogRetention, req.LogRetention); err != nil {
+				writeError(w, err)
+				return
+			}
+			h.retention.SetPolicy(retention)
+		}
+		if req.MinPayloadSize != nil {
+			if err := h.db.SetSetting(r.Context(), settingMinPayload, *req.MinPayloadSize); err != nil {
+				writeError(w, err)
+				return
+			}
+			h.tunnel.SetMinPayloadSize(*req.MinPayloadSize)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ignorePaths := h.tunnel.IgnorePaths()
+	retention := retentionSettingsOf(h.retention.Policy())
+	minPayloadSize := h.tunnel.MinPayloadSize()
+	writeJSON(w, http.StatusOK, runtimeSettings{
+		IgnorePaths:    &ignorePaths,
+		LogRetention:   &retention,
+		MinPayloadSize: &minPayloadSize,
+	})
+}
+
+// loadSettings applies the persisted settings over those from the
+// environment. Settings never changed through the API keep their
+// environment values.
+func (h *Handler) loadSettings(ctx context.Context) error {
+	var ignorePaths []string
+	switch err := h.db.GetSetting(ctx, settingIgnorePaths, &ignorePaths); {
+	case errors.Is(err, db.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("load %s: %w", settingIgnorePaths, err)
+	default:
+		if err := h.tunnel.SetIgnorePaths(ctx, ignorePaths); err != nil {
+			return fmt.Errorf("apply %s: %w", settingIgnorePaths, err)
+		}
+		log.Printf("[API] Using stored ignore paths %v", ignorePaths)
+	}
+
+	var retention retentionSettings
+	switch err := h.db.GetSetting(ctx, settingLogRetention, &retention); {
+	case errors.Is(err, db.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("load %s: %w", settingLogRetention, err)
+	default:
+		p, err := retention.policy()
+		if err != nil {
+			return fmt.Errorf("apply %s: %w", settingLogRetention, err)
+		}
+		h.retention.SetPolicy(p)
+		log.Printf("[API] Using stored log retention %+v", retention)
+	}
+
+	var minPayloadSize int
+	switch err := h.db.GetSetting(ctx, settingMinPayload, &minPayloadSize); {
+	case errors.Is(err, db.ErrNotFound):
+	case err != nil:
+		return fmt.Errorf("load %s: %w", settingMinPayload, err)
+	default:
+		h.tunnel.SetMinPayloadSize(minPayloadSize)
+		log.Printf("[API] Using stored minimum payload size %d", minPayloadSize)
+	}
+
+	return nil
+}
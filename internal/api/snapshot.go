@@ -0,0 +1,91 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ExportFiles streams the whole file tree as JSON lines for backup or for
+// cloning a collector
+func (h *Handler) ExportFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Large trees take longer than the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("[API] Error lifting write deadline for file export: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="files-`+time.Now().UTC().Format("20060102T150405Z")+`.jsonl"`)
+
+	// The status is sent with the first line, so later failures can only
+	// cut the stream short; a truncated export fails to import cleanly
+	n, err := h.db.ExportFileTree(r.Context(), w)
+	if err != nil {
+		log.Printf("[API] File export stopped after %d files: %v", n, err)
+		return
+	}
+	log.Printf("[API] Exported %d files", n)
+}
+
+// ImportFiles upserts file nodes from a JSON lines export and reloads the
+// tunnel's file cache so the import takes effect immediately
+func (h *Handler) ImportFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("[API] Error lifting read deadline for file import: %v", err)
+	}
+
+	n, err := h.db.ImportFileTree(r.Context(), r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Printf("[API] Imported %d files", n)
+
+	if err := h.tunnel.ReloadFileCache(r.Context()); err != nil {
+		http.Error(w, "files imported but reloading the file cache failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"imported": n})
+}
+
+// VerifyFiles compares the tunnel's file cache with the files table and
+// reports where they disagree. With repair=true a disagreeing cache is
+// reloaded from the table.
+func (h *Handler) VerifyFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var repair bool
+	if v := r.URL.Query().Get("repair"); v != "" {
+		var err error
+		if repair, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid repair", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := h.tunnel.VerifyFileCache(r.Context(), repair)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if report.Repaired {
+		log.Printf("[API] File cache reloaded after verification")
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+// Comment lines sent on an idle stream, so proxies don't close it
+const streamKeepAlive = 15 * time.Second
+
+// StreamNetwork streams packets as server-sent events once they are stored.
+// Each batch the tunnel flushes is sent as packets events of up to
+// StreamBatchSize packets, optionally only those of the given protocols.
+// Event IDs are seq:next, the batch's sequence number and the index in the
+// batch after the event's last packet, so a client reconnecting with
+// Last-Event-ID continues from there while the batches are still buffered.
+func (h *Handler) StreamNetwork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		after  uint64
+		next   int
+		resume bool
+	)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		if after, next, err = parseStreamEventID(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resume = true
+	}
+
+	protocols := make(map[string]bool)
+	for _, p := range r.URL.Query()["protocol"] {
+		protocols[p] = true
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("[API] Error clearing write deadline of network stream: %v", err)
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The batch named by Last-Event-ID may be partly sent; it is replayed
+	// from next and the ones after it in full
+	sub, backlog, complete := h.tunnel.SubscribeNetwork(after-min(after, 1), resume)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(batch tunnel.NetworkBatch, from int) error {
+		if err := h.writePacketEvents(w, batch, from, protocols); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if resume && !complete {
+		// Batches after the client's last event were evicted or are from
+		// before a restart; it should backfill from /api/network/metrics
+		fmt.Fprintf(w, "event: gap\ndata: {}\n\n")
+	}
+	for _, batch := range backlog {
+		from := 0
+		if batch.Seq == after {
+			from = next
+		}
+		if err := send(batch, from); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := h.clock.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Evicted():
+			fmt.Fprintf(w, "event: evicted\ndata: {}\n\n")
+			rc.Flush()
+			return
+		case batch := <-sub.Batches():
+			if err := send(batch, 0); err != nil {
+				return
+			}
+		case <-keepAlive.C():
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writePacketEvents writes the batch's packets from index from on, filtered
+// by protocol, in events of up to StreamBatchSize packets
+func (h *Handler) writePacketEvents(w http.ResponseWriter, batch tunnel.NetworkBatch, from int, protocols map[string]bool) error {
+	chunk := make([]models.NetworkPacket, 0, h.cfg.StreamBatchSize)
+	flush := func(end int) error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			log.Printf("[API] Error encoding packet event: %v", err)
+			return err
+		}
+		chunk = chunk[:0]
+		_, err = fmt.Fprintf(w, "id: %d:%d\nevent: packets\ndata: %s\n\n", batch.Seq, end, data)
+		return err
+	}
+
+	for i := from; i < len(batch.Packets); i++ {
+		p := batch.Packets[i]
+		if len(protocols) > 0 && !protocols[p.Protocol] {
+			continue
+		}
+		chunk = append(chunk, p)
+		if len(chunk) == h.cfg.StreamBatchSize {
+			if err := flush(i + 1); err != nil {
+				return err
+			}
+		}
+	}
+	return flush(len(batch.Packets))
+}
+
+// parseStreamEventID parses a seq:next event ID
+func parseStreamEventID(id string) (uint64, int, error) {
+	seqPart, nextPart, ok := strings.Cut(id, ":")
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if !ok || err != nil {
+		return 0, 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+	}
+	next, err := strconv.Atoi(nextPart)
+	if err != nil || next < 0 {
+		return 0, 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+	}
+	return seq, next, nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"diagnostic-client/internal/tunnel"
+)
+
+// Bounds of the stream policy settings
+const (
+	maxStreamSamplingFloor = 64
+	maxStreamWindowMs      = 60000
+	maxStreamPolicyTTL     = 24 * time.Hour
+)
+
+// streamPolicyRequest changes the stream policy. Fields left out keep their
+// current values; ttl, a Go duration, reverts the whole policy to the
+// configured one after it.
+type streamPolicyRequest struct {
+	tunnel.StreamPolicy
+	TTL string `json:"ttl,omitempty"`
+}
+
+// StreamPolicy returns (GET), changes (PUT) or resets to the configured
+// defaults (DELETE) the live stream policy. Changes apply to connected
+// clients right away and are announced to them in stream_quality.
+func (h *Handler) StreamPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.tunnel.StreamPolicy())
+	case http.MethodPut:
+		req := streamPolicyRequest{StreamPolicy: h.tunnel.StreamPolicy()}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validStreamPolicy(req.StreamPolicy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 || ttl > maxStreamPolicyTTL {
+				http.Error(w, fmt.Sprintf("ttl must be a positive duration up to %v", maxStreamPolicyTTL), http.StatusBadRequest)
+				return
+			}
+		}
+
+		p := h.tunnel.SetStreamPolicy(req.StreamPolicy, ttl)
+		log.Printf("[API] Stream policy set to %+v for %v [%s]", p, ttl, w.Header().Get("X-Request-ID"))
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodDelete:
+		p := h.tunnel.ResetStreamPolicy()
+		log.Printf("[API] Stream policy reset to %+v [%s]", p, w.Header().Get("X-Request-ID"))
+		writeJSON(w, http.StatusOK, p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func validStreamPolicy(p tunnel.StreamPolicy) error {
+	if p.Network.SamplingFloor < 1 || p.Network.SamplingFloor > maxStreamSamplingFloor {
+		return fmt.Errorf("network.sampling_floor must be between 1 and %d", maxStreamSamplingFloor)
+	}
+	if p.Logs.BatchWindowMs < 0 || p.Logs.BatchWindowMs > maxStreamWindowMs {
+		return fmt.Errorf("logs.batch_window_ms must be between 0 and %d", maxStreamWindowMs)
+	}
+	if p.FileUpdates.CoalesceWindowMs < 0 || p.FileUpdates.CoalesceWindowMs > maxStreamWindowMs {
+		return fmt.Errorf("file_updates.coalesce_window_ms must be between 0 and %d", maxStreamWindowMs)
+	}
+	return nil
+}
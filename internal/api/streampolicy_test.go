@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/tunnel"
+)
+
+func TestValidStreamPolicy(t *testing.T) {
+	valid := tunnel.StreamPolicy{
+		Network:     tunnel.NetworkStreamPolicy{RawPackets: true, SamplingFloor: 1},
+		Logs:        tunnel.LogStreamPolicy{BatchWindowMs: 100},
+		FileUpdates: tunnel.FileUpdateStreamPolicy{CoalesceWindowMs: 500},
+	}
+	tests := []struct {
+		name   string
+		adjust func(*tunnel.StreamPolicy)
+		ok     bool
+	}{
+		{"valid", func(*tunnel.StreamPolicy) {}, true},
+		{"windows off", func(p *tunnel.StreamPolicy) { p.Logs.BatchWindowMs, p.FileUpdates.CoalesceWindowMs = 0, 0 }, true},
+		{"largest", func(p *tunnel.StreamPolicy) {
+			p.Network.SamplingFloor, p.Logs.BatchWindowMs, p.FileUpdates.CoalesceWindowMs = maxStreamSamplingFloor, maxStreamWindowMs, maxStreamWindowMs
+		}, true},
+		{"floor 0", func(p *tunnel.StreamPolicy) { p.Network.SamplingFloor = 0 }, false},
+		{"floor too high", func(p *tunnel.StreamPolicy) { p.Network.SamplingFloor = maxStreamSamplingFloor + 1 }, false},
+		{"negative log window", func(p *tunnel.StreamPolicy) { p.Logs.BatchWindowMs = -1 }, false},
+		{"log window too long", func(p *tunnel.StreamPolicy) { p.Logs.BatchWindowMs = maxStreamWindowMs + 1 }, false},
+		{"negative file window", func(p *tunnel.StreamPolicy) { p.FileUpdates.CoalesceWindowMs = -1 }, false},
+		{"file window too long", func(p *tunnel.StreamPolicy) { p.FileUpdates.CoalesceWindowMs = maxStreamWindowMs + 1 }, false},
+	}
+	for _, tt := range tests {
+		p := valid
+		tt.adjust(&p)
+		if err := validStreamPolicy(p); (err == nil) != tt.ok {
+			t.Errorf("%s: validStreamPolicy(%+v) = %v, want ok %v", tt.name, p, err, tt.ok)
+		}
+	}
+}
+
+func TestStreamPolicyEndpoint(t *testing.T) {
+	h, tun := newTestHandler(t)
+	configured := tun.DefaultStreamPolicy()
+
+	serve := func(method, body string) (*httptest.ResponseRecorder, tunnel.StreamPolicy) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.StreamPolicy(rec, httptest.NewRequest(method, "/api/admin/stream-policy", strings.NewReader(body)))
+		var p tunnel.StreamPolicy
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec, p
+	}
+
+	// Fields left out keep their values
+	before := time.Now()
+	rec, p := serve(http.MethodPut, `{"logs": {"batch_window_ms": 2000}, "ttl": "10m"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	if p.Logs.BatchWindowMs != 2000 || p.Network != configured.Network || p.FileUpdates != configured.FileUpdates {
+		t.Errorf("policy after PUT = %+v, want only the log window changed from %+v", p, configured)
+	}
+	if p.ExpiresAt == nil || p.ExpiresAt.Before(before.Add(10*time.Minute)) {
+		t.Errorf("expires at %v, want ten minutes from now", p.ExpiresAt)
+	}
+	if got := tun.StreamPolicy(); got.Logs.BatchWindowMs != 2000 {
+		t.Errorf("tunnel policy = %+v, want the PUT applied", got)
+	}
+	if _, p := serve(http.MethodGet, ""); p.Logs.BatchWindowMs != 2000 {
+		t.Errorf("GET = %+v, want the PUT policy", p)
+	}
+
+	for _, body := range []string{
+		`{"network": {"sampling_floor": 0}}`,
+		`{"logs": {"batch_window_ms": -1}}`,
+		`{"ttl": "forever"}`,
+		`{"ttl": "-1m"}`,
+		`{"ttl": "25h"}`,
+		`not json`,
+	} {
+		if rec, _ := serve(http.MethodPut, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want 400", body, rec.Code)
+		}
+	}
+	if got := tun.StreamPolicy(); got.Logs.BatchWindowMs != 2000 {
+		t.Errorf("tunnel policy after rejected PUTs = %+v, want it unchanged", got)
+	}
+
+	if rec, p := serve(http.MethodDelete, ""); rec.Code != http.StatusOK || p != configured {
+		t.Errorf("DELETE = %d %+v, want the configured %+v", rec.Code, p, configured)
+	}
+	if rec, _ := serve(http.MethodPost, ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fired returns the time sent on c, if any
+func fired(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(epoch)
+	timer := f.NewTimer(time.Second)
+
+	f.Advance(999 * time.Millisecond)
+	if _, ok := fired(timer.C()); ok {
+		t.Fatal("timer fired early")
+	}
+	f.Advance(time.Millisecond)
+	if at, ok := fired(timer.C()); !ok || !at.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("timer fired = %v at %v, want at %v", ok, at, epoch.Add(time.Second))
+	}
+	if f.Waiters() != 0 {
+		t.Fatalf("fired timer still waiting")
+	}
+
+	if timer.Reset(time.Minute) {
+		t.Error("Reset of a fired timer reports it active")
+	}
+	if !timer.Stop() {
+		t.Error("Stop of a pending timer reports it inactive")
+	}
+	f.Advance(time.Hour)
+	if _, ok := fired(timer.C()); ok {
+		t.Error("stopped timer fired")
+	}
+}
+
+func TestFakeTickerDropsMissedTicks(t *testing.T) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// Like time.Ticker, ticks nobody received in time are dropped
+	f.Advance(5 * time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("first tick = %v at %v, want at %v", ok, at, epoch.Add(time.Second))
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Fatal("missed ticks were queued")
+	}
+	f.Advance(time.Second)
+	if at, ok := fired(ticker.C()); !ok || !at.Equal(epoch.Add(6*time.Second)) {
+		t.Fatalf("next tick = %v at %v, want at %v", ok, at, epoch.Add(6*time.Second))
+	}
+	if !f.Now().Equal(epoch.Add(6 * time.Second)) {
+		t.Fatalf("Now = %v after advancing 6s", f.Now())
+	}
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	f := NewFake(epoch)
+	late := f.After(2 * time.Second)
+	early := f.After(time.Second)
+	now := f.After(0)
+
+	if _, ok := fired(now); !ok {
+		t.Fatal("After(0) didn't fire at once")
+	}
+	f.Advance(3 * time.Second)
+	e, _ := fired(early)
+	l, _ := fired(late)
+	if !e.Equal(epoch.Add(time.Second)) || !l.Equal(epoch.Add(2*time.Second)) {
+		t.Fatalf("fired at %v and %v, want each at its own due time", e, l)
+	}
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSharedAgentAddrRejectsListenerSettings(t *testing.T) {
+	keys := []string{"AGENT_ADDR", "AGENT_REUSE_PORT", "AGENT_LISTEN_BACKLOG", "AGENT_TLS_CERT_FILE", "AGENT_TLS_KEY_FILE"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{name: "shared", env: map[string]string{"AGENT_ADDR": "shared"}},
+		{name: "dedicated port tuned", env: map[string]string{"AGENT_ADDR": ":8081", "AGENT_REUSE_PORT": "true", "AGENT_LISTEN_BACKLOG": "128"}},
+		{name: "shared with reuse port", env: map[string]string{"AGENT_ADDR": "shared", "AGENT_REUSE_PORT": "true"}, err: "AGENT_REUSE_PORT"},
+		{name: "shared with backlog", env: map[string]string{"AGENT_ADDR": "shared", "AGENT_LISTEN_BACKLOG": "128"}, err: "AGENT_LISTEN_BACKLOG"},
+		{name: "shared with TLS", env: map[string]string{"AGENT_ADDR": "shared", "AGENT_TLS_CERT_FILE": "agent.pem", "AGENT_TLS_KEY_FILE": "agent.key"}, err: "AGENT_TLS_CERT_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range keys {
+				if value, ok := tt.env[key]; ok {
+					t.Setenv(key, value)
+				} else {
+					unsetenv(t, key)
+				}
+			}
+
+			c, err := Load()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.AgentAddr != tt.env["AGENT_ADDR"] {
+					t.Errorf("AgentAddr = %q", c.AgentAddr)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load() error = %v, want one naming %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAgentTLSSettings(t *testing.T) {
+	keys := []string{"AGENT_ADDR", "AGENT_TLS_CERT_FILE", "AGENT_TLS_KEY_FILE", "AGENT_TLS_CA_FILE"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{name: "TLS", env: map[string]string{"AGENT_TLS_CERT_FILE": "agent.pem", "AGENT_TLS_KEY_FILE": "agent.key"}},
+		{name: "mutual TLS", env: map[string]string{"AGENT_TLS_CERT_FILE": "agent.pem", "AGENT_TLS_KEY_FILE": "agent.key", "AGENT_TLS_CA_FILE": "ca.pem"}},
+		{name: "certificate without key", env: map[string]string{"AGENT_TLS_CERT_FILE": "agent.pem"}, err: "AGENT_TLS_KEY_FILE"},
+		{name: "key without certificate", env: map[string]string{"AGENT_TLS_KEY_FILE": "agent.key"}, err: "AGENT_TLS_CERT_FILE"},
+		{name: "CA without certificate", env: map[string]string{"AGENT_TLS_CA_FILE": "ca.pem"}, err: "AGENT_TLS_CA_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range keys {
+				if value, ok := tt.env[key]; ok {
+					t.Setenv(key, value)
+				} else {
+					unsetenv(t, key)
+				}
+			}
+
+			c, err := Load()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.TLSCertFile != tt.env["AGENT_TLS_CERT_FILE"] || c.TLSCAFile != tt.env["AGENT_TLS_CA_FILE"] {
+					t.Errorf("TLS files = %q, %q", c.TLSCertFile, c.TLSCAFile)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load() error = %v, want one naming %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCORSOriginsFallBackToAllowedOrigins(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://a.example")
+	unsetenv(t, "CORS_ORIGINS")
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.CORSOrigins) != 1 || c.CORSOrigins[0] != "https://a.example" {
+		t.Errorf("CORSOrigins = %v, want ALLOWED_ORIGINS", c.CORSOrigins)
+	}
+
+	// Set but empty turns REST CORS off
+	t.Setenv("CORS_ORIGINS", "")
+	if c, err = Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.CORSOrigins) != 0 {
+		t.Errorf("CORSOrigins = %v with CORS_ORIGINS empty, want none", c.CORSOrigins)
+	}
+
+	unsetenv(t, "CORS_ORIGINS")
+	t.Setenv("ALLOWED_ORIGINS", "a.example")
+	if _, err = Load(); err == nil || !strings.Contains(err.Error(), "ALLOWED_ORIGINS") {
+		t.Errorf("Load() error = %v, want one naming ALLOWED_ORIGINS", err)
+	}
+}
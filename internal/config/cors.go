@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// adminPrefix is never opened to cross-origin requests, whatever the rules
+const adminPrefix = "/api/admin"
+
+// CORSRule sets the origins allowed to call API routes whose path starts
+// with Prefix, instead of CORS_ORIGINS. No origins turns CORS off for them.
+type CORSRule struct {
+	Prefix  string
+	Origins []string
+}
+
+// ParseCORSRules parses prefix=origins rules such as
+// "/api/files=https://a.example|https://b.example". Origins are separated
+// by |, * allows any, and an empty list turns CORS off for the prefix.
+func ParseCORSRules(rules []string) ([]CORSRule, error) {
+	parsed := make([]CORSRule, 0, len(rules))
+	for _, rule := range rules {
+		prefix, list, ok := strings.Cut(rule, "=")
+		prefix = strings.TrimSpace(prefix)
+		if !ok || !strings.HasPrefix(prefix, "/api/") {
+			return nil, fmt.Errorf("rule %q must be /api/prefix=origins", rule)
+		}
+		if strings.HasPrefix(prefix, adminPrefix) {
+			return nil, fmt.Errorf("rule %q: admin endpoints never allow cross-origin requests", rule)
+		}
+
+		var origins []string
+		for _, origin := range strings.Split(list, "|") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+		if err := ValidateOrigins(origins); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule, err)
+		}
+		parsed = append(parsed, CORSRule{Prefix: prefix, Origins: origins})
+	}
+	return parsed, nil
+}
+
+// ValidateOrigins checks that each origin is * or a bare scheme://host[:port]
+func ValidateOrigins(origins []string) error {
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return fmt.Errorf("invalid origin %q, want scheme://host[:port]", origin)
+		}
+	}
+	return nil
+}
+
+// CORSOriginsFor returns the origins allowed to call the API route at path:
+// those of the longest matching CORS_ROUTES prefix, else CORS_ORIGINS.
+// Admin routes allow none.
+func (c *Config) CORSOriginsFor(path string) []string {
+	if strings.HasPrefix(path, adminPrefix) {
+		return nil
+	}
+
+	origins, matched := c.CORSOrigins, ""
+	for _, rule := range c.CORSRoutes {
+		if strings.HasPrefix(path, rule.Prefix) && len(rule.Prefix) > len(matched) {
+			origins, matched = rule.Origins, rule.Prefix
+		}
+	}
+	return origins
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Fair scheduling modes of the live packet stream, see STREAM_FAIRNESS
+const (
+	StreamFairnessOff        = "off"
+	StreamFairnessRoundRobin = "round_robin"
+	StreamFairnessWeighted   = "weighted"
+)
+
+// ParseAgentWeights parses agent=N weights such as "10.0.0.5=4"
+func ParseAgentWeights(weights []string) (map[string]int, error) {
+	parsed := make(map[string]int, len(weights))
+	for _, w := range weights {
+		i := strings.LastIndex(w, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("weight %q must be agent=N", w)
+		}
+		agent := strings.TrimSpace(w[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(w[i+1:]))
+		if err != nil || n < 1 || n > 1000 {
+			return nil, fmt.Errorf("weight %q must be between 1 and 1000", w)
+		}
+		if _, dup := parsed[agent]; dup {
+			return nil, fmt.Errorf("agent %s weighted twice", agent)
+		}
+		parsed[agent] = n
+	}
+	return parsed, nil
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Targets used to derive and check buffer sizes against expected ingest rates
+const (
+	// Each client's stream buffers should absorb this long a burst without
+	// dropping
+	targetBufferedSeconds = 10
+	// Beyond this, buffered data is stale and a shutdown loses minutes of it
+	maxBufferedSeconds = 60
+	// More inserts per second than this means batches are too small
+	maxInsertsPerSecond = 50
+	// Websocket network messages per second when deriving StreamBatchSize
+	streamMessagesPerSecond = 10
+
+	minBatchSize = 100
+	maxBatchSize = 10000
+
+	// Rough in-memory size of a decoded packet, for worst-case estimates
+	approxPacketBytes = 200
+)
+
+// deriveLimits fills batch and buffer sizes from the expected peak rates,
+// when they are given, so that the knobs agree with each other. Sizes set
+// in the environment are kept; malformed ones are derived as if unset.
+func (c *Config) deriveLimits() {
+	if pps := float64(c.ExpectedMaxPPS); pps > 0 {
+		if !envIntSet("BATCH_SIZE") {
+			c.BatchSize = clampInt(int(pps*c.NetworkFlushInterval.Seconds()), minBatchSize, maxBatchSize)
+			c.derived = append(c.derived, "BatchSize")
+		}
+		if !envIntSet("STREAM_BATCH_SIZE") {
+			c.StreamBatchSize = clampInt(int(pps/streamMessagesPerSecond), 10, c.BatchSize)
+			c.derived = append(c.derived, "StreamBatchSize")
+		}
+		// The stream buffer holds whole flushed batches
+		if !envIntSet("NETWORK_BUFFER_SIZE") {
+			c.NetworkBufferSize = int(math.Ceil(targetBufferedSeconds * pps / float64(c.BatchSize)))
+			c.derived = append(c.derived, "NetworkBufferSize")
+		}
+	}
+
+	if lps := c.ExpectedMaxLPS; lps > 0 && !envIntSet("LOG_BUFFER_SIZE") {
+		c.LogBufferSize = clampInt(lps*targetBufferedSeconds, 100, 100000)
+		c.derived = append(c.derived, "LogBufferSize")
+	}
+}
+
+// validateLimits rejects settings that cannot work and returns warnings for
+// combinations that work badly
+func (c *Config) validateLimits() (warnings []string, err error) {
+	for _, knob := range []struct {
+		name  string
+		value int
+	}{
+		{"LogBufferSize", c.LogBufferSize},
+		{"NetworkBufferSize", c.NetworkBufferSize},
+		{"BatchSize", c.BatchSize},
+		{"StreamBatchSize", c.StreamBatchSize},
+	} {
+		if knob.value <= 0 {
+			return nil, fmt.Errorf("%s must be positive, got %d", knob.name, knob.value)
+		}
+	}
+	if c.NetworkFlushInterval <= 0 {
+		return nil, fmt.Errorf("NETWORK_FLUSH_INTERVAL_MS must be positive")
+	}
+	if c.StreamBatchSize > c.BatchSize {
+		return nil, fmt.Errorf("StreamBatchSize (%d) exceeds BatchSize (%d)", c.StreamBatchSize, c.BatchSize)
+	}
+
+	// A flushed batch is never larger than what arrives within one interval
+	batchPackets := float64(c.BatchSize)
+	if pps := float64(c.ExpectedMaxPPS); pps > 0 {
+		batchPackets = math.Min(batchPackets, math.Max(1, pps*c.NetworkFlushInterval.Seconds()))
+
+		buffered := float64(c.NetworkBufferSize) * batchPackets / pps
+		if buffered > maxBufferedSeconds {
+			warnings = append(warnings, fmt.Sprintf(
+				"network stream buffer holds up to %.0fs of traffic at %d pps; streamed data can be minutes stale",
+				buffered, c.ExpectedMaxPPS))
+		}
+
+		if inserts := pps / float64(c.BatchSize); inserts > maxInsertsPerSecond {
+			warnings = append(warnings, fmt.Sprintf(
+				"BatchSize %d means %.0f packet inserts per second at %d pps",
+				c.BatchSize, inserts, c.ExpectedMaxPPS))
+		}
+	}
+
+	worstCase := int64(float64(c.NetworkBufferSize) * batchPackets * approxPacketBytes)
+	if worstCase > c.MemoryCeiling {
+		warnings = append(warnings, fmt.Sprintf(
+			"a client's full network stream buffer needs ~%d MB, above the %d MB memory ceiling; the budget will shed it under load",
+			worstCase>>20, c.MemoryCeiling>>20))
+	}
+
+	if lps := c.ExpectedMaxLPS; lps > 0 && c.LogBufferSize < lps {
+		warnings = append(warnings, fmt.Sprintf(
+			"log stream buffer (%d) holds under a second at %d lines/s; bursts will drop streamed lines",
+			c.LogBufferSize, lps))
+	}
+
+	if c.IngestWriteTimeout > 0 && c.IngestWriteTimeout <= c.FailoverTimeout {
+		warnings = append(warnings, fmt.Sprintf(
+			"ingest writes time out after %v, before a failover of up to %v is waited out",
+			c.IngestWriteTimeout, c.FailoverTimeout))
+	}
+
+	return warnings, nil
+}
+
+// Warnings lists questionable setting combinations found by Load
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// Limits describes the effective batch and buffer settings, marking the ones
+// derived from EXPECTED_MAX_PPS/LPS
+func (c *Config) Limits() string {
+	derived := make(map[string]bool, len(c.derived))
+	for _, name := range c.derived {
+		derived[name] = true
+	}
+
+	var b strings.Builder
+	line := func(name string, v interface{}) {
+		fmt.Fprintf(&b, "  %-20s %v", name, v)
+		if derived[name] {
+			b.WriteString(" (derived)")
+		}
+		b.WriteString("\n")
+	}
+	line("ExpectedMaxPPS", c.ExpectedMaxPPS)
+	line("ExpectedMaxLPS", c.ExpectedMaxLPS)
+	line("NetworkFlushInterval", c.NetworkFlushInterval.Round(time.Millisecond))
+	line("BatchSize", c.BatchSize)
+	line("StreamBatchSize", c.StreamBatchSize)
+	line("NetworkBufferSize", c.NetworkBufferSize)
+	line("LogBufferSize", c.LogBufferSize)
+	line("MemoryCeiling", fmt.Sprintf("%d MB", c.MemoryCeiling>>20))
+	return b.String()
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeriveLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want Config
+	}{
+		{
+			name: "defaults",
+			want: Config{BatchSize: 10000, StreamBatchSize: 100, NetworkBufferSize: 64, LogBufferSize: 1000},
+		},
+		{
+			name: "derived from rates",
+			env:  map[string]string{"EXPECTED_MAX_PPS": "1000", "EXPECTED_MAX_LPS": "500"},
+			want: Config{BatchSize: 5000, StreamBatchSize: 100, NetworkBufferSize: 2, LogBufferSize: 5000},
+		},
+		{
+			name: "set sizes kept",
+			env:  map[string]string{"EXPECTED_MAX_PPS": "1000", "EXPECTED_MAX_LPS": "500", "BATCH_SIZE": "2000", "LOG_BUFFER_SIZE": "300"},
+			want: Config{BatchSize: 2000, StreamBatchSize: 100, NetworkBufferSize: 5, LogBufferSize: 300},
+		},
+		{
+			name: "malformed sizes derived as if unset",
+			env:  map[string]string{"EXPECTED_MAX_PPS": "1000", "EXPECTED_MAX_LPS": "500", "NETWORK_BUFFER_SIZE": "lots", "LOG_BUFFER_SIZE": "1e3"},
+			want: Config{BatchSize: 5000, StreamBatchSize: 100, NetworkBufferSize: 2, LogBufferSize: 5000},
+		},
+		{
+			name: "malformed size without rates falls back to default",
+			env:  map[string]string{"LOG_BUFFER_SIZE": "big"},
+			want: Config{BatchSize: 10000, StreamBatchSize: 100, NetworkBufferSize: 64, LogBufferSize: 1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"EXPECTED_MAX_PPS", "EXPECTED_MAX_LPS", "BATCH_SIZE", "STREAM_BATCH_SIZE", "NETWORK_BUFFER_SIZE", "LOG_BUFFER_SIZE"} {
+				if value, ok := tt.env[key]; ok {
+					t.Setenv(key, value)
+				} else {
+					unsetenv(t, key)
+				}
+			}
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			c, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := [4]int{c.BatchSize, c.StreamBatchSize, c.NetworkBufferSize, c.LogBufferSize}
+			want := [4]int{tt.want.BatchSize, tt.want.StreamBatchSize, tt.want.NetworkBufferSize, tt.want.LogBufferSize}
+			if got != want {
+				t.Errorf("batch, stream batch, network buffer, log buffer = %v, want %v", got, want)
+			}
+			for key, value := range tt.env {
+				if _, err := strconv.Atoi(value); err != nil && !strings.Contains(logged.String(), key) {
+					t.Errorf("malformed %s not logged", key)
+				}
+			}
+		})
+	}
+}
+
+// unsetenv removes key for the rest of the test
+func unsetenv(t *testing.T, key string) {
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestDeriveLimitsClamps(t *testing.T) {
+	for _, key := range []string{"BATCH_SIZE", "STREAM_BATCH_SIZE", "NETWORK_BUFFER_SIZE", "LOG_BUFFER_SIZE"} {
+		unsetenv(t, key)
+	}
+	tests := []struct {
+		name     string
+		pps, lps int
+		want     [4]int // Batch, stream batch, network buffer, log buffer
+	}{
+		{name: "trickle", pps: 5, lps: 1, want: [4]int{100, 10, 1, 100}},
+		{name: "flood", pps: 1000000, lps: 50000, want: [4]int{10000, 10000, 1000, 100000}},
+		{name: "moderate", pps: 20000, lps: 2000, want: [4]int{10000, 2000, 20, 20000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{ExpectedMaxPPS: tt.pps, ExpectedMaxLPS: tt.lps, NetworkFlushInterval: 5 * time.Second}
+			c.deriveLimits()
+			if got := [4]int{c.BatchSize, c.StreamBatchSize, c.NetworkBufferSize, c.LogBufferSize}; got != tt.want {
+				t.Errorf("batch, stream batch, network buffer, log buffer = %v, want %v", got, tt.want)
+			}
+			if len(c.derived) != 4 {
+				t.Errorf("derived = %v, want all four", c.derived)
+			}
+		})
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			BatchSize:            1000,
+			StreamBatchSize:      100,
+			NetworkBufferSize:    10,
+			LogBufferSize:        1000,
+			NetworkFlushInterval: time.Second,
+			MemoryCeiling:        512 << 20,
+			ExpectedMaxPPS:       1000,
+			ExpectedMaxLPS:       100,
+		}
+	}
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		err     string
+		warning string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{name: "zero log buffer", change: func(c *Config) { c.LogBufferSize = 0 }, err: "LogBufferSize must be positive"},
+		{name: "negative network buffer", change: func(c *Config) { c.NetworkBufferSize = -1 }, err: "NetworkBufferSize must be positive"},
+		{name: "zero batch", change: func(c *Config) { c.BatchSize = 0 }, err: "BatchSize must be positive"},
+		{name: "zero stream batch", change: func(c *Config) { c.StreamBatchSize = 0 }, err: "StreamBatchSize must be positive"},
+		{name: "zero flush interval", change: func(c *Config) { c.NetworkFlushInterval = 0 }, err: "NETWORK_FLUSH_INTERVAL_MS must be positive"},
+		{name: "stream batch over batch", change: func(c *Config) { c.StreamBatchSize = 2000 }, err: "exceeds BatchSize"},
+		{name: "stale stream buffer", change: func(c *Config) { c.NetworkBufferSize = 100 }, warning: "streamed data can be minutes stale"},
+		{name: "small batches", change: func(c *Config) { c.ExpectedMaxPPS = 200000; c.BatchSize = 1000; c.NetworkBufferSize = 1 }, warning: "packet inserts per second"},
+		{name: "buffer over memory ceiling", change: func(c *Config) { c.MemoryCeiling = 1 << 20 }, warning: "above the 1 MB memory ceiling"},
+		{name: "buffer over ceiling without rates", change: func(c *Config) { c.ExpectedMaxPPS = 0; c.MemoryCeiling = 1 << 20 }, warning: "memory ceiling"},
+		{name: "log buffer under a second", change: func(c *Config) { c.ExpectedMaxLPS = 5000 }, warning: "log stream buffer (1000) holds under a second"},
+		{name: "write timeout before failover", change: func(c *Config) { c.IngestWriteTimeout = time.Second; c.FailoverTimeout = 2 * time.Second }, warning: "before a failover"},
+		{name: "write timeout after failover", change: func(c *Config) { c.IngestWriteTimeout = 3 * time.Second; c.FailoverTimeout = 2 * time.Second }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(c)
+			warnings, err := c.validateLimits()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.warning == "" {
+				if len(warnings) > 0 {
+					t.Errorf("warnings = %q, want none", warnings)
+				}
+				return
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], tt.warning) {
+				t.Errorf("warnings = %q, want one about %q", warnings, tt.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// Fields tagged redact are hidden by Redacted: "all" replaces the whole
+// value and "password" only the password of a URL, keeping the host
+// visible. New secrets only need the tag.
+const redactedValue = "REDACTED"
+
+// Redacted returns the effective configuration by field name with secrets
+// hidden, for display. Durations are written like "1m30s" and networks in
+// CIDR notation.
+func (c *Config) Redacted() map[string]interface{} {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		out[f.Name] = redactValue(v.Field(i).Interface(), f.Tag.Get("redact"))
+	}
+	out["Warnings"] = append([]string{}, c.Warnings()...)
+	return out
+}
+
+func redactValue(value interface{}, mode string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactString(v, mode)
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = redactString(s, mode)
+		}
+		return out
+	case time.Duration:
+		return v.String()
+	case map[string]time.Duration:
+		out := make(map[string]string, len(v))
+		for k, d := range v {
+			out[k] = d.String()
+		}
+		return out
+	case []*net.IPNet:
+		out := make([]string, len(v))
+		for i, n := range v {
+			out[i] = n.String()
+		}
+		return out
+	}
+	if mode != "" && !reflect.ValueOf(value).IsZero() {
+		return redactedValue
+	}
+	return value
+}
+
+func redactString(s, mode string) string {
+	if s == "" {
+		return s
+	}
+	switch mode {
+	case "":
+		return s
+	case "password":
+		// Connection strings in key=value form aren't parsed, so they are
+		// hidden whole
+		if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+			if q := u.Query(); q.Has("password") {
+				q.Set("password", "xxxxx")
+				u.RawQuery = q.Encode()
+			}
+			return u.Redacted()
+		}
+	}
+	return redactedValue
+}
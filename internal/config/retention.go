@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseRetention parses a retention window. Besides Go durations such as
+// "36h" it accepts whole days such as "7d"; an empty string means keep
+// forever and returns 0.
+func ParseRetention(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	var d time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid retention %q", s)
+		}
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("negative retention %q", s)
+	}
+	return d, nil
+}
+
+// ParseLevelRetention parses LEVEL=window rules such as "DEBUG=24h". Levels
+// are upper-cased, since they are matched case-insensitively.
+func ParseLevelRetention(rules []string) (map[string]time.Duration, error) {
+	levels := make(map[string]time.Duration, len(rules))
+	for _, rule := range rules {
+		level, window, ok := strings.Cut(rule, "=")
+		level = strings.ToUpper(strings.TrimSpace(level))
+		if !ok || level == "" {
+			return nil, fmt.Errorf("rule %q must be LEVEL=window", rule)
+		}
+		d, err := ParseRetention(window)
+		if err != nil {
+			return nil, err
+		}
+		levels[level] = d
+	}
+	return levels, nil
+}
+
+// FormatRetention is the inverse of ParseRetention, using days where the
+// window is a whole number of them
+func FormatRetention(d time.Duration) string {
+	switch {
+	case d <= 0:
+		return ""
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	default:
+		return d.String()
+	}
+}
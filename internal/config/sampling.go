@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"diagnostic-client/internal/paths"
+)
+
+// SamplingRule stores only one in KeepOneIn log lines of files matching
+// Pattern, a path prefix or glob as in IGNORE_PATHS
+type SamplingRule struct {
+	Pattern   string
+	KeepOneIn int
+}
+
+// ParseSamplingRules parses pattern=N rules such as
+// "/var/log/nginx/access.log*=10". Their order is kept, since the first
+// rule matching a file applies.
+func ParseSamplingRules(rules []string) ([]SamplingRule, error) {
+	parsed := make([]SamplingRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("rule %q must be pattern=N", rule)
+		}
+		pattern := strings.TrimSpace(rule[:i])
+		n, err := strconv.Atoi(strings.TrimSpace(rule[i+1:]))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("rule %q must keep 1 in a positive number of lines", rule)
+		}
+		if err := paths.ValidatePatterns([]string{pattern}); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, SamplingRule{Pattern: pattern, KeepOneIn: n})
+	}
+	return parsed, nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestParseSamplingRules(t *testing.T) {
+	rules, err := ParseSamplingRules([]string{
+		"/var/log/nginx/access.log*=10",
+		" /var/log/app = 3 ",
+		"/var/log/a=b.log=2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SamplingRule{
+		{Pattern: "/var/log/nginx/access.log*", KeepOneIn: 10},
+		{Pattern: "/var/log/app", KeepOneIn: 3},
+		// The count follows the last '=', so patterns may contain one
+		{Pattern: "/var/log/a=b.log", KeepOneIn: 2},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("rules = %+v, want %+v", rules, want)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("rule %d = %+v, want %+v", i, rules[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{"/var/log/x.log", "=10", "/var/log/x.log=0", "/var/log/x.log=-2", "/var/log/x.log=ten", "/var/log/[x.log=10"} {
+		if _, err := ParseSamplingRules([]string{bad}); err == nil {
+			t.Errorf("%q parsed, want an error", bad)
+		}
+	}
+}
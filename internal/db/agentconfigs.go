@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const agentConfigColumns = `agent_id, version, config, updated_at`
+
+func scanAgentConfig(row pgx.Row) (models.AgentConfigProfile, error) {
+	var (
+		p   models.AgentConfigProfile
+		raw []byte
+	)
+	if err := row.Scan(&p.AgentID, &p.Version, &raw, &p.UpdatedAt); err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(raw, &p.Config); err != nil {
+		return p, fmt.Errorf("decode config of %s: %w", p.AgentID, err)
+	}
+	return p, nil
+}
+
+// GetAgentConfigs lists the stored agent config profiles by agent ID
+func (db *DB) GetAgentConfigs(ctx context.Context) ([]models.AgentConfigProfile, error) {
+	rows, err := db.pool.Query(ctx, `SELECT `+agentConfigColumns+` FROM agent_configs ORDER BY agent_id`)
+	if err != nil {
+		return nil, fmt.Errorf("query agent configs: %w", err)
+	}
+	defer rows.Close()
+
+	profiles, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.AgentConfigProfile, error) {
+		return scanAgentConfig(row)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan agent configs: %w", err)
+	}
+	return profiles, nil
+}
+
+// GetAgentConfig retrieves the profile stored under agentID
+func (db *DB) GetAgentConfig(ctx context.Context, agentID string) (*models.AgentConfigProfile, error) {
+	p, err := scanAgentConfig(db.pool.QueryRow(ctx,
+		`SELECT `+agentConfigColumns+` FROM agent_configs WHERE agent_id = $1`, agentID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query agent config %s: %w", agentID, err)
+	}
+	return &p, nil
+}
+
+// GetEffectiveAgentConfig retrieves the config an agent should run: its own
+// profile, else the default one. ErrNotFound means neither exists.
+func (db *DB) GetEffectiveAgentConfig(ctx context.Context, agentID string) (*models.AgentConfigProfile, error) {
+	p, err := scanAgentConfig(db.pool.QueryRow(ctx, `
+		SELECT `+agentConfigColumns+`
+		FROM agent_configs
+		WHERE agent_id IN ($1, $2)
+		ORDER BY agent_id = $2
+		LIMIT 1`,
+		agentID, models.DefaultAgentProfile))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query effective config of %s: %w", agentID, err)
+	}
+	return &p, nil
+}
+
+// PutAgentConfig creates or replaces the profile of agentID under a new
+// version
+func (db *DB) PutAgentConfig(ctx context.Context, agentID string, config models.AgentConfig) (*models.AgentConfigProfile, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("encode agent config: %w", err)
+	}
+
+	p, err := scanAgentConfig(db.pool.QueryRow(ctx, `
+		INSERT INTO agent_configs (agent_id, version, config)
+		VALUES ($1, nextval('agent_config_versions'), $2)
+		ON CONFLICT (agent_id) DO UPDATE
+		SET version = EXCLUDED.version, config = EXCLUDED.config, updated_at = CURRENT_TIMESTAMP
+		RETURNING `+agentConfigColumns,
+		agentID, raw))
+	if err != nil {
+		return nil, fmt.Errorf("store agent config %s: %w", agentID, err)
+	}
+	return &p, nil
+}
+
+// DeleteAgentConfig removes the profile of agentID
+func (db *DB) DeleteAgentConfig(ctx context.Context, agentID string) error {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM agent_configs WHERE agent_id = $1`, agentID)
+	if err != nil {
+		return fmt.Errorf("delete agent config %s: %w", agentID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SaveAgentConfigAck records the config version an agent applied
+func (db *DB) SaveAgentConfigAck(ctx context.Context, ack models.AgentConfigAck) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO agent_config_acks (agent_id, profile, version, error)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (agent_id) DO UPDATE
+		SET profile = EXCLUDED.profile, version = EXCLUDED.version,
+		    error = EXCLUDED.error, acked_at = CURRENT_TIMESTAMP`,
+		ack.AgentID, ack.Profile, ack.Version, ack.Error)
+	if err != nil {
+		return fmt.Errorf("store config ack of %s: %w", ack.AgentID, err)
+	}
+	return nil
+}
+
+// GetAgentConfigAcks lists the last config ack of every agent
+func (db *DB) GetAgentConfigAcks(ctx context.Context) ([]models.AgentConfigAck, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT agent_id, profile, version, error, acked_at
+		FROM agent_config_acks
+		ORDER BY agent_id`)
+	if err != nil {
+		return nil, fmt.Errorf("query config acks: %w", err)
+	}
+	defer rows.Close()
+
+	acks, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.AgentConfigAck, error) {
+		var a models.AgentConfigAck
+		err := row.Scan(&a.AgentID, &a.Profile, &a.Version, &a.Error, &a.AckedAt)
+		return a, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan config acks: %w", err)
+	}
+	return acks, nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Rates QuietAgents can look at, by the column holding them
+var agentRateColumns = map[string]string{
+	"lines":   "lines_per_second",
+	"packets": "packets_per_second",
+	"bytes":   "bytes_per_second",
+}
+
+// SaveAgentMetrics stores one sample per agent, all taken at the same time
+func (db *DB) SaveAgentMetrics(ctx context.Context, samples map[string]models.AgentMetric) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	var (
+		ids                         []string
+		times                       []time.Time
+		lines, packets, bytesPerSec []float64
+	)
+	for id, m := range samples {
+		ids = append(ids, id)
+		times = append(times, m.Time)
+		lines = append(lines, m.LinesPerSecond)
+		packets = append(packets, m.PacketsPerSecond)
+		bytesPerSec = append(bytesPerSec, m.BytesPerSecond)
+	}
+
+	return db.withFailover(ctx, db.pool, "save agent metrics", func() error {
+		_, err := db.pool.Exec(ctx, `
+			INSERT INTO agent_metrics (agent_id, time, lines_per_second, packets_per_second, bytes_per_second)
+			SELECT * FROM unnest($1::text[], $2::timestamptz[], $3::float8[], $4::float8[], $5::float8[])
+			ON CONFLICT DO NOTHING`,
+			ids, times, lines, packets, bytesPerSec)
+		return err
+	})
+}
+
+// GetAgentMetrics returns an agent's samples in [start, end), oldest first
+func (db *DB) GetAgentMetrics(ctx context.Context, agentID string, start, end time.Time) ([]models.AgentMetric, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT time, lines_per_second, packets_per_second, bytes_per_second
+		FROM agent_metrics
+		WHERE agent_id = $1 AND time >= $2 AND time < $3
+		ORDER BY time`,
+		agentID, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("query metrics of agent %s: %w", agentID, err)
+	}
+	defer rows.Close()
+
+	metrics, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.AgentMetric])
+	if err != nil {
+		return nil, fmt.Errorf("query metrics of agent %s: %w", agentID, err)
+	}
+	return metrics, nil
+}
+
+// GetRecentAgentMetrics returns every agent's samples since since, oldest
+// first
+func (db *DB) GetRecentAgentMetrics(ctx context.Context, since time.Time) (map[string][]models.AgentMetric, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT agent_id, time, lines_per_second, packets_per_second, bytes_per_second
+		FROM agent_metrics
+		WHERE time >= $1
+		ORDER BY agent_id, time`,
+		since)
+	if err != nil {
+		return nil, fmt.Errorf("query recent agent metrics: %w", err)
+	}
+	defer rows.Close()
+
+	metrics := make(map[string][]models.AgentMetric)
+	for rows.Next() {
+		var id string
+		var m models.AgentMetric
+		if err := rows.Scan(&id, &m.Time, &m.LinesPerSecond, &m.PacketsPerSecond, &m.BytesPerSecond); err != nil {
+			return nil, fmt.Errorf("scan agent metric: %w", err)
+		}
+		metrics[id] = append(metrics[id], m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query recent agent metrics: %w", err)
+	}
+	return metrics, nil
+}
+
+// DeleteAgentMetricsBefore deletes samples taken before cutoff
+func (db *DB) DeleteAgentMetricsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM agent_metrics WHERE time < $1`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("delete agent metrics: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// QuietAgent is an agent whose rate stayed at zero
+type QuietAgent struct {
+	AgentID string `json:"agent_id"`
+	// Time of the agent's last non-zero sample; nil when none is kept
+	LastActive *time.Time `json:"last_active"`
+}
+
+// QuietAgents finds agents whose rate of kind (lines, packets or bytes) was
+// zero in every sample after quietSince, or that stopped being sampled, for
+// example by disconnecting. Each sample covers the minute before it. Only
+// agents sampled by quietSince and since seenSince count, so newly connected
+// and long gone agents aren't reported.
+func (db *DB) QuietAgents(ctx context.Context, kind string, seenSince, quietSince time.Time) ([]QuietAgent, error) {
+	column, ok := agentRateColumns[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown agent rate %q", ErrInvalidQuery, kind)
+	}
+
+	rows, err := db.pool.Query(ctx, `
+		SELECT agent_id, MAX(time) FILTER (WHERE `+column+` > 0)
+		FROM agent_metrics
+		WHERE time >= $1
+		GROUP BY agent_id
+		HAVING MIN(time) <= $2
+		   AND COALESCE(MAX(time) FILTER (WHERE `+column+` > 0), '-infinity') <= $2
+		ORDER BY agent_id`,
+		seenSince, quietSince)
+	if err != nil {
+		return nil, fmt.Errorf("query quiet agents: %w", err)
+	}
+	defer rows.Close()
+
+	agents, err := pgx.CollectRows(rows, pgx.RowToStructByPos[QuietAgent])
+	if err != nil {
+		return nil, fmt.Errorf("query quiet agents: %w", err)
+	}
+	return agents, nil
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestQuietAgentsUnknownRate(t *testing.T) {
+	// Rejected before the database is queried
+	var db *DB
+	if _, err := db.QuietAgents(context.Background(), "errors", time.Time{}, time.Time{}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("unknown rate = %v, want ErrInvalidQuery", err)
+	}
+}
+
+func TestQuietAgents(t *testing.T) {
+	db := openTestDB(t, "agent_metrics")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	// Minute samples of lines per second, the newest last, by agent
+	history := map[string][]float64{
+		"busy":     {1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+		"quiet":    {1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"silent":   {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"resumed":  {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		"new":      {0, 0, 0},
+		"gone":     {1, 1, 1, 1, 1},
+		"exact":    {1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"brief":    {0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"recovers": {0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 2},
+	}
+	for id, rates := range history {
+		for i, rate := range rates {
+			// "gone" stopped being sampled 11 minutes ago
+			at := now.Add(-time.Duration(len(rates)-1-i) * time.Minute)
+			if id == "gone" {
+				at = at.Add(-11 * time.Minute)
+			}
+			if err := db.SaveAgentMetrics(ctx, map[string]models.AgentMetric{id: {Time: at, LinesPerSecond: rate}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	quiet, err := db.QuietAgents(ctx, "lines", now.Add(-24*time.Hour), now.Add(-10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*time.Time)
+	for _, a := range quiet {
+		got[a.AgentID] = a.LastActive
+	}
+	want := map[string]*time.Time{
+		"quiet":  ptr(now.Add(-12 * time.Minute)),
+		"silent": nil,
+		"gone":   ptr(now.Add(-11 * time.Minute)),
+		// Each sample covers the minute before it, so this one's ten zero
+		// samples are ten quiet minutes
+		"exact": ptr(now.Add(-10 * time.Minute)),
+	}
+	if len(got) != len(want) {
+		t.Errorf("quiet agents = %v, want %v", quiet, want)
+	}
+	for id, last := range want {
+		at, ok := got[id]
+		switch {
+		case !ok:
+			t.Errorf("%s not reported as quiet", id)
+		case (at == nil) != (last == nil) || at != nil && !at.Equal(*last):
+			t.Errorf("%s last active at %v, want %v", id, at, last)
+		}
+	}
+
+	// Agents not sampled within the lookback aren't reported at all
+	quiet, err = db.QuietAgents(ctx, "lines", now.Add(-5*time.Minute), now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range quiet {
+		if a.AgentID == "gone" {
+			t.Errorf("agent gone before the lookback reported: %+v", a)
+		}
+	}
+}
+
+func TestAgentMetricsRanges(t *testing.T) {
+	db := openTestDB(t, "agent_metrics")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Minute)
+
+	for i := 0; i < 5; i++ {
+		at := now.Add(-time.Duration(i) * time.Minute)
+		if err := db.SaveAgentMetrics(ctx, map[string]models.AgentMetric{
+			"a": {Time: at, LinesPerSecond: float64(i)},
+			"b": {Time: at, PacketsPerSecond: float64(i)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A sample taken twice, as a retried job run would, is kept once
+	if err := db.SaveAgentMetrics(ctx, map[string]models.AgentMetric{"a": {Time: now, LinesPerSecond: 99}}); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := db.GetAgentMetrics(ctx, "a", now.Add(-3*time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 3 || !samples[0].Time.Equal(now.Add(-3*time.Minute)) || samples[0].LinesPerSecond != 3 {
+		t.Errorf("samples in [now-3m, now) = %+v, want 3 oldest first", samples)
+	}
+
+	recent, err := db.GetRecentAgentMetrics(ctx, now.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 2 || len(recent["a"]) != 2 || recent["a"][1].LinesPerSecond != 0 || len(recent["b"]) != 2 {
+		t.Errorf("recent samples = %+v, want the last 2 of each agent", recent)
+	}
+
+	deleted, err := db.DeleteAgentMetricsBefore(ctx, now.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 4 {
+		t.Errorf("deleted %d samples, want the 2 oldest of each agent", deleted)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
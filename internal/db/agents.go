@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CountDistinctAgents counts the agents that stored logs or packets at or
+// after since. Rows written before agent IDs were recorded have no agent and
+// are not counted, so the result can be zero for a fleet that predates them.
+func (db *DB) CountDistinctAgents(ctx context.Context, since time.Time) (int, error) {
+	// An agent can have rows on more than one shard if DATABASE_URLS changed,
+	// so IDs are deduplicated here rather than summing per-shard counts
+	ids := make([][]string, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT agent_id FROM logs WHERE agent_id IS NOT NULL AND timestamp >= $1
+			UNION
+			SELECT agent_id FROM network_packets WHERE agent_id IS NOT NULL AND time >= $1`,
+			since)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids[shard] = append(ids[shard], id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("count agents: %w", err)
+	}
+
+	seen := make(map[string]struct{})
+	for _, part := range ids {
+		for _, id := range part {
+			seen[id] = struct{}{}
+		}
+	}
+	return len(seen), nil
+}
+
+// UpsertAgent stores an agent's registration. A connection older than the
+// stored one doesn't overwrite it, so when an agent has several connections
+// the latest registration wins whichever disconnects last.
+func (db *DB) UpsertAgent(ctx context.Context, a models.Agent) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO agents (id, hostname, ip_address, version, connected_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (id) DO UPDATE
+		SET hostname = EXCLUDED.hostname, ip_address = EXCLUDED.ip_address,
+		    version = EXCLUDED.version, connected_at = EXCLUDED.connected_at,
+		    last_seen_at = GREATEST(agents.last_seen_at, EXCLUDED.last_seen_at)
+		WHERE EXCLUDED.connected_at >= agents.connected_at`,
+		a.ID, a.Hostname, a.IPAddress, a.Version, a.ConnectedAt, a.LastSeenAt)
+	if err != nil {
+		return fmt.Errorf("store agent %s: %w", a.ID, err)
+	}
+	return nil
+}
+
+// GetAgents lists the stored registrations of agents, by ID
+func (db *DB) GetAgents(ctx context.Context) ([]models.Agent, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, hostname, ip_address, version, connected_at, last_seen_at
+		FROM agents
+		ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("query agents: %w", err)
+	}
+	defer rows.Close()
+
+	agents, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Agent, error) {
+		var a models.Agent
+		err := row.Scan(&a.ID, &a.Hostname, &a.IPAddress, &a.Version, &a.ConnectedAt, &a.LastSeenAt)
+		return a, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan agents: %w", err)
+	}
+	return agents, nil
+}
+
+// maxAgentEvents is how many events are kept per agent
+const maxAgentEvents = 100
+
+// SaveAgentEvent stores an event, dropping the agent's oldest beyond
+// maxAgentEvents
+func (db *DB) SaveAgentEvent(ctx context.Context, e models.AgentEvent) error {
+	return db.withFailover(ctx, db.pool, "save agent event", func() error {
+		_, err := db.pool.Exec(ctx, `
+			WITH inserted AS (
+				INSERT INTO agent_events (agent_id, time, kind, detail)
+				VALUES ($1, $2, $3, $4)
+			)
+			DELETE FROM agent_events
+			WHERE agent_id = $1 AND id IN (
+				SELECT id FROM agent_events WHERE agent_id = $1
+				ORDER BY time DESC, id DESC
+				OFFSET $5
+			)`,
+			e.AgentID, e.Time, e.Kind, e.Detail, maxAgentEvents-1)
+		return err
+	})
+}
+
+// GetLatestAgentEvents returns up to limit of each agent's newest events,
+// newest first
+func (db *DB) GetLatestAgentEvents(ctx context.Context, limit int) (map[string][]models.AgentEvent, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT agent_id, time, kind, detail FROM (
+			SELECT *, row_number() OVER (PARTITION BY agent_id ORDER BY time DESC, id DESC) AS n
+			FROM agent_events
+		) e
+		WHERE n <= $1
+		ORDER BY agent_id, time DESC, id DESC`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query agent events: %w", err)
+	}
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByPos[models.AgentEvent])
+	if err != nil {
+		return nil, fmt.Errorf("query agent events: %w", err)
+	}
+
+	byAgent := make(map[string][]models.AgentEvent)
+	for _, e := range events {
+		byAgent[e.AgentID] = append(byAgent[e.AgentID], e)
+	}
+	return byAgent, nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Cap on annotations returned for one range
+const annotationLimit = 1000
+
+// CreateAnnotation stores an annotation and fills in its ID
+func (db *DB) CreateAnnotation(ctx context.Context, a *models.Annotation) error {
+	if a.Tags == nil {
+		a.Tags = []string{}
+	}
+
+	err := db.pool.QueryRow(ctx, `
+		INSERT INTO annotations (timestamp, text, tags)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`,
+		a.Timestamp, a.Text, a.Tags,
+	).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert annotation: %w", err)
+	}
+
+	return nil
+}
+
+// GetAnnotations retrieves the annotations between start (inclusive) and end
+// (exclusive), oldest first
+func (db *DB) GetAnnotations(ctx context.Context, start, end time.Time) ([]models.Annotation, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, timestamp, text, tags, created_at
+		FROM annotations
+		WHERE timestamp >= $1 AND timestamp < $2
+		ORDER BY timestamp, id
+		LIMIT `+strconv.Itoa(annotationLimit), start, end)
+	if err != nil {
+		return nil, fmt.Errorf("query annotations: %w", err)
+	}
+	defer rows.Close()
+
+	annotations, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.Annotation, error) {
+		var a models.Annotation
+		err := row.Scan(&a.ID, &a.Timestamp, &a.Text, &a.Tags, &a.CreatedAt)
+		return a, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan annotations: %w", err)
+	}
+
+	return annotations, nil
+}
+
+// DeleteAnnotation removes an annotation by ID
+func (db *DB) DeleteAnnotation(ctx context.Context, id int64) error {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM annotations WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete annotation %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// archiveFixture stores a file at generation 2 with lines from generation 1
+// and compacts them into logs_archive, leaving one manifest
+func archiveFixture(t *testing.T, db *DB, path string) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+
+	err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: path[len("/var/log/"):], ModTime: now, LastSeen: now, Generation: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []models.LogEntry
+	for i := 1; i <= 5; i++ {
+		logs = append(logs, models.LogEntry{Filename: path, Line: fmt.Sprintf("line %d", i), LineNum: i, Timestamp: now, Level: "INFO", Generation: 1})
+	}
+	logs = append(logs, models.LogEntry{Filename: path, Line: "current", LineNum: 1, Timestamp: now, Level: "INFO", Generation: 2})
+	if err := db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.CompactGenerations(ctx, true); err != nil || n != 5 {
+		t.Fatalf("archived %d lines, %v; want 5", n, err)
+	}
+}
+
+func manifestStatus(t *testing.T, db *DB, path string) string {
+	t.Helper()
+	var status string
+	if err := db.pool.QueryRow(context.Background(), `SELECT status FROM archive_manifests WHERE file_path = $1`, path).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestVerifyArchiveDetectsCorruption(t *testing.T) {
+	const path = "/var/log/app.log"
+	for _, tc := range []struct {
+		name    string
+		corrupt string
+	}{
+		{"changed line", `UPDATE logs_archive SET line = 'line 3 edited' WHERE line = 'line 3'`},
+		{"changed level", `UPDATE logs_archive SET level = 'ERROR' WHERE line = 'line 2'`},
+		{"changed timestamp", `UPDATE logs_archive SET timestamp = timestamp + interval '1 second' WHERE line = 'line 4'`},
+		{"lost row", `DELETE FROM logs_archive WHERE line = 'line 5'`},
+		{"extra row", `INSERT INTO logs_archive SELECT * FROM logs_archive WHERE line = 'line 1'`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := openTestDB(t, "files", "logs_archive", "archive_manifests")
+			ctx := context.Background()
+			archiveFixture(t, db, path)
+
+			report, err := db.VerifyArchive(ctx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Checked != 1 || len(report.Discrepancies) != 0 {
+				t.Fatalf("fresh archive: %+v, want one clean manifest", report)
+			}
+
+			if _, err := db.pool.Exec(ctx, tc.corrupt); err != nil {
+				t.Fatal(err)
+			}
+			report, err = db.VerifyArchive(ctx, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Discrepancies) != 1 || report.Discrepancies[0].Manifest.FilePath != path {
+				t.Fatalf("corrupted archive: %+v, want one discrepancy", report)
+			}
+			if got := manifestStatus(t, db, path); got != ManifestMismatch {
+				t.Errorf("manifest status = %s, want %s", got, ManifestMismatch)
+			}
+		})
+	}
+}
+
+func TestRepairArchiveQuarantinesWithoutSource(t *testing.T) {
+	const path = "/var/log/app.log"
+	db := openTestDB(t, "files", "logs_archive", "archive_manifests")
+	ctx := context.Background()
+	archiveFixture(t, db, path)
+
+	if _, err := db.pool.Exec(ctx, `DELETE FROM logs_archive WHERE line = 'line 1'`); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.VerifyArchive(ctx, 0)
+	if err != nil || len(report.Discrepancies) != 1 {
+		t.Fatalf("report = %+v, %v; want one discrepancy", report, err)
+	}
+
+	// Generation 1's lines are all archived, so nothing can restore the row
+	action, err := db.RepairArchive(ctx, report.Discrepancies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != RepairQuarantined {
+		t.Errorf("repair = %s, want %s", action, RepairQuarantined)
+	}
+	if got := manifestStatus(t, db, path); got != ManifestQuarantined {
+		t.Errorf("manifest status = %s, want %s", got, ManifestQuarantined)
+	}
+
+	// Quarantined manifests are left out of later checks
+	report, err = db.VerifyArchive(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 0 {
+		t.Errorf("checked %d manifests after quarantine, want 0", report.Checked)
+	}
+}
+
+func TestRepairArchiveRearchivesFromLogs(t *testing.T) {
+	const path = "/var/log/app.log"
+	db := openTestDB(t, "files", "logs_archive", "archive_manifests")
+	ctx := context.Background()
+	archiveFixture(t, db, path)
+
+	// A late line of generation 1 still in logs, and an archive that lost one
+	now := time.Now()
+	if err := db.SaveLogs(ctx, []models.LogEntry{{Filename: path, Line: "late", LineNum: 6, Timestamp: now, Generation: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM logs_archive WHERE line = 'line 1'`); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.VerifyArchive(ctx, 0)
+	if err != nil || len(report.Discrepancies) != 1 {
+		t.Fatalf("report = %+v, %v; want one discrepancy", report, err)
+	}
+
+	action, err := db.RepairArchive(ctx, report.Discrepancies[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != RepairRearchived {
+		t.Errorf("repair = %s, want %s", action, RepairRearchived)
+	}
+
+	// The manifest now describes what the archive holds
+	report, err = db.VerifyArchive(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || len(report.Discrepancies) != 0 {
+		t.Errorf("after repair: %+v, want one clean manifest", report)
+	}
+	var inLogs int
+	if err := db.pool.QueryRow(ctx, `SELECT count(*) FROM logs WHERE file_path = $1 AND generation = 1`, path).Scan(&inLogs); err != nil {
+		t.Fatal(err)
+	}
+	if inLogs != 0 {
+		t.Errorf("%d generation 1 lines left in logs, want 0", inLogs)
+	}
+}
+
+func TestVerifyArchiveSamplesLeastRecentlyVerified(t *testing.T) {
+	db := openTestDB(t, "files", "logs_archive", "archive_manifests")
+	ctx := context.Background()
+	archiveFixture(t, db, "/var/log/a.log")
+	archiveFixture(t, db, "/var/log/b.log")
+
+	first, err := db.VerifyArchive(ctx, 1)
+	if err != nil || first.Checked != 1 {
+		t.Fatalf("first sample: %+v, %v", first, err)
+	}
+	if _, err := db.pool.Exec(ctx, `DELETE FROM logs_archive`); err != nil {
+		t.Fatal(err)
+	}
+	// The next sample is the manifest not yet verified
+	second, err := db.VerifyArchive(ctx, 1)
+	if err != nil || second.Checked != 1 || len(second.Discrepancies) != 1 {
+		t.Fatalf("second sample: %+v, %v", second, err)
+	}
+	var verified int
+	if err := db.pool.QueryRow(ctx, `SELECT count(*) FROM archive_manifests WHERE verified_at IS NOT NULL`).Scan(&verified); err != nil {
+		t.Fatal(err)
+	}
+	if verified != 2 {
+		t.Errorf("%d manifests verified after two samples of one, want 2", verified)
+	}
+}
+
+func TestArchiveDiscrepancyString(t *testing.T) {
+	d := ArchiveDiscrepancy{
+		Manifest: ArchiveManifest{Shard: 1, FilePath: "/var/log/app.log", Generation: 3, RowCount: 10, Checksum: "abc"},
+		RowCount: 9,
+		Checksum: "def",
+	}
+	want := "shard 1 /var/log/app.log generation 3: 9 rows (checksum def), manifest has 10 (checksum abc)"
+	if got := d.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// columnStatsSample is how many of a file's newest lines LogColumnStats
+// reads from each shard. Both of its queries walk idx_logs_file_line from
+// one end, so their cost doesn't grow with the file.
+const columnStatsSample = 500
+
+// durationPattern matches durations such as 12ms, 1.5 s or 3 minutes
+var durationPattern = regexp.MustCompile(`(?i)\b\d+(?:\.\d+)?\s?(?:ns|us|µs|ms|s|secs?|seconds?|mins?|minutes?|h|hours?)\b`)
+
+// LogColumnStats summarizes the current generation of a file from its first
+// stored line and a sample of its newest ones
+func (db *DB) LogColumnStats(ctx context.Context, path string) (*models.LogColumnStats, error) {
+	file, err := db.GetFileByPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([][]models.LogEntry, len(db.shards))
+	firsts := make([]*time.Time, len(db.shards))
+	err = db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT `+logColumns+`
+			FROM logs
+			WHERE file_path = $1 AND generation = $2
+			ORDER BY line_number DESC
+			LIMIT $3`,
+			path, file.Generation, columnStatsSample)
+		if err != nil {
+			return err
+		}
+		logs, err := scanLogEntries(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		parts[shard] = logs
+		if len(logs) == 0 {
+			return nil
+		}
+
+		var first time.Time
+		err = pool.QueryRow(ctx, `
+			SELECT timestamp
+			FROM logs
+			WHERE file_path = $1 AND generation = $2
+			ORDER BY line_number
+			LIMIT 1`,
+			path, file.Generation).Scan(&first)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The lines were deleted since the sample was read
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		firsts[shard] = &first
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sample logs of %s: %w", path, err)
+	}
+
+	sample := mergeSorted(parts, func(a, b models.LogEntry) bool {
+		return a.LineNum > b.LineNum
+	}, columnStatsSample)
+
+	stats := summarizeColumns(sample)
+	stats.Path = path
+	stats.Generation = file.Generation
+	for _, first := range firsts {
+		if first != nil && (stats.MinTimestamp == nil || first.Before(*stats.MinTimestamp)) {
+			stats.MinTimestamp = first
+		}
+	}
+	return stats, nil
+}
+
+// summarizeColumns computes the sampled parts of LogColumnStats from lines
+// ordered newest first
+func summarizeColumns(sample []models.LogEntry) *models.LogColumnStats {
+	stats := &models.LogColumnStats{Levels: []string{}, SampledLines: len(sample)}
+	if len(sample) == 0 {
+		return stats
+	}
+	stats.MaxLineNumber = sample[0].LineNum
+
+	levels := make(map[string]bool)
+	var jsonLines, durationLines, length int
+	for _, l := range sample {
+		if l.Level != "" {
+			levels[strings.ToUpper(l.Level)] = true
+		}
+		if trimmed := strings.TrimSpace(l.Line); strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+			jsonLines++
+		}
+		if durationPattern.MatchString(l.Line) {
+			durationLines++
+		}
+		length += len(l.Line)
+		if stats.MaxTimestamp == nil || l.Timestamp.After(*stats.MaxTimestamp) {
+			ts := l.Timestamp
+			stats.MaxTimestamp = &ts
+		}
+	}
+	for level := range levels {
+		stats.Levels = append(stats.Levels, level)
+	}
+	sort.Strings(stats.Levels)
+
+	n := float64(len(sample))
+	stats.JSONShare = float64(jsonLines) / n
+	stats.DurationShare = float64(durationLines) / n
+	stats.AvgLineLength = float64(length) / n
+	return stats
+}
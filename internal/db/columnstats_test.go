@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestDurationPattern(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"request took 12ms", true},
+		{"done in 1.5 s", true},
+		{"retrying in 3 minutes", true},
+		{"elapsed=250us", true},
+		{"waited 2h for the lock", true},
+		{"user 12 logged in", false},
+		{"GET /items/15s3 200", false},
+		{"version 1.5", false},
+	}
+	for _, tt := range tests {
+		if got := durationPattern.MatchString(tt.line); got != tt.want {
+			t.Errorf("%q has a duration = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeColumns(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	// Newest first, as the sample is read
+	sample := []models.LogEntry{
+		{LineNum: 4, Level: "error", Line: `{"msg": "failed", "took": "3ms"}`, Timestamp: now.Add(-time.Second)},
+		{LineNum: 3, Level: "INFO", Line: "served in 12ms", Timestamp: now},
+		{LineNum: 2, Line: "  {not json", Timestamp: now.Add(-2 * time.Second)},
+		{LineNum: 1, Level: "info", Line: "started", Timestamp: now.Add(-3 * time.Second)},
+	}
+
+	stats := summarizeColumns(sample)
+	if stats.MaxLineNumber != 4 || stats.SampledLines != 4 {
+		t.Errorf("max line %d of %d sampled, want 4 of 4", stats.MaxLineNumber, stats.SampledLines)
+	}
+	if fmt.Sprint(stats.Levels) != "[ERROR INFO]" {
+		t.Errorf("levels = %v, want [ERROR INFO]", stats.Levels)
+	}
+	if stats.MaxTimestamp == nil || !stats.MaxTimestamp.Equal(now) {
+		t.Errorf("max timestamp = %v, want %v", stats.MaxTimestamp, now)
+	}
+	if stats.JSONShare != 0.25 || stats.DurationShare != 0.5 {
+		t.Errorf("JSON share %v, duration share %v, want 0.25 and 0.5", stats.JSONShare, stats.DurationShare)
+	}
+	var length int
+	for _, l := range sample {
+		length += len(l.Line)
+	}
+	if want := float64(length) / 4; stats.AvgLineLength != want {
+		t.Errorf("average line length = %v, want %v", stats.AvgLineLength, want)
+	}
+
+	empty := summarizeColumns(nil)
+	if empty.Levels == nil || empty.SampledLines != 0 || empty.MaxTimestamp != nil {
+		t.Errorf("stats of no lines = %+v, want empty levels and no timestamps", empty)
+	}
+}
+
+func TestLogColumnStats(t *testing.T) {
+	db := openTestDB(t, "files", "logs")
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const path = "/var/log/columns.log"
+
+	if _, err := db.LogColumnStats(ctx, path); err == nil {
+		t.Error("stats of an unknown file, want an error")
+	}
+
+	if err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "columns.log", ModTime: start, Generation: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// An older generation's lines aren't counted
+	old := []models.LogEntry{{Filename: path, Line: "old", LineNum: 5000, Level: "FATAL", Generation: 0, Timestamp: start.Add(-time.Hour)}}
+	var logs []models.LogEntry
+	for i := 1; i <= 3*columnStatsSample; i++ {
+		l := models.LogEntry{Filename: path, Line: "plain line", LineNum: i, Generation: 1, Timestamp: start.Add(time.Duration(i) * time.Second)}
+		// Only lines older than the sample have a level
+		if i <= columnStatsSample {
+			l.Level = "DEBUG"
+		}
+		logs = append(logs, l)
+	}
+	if err := db.SaveLogs(ctx, append(old, logs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := db.LogColumnStats(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Generation != 1 || stats.MaxLineNumber != 3*columnStatsSample || stats.SampledLines != columnStatsSample {
+		t.Errorf("stats = %+v, want line %d of generation 1 with %d sampled", stats, 3*columnStatsSample, columnStatsSample)
+	}
+	if len(stats.Levels) != 0 {
+		t.Errorf("levels = %v, want none in the sample", stats.Levels)
+	}
+	// The first timestamp comes from the first line, outside the sample
+	if stats.MinTimestamp == nil || !stats.MinTimestamp.Equal(start.Add(time.Second)) {
+		t.Errorf("min timestamp = %v, want the first line's %v", stats.MinTimestamp, start.Add(time.Second))
+	}
+	if want := start.Add(3 * columnStatsSample * time.Second); stats.MaxTimestamp == nil || !stats.MaxTimestamp.Equal(want) {
+		t.Errorf("max timestamp = %v, want %v", stats.MaxTimestamp, want)
+	}
+}
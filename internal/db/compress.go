@@ -0,0 +1,48 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// minCompressLength is the shortest line worth compressing; below this the
+// gzip header outweighs any savings.
+const minCompressLength = 256
+
+// compressLine gzips a log line for storage in line_gz. It returns nil when
+// the line is too short or doesn't shrink, in which case it is stored plainly.
+func compressLine(line string) []byte {
+	if len(line) < minCompressLength {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(line)); err != nil {
+		return nil
+	}
+	if err := zw.Close(); err != nil {
+		return nil
+	}
+
+	if buf.Len() >= len(line) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompressLine(data []byte) (string, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("open gzip line: %w", err)
+	}
+	defer zr.Close()
+
+	line, err := io.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("read gzip line: %w", err)
+	}
+	return string(line), nil
+}
@@ -2,17 +2,85 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
+	"diagnostic-client/internal/config"
+
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+var (
+	// ErrNotFound is returned when a lookup by key matches no rows.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidQuery is returned for unknown queries or bad parameters.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrTooManyRows is returned when a request would touch more rows than
+	// a method allows; narrowing it can succeed.
+	ErrTooManyRows = errors.New("too many rows")
+	// ErrUnavailable is returned when the database can't be reached, or
+	// didn't come back within the failover timeout. Retrying later can
+	// succeed. See Unavailable for errors not wrapped with it.
+	ErrUnavailable = errors.New("database unavailable")
+)
+
 type DB struct {
+	// pool is the primary database, holding all metadata tables and the
+	// first shard of the log and packet tables
 	pool *pgxpool.Pool
+	// shards holds one pool per configured database URL; shards[0] is pool.
+	// Logs and packets are routed by agent, everything else uses pool.
+	shards []*pgxpool.Pool
+
+	compressLines bool
+	maxFileRows   int // Lines of one file a search considers; 0 is unlimited
+	plans         *planCapture
+	failover      failoverTracker
 }
 
-func New(ctx context.Context, url string) (*DB, error) {
+func New(ctx context.Context, cfg *config.Config) (*DB, error) {
+	urls := cfg.DatabaseURLs
+	if len(urls) == 0 {
+		urls = []string{cfg.DatabaseURL}
+	}
+	if len(urls) > maxShards {
+		return nil, fmt.Errorf("at most %d database URLs are supported, got %d", maxShards, len(urls))
+	}
+
+	db := &DB{
+		compressLines: cfg.CompressLogLines,
+		maxFileRows:   cfg.MaxFileQueryRows,
+		failover: failoverTracker{
+			initialBackoff: cfg.InitialBackoff,
+			maxBackoff:     cfg.MaxBackoff,
+			timeout:        cfg.FailoverTimeout,
+		},
+	}
+	for i, url := range urls {
+		pool, err := newPool(ctx, url)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		db.shards = append(db.shards, pool)
+	}
+
+	db.pool = db.shards[0]
+	db.plans = newPlanCapture(db.pool, cfg)
+
+	// A read-only server's database is a replica, migrated by its primary
+	if !cfg.ReadOnly {
+		if err := db.Migrate(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+func newPool(ctx context.Context, url string) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(url)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse database URL: %w", err)
@@ -31,14 +99,22 @@ func New(ctx context.Context, url string) (*DB, error) {
 	}
 
 	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("unable to connect to database: %w", err)
 	}
 
-	return &DB{pool: pool}, nil
+	return pool, nil
 }
 
 func (db *DB) Close() {
-	if db.pool != nil {
-		db.pool.Close()
+	for _, pool := range db.shards {
+		pool.Close()
 	}
 }
+
+// Ping checks that every shard accepts queries
+func (db *DB) Ping(ctx context.Context) error {
+	return db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		return pool.Ping(ctx)
+	})
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// openTestDB connects to the database TEST_DATABASE_URL names, migrating it,
+// and empties the given tables. Tests needing it are skipped when the
+// variable isn't set.
+func openTestDB(tb testing.TB, tables ...string) *DB {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	db, err := New(ctx, &config.Config{
+		DatabaseURL:     url,
+		InitialBackoff:  10 * time.Millisecond,
+		MaxBackoff:      100 * time.Millisecond,
+		FailoverTimeout: time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	tb.Cleanup(db.Close)
+
+	for _, table := range tables {
+		if _, err := db.pool.Exec(ctx, "TRUNCATE "+table+" CASCADE"); err != nil {
+			tb.Fatalf("truncate %s: %v", table, err)
+		}
+	}
+	return db
+}
+
+func TestSaveAgentEventKeepsNewest(t *testing.T) {
+	db := openTestDB(t, "agent_events")
+	ctx := context.Background()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for i := 0; i < maxAgentEvents+5; i++ {
+		e := models.AgentEvent{AgentID: "web-01", Time: start.Add(time.Duration(i) * time.Second), Kind: models.AgentEventProtocolError, Detail: "too many malformed messages"}
+		if err := db.SaveAgentEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SaveAgentEvent(ctx, models.AgentEvent{AgentID: "web-02", Time: start, Kind: models.AgentEventProtocolError}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored int
+	if err := db.pool.QueryRow(ctx, "SELECT count(*) FROM agent_events WHERE agent_id = 'web-01'").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != maxAgentEvents {
+		t.Fatalf("stored %d events, want %d", stored, maxAgentEvents)
+	}
+
+	latest, err := db.GetLatestAgentEvents(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest["web-01"]) != 2 || len(latest["web-02"]) != 1 {
+		t.Fatalf("latest events = %v", latest)
+	}
+	if want := start.Add((maxAgentEvents + 4) * time.Second); !latest["web-01"][0].Time.Equal(want) {
+		t.Fatalf("newest event at %v, want %v", latest["web-01"][0].Time, want)
+	}
+}
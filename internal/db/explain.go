@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// planCapture records plans of registered queries that exceed the slow
+// threshold, sampled so a burst of slow queries doesn't double the load
+type planCapture struct {
+	pool       *pgxpool.Pool
+	threshold  time.Duration
+	sampleRate float64
+	maxPlans   int
+	timeout    time.Duration
+
+	// Only one capture runs at a time; others are skipped
+	busy int32
+}
+
+func newPlanCapture(pool *pgxpool.Pool, cfg *config.Config) *planCapture {
+	c := &planCapture{
+		pool:       pool,
+		threshold:  cfg.SlowQueryThreshold,
+		sampleRate: cfg.PlanCaptureSampleRate,
+		maxPlans:   cfg.MaxCapturedPlans,
+		timeout:    cfg.ExplainTimeout,
+	}
+	// Captured plans are stored, which a read-only server can't do
+	if cfg.ReadOnly {
+		c.sampleRate = 0
+	}
+	return c
+}
+
+func (c *planCapture) observe(name, sql string, args []interface{}, took time.Duration) {
+	if c.threshold <= 0 || c.sampleRate <= 0 || took < c.threshold {
+		return
+	}
+	if rand.Float64() >= c.sampleRate {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&c.busy, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&c.busy, 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+
+		if err := c.capture(ctx, name, sql, args, took); err != nil {
+			log.Printf("[DB] Error capturing plan for slow %s query: %v", name, err)
+		}
+	}()
+}
+
+// capture stores a plain EXPLAIN (without ANALYZE, so the slow query isn't
+// run a second time) and trims stored plans to the cap
+func (c *planCapture) capture(ctx context.Context, name, sql string, args []interface{}, took time.Duration) error {
+	plan, err := explain(ctx, c.pool, "EXPLAIN "+sql, args, c.timeout)
+	if err != nil {
+		return err
+	}
+
+	params, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("marshal params: %w", err)
+	}
+
+	_, err = c.pool.Exec(ctx, `
+		INSERT INTO query_plans (query_name, params, duration_ms, plan)
+		VALUES ($1, $2, $3, $4)`,
+		name, params, float64(took.Microseconds())/1000, plan)
+	if err != nil {
+		return fmt.Errorf("insert query plan: %w", err)
+	}
+
+	_, err = c.pool.Exec(ctx, `
+		DELETE FROM query_plans
+		WHERE id <= (SELECT id FROM query_plans ORDER BY id DESC OFFSET $1 LIMIT 1)`,
+		c.maxPlans)
+	if err != nil {
+		return fmt.Errorf("trim query plans: %w", err)
+	}
+
+	return nil
+}
+
+// Explain runs EXPLAIN (ANALYZE, BUFFERS) for a registered query with
+// parameters bound from params, returning the plan text. It runs in a
+// read-only transaction with a statement timeout.
+func (db *DB) Explain(ctx context.Context, name string, params map[string]string) (string, error) {
+	q, ok := namedQueries[name]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown query %s", ErrInvalidQuery, name)
+	}
+
+	args, err := q.bind(params)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	return explain(ctx, db.pool, "EXPLAIN (ANALYZE, BUFFERS) "+q.sql, args, db.plans.timeout)
+}
+
+func explain(ctx context.Context, pool *pgxpool.Pool, stmt string, args []interface{}, timeout time.Duration) (string, error) {
+	// ANALYZE executes the statement, so refuse anything but a read
+	body := strings.ToUpper(strings.TrimSpace(strings.TrimPrefix(stmt, "EXPLAIN")))
+	if i := strings.Index(body, ")"); strings.HasPrefix(body, "(") && i >= 0 {
+		body = strings.TrimSpace(body[i+1:])
+	}
+	if !strings.HasPrefix(body, "SELECT") && !strings.HasPrefix(body, "WITH") {
+		return "", fmt.Errorf("refusing to explain non-SELECT statement")
+	}
+
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return "", fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		return "", fmt.Errorf("set statement timeout: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, stmt, args...)
+	if err != nil {
+		return "", fmt.Errorf("explain: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", fmt.Errorf("scan plan line: %w", err)
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("explain: %w", err)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// GetCapturedPlans retrieves the most recently captured slow query plans
+func (db *DB) GetCapturedPlans(ctx context.Context, limit int) ([]models.QueryPlan, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT id, query_name, params, duration_ms, plan, captured_at
+		FROM query_plans
+		ORDER BY id DESC
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("query captured plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []models.QueryPlan{}
+	for rows.Next() {
+		var p models.QueryPlan
+		if err := rows.Scan(&p.ID, &p.QueryName, &p.Params, &p.DurationMs, &p.Plan, &p.CapturedAt); err != nil {
+			return nil, fmt.Errorf("scan query plan: %w", err)
+		}
+		plans = append(plans, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return plans, nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SQLSTATEs seen while a primary is restarted or replaced
+var failoverCodes = map[string]bool{
+	"57P01": true, // admin_shutdown: terminating connection due to administrator command
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now: the database system is starting up / in recovery mode
+	"25006": true, // read_only_sql_transaction: still connected to a demoted primary
+}
+
+// isFailoverError reports whether err means the database is temporarily
+// unavailable rather than that the statement itself was bad
+func isFailoverError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return failoverCodes[pgErr.Code]
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		pgconn.SafeToRetry(err)
+}
+
+// Unavailable reports whether err means the database couldn't be reached:
+// it wraps ErrUnavailable, or is a connection failure from a method that
+// doesn't wait out failovers, such as a read. A cancelled or expired
+// context is not unavailability.
+func Unavailable(err error) bool {
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return isFailoverError(err)
+}
+
+// FailoverStats counts periods during which writes were held back waiting
+// for the database to come back
+type FailoverStats struct {
+	Events        int64         `json:"events"`
+	TotalDuration time.Duration `json:"total_duration_ns"`
+	LastDuration  time.Duration `json:"last_duration_ns"`
+	InFailover    bool          `json:"in_failover"`
+}
+
+type failoverTracker struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	timeout        time.Duration
+
+	mu      sync.Mutex
+	stats   FailoverStats
+	waiting int
+}
+
+// FailoverStats returns failover counters since startup
+func (db *DB) FailoverStats() FailoverStats {
+	db.failover.mu.Lock()
+	defer db.failover.mu.Unlock()
+
+	stats := db.failover.stats
+	stats.InFailover = db.failover.waiting > 0
+	return stats
+}
+
+// withFailover runs a write, and when it fails because the database is
+// failing over, blocks until the database answers pings again and retries.
+// Blocking the caller is deliberate: ingest stalls and agents are pushed back
+// on instead of the batch being dropped. It gives up after the failover
+// timeout or when ctx ends.
+func (db *DB) withFailover(ctx context.Context, pool *pgxpool.Pool, op string, fn func() error) error {
+	err := fn()
+	if err == nil || !isFailoverError(err) || ctx.Err() != nil {
+		return err
+	}
+
+	t := &db.failover
+	start := time.Now()
+	t.mu.Lock()
+	t.waiting++
+	t.mu.Unlock()
+	log.Printf("[DB] %s failed during database failover, holding writes: %v", op, err)
+
+	defer func() {
+		d := time.Since(start)
+		t.mu.Lock()
+		t.waiting--
+		t.stats.Events++
+		t.stats.TotalDuration += d
+		t.stats.LastDuration = d
+		t.mu.Unlock()
+	}()
+
+	deadline := start.Add(t.timeout)
+	backoff := t.initialBackoff
+	for {
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%s: %w for %v: %w", op, ErrUnavailable, t.timeout, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > t.maxBackoff {
+			backoff = t.maxBackoff
+		}
+
+		if pingErr := pool.Ping(ctx); pingErr != nil {
+			continue
+		}
+
+		if err = fn(); err == nil {
+			log.Printf("[DB] %s resumed after failover of %v", op, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if !isFailoverError(err) {
+			return err
+		}
+	}
+}
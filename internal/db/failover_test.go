@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestIsFailoverError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"admin shutdown", &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"}, true},
+		{"crash shutdown", &pgconn.PgError{Code: "57P02"}, true},
+		{"recovery mode", &pgconn.PgError{Code: "57P03", Message: "the database system is in recovery mode"}, true},
+		{"demoted primary", &pgconn.PgError{Code: "25006"}, true},
+		{"wrapped", fmt.Errorf("save logs: %w", &pgconn.PgError{Code: "57P01"}), true},
+		{"connection dropped", io.ErrUnexpectedEOF, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"syntax error", &pgconn.PgError{Code: "42601"}, false},
+		{"other", errors.New("boom"), false},
+	} {
+		if got := isFailoverError(tc.err); got != tc.want {
+			t.Errorf("%s: isFailoverError = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"gave up", fmt.Errorf("save logs: %w", ErrUnavailable), true},
+		{"recovery mode", &pgconn.PgError{Code: "57P03"}, true},
+		{"cancelled", context.Canceled, false},
+		{"expired", fmt.Errorf("query: %w", context.DeadlineExceeded), false},
+		{"bad statement", &pgconn.PgError{Code: "42601"}, false},
+	} {
+		if got := Unavailable(tc.err); got != tc.want {
+			t.Errorf("%s: Unavailable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// unreachablePool returns a pool whose pings fail, as during a failover
+func unreachablePool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	pool, err := pgxpool.New(context.Background(), "postgres://test@127.0.0.1:1/test?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestWithFailoverPassesOtherErrorsThrough(t *testing.T) {
+	db := &DB{failover: failoverTracker{initialBackoff: time.Millisecond, maxBackoff: time.Millisecond, timeout: time.Second}}
+	bad := &pgconn.PgError{Code: "23505"}
+
+	calls := 0
+	err := db.withFailover(context.Background(), nil, "save", func() error {
+		calls++
+		return bad
+	})
+	if !errors.Is(err, bad) || calls != 1 {
+		t.Fatalf("withFailover = %v after %d calls, want the statement's error after 1", err, calls)
+	}
+	if stats := db.FailoverStats(); stats.Events != 0 {
+		t.Errorf("stats = %+v, want no failover events", stats)
+	}
+}
+
+func TestWithFailoverGivesUpAfterTimeout(t *testing.T) {
+	db := &DB{failover: failoverTracker{initialBackoff: 5 * time.Millisecond, maxBackoff: 20 * time.Millisecond, timeout: 100 * time.Millisecond}}
+	pool := unreachablePool(t)
+
+	start := time.Now()
+	err := db.withFailover(context.Background(), pool, "save", func() error {
+		return &pgconn.PgError{Code: "57P01"}
+	})
+	if !errors.Is(err, ErrUnavailable) || !Unavailable(err) {
+		t.Fatalf("withFailover = %v, want ErrUnavailable", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v, want about the 100ms timeout", elapsed)
+	}
+	stats := db.FailoverStats()
+	if stats.Events != 1 || stats.LastDuration <= 0 || stats.InFailover {
+		t.Errorf("stats = %+v, want one finished failover event", stats)
+	}
+}
+
+func TestWithFailoverStopsWithContext(t *testing.T) {
+	db := &DB{failover: failoverTracker{initialBackoff: time.Hour, maxBackoff: time.Hour, timeout: 2 * time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.withFailover(ctx, nil, "save", func() error {
+			return &pgconn.PgError{Code: "57P03"}
+		})
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !db.FailoverStats().InFailover {
+		if time.Now().After(deadline) {
+			t.Fatal("write never started waiting out the failover")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("withFailover = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("withFailover ignored the cancelled context")
+	}
+}
+
+func TestWithFailoverResumesOncePingSucceeds(t *testing.T) {
+	db := openTestDB(t)
+
+	calls := 0
+	err := db.withFailover(context.Background(), db.pool, "save", func() error {
+		calls++
+		switch calls {
+		case 1:
+			return &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"}
+		case 2:
+			return &pgconn.PgError{Code: "57P03", Message: "the database system is in recovery mode"}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("withFailover = %v after %d calls, want success on the third", err, calls)
+	}
+	stats := db.FailoverStats()
+	if stats.Events != 1 || stats.TotalDuration <= 0 || stats.InFailover {
+		t.Errorf("stats = %+v, want one finished failover event", stats)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// filesAt reconstructs the files table at $1 from file_history: each path's
+// latest row at or before then, unless that row records its deletion.
+// Scrape state isn't recorded, and last_seen is the time of that row.
+const filesAt = `
+    files_at AS (
+        SELECT
+            path, parent_path, name, is_directory, size, mod_time, is_gzipped,
+            false AS is_scraped, ''::text AS scrape_state, generation, observed_at AS last_seen
+        FROM (
+            SELECT DISTINCT ON (path) *
+            FROM file_history
+            WHERE observed_at <= $1
+            ORDER BY path, observed_at DESC
+        ) latest
+        WHERE NOT deleted
+    )`
+
+// GetFileTreeAt is GetFileTree for the tree as it was at asOf, rebuilt from
+// file history. Files changed before history was recorded are missing, and
+// sizes are those last recorded, see file_history.
+func (db *DB) GetFileTreeAt(ctx context.Context, path string, depth int, order FileOrder, asOf time.Time) ([]models.FileNode, error) {
+	orderBy, err := order.orderBy()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+        WITH RECURSIVE` + filesAt + `,
+        tree AS (
+            -- The directory itself, unless it is the root
+            SELECT f.*, 0 as level
+            FROM files_at f
+            WHERE path = $2 AND $2 <> '/'
+
+            UNION ALL
+
+            SELECT f.*, 1 as level
+            FROM files_at f
+            WHERE f.parent_path = $2 AND f.path <> '/'
+
+            UNION ALL
+
+            SELECT f.*, t.level + 1
+            FROM files_at f
+            JOIN tree t ON f.parent_path = t.path
+            WHERE t.is_directory
+              AND t.level < $3
+              AND t.level > 0
+        )
+        SELECT
+            path, parent_path, name, is_directory,
+            size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
+        FROM tree
+        ORDER BY level, parent_path, ` + orderBy + `
+        LIMIT $4 OFFSET $5`
+
+	rows, err := db.pool.Query(ctx, query, asOf, path, depth, order.limit(), order.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("query file tree at %s: %w", asOf.Format(time.RFC3339), err)
+	}
+	defer rows.Close()
+
+	return scanFileNodes(rows)
+}
+
+// FileHistoryStart returns when the oldest file history row was recorded, or
+// nil when there is none
+func (db *DB) FileHistoryStart(ctx context.Context) (*time.Time, error) {
+	var start *time.Time
+	if err := db.pool.QueryRow(ctx, `SELECT min(observed_at) FROM file_history`).Scan(&start); err != nil {
+		return nil, fmt.Errorf("query file history start: %w", err)
+	}
+	return start, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestFileTreeAtReconstructsPastStates(t *testing.T) {
+	db := openTestDB(t, "files", "file_history")
+	ctx := context.Background()
+
+	// History rows are stamped with the database's clock; each step moves
+	// the rows it recorded back to a simulated time
+	t1 := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	t2, t3, t4 := t1.Add(time.Hour), t1.Add(2*time.Hour), t1.Add(3*time.Hour)
+	step := func(at time.Time, change func() error) {
+		t.Helper()
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(ctx, `UPDATE file_history SET observed_at = $1 WHERE observed_at > $2`, at, t4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string, size int64) models.FileNode {
+		return models.FileNode{
+			Path: "/var/log/" + name, ParentPath: "/var/log", Name: name,
+			Size: size, ModTime: t1, LastSeen: t1, Generation: 1,
+		}
+	}
+
+	step(t1, func() error {
+		return db.SaveFiles(ctx, []models.FileNode{
+			{Path: "/var/log", ParentPath: "/var", Name: "log", IsDirectory: true, ModTime: t1, LastSeen: t1, Generation: 1},
+			file("app.log", 100),
+			file("old.log", 50),
+		})
+	})
+	// Growth under 10% isn't recorded
+	step(t2, func() error { return db.SaveFiles(ctx, []models.FileNode{file("app.log", 105)}) })
+	step(t3, func() error {
+		if err := db.SaveFiles(ctx, []models.FileNode{file("app.log", 200), file("new.log", 10)}); err != nil {
+			return err
+		}
+		return db.DeleteFiles(ctx, []string{"/var/log/old.log"})
+	})
+
+	for _, tc := range []struct {
+		name string
+		asOf time.Time
+		want map[string]int64
+	}{
+		{"before history", t1.Add(-time.Minute), map[string]int64{}},
+		{"first scan", t1, map[string]int64{"/var/log/app.log": 100, "/var/log/old.log": 50}},
+		{"small growth", t2.Add(time.Minute), map[string]int64{"/var/log/app.log": 100, "/var/log/old.log": 50}},
+		{"just before the changes", t3.Add(-time.Second), map[string]int64{"/var/log/app.log": 100, "/var/log/old.log": 50}},
+		{"after the changes", t3, map[string]int64{"/var/log/app.log": 200, "/var/log/new.log": 10}},
+		{"now", time.Now(), map[string]int64{"/var/log/app.log": 200, "/var/log/new.log": 10}},
+	} {
+		files, err := db.GetFileTreeAt(ctx, "/var/log", 1, FileOrder{}, tc.asOf)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := map[string]int64{}
+		for _, f := range files {
+			if !f.IsDirectory {
+				got[f.Path] = f.Size
+			}
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: tree = %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for path, size := range tc.want {
+			if got[path] != size {
+				t.Errorf("%s: tree = %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	start, err := db.FileHistoryStart(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start == nil || !start.Equal(t1) {
+		t.Errorf("history start = %v, want %s", start, t1)
+	}
+}
+
+func TestFileHistoryStartWithoutHistory(t *testing.T) {
+	db := openTestDB(t, "files", "file_history")
+
+	start, err := db.FileHistoryStart(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != nil {
+		t.Errorf("history start = %s, want none", start)
+	}
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// searchFiles runs a capped search per file on every shard. Files are
+// searched one at a time per shard; the results of each shard are merged by
+// the caller like those of an uncapped search.
+func (db *DB) searchFiles(ctx context.Context, query string, files []string, startTime, endTime time.Time) ([][]models.LogEntry, bool, error) {
+	parts := make([][]models.LogEntry, len(db.shards)*len(files))
+	var truncated atomic.Bool
+
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		for i, file := range files {
+			rows, err := db.namedQuery(ctx, pool, QuerySearchFile, startTime, endTime, file, query, db.maxFileRows)
+			if err != nil {
+				return err
+			}
+			logs, err := scanLogEntries(rows)
+			rows.Close()
+			if err != nil {
+				return err
+			}
+			for j := range logs {
+				logs[j].ID = encodeLogID(shard, logs[j].ID)
+			}
+			parts[shard*len(files)+i] = logs
+
+			// Only a file with more lines than the cap was cut short
+			var more bool
+			err = pool.QueryRow(ctx, `
+				SELECT EXISTS (
+					SELECT 1 FROM logs
+					WHERE file_path = $1 AND timestamp >= $2 AND timestamp < $3
+					ORDER BY timestamp DESC, id DESC
+					OFFSET $4
+				)`, file, startTime, endTime, db.maxFileRows).Scan(&more)
+			if err != nil {
+				return fmt.Errorf("count lines of %s: %w", file, err)
+			}
+			if more {
+				truncated.Store(true)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return parts, truncated.Load(), nil
+}
+
+// SetFileRetention overrides the log retention of one file; 0 removes the
+// override. It returns ErrNotFound for unknown files.
+func (db *DB) SetFileRetention(ctx context.Context, path string, retention time.Duration) error {
+	var seconds *int64
+	if retention > 0 {
+		s := int64(retention / time.Second)
+		seconds = &s
+	}
+
+	tag, err := db.pool.Exec(ctx, `UPDATE files SET retention_seconds = $2 WHERE path = $1`, path, seconds)
+	if err != nil {
+		return fmt.Errorf("set retention of %s: %w", path, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetFileRetentions returns the files with a retention override
+func (db *DB) GetFileRetentions(ctx context.Context) (map[string]time.Duration, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT path, retention_seconds FROM files
+		WHERE retention_seconds IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("query file retentions: %w", err)
+	}
+	defer rows.Close()
+
+	retentions := make(map[string]time.Duration)
+	for rows.Next() {
+		var path string
+		var seconds int64
+		if err := rows.Scan(&path, &seconds); err != nil {
+			return nil, fmt.Errorf("scan file retention: %w", err)
+		}
+		retentions[path] = time.Duration(seconds) * time.Second
+	}
+	return retentions, rows.Err()
+}
+
+// SetFileLegalHold places or lifts a legal hold on one file. It returns
+// ErrNotFound for unknown files.
+func (db *DB) SetFileLegalHold(ctx context.Context, path string, hold bool) error {
+	tag, err := db.pool.Exec(ctx, `UPDATE files SET legal_hold = $2 WHERE path = $1`, path, hold)
+	if err != nil {
+		return fmt.Errorf("set legal hold of %s: %w", path, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetHeldFiles returns the paths of files on legal hold
+func (db *DB) GetHeldFiles(ctx context.Context) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `SELECT path FROM files WHERE legal_hold ORDER BY path`)
+	if err != nil {
+		return nil, fmt.Errorf("query held files: %w", err)
+	}
+	held, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("scan held files: %w", err)
+	}
+	return held, nil
+}
+
+// FileSettings are the per-file settings changed through the files API
+type FileSettings struct {
+	Retention time.Duration // 0 follows the policy
+	LegalHold bool
+}
+
+// GetFileSettings returns the settings of one file, or ErrNotFound
+func (db *DB) GetFileSettings(ctx context.Context, path string) (FileSettings, error) {
+	var s FileSettings
+	var seconds *int64
+	err := db.pool.QueryRow(ctx, `
+		SELECT retention_seconds, legal_hold FROM files WHERE path = $1`, path).Scan(&seconds, &s.LegalHold)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, ErrNotFound
+	}
+	if err != nil {
+		return s, fmt.Errorf("query settings of %s: %w", path, err)
+	}
+	if seconds != nil {
+		s.Retention = time.Duration(*seconds) * time.Second
+	}
+	return s, nil
+}
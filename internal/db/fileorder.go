@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxFileListLimit caps one page of a file listing
+const MaxFileListLimit = 10000
+
+// fileSortColumns is the allowlist of sort keys for file listings
+var fileSortColumns = map[string]string{
+	"name":      "name",
+	"size":      "size",
+	"mod_time":  "mod_time",
+	"last_seen": "last_seen",
+}
+
+// FileOrder orders siblings in a file listing and selects a page of it
+type FileOrder struct {
+	Sort      string // name (default), size, mod_time or last_seen
+	Desc      bool
+	DirsFirst bool // Group directories before files
+	Limit     int  // 0 returns everything
+	Offset    int
+}
+
+// orderBy renders the sibling ordering. Name and path break ties, so pages
+// stay stable when many files share a size or time.
+func (o FileOrder) orderBy() (string, error) {
+	key := o.Sort
+	if key == "" {
+		key = "name"
+	}
+	column, ok := fileSortColumns[key]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown sort key %q", ErrInvalidQuery, o.Sort)
+	}
+	if o.Limit < 0 || o.Limit > MaxFileListLimit || o.Offset < 0 {
+		return "", fmt.Errorf("%w: limit must be between 0 and %d and offset not negative", ErrInvalidQuery, MaxFileListLimit)
+	}
+
+	var terms []string
+	if o.DirsFirst {
+		terms = append(terms, "is_directory DESC")
+	}
+	direction := "ASC"
+	if o.Desc {
+		direction = "DESC"
+	}
+	terms = append(terms, column+" "+direction)
+	if column != "name" {
+		terms = append(terms, "name")
+	}
+	terms = append(terms, "path")
+
+	return strings.Join(terms, ", "), nil
+}
+
+// limit returns the LIMIT argument; NULL means no limit
+func (o FileOrder) limit() interface{} {
+	if o.Limit == 0 {
+		return nil
+	}
+	return o.Limit
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFileOrderBy(t *testing.T) {
+	for _, tc := range []struct {
+		order FileOrder
+		want  string
+	}{
+		{FileOrder{}, "name ASC, path"},
+		{FileOrder{DirsFirst: true}, "is_directory DESC, name ASC, path"},
+		{FileOrder{Sort: "name", Desc: true}, "name DESC, path"},
+		{FileOrder{Sort: "size", DirsFirst: true}, "is_directory DESC, size ASC, name, path"},
+		{FileOrder{Sort: "mod_time", Desc: true}, "mod_time DESC, name, path"},
+		{FileOrder{Sort: "last_seen", Limit: MaxFileListLimit, Offset: 5}, "last_seen ASC, name, path"},
+	} {
+		got, err := tc.order.orderBy()
+		if err != nil || got != tc.want {
+			t.Errorf("%+v: orderBy = %q, %v; want %q", tc.order, got, err, tc.want)
+		}
+	}
+
+	for _, order := range []FileOrder{
+		{Sort: "size; DROP TABLE files"},
+		{Sort: "path"},
+		{Limit: -1},
+		{Limit: MaxFileListLimit + 1},
+		{Offset: -1},
+	} {
+		if _, err := order.orderBy(); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%+v: err = %v, want ErrInvalidQuery", order, err)
+		}
+	}
+}
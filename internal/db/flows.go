@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// How flows of several agents are combined
+const (
+	// FlowsCombined sums each 5-tuple across agents, so a flow captured at
+	// both ends counts twice
+	FlowsCombined = "combined"
+	// FlowsByAgent keeps each agent's flows apart
+	FlowsByAgent = "agent"
+	// FlowsDedup merges captures of one 5-tuple by several agents that
+	// overlap in time into one flow
+	FlowsDedup = "dedup"
+)
+
+// Flows each shard returns before combining, largest first
+const flowScanLimit = 10000
+
+// GetNetworkFlows aggregates packets in [start, end) into flows by 5-tuple,
+// largest by bytes first. Flows are aggregated per agent in SQL; since
+// agents are spread across shards, combining them happens afterwards in
+// combineFlows. tolerance is how far apart in time two agents' captures of
+// a 5-tuple may be and still be merged by FlowsDedup.
+func (db *DB) GetNetworkFlows(ctx context.Context, start, end time.Time, protocols []string, mode string, tolerance time.Duration, limit int) ([]models.NetworkFlow, error) {
+	switch mode {
+	case FlowsCombined, FlowsByAgent, FlowsDedup:
+	default:
+		return nil, fmt.Errorf("%w: unknown flow mode %q", ErrInvalidQuery, mode)
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("%w: end must be after start", ErrInvalidQuery)
+	}
+
+	parts := make([][]models.NetworkFlow, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT
+				COALESCE(agent_id, ''), protocol,
+				COALESCE(host(src_ip), ''), COALESCE(src_port, 0),
+				COALESCE(host(dst_ip), ''), COALESCE(dst_port, 0),
+				COUNT(*), COALESCE(SUM(length), 0), MIN(time), MAX(time)
+			FROM network_packets
+			WHERE time >= $1 AND time < $2
+			  AND ($3::text[] IS NULL OR protocol = ANY($3))
+			GROUP BY agent_id, protocol, src_ip, src_port, dst_ip, dst_port
+			ORDER BY SUM(length) DESC
+			LIMIT `+strconv.Itoa(flowScanLimit),
+			start, end, protocols)
+		if err != nil {
+			return fmt.Errorf("query network flows: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var f models.NetworkFlow
+			err := rows.Scan(&f.AgentID, &f.Protocol, &f.SrcIP, &f.SrcPort, &f.DstIP, &f.DstPort,
+				&f.Packets, &f.Bytes, &f.FirstSeen, &f.LastSeen)
+			if err != nil {
+				return fmt.Errorf("scan network flow: %w", err)
+			}
+			parts[shard] = append(parts[shard], f)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var flows []models.NetworkFlow
+	for _, part := range parts {
+		flows = append(flows, part...)
+	}
+	if mode != FlowsByAgent {
+		flows = combineFlows(flows, mode == FlowsDedup, tolerance)
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Bytes != flows[j].Bytes {
+			return flows[i].Bytes > flows[j].Bytes
+		}
+		return flows[i].FirstSeen.Before(flows[j].FirstSeen)
+	})
+	if limit > 0 && len(flows) > limit {
+		flows = flows[:limit]
+	}
+	return flows, nil
+}
+
+type flowKey struct {
+	protocol         string
+	srcIP, dstIP     string
+	srcPort, dstPort int
+}
+
+// combineFlows merges per-agent flows of the same 5-tuple, listing the
+// agents in ObservedBy; packets stored before agents were tracked have none. Without dedup, counts are summed. With dedup, flows
+// of different agents whose captures overlap within tolerance are taken to
+// be one flow seen from both ends: its counts are the largest of the
+// captures rather than their sum, since each end saw the same packets.
+// Captures of one agent are never merged with each other.
+func combineFlows(flows []models.NetworkFlow, dedup bool, tolerance time.Duration) []models.NetworkFlow {
+	groups := make(map[flowKey][]models.NetworkFlow)
+	var keys []flowKey
+	for _, f := range flows {
+		k := flowKey{f.Protocol, f.SrcIP, f.DstIP, f.SrcPort, f.DstPort}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], f)
+	}
+
+	combined := make([]models.NetworkFlow, 0, len(keys))
+	for _, k := range keys {
+		group := groups[k]
+		if !dedup {
+			combined = append(combined, mergeFlows(group, false))
+			continue
+		}
+
+		// Sweep captures in order of first packet, growing a cluster while
+		// the next capture starts within tolerance of the cluster's end and
+		// comes from an agent not yet in it
+		sort.Slice(group, func(i, j int) bool { return group[i].FirstSeen.Before(group[j].FirstSeen) })
+		var cluster []models.NetworkFlow
+		var clusterEnd time.Time
+		for _, f := range group {
+			if len(cluster) > 0 && (f.FirstSeen.After(clusterEnd.Add(tolerance)) || hasAgent(cluster, f.AgentID)) {
+				combined = append(combined, mergeFlows(cluster, true))
+				cluster = nil
+			}
+			if len(cluster) == 0 || f.LastSeen.After(clusterEnd) {
+				clusterEnd = f.LastSeen
+			}
+			cluster = append(cluster, f)
+		}
+		combined = append(combined, mergeFlows(cluster, true))
+	}
+	return combined
+}
+
+// mergeFlows combines captures of one 5-tuple, summing their counts or,
+// for captures of the same packets, taking the largest
+func mergeFlows(captures []models.NetworkFlow, samePackets bool) models.NetworkFlow {
+	merged := captures[0]
+	merged.AgentID = ""
+	merged.ObservedBy = nil
+	seen := make(map[string]bool)
+	for i, f := range captures {
+		if i > 0 {
+			if samePackets {
+				merged.Packets = max(merged.Packets, f.Packets)
+				merged.Bytes = max(merged.Bytes, f.Bytes)
+			} else {
+				merged.Packets += f.Packets
+				merged.Bytes += f.Bytes
+			}
+			if f.FirstSeen.Before(merged.FirstSeen) {
+				merged.FirstSeen = f.FirstSeen
+			}
+			if f.LastSeen.After(merged.LastSeen) {
+				merged.LastSeen = f.LastSeen
+			}
+		}
+		if f.AgentID != "" && !seen[f.AgentID] {
+			seen[f.AgentID] = true
+			merged.ObservedBy = append(merged.ObservedBy, f.AgentID)
+		}
+	}
+	sort.Strings(merged.ObservedBy)
+	return merged
+}
+
+func hasAgent(flows []models.NetworkFlow, agentID string) bool {
+	for _, f := range flows {
+		if f.AgentID == agentID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestCombineFlows(t *testing.T) {
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	capture := func(agent string, from, to, packets int) models.NetworkFlow {
+		return models.NetworkFlow{
+			Protocol: "TCP", SrcIP: "10.0.0.1", SrcPort: 50000, DstIP: "10.0.0.2", DstPort: 443,
+			Packets: int64(packets), Bytes: int64(packets * 100),
+			FirstSeen: base.Add(time.Duration(from) * time.Second),
+			LastSeen:  base.Add(time.Duration(to) * time.Second),
+			AgentID:   agent,
+		}
+	}
+	describe := func(flows []models.NetworkFlow) []string {
+		var out []string
+		for _, f := range flows {
+			out = append(out, fmt.Sprintf("%v %d pkts %ds-%ds",
+				f.ObservedBy, f.Packets, int(f.FirstSeen.Sub(base).Seconds()), int(f.LastSeen.Sub(base).Seconds())))
+		}
+		return out
+	}
+	other := capture("a", 0, 10, 5)
+	other.DstPort = 80
+
+	tests := []struct {
+		name  string
+		dedup bool
+		in    []models.NetworkFlow
+		want  []string
+	}{
+		{
+			name: "combined sums both ends",
+			in:   []models.NetworkFlow{capture("b", 0, 10, 10), capture("a", 1, 11, 12)},
+			want: []string{"[a b] 22 pkts 0s-11s"},
+		},
+		{
+			name:  "both ends overlapping merge into the larger capture",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), capture("b", 1, 11, 12)},
+			want:  []string{"[a b] 12 pkts 0s-11s"},
+		},
+		{
+			name:  "a gap within tolerance still merges",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), capture("b", 12, 20, 8)},
+			want:  []string{"[a b] 10 pkts 0s-20s"},
+		},
+		{
+			name:  "a gap past tolerance is another flow",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), capture("b", 13, 20, 8)},
+			want:  []string{"[a] 10 pkts 0s-10s", "[b] 8 pkts 13s-20s"},
+		},
+		{
+			name:  "one agent's captures are never merged",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), capture("a", 5, 15, 8)},
+			want:  []string{"[a] 10 pkts 0s-10s", "[a] 8 pkts 5s-15s"},
+		},
+		{
+			name:  "a third capture by an agent already in the flow starts another",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), capture("b", 2, 10, 10), capture("a", 11, 20, 4)},
+			want:  []string{"[a b] 10 pkts 0s-10s", "[a] 4 pkts 11s-20s"},
+		},
+		{
+			name:  "other 5-tuples are kept apart",
+			dedup: true,
+			in:    []models.NetworkFlow{capture("a", 0, 10, 10), other, capture("b", 0, 10, 10)},
+			want:  []string{"[a b] 10 pkts 0s-10s", "[a] 5 pkts 0s-10s"},
+		},
+		{
+			name: "packets stored before agents were tracked have no observers",
+			in:   []models.NetworkFlow{capture("", 0, 10, 10)},
+			want: []string{"[] 10 pkts 0s-10s"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describe(combineFlows(tt.in, tt.dedup, 2*time.Second))
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("flows = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNetworkFlowsRejectsBadQueries(t *testing.T) {
+	d := &DB{}
+	now := time.Now()
+	if _, err := d.GetNetworkFlows(context.Background(), now.Add(-time.Hour), now, nil, "both", 0, 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("unknown mode = %v, want ErrInvalidQuery", err)
+	}
+	if _, err := d.GetNetworkFlows(context.Background(), now, now, nil, FlowsCombined, 0, 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("empty range = %v, want ErrInvalidQuery", err)
+	}
+}
+
+// TestTwoEndedCaptureByMode stores one connection captured at both ends and
+// reads its flows back in each mode, and its rate per agent
+func TestTwoEndedCaptureByMode(t *testing.T) {
+	d := openTestDB(t, "network_packets")
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Minute)
+
+	var packets []models.NetworkPacket
+	for i := 0; i < 3; i++ {
+		for _, agent := range []string{"client-host", "server-host"} {
+			packets = append(packets, models.NetworkPacket{
+				Timestamp: start.Add(time.Duration(i) * time.Second), Protocol: "TCP",
+				SrcIP: "10.0.0.1", SrcPort: 50000, DstIP: "10.0.0.2", DstPort: 443,
+				Length: 100, AgentID: agent,
+			})
+		}
+	}
+	if err := d.SaveNetworkPackets(ctx, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mode    string
+		flows   int
+		packets int64
+	}{
+		{FlowsCombined, 1, 6},
+		{FlowsByAgent, 2, 3},
+		{FlowsDedup, 1, 3},
+	} {
+		flows, err := d.GetNetworkFlows(ctx, start, start.Add(time.Minute), nil, tc.mode, 2*time.Second, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(flows) != tc.flows {
+			t.Errorf("%s: %d flows, want %d", tc.mode, len(flows), tc.flows)
+			continue
+		}
+		for _, f := range flows {
+			if f.Packets != tc.packets {
+				t.Errorf("%s: flow of %d packets, want %d", tc.mode, f.Packets, tc.packets)
+			}
+			if tc.mode == FlowsByAgent && (f.AgentID == "" || f.ObservedBy != nil) {
+				t.Errorf("%s: flow agent %q, observed by %v", tc.mode, f.AgentID, f.ObservedBy)
+			}
+			if tc.mode != FlowsByAgent && fmt.Sprint(f.ObservedBy) != "[client-host server-host]" {
+				t.Errorf("%s: observed by %v, want both hosts", tc.mode, f.ObservedBy)
+			}
+		}
+	}
+
+	rate, err := d.GetPacketRate(ctx, start, start.Add(time.Minute), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rate.Agents) != 2 || rate.Agents[0].AgentID != "client-host" || rate.Agents[1].AgentID != "server-host" {
+		t.Fatalf("agent rates = %+v, want client-host and server-host", rate.Agents)
+	}
+	for _, a := range rate.Agents {
+		if a.PacketsPerSecond != 3.0/60 {
+			t.Errorf("%s: %v packets/s, want %v", a.AgentID, a.PacketsPerSecond, 3.0/60)
+		}
+	}
+	if rate.PacketsPerSecond != 6.0/60 {
+		t.Errorf("combined rate %v packets/s, want %v", rate.PacketsPerSecond, 6.0/60)
+	}
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AllGenerations disables generation filtering in line-number-scoped queries
+const AllGenerations = -1
+
+// CompactGenerations removes log lines from generations older than their
+// file's current one, except for files on legal hold, moving them to
+// logs_archive when archive is set, and returns how many rows were affected
+// across all shards. Archived file generations get their manifests
+// rewritten for VerifyArchive.
+func (db *DB) CompactGenerations(ctx context.Context, archive bool) (int64, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT path, generation
+		FROM files
+		WHERE generation > 0 AND NOT legal_hold`)
+	if err != nil {
+		return 0, fmt.Errorf("query file generations: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	var generations []int32
+	for rows.Next() {
+		var path string
+		var generation int32
+		if err := rows.Scan(&path, &generation); err != nil {
+			return 0, fmt.Errorf("scan file generation: %w", err)
+		}
+		paths = append(paths, path)
+		generations = append(generations, generation)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows error: %w", err)
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+
+	query := `
+		DELETE FROM logs l
+		USING unnest($1::text[], $2::int[]) AS f(path, generation)
+		WHERE l.file_path = f.path AND l.generation < f.generation`
+	if archive {
+		query = `
+		WITH moved AS (` + query + `
+			RETURNING l.*
+		), archived AS (
+			INSERT INTO logs_archive SELECT * FROM moved
+			RETURNING file_path, generation
+		)
+		SELECT file_path, generation, count(*) FROM archived GROUP BY 1, 2`
+	}
+
+	var total atomic.Int64
+	err = db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		if archive {
+			return db.archiveGenerations(ctx, shard, pool, query, paths, generations, &total)
+		}
+		tag, err := pool.Exec(ctx, query, paths, generations)
+		if err != nil {
+			return fmt.Errorf("compact generations: %w", err)
+		}
+		total.Add(tag.RowsAffected())
+		return nil
+	})
+
+	return total.Load(), err
+}
+
+func (db *DB) archiveGenerations(ctx context.Context, shard int, pool *pgxpool.Pool, query string, paths []string, generations []int32, total *atomic.Int64) error {
+	rows, err := pool.Query(ctx, query, paths, generations)
+	if err != nil {
+		return fmt.Errorf("archive generations: %w", err)
+	}
+	var groups []archivedGroup
+	for rows.Next() {
+		var g archivedGroup
+		var count int64
+		if err := rows.Scan(&g.path, &g.generation, &count); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan archived generation: %w", err)
+		}
+		groups = append(groups, g)
+		total.Add(count)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("archive generations: %w", err)
+	}
+	return db.recordArchiveManifests(ctx, shard, pool, groups)
+}
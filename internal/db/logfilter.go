@@ -0,0 +1,260 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// MaxFilterLimit caps the entries returned by one FilterLogs page
+const MaxFilterLimit = 1000
+
+// LogFilter combines optional predicates over logs. Zero values leave a
+// predicate out; the ones that are set must all match.
+type LogFilter struct {
+	Files    []string
+	Levels   []string
+	Start    time.Time // Inclusive
+	End      time.Time // Exclusive
+	Contains string    // Case-insensitive substring of the line
+	LineFrom int       // Inclusive; 0 is unbounded
+	LineTo   int       // Inclusive; 0 is unbounded
+}
+
+// LogCursor marks the last entry of a FilterLogs page. Entries are ordered
+// newest first by timestamp, then by ID.
+type LogCursor struct {
+	Timestamp time.Time
+	ID        int64
+}
+
+// String encodes the cursor as an opaque token for clients
+func (c LogCursor) String() string {
+	raw := strconv.FormatInt(c.Timestamp.UnixMicro(), 10) + "." + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseLogCursor decodes a token produced by LogCursor.String
+func ParseLogCursor(token string) (*LogCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	ts, id, ok := strings.Cut(string(raw), ".")
+	micros, err1 := strconv.ParseInt(ts, 10, 64)
+	logID, err2 := strconv.ParseInt(id, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	return &LogCursor{Timestamp: time.UnixMicro(micros).UTC(), ID: logID}, nil
+}
+
+// logPageCursor marks the last entry of a GetLogs page, which are ordered
+// newest first by timestamp, then line number, then ID. The zero cursor
+// starts at the newest entry.
+type logPageCursor struct {
+	Timestamp time.Time
+	LineNum   int
+	ID        int64
+}
+
+// logPageToken is the JSON inside a logPageCursor token. Pointers tell a
+// missing field from a zero one.
+type logPageToken struct {
+	Timestamp *int64 `json:"ts"` // Unix microseconds
+	LineNum   *int   `json:"line"`
+	ID        *int64 `json:"id"`
+}
+
+// String encodes the cursor as an opaque token for clients: base64 of
+// {"ts":…,"line":…,"id":…}
+func (c logPageCursor) String() string {
+	micros := c.Timestamp.UnixMicro()
+	raw, _ := json.Marshal(logPageToken{Timestamp: &micros, LineNum: &c.LineNum, ID: &c.ID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// parseLogPageCursor decodes a token produced by logPageCursor.String; an
+// empty token is the zero cursor. Unknown or missing fields are rejected.
+func parseLogPageCursor(token string) (logPageCursor, error) {
+	if token == "" {
+		return logPageCursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return logPageCursor{}, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	var t logPageToken
+	if err := dec.Decode(&t); err != nil || dec.More() {
+		return logPageCursor{}, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if t.Timestamp == nil || t.LineNum == nil || t.ID == nil {
+		return logPageCursor{}, fmt.Errorf("%w: incomplete cursor", ErrInvalidQuery)
+	}
+	return logPageCursor{Timestamp: time.UnixMicro(*t.Timestamp).UTC(), LineNum: *t.LineNum, ID: *t.ID}, nil
+}
+
+// args binds QueryLogsPage on one shard
+func (c logPageCursor) args(shard int, filePath string, limit, generation int) []interface{} {
+	if c.Timestamp.IsZero() {
+		return []interface{}{filePath, nil, limit, generation, 0, int64(0)}
+	}
+	return []interface{}{filePath, c.Timestamp, limit, generation, c.LineNum, cursorRowBound(shard, c.ID)}
+}
+
+// where renders the filter as SQL predicates, appending their arguments
+func (f LogFilter) where(args []interface{}) (string, []interface{}) {
+	conds := []string{"true"}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, strings.ReplaceAll(cond, "$?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if len(f.Files) > 0 {
+		add("file_path = ANY($?)", f.Files)
+	}
+	if len(f.Levels) > 0 {
+		add("level = ANY($?)", f.Levels)
+	}
+	if !f.Start.IsZero() {
+		add("timestamp >= $?", f.Start)
+	}
+	if !f.End.IsZero() {
+		add("timestamp < $?", f.End)
+	}
+	if f.LineFrom > 0 {
+		add("line_number >= $?", f.LineFrom)
+	}
+	if f.LineTo > 0 {
+		add("line_number <= $?", f.LineTo)
+	}
+	if f.Contains != "" {
+		// Compressed lines can only be checked once decompressed, so they
+		// all pass here and are filtered in matches
+		add("(line_gz IS NOT NULL OR strpos(lower(line), lower($?)) > 0)", f.Contains)
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+// matches applies the predicates SQL can't evaluate
+func (f LogFilter) matches(entry models.LogEntry) bool {
+	return f.Contains == "" || strings.Contains(strings.ToLower(entry.Line), strings.ToLower(f.Contains))
+}
+
+// FilterLogs returns up to limit entries matching f, newest first, starting
+// after cursor when it is set. The returned cursor continues from the last
+// row examined and is nil once no rows remain. A page can hold fewer than
+// limit entries when compressed lines fail the Contains check.
+func (db *DB) FilterLogs(ctx context.Context, f LogFilter, cursor *LogCursor, limit int) ([]models.LogEntry, *LogCursor, error) {
+	if limit <= 0 || limit > MaxFilterLimit {
+		limit = MaxFilterLimit
+	}
+	if !f.Start.IsZero() && !f.End.IsZero() && !f.End.After(f.Start) {
+		return nil, nil, fmt.Errorf("%w: end must be after start", ErrInvalidQuery)
+	}
+
+	parts := make([][]models.LogEntry, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		where, args := f.where(nil)
+		if cursor != nil {
+			args = append(args, cursor.Timestamp, cursorRowBound(shard, cursor.ID))
+			where += fmt.Sprintf(" AND (timestamp < $%d OR (timestamp = $%d AND id < $%d))",
+				len(args)-1, len(args)-1, len(args))
+		}
+		args = append(args, limit)
+
+		rows, err := pool.Query(ctx, fmt.Sprintf(`
+			SELECT %s
+			FROM logs
+			WHERE %s
+			ORDER BY timestamp DESC, id DESC
+			LIMIT $%d`, logColumns, where, len(args)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		logs, err := scanLogEntries(rows)
+		if err != nil {
+			return err
+		}
+		for i := range logs {
+			logs[i].ID = encodeLogID(shard, logs[i].ID)
+		}
+		parts[shard] = logs
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("filter logs: %w", err)
+	}
+
+	page := mergeSorted(parts, func(a, b models.LogEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		return a.ID > b.ID
+	}, limit)
+
+	var next *LogCursor
+	if len(page) == limit {
+		last := page[len(page)-1]
+		next = &LogCursor{Timestamp: last.Timestamp, ID: last.ID}
+	}
+
+	entries := page[:0:0]
+	for _, entry := range page {
+		if f.matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, next, nil
+}
+
+// cursorRowBound translates an encoded cursor ID into the row ID bound for
+// one shard, so shards keep the merged (timestamp, encoded ID) order: at the
+// cursor's timestamp, lower shards sort entirely after it and higher shards
+// entirely before it.
+func cursorRowBound(shard int, id int64) int64 {
+	cursorShard := int(id >> shardIDBits)
+	switch {
+	case shard < cursorShard:
+		return math.MaxInt64
+	case shard > cursorShard:
+		return 0
+	default:
+		return id & shardIDMask
+	}
+}
+
+// CountLogs counts the entries matching f. When Contains is set, compressed
+// lines are counted without checking their text.
+func (db *DB) CountLogs(ctx context.Context, f LogFilter) (int64, error) {
+	var total atomic.Int64
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		where, args := f.where(nil)
+		var count int64
+		if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM logs WHERE `+where, args...).Scan(&count); err != nil {
+			return err
+		}
+		total.Add(count)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("count logs: %w", err)
+	}
+	return total.Load(), nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLogPageCursorRoundTrip(t *testing.T) {
+	c := logPageCursor{Timestamp: time.Date(2024, 1, 1, 12, 0, 0, 123456000, time.UTC), LineNum: 42, ID: encodeLogID(0, 7)}
+	got, err := parseLogPageCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Errorf("round trip = %+v, want %+v", got, c)
+	}
+
+	zero, err := parseLogPageCursor("")
+	if err != nil || !zero.Timestamp.IsZero() {
+		t.Errorf("empty cursor = %+v, %v, want the zero cursor", zero, err)
+	}
+	if args := zero.args(0, "/var/log/app.log", 10, 0); args[1] != nil {
+		t.Errorf("zero cursor binds timestamp %v, want NULL for the first page", args[1])
+	}
+}
+
+func TestParseLogPageCursorRejectsMalformed(t *testing.T) {
+	encode := func(raw string) string { return base64.RawURLEncoding.EncodeToString([]byte(raw)) }
+	for _, token := range []string{
+		"not base64!",
+		encode("1704110400000000.42.7"),
+		encode(`{"ts":1704110400000000,"line":42}`),
+		encode(`{"ts":1704110400000000,"id":7}`),
+		encode(`{"line":42,"id":7}`),
+		encode(`{"ts":1704110400000000,"line":42,"id":7,"shard":1}`),
+		encode(`{"ts":"yesterday","line":42,"id":7}`),
+		encode(`{"ts":1704110400000000,"line":"forty","id":7}`),
+		encode(`{"ts":1704110400000000,"line":42,"id":7}{}`),
+		encode(`[1704110400000000,42,7]`),
+	} {
+		if _, err := parseLogPageCursor(token); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("cursor %q = %v, want ErrInvalidQuery", token, err)
+		}
+	}
+}
+
+func TestCursorRowBound(t *testing.T) {
+	id := encodeLogID(1, 500)
+	tests := []struct {
+		shard int
+		want  int64
+	}{
+		// Rows of earlier shards have smaller IDs, so all of them follow
+		// the cursor on a tie, and none of a later shard's do
+		{0, math.MaxInt64},
+		{1, 500},
+		{2, 0},
+	}
+	for _, tt := range tests {
+		if got := cursorRowBound(tt.shard, id); got != tt.want {
+			t.Errorf("bound on shard %d = %d, want %d", tt.shard, got, tt.want)
+		}
+	}
+}
+
+func TestLogPageCursorIsBase64JSON(t *testing.T) {
+	c := logPageCursor{Timestamp: time.UnixMicro(1704110400000000).UTC(), LineNum: 42, ID: 7}
+	raw, err := base64.RawURLEncoding.DecodeString(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ts":1704110400000000,"line":42,"id":7}`; string(raw) != want {
+		t.Errorf("cursor token = %s, want %s", raw, want)
+	}
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	batchInsertDuration    = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "db_batch_insert_duration_seconds", Help: "Time to store one batch, including failover waits, by table.", Buckets: prometheus.DefBuckets}, []string{"table"})
+	logEntriesIngested     = promauto.NewCounter(prometheus.CounterOpts{Name: "log_entries_ingested_total", Help: "Log lines stored."})
+	networkPacketsIngested = promauto.NewCounter(prometheus.CounterOpts{Name: "network_packets_ingested_total", Help: "Network packets stored."})
+)
+
+func init() {
+	// Exported empty until the first batch of each table
+	for _, table := range []string{"files", "logs", "network_packets"} {
+		batchInsertDuration.WithLabelValues(table)
+	}
+}
+
+// observeBatchInsert records how long a batch insert into table took
+func observeBatchInsert(table string, start time.Time) {
+	batchInsertDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Databases created from an older schema.sql or shard_schema.sql lack the
+// tables and columns added since. Every statement here is idempotent, so
+// the migrations simply run on every shard at each start; schema.sql and
+// shard_schema.sql describe the result.
+
+// migrationLock serializes servers migrating the same database
+const migrationLock = 0x6469616700
+
+var extensionMigrations = []string{
+	`CREATE EXTENSION IF NOT EXISTS btree_gin`,
+	`CREATE EXTENSION IF NOT EXISTS timescaledb`,
+}
+
+// primaryMigrations create the tables that live only on the primary. logs
+// references files there, so it is created with them.
+var primaryMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS files (
+		path TEXT PRIMARY KEY,
+		parent_path TEXT NOT NULL CHECK (parent_path <> ''),
+		name TEXT NOT NULL,
+		is_directory BOOLEAN NOT NULL DEFAULT false,
+		size BIGINT NOT NULL DEFAULT 0,
+		mod_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		is_gzipped BOOLEAN NOT NULL DEFAULT false,
+		is_scraped BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`ALTER TABLE files
+		ADD COLUMN IF NOT EXISTS scrape_state TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS retention_seconds BIGINT,
+		ADD COLUMN IF NOT EXISTS legal_hold BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS ingested_generation INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS ingested_line INTEGER NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS idx_files_parent ON files(parent_path)`,
+	`CREATE INDEX IF NOT EXISTS idx_files_directory ON files(is_directory) WHERE is_directory = true`,
+	`CREATE INDEX IF NOT EXISTS idx_files_scraped ON files(is_scraped) WHERE is_scraped = true`,
+
+	`CREATE TABLE IF NOT EXISTS file_history (
+		path TEXT NOT NULL,
+		parent_path TEXT NOT NULL,
+		name TEXT NOT NULL,
+		is_directory BOOLEAN NOT NULL,
+		size BIGINT NOT NULL,
+		mod_time TIMESTAMP WITH TIME ZONE NOT NULL,
+		is_gzipped BOOLEAN NOT NULL,
+		generation INTEGER NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT false,
+		observed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_file_history_path ON file_history(path, observed_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_file_history_observed_at ON file_history(observed_at)`,
+	`CREATE OR REPLACE FUNCTION record_file_history() RETURNS trigger AS $$
+	DECLARE
+		recorded BIGINT;
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO file_history (path, parent_path, name, is_directory, size, mod_time, is_gzipped, generation, deleted)
+			VALUES (OLD.path, OLD.parent_path, OLD.name, OLD.is_directory, OLD.size, OLD.mod_time, OLD.is_gzipped, OLD.generation, true);
+			RETURN NULL;
+		END IF;
+
+		IF TG_OP = 'UPDATE'
+		   AND NEW.is_directory = OLD.is_directory
+		   AND NEW.parent_path = OLD.parent_path
+		   AND NEW.generation = OLD.generation THEN
+			IF NEW.size = OLD.size THEN
+				RETURN NULL;
+			END IF;
+			SELECT size INTO recorded FROM file_history
+			WHERE path = NEW.path ORDER BY observed_at DESC LIMIT 1;
+			IF recorded IS NOT NULL AND abs(NEW.size - recorded) * 10 < recorded THEN
+				RETURN NULL;
+			END IF;
+		END IF;
+
+		INSERT INTO file_history (path, parent_path, name, is_directory, size, mod_time, is_gzipped, generation)
+		VALUES (NEW.path, NEW.parent_path, NEW.name, NEW.is_directory, NEW.size, NEW.mod_time, NEW.is_gzipped, NEW.generation);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'files_history' AND tgrelid = 'files'::regclass) THEN
+			CREATE TRIGGER files_history
+			AFTER INSERT OR DELETE OR UPDATE OF parent_path, is_directory, size, generation ON files
+			FOR EACH ROW EXECUTE FUNCTION record_file_history();
+		END IF;
+	END $$`,
+
+	`CREATE TABLE IF NOT EXISTS file_pins (
+		path TEXT PRIMARY KEY,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value JSONB NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS logs (
+		id BIGSERIAL PRIMARY KEY,
+		file_path TEXT REFERENCES files(path) ON DELETE CASCADE,
+		line TEXT NOT NULL,
+		line_number INTEGER NOT NULL,
+		timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		level TEXT DEFAULT 'info'
+	)`,
+	`CREATE TABLE IF NOT EXISTS archive_manifests (
+		shard INTEGER NOT NULL,
+		file_path TEXT NOT NULL,
+		generation INTEGER NOT NULL,
+		row_count BIGINT NOT NULL,
+		checksum TEXT NOT NULL,
+		archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		verified_at TIMESTAMP WITH TIME ZONE,
+		status TEXT NOT NULL DEFAULT 'ok',
+		detail TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (shard, file_path, generation)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_archive_manifests_verified ON archive_manifests(verified_at NULLS FIRST)`,
+	`CREATE TABLE IF NOT EXISTS reports (
+		id BIGSERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		params JSONB NOT NULL DEFAULT '{}'::jsonb,
+		schedule TEXT NOT NULL,
+		recipient_emails TEXT[] NOT NULL DEFAULT '{}',
+		format TEXT NOT NULL DEFAULT 'json',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS annotations (
+		id BIGSERIAL PRIMARY KEY,
+		timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+		text TEXT NOT NULL,
+		tags TEXT[] NOT NULL DEFAULT '{}',
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_annotations_timestamp ON annotations(timestamp)`,
+	`CREATE SEQUENCE IF NOT EXISTS agent_config_versions`,
+	`CREATE TABLE IF NOT EXISTS agent_configs (
+		agent_id TEXT PRIMARY KEY,
+		version BIGINT NOT NULL,
+		config JSONB NOT NULL,
+		updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS agents (
+		id TEXT PRIMARY KEY,
+		hostname TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL DEFAULT '',
+		version TEXT NOT NULL DEFAULT '',
+		connected_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS agent_config_acks (
+		agent_id TEXT PRIMARY KEY,
+		profile TEXT NOT NULL,
+		version BIGINT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		acked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS agent_metrics (
+		agent_id TEXT NOT NULL,
+		time TIMESTAMP WITH TIME ZONE NOT NULL,
+		lines_per_second DOUBLE PRECISION NOT NULL,
+		packets_per_second DOUBLE PRECISION NOT NULL,
+		bytes_per_second DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (agent_id, time)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_agent_metrics_time ON agent_metrics(time)`,
+	`CREATE TABLE IF NOT EXISTS agent_events (
+		id BIGSERIAL PRIMARY KEY,
+		agent_id TEXT NOT NULL,
+		time TIMESTAMP WITH TIME ZONE NOT NULL,
+		kind TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_agent_events_agent ON agent_events(agent_id, time DESC)`,
+	`CREATE TABLE IF NOT EXISTS query_plans (
+		id BIGSERIAL PRIMARY KEY,
+		query_name TEXT NOT NULL,
+		params JSONB NOT NULL DEFAULT '[]'::jsonb,
+		duration_ms DOUBLE PRECISION NOT NULL,
+		plan TEXT NOT NULL,
+		captured_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+}
+
+// shardMigrations create the tables of additional shards, whose logs have
+// no files table to reference
+var shardMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS logs (
+		id BIGSERIAL PRIMARY KEY,
+		file_path TEXT,
+		line TEXT NOT NULL,
+		line_number INTEGER NOT NULL,
+		timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		level TEXT DEFAULT 'info'
+	)`,
+}
+
+// ingestMigrations bring the log and packet tables every shard holds up to
+// date, after the shard's own tables exist
+var ingestMigrations = []string{
+	`ALTER TABLE logs
+		ADD COLUMN IF NOT EXISTS line_gz BYTEA,
+		ADD COLUMN IF NOT EXISTS truncated BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS agent_id TEXT,
+		ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+	// search_vector was once generated from line, which is empty for
+	// compressed lines; it is now written on insert
+	`ALTER TABLE logs ALTER COLUMN search_vector DROP EXPRESSION IF EXISTS`,
+	// The index once lacked generation
+	`DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'idx_logs_file_line' AND indexdef NOT LIKE '%generation%') THEN
+			DROP INDEX idx_logs_file_line;
+		END IF;
+	END $$`,
+	`CREATE INDEX IF NOT EXISTS idx_logs_file_line ON logs(file_path, generation, line_number)`,
+	`CREATE INDEX IF NOT EXISTS idx_logs_timestamp ON logs(timestamp)`,
+	`CREATE INDEX IF NOT EXISTS idx_logs_level ON logs(level)`,
+	`CREATE INDEX IF NOT EXISTS idx_logs_search ON logs USING GIN(search_vector)`,
+
+	`CREATE TABLE IF NOT EXISTS logs_archive (LIKE logs INCLUDING DEFAULTS)`,
+	`ALTER TABLE logs_archive
+		ADD COLUMN IF NOT EXISTS line_gz BYTEA,
+		ADD COLUMN IF NOT EXISTS truncated BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS agent_id TEXT,
+		ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+	`CREATE INDEX IF NOT EXISTS idx_logs_archive_file ON logs_archive(file_path, generation)`,
+
+	`CREATE TABLE IF NOT EXISTS network_packets (
+		time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		protocol TEXT NOT NULL,
+		src_ip INET,
+		dst_ip INET,
+		src_port INTEGER,
+		dst_port INTEGER,
+		length INTEGER DEFAULT 0,
+		payload_size INTEGER DEFAULT 0,
+		tcp_flags TEXT
+	)`,
+	`ALTER TABLE network_packets
+		ADD COLUMN IF NOT EXISTS id BIGSERIAL,
+		ADD COLUMN IF NOT EXISTS agent_id TEXT`,
+	`SELECT create_hypertable('network_packets', 'time', chunk_time_interval => INTERVAL '1 hour', if_not_exists => TRUE)`,
+	`CREATE INDEX IF NOT EXISTS idx_network_protocol ON network_packets(protocol, time DESC)`,
+	`CREATE INDEX IF NOT EXISTS idx_network_ips ON network_packets(src_ip, dst_ip)`,
+}
+
+// parentPathMigrations make parent_path canonical and then enforce it, on
+// any shard with a files table: the primary, and shards created from the
+// full schema
+var parentPathMigrations = []string{
+	`ALTER TABLE files ALTER COLUMN parent_path SET NOT NULL`,
+	`DO $$ BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'files_parent_path_check' AND conrelid = 'files'::regclass) THEN
+			ALTER TABLE files ADD CONSTRAINT files_parent_path_check CHECK (parent_path <> '');
+		END IF;
+	END $$`,
+}
+
+// Migrate brings every shard up to the current schema, each in one
+// transaction
+func (db *DB) Migrate(ctx context.Context) error {
+	return db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		tables := shardMigrations
+		if shard == 0 {
+			tables = primaryMigrations
+		}
+		return migrateShard(ctx, shard, pool, tables)
+	})
+}
+
+func migrateShard(ctx context.Context, shard int, pool *pgxpool.Pool, tables []string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin migration: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("lock migration: %w", err)
+	}
+	for _, group := range [][]string{extensionMigrations, tables, ingestMigrations} {
+		for _, stmt := range group {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("migrate: %w\n%s", err, stmt)
+			}
+		}
+	}
+
+	var hasFiles bool
+	if err := tx.QueryRow(ctx, `SELECT to_regclass('files') IS NOT NULL`).Scan(&hasFiles); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if hasFiles {
+		n, err := canonicalizeParentPaths(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("[DB] Shard %d: canonicalized parent_path of %d files", shard, n)
+		}
+		for _, stmt := range parentPathMigrations {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("migrate: %w\n%s", err, stmt)
+			}
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// canonicalizeParentPaths rewrites parent_path of files stored before it
+// was derived from the path, such as empty or NULL for children of the root,
+// and returns how many were changed
+func canonicalizeParentPaths(ctx context.Context, tx pgx.Tx) (int64, error) {
+	tag, err := tx.Exec(ctx, `
+		UPDATE files
+		SET parent_path = COALESCE(NULLIF(regexp_replace(path, '/[^/]*$', ''), ''), '/')
+		WHERE parent_path IS DISTINCT FROM COALESCE(NULLIF(regexp_replace(path, '/[^/]*$', ''), ''), '/')`)
+	if err != nil {
+		return 0, fmt.Errorf("canonicalize parent paths: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// baselineSchema is the schema of the first release, before any migration
+const baselineSchema = `
+CREATE TABLE files (
+    path TEXT PRIMARY KEY,
+    parent_path TEXT,
+    name TEXT NOT NULL,
+    is_directory BOOLEAN NOT NULL DEFAULT false,
+    size BIGINT NOT NULL DEFAULT 0,
+    mod_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    is_gzipped BOOLEAN NOT NULL DEFAULT false,
+    is_scraped BOOLEAN NOT NULL DEFAULT false
+);
+CREATE INDEX idx_files_parent ON files(parent_path);
+CREATE TABLE logs (
+    id BIGSERIAL PRIMARY KEY,
+    file_path TEXT REFERENCES files(path) ON DELETE CASCADE,
+    line TEXT NOT NULL,
+    line_number INTEGER NOT NULL,
+    timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    level TEXT DEFAULT 'info',
+    search_vector tsvector GENERATED ALWAYS AS (to_tsvector('english', line)) STORED
+);
+CREATE INDEX idx_logs_file_line ON logs(file_path, line_number);
+CREATE TABLE network_packets (
+    time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    protocol TEXT NOT NULL,
+    src_ip INET,
+    dst_ip INET,
+    src_port INTEGER,
+    dst_port INTEGER,
+    length INTEGER DEFAULT 0,
+    payload_size INTEGER DEFAULT 0,
+    tcp_flags TEXT
+);
+INSERT INTO files (path, parent_path, name) VALUES
+    ('/a.log', '', 'a.log'),
+    ('/b.log', NULL, 'b.log'),
+    ('/var/c.log', '/var', 'c.log');
+INSERT INTO network_packets (protocol) VALUES ('TCP');
+`
+
+func TestMigrateUpgradesBaselineSchema(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := context.Background()
+
+	// The baseline lives in its own schema, so other tests' tables are
+	// left alone
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	for _, stmt := range []string{
+		`DROP SCHEMA IF EXISTS migrate_test CASCADE`,
+		`CREATE SCHEMA migrate_test`,
+		`SET search_path = migrate_test, public`,
+		baselineSchema,
+	} {
+		if _, err := conn.Exec(ctx, stmt); err != nil {
+			t.Fatalf("%v\n%s", err, stmt)
+		}
+	}
+	t.Cleanup(func() { conn.Exec(ctx, `DROP SCHEMA migrate_test CASCADE`) })
+
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	cfg := &config.Config{
+		DatabaseURL:     url + sep + "search_path=migrate_test,public",
+		InitialBackoff:  10 * time.Millisecond,
+		MaxBackoff:      100 * time.Millisecond,
+		FailoverTimeout: time.Second,
+	}
+	// New migrates; running it again must change nothing
+	db, err := New(ctx, cfg)
+	if err != nil {
+		t.Fatalf("migrate baseline: %v", err)
+	}
+	defer db.Close()
+	if err := db.Migrate(ctx); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+
+	files, err := db.GetAllFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/a.log": "/", "/b.log": "/", "/var/c.log": "/var"}
+	for _, f := range files {
+		if f.ParentPath != want[f.Path] {
+			t.Errorf("%s parent_path = %q, want %q", f.Path, f.ParentPath, want[f.Path])
+		}
+	}
+
+	if _, err := conn.Exec(ctx, `INSERT INTO files (path, parent_path, name) VALUES ('/d.log', '', 'd.log')`); err == nil {
+		t.Error("empty parent_path accepted after migration")
+	}
+	if _, err := conn.Exec(ctx, `INSERT INTO logs (file_path, line, line_number, generation, agent_id, search_vector)
+		VALUES ('/a.log', 'x', 1, 1, 'agent', to_tsvector('x'))`); err != nil {
+		t.Errorf("log insert after migration: %v", err)
+	}
+	var ids int
+	if err := conn.QueryRow(ctx, `SELECT count(id) FROM network_packets`).Scan(&ids); err != nil || ids != 1 {
+		t.Errorf("existing packets numbered: %d, %v; want 1", ids, err)
+	}
+	for _, table := range []string{"settings", "file_history", "agents", "reports", "logs_archive", "query_plans"} {
+		var exists bool
+		if err := conn.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, "migrate_test."+table).Scan(&exists); err != nil || !exists {
+			t.Errorf("table %s not created: %v", table, err)
+		}
+	}
+}
@@ -3,13 +3,20 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"diagnostic-client/internal/tracing"
 	"diagnostic-client/pkg/models"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // GetAllFiles retrieves all files from the database
@@ -17,7 +24,7 @@ func (db *DB) GetAllFiles(ctx context.Context) ([]models.FileNode, error) {
 	query := `
 		SELECT 
 			path, parent_path, name, is_directory, 
-			size, mod_time, is_gzipped, is_scraped
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
 		FROM files 
 		ORDER BY path`
 
@@ -32,7 +39,7 @@ func (db *DB) GetAllFiles(ctx context.Context) ([]models.FileNode, error) {
 		var f models.FileNode
 		err := rows.Scan(
 			&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
-			&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped,
+			&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped, &f.ScrapeState, &f.Generation, &f.LastSeen,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("scan file row: %w", err)
@@ -43,33 +50,146 @@ func (db *DB) GetAllFiles(ctx context.Context) ([]models.FileNode, error) {
 	return files, nil
 }
 
-// SaveFiles performs an efficient bulk insert/update of files
+// GetFileByPath retrieves a single file by its path
+func (db *DB) GetFileByPath(ctx context.Context, path string) (*models.FileNode, error) {
+	var f models.FileNode
+	err := db.pool.QueryRow(ctx, `
+		SELECT 
+			path, parent_path, name, is_directory, 
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
+		FROM files 
+		WHERE path = $1`, path).Scan(
+		&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
+		&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped, &f.ScrapeState, &f.Generation, &f.LastSeen,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query file %s: %w", path, err)
+	}
+
+	return &f, nil
+}
+
+// GetFilesByPaths retrieves the files among paths, skipping unknown ones
+func (db *DB) GetFilesByPaths(ctx context.Context, paths []string) ([]models.FileNode, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT
+			path, parent_path, name, is_directory,
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
+		FROM files
+		WHERE path = ANY($1)`, paths)
+	if err != nil {
+		return nil, fmt.Errorf("query files: %w", err)
+	}
+	defer rows.Close()
+
+	var files []models.FileNode
+	for rows.Next() {
+		var f models.FileNode
+		err := rows.Scan(
+			&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
+			&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped, &f.ScrapeState, &f.Generation, &f.LastSeen,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("scan file row: %w", err)
+		}
+		files = append(files, f)
+	}
+
+	return files, rows.Err()
+}
+
+// UpdateScrapeState sets the scrape state of a single file
+func (db *DB) UpdateScrapeState(ctx context.Context, path, state string) error {
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE files SET scrape_state = $2
+		WHERE path = $1`, path, state)
+	if err != nil {
+		return fmt.Errorf("update scrape state of %s: %w", path, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Rows per bulk statement, keeping each under Postgres' limit of 65535 bind
+// parameters: 11 per file, 9 per log entry and 10 per packet
+const (
+	fileBatchSize   = 5000
+	logBatchSize    = 7000
+	packetBatchSize = 6000
+)
+
+// SaveFiles performs an efficient bulk insert/update of files, one statement
+// per fileBatchSize files, in a single transaction
 func (db *DB) SaveFiles(ctx context.Context, files []models.FileNode) error {
 	if len(files) == 0 {
 		return nil
 	}
 
-	// Build bulk upsert query
+	ctx, span := tracing.Start(ctx, "db.save_files", attribute.Int("db.rows", len(files)))
+	defer span.End()
+	defer observeBatchInsert("files", time.Now())
+
+	err := db.withFailover(ctx, db.pool, "save files", func() error {
+		tx, err := db.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin upsert: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if err := upsertFiles(ctx, tx, files); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("bulk upsert files: %w", err)
+	}
+
+	return nil
+}
+
+// upsertFiles upserts files in tx, one statement per fileBatchSize files
+func upsertFiles(ctx context.Context, tx pgx.Tx, files []models.FileNode) error {
+	for start := 0; start < len(files); start += fileBatchSize {
+		end := min(start+fileBatchSize, len(files))
+		query, args := upsertFilesQuery(files[start:end])
+		if _, err := tx.Exec(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertFilesQuery builds a bulk upsert of files; a file's generation never
+// moves backwards
+func upsertFilesQuery(files []models.FileNode) (string, []interface{}) {
 	valueStrings := make([]string, 0, len(files))
-	valueArgs := make([]interface{}, 0, len(files)*8)
+	valueArgs := make([]interface{}, 0, len(files)*11)
 
 	for i, file := range files {
-		baseIndex := i * 8
+		baseIndex := i * 11
 		valueStrings = append(valueStrings, fmt.Sprintf(
-			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
-			baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4,
-			baseIndex+5, baseIndex+6, baseIndex+7, baseIndex+8,
+			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4, baseIndex+5,
+			baseIndex+6, baseIndex+7, baseIndex+8, baseIndex+9, baseIndex+10, baseIndex+11,
 		))
 		valueArgs = append(valueArgs,
 			file.Path, file.ParentPath, file.Name, file.IsDirectory,
-			file.Size, file.ModTime, file.IsGzipped, file.IsScraped,
+			file.Size, file.ModTime, file.IsGzipped, file.IsScraped, file.ScrapeState,
+			file.Generation, file.LastSeen,
 		)
 	}
 
 	query := fmt.Sprintf(`
 		INSERT INTO files (
 			path, parent_path, name, is_directory,
-			size, mod_time, is_gzipped, is_scraped
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
 		)
 		VALUES %s
 		ON CONFLICT (path) DO UPDATE SET
@@ -79,222 +199,951 @@ func (db *DB) SaveFiles(ctx context.Context, files []models.FileNode) error {
 			size = EXCLUDED.size,
 			mod_time = EXCLUDED.mod_time,
 			is_gzipped = EXCLUDED.is_gzipped,
-			is_scraped = EXCLUDED.is_scraped`,
+			is_scraped = EXCLUDED.is_scraped,
+			scrape_state = EXCLUDED.scrape_state,
+			generation = GREATEST(files.generation, EXCLUDED.generation),
+			last_seen = GREATEST(files.last_seen, EXCLUDED.last_seen)`,
 		strings.Join(valueStrings, ","))
 
-	_, err := db.pool.Exec(ctx, query, valueArgs...)
-	if err != nil {
-		return fmt.Errorf("bulk upsert files: %w", err)
-	}
-
-	return nil
+	return query, valueArgs
 }
 
-// UpdateFiles performs efficient batch updates
-func (db *DB) UpdateFiles(ctx context.Context, files []models.FileNode) error {
+// UpdateFiles updates stored files in place, one statement per
+// fileBatchSize files, in a single transaction. It returns how many rows
+// were updated; fewer than len(files) means some paths weren't stored.
+func (db *DB) UpdateFiles(ctx context.Context, files []models.FileNode) (int64, error) {
 	if len(files) == 0 {
-		return nil
+		return 0, nil
 	}
 
-	batch := &pgx.Batch{}
+	ctx, span := tracing.Start(ctx, "db.update_files", attribute.Int("db.rows", len(files)))
+	defer span.End()
 
-	const updateQuery = `
-		UPDATE files SET
-			parent_path = $2,
-			name = $3,
-			is_directory = $4,
-			size = $5,
-			mod_time = $6,
-			is_gzipped = $7,
-			is_scraped = $8
-		WHERE path = $1`
-
-	for _, file := range files {
-		batch.Queue(updateQuery,
-			file.Path, file.ParentPath, file.Name, file.IsDirectory,
-			file.Size, file.ModTime, file.IsGzipped, file.IsScraped,
-		)
+	var updated int64
+	err := db.withFailover(ctx, db.pool, "update files", func() error {
+		tx, err := db.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin update: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if updated, err = updateFiles(ctx, tx, files); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, err
 	}
+	return updated, nil
+}
+
+// updateFiles updates stored files in tx, one statement per fileBatchSize
+// files, and returns how many rows were updated
+func updateFiles(ctx context.Context, tx pgx.Tx, files []models.FileNode) (int64, error) {
+	var updated int64
+	for start := 0; start < len(files); start += fileBatchSize {
+		end := min(start+fileBatchSize, len(files))
+		query, args := updateFilesQuery(files[start:end])
+		tag, err := tx.Exec(ctx, query, args...)
+		if err != nil {
+			return 0, fmt.Errorf("bulk update files: %w", err)
+		}
+		updated += tag.RowsAffected()
+	}
+	return updated, nil
+}
 
-	br := db.pool.SendBatch(ctx, batch)
-	defer br.Close()
+// updateFilesQuery builds one UPDATE of files joined to a VALUES list. The
+// first row carries the column types, which Postgres can't infer from
+// parameters in VALUES.
+func updateFilesQuery(files []models.FileNode) (string, []interface{}) {
+	valueStrings := make([]string, 0, len(files))
+	valueArgs := make([]interface{}, 0, len(files)*11)
 
-	for i := 0; i < len(files); i++ {
-		if _, err := br.Exec(); err != nil {
-			return fmt.Errorf("batch update file %s: %w", files[i].Path, err)
+	for i, file := range files {
+		baseIndex := i * 11
+		format := "($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)"
+		if i == 0 {
+			format = "($%d::text, $%d::text, $%d::text, $%d::boolean, $%d::bigint, $%d::timestamptz, " +
+				"$%d::boolean, $%d::boolean, $%d::text, $%d::integer, $%d::timestamptz)"
 		}
+		valueStrings = append(valueStrings, fmt.Sprintf(format,
+			baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4, baseIndex+5,
+			baseIndex+6, baseIndex+7, baseIndex+8, baseIndex+9, baseIndex+10, baseIndex+11,
+		))
+		valueArgs = append(valueArgs,
+			file.Path, file.ParentPath, file.Name, file.IsDirectory,
+			file.Size, file.ModTime, file.IsGzipped, file.IsScraped, file.ScrapeState,
+			file.Generation, file.LastSeen,
+		)
 	}
 
-	return nil
+	query := fmt.Sprintf(`
+		UPDATE files SET
+			parent_path = v.parent_path,
+			name = v.name,
+			is_directory = v.is_directory,
+			size = v.size,
+			mod_time = v.mod_time,
+			is_gzipped = v.is_gzipped,
+			is_scraped = v.is_scraped,
+			scrape_state = v.scrape_state,
+			generation = v.generation,
+			last_seen = v.last_seen
+		FROM (VALUES %s) AS v (
+			path, parent_path, name, is_directory,
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
+		)
+		WHERE files.path = v.path`,
+		strings.Join(valueStrings, ","))
+
+	return query, valueArgs
 }
 
-// DeleteFiles performs an efficient bulk delete
+// DeleteFiles performs an efficient bulk delete. Logs on the primary go with
+// their files by cascade; other shards have no foreign key and are cleaned here.
+// Files on legal hold are kept.
 func (db *DB) DeleteFiles(ctx context.Context, paths []string) error {
 	if len(paths) == 0 {
 		return nil
 	}
 
-	args := make([]interface{}, len(paths))
-	placeholders := make([]string, len(paths))
-
-	for i, path := range paths {
-		args[i] = path
-		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	var deleted []string
+	err := db.withFailover(ctx, db.pool, "delete files", func() error {
+		var err error
+		deleted, err = deleteFiles(ctx, db.pool, paths)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("bulk delete files: %w", err)
 	}
+	return db.deleteShardLogs(ctx, paths, deleted)
+}
 
-	query := fmt.Sprintf(`
-		DELETE FROM files 
-		WHERE path IN (%s)`,
-		strings.Join(placeholders, ","))
+// querier runs queries on a pool or in a transaction
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
 
-	_, err := db.pool.Exec(ctx, query, args...)
+// deleteFiles deletes the files not on legal hold and returns their paths
+func deleteFiles(ctx context.Context, q querier, paths []string) ([]string, error) {
+	rows, err := q.Query(ctx, `
+		DELETE FROM files
+		WHERE path = ANY($1) AND NOT legal_hold
+		RETURNING path`, paths)
 	if err != nil {
-		return fmt.Errorf("bulk delete files: %w", err)
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// deleteShardLogs removes the logs of deleted files from the shards without
+// a foreign key to files
+func (db *DB) deleteShardLogs(ctx context.Context, paths, deleted []string) error {
+	if held := len(paths) - len(deleted); held > 0 {
+		log.Printf("[DB] Kept %d deleted files on legal hold", held)
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	for shard, pool := range db.shards[1:] {
+		if _, err := pool.Exec(ctx, `DELETE FROM logs WHERE file_path = ANY($1)`, deleted); err != nil {
+			return fmt.Errorf("shard %d: delete logs: %w", shard+1, err)
+		}
 	}
 
 	return nil
 }
 
-// SaveLogs efficiently saves log entries in bulk
+// FileChanges is how a scan's files differ from the stored ones
+type FileChanges struct {
+	Deleted []string
+	Added   []models.FileNode
+	Updated []models.FileNode
+}
+
+// ApplyFileChanges deletes, inserts and updates files in one transaction, so
+// a failure leaves the stored files as they were. Updated files that weren't
+// stored are inserted instead; their count is returned, since it means the
+// caller's view of the stored files had drifted. Logs of deleted files on
+// other shards are removed once the transaction commits.
+func (db *DB) ApplyFileChanges(ctx context.Context, changes FileChanges) (int64, error) {
+	ctx, span := tracing.Start(ctx, "db.apply_file_changes",
+		attribute.Int("db.deleted", len(changes.Deleted)),
+		attribute.Int("db.added", len(changes.Added)),
+		attribute.Int("db.updated", len(changes.Updated)))
+	defer span.End()
+	defer observeBatchInsert("files", time.Now())
+
+	var (
+		deleted []string
+		drifted int64
+	)
+	err := db.withFailover(ctx, db.pool, "apply file changes", func() error {
+		deleted, drifted = nil, 0
+		tx, err := db.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin file changes: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		if len(changes.Deleted) > 0 {
+			if deleted, err = deleteFiles(ctx, tx, changes.Deleted); err != nil {
+				return fmt.Errorf("delete files: %w", err)
+			}
+		}
+		if err := upsertFiles(ctx, tx, changes.Added); err != nil {
+			return fmt.Errorf("save new files: %w", err)
+		}
+		updated, err := updateFiles(ctx, tx, changes.Updated)
+		if err != nil {
+			return err
+		}
+		if drifted = int64(len(changes.Updated)) - updated; drifted > 0 {
+			if err := upsertFiles(ctx, tx, changes.Updated); err != nil {
+				return fmt.Errorf("save drifted files: %w", err)
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return drifted, db.deleteShardLogs(ctx, changes.Deleted, deleted)
+}
+
+// SaveLogs efficiently saves log entries in bulk and fills in their IDs. When
+// line compression is enabled, long lines are stored gzipped in line_gz with an
+// empty line column; the search vector is always built from the uncompressed text.
+// Entries are written to the shard owning their agent, one statement per
+// logBatchSize entries in a transaction per shard. Shards are written in
+// ascending order and each commits on its own; when one fails, the error is a
+// *ShardWriteError naming the shards already committed, whose entries have
+// their IDs.
 func (db *DB) SaveLogs(ctx context.Context, logs []models.LogEntry) error {
 	if len(logs) == 0 {
 		return nil
 	}
 
+	ctx, span := tracing.Start(ctx, "db.save_logs", attribute.Int("db.rows", len(logs)))
+	defer span.End()
+
+	byShard := make([][]int, len(db.shards))
+	for i, l := range logs {
+		shard := db.shardFor(l.AgentID)
+		byShard[shard] = append(byShard[shard], i)
+	}
+
+	var committed []int
+	for shard, idx := range byShard {
+		if len(idx) == 0 {
+			continue
+		}
+		if len(idx) == len(logs) {
+			return db.saveLogs(ctx, shard, logs)
+		}
+
+		part := make([]models.LogEntry, len(idx))
+		for j, i := range idx {
+			part[j] = logs[i]
+		}
+		if err := db.saveLogs(ctx, shard, part); err != nil {
+			return &ShardWriteError{Shard: shard, Committed: committed, Err: err}
+		}
+		for j, i := range idx {
+			logs[i].ID = part[j].ID
+		}
+		committed = append(committed, shard)
+	}
+
+	return nil
+}
+
+func (db *DB) saveLogs(ctx context.Context, shard int, logs []models.LogEntry) error {
+	defer observeBatchInsert("logs", time.Now())
+
+	pool := db.shards[shard]
+	err := db.withFailover(ctx, pool, "save logs", func() error {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin insert logs: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		for start := 0; start < len(logs); start += logBatchSize {
+			end := min(start+logBatchSize, len(logs))
+			if err := db.insertLogs(ctx, tx, shard, logs[start:end]); err != nil {
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	logEntriesIngested.Add(float64(len(logs)))
+	return nil
+}
+
+// insertLogs inserts one batch of log entries and fills in their IDs
+func (db *DB) insertLogs(ctx context.Context, tx pgx.Tx, shard int, logs []models.LogEntry) error {
 	valueStrings := make([]string, 0, len(logs))
-	valueArgs := make([]interface{}, 0, len(logs)*5)
+	valueArgs := make([]interface{}, 0, len(logs)*9)
 
 	for i, log := range logs {
-		baseIndex := i * 5
+		baseIndex := i * 9
 		valueStrings = append(valueStrings, fmt.Sprintf(
-			"($%d, $%d, $%d, $%d, $%d)",
-			baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4, baseIndex+5,
+			"($%d, CASE WHEN $%d::bytea IS NULL THEN $%d ELSE '' END, $%d, $%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''), to_tsvector('english', $%d))",
+			baseIndex+1, baseIndex+3, baseIndex+2, baseIndex+3,
+			baseIndex+4, baseIndex+5, baseIndex+6, baseIndex+7, baseIndex+8, baseIndex+9, baseIndex+2,
 		))
+
+		var lineGz []byte
+		if db.compressLines {
+			lineGz = compressLine(log.Line)
+		}
 		valueArgs = append(valueArgs,
-			log.Filename, log.Line, log.LineNum, log.Timestamp, log.Level,
+			log.Filename, log.Line, lineGz, log.LineNum, log.Timestamp, log.Level, log.Truncated,
+			log.Generation, log.AgentID,
 		)
 	}
 
 	query := fmt.Sprintf(`
-		INSERT INTO logs (file_path, line, line_number, timestamp, level)
-		VALUES %s`,
+		INSERT INTO logs (file_path, line, line_gz, line_number, timestamp, level, truncated, generation, agent_id, search_vector)
+		VALUES %s
+		RETURNING id`,
 		strings.Join(valueStrings, ","))
 
-	_, err := db.pool.Exec(ctx, query, valueArgs...)
+	rows, err := tx.Query(ctx, query, valueArgs...)
 	if err != nil {
 		return fmt.Errorf("bulk insert logs: %w", err)
 	}
+	defer rows.Close()
 
+	// Rows come back in VALUES order; record the IDs so streamed entries
+	// carry the same identifier the REST API uses
+	for i := 0; rows.Next() && i < len(logs); i++ {
+		if err := rows.Scan(&logs[i].ID); err != nil {
+			return fmt.Errorf("scan log id: %w", err)
+		}
+		logs[i].ID = encodeLogID(shard, logs[i].ID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("bulk insert logs: %w", err)
+	}
 	return nil
 }
 
-// SaveNetworkPackets saves network packets in efficient batches
+// SaveNetworkPackets saves network packets in efficient batches, each on the
+// shard owning its agent, one statement per packetBatchSize packets in a
+// transaction per shard. Shards are written in ascending order and each
+// commits on its own; when one fails, the error is a *ShardWriteError naming
+// the shards already committed.
 func (db *DB) SaveNetworkPackets(ctx context.Context, packets []models.NetworkPacket) error {
 	if len(packets) == 0 {
 		return nil
 	}
 
+	ctx, span := tracing.Start(ctx, "db.save_network_packets", attribute.Int("db.rows", len(packets)))
+	defer span.End()
+
+	if len(db.shards) == 1 {
+		return db.saveNetworkPackets(ctx, db.pool, packets)
+	}
+
+	byShard := make([][]models.NetworkPacket, len(db.shards))
+	for _, p := range packets {
+		shard := db.shardFor(p.AgentID)
+		byShard[shard] = append(byShard[shard], p)
+	}
+	var committed []int
+	for shard, part := range byShard {
+		if len(part) == 0 {
+			continue
+		}
+		if err := db.saveNetworkPackets(ctx, db.shards[shard], part); err != nil {
+			return &ShardWriteError{Shard: shard, Committed: committed, Err: err}
+		}
+		committed = append(committed, shard)
+	}
+
+	return nil
+}
+
+func (db *DB) saveNetworkPackets(ctx context.Context, pool *pgxpool.Pool, packets []models.NetworkPacket) error {
+	defer observeBatchInsert("network_packets", time.Now())
+
+	err := db.withFailover(ctx, pool, "save network packets", func() error {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("begin insert: %w", err)
+		}
+		defer tx.Rollback(ctx)
+
+		for start := 0; start < len(packets); start += packetBatchSize {
+			end := min(start+packetBatchSize, len(packets))
+			query, args := insertPacketsQuery(packets[start:end])
+			if _, err := tx.Exec(ctx, query, args...); err != nil {
+				return err
+			}
+		}
+		return tx.Commit(ctx)
+	})
+	if err != nil {
+		return fmt.Errorf("bulk insert network packets: %w", err)
+	}
+
+	networkPacketsIngested.Add(float64(len(packets)))
+	return nil
+}
+
+// insertPacketsQuery builds a bulk insert of network packets
+func insertPacketsQuery(packets []models.NetworkPacket) (string, []interface{}) {
 	valueStrings := make([]string, 0, len(packets))
-	valueArgs := make([]interface{}, 0, len(packets)*9)
+	valueArgs := make([]interface{}, 0, len(packets)*10)
 
 	for i, packet := range packets {
-		baseIndex := i * 9
+		baseIndex := i * 10
 		valueStrings = append(valueStrings, fmt.Sprintf(
-			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''))",
 			baseIndex+1, baseIndex+2, baseIndex+3, baseIndex+4,
-			baseIndex+5, baseIndex+6, baseIndex+7, baseIndex+8, baseIndex+9,
+			baseIndex+5, baseIndex+6, baseIndex+7, baseIndex+8, baseIndex+9, baseIndex+10,
 		))
 		valueArgs = append(valueArgs,
 			packet.Timestamp, packet.Protocol, packet.SrcIP, packet.DstIP,
 			packet.SrcPort, packet.DstPort, packet.Length, packet.PayloadSize, packet.TCPFlags,
+			packet.AgentID,
 		)
 	}
 
 	query := fmt.Sprintf(`
 		INSERT INTO network_packets (
 			time, protocol, src_ip, dst_ip, src_port,
-			dst_port, length, payload_size, tcp_flags
+			dst_port, length, payload_size, tcp_flags, agent_id
 		)
 		VALUES %s`,
 		strings.Join(valueStrings, ","))
 
-	_, err := db.pool.Exec(ctx, query, valueArgs...)
+	return query, valueArgs
+}
+
+// GetLogs returns a page of up to limit log entries of one generation of the
+// file, or of all of them when generation is AllGenerations, newest first.
+// An empty cursor starts at the newest entry; otherwise it is the NextCursor
+// of the previous page. Entries are ordered by timestamp, line number and ID,
+// so entries sharing a timestamp are neither skipped nor repeated across
+// pages, and entries stored meanwhile with newer timestamps don't shift them.
+func (db *DB) GetLogs(ctx context.Context, filePath string, cursor string, limit, generation int) (*models.LogPage, error) {
+	if limit <= 0 || limit > MaxFilterLimit {
+		limit = MaxFilterLimit
+	}
+	after, err := parseLogPageCursor(cursor)
 	if err != nil {
-		return fmt.Errorf("bulk insert network packets: %w", err)
+		return nil, err
 	}
 
-	return nil
+	// One extra entry tells whether another page follows
+	parts := make([][]models.LogEntry, len(db.shards))
+	err = db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := db.namedQuery(ctx, pool, QueryLogsPage, after.args(shard, filePath, limit+1, generation)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		logs, err := scanLogEntries(rows)
+		if err != nil {
+			return err
+		}
+		for i := range logs {
+			logs[i].ID = encodeLogID(shard, logs[i].ID)
+		}
+		parts[shard] = logs
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query logs of %s: %w", filePath, err)
+	}
+
+	logs := mergeSorted(parts, func(a, b models.LogEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if a.LineNum != b.LineNum {
+			return a.LineNum > b.LineNum
+		}
+		return a.ID > b.ID
+	}, limit+1)
+
+	page := &models.LogPage{Entries: logs}
+	if len(logs) > limit {
+		page.Entries = logs[:limit]
+		page.HasMore = true
+		last := page.Entries[limit-1]
+		page.NextCursor = logPageCursor{Timestamp: last.Timestamp, LineNum: last.LineNum, ID: last.ID}.String()
+	}
+	if page.Entries == nil {
+		page.Entries = []models.LogEntry{}
+	}
+	return page, nil
 }
 
-// GetLogs retrieves log entries with pagination
-func (db *DB) GetLogs(ctx context.Context, filePath string, beforeTime time.Time, limit int) ([]models.LogEntry, error) {
-	rows, err := db.pool.Query(ctx, `
-		SELECT file_path, line, line_number, timestamp, level
-		FROM logs
-		WHERE file_path = $1 AND timestamp < $2
-		ORDER BY timestamp DESC, line_number DESC
-		LIMIT $3`,
-		filePath, beforeTime, limit)
+// GetLogsBetween retrieves up to limit log entries of a file in [start, end)
+// across generations, oldest first. truncated reports whether the range
+// holds more.
+func (db *DB) GetLogsBetween(ctx context.Context, filePath string, start, end time.Time, limit int) ([]models.LogEntry, bool, error) {
+	parts := make([][]models.LogEntry, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT `+logColumns+`
+			FROM logs
+			WHERE file_path = $1 AND timestamp >= $2 AND timestamp < $3
+			ORDER BY timestamp, generation, line_number, id
+			LIMIT $4`,
+			filePath, start, end, limit+1)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		logs, err := scanLogEntries(rows)
+		if err != nil {
+			return err
+		}
+		for i := range logs {
+			logs[i].ID = encodeLogID(shard, logs[i].ID)
+		}
+		parts[shard] = logs
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("query logs of %s between %v and %v: %w", filePath, start, end, err)
+	}
+
+	logs := mergeSorted(parts, func(a, b models.LogEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if a.Generation != b.Generation {
+			return a.Generation < b.Generation
+		}
+		return a.LineNum < b.LineNum
+	}, limit+1)
+	if len(logs) > limit {
+		return logs[:limit], true, nil
+	}
+	return logs, false, nil
+}
+
+// SearchLogs performs full-text search on log entries. When the search is
+// limited to files, each file is searched separately within its newest lines
+// in the window, and truncated reports whether a file had more.
+func (db *DB) SearchLogs(ctx context.Context, query string, files []string, startTime, endTime time.Time) ([]models.LogEntry, bool, error) {
+	var (
+		parts     [][]models.LogEntry
+		truncated bool
+		err       error
+	)
+	if len(files) > 0 && db.maxFileRows > 0 {
+		parts, truncated, err = db.searchFiles(ctx, query, files, startTime, endTime)
+	} else {
+		parts, err = db.queryLogs(ctx, QuerySearch, startTime, endTime, files, query)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return mergeSorted(parts, func(a, b models.LogEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		return a.ID > b.ID
+	}, searchLimit), truncated, nil
+}
+
+// queryLogs runs a registered log query on every shard, returning the
+// per-shard results with their IDs encoded
+func (db *DB) queryLogs(ctx context.Context, name string, args ...interface{}) ([][]models.LogEntry, error) {
+	parts := make([][]models.LogEntry, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := db.namedQuery(ctx, pool, name, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		logs, err := scanLogEntries(rows)
+		if err != nil {
+			return err
+		}
+		for i := range logs {
+			logs[i].ID = encodeLogID(shard, logs[i].ID)
+		}
+		parts[shard] = logs
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
+	return parts, nil
+}
+
+// logColumns is the column list expected by scanLogEntry
+const logColumns = `id, file_path, line, line_gz, line_number, timestamp, level, truncated, generation`
+
+// scanLogEntry reads a row selected with logColumns, transparently
+// decompressing lines stored in compressed form
+func scanLogEntry(row pgx.Row) (*models.LogEntry, error) {
+	var l models.LogEntry
+	var lineGz []byte
+	if err := row.Scan(
+		&l.ID, &l.Filename, &l.Line, &lineGz, &l.LineNum, &l.Timestamp, &l.Level, &l.Truncated,
+		&l.Generation,
+	); err != nil {
+		return nil, err
+	}
+
+	if lineGz != nil {
+		line, err := decompressLine(lineGz)
+		if err != nil {
+			return nil, fmt.Errorf("decompress log line %d: %w", l.ID, err)
+		}
+		l.Line = line
+	}
+
+	return &l, nil
+}
+
+func scanLogEntries(rows pgx.Rows) ([]models.LogEntry, error) {
 	var logs []models.LogEntry
 	for rows.Next() {
-		var l models.LogEntry
-		if err := rows.Scan(
-			&l.Filename, &l.Line, &l.LineNum, &l.Timestamp, &l.Level,
-		); err != nil {
+		l, err := scanLogEntry(rows)
+		if err != nil {
 			return nil, err
 		}
-		logs = append(logs, l)
+		logs = append(logs, *l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
 	}
 
 	return logs, nil
 }
 
-// SearchLogs performs full-text search on log entries
-func (db *DB) SearchLogs(ctx context.Context, query string, files []string, startTime, endTime time.Time) ([]models.LogEntry, error) {
-	rows, err := db.pool.Query(ctx, `
-		SELECT file_path, line, line_number, timestamp, level
+// GetLogEntry retrieves a single log entry by ID
+func (db *DB) GetLogEntry(ctx context.Context, id int64) (*models.LogEntry, error) {
+	shard, rowID, err := db.decodeLogID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	row := db.shards[shard].QueryRow(ctx, `
+		SELECT `+logColumns+`
 		FROM logs
-		WHERE 
-			timestamp BETWEEN $1 AND $2
-			AND ($3::text[] IS NULL OR file_path = ANY($3))
-			AND search_vector @@ plainto_tsquery('english', $4)
-		ORDER BY timestamp DESC
-		LIMIT 1000`,
-		startTime, endTime, files, query)
+		WHERE id = $1`, rowID)
+
+	entry, err := scanLogEntry(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query log entry %d: %w", id, err)
+	}
+	entry.ID = id
+
+	return entry, nil
+}
+
+// GetLogContext retrieves up to n lines on either side of entry in the same
+// file, ordered by line number. Ties on line number are broken by ID. Context
+// comes from the entry's own shard, which holds everything its agent sent.
+// Only the entry's generation is considered unless allGenerations is set, as
+// line numbers restart when a file is truncated.
+func (db *DB) GetLogContext(ctx context.Context, entry *models.LogEntry, n int, allGenerations bool) (before, after []models.LogEntry, err error) {
+	generation := entry.Generation
+	if allGenerations {
+		generation = AllGenerations
+	}
+
+	shard, rowID, err := db.decodeLogID(entry.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := db.shards[shard]
+
+	rows, err := pool.Query(ctx, `
+		SELECT `+logColumns+`
+		FROM logs
+		WHERE file_path = $1 AND (line_number, id) < ($2, $3)
+		  AND ($5::int < 0 OR generation = $5)
+		ORDER BY line_number DESC, id DESC
+		LIMIT $4`,
+		entry.Filename, entry.LineNum, rowID, n, generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query preceding lines: %w", err)
+	}
+	before, err = scanLogEntries(rows)
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Preceding lines were fetched nearest-first; present them in file order
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	rows, err = pool.Query(ctx, `
+		SELECT `+logColumns+`
+		FROM logs
+		WHERE file_path = $1 AND (line_number, id) > ($2, $3)
+		  AND ($5::int < 0 OR generation = $5)
+		ORDER BY line_number, id
+		LIMIT $4`,
+		entry.Filename, entry.LineNum, rowID, n, generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query following lines: %w", err)
+	}
+	defer rows.Close()
+
+	after, err = scanLogEntries(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range before {
+		before[i].ID = encodeLogID(shard, before[i].ID)
+	}
+	for i := range after {
+		after[i].ID = encodeLogID(shard, after[i].ID)
+	}
+
+	return before, after, nil
+}
+
+// GetStaleLogFiles finds log sources that went quiet: files whose latest log
+// line is older than olderThan. Files with no log lines at all are reported
+// separately, capped at limit. With several shards a file's logs may be spread
+// across them, so candidates from one shard are checked against the others.
+func (db *DB) GetStaleLogFiles(ctx context.Context, olderThan time.Duration, limit int) (*models.StaleLogFiles, error) {
+	result := &models.StaleLogFiles{
+		Stale:       []models.StaleLogFile{},
+		NeverLogged: []string{},
+	}
+
+	parts := make([][]models.StaleLogFile, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT file_path, MAX(timestamp) AS last_log_at
+			FROM logs
+			GROUP BY file_path
+			HAVING MAX(timestamp) < now() - $1::interval
+			ORDER BY last_log_at
+			LIMIT $2`,
+			olderThan, limit)
+		if err != nil {
+			return fmt.Errorf("query stale log files: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var f models.StaleLogFile
+			if err := rows.Scan(&f.Path, &f.LastLogAt); err != nil {
+				return fmt.Errorf("scan stale log file: %w", err)
+			}
+			parts[shard] = append(parts[shard], f)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	if len(db.shards) == 1 {
+		result.Stale = append(result.Stale, parts[0]...)
+	} else {
+		latest := make(map[string]time.Time)
+		var paths []string
+		for _, part := range parts {
+			for _, f := range part {
+				if t, ok := latest[f.Path]; !ok || f.LastLogAt.After(t) {
+					if !ok {
+						paths = append(paths, f.Path)
+					}
+					latest[f.Path] = f.LastLogAt
+				}
+			}
+		}
+
+		// A file quiet on one shard may still be logging through another agent
+		active, err := db.pathsWithLogs(ctx, paths, olderThan)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			for _, f := range part {
+				if !active[f.Path] && latest[f.Path].Equal(f.LastLogAt) {
+					result.Stale = append(result.Stale, f)
+					delete(latest, f.Path)
+				}
+			}
+		}
+		sort.Slice(result.Stale, func(i, j int) bool {
+			return result.Stale[i].LastLogAt.Before(result.Stale[j].LastLogAt)
+		})
+		if len(result.Stale) > limit {
+			result.Stale = result.Stale[:limit]
+		}
+	}
+
+	// Files live on the primary, so only its logs can be checked in SQL;
+	// the candidate list is uncapped when other shards must filter it
+	candidateLimit := limit
+	if len(db.shards) > 1 {
+		candidateLimit = -1
+	}
+	rows, err := db.pool.Query(ctx, `
+		SELECT f.path
+		FROM files f
+		WHERE NOT f.is_directory
+		  AND NOT EXISTS (SELECT 1 FROM logs l WHERE l.file_path = f.path)
+		ORDER BY f.path
+		LIMIT NULLIF($1, -1)`, candidateLimit)
+	if err != nil {
+		return nil, fmt.Errorf("query never logged files: %w", err)
+	}
 	defer rows.Close()
 
-	var logs []models.LogEntry
+	var neverLogged []string
 	for rows.Next() {
-		var l models.LogEntry
-		if err := rows.Scan(
-			&l.Filename, &l.Line, &l.LineNum, &l.Timestamp, &l.Level,
-		); err != nil {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("scan never logged file: %w", err)
+		}
+		neverLogged = append(neverLogged, path)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	if len(db.shards) > 1 {
+		logged, err := db.pathsWithLogs(ctx, neverLogged, 0)
+		if err != nil {
 			return nil, err
 		}
-		logs = append(logs, l)
+		for _, path := range neverLogged {
+			if !logged[path] && len(result.NeverLogged) < limit {
+				result.NeverLogged = append(result.NeverLogged, path)
+			}
+		}
+	} else {
+		result.NeverLogged = append(result.NeverLogged, neverLogged...)
 	}
 
-	return logs, nil
+	return result, nil
+}
+
+// pathsWithLogs reports which of paths have log lines on any shard newer than
+// within ago (0 means at any time)
+func (db *DB) pathsWithLogs(ctx context.Context, paths []string, within time.Duration) (map[string]bool, error) {
+	found := make(map[string]bool)
+	if len(paths) == 0 {
+		return found, nil
+	}
+
+	var mu sync.Mutex
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT DISTINCT file_path
+			FROM logs
+			WHERE file_path = ANY($1)
+			  AND ($2::interval = '0'::interval OR timestamp >= now() - $2::interval)`,
+			paths, within)
+		if err != nil {
+			return fmt.Errorf("query logged paths: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				return fmt.Errorf("scan logged path: %w", err)
+			}
+			mu.Lock()
+			found[path] = true
+			mu.Unlock()
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
 }
 
-func (db *DB) GetFileTree(ctx context.Context, path string, depth int) ([]models.FileNode, error) {
+// fileTreeChunk is how many nodes StreamFileTree hands over at a time
+const fileTreeChunk = 1000
+
+// StreamFileTree reads the nodes of the tree under path down to depth and
+// passes them to fn in chunks of up to 1000 as they are read, so memory use
+// does not grow with the size of the tree. fn must not keep the chunk. An
+// error from fn stops the read and is returned as is.
+func (db *DB) StreamFileTree(ctx context.Context, path string, depth int, order FileOrder, fn func([]models.FileNode) error) error {
+	rows, err := db.queryFileTree(ctx, path, depth, order)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	chunk := make([]models.FileNode, 0, fileTreeChunk)
+	for rows.Next() {
+		f, err := scanFileNode(rows)
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, f)
+		if len(chunk) == fileTreeChunk {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("rows error: %w", err)
+	}
+
+	if len(chunk) > 0 {
+		return fn(chunk)
+	}
+	return nil
+}
+
+func (db *DB) queryFileTree(ctx context.Context, path string, depth int, order FileOrder) (pgx.Rows, error) {
+	orderBy, err := order.orderBy()
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows are grouped by level and then by parent so every directory comes
+	// before its children; the requested order applies among siblings
 	if path == "/" {
 		query := `
             WITH RECURSIVE tree AS (
-                -- Base case: files with no parent or root-level files
+                -- Base case: root-level files
                 SELECT f.*, 1 as level
                 FROM files f
-                WHERE parent_path = '/' 
-                   OR parent_path = ''
-                   OR parent_path IS NULL
+                WHERE parent_path = '/' AND path <> '/'
 
                 UNION ALL
 
@@ -307,23 +1156,16 @@ func (db *DB) GetFileTree(ctx context.Context, path string, depth int) ([]models
             )
             SELECT 
                 path, parent_path, name, is_directory, 
-                size, mod_time, is_gzipped, is_scraped
+                size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
             FROM tree
-            ORDER BY 
-                CASE WHEN parent_path = '/' OR parent_path = '' OR parent_path IS NULL 
-                     THEN 0 ELSE 1 END,
-                parent_path,
-                CASE WHEN is_directory THEN 0 ELSE 1 END,
-                name;
-        `
-
-		rows, err := db.pool.Query(ctx, query, depth)
+            ORDER BY level, parent_path, ` + orderBy + `
+            LIMIT $2 OFFSET $3`
+
+		rows, err := db.pool.Query(ctx, query, depth, order.limit(), order.Offset)
 		if err != nil {
 			return nil, fmt.Errorf("query root files: %w", err)
 		}
-		defer rows.Close()
-
-		return scanFileNodes(rows)
+		return rows, nil
 	}
 
 	query := `
@@ -350,40 +1192,26 @@ func (db *DB) GetFileTree(ctx context.Context, path string, depth int) ([]models
               AND t.level < $2
               AND t.level > 0
         )
-        SELECT DISTINCT 
+        SELECT 
             path, parent_path, name, is_directory, 
-            size, mod_time, is_gzipped, is_scraped
+            size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
         FROM tree
-        ORDER BY 
-            level,
-            parent_path,
-            CASE WHEN is_directory THEN 0 ELSE 1 END,
-            name;
-    `
+        ORDER BY level, parent_path, ` + orderBy + `
+        LIMIT $3 OFFSET $4`
 
-	rows, err := db.pool.Query(ctx, query, path, depth)
+	rows, err := db.pool.Query(ctx, query, path, depth, order.limit(), order.Offset)
 	if err != nil {
 		return nil, fmt.Errorf("query file tree: %w", err)
 	}
-	defer rows.Close()
-
-	return scanFileNodes(rows)
+	return rows, nil
 }
 
 func scanFileNodes(rows pgx.Rows) ([]models.FileNode, error) {
 	var files []models.FileNode
 	for rows.Next() {
-		var f models.FileNode
-		err := rows.Scan(
-			&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
-			&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped,
-		)
+		f, err := scanFileNode(rows)
 		if err != nil {
-			return nil, fmt.Errorf("scan file row: %w", err)
-		}
-
-		if f.ParentPath == "" {
-			f.ParentPath = "/"
+			return nil, err
 		}
 
 		files = append(files, f)
@@ -396,69 +1224,140 @@ func scanFileNodes(rows pgx.Rows) ([]models.FileNode, error) {
 	return files, nil
 }
 
+func scanFileNode(rows pgx.Rows) (models.FileNode, error) {
+	var f models.FileNode
+	err := rows.Scan(
+		&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
+		&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped, &f.ScrapeState, &f.Generation, &f.LastSeen,
+	)
+	if err != nil {
+		return f, fmt.Errorf("scan file row: %w", err)
+	}
+	return f, nil
+}
+
 func (db *DB) GetNetworkPackets(ctx context.Context, startTime, endTime time.Time, protocols []string) ([]models.NetworkPacket, error) {
-	query := `
-		SELECT 
-			time, protocol, src_ip, dst_ip, src_port, 
-			dst_port, length, payload_size, tcp_flags
-		FROM network_packets
-		WHERE 
-			time BETWEEN $1 AND $2
-			AND ($3::text[] IS NULL OR protocol = ANY($3))
-		ORDER BY time DESC
-		LIMIT 1000`
+	parts := make([][]models.NetworkPacket, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := db.namedQuery(ctx, pool, QueryNetworkPackets, startTime, endTime, protocols)
+		if err != nil {
+			return fmt.Errorf("query network packets: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var p models.NetworkPacket
+			err := rows.Scan(
+				&p.Timestamp, &p.Protocol, &p.SrcIP, &p.DstIP,
+				&p.SrcPort, &p.DstPort, &p.Length, &p.PayloadSize, &p.TCPFlags,
+			)
+			if err != nil {
+				return fmt.Errorf("scan network packet: %w", err)
+			}
+			parts[shard] = append(parts[shard], p)
+		}
 
-	rows, err := db.pool.Query(ctx, query,
-		startTime, endTime, protocols)
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("rows error: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("query network packets: %w", err)
+		return nil, err
 	}
-	defer rows.Close()
 
-	var packets []models.NetworkPacket
-	for rows.Next() {
-		var p models.NetworkPacket
-		err := rows.Scan(
-			&p.Timestamp, &p.Protocol, &p.SrcIP, &p.DstIP,
-			&p.SrcPort, &p.DstPort, &p.Length, &p.PayloadSize, &p.TCPFlags,
-		)
+	return mergeSorted(parts, func(a, b models.NetworkPacket) bool {
+		return a.Timestamp.After(b.Timestamp)
+	}, packetLimit), nil
+}
+
+// GetPacketRate computes the average packet and byte rates between start and
+// end from stored packets, with the rate of each agent when byAgent is set
+func (db *DB) GetPacketRate(ctx context.Context, startTime, endTime time.Time, byAgent bool) (*models.PacketRate, error) {
+	seconds := endTime.Sub(startTime).Seconds()
+	if seconds <= 0 {
+		return nil, fmt.Errorf("%w: end must be after start", ErrInvalidQuery)
+	}
+
+	// An agent's packets are all on its shard, so per-agent sums from
+	// different shards never overlap
+	parts := make([][]models.AgentPacketRate, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT COALESCE(agent_id, ''), COUNT(*), COALESCE(SUM(length), 0)
+			FROM network_packets
+			WHERE time >= $1 AND time < $2
+			GROUP BY agent_id`,
+			startTime, endTime)
 		if err != nil {
-			return nil, fmt.Errorf("scan network packet: %w", err)
+			return fmt.Errorf("query packet rate: %w", err)
 		}
-		packets = append(packets, p)
-	}
+		defer rows.Close()
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("rows error: %w", err)
+		for rows.Next() {
+			var a models.AgentPacketRate
+			var count, total int64
+			if err := rows.Scan(&a.AgentID, &count, &total); err != nil {
+				return fmt.Errorf("scan packet rate: %w", err)
+			}
+			a.PacketsPerSecond = float64(count) / seconds
+			a.BytesPerSecond = float64(total) / seconds
+			parts[shard] = append(parts[shard], a)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return packets, nil
+	rate := &models.PacketRate{Start: startTime, End: endTime}
+	for _, part := range parts {
+		for _, a := range part {
+			rate.PacketsPerSecond += a.PacketsPerSecond
+			rate.BytesPerSecond += a.BytesPerSecond
+			if byAgent {
+				rate.Agents = append(rate.Agents, a)
+			}
+		}
+	}
+	if byAgent {
+		sort.Slice(rate.Agents, func(i, j int) bool { return rate.Agents[i].AgentID < rate.Agents[j].AgentID })
+		if rate.Agents == nil {
+			rate.Agents = []models.AgentPacketRate{}
+		}
+	}
+	return rate, nil
 }
 
-// GetNetworkPacketsWithStats retrieves network packets with aggregated statistics
+// GetNetworkPacketsWithStats retrieves network packets with aggregated
+// statistics. A range without packets has zero statistics.
 func (db *DB) GetNetworkPacketsWithStats(ctx context.Context, startTime, endTime time.Time, protocols []string) (*models.NetworkStats, error) {
+	if len(db.shards) > 1 {
+		return db.shardedNetworkStats(ctx, startTime, endTime, protocols)
+	}
+
 	statsQuery := `
 		WITH filtered_packets AS (
 			SELECT *
 			FROM network_packets
 			WHERE 
-				time BETWEEN $1 AND $2
+				time >= $1 AND time < $2
 				AND ($3::text[] IS NULL OR protocol = ANY($3))
 		)
 		SELECT 
 			COUNT(*) as packet_count,
-			SUM(length) as total_bytes,
-			AVG(length) as avg_packet_size,
+			COALESCE(SUM(length), 0) as total_bytes,
+			COALESCE(AVG(length), 0) as avg_packet_size,
 			COUNT(DISTINCT src_ip) as unique_sources,
 			COUNT(DISTINCT dst_ip) as unique_destinations,
 			COUNT(DISTINCT protocol) as protocol_count,
-			COALESCE(jsonb_object_agg(protocol, protocol_count), '{}'::jsonb) as protocol_stats
-		FROM filtered_packets
-		LEFT JOIN (
-			SELECT protocol, COUNT(*) as protocol_count
-			FROM filtered_packets
-			GROUP BY protocol
-		) protocol_summary ON true;`
+			-- Aggregated in a subquery: joined to the packets, the protocol
+			-- counts would multiply the totals and make protocol ambiguous
+			COALESCE((
+				SELECT jsonb_object_agg(protocol, n)
+				FROM (SELECT protocol, COUNT(*) AS n FROM filtered_packets GROUP BY protocol) p
+			), '{}'::jsonb) as protocol_stats
+		FROM filtered_packets`
 
 	var stats models.NetworkStats
 	var protocolStatsJSON []byte
@@ -480,6 +1379,82 @@ func (db *DB) GetNetworkPacketsWithStats(ctx context.Context, startTime, endTime
 		return nil, fmt.Errorf("unmarshal protocol stats: %w", err)
 	}
 
+	return db.withPackets(ctx, &stats, startTime, endTime, protocols)
+}
+
+// shardedNetworkStats computes the same statistics across shards. Distinct
+// addresses are collected from every shard so unique counts stay exact.
+func (db *DB) shardedNetworkStats(ctx context.Context, startTime, endTime time.Time, protocols []string) (*models.NetworkStats, error) {
+	type shardStats struct {
+		count, bytes int64
+		srcs, dsts   []string
+		protocols    map[string]int64
+	}
+
+	parts := make([]shardStats, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		var protocolStatsJSON []byte
+		part := &parts[shard]
+		err := pool.QueryRow(ctx, `
+			WITH filtered_packets AS (
+				SELECT *
+				FROM network_packets
+				WHERE
+					time >= $1 AND time < $2
+					AND ($3::text[] IS NULL OR protocol = ANY($3))
+			)
+			SELECT
+				COUNT(*),
+				COALESCE(SUM(length), 0),
+				COALESCE(array_agg(DISTINCT host(src_ip)) FILTER (WHERE src_ip IS NOT NULL), '{}'),
+				COALESCE(array_agg(DISTINCT host(dst_ip)) FILTER (WHERE dst_ip IS NOT NULL), '{}'),
+				COALESCE((
+					SELECT jsonb_object_agg(protocol, n)
+					FROM (SELECT protocol, COUNT(*) AS n FROM filtered_packets GROUP BY protocol) p
+				), '{}'::jsonb)
+			FROM filtered_packets`,
+			startTime, endTime, protocols).Scan(
+			&part.count, &part.bytes, &part.srcs, &part.dsts, &protocolStatsJSON,
+		)
+		if err != nil {
+			return fmt.Errorf("query network stats: %w", err)
+		}
+		if err := json.Unmarshal(protocolStatsJSON, &part.protocols); err != nil {
+			return fmt.Errorf("unmarshal protocol stats: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := models.NetworkStats{ProtocolStats: make(map[string]int64)}
+	srcs := make(map[string]struct{})
+	dsts := make(map[string]struct{})
+	for _, part := range parts {
+		stats.PacketCount += part.count
+		stats.TotalBytes += part.bytes
+		for _, ip := range part.srcs {
+			srcs[ip] = struct{}{}
+		}
+		for _, ip := range part.dsts {
+			dsts[ip] = struct{}{}
+		}
+		for protocol, n := range part.protocols {
+			stats.ProtocolStats[protocol] += n
+		}
+	}
+	if stats.PacketCount > 0 {
+		stats.AvgPacketSize = float64(stats.TotalBytes) / float64(stats.PacketCount)
+	}
+	stats.UniqueSources = int64(len(srcs))
+	stats.UniqueDestinations = int64(len(dsts))
+	stats.ProtocolCount = int64(len(stats.ProtocolStats))
+
+	return db.withPackets(ctx, &stats, startTime, endTime, protocols)
+}
+
+func (db *DB) withPackets(ctx context.Context, stats *models.NetworkStats, startTime, endTime time.Time, protocols []string) (*models.NetworkStats, error) {
 	// Get the actual packets
 	packets, err := db.GetNetworkPackets(ctx, startTime, endTime, protocols)
 	if err != nil {
@@ -487,20 +1462,90 @@ func (db *DB) GetNetworkPacketsWithStats(ctx context.Context, startTime, endTime
 	}
 	stats.Packets = packets
 
-	return &stats, nil
+	return stats, nil
+}
+
+// GetTopNetworkStats retrieves top network statistics of packets with one of
+// protocols, or of all packets when there are none. With several shards
+// each one is asked for more than limit entries and the counts are summed, so
+// the ranking is exact unless a key is spread thinly across many shards.
+func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Time, protocols []string, limit int) (*models.TopNetworkStats, error) {
+	shardLimit := limit
+	if len(db.shards) > 1 {
+		shardLimit = limit * topOverfetch
+	}
+
+	parts := make([]*models.TopNetworkStats, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		stats, err := topNetworkStats(ctx, pool, startTime, endTime, protocols, shardLimit)
+		if err != nil {
+			return err
+		}
+		parts[shard] = stats
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	merged := &models.TopNetworkStats{}
+	pick := func(get func(*models.TopNetworkStats) map[string]int64) map[string]int64 {
+		sum := make(map[string]int64)
+		for _, part := range parts {
+			for k, n := range get(part) {
+				sum[k] += n
+			}
+		}
+		return topN(sum, limit)
+	}
+	merged.TopSources = pick(func(s *models.TopNetworkStats) map[string]int64 { return s.TopSources })
+	merged.TopDestinations = pick(func(s *models.TopNetworkStats) map[string]int64 { return s.TopDestinations })
+	merged.TopProtocols = pick(func(s *models.TopNetworkStats) map[string]int64 { return s.TopProtocols })
+	merged.TopPorts = pick(func(s *models.TopNetworkStats) map[string]int64 { return s.TopPorts })
+
+	return merged, nil
+}
+
+// topOverfetch is how many times limit each shard returns for top stats
+const topOverfetch = 4
+
+// topN keeps the n largest counts, breaking ties by key for stable output
+func topN(counts map[string]int64, n int) map[string]int64 {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	top := make(map[string]int64, len(keys))
+	for _, k := range keys {
+		top[k] = counts[k]
+	}
+	return top
 }
 
-// GetTopNetworkStats retrieves top network statistics
-func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Time, limit int) (*models.TopNetworkStats, error) {
+func topNetworkStats(ctx context.Context, pool *pgxpool.Pool, startTime, endTime time.Time, protocols []string, limit int) (*models.TopNetworkStats, error) {
 	query := `
 		WITH time_range AS (
 			SELECT * FROM network_packets
-			WHERE time BETWEEN $1 AND $2
+			WHERE time >= $1 AND time < $2
+				AND ($4::text[] IS NULL OR protocol = ANY($4))
 		)
 		SELECT
 			jsonb_build_object(
 				'top_sources', (
-					SELECT jsonb_object_agg(src_ip, packet_count)
+					SELECT COALESCE(jsonb_object_agg(src_ip, packet_count), '{}'::jsonb)
 					FROM (
 						SELECT src_ip, COUNT(*) as packet_count
 						FROM time_range
@@ -510,7 +1555,7 @@ func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Ti
 					) top_sources
 				),
 				'top_destinations', (
-					SELECT jsonb_object_agg(dst_ip, packet_count)
+					SELECT COALESCE(jsonb_object_agg(dst_ip, packet_count), '{}'::jsonb)
 					FROM (
 						SELECT dst_ip, COUNT(*) as packet_count
 						FROM time_range
@@ -520,7 +1565,7 @@ func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Ti
 					) top_destinations
 				),
 				'top_protocols', (
-					SELECT jsonb_object_agg(protocol, packet_count)
+					SELECT COALESCE(jsonb_object_agg(protocol, packet_count), '{}'::jsonb)
 					FROM (
 						SELECT protocol, COUNT(*) as packet_count
 						FROM time_range
@@ -530,7 +1575,7 @@ func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Ti
 					) top_protocols
 				),
 				'top_ports', (
-					SELECT jsonb_object_agg(port, packet_count)
+					SELECT COALESCE(jsonb_object_agg(port, packet_count), '{}'::jsonb)
 					FROM (
 						SELECT dst_port as port, COUNT(*) as packet_count
 						FROM time_range
@@ -542,7 +1587,7 @@ func (db *DB) GetTopNetworkStats(ctx context.Context, startTime, endTime time.Ti
 			) as stats`
 
 	var statsJSON []byte
-	err := db.pool.QueryRow(ctx, query, startTime, endTime, limit).Scan(&statsJSON)
+	err := pool.QueryRow(ctx, query, startTime, endTime, limit, protocols).Scan(&statsJSON)
 	if err != nil {
 		return nil, fmt.Errorf("query top network stats: %w", err)
 	}
@@ -0,0 +1,625 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func testFiles(n int, now time.Time) []models.FileNode {
+	files := make([]models.FileNode, n)
+	for i := range files {
+		files[i] = models.FileNode{
+			Path:       fmt.Sprintf("/var/log/app/%d.log", i),
+			ParentPath: "/var/log/app",
+			Name:       fmt.Sprintf("%d.log", i),
+			Size:       int64(i),
+			ModTime:    now,
+			LastSeen:   now,
+		}
+	}
+	return files
+}
+
+func TestApplyFileChanges(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	files := testFiles(3, now)
+	if err := db.SaveFiles(ctx, files[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := files[1]
+	updated.Size = 100
+	drifted, err := db.ApplyFileChanges(ctx, FileChanges{
+		Deleted: []string{files[0].Path},
+		// files[2] was never stored
+		Updated: []models.FileNode{updated, files[2]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drifted != 1 {
+		t.Errorf("drifted = %d, want 1", drifted)
+	}
+
+	stored, err := db.GetAllFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[0].Path != files[1].Path || stored[1].Path != files[2].Path {
+		t.Fatalf("stored files = %+v, want %s and %s", stored, files[1].Path, files[2].Path)
+	}
+	if stored[0].Size != 100 {
+		t.Errorf("updated size = %d, want 100", stored[0].Size)
+	}
+}
+
+func TestApplyFileChangesRollsBack(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	files := testFiles(2, now)
+	if err := db.SaveFiles(ctx, files[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A NUL byte fails the insert after the delete ran
+	bad := files[1]
+	bad.Path = "/var/log/\x00"
+	if _, err := db.ApplyFileChanges(ctx, FileChanges{
+		Deleted: []string{files[0].Path},
+		Added:   []models.FileNode{bad},
+	}); err == nil {
+		t.Fatal("applying an invalid path succeeded")
+	}
+
+	if _, err := db.GetFileByPath(ctx, files[0].Path); err != nil {
+		t.Fatalf("delete wasn't rolled back: %v", err)
+	}
+}
+
+// updateFilesBatched is the previous UpdateFiles: one UPDATE per file
+// queued through a pgx.Batch
+func updateFilesBatched(ctx context.Context, tx pgx.Tx, files []models.FileNode) (int64, error) {
+	batch := &pgx.Batch{}
+	for _, file := range files {
+		batch.Queue(`
+			UPDATE files SET
+				parent_path = $2, name = $3, is_directory = $4, size = $5, mod_time = $6,
+				is_gzipped = $7, is_scraped = $8, scrape_state = $9, generation = $10, last_seen = $11
+			WHERE path = $1`,
+			file.Path, file.ParentPath, file.Name, file.IsDirectory, file.Size, file.ModTime,
+			file.IsGzipped, file.IsScraped, file.ScrapeState, file.Generation, file.LastSeen)
+	}
+	results := tx.SendBatch(ctx, batch)
+	defer results.Close()
+
+	var updated int64
+	for range files {
+		tag, err := results.Exec()
+		if err != nil {
+			return 0, err
+		}
+		updated += tag.RowsAffected()
+	}
+	return updated, nil
+}
+
+func BenchmarkUpdateFiles(b *testing.B) {
+	approaches := []struct {
+		name   string
+		update func(context.Context, pgx.Tx, []models.FileNode) (int64, error)
+	}{
+		{"values", updateFiles},
+		{"batch", updateFilesBatched},
+	}
+
+	for _, n := range []int{1000, 10000} {
+		for _, approach := range approaches {
+			b.Run(fmt.Sprintf("%s/%d", approach.name, n), func(b *testing.B) {
+				db := openTestDB(b, "files")
+				ctx := context.Background()
+				files := testFiles(n, time.Now())
+				if err := db.SaveFiles(ctx, files); err != nil {
+					b.Fatal(err)
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					tx, err := db.pool.Begin(ctx)
+					if err != nil {
+						b.Fatal(err)
+					}
+					updated, err := approach.update(ctx, tx, files)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if updated != int64(n) {
+						b.Fatalf("updated %d files, want %d", updated, n)
+					}
+					if err := tx.Rollback(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestUpdateFilesQuery(t *testing.T) {
+	// Postgres takes at most 65535 parameters in one statement
+	if fileBatchSize*11 > 65535 {
+		t.Fatalf("a chunk of %d files needs %d parameters", fileBatchSize, fileBatchSize*11)
+	}
+
+	query, args := updateFilesQuery(testFiles(3, time.Now()))
+	if len(args) != 33 {
+		t.Errorf("got %d arguments for 3 files, want 33", len(args))
+	}
+	if !strings.Contains(query, "$33)") || strings.Contains(query, "$34") {
+		t.Errorf("query doesn't use exactly 33 parameters: %s", query)
+	}
+	// Only the first row is typed
+	if strings.Count(query, "::timestamptz") != 2 {
+		t.Errorf("query types more than the first VALUES row: %s", query)
+	}
+}
+
+// TestUpdateFilesAcrossChunks updates more files than fit in one statement,
+// some of which aren't stored
+func TestUpdateFilesAcrossChunks(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	files := testFiles(2*fileBatchSize+10, now)
+	missing := map[int]bool{0: true, fileBatchSize: true, len(files) - 1: true}
+	var stored []models.FileNode
+	for i, f := range files {
+		if !missing[i] {
+			stored = append(stored, f)
+		}
+	}
+	if err := db.SaveFiles(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range files {
+		files[i].Size = -1
+	}
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	updated, err := updateFiles(ctx, tx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len(stored)); updated != want {
+		t.Errorf("updated %d files, want the %d stored", updated, want)
+	}
+
+	var unchanged int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM files WHERE size <> -1`).Scan(&unchanged); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged != 0 {
+		t.Errorf("%d stored files weren't updated", unchanged)
+	}
+}
+
+func TestBatchSizesStayUnderParameterLimit(t *testing.T) {
+	// Postgres takes at most 65535 parameters in one statement
+	for _, batch := range []struct {
+		table        string
+		rows, params int
+	}{
+		{"files", fileBatchSize, 11},
+		{"logs", logBatchSize, 9},
+		{"network_packets", packetBatchSize, 10},
+	} {
+		if n := batch.rows * batch.params; n > 65535 {
+			t.Errorf("a batch of %d %s needs %d parameters", batch.rows, batch.table, n)
+		}
+	}
+}
+
+// TestSaveLogsInChunks stores 20k lines, more than fit in one statement
+func TestSaveLogsInChunks(t *testing.T) {
+	db := openTestDB(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	const path = "/var/log/bulk.log"
+	if err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "bulk.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20000
+	logs := make([]models.LogEntry, n)
+	for i := range logs {
+		logs[i] = models.LogEntry{Filename: path, Line: fmt.Sprintf("line %d", i+1), LineNum: i + 1, Timestamp: now}
+	}
+	if err := db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored, distinct int
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*), COUNT(DISTINCT line_number) FROM logs WHERE file_path = $1`, path).Scan(&stored, &distinct); err != nil {
+		t.Fatal(err)
+	}
+	if stored != n || distinct != n {
+		t.Errorf("stored %d lines, %d distinct, want %d", stored, distinct, n)
+	}
+	ids := make(map[int64]bool, n)
+	for _, l := range logs {
+		ids[l.ID] = true
+	}
+	if len(ids) != n || ids[0] {
+		t.Errorf("got %d distinct IDs, want one for each of %d lines", len(ids), n)
+	}
+}
+
+// TestSaveLogsRollsBackEveryChunk fails a statement after the first chunk
+// went through, and none of the batch is kept
+func TestSaveLogsRollsBackEveryChunk(t *testing.T) {
+	db := openTestDB(t, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC()
+	const path = "/var/log/bulk.log"
+	if err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "bulk.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := make([]models.LogEntry, logBatchSize+10)
+	for i := range logs {
+		logs[i] = models.LogEntry{Filename: path, Line: "line", LineNum: i + 1, Timestamp: now}
+	}
+	// The second chunk refers to a file that isn't stored
+	logs[len(logs)-1].Filename = "/var/log/missing.log"
+	if err := db.SaveLogs(ctx, logs); err == nil {
+		t.Fatal("saved lines of a file that isn't stored")
+	}
+
+	var stored int
+	if err := db.pool.QueryRow(ctx, `SELECT COUNT(*) FROM logs`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Errorf("%d lines of the failed batch were kept", stored)
+	}
+}
+
+func TestSaveFilesAndPacketsInChunks(t *testing.T) {
+	db := openTestDB(t, "files", "network_packets")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	files := testFiles(2*fileBatchSize+1, now)
+	if err := db.SaveFiles(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+	packets := make([]models.NetworkPacket, 2*packetBatchSize+1)
+	for i := range packets {
+		packets[i] = models.NetworkPacket{Timestamp: now, Protocol: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: i, Length: 64}
+	}
+	if err := db.SaveNetworkPackets(ctx, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	var storedFiles, storedPackets int
+	if err := db.pool.QueryRow(ctx, `SELECT (SELECT COUNT(*) FROM files), (SELECT COUNT(*) FROM network_packets)`).Scan(&storedFiles, &storedPackets); err != nil {
+		t.Fatal(err)
+	}
+	if storedFiles != len(files) || storedPackets != len(packets) {
+		t.Errorf("stored %d files and %d packets, want %d and %d", storedFiles, storedPackets, len(files), len(packets))
+	}
+}
+
+// TestLogPagesTileUnderConcurrentInserts pages through a file whose lines
+// share timestamps, while new lines keep arriving. Every line stored before
+// paging starts is returned exactly once, in order.
+func TestLogPagesTileUnderConcurrentInserts(t *testing.T) {
+	db := openTestDB(t, "files", "logs")
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const path = "/var/log/busy.log"
+	if err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "busy.log", ModTime: start}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ten lines a millisecond, so pages end in the middle of a timestamp
+	const n = 600
+	logs := make([]models.LogEntry, n)
+	for i := range logs {
+		logs[i] = models.LogEntry{Filename: path, Line: fmt.Sprintf("line %d", i+1), LineNum: i + 1, Timestamp: start.Add(time.Duration(i/10) * time.Millisecond)}
+	}
+	if err := db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[int64]bool, n)
+	for _, l := range logs {
+		want[l.ID] = true
+	}
+
+	// Lines arriving while paging: newer ones, and late ones stamped with
+	// the timestamps being paged through
+	stop := make(chan struct{})
+	inserted := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				inserted <- nil
+				return
+			default:
+			}
+			late := []models.LogEntry{
+				{Filename: path, Line: "new", LineNum: n + 2*i + 1, Timestamp: start.Add(time.Hour)},
+				{Filename: path, Line: "late", LineNum: n + 2*i + 2, Timestamp: start.Add(time.Duration(i%60) * time.Millisecond)},
+			}
+			if err := db.SaveLogs(ctx, late); err != nil {
+				inserted <- err
+				return
+			}
+		}
+	}()
+
+	seen := make(map[int64]bool)
+	var last *models.LogEntry
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 1000 {
+			t.Fatal("paging doesn't end")
+		}
+		page, err := db.GetLogs(ctx, path, cursor, 37, AllGenerations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, l := range page.Entries {
+			if seen[l.ID] {
+				t.Fatalf("line %d (ID %d) returned twice", l.LineNum, l.ID)
+			}
+			seen[l.ID] = true
+			if last != nil && !pagedAfter(l, *last) {
+				t.Fatalf("line %d at %v follows line %d at %v out of order", l.LineNum, l.Timestamp, last.LineNum, last.Timestamp)
+			}
+			last = &page.Entries[i]
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	close(stop)
+	if err := <-inserted; err != nil {
+		t.Fatal(err)
+	}
+
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("line with ID %d skipped", id)
+		}
+	}
+}
+
+// pagedAfter reports whether a comes after b in GetLogs order, newest first
+func pagedAfter(a, b models.LogEntry) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	if a.LineNum != b.LineNum {
+		return a.LineNum < b.LineNum
+	}
+	return a.ID < b.ID
+}
+
+// TestPacketsMicrosecondsApart stores a burst of packets 1µs apart and reads
+// them back in order with their exact timestamps
+func TestPacketsMicrosecondsApart(t *testing.T) {
+	db := openTestDB(t, "network_packets")
+	ctx := context.Background()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 999_000_000, time.UTC)
+	const n = packetLimit
+	packets := make([]models.NetworkPacket, n)
+	for i := range packets {
+		packets[i] = models.NetworkPacket{
+			Timestamp: start.Add(time.Duration(i) * time.Microsecond),
+			Protocol:  "TCP",
+			SrcIP:     "10.0.0.1",
+			DstIP:     "10.0.0.2",
+			SrcPort:   i,
+			Length:    100,
+		}
+	}
+	if err := db.SaveNetworkPackets(ctx, packets); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetNetworkPackets(ctx, start, start.Add(n*time.Microsecond), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != n {
+		t.Fatalf("read %d packets, want %d", len(got), n)
+	}
+	// Newest first
+	for i, p := range got {
+		want := packets[n-1-i]
+		if !p.Timestamp.Equal(want.Timestamp) || p.SrcPort != want.SrcPort {
+			t.Fatalf("packet %d = %v port %d, want %v port %d", i, p.Timestamp, p.SrcPort, want.Timestamp, want.SrcPort)
+		}
+	}
+
+	// Ranges are half-open: a packet on the boundary between two ranges is
+	// counted in the later one only
+	boundary := start.Add(n / 2 * time.Microsecond)
+	for _, tc := range []struct {
+		start, end time.Time
+		want       int64
+	}{
+		{start, boundary, n / 2},
+		{boundary, start.Add(n * time.Microsecond), n / 2},
+		{boundary, boundary.Add(time.Microsecond), 1},
+		{boundary, boundary, 0},
+	} {
+		stats, err := db.GetNetworkPacketsWithStats(ctx, tc.start, tc.end, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.PacketCount != tc.want {
+			t.Errorf("[%v, %v) holds %d packets, want %d", tc.start.Format(time.RFC3339Nano), tc.end.Format(time.RFC3339Nano), stats.PacketCount, tc.want)
+		}
+	}
+}
+
+// TestFileTreeSortAndPaging pages through a directory in every sort order
+// and checks the pages tile the full listing, which is itself sorted
+func TestFileTreeSortAndPaging(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	files := []models.FileNode{
+		{Path: "/srv", ParentPath: "/", Name: "srv", IsDirectory: true, ModTime: now, LastSeen: now},
+		{Path: "/srv/zdir", ParentPath: "/srv", Name: "zdir", IsDirectory: true, ModTime: now.Add(-time.Hour), LastSeen: now},
+		{Path: "/srv/adir", ParentPath: "/srv", Name: "adir", IsDirectory: true, ModTime: now.Add(time.Hour), LastSeen: now},
+		{Path: "/srv/zdir/nested.log", ParentPath: "/srv/zdir", Name: "nested.log", ModTime: now, LastSeen: now},
+	}
+	for i := 0; i < 23; i++ {
+		files = append(files, models.FileNode{
+			Path:       fmt.Sprintf("/srv/f%02d.log", i),
+			ParentPath: "/srv",
+			Name:       fmt.Sprintf("f%02d.log", i),
+			// Repeating sizes and times, so ties need the secondary keys
+			Size:     int64(i%4) * 100,
+			ModTime:  now.Add(-time.Duration(i%5) * time.Minute),
+			LastSeen: now.Add(-time.Duration(i%3) * time.Second),
+		})
+	}
+	if err := db.SaveFiles(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+
+	compare := map[string]func(a, b models.FileNode) int{
+		"name":      func(a, b models.FileNode) int { return strings.Compare(a.Name, b.Name) },
+		"size":      func(a, b models.FileNode) int { return int(a.Size - b.Size) },
+		"mod_time":  func(a, b models.FileNode) int { return a.ModTime.Compare(b.ModTime) },
+		"last_seen": func(a, b models.FileNode) int { return a.LastSeen.Compare(b.LastSeen) },
+	}
+	read := func(order FileOrder, depth int) []models.FileNode {
+		t.Helper()
+		var got []models.FileNode
+		err := db.StreamFileTree(ctx, "/srv", depth, order, func(chunk []models.FileNode) error {
+			got = append(got, chunk...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	for key, cmp := range compare {
+		for _, desc := range []bool{false, true} {
+			for _, dirsFirst := range []bool{false, true} {
+				order := FileOrder{Sort: key, Desc: desc, DirsFirst: dirsFirst}
+				name := fmt.Sprintf("%s desc=%v dirs_first=%v", key, desc, dirsFirst)
+
+				all := read(order, 1)
+				if len(all) != 26 || all[0].Path != "/srv" {
+					t.Fatalf("%s: listing of %d nodes starting %q, want /srv and its 25 children", name, len(all), all[0].Path)
+				}
+				children := all[1:]
+				for i := 1; i < len(children); i++ {
+					a, b := children[i-1], children[i]
+					if dirsFirst && a.IsDirectory != b.IsDirectory {
+						if !a.IsDirectory {
+							t.Errorf("%s: file %s before directory %s", name, a.Path, b.Path)
+						}
+						continue
+					}
+					c := cmp(a, b)
+					if desc {
+						c = -c
+					}
+					if c > 0 || c == 0 && key != "name" && a.Name > b.Name {
+						t.Errorf("%s: %s before %s", name, a.Path, b.Path)
+					}
+				}
+
+				var paged []models.FileNode
+				for offset := 0; offset < len(all)+7; offset += 7 {
+					order.Limit, order.Offset = 7, offset
+					page := read(order, 1)
+					if len(page) > 7 {
+						t.Fatalf("%s: page at %d has %d nodes", name, offset, len(page))
+					}
+					paged = append(paged, page...)
+				}
+				order.Limit, order.Offset = 0, 0
+				if len(paged) != len(all) {
+					t.Fatalf("%s: pages hold %d nodes, want %d", name, len(paged), len(all))
+				}
+				for i := range all {
+					if paged[i].Path != all[i].Path {
+						t.Fatalf("%s: node %d is %s across pages, %s in the listing", name, i, paged[i].Path, all[i].Path)
+					}
+				}
+			}
+		}
+	}
+
+	// Deeper levels keep parents before their children
+	deep := read(FileOrder{Sort: "size", Desc: true}, 2)
+	seen := make(map[string]bool)
+	for _, f := range deep {
+		if f.Path != "/srv" && !seen[f.ParentPath] {
+			t.Errorf("%s listed before its parent", f.Path)
+		}
+		seen[f.Path] = true
+	}
+	if !seen["/srv/zdir/nested.log"] {
+		t.Error("depth 2 listing lacks the nested file")
+	}
+}
+
+// TestQueriesStopWithContext checks reads, and writes given a cancelled
+// context, stop with it; the tunnel detaches ingest writes from their
+// caller so they don't
+func TestQueriesStopWithContext(t *testing.T) {
+	d := openTestDB(t, "network_packets", "logs", "files")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	now := time.Now()
+
+	if _, err := d.GetNetworkPackets(ctx, now.Add(-time.Hour), now, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("packet query with a cancelled context = %v, want cancelled", err)
+	}
+	if _, err := d.GetLogs(ctx, "/var/log/app/0.log", "", 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("log query with a cancelled context = %v, want cancelled", err)
+	}
+	packets := []models.NetworkPacket{{Timestamp: now, Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", Length: 60}}
+	if err := d.SaveNetworkPackets(ctx, packets); !errors.Is(err, context.Canceled) {
+		t.Errorf("insert with a cancelled context = %v, want cancelled", err)
+	}
+	stored, err := d.GetNetworkPackets(context.Background(), now.Add(-time.Hour), now.Add(time.Second), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("cancelled insert stored %d packets", len(stored))
+	}
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrorLevels are the levels, compared case-insensitively, that count as errors
+var ErrorLevels = []string{"ERROR", "FATAL", "CRITICAL"}
+
+// CountLogsByLevel counts log lines with a timestamp in [start, end) by
+// upper-cased level
+func (db *DB) CountLogsByLevel(ctx context.Context, start, end time.Time) (map[string]int64, error) {
+	var mu sync.Mutex
+	counts := make(map[string]int64)
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT upper(COALESCE(level, '')), COUNT(*)
+			FROM logs
+			WHERE timestamp >= $1 AND timestamp < $2
+			GROUP BY 1`,
+			start, end)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var level string
+			var n int64
+			if err := rows.Scan(&level, &n); err != nil {
+				return err
+			}
+			mu.Lock()
+			counts[level] += n
+			mu.Unlock()
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("count logs by level: %w", err)
+	}
+	return counts, nil
+}
+
+// MaxLogCountPaths caps the paths GetLogCountsByFile counts in one call
+const MaxLogCountPaths = 1000
+
+// GetLogCountsByFile returns the number of stored log lines of each path,
+// across generations; paths without lines are missing from the map
+func (db *DB) GetLogCountsByFile(ctx context.Context, paths []string) (map[string]int64, error) {
+	if len(paths) > MaxLogCountPaths {
+		return nil, fmt.Errorf("%w: at most %d paths can be counted, got %d", ErrInvalidQuery, MaxLogCountPaths, len(paths))
+	}
+
+	counts := make(map[string]int64, len(paths))
+	if len(paths) == 0 {
+		return counts, nil
+	}
+
+	var mu sync.Mutex
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT file_path, COUNT(*)
+			FROM logs
+			WHERE file_path = ANY($1)
+			GROUP BY file_path`,
+			paths)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var path string
+			var c int64
+			if err := rows.Scan(&path, &c); err != nil {
+				return err
+			}
+			mu.Lock()
+			counts[path] += c
+			mu.Unlock()
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("count logs by file: %w", err)
+	}
+	return counts, nil
+}
+
+// TopErrorFiles returns the n files with the most error-level lines in
+// [start, end), most errors first
+func (db *DB) TopErrorFiles(ctx context.Context, start, end time.Time, n int) ([]models.FileErrorCount, error) {
+	var mu sync.Mutex
+	counts := make(map[string]int64)
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		// A file's lines live on every shard its agents hash to, so each
+		// shard returns all its counts rather than its own top n
+		rows, err := pool.Query(ctx, `
+			SELECT file_path, COUNT(*)
+			FROM logs
+			WHERE timestamp >= $1 AND timestamp < $2
+			  AND upper(level) = ANY($3)
+			GROUP BY file_path`,
+			start, end, ErrorLevels)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var path string
+			var c int64
+			if err := rows.Scan(&path, &c); err != nil {
+				return err
+			}
+			mu.Lock()
+			counts[path] += c
+			mu.Unlock()
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("top error files: %w", err)
+	}
+
+	top := make([]models.FileErrorCount, 0, len(counts))
+	for path, c := range counts {
+		top = append(top, models.FileErrorCount{Path: path, Errors: c})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Errors != top[j].Errors {
+			return top[i].Errors > top[j].Errors
+		}
+		return top[i].Path < top[j].Path
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top, nil
+}
+
+// LatestError returns the newest error-level line in [start, end), or
+// ErrNotFound when there is none
+func (db *DB) LatestError(ctx context.Context, start, end time.Time) (*models.LogEntry, error) {
+	parts := make([][]models.LogEntry, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		entry, err := scanLogEntry(pool.QueryRow(ctx, `
+			SELECT `+logColumns+`
+			FROM logs
+			WHERE timestamp >= $1 AND timestamp < $2
+			  AND upper(level) = ANY($3)
+			ORDER BY timestamp DESC, id DESC
+			LIMIT 1`,
+			start, end, ErrorLevels))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry.ID = encodeLogID(shard, entry.ID)
+		parts[shard] = []models.LogEntry{*entry}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("latest error: %w", err)
+	}
+
+	latest := mergeSorted(parts, func(a, b models.LogEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		return a.ID > b.ID
+	}, 1)
+	if len(latest) == 0 {
+		return nil, ErrNotFound
+	}
+	return &latest[0], nil
+}
+
+// LogsPerMinute counts log lines per minute in [start, end). Every minute
+// bucket is returned, oldest first, including empty ones; start is rounded
+// down to a whole minute.
+func (db *DB) LogsPerMinute(ctx context.Context, start, end time.Time) ([]models.MinuteCount, error) {
+	start = start.Truncate(time.Minute)
+	counts, err := db.bucketTotals(ctx, MetricLogs, start, end, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("logs per minute: %w", err)
+	}
+
+	var series []models.MinuteCount
+	for m := start; m.Before(end); m = m.Add(time.Minute) {
+		series = append(series, models.MinuteCount{Minute: m.UTC(), Lines: counts[m.Unix()]})
+	}
+	return series, nil
+}
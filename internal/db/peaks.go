@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Metrics GetBusiestPeriods can rank by
+const (
+	MetricPackets = "packets"
+	MetricBytes   = "bytes"
+	MetricLogs    = "logs"
+)
+
+// bucketSources maps a metric to its table, time column and summed value
+var bucketSources = map[string]struct{ table, column, value string }{
+	MetricPackets: {"network_packets", "time", "COUNT(*)"},
+	MetricBytes:   {"network_packets", "time", "COALESCE(SUM(length), 0)"},
+	MetricLogs:    {"logs", "timestamp", "COUNT(*)"},
+}
+
+// bucketTotals sums metric over [start, end) per bucket, keyed by the Unix
+// time of each bucket's start. Buckets are aligned to the Unix epoch, so
+// the same bucket size always splits time the same way; only non-empty
+// buckets are returned.
+func (db *DB) bucketTotals(ctx context.Context, metric string, start, end time.Time, bucket time.Duration) (map[int64]int64, error) {
+	src, ok := bucketSources[metric]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown metric %q", ErrInvalidQuery, metric)
+	}
+	if bucket < time.Second || bucket%time.Second != 0 {
+		return nil, fmt.Errorf("%w: bucket must be a whole number of seconds", ErrInvalidQuery)
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("%w: end must be after start", ErrInvalidQuery)
+	}
+
+	var mu sync.Mutex
+	totals := make(map[int64]int64)
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, fmt.Sprintf(`
+			SELECT (floor(extract(epoch FROM %[2]s) / $3) * $3)::bigint, %[3]s
+			FROM %[1]s
+			WHERE %[2]s >= $1 AND %[2]s < $2
+			GROUP BY 1`, src.table, src.column, src.value),
+			start, end, int64(bucket/time.Second))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var at, n int64
+			if err := rows.Scan(&at, &n); err != nil {
+				return err
+			}
+			mu.Lock()
+			totals[at] += n
+			mu.Unlock()
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// GetBusiestPeriods returns the limit buckets of [start, end) with the
+// highest metric (packets, bytes or logs), busiest first. Ties go to the
+// earlier bucket.
+func (db *DB) GetBusiestPeriods(ctx context.Context, start, end time.Time, bucket time.Duration, metric string, limit int) ([]models.PeriodTotal, error) {
+	totals, err := db.bucketTotals(ctx, metric, start, end, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("busiest periods: %w", err)
+	}
+
+	peaks := make([]models.PeriodTotal, 0, len(totals))
+	for at, n := range totals {
+		peaks = append(peaks, models.PeriodTotal{Start: time.Unix(at, 0).UTC(), Total: n})
+	}
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].Total != peaks[j].Total {
+			return peaks[i].Total > peaks[j].Total
+		}
+		return peaks[i].Start.Before(peaks[j].Start)
+	})
+	if len(peaks) > limit {
+		peaks = peaks[:limit]
+	}
+	return peaks, nil
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetFilePins retrieves the pinned paths stored in the database
+func (db *DB) GetFilePins(ctx context.Context) ([]string, error) {
+	rows, err := db.pool.Query(ctx, `SELECT path FROM file_pins ORDER BY created_at, path`)
+	if err != nil {
+		return nil, fmt.Errorf("query file pins: %w", err)
+	}
+	defer rows.Close()
+
+	pins, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("scan file pins: %w", err)
+	}
+
+	return pins, nil
+}
+
+// SetFilePins replaces the stored pinned paths
+func (db *DB) SetFilePins(ctx context.Context, paths []string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM file_pins`); err != nil {
+		return fmt.Errorf("clear file pins: %w", err)
+	}
+
+	if len(paths) > 0 {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO file_pins (path)
+			SELECT DISTINCT unnest($1::text[])`, paths)
+		if err != nil {
+			return fmt.Errorf("insert file pins: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetPinnedRoots resolves the configured pins plus those stored in the
+// database into virtual roots with file counts and total sizes. Configured
+// pins come first; duplicates are dropped.
+func (db *DB) GetPinnedRoots(ctx context.Context, configured []string) ([]models.PinnedRoot, error) {
+	stored, err := db.GetFilePins(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var pins []string
+	for _, p := range append(append([]string{}, configured...), stored...) {
+		if !seen[p] {
+			seen[p] = true
+			pins = append(pins, p)
+		}
+	}
+
+	if len(pins) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.pool.Query(ctx, `
+		SELECT
+			p.path,
+			f.path IS NOT NULL,
+			COALESCE(f.is_directory, true),
+			COALESCE(s.file_count, 0),
+			COALESCE(s.total_size, 0)
+		FROM unnest($1::text[]) WITH ORDINALITY AS p(path, ord)
+		LEFT JOIN files f ON f.path = p.path
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS file_count, SUM(c.size) AS total_size
+			FROM files c
+			WHERE NOT c.is_directory
+			  AND (c.path = p.path OR starts_with(c.path, rtrim(p.path, '/') || '/'))
+		) s ON true
+		ORDER BY p.ord`, pins)
+	if err != nil {
+		return nil, fmt.Errorf("query pinned roots: %w", err)
+	}
+	defer rows.Close()
+
+	var roots []models.PinnedRoot
+	for rows.Next() {
+		var r models.PinnedRoot
+		if err := rows.Scan(&r.Path, &r.Exists, &r.IsDirectory, &r.FileCount, &r.TotalSize); err != nil {
+			return nil, fmt.Errorf("scan pinned root: %w", err)
+		}
+		r.Name = path.Base(r.Path)
+		roots = append(roots, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Names of read queries in the registry. Registered queries are timed, can be
+// explained on demand and have their plans captured when slow.
+const (
+	QueryLogsPage       = "logs-page"
+	QuerySearch         = "search"
+	QuerySearchFile     = "search-file"
+	QueryNetworkPackets = "network-packets"
+)
+
+// Result caps for unpaginated queries, applied per shard and again after merging
+const (
+	searchLimit = 1000
+	packetLimit = 1000
+)
+
+type namedQuery struct {
+	sql string
+	// bind builds the query arguments from string parameters, for EXPLAIN
+	bind func(params map[string]string) ([]interface{}, error)
+}
+
+var namedQueries = map[string]namedQuery{
+	// Newest lines of a file, after the cursor ($2, $5, $6) when $2 is set
+	QueryLogsPage: {
+		sql: `
+		SELECT ` + logColumns + `
+		FROM logs
+		WHERE file_path = $1
+		  AND ($4::int < 0 OR generation = $4)
+		  AND ($2::timestamptz IS NULL OR (timestamp, line_number, id) < ($2, $5::int, $6::bigint))
+		ORDER BY timestamp DESC, line_number DESC, id DESC
+		LIMIT $3`,
+		bind: func(p map[string]string) ([]interface{}, error) {
+			cursor, err := parseLogPageCursor(p["cursor"])
+			if err != nil {
+				return nil, err
+			}
+			limit, err := paramInt(p, "limit", 100)
+			if err != nil {
+				return nil, err
+			}
+			generation, err := paramInt(p, "generation", AllGenerations)
+			if err != nil {
+				return nil, err
+			}
+			return cursor.args(0, p["file"], limit, generation), nil
+		},
+	},
+	QuerySearch: {
+		sql: `
+		SELECT ` + logColumns + `
+		FROM logs
+		WHERE 
+			timestamp >= $1 AND timestamp < $2
+			AND ($3::text[] IS NULL OR file_path = ANY($3))
+			AND search_vector @@ plainto_tsquery('english', $4)
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ` + strconv.Itoa(searchLimit),
+		bind: func(p map[string]string) ([]interface{}, error) {
+			start, end, err := paramRange(p)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{start, end, paramList(p, "files"), p["query"]}, nil
+		},
+	},
+	// Search within one file, considering only its newest $5 lines in the
+	// window so a runaway file can't make the query scan without bound
+	QuerySearchFile: {
+		sql: `
+		SELECT ` + logColumns + `
+		FROM (
+			SELECT * FROM logs
+			WHERE file_path = $3 AND timestamp >= $1 AND timestamp < $2
+			ORDER BY timestamp DESC, id DESC
+			LIMIT $5
+		) recent
+		WHERE search_vector @@ plainto_tsquery('english', $4)
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ` + strconv.Itoa(searchLimit),
+		bind: func(p map[string]string) ([]interface{}, error) {
+			start, end, err := paramRange(p)
+			if err != nil {
+				return nil, err
+			}
+			maxRows, err := paramInt(p, "max_rows", 1000000)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{start, end, p["file"], p["query"], maxRows}, nil
+		},
+	},
+	QueryNetworkPackets: {
+		sql: `
+		SELECT 
+			time, protocol, src_ip, dst_ip, src_port, 
+			dst_port, length, payload_size, tcp_flags
+		FROM network_packets
+		WHERE 
+			time >= $1 AND time < $2
+			AND ($3::text[] IS NULL OR protocol = ANY($3))
+		ORDER BY time DESC, id DESC
+		LIMIT ` + strconv.Itoa(packetLimit),
+		bind: func(p map[string]string) ([]interface{}, error) {
+			start, end, err := paramRange(p)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{start, end, paramList(p, "protocols")}, nil
+		},
+	},
+}
+
+// QueryNames lists the registered query names
+func QueryNames() []string {
+	names := make([]string, 0, len(namedQueries))
+	for name := range namedQueries {
+		names = append(names, name)
+	}
+	return names
+}
+
+// namedQuery runs a registered query on one shard, capturing its plan when it
+// is slow. Plans are only captured from the primary.
+func (db *DB) namedQuery(ctx context.Context, pool *pgxpool.Pool, name string, args ...interface{}) (pgx.Rows, error) {
+	q, ok := namedQueries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown query: %s", name)
+	}
+
+	start := time.Now()
+	rows, err := pool.Query(ctx, q.sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if pool == db.pool {
+		db.plans.observe(name, q.sql, args, time.Since(start))
+	}
+	return rows, nil
+}
+
+func paramTime(p map[string]string, key string, fallback time.Time) (time.Time, error) {
+	v := p[key]
+	if v == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return t, nil
+}
+
+func paramInt(p map[string]string, key string, fallback int) (int, error) {
+	v := p[key]
+	if v == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return i, nil
+}
+
+func paramRange(p map[string]string) (time.Time, time.Time, error) {
+	end, err := paramTime(p, "end", time.Now())
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start, err := paramTime(p, "start", end.Add(-time.Hour))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, end, nil
+}
+
+func paramList(p map[string]string, key string) []string {
+	if p[key] == "" {
+		return nil
+	}
+	return strings.Split(p[key], ",")
+}
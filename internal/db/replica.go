@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReplicaStatus describes the primary database server as a replication
+// standby
+type ReplicaStatus struct {
+	// The server is a standby replaying the primary's changes
+	InRecovery bool `json:"in_recovery"`
+	// Time since the last replayed transaction was committed on the
+	// primary; nil unless in recovery with something replayed. It grows
+	// while the primary is idle too.
+	ReplayLagMs *float64 `json:"replay_lag_ms,omitempty"`
+}
+
+// GetReplicaStatus reports whether the database is a standby and how far
+// behind it is
+func (db *DB) GetReplicaStatus(ctx context.Context) (ReplicaStatus, error) {
+	var status ReplicaStatus
+	err := db.pool.QueryRow(ctx, `
+		SELECT pg_is_in_recovery(),
+		       CASE WHEN pg_is_in_recovery()
+		            THEN EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::float8 * 1000
+		       END`,
+	).Scan(&status.InRecovery, &status.ReplayLagMs)
+	if err != nil {
+		return ReplicaStatus{}, fmt.Errorf("query replica status: %w", err)
+	}
+	return status, nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const reportColumns = `id, name, query, params, schedule, recipient_emails, format, created_at`
+
+// CreateReport inserts a new report definition and fills in its ID
+func (db *DB) CreateReport(ctx context.Context, r *models.Report) error {
+	err := db.pool.QueryRow(ctx, `
+		INSERT INTO reports (name, query, params, schedule, recipient_emails, format)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		r.Name, r.Query, reportParams(r), r.Schedule, r.RecipientEmails, r.Format,
+	).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert report: %w", err)
+	}
+
+	return nil
+}
+
+// GetReports retrieves all report definitions
+func (db *DB) GetReports(ctx context.Context) ([]models.Report, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+reportColumns+`
+		FROM reports
+		ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("query reports: %w", err)
+	}
+	defer rows.Close()
+
+	var reports []models.Report
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+
+	return reports, nil
+}
+
+// GetReport retrieves a single report definition by ID
+func (db *DB) GetReport(ctx context.Context, id int64) (*models.Report, error) {
+	row := db.pool.QueryRow(ctx, `
+		SELECT `+reportColumns+`
+		FROM reports
+		WHERE id = $1`, id)
+
+	r, err := scanReport(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return r, err
+}
+
+// UpdateReport replaces the definition of an existing report
+func (db *DB) UpdateReport(ctx context.Context, r *models.Report) error {
+	err := db.pool.QueryRow(ctx, `
+		UPDATE reports SET
+			name = $2,
+			query = $3,
+			params = $4,
+			schedule = $5,
+			recipient_emails = $6,
+			format = $7
+		WHERE id = $1
+		RETURNING created_at`,
+		r.ID, r.Name, r.Query, reportParams(r), r.Schedule, r.RecipientEmails, r.Format,
+	).Scan(&r.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("update report %d: %w", r.ID, err)
+	}
+
+	return nil
+}
+
+// DeleteReport removes a report definition
+func (db *DB) DeleteReport(ctx context.Context, id int64) error {
+	tag, err := db.pool.Exec(ctx, `DELETE FROM reports WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete report %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func scanReport(row pgx.Row) (*models.Report, error) {
+	var r models.Report
+	err := row.Scan(
+		&r.ID, &r.Name, &r.Query, &r.Params, &r.Schedule,
+		&r.RecipientEmails, &r.Format, &r.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("scan report row: %w", err)
+	}
+
+	return &r, nil
+}
+
+func reportParams(r *models.Report) map[string]string {
+	if r.Params == nil {
+		return map[string]string{}
+	}
+	return r.Params
+}
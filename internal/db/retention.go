@@ -0,0 +1,224 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RetentionCutoffs says which log lines have expired: those older than the
+// cutoff of their file, else of their level, else Default. A zero Default
+// keeps lines without a more specific rule. Lines of Held files never expire.
+type RetentionCutoffs struct {
+	Default time.Time
+	Levels  map[string]time.Time // Keyed by upper-case level
+	Keep    []string             // Upper-case levels that are never deleted
+	Files   map[string]time.Time // Overrides every level rule for the file
+	Held    []string             // Files on legal hold; override everything
+}
+
+// RetentionPreview is what a retention pass would delete from one table
+type RetentionPreview struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	// Rows times the table's average row size including indexes and TOAST,
+	// from planner statistics
+	EstimatedBytes int64 `json:"estimated_bytes"`
+}
+
+// retentionPass selects the expired lines of one file, one level or the
+// rest. Each pass stands alone so it can use an index.
+type retentionPass struct {
+	what  string
+	where string
+	args  []interface{}
+}
+
+func (c RetentionCutoffs) passes() []retentionPass {
+	// Levels and files with their own rule are excluded from the broader
+	// passes, and held files from all of them
+	levels := append([]string{}, c.Keep...)
+	for level := range c.Levels {
+		levels = append(levels, level)
+	}
+	held := make(map[string]bool, len(c.Held))
+	files := make([]string, 0, len(c.Files)+len(c.Held))
+	for _, file := range c.Held {
+		held[file] = true
+		files = append(files, file)
+	}
+	for file := range c.Files {
+		if !held[file] {
+			files = append(files, file)
+		}
+	}
+
+	var passes []retentionPass
+	for file, cutoff := range c.Files {
+		if held[file] {
+			continue
+		}
+		passes = append(passes, retentionPass{
+			what:  "logs of " + file,
+			where: `file_path = $2 AND timestamp < $1`,
+			args:  []interface{}{cutoff, file},
+		})
+	}
+	for level, cutoff := range c.Levels {
+		passes = append(passes, retentionPass{
+			what: level + " logs",
+			where: `timestamp < $1 AND upper(level) = $2
+				AND (file_path IS NULL OR file_path <> ALL($3))`,
+			args: []interface{}{cutoff, level, files},
+		})
+	}
+	if !c.Default.IsZero() {
+		// Lines with no level fall under the default window too
+		passes = append(passes, retentionPass{
+			what: "logs",
+			where: `timestamp < $1 AND (level IS NULL OR upper(level) <> ALL($2))
+				AND (file_path IS NULL OR file_path <> ALL($3))`,
+			args: []interface{}{c.Default, levels, files},
+		})
+	}
+	return passes
+}
+
+// DeleteLogsBefore deletes log lines older than cutoff on every shard
+func (db *DB) DeleteLogsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	return db.DeleteExpiredLogs(ctx, RetentionCutoffs{Default: cutoff})
+}
+
+// DeleteExpiredLogs deletes expired log lines on every shard. Levels are
+// matched case-insensitively.
+func (db *DB) DeleteExpiredLogs(ctx context.Context, c RetentionCutoffs) (int64, error) {
+	passes := c.passes()
+
+	var deleted atomic.Int64
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		for _, p := range passes {
+			tag, err := pool.Exec(ctx, `DELETE FROM logs WHERE `+p.where, p.args...)
+			if err != nil {
+				return fmt.Errorf("delete %s: %w", p.what, err)
+			}
+			deleted.Add(tag.RowsAffected())
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted.Load(), err
+	}
+
+	return deleted.Load(), nil
+}
+
+// PreviewExpiredLogs counts what DeleteExpiredLogs would delete, without
+// deleting anything
+func (db *DB) PreviewExpiredLogs(ctx context.Context, c RetentionCutoffs) ([]RetentionPreview, error) {
+	passes := c.passes()
+
+	var rows, bytes atomic.Int64
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		var shardRows int64
+		for _, p := range passes {
+			var n int64
+			if err := pool.QueryRow(ctx, `SELECT COUNT(*) FROM logs WHERE `+p.where, p.args...).Scan(&n); err != nil {
+				return fmt.Errorf("count %s: %w", p.what, err)
+			}
+			shardRows += n
+		}
+
+		// Average row size differs per shard, so the estimate is too
+		var rowBytes float64
+		err := pool.QueryRow(ctx, `
+			SELECT CASE WHEN reltuples > 0
+				THEN pg_total_relation_size(oid) / reltuples
+				ELSE 0 END
+			FROM pg_class WHERE oid = 'logs'::regclass`).Scan(&rowBytes)
+		if err != nil {
+			return fmt.Errorf("estimate log row size: %w", err)
+		}
+
+		rows.Add(shardRows)
+		bytes.Add(int64(float64(shardRows) * rowBytes))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []RetentionPreview{{Table: "logs", Rows: rows.Load(), EstimatedBytes: bytes.Load()}}, nil
+}
+
+// StorageUsage is the estimated size of a set of log lines
+type StorageUsage struct {
+	Files          int   `json:"files,omitempty"`
+	Rows           int64 `json:"rows"`
+	EstimatedBytes int64 `json:"estimated_bytes"`
+}
+
+// RetentionUsage breaks stored logs down by how retention treats them
+type RetentionUsage struct {
+	Total      StorageUsage `json:"total"`
+	Held       StorageUsage `json:"held"`       // Files on legal hold
+	Overridden StorageUsage `json:"overridden"` // Files with their own window and no hold
+}
+
+// GetRetentionUsage estimates how much of the logs tables belongs to held
+// and to overridden files. Totals come from planner statistics; the held
+// and overridden rows are counted and sized by the average row.
+func (db *DB) GetRetentionUsage(ctx context.Context, c RetentionCutoffs) (RetentionUsage, error) {
+	held := make(map[string]bool, len(c.Held))
+	for _, file := range c.Held {
+		held[file] = true
+	}
+	var overridden []string
+	for file := range c.Files {
+		if !held[file] {
+			overridden = append(overridden, file)
+		}
+	}
+
+	usage := RetentionUsage{
+		Held:       StorageUsage{Files: len(c.Held)},
+		Overridden: StorageUsage{Files: len(overridden)},
+	}
+	var mu sync.Mutex
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		var rows, bytes float64
+		err := pool.QueryRow(ctx, `
+			SELECT greatest(reltuples, 0), pg_total_relation_size(oid)
+			FROM pg_class WHERE oid = 'logs'::regclass`).Scan(&rows, &bytes)
+		if err != nil {
+			return fmt.Errorf("estimate log table size: %w", err)
+		}
+		var heldRows, overriddenRows int64
+		err = pool.QueryRow(ctx, `
+			SELECT count(*) FILTER (WHERE file_path = ANY($1)),
+				count(*) FILTER (WHERE file_path = ANY($2))
+			FROM logs
+			WHERE file_path = ANY($1) OR file_path = ANY($2)`, c.Held, overridden).Scan(&heldRows, &overriddenRows)
+		if err != nil {
+			return fmt.Errorf("count held and overridden logs: %w", err)
+		}
+
+		var rowBytes float64
+		if rows > 0 {
+			rowBytes = bytes / rows
+		}
+		mu.Lock()
+		usage.Total.Rows += int64(rows)
+		usage.Total.EstimatedBytes += int64(bytes)
+		usage.Held.Rows += heldRows
+		usage.Held.EstimatedBytes += int64(float64(heldRows) * rowBytes)
+		usage.Overridden.Rows += overriddenRows
+		usage.Overridden.EstimatedBytes += int64(float64(overriddenRows) * rowBytes)
+		mu.Unlock()
+		return nil
+	})
+	return usage, err
+}
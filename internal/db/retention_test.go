@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestRetentionPassesSkipHeldFiles(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := RetentionCutoffs{
+		Default: now.Add(-72 * time.Hour),
+		Levels:  map[string]time.Time{"DEBUG": now.Add(-time.Hour)},
+		Files: map[string]time.Time{
+			"/var/log/audit.log": now.Add(-365 * 24 * time.Hour),
+			"/var/log/held.log":  now.Add(-time.Hour),
+		},
+		Held: []string{"/var/log/held.log"},
+	}
+
+	passes := c.passes()
+	// One for the overridden file, one for DEBUG and one for the default
+	if len(passes) != 3 {
+		t.Fatalf("%d passes, want 3", len(passes))
+	}
+	for _, p := range passes {
+		if strings.HasPrefix(p.what, "logs of ") {
+			if p.what != "logs of /var/log/audit.log" {
+				t.Errorf("pass for %s", p.what)
+			}
+			continue
+		}
+		// Broader passes exclude both files with their own rule
+		excluded := p.args[len(p.args)-1].([]string)
+		if len(excluded) != 2 {
+			t.Errorf("%s pass excludes %v, want both files", p.what, excluded)
+		}
+	}
+}
+
+func TestRetentionUsageAndDeletionOfHeldFiles(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now()
+
+	var logs []models.LogEntry
+	for _, name := range []string{"plain.log", "audit.log", "held.log"} {
+		path := "/var/log/" + name
+		if err := db.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: name, ModTime: now, LastSeen: now}}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 3; i++ {
+			logs = append(logs, models.LogEntry{Filename: path, Line: "line", LineNum: i, Timestamp: now})
+		}
+	}
+	if err := db.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFileRetention(ctx, "/var/log/audit.log", 365*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFileRetention(ctx, "/var/log/held.log", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFileLegalHold(ctx, "/var/log/held.log", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFileLegalHold(ctx, "/var/log/missing.log", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("hold on an unknown file: %v, want ErrNotFound", err)
+	}
+
+	settings, err := db.GetFileSettings(ctx, "/var/log/held.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.LegalHold || settings.Retention != time.Hour {
+		t.Errorf("settings = %+v, want held with an hour's retention", settings)
+	}
+
+	files, err := db.GetFileRetentions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := db.GetHeldFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cutoffs := RetentionCutoffs{Files: make(map[string]time.Time), Held: held}
+	for file, d := range files {
+		cutoffs.Files[file] = now.Add(-d)
+	}
+
+	// A held file with an override counts as held only
+	usage, err := db.GetRetentionUsage(ctx, cutoffs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Held.Files != 1 || usage.Held.Rows != 3 {
+		t.Errorf("held usage = %+v, want 1 file with 3 rows", usage.Held)
+	}
+	if usage.Overridden.Files != 1 || usage.Overridden.Rows != 3 {
+		t.Errorf("overridden usage = %+v, want 1 file with 3 rows", usage.Overridden)
+	}
+
+	// Deleting files keeps those on hold, with their logs
+	if err := db.DeleteFiles(ctx, []string{"/var/log/plain.log", "/var/log/held.log"}); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := db.GetFileByPath(ctx, "/var/log/held.log"); err != nil || f == nil {
+		t.Errorf("held file after deletion: %v, %v", f, err)
+	}
+	if f, _ := db.GetFileByPath(ctx, "/var/log/plain.log"); f != nil {
+		t.Error("file not on hold survived deletion")
+	}
+	page, err := db.GetLogs(ctx, "/var/log/held.log", "", 10, AllGenerations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 3 {
+		t.Errorf("held file has %d lines after deletion, want 3", len(page.Entries))
+	}
+}
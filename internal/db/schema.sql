@@ -8,13 +8,29 @@ CREATE EXTENSION IF NOT EXISTS timescaledb;
 -- File system table
 CREATE TABLE files (
     path TEXT PRIMARY KEY,
-    parent_path TEXT,
+    -- Directory of path; '/' for children of the root, never empty
+    parent_path TEXT NOT NULL CHECK (parent_path <> ''),
     name TEXT NOT NULL,
     is_directory BOOLEAN NOT NULL DEFAULT false,
     size BIGINT NOT NULL DEFAULT 0,
     mod_time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     is_gzipped BOOLEAN NOT NULL DEFAULT false,
-    is_scraped BOOLEAN NOT NULL DEFAULT false
+    is_scraped BOOLEAN NOT NULL DEFAULT false,
+    -- pending_decompress, scraped, skipped_too_large, or a newer agent's state verbatim
+    scrape_state TEXT NOT NULL DEFAULT '',
+    -- Bumped each time the file is truncated and restarts from line 1
+    generation INTEGER NOT NULL DEFAULT 0,
+    -- Last time an agent reported the file as new or changed
+    last_seen TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- Overrides the log retention policy for this file; NULL follows the policy
+    retention_seconds BIGINT,
+    -- Set while the file's logs must be kept: retention, compaction and
+    -- deletion by agents all leave held files alone
+    legal_hold BOOLEAN NOT NULL DEFAULT false,
+    -- Highest line number stored for ingested_generation, so lines re-sent
+    -- after a restart aren't stored twice
+    ingested_generation INTEGER NOT NULL DEFAULT 0,
+    ingested_line INTEGER NOT NULL DEFAULT 0
 );
 
 -- Indexes for tree operations
@@ -22,24 +38,124 @@ CREATE INDEX idx_files_parent ON files(parent_path);
 CREATE INDEX idx_files_directory ON files(is_directory) WHERE is_directory = true;
 CREATE INDEX idx_files_scraped ON files(is_scraped) WHERE is_scraped = true;
 
+-- Past states of files, for browsing the tree as it was at a given time.
+-- Rows are appended by the trigger below when a file appears, changes kind,
+-- directory or generation, changes size by 10% or more since its last row,
+-- or is deleted.
+CREATE TABLE file_history (
+    path TEXT NOT NULL,
+    parent_path TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_directory BOOLEAN NOT NULL,
+    size BIGINT NOT NULL,
+    mod_time TIMESTAMP WITH TIME ZONE NOT NULL,
+    is_gzipped BOOLEAN NOT NULL,
+    generation INTEGER NOT NULL,
+    -- The file was deleted at observed_at; the other columns are its last state
+    deleted BOOLEAN NOT NULL DEFAULT false,
+    observed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_file_history_path ON file_history(path, observed_at);
+CREATE INDEX idx_file_history_observed_at ON file_history(observed_at);
+
+CREATE FUNCTION record_file_history() RETURNS trigger AS $$
+DECLARE
+    recorded BIGINT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO file_history (path, parent_path, name, is_directory, size, mod_time, is_gzipped, generation, deleted)
+        VALUES (OLD.path, OLD.parent_path, OLD.name, OLD.is_directory, OLD.size, OLD.mod_time, OLD.is_gzipped, OLD.generation, true);
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP = 'UPDATE'
+       AND NEW.is_directory = OLD.is_directory
+       AND NEW.parent_path = OLD.parent_path
+       AND NEW.generation = OLD.generation THEN
+        IF NEW.size = OLD.size THEN
+            RETURN NULL;
+        END IF;
+        SELECT size INTO recorded FROM file_history
+        WHERE path = NEW.path ORDER BY observed_at DESC LIMIT 1;
+        IF recorded IS NOT NULL AND abs(NEW.size - recorded) * 10 < recorded THEN
+            RETURN NULL;
+        END IF;
+    END IF;
+
+    INSERT INTO file_history (path, parent_path, name, is_directory, size, mod_time, is_gzipped, generation)
+    VALUES (NEW.path, NEW.parent_path, NEW.name, NEW.is_directory, NEW.size, NEW.mod_time, NEW.is_gzipped, NEW.generation);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER files_history
+AFTER INSERT OR DELETE OR UPDATE OF parent_path, is_directory, size, generation ON files
+FOR EACH ROW EXECUTE FUNCTION record_file_history();
+
+-- Pinned roots shown as the virtual top level of the file tree
+CREATE TABLE file_pins (
+    path TEXT PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Runtime settings changed through the API; they override the environment
+CREATE TABLE settings (
+    key TEXT PRIMARY KEY,
+    value JSONB NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Log entries
 CREATE TABLE logs (
     id BIGSERIAL PRIMARY KEY,
     file_path TEXT REFERENCES files(path) ON DELETE CASCADE,
     line TEXT NOT NULL,
+    line_gz BYTEA,
     line_number INTEGER NOT NULL,
     timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     level TEXT DEFAULT 'info',
-    search_vector tsvector GENERATED ALWAYS AS (to_tsvector('english', line)) STORED
+    -- Set when the line exceeded the maximum length and was cut
+    truncated BOOLEAN NOT NULL DEFAULT false,
+    -- Matches files.generation at ingest; line numbers restart in each generation
+    generation INTEGER NOT NULL DEFAULT 0,
+    -- Reporting agent; NULL for lines stored before agents were tracked
+    agent_id TEXT,
+    -- Populated on insert from the uncompressed line so search works for line_gz rows
+    search_vector tsvector
 );
 
-CREATE INDEX idx_logs_file_line ON logs(file_path, line_number);
+CREATE INDEX idx_logs_file_line ON logs(file_path, generation, line_number);
 CREATE INDEX idx_logs_timestamp ON logs(timestamp);
 CREATE INDEX idx_logs_level ON logs(level);
 CREATE INDEX idx_logs_search ON logs USING GIN(search_vector);
 
+-- Log lines from superseded file generations, when compaction archives them
+CREATE TABLE logs_archive (LIKE logs INCLUDING DEFAULTS);
+CREATE INDEX idx_logs_archive_file ON logs_archive(file_path, generation);
+
+-- Integrity manifests of logs_archive, one per shard, file and generation,
+-- written when compaction archives lines and checked by archive verification
+CREATE TABLE archive_manifests (
+    shard INTEGER NOT NULL,
+    file_path TEXT NOT NULL,
+    generation INTEGER NOT NULL,
+    row_count BIGINT NOT NULL,
+    -- md5 over the archived rows in ID order
+    checksum TEXT NOT NULL,
+    archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    verified_at TIMESTAMP WITH TIME ZONE,
+    -- ok, mismatch, or quarantined once a mismatch couldn't be repaired
+    status TEXT NOT NULL DEFAULT 'ok',
+    detail TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (shard, file_path, generation)
+);
+CREATE INDEX idx_archive_manifests_verified ON archive_manifests(verified_at NULLS FIRST);
+
 -- Network packets
 CREATE TABLE network_packets (
+    -- Insertion order; breaks ties between packets with the same time
+    id BIGSERIAL,
     time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     protocol TEXT NOT NULL,
     src_ip INET,
@@ -48,10 +164,103 @@ CREATE TABLE network_packets (
     dst_port INTEGER,
     length INTEGER DEFAULT 0,
     payload_size INTEGER DEFAULT 0,
-    tcp_flags TEXT
+    tcp_flags TEXT,
+    -- Reporting agent; NULL for packets stored before agents were tracked
+    agent_id TEXT
 );
 
 SELECT create_hypertable('network_packets', 'time', chunk_time_interval => INTERVAL '1 hour');
 
 CREATE INDEX idx_network_protocol ON network_packets(protocol, time DESC);
-CREATE INDEX idx_network_ips ON network_packets(src_ip, dst_ip);
\ No newline at end of file
+CREATE INDEX idx_network_ips ON network_packets(src_ip, dst_ip);
+
+-- Scheduled reports
+CREATE TABLE reports (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    query TEXT NOT NULL,
+    params JSONB NOT NULL DEFAULT '{}'::jsonb,
+    schedule TEXT NOT NULL,
+    recipient_emails TEXT[] NOT NULL DEFAULT '{}',
+    format TEXT NOT NULL DEFAULT 'json',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Notes on points in time, such as deploys, shown on charts
+CREATE TABLE annotations (
+    id BIGSERIAL PRIMARY KEY,
+    timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+    text TEXT NOT NULL,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_annotations_timestamp ON annotations(timestamp);
+
+-- Agent-side settings pushed through the tunnel: one row per agent ID, plus
+-- the 'default' profile for agents without their own
+CREATE SEQUENCE agent_config_versions;
+
+CREATE TABLE agent_configs (
+    agent_id TEXT PRIMARY KEY,
+    -- From agent_config_versions on every change, so a version names one
+    -- document even across deleted and recreated profiles
+    version BIGINT NOT NULL,
+    config JSONB NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The identity each agent registered with on its latest connection
+CREATE TABLE agents (
+    id TEXT PRIMARY KEY,
+    hostname TEXT NOT NULL DEFAULT '',
+    ip_address TEXT NOT NULL DEFAULT '',
+    version TEXT NOT NULL DEFAULT '',
+    connected_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- The config version each agent last reported applying
+CREATE TABLE agent_config_acks (
+    agent_id TEXT PRIMARY KEY,
+    profile TEXT NOT NULL,
+    version BIGINT NOT NULL,
+    -- Why the agent couldn't apply it; empty on success
+    error TEXT NOT NULL DEFAULT '',
+    acked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Each agent's ingest rates, one row per agent and minute, kept for
+-- AGENT_METRICS_RETENTION_DAYS
+CREATE TABLE agent_metrics (
+    agent_id TEXT NOT NULL,
+    time TIMESTAMP WITH TIME ZONE NOT NULL,
+    lines_per_second DOUBLE PRECISION NOT NULL,
+    packets_per_second DOUBLE PRECISION NOT NULL,
+    bytes_per_second DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (agent_id, time)
+);
+
+CREATE INDEX idx_agent_metrics_time ON agent_metrics(time);
+
+-- Why the server dropped an agent's connection, the newest 100 per agent
+CREATE TABLE agent_events (
+    id BIGSERIAL PRIMARY KEY,
+    agent_id TEXT NOT NULL,
+    time TIMESTAMP WITH TIME ZONE NOT NULL,
+    kind TEXT NOT NULL,
+    detail TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_agent_events_agent ON agent_events(agent_id, time DESC);
+
+
+-- Plans captured for slow queries, capped by MAX_CAPTURED_PLANS
+CREATE TABLE query_plans (
+    id BIGSERIAL PRIMARY KEY,
+    query_name TEXT NOT NULL,
+    params JSONB NOT NULL DEFAULT '[]'::jsonb,
+    duration_ms DOUBLE PRECISION NOT NULL,
+    plan TEXT NOT NULL,
+    captured_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
\ No newline at end of file
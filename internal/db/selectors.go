@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"diagnostic-client/internal/selector"
+)
+
+// likeEscaper escapes LIKE wildcards, with backslash as the escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ResolveFileSelectors expands selectors to the paths of the files they
+// select, sorted and without duplicates. Exact paths are kept as given, even
+// for files no longer in the files table, since their logs may still be
+// asked for; prefixes and globs select files, not directories. Expanding to
+// more than limit paths fails with ErrTooManyRows.
+func (db *DB) ResolveFileSelectors(ctx context.Context, selectors []selector.Selector, limit int) ([]string, error) {
+	seen := make(map[string]bool)
+	add := func(path string) error {
+		if seen[path] {
+			return nil
+		}
+		if len(seen) == limit {
+			return fmt.Errorf("%w: file selectors match more than %d files", ErrTooManyRows, limit)
+		}
+		seen[path] = true
+		return nil
+	}
+
+	for _, sel := range selectors {
+		if sel.Kind() == selector.Exact {
+			if err := add(sel.Literal()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The literal start narrows the scan to an index range; the pattern
+		// then checks globs exactly
+		args := []interface{}{likeEscaper.Replace(sel.Literal()) + "%", limit + 1}
+		cond := ""
+		if sel.Kind() == selector.Glob {
+			args = append(args, sel.Pattern())
+			cond = "AND path ~ $3"
+		}
+		rows, err := db.pool.Query(ctx, `
+			SELECT path FROM files
+			WHERE path LIKE $1 AND NOT is_directory `+cond+`
+			ORDER BY path
+			LIMIT $2`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("resolve selector %s: %w", sel, err)
+		}
+		for rows.Next() {
+			var path string
+			if err := rows.Scan(&path); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("resolve selector %s: %w", sel, err)
+			}
+			if err := add(path); err != nil {
+				rows.Close()
+				return nil, err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("resolve selector %s: %w", sel, err)
+		}
+	}
+
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/selector"
+	"diagnostic-client/pkg/models"
+)
+
+func TestResolveFileSelectors(t *testing.T) {
+	db := openTestDB(t, "files")
+	ctx := context.Background()
+	now := time.Now()
+
+	var files []models.FileNode
+	for _, path := range []string{
+		"/var/log/app/a.err", "/var/log/app/b.log", "/var/log/app/deep/c.err",
+		"/var/log/apps/d.err",
+		// LIKE wildcards in a literal start mustn't widen the scan
+		"/srv/50%/a.log", "/srv/50x/a.log", "/srv/a_b/c.log", "/srv/axb/c.log",
+		`/srv/back\slash/a.log`,
+	} {
+		i := strings.LastIndex(path, "/")
+		files = append(files, models.FileNode{Path: path, ParentPath: path[:i], Name: path[i+1:], ModTime: now, LastSeen: now, Generation: 1})
+	}
+	files = append(files, models.FileNode{Path: "/var/log/app/deep", ParentPath: "/var/log/app", Name: "deep", IsDirectory: true, ModTime: now, LastSeen: now, Generation: 1})
+	if err := db.SaveFiles(ctx, files); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		selectors []string
+		want      string
+	}{
+		{[]string{"/var/log/app/"}, "[/var/log/app/a.err /var/log/app/b.log /var/log/app/deep/c.err]"},
+		{[]string{"/var/log/app/*.err"}, "[/var/log/app/a.err]"},
+		{[]string{"/var/log/**.err"}, "[/var/log/app/a.err /var/log/app/deep/c.err /var/log/apps/d.err]"},
+		{[]string{"/var/log/app/*.err", "/var/log/app/"}, "[/var/log/app/a.err /var/log/app/b.log /var/log/app/deep/c.err]"},
+		{[]string{"/srv/50%/"}, "[/srv/50%/a.log]"},
+		{[]string{"/srv/a_b/*"}, "[/srv/a_b/c.log]"},
+		{[]string{`/srv/back\\slash/`}, `[/srv/back\slash/a.log]`},
+		// Exact paths are kept whether or not they are stored
+		{[]string{"/var/log/gone.log", "/var/log/app/b.log"}, "[/var/log/app/b.log /var/log/gone.log]"},
+		{[]string{"/nothing/"}, "[]"},
+	} {
+		sels, err := selector.ParseAll(tc.selectors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.ResolveFileSelectors(ctx, sels, selector.MaxFiles)
+		if err != nil {
+			t.Errorf("%v: %v", tc.selectors, err)
+			continue
+		}
+		if fmt.Sprint(got) != tc.want {
+			t.Errorf("%v = %v, want %s", tc.selectors, got, tc.want)
+		}
+	}
+
+	sels, _ := selector.ParseAll([]string{"/var/log/"})
+	if _, err := db.ResolveFileSelectors(ctx, sels, 3); !errors.Is(err, ErrTooManyRows) {
+		t.Errorf("four files with a limit of three: %v, want ErrTooManyRows", err)
+	}
+	if got, err := db.ResolveFileSelectors(ctx, sels, 4); err != nil || len(got) != 4 {
+		t.Errorf("four files with a limit of four = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Log IDs are only unique within a shard, so the shard index is folded into
+// the high bits of the ID handed out by the API. Shard 0 IDs are unchanged,
+// which keeps existing permalinks valid on single-database deployments.
+const (
+	shardIDBits = 48
+	shardIDMask = 1<<shardIDBits - 1
+	maxShards   = 1 << (63 - shardIDBits)
+)
+
+// shardFor picks the shard that owns an agent's logs and packets
+func (db *DB) shardFor(agentID string) int {
+	if len(db.shards) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(agentID))
+	return int(h.Sum32() % uint32(len(db.shards)))
+}
+
+// ShardWriteError reports a write spread over shards that failed part way.
+// Each shard commits in a transaction of its own, in ascending shard order,
+// so the rows of the Committed shards are stored and those of the failed
+// shard and any after it are not.
+type ShardWriteError struct {
+	Shard     int   // The shard whose write failed
+	Committed []int // Shards written before it
+	Err       error
+}
+
+func (e *ShardWriteError) Error() string {
+	return fmt.Sprintf("shard %d, after committing shards %v: %v", e.Shard, e.Committed, e.Err)
+}
+
+func (e *ShardWriteError) Unwrap() error { return e.Err }
+
+// Committed reports whether the rows of agentID were stored by a write that
+// returned err: all of them when err is nil, those on a committed shard when
+// err is a *ShardWriteError, and none otherwise. Callers retrying a failed
+// write use it to retry only what wasn't stored.
+func (db *DB) Committed(agentID string, err error) bool {
+	if err == nil {
+		return true
+	}
+	var shardErr *ShardWriteError
+	if !errors.As(err, &shardErr) {
+		return false
+	}
+	shard := db.shardFor(agentID)
+	for _, committed := range shardErr.Committed {
+		if committed == shard {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeLogID(shard int, id int64) int64 {
+	return int64(shard)<<shardIDBits | id
+}
+
+// decodeLogID splits an API log ID into its shard and row ID
+func (db *DB) decodeLogID(id int64) (int, int64, error) {
+	shard := int(id >> shardIDBits)
+	if id < 0 || shard >= len(db.shards) {
+		return 0, 0, ErrNotFound
+	}
+	return shard, id & shardIDMask, nil
+}
+
+// fanOut runs fn against every shard concurrently and returns the first error,
+// cancelling the remaining shards. Calls run in parallel, so fn should write
+// results into per-shard slots indexed by its shard argument.
+func (db *DB) fanOut(ctx context.Context, fn func(ctx context.Context, shard int, pool *pgxpool.Pool) error) error {
+	if len(db.shards) == 1 {
+		return fn(ctx, 0, db.pool)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The first error wins; the others are usually cancellations it caused
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i, pool := range db.shards {
+		wg.Add(1)
+		go func(i int, pool *pgxpool.Pool) {
+			defer wg.Done()
+			if err := fn(ctx, i, pool); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("shard %d: %w", i, err)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(i, pool)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// mergeSorted merges per-shard results that are each already ordered by less
+// into a single ordered slice of at most limit entries (limit <= 0 is unbounded)
+func mergeSorted[T any](parts [][]T, less func(a, b T) bool, limit int) []T {
+	if len(parts) == 1 {
+		if limit > 0 && len(parts[0]) > limit {
+			return parts[0][:limit]
+		}
+		return parts[0]
+	}
+
+	total := 0
+	for _, p := range parts {
+		total += len(p)
+	}
+	if limit > 0 && total > limit {
+		total = limit
+	}
+
+	merged := make([]T, 0, total)
+	idx := make([]int, len(parts))
+	for len(merged) < total {
+		best := -1
+		for i, p := range parts {
+			if idx[i] == len(p) {
+				continue
+			}
+			if best == -1 || less(p[idx[i]], parts[best][idx[best]]) {
+				best = i
+			}
+		}
+		merged = append(merged, parts[best][idx[best]])
+		idx[best]++
+	}
+	return merged
+}
@@ -0,0 +1,59 @@
+-- Schema for additional shards listed in DATABASE_URLS. Shards only hold logs
+-- and network packets; files and every other table live on the primary, so
+-- logs.file_path has no foreign key here.
+CREATE DATABASE diagnostic;
+\c diagnostic
+
+-- Enable required extensions
+CREATE EXTENSION IF NOT EXISTS btree_gin;
+CREATE EXTENSION IF NOT EXISTS timescaledb;
+
+-- Log entries
+CREATE TABLE logs (
+    id BIGSERIAL PRIMARY KEY,
+    file_path TEXT,
+    line TEXT NOT NULL,
+    line_gz BYTEA,
+    line_number INTEGER NOT NULL,
+    timestamp TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    level TEXT DEFAULT 'info',
+    -- Set when the line exceeded the maximum length and was cut
+    truncated BOOLEAN NOT NULL DEFAULT false,
+    -- Matches files.generation at ingest; line numbers restart in each generation
+    generation INTEGER NOT NULL DEFAULT 0,
+    -- Reporting agent; NULL for lines stored before agents were tracked
+    agent_id TEXT,
+    -- Populated on insert from the uncompressed line so search works for line_gz rows
+    search_vector tsvector
+);
+
+CREATE INDEX idx_logs_file_line ON logs(file_path, generation, line_number);
+CREATE INDEX idx_logs_timestamp ON logs(timestamp);
+CREATE INDEX idx_logs_level ON logs(level);
+CREATE INDEX idx_logs_search ON logs USING GIN(search_vector);
+
+-- Log lines from superseded file generations, when compaction archives them
+CREATE TABLE logs_archive (LIKE logs INCLUDING DEFAULTS);
+CREATE INDEX idx_logs_archive_file ON logs_archive(file_path, generation);
+
+-- Network packets
+CREATE TABLE network_packets (
+    -- Insertion order; breaks ties between packets with the same time
+    id BIGSERIAL,
+    time TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    protocol TEXT NOT NULL,
+    src_ip INET,
+    dst_ip INET,
+    src_port INTEGER,
+    dst_port INTEGER,
+    length INTEGER DEFAULT 0,
+    payload_size INTEGER DEFAULT 0,
+    tcp_flags TEXT,
+    -- Reporting agent; NULL for packets stored before agents were tracked
+    agent_id TEXT
+);
+
+SELECT create_hypertable('network_packets', 'time', chunk_time_interval => INTERVAL '1 hour');
+
+CREATE INDEX idx_network_protocol ON network_packets(protocol, time DESC);
+CREATE INDEX idx_network_ips ON network_packets(src_ip, dst_ip);
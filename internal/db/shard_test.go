@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestCommitted(t *testing.T) {
+	db := &DB{shards: make([]*pgxpool.Pool, 3)}
+	agents := make([]string, 3) // An agent on each shard
+	for i := 0; agents[0] == "" || agents[1] == "" || agents[2] == ""; i++ {
+		agent := fmt.Sprintf("agent-%d", i)
+		agents[db.shardFor(agent)] = agent
+	}
+
+	failed := &ShardWriteError{Shard: 1, Committed: []int{0}, Err: ErrUnavailable}
+	wrapped := fmt.Errorf("save logs: %w", failed)
+	for _, tc := range []struct {
+		name string
+		err  error
+		want []bool
+	}{
+		{"success", nil, []bool{true, true, true}},
+		{"shard 1 failed after shard 0", wrapped, []bool{true, false, false}},
+		{"not sharded", errors.New("boom"), []bool{false, false, false}},
+	} {
+		for shard, agent := range agents {
+			if got := db.Committed(agent, tc.err); got != tc.want[shard] {
+				t.Errorf("%s: Committed on shard %d = %v, want %v", tc.name, shard, got, tc.want[shard])
+			}
+		}
+	}
+
+	// The shard's own error stays visible for callers deciding to retry
+	if !Unavailable(wrapped) {
+		t.Errorf("Unavailable(%v) = false, want true", wrapped)
+	}
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// importBatchSize keeps each import upsert well under Postgres' limit of
+// 65535 bind parameters (11 per file)
+const importBatchSize = 1000
+
+// ExportFileTree streams every file node to w as JSON lines, ordered by
+// path. Rows are written as they are read, so memory use does not grow with
+// the size of the tree.
+func (db *DB) ExportFileTree(ctx context.Context, w io.Writer) (int, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT
+			path, parent_path, name, is_directory,
+			size, mod_time, is_gzipped, is_scraped, scrape_state, generation, last_seen
+		FROM files
+		ORDER BY path`)
+	if err != nil {
+		return 0, fmt.Errorf("query files: %w", err)
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	for rows.Next() {
+		var f models.FileNode
+		err := rows.Scan(
+			&f.Path, &f.ParentPath, &f.Name, &f.IsDirectory,
+			&f.Size, &f.ModTime, &f.IsGzipped, &f.IsScraped, &f.ScrapeState, &f.Generation, &f.LastSeen,
+		)
+		if err != nil {
+			return n, fmt.Errorf("scan file row: %w", err)
+		}
+		if err := enc.Encode(f); err != nil {
+			return n, fmt.Errorf("write file %s: %w", f.Path, err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, fmt.Errorf("rows error: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return n, fmt.Errorf("flush export: %w", err)
+	}
+	return n, nil
+}
+
+// ImportFileTree upserts file nodes read from JSON lines as written by
+// ExportFileTree. The import runs in one transaction: an invalid node
+// aborts it with ErrInvalidQuery and nothing is written.
+func (db *DB) ImportFileTree(ctx context.Context, r io.Reader) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("begin import: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	flush := func(batch []models.FileNode) error {
+		if len(batch) == 0 {
+			return nil
+		}
+		query, args := upsertFilesQuery(batch)
+		if _, err := tx.Exec(ctx, query, args...); err != nil {
+			return fmt.Errorf("upsert files: %w", err)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	batch := make([]models.FileNode, 0, importBatchSize)
+	n := 0
+	for {
+		var f models.FileNode
+		err := dec.Decode(&f)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: node %d: %v", ErrInvalidQuery, n+1, err)
+		}
+		if err := validateFileNode(&f); err != nil {
+			return 0, fmt.Errorf("%w: node %d: %v", ErrInvalidQuery, n+1, err)
+		}
+
+		batch = append(batch, f)
+		n++
+		if len(batch) == importBatchSize {
+			if err := flush(batch); err != nil {
+				return 0, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := flush(batch); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit import: %w", err)
+	}
+	return n, nil
+}
+
+// validateFileNode checks that a node's path fields agree with each other,
+// filling in a missing name, parent_path and last_seen
+func validateFileNode(f *models.FileNode) error {
+	if f.Path == "" || f.Path != paths.Normalize(f.Path) {
+		return fmt.Errorf("path %q must be absolute without a trailing slash", f.Path)
+	}
+
+	// Exports from before parent_path was canonical may leave it empty
+	parent := paths.Parent(f.Path)
+	if f.ParentPath != parent && f.ParentPath != "" {
+		return fmt.Errorf("parent_path %q of %s should be %q", f.ParentPath, f.Path, parent)
+	}
+	f.ParentPath = parent
+
+	if f.Name == "" {
+		f.Name = path.Base(f.Path)
+	}
+	if f.LastSeen.IsZero() {
+		f.LastSeen = time.Now()
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("negative size for %s", f.Path)
+	}
+	if f.Generation < 0 {
+		return fmt.Errorf("negative generation for %s", f.Path)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TailCursor is a position in the logs tables for following new lines without
+// the in-process stream: the highest row ID seen on each shard. IDs are
+// assigned at insert, so a line whose transaction commits after one with a
+// higher ID is missed; tailing with a cursor is best-effort.
+type TailCursor []int64
+
+// TailCursorNow returns a cursor past every stored log line
+func (db *DB) TailCursorNow(ctx context.Context) (TailCursor, error) {
+	cursor := make(TailCursor, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		return pool.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM logs`).Scan(&cursor[shard])
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query log cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+// GetLogsAfter returns up to limit lines per shard of a file stored after
+// the cursor, ordered by timestamp, and the cursor past them. Lines beyond
+// the limit are returned by the next call.
+func (db *DB) GetLogsAfter(ctx context.Context, filePath string, after TailCursor, limit int) ([]models.LogEntry, TailCursor, error) {
+	if len(after) != len(db.shards) {
+		return nil, nil, fmt.Errorf("%w: cursor has %d shards, want %d", ErrInvalidQuery, len(after), len(db.shards))
+	}
+
+	next := make(TailCursor, len(after))
+	copy(next, after)
+	parts := make([][]models.LogEntry, len(db.shards))
+	err := db.fanOut(ctx, func(ctx context.Context, shard int, pool *pgxpool.Pool) error {
+		rows, err := pool.Query(ctx, `
+			SELECT `+logColumns+`
+			FROM logs
+			WHERE file_path = $1 AND id > $2
+			ORDER BY id
+			LIMIT $3`,
+			filePath, after[shard], limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		logs, err := scanLogEntries(rows)
+		if err != nil {
+			return err
+		}
+		for i := range logs {
+			next[shard] = logs[i].ID
+			logs[i].ID = encodeLogID(shard, logs[i].ID)
+		}
+		parts[shard] = logs
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("query logs of %s after cursor: %w", filePath, err)
+	}
+
+	var logs []models.LogEntry
+	for _, part := range parts {
+		logs = append(logs, part...)
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].Timestamp.Before(logs[j].Timestamp)
+	})
+	return logs, next, nil
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// IngestWatermark is the highest line number stored for a generation of a
+// file. Lines of that generation at or below it are already stored.
+type IngestWatermark struct {
+	Generation int
+	Line       int
+}
+
+// GetIngestWatermarks returns the watermarks of all files that have any
+func (db *DB) GetIngestWatermarks(ctx context.Context) (map[string]IngestWatermark, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT path, ingested_generation, ingested_line
+		FROM files
+		WHERE ingested_line > 0`)
+	if err != nil {
+		return nil, fmt.Errorf("query ingest watermarks: %w", err)
+	}
+	defer rows.Close()
+
+	marks := make(map[string]IngestWatermark)
+	for rows.Next() {
+		var path string
+		var m IngestWatermark
+		if err := rows.Scan(&path, &m.Generation, &m.Line); err != nil {
+			return nil, fmt.Errorf("scan ingest watermark: %w", err)
+		}
+		marks[path] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return marks, nil
+}
+
+// SaveIngestWatermarks records watermarks of known files. A watermark never
+// moves back within a generation, so a stale save can't reopen a range of
+// lines for storing twice.
+func (db *DB) SaveIngestWatermarks(ctx context.Context, marks map[string]IngestWatermark) error {
+	if len(marks) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(marks))
+	generations := make([]int, 0, len(marks))
+	lines := make([]int, 0, len(marks))
+	for path, m := range marks {
+		paths = append(paths, path)
+		generations = append(generations, m.Generation)
+		lines = append(lines, m.Line)
+	}
+
+	_, err := db.pool.Exec(ctx, `
+		UPDATE files f
+		SET ingested_generation = w.generation, ingested_line = w.line
+		FROM unnest($1::text[], $2::int[], $3::int[]) AS w(path, generation, line)
+		WHERE f.path = w.path
+		  AND (w.generation > f.ingested_generation
+		       OR (w.generation = f.ingested_generation AND w.line > f.ingested_line))`,
+		paths, generations, lines)
+	if err != nil {
+		return fmt.Errorf("save ingest watermarks: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/clock"
+)
+
+// Each wait between runs is lengthened by up to this fraction of the
+// interval, so jobs with equal intervals don't hit the database together
+const jitterFraction = 0.1
+
+var (
+	// ErrUnknownJob is returned when triggering a job that isn't registered
+	ErrUnknownJob = errors.New("unknown job")
+	// ErrRunning is returned when triggering a job that is already running
+	ErrRunning = errors.New("job is already running")
+	// ErrNotStarted is returned when triggering a job before Start
+	ErrNotStarted = errors.New("scheduler not started")
+)
+
+// Job is periodic background work
+type Job struct {
+	Name string
+	// Time between the end of one scheduled run and the start of the next;
+	// zero or negative runs the job only when triggered
+	Interval time.Duration
+	// Run does one pass. Its context is cancelled when the scheduler stops.
+	Run func(ctx context.Context) error
+}
+
+// Status reports a job's schedule and its last run
+type Status struct {
+	Name       string  `json:"name"`
+	IntervalMs float64 `json:"interval_ms"`
+	Running    bool    `json:"running"`
+	Runs       int64   `json:"runs"`
+	Failures   int64   `json:"failures"`
+	// Scheduled runs skipped because a triggered run was still going
+	Skipped        int64      `json:"skipped"`
+	LastRun        *time.Time `json:"last_run,omitempty"`
+	LastDurationMs float64    `json:"last_duration_ms"`
+	LastError      string     `json:"last_error,omitempty"`
+	NextRun        *time.Time `json:"next_run,omitempty"`
+}
+
+// Scheduler runs registered jobs on their intervals. A job never overlaps
+// itself, and a failing or panicking job doesn't affect the others.
+type Scheduler struct {
+	mu    sync.Mutex
+	jobs  []*job
+	ctx   context.Context // Set by Start; triggered runs use it too
+	wg    sync.WaitGroup
+	clock clock.Clock
+}
+
+type job struct {
+	Job
+	running      bool
+	runs         int64
+	failures     int64
+	skipped      int64
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastErr      error
+	nextRun      time.Time
+}
+
+func New(clk clock.Clock) *Scheduler {
+	return &Scheduler{clock: clk}
+}
+
+// Register adds a job; it must be called before Start. Names must be unique.
+func (s *Scheduler) Register(j Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.jobs {
+		if existing.Name == j.Name {
+			panic(fmt.Sprintf("jobs: %s registered twice", j.Name))
+		}
+	}
+	s.jobs = append(s.jobs, &job{Job: j})
+}
+
+// Start runs the registered jobs until ctx is cancelled. The first run of
+// each job is one interval after Start.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		if j.Interval > 0 {
+			s.wg.Add(1)
+			go s.loop(ctx, j)
+		}
+	}
+}
+
+// Wait blocks until the schedule has stopped and running jobs have returned
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Trigger starts a run of the named job now, without moving its schedule
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		return ErrNotStarted
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, j := range s.jobs {
+		if j.Name != name {
+			continue
+		}
+		if j.running {
+			return ErrRunning
+		}
+		j.running = true
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(s.ctx, j)
+		}()
+		return nil
+	}
+	return ErrUnknownJob
+}
+
+// Status lists the jobs in registration order
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := Status{
+			Name:           j.Name,
+			IntervalMs:     float64(j.Interval) / float64(time.Millisecond),
+			Running:        j.running,
+			Runs:           j.runs,
+			Failures:       j.failures,
+			Skipped:        j.skipped,
+			LastDurationMs: float64(j.lastDuration) / float64(time.Millisecond),
+		}
+		if !j.lastRun.IsZero() {
+			lastRun := j.lastRun
+			st.LastRun = &lastRun
+		}
+		if j.lastErr != nil {
+			st.LastError = j.lastErr.Error()
+		}
+		if !j.nextRun.IsZero() && !j.running {
+			nextRun := j.nextRun
+			st.NextRun = &nextRun
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	defer s.wg.Done()
+
+	for {
+		wait := j.Interval + time.Duration(rand.Int63n(int64(float64(j.Interval)*jitterFraction)+1))
+		s.mu.Lock()
+		j.nextRun = s.clock.Now().Add(wait)
+		s.mu.Unlock()
+
+		timer := s.clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		s.mu.Lock()
+		if j.running {
+			j.skipped++
+			s.mu.Unlock()
+			continue
+		}
+		j.running = true
+		s.mu.Unlock()
+
+		s.run(ctx, j)
+	}
+}
+
+// run does one pass of a job already marked running and records it
+func (s *Scheduler) run(ctx context.Context, j *job) {
+	start := s.clock.Now()
+	err := call(ctx, j)
+	duration := s.clock.Now().Sub(start)
+
+	s.mu.Lock()
+	j.running = false
+	j.runs++
+	j.lastRun = start
+	j.lastDuration = duration
+	j.lastErr = err
+	if err != nil {
+		j.failures++
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Printf("[SCHEDULER] Job %s failed after %v: %v", j.Name, duration.Round(time.Millisecond), err)
+	}
+}
+
+// call runs the job, turning a panic into an error
+func call(ctx context.Context, j *job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("[SCHEDULER] Job %s panicked: %v\n%s", j.Name, p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return j.Run(ctx)
+}
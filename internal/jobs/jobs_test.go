@@ -0,0 +1,177 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+)
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPeriodicJobRunsEachInterval(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := New(clk)
+	runs := make(chan struct{}, 10)
+	s.Register(Job{Name: "flush", Interval: 5 * time.Second, Run: func(ctx context.Context) error {
+		runs <- struct{}{}
+		return nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	defer s.Wait()
+	defer cancel()
+
+	for i := 1; i <= 3; i++ {
+		waitFor(t, "the job to wait", func() bool { return clk.Waiters() == 1 })
+		// Short of the interval nothing runs
+		clk.Advance(4 * time.Second)
+		select {
+		case <-runs:
+			t.Fatalf("run %d before its interval", i)
+		default:
+		}
+		// The interval plus the largest jitter
+		clk.Advance(1500 * time.Millisecond)
+		select {
+		case <-runs:
+		case <-time.After(time.Second):
+			t.Fatalf("run %d didn't happen after its interval", i)
+		}
+		waitFor(t, "the run to be recorded", func() bool { return s.Status()[0].Runs == int64(i) })
+	}
+}
+
+func TestFailingJobIsRecorded(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := New(clk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s.Register(Job{Name: "broken", Run: func(ctx context.Context) error { panic("boom") }})
+	s.Register(Job{Name: "failing", Run: func(ctx context.Context) error { return errors.New("no database") }})
+
+	if err := s.Trigger("failing"); !errors.Is(err, ErrNotStarted) {
+		t.Fatalf("trigger before start = %v, want ErrNotStarted", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	defer s.Wait()
+	defer cancel()
+
+	for _, name := range []string{"broken", "failing"} {
+		if err := s.Trigger(name); err != nil {
+			t.Fatalf("trigger %s: %v", name, err)
+		}
+	}
+	if err := s.Trigger("missing"); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("trigger of an unknown job = %v, want ErrUnknownJob", err)
+	}
+	waitFor(t, "both runs", func() bool {
+		st := s.Status()
+		return st[0].Runs == 1 && st[1].Runs == 1
+	})
+
+	st := s.Status()
+	if st[0].Failures != 1 || st[0].LastError != "panic: boom" {
+		t.Errorf("panicking job: %+v", st[0])
+	}
+	if st[1].Failures != 1 || st[1].LastError != "no database" {
+		t.Errorf("failing job: %+v", st[1])
+	}
+}
+
+func TestTriggeredRunPreventsOverlap(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := New(clk)
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	s.Register(Job{Name: "rollup", Interval: 5 * time.Second, Run: func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	defer s.Wait()
+	defer cancel()
+
+	waitFor(t, "the job to wait", func() bool { return clk.Waiters() == 1 })
+	if err := s.Trigger("rollup"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if st := s.Status()[0]; !st.Running || st.NextRun != nil {
+		t.Errorf("status during a triggered run: %+v", st)
+	}
+
+	if err := s.Trigger("rollup"); !errors.Is(err, ErrRunning) {
+		t.Errorf("second trigger = %v, want ErrRunning", err)
+	}
+
+	// The schedule comes due while the triggered run is going, and skips
+	clk.Advance(6 * time.Second)
+	waitFor(t, "the scheduled run to be skipped", func() bool { return s.Status()[0].Skipped == 1 })
+	select {
+	case <-started:
+		t.Fatal("scheduled run overlapped the triggered one")
+	default:
+	}
+
+	close(release)
+	waitFor(t, "the triggered run to finish", func() bool {
+		st := s.Status()[0]
+		return !st.Running && st.Runs == 1
+	})
+	if err := s.Trigger("rollup"); err != nil {
+		t.Errorf("trigger after the run finished: %v", err)
+	}
+	<-started
+	waitFor(t, "the second run to finish", func() bool { return s.Status()[0].Runs == 2 })
+}
+
+func TestPanickingJobKeepsItsScheduleAndOthers(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := New(clk)
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s.Register(Job{Name: "broken", Interval: time.Second, Run: func(ctx context.Context) error { panic("boom") }})
+	s.Register(Job{Name: "healthy", Interval: time.Second, Run: func(ctx context.Context) error { return nil }})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	defer s.Wait()
+	defer cancel()
+
+	for i := 1; i <= 2; i++ {
+		waitFor(t, "both jobs to wait", func() bool { return clk.Waiters() == 2 })
+		clk.Advance(1100 * time.Millisecond)
+		waitFor(t, "both jobs to run", func() bool {
+			st := s.Status()
+			return st[0].Runs == int64(i) && st[1].Runs == int64(i)
+		})
+	}
+
+	st := s.Status()
+	if st[0].Failures != 2 || st[1].Failures != 0 {
+		t.Errorf("failures = %d and %d, want 2 and 0", st[0].Failures, st[1].Failures)
+	}
+}
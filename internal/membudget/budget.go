@@ -0,0 +1,159 @@
+package membudget
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shedding starts when usage crosses the high watermark and trims buffers
+// until usage is back under the low watermark, to avoid flapping at the limit.
+const (
+	highWaterPercent = 90
+	lowWaterPercent  = 75
+)
+
+// Component is a buffer whose memory is accounted against the budget. Sizes
+// are estimates (an RSS proxy), not exact heap usage.
+type Component interface {
+	// Name identifies the component in stats
+	Name() string
+	// Priority orders shedding; lower priorities are trimmed first
+	Priority() int
+	// BytesHeld returns the estimated bytes currently buffered
+	BytesHeld() int64
+	// Shed releases roughly target bytes if possible and returns the
+	// estimated amount actually released
+	Shed(target int64) int64
+}
+
+// ComponentStats reports accounting for a single component
+type ComponentStats struct {
+	Name       string `json:"name"`
+	Priority   int    `json:"priority"`
+	Bytes      int64  `json:"bytes"`
+	ShedEvents int64  `json:"shed_events"`
+	ShedBytes  int64  `json:"shed_bytes"`
+}
+
+// Stats is a point-in-time view of the budget
+type Stats struct {
+	Ceiling    int64            `json:"ceiling"`
+	Used       int64            `json:"used"`
+	Components []ComponentStats `json:"components"`
+}
+
+// Budget holds the global memory ceiling and the registered components
+type Budget struct {
+	ceiling int64
+
+	mu         sync.Mutex
+	components []*entry
+}
+
+type entry struct {
+	Component
+	shedEvents int64
+	shedBytes  int64
+}
+
+func New(ceiling int64) *Budget {
+	return &Budget{ceiling: ceiling}
+}
+
+// Register adds a component to the accounting
+func (b *Budget) Register(c Component) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.components = append(b.components, &entry{Component: c})
+	sort.SliceStable(b.components, func(i, j int) bool {
+		return b.components[i].Priority() < b.components[j].Priority()
+	})
+}
+
+// Used returns the estimated bytes held across all components
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var used int64
+	for _, c := range b.components {
+		used += c.BytesHeld()
+	}
+	return used
+}
+
+// Check sheds buffers in priority order when usage approaches the ceiling
+func (b *Budget) Check() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var used int64
+	for _, c := range b.components {
+		used += c.BytesHeld()
+	}
+
+	if used <= b.ceiling*highWaterPercent/100 {
+		return
+	}
+
+	target := used - b.ceiling*lowWaterPercent/100
+	for _, c := range b.components {
+		if target <= 0 {
+			break
+		}
+
+		released := c.Shed(target)
+		if released <= 0 {
+			continue
+		}
+
+		c.shedEvents++
+		c.shedBytes += released
+		target -= released
+
+		log.Printf("[MEMORY] Shed %d bytes from %s (used %d of %d)",
+			released, c.Name(), used, b.ceiling)
+	}
+}
+
+// Run checks the budget every interval until ctx is cancelled
+func (b *Budget) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.Check()
+		}
+	}
+}
+
+// Stats returns current usage and shed counters per component
+func (b *Budget) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := Stats{
+		Ceiling:    b.ceiling,
+		Components: make([]ComponentStats, 0, len(b.components)),
+	}
+	for _, c := range b.components {
+		held := c.BytesHeld()
+		stats.Used += held
+		stats.Components = append(stats.Components, ComponentStats{
+			Name:       c.Name(),
+			Priority:   c.Priority(),
+			Bytes:      held,
+			ShedEvents: c.shedEvents,
+			ShedBytes:  c.shedBytes,
+		})
+	}
+	return stats
+}
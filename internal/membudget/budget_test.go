@@ -0,0 +1,82 @@
+package membudget
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+// buffer is a component holding bytes that it releases in full when shed
+type buffer struct {
+	name     string
+	priority int
+	held     int64
+}
+
+func (b *buffer) Name() string     { return b.name }
+func (b *buffer) Priority() int    { return b.priority }
+func (b *buffer) BytesHeld() int64 { return b.held }
+
+func (b *buffer) Shed(target int64) int64 {
+	released := min(target, b.held)
+	b.held -= released
+	return released
+}
+
+func TestCheckShedsLowestPriorityFirst(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	queues := &buffer{name: "queues", priority: 0, held: 300}
+	batch := &buffer{name: "batch", priority: 1, held: 500}
+	cache := &buffer{name: "cache", priority: 2, held: 150}
+	b := New(1000)
+	// Registered out of priority order
+	b.Register(cache)
+	b.Register(batch)
+	b.Register(queues)
+
+	b.Check()
+	// 950 is over the 900 high watermark, so 200 are shed to reach 750
+	if queues.held != 100 || batch.held != 500 || cache.held != 150 {
+		t.Fatalf("held after shedding = %d, %d, %d; want 100, 500, 150", queues.held, batch.held, cache.held)
+	}
+	if used := b.Used(); used != 750 {
+		t.Fatalf("used = %d, want 750", used)
+	}
+
+	queues.held = 50
+	batch.held = 1000
+	b.Check()
+	// 1200 needs 450 shed: all 50 of the queues, then 400 of the batch
+	if queues.held != 0 || batch.held != 600 || cache.held != 150 {
+		t.Fatalf("held after second shedding = %d, %d, %d; want 0, 600, 150", queues.held, batch.held, cache.held)
+	}
+
+	stats := b.Stats()
+	if stats.Ceiling != 1000 || stats.Used != 750 {
+		t.Fatalf("stats = %d of %d, want 750 of 1000", stats.Used, stats.Ceiling)
+	}
+	want := []ComponentStats{
+		{Name: "queues", Priority: 0, Bytes: 0, ShedEvents: 2, ShedBytes: 250},
+		{Name: "batch", Priority: 1, Bytes: 600, ShedEvents: 1, ShedBytes: 400},
+		{Name: "cache", Priority: 2, Bytes: 150},
+	}
+	for i, c := range stats.Components {
+		if c != want[i] {
+			t.Errorf("component %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+}
+
+func TestCheckBelowHighWatermark(t *testing.T) {
+	queues := &buffer{name: "queues", held: 900}
+	b := New(1000)
+	b.Register(queues)
+
+	b.Check()
+	if queues.held != 900 {
+		t.Fatalf("shed %d bytes at the high watermark", 900-queues.held)
+	}
+}
@@ -0,0 +1,92 @@
+package paths
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Denylist matches file paths operators do not want tracked. A pattern
+// containing glob metacharacters is matched with path.Match against the path
+// and each of its parent directories, so "*/tmp" also hides everything below
+// any tmp directory one level down; any other pattern is a path prefix that
+// matches whole components. Patterns can be replaced while in use.
+type Denylist struct {
+	mu       sync.RWMutex
+	patterns []string
+}
+
+// NewDenylist returns a denylist for patterns, which must already be valid
+func NewDenylist(patterns []string) *Denylist {
+	return &Denylist{patterns: normalizePatterns(patterns)}
+}
+
+// ValidatePatterns reports the first malformed glob in patterns
+func ValidatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if isGlob(p) {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Set replaces the patterns, leaving them unchanged if any is malformed
+func (d *Denylist) Set(patterns []string) error {
+	if err := ValidatePatterns(patterns); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.patterns = normalizePatterns(patterns)
+	d.mu.Unlock()
+	return nil
+}
+
+// Patterns returns a copy of the current patterns
+func (d *Denylist) Patterns() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]string{}, d.patterns...)
+}
+
+// Match reports whether p is hidden by any pattern
+func (d *Denylist) Match(p string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, pattern := range d.patterns {
+		if !isGlob(pattern) {
+			if p == pattern || pattern == "/" || strings.HasPrefix(p, pattern+"/") {
+				return true
+			}
+			continue
+		}
+		for dir := p; ; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern, dir); ok {
+				return true
+			}
+			if dir == "/" || dir == "." {
+				break
+			}
+		}
+	}
+	return false
+}
+
+func normalizePatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		if p = strings.TrimSpace(p); p != "" {
+			normalized = append(normalized, Normalize(p))
+		}
+	}
+	return normalized
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
@@ -0,0 +1,61 @@
+// Package paths gives every layer the same view of a file path. Paths are
+// kept byte for byte as agents report them, apart from the leading and
+// trailing slash rules in Normalize, so a path typed into the API, sent over
+// the websocket or reported by an agent always matches the same cache key
+// and database row. Spaces, '#', '%' and non-ASCII names need no special
+// handling beyond correct decoding at the edges.
+package paths
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Normalize ensures a leading slash and removes a trailing one, except for
+// the root. It does not clean, case-fold or Unicode-normalize the path.
+func Normalize(path string) string {
+	// Ensure path starts with /
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	// Remove trailing slash unless it's the root path
+	if path != "/" && strings.HasSuffix(path, "/") {
+		path = path[:len(path)-1]
+	}
+
+	return path
+}
+
+// Parent returns the canonical parent_path of a normalized path: "/" for
+// children of the root, and never empty. The root is its own parent.
+func Parent(p string) string {
+	i := strings.LastIndexByte(p, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+// FromQuery returns the decoded value of a query parameter holding a path.
+// Unlike r.URL.Query(), a value that is not valid percent-encoding, such as
+// an unescaped "100%.log", is used literally instead of being dropped. A
+// literal '+' still decodes to a space, as in any query string, so clients
+// must send it as %2B.
+func FromQuery(r *http.Request, key string) string {
+	for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+		k, v, _ := strings.Cut(pair, "=")
+		if unescape(k) == key {
+			return unescape(v)
+		}
+	}
+	return ""
+}
+
+func unescape(s string) string {
+	if u, err := url.QueryUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
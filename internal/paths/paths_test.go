@@ -0,0 +1,85 @@
+package paths
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Names that exist on real systems and used to be mangled on the way in
+var unusualPaths = []string{
+	"/var/log/my app/weird#file (1).log",
+	"/var/log/100%.log",
+	"/var/log/a+b&c=d.log",
+	"/var/log/журнал/ошибки.log",
+	"/var/log/日本語 ログ.log",
+	"/var/log/cafe\u0301.log",
+}
+
+func TestFromQueryDecodesUnusualNames(t *testing.T) {
+	for _, p := range unusualPaths {
+		target := "/api/logs?" + url.Values{"file": {p}, "limit": {"10"}}.Encode()
+		if got := FromQuery(httptest.NewRequest("GET", target, nil), "file"); got != p {
+			t.Errorf("%s: FromQuery = %q, want %q", target, got, p)
+		}
+	}
+}
+
+func TestFromQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		// Encoded by a browser's encodeURIComponent
+		{"file=%2Fvar%2Flog%2Fmy%20app%2Fweird%23file%20(1).log", "/var/log/my app/weird#file (1).log"},
+		// Invalid percent-encoding is kept literally instead of dropped
+		{"file=/var/log/100%.log", "/var/log/100%.log"},
+		{"file=/var/log/%zz.log", "/var/log/%zz.log"},
+		// '+' is a space in a query string; a literal one must be %2B
+		{"file=/var/log/a+b.log", "/var/log/a b.log"},
+		{"file=/var/log/a%2Bb.log", "/var/log/a+b.log"},
+		{"other=x&file=/var/log/%C3%A9.log", "/var/log/é.log"},
+		{"f%69le=/var/log/key.log", "/var/log/key.log"},
+		{"file=", ""},
+		{"other=/var/log/x.log", ""},
+	} {
+		r := httptest.NewRequest("GET", "/api/logs", nil)
+		r.URL.RawQuery = tc.query
+		if got := FromQuery(r, "file"); got != tc.want {
+			t.Errorf("%s: FromQuery = %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeKeepsBytes(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"/", "/"},
+		{"", "/"},
+		{"var/log/app.log", "/var/log/app.log"},
+		{"/var/log/", "/var/log"},
+		{"/var/log/my app/weird#file (1).log", "/var/log/my app/weird#file (1).log"},
+		// Neither cleaned nor Unicode-normalized: the composed and decomposed
+		// forms are different files
+		{"/var/log/./x.log", "/var/log/./x.log"},
+		{"/var/log/caf\u00e9.log", "/var/log/caf\u00e9.log"},
+		{"/var/log/cafe\u0301.log", "/var/log/cafe\u0301.log"},
+		{"/var/log/100%25.log", "/var/log/100%25.log"},
+	} {
+		if got := Normalize(tc.in); got != tc.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParent(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"/", "/"},
+		{"/app.log", "/"},
+		{"/var/log/my app/weird#file (1).log", "/var/log/my app"},
+		{"/var/log/журнал/ошибки.log", "/var/log/журнал"},
+	} {
+		if got := Parent(tc.in); got != tc.want {
+			t.Errorf("Parent(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
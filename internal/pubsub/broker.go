@@ -0,0 +1,133 @@
+// Package pubsub fans values out to any number of subscribers without
+// letting a slow one hold up the publisher or the others.
+package pubsub
+
+import "sync"
+
+// Broker hands each published value to every subscriber's own buffered
+// channel. A subscriber whose buffer is full misses the value.
+type Broker[T any] struct {
+	buffer int
+
+	mu     sync.RWMutex
+	subs   map[<-chan T]*subscriber[T]
+	closed bool
+}
+
+type subscriber[T any] struct {
+	ch    chan T
+	match func(T) bool // Nil matches everything
+}
+
+// NewBroker returns a broker giving each subscriber a buffer of the given
+// size
+func NewBroker[T any](buffer int) *Broker[T] {
+	return &Broker[T]{
+		buffer: buffer,
+		subs:   make(map[<-chan T]*subscriber[T]),
+	}
+}
+
+// Subscribe returns a channel receiving every value published from now on
+func (b *Broker[T]) Subscribe() <-chan T {
+	return b.SubscribeFunc(nil)
+}
+
+// SubscribeFunc returns a channel receiving the values published from now
+// on that match reports true for. match is called by Publish and must not
+// block.
+func (b *Broker[T]) SubscribeFunc(match func(T) bool) <-chan T {
+	sub := &subscriber[T]{ch: make(chan T, b.buffer), match: match}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+	} else {
+		b.subs[sub.ch] = sub
+	}
+	return sub.ch
+}
+
+// Unsubscribe ends a subscription and closes its channel. Unknown or
+// already ended subscriptions are ignored.
+func (b *Broker[T]) Unsubscribe(ch <-chan T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sub, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(sub.ch)
+	}
+}
+
+// Publish offers v to every matching subscriber without waiting, and
+// returns how many missed it because their buffer was full
+func (b *Broker[T]) Publish(v T) (missed int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		if sub.match != nil && !sub.match(v) {
+			continue
+		}
+		select {
+		case sub.ch <- v:
+		default:
+			missed++
+		}
+	}
+	return missed
+}
+
+// Close ends every subscription. Later subscriptions get a closed channel
+// and publishing reaches no one.
+func (b *Broker[T]) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch, sub := range b.subs {
+		delete(b.subs, ch)
+		close(sub.ch)
+	}
+}
+
+// Capacity is the buffer size of each subscription
+func (b *Broker[T]) Capacity() int {
+	return b.buffer
+}
+
+// Queued returns the values waiting in all subscriptions and in the fullest
+// one
+func (b *Broker[T]) Queued() (total, fullest int) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		n := len(sub.ch)
+		total += n
+		fullest = max(fullest, n)
+	}
+	return total, fullest
+}
+
+// Shed discards queued values, oldest first within each subscription,
+// passing each to dropped until it returns false or nothing is queued
+func (b *Broker[T]) Shed(dropped func(T) bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+	drain:
+		for {
+			select {
+			case v := <-sub.ch:
+				if !dropped(v) {
+					return
+				}
+			default:
+				break drain
+			}
+		}
+	}
+}
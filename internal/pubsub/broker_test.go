@@ -0,0 +1,159 @@
+package pubsub
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBrokerFansOut(t *testing.T) {
+	b := NewBroker[int](4)
+	first, second := b.Subscribe(), b.Subscribe()
+
+	if missed := b.Publish(1); missed != 0 {
+		t.Fatalf("missed = %d, want 0", missed)
+	}
+	for i, ch := range []<-chan int{first, second} {
+		if got := <-ch; got != 1 {
+			t.Errorf("subscriber %d got %d, want 1", i, got)
+		}
+	}
+}
+
+func TestBrokerSlowSubscriberDoesNotBlockOthers(t *testing.T) {
+	b := NewBroker[int](2)
+	_ = b.Subscribe() // Never reads
+	fast := b.Subscribe()
+
+	const n = 100
+	missed := 0
+	for i := 0; i < n; i++ {
+		missed += b.Publish(i)
+		if got := <-fast; got != i {
+			t.Fatalf("fast subscriber got %d, want %d", got, i)
+		}
+	}
+	if want := n - b.Capacity(); missed != want {
+		t.Errorf("missed = %d, want %d for the slow subscriber", missed, want)
+	}
+}
+
+func TestBrokerSubscribeFunc(t *testing.T) {
+	b := NewBroker[int](4)
+	even := b.SubscribeFunc(func(v int) bool { return v%2 == 0 })
+
+	for i := 1; i <= 4; i++ {
+		b.Publish(i)
+	}
+	if got := []int{<-even, <-even}; got[0] != 2 || got[1] != 4 {
+		t.Errorf("filtered subscriber got %v, want [2 4]", got)
+	}
+	if len(even) != 0 {
+		t.Errorf("%d unmatched values delivered", len(even))
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	b := NewBroker[int](4)
+	ch := b.Subscribe()
+	b.Unsubscribe(ch)
+	b.Unsubscribe(ch) // Ignored
+
+	if _, ok := <-ch; ok {
+		t.Fatal("unsubscribed channel still open")
+	}
+	if missed := b.Publish(1); missed != 0 {
+		t.Errorf("publishing to no one missed %d", missed)
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := NewBroker[int](4)
+	before := b.Subscribe()
+	b.Close()
+
+	if _, ok := <-before; ok {
+		t.Error("subscription open after Close")
+	}
+	if _, ok := <-b.Subscribe(); ok {
+		t.Error("subscription after Close is open")
+	}
+	b.Publish(1)
+}
+
+func TestBrokerQueuedAndShed(t *testing.T) {
+	b := NewBroker[int](4)
+	first, _ := b.Subscribe(), b.Subscribe()
+	b.Publish(1)
+	b.Publish(2)
+	<-first
+
+	if total, fullest := b.Queued(); total != 3 || fullest != 2 {
+		t.Fatalf("queued = %d, fullest %d; want 3, 2", total, fullest)
+	}
+
+	shed := 0
+	b.Shed(func(int) bool {
+		shed++
+		return shed < 2
+	})
+	if total, _ := b.Queued(); shed != 2 || total != 1 {
+		t.Errorf("shed %d leaving %d, want 2 leaving 1", shed, total)
+	}
+}
+
+func TestBrokerConcurrentUse(t *testing.T) {
+	b := NewBroker[int](8)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ch := b.Subscribe()
+				b.Unsubscribe(ch)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Publish(j)
+			}
+		}()
+	}
+	wg.Wait()
+	b.Close()
+}
+
+// BenchmarkBrokerHeadOfLine publishes to two clients, one of which reads
+// each value as it comes. A stalled second client costs the first nothing:
+// publishing takes as long as when both keep up, and never waits.
+func BenchmarkBrokerHeadOfLine(b *testing.B) {
+	for _, stalled := range []bool{false, true} {
+		name := "both_reading"
+		if stalled {
+			name = "one_stalled"
+		}
+		b.Run(name, func(b *testing.B) {
+			broker := NewBroker[int](64)
+			other, client := broker.Subscribe(), broker.Subscribe()
+
+			missed := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				missed += broker.Publish(i)
+				if got := <-client; got != i {
+					b.Fatalf("client got %d, want %d", got, i)
+				}
+				if !stalled {
+					<-other
+				}
+			}
+			b.StopTimer()
+
+			if !stalled && missed > 0 {
+				b.Fatalf("missed %d with both clients reading", missed)
+			}
+			b.ReportMetric(float64(missed)/float64(b.N), "missed/op")
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Package realip resolves the client address and scheme of HTTP requests that
+// arrive through reverse proxies. Forwarding headers are only honoured when
+// the direct peer is a configured trusted proxy, so clients cannot spoof them.
+package realip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// New builds a resolver trusting the given networks. With none, forwarding
+// headers are never used.
+func New(trusted []*net.IPNet) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer returns the address of the direct TCP peer
+func peer(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (r *Resolver) fromTrustedProxy(req *http.Request) bool {
+	return len(r.trusted) > 0 && r.isTrusted(net.ParseIP(peer(req)))
+}
+
+// ClientIP returns the originating client address. X-Forwarded-For is walked
+// from the right, skipping trusted proxies, so the result is the first hop
+// the deployment cannot vouch for. X-Real-IP is used when there is no
+// X-Forwarded-For.
+func (r *Resolver) ClientIP(req *http.Request) string {
+	addr := peer(req)
+	if !r.fromTrustedProxy(req) {
+		return addr
+	}
+
+	if xff := req.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHop(hops[i])
+			if ip == nil {
+				// A malformed entry can't be trusted further; stop at the last good hop
+				return addr
+			}
+			addr = ip.String()
+			if !r.isTrusted(ip) {
+				return addr
+			}
+		}
+		return addr
+	}
+
+	if ip := parseHop(req.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+
+	return addr
+}
+
+// parseHop parses one forwarding entry, tolerating ports and IPv6 brackets
+func parseHop(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// Scheme returns "https" or "http" as seen by the client. X-Forwarded-Proto
+// is honoured from trusted proxies; otherwise the connection itself decides.
+func (r *Resolver) Scheme(req *http.Request) string {
+	if r.fromTrustedProxy(req) {
+		proto := req.Header.Get("X-Forwarded-Proto")
+		// Chained proxies may append; the first value is the client's
+		if i := strings.IndexByte(proto, ','); i >= 0 {
+			proto = proto[:i]
+		}
+		switch strings.ToLower(strings.TrimSpace(proto)) {
+		case "https":
+			return "https"
+		case "http":
+			return "http"
+		}
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Host returns the host the client addressed, honouring X-Forwarded-Host
+// from trusted proxies
+func (r *Resolver) Host(req *http.Request) string {
+	if r.fromTrustedProxy(req) {
+		if host := req.Header.Get("X-Forwarded-Host"); host != "" {
+			if i := strings.IndexByte(host, ','); i >= 0 {
+				host = host[:i]
+			}
+			return strings.TrimSpace(host)
+		}
+	}
+	return req.Host
+}
+
+// Origin returns the scheme and host the client used, as in an Origin header
+func (r *Resolver) Origin(req *http.Request) string {
+	return r.Scheme(req) + "://" + r.Host(req)
+}
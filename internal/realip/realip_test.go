@@ -0,0 +1,115 @@
+package realip
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestClientIP(t *testing.T) {
+	r := New(mustCIDRs(t, "10.0.0.0/8", "fd00::/8"))
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "direct client", remote: "203.0.113.7:5000", want: "203.0.113.7"},
+		{name: "untrusted peer's headers ignored", remote: "203.0.113.7:5000", xff: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "203.0.113.7"},
+		{name: "trusted proxy", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain through trusted proxies", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "spoofed leftmost entry", remote: "10.0.0.1:5000", xff: []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, want: "198.51.100.1"},
+		{name: "repeated headers", remote: "10.0.0.1:5000", xff: []string{"1.2.3.4, 198.51.100.1", "10.0.0.2"}, want: "198.51.100.1"},
+		{name: "only trusted hops", remote: "10.0.0.1:5000", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "malformed hop", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1, not-an-ip, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "hop with port", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1:4711"}, want: "198.51.100.1"},
+		{name: "IPv6 peer and hop", remote: "[fd00::1]:5000", xff: []string{"2001:db8::5"}, want: "2001:db8::5"},
+		{name: "bracketed IPv6 hop with port", remote: "[fd00::1]:5000", xff: []string{"[2001:db8::5]:4711, fd00::2"}, want: "2001:db8::5"},
+		{name: "bracketed IPv6 hop", remote: "10.0.0.1:5000", xff: []string{"[2001:db8::5]"}, want: "2001:db8::5"},
+		{name: "untrusted IPv6 peer", remote: "[2001:db8::9]:5000", xff: []string{"198.51.100.1"}, want: "2001:db8::9"},
+		{name: "X-Real-IP without X-Forwarded-For", remote: "10.0.0.1:5000", realIP: "198.51.100.2", want: "198.51.100.2"},
+		{name: "X-Forwarded-For wins over X-Real-IP", remote: "10.0.0.1:5000", xff: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "198.51.100.1"},
+		{name: "malformed X-Real-IP", remote: "10.0.0.1:5000", realIP: "nope", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := r.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoTrustedProxies(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "logs.example.com")
+
+	r := New(nil)
+	if got := r.ClientIP(req); got != "10.0.0.1" {
+		t.Errorf("ClientIP = %q, want the peer", got)
+	}
+	if got := r.Origin(req); got != "http://"+req.Host {
+		t.Errorf("Origin = %q, want the request's own", got)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	r := New(mustCIDRs(t, "10.0.0.0/8"))
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		tls     bool
+		want    string
+	}{
+		{name: "plain", remote: "203.0.113.7:5000", want: "http://example.com"},
+		{name: "TLS", remote: "203.0.113.7:5000", tls: true, want: "https://example.com"},
+		{name: "forwarded by trusted proxy", remote: "10.0.0.1:5000",
+			headers: map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "logs.example.com, proxy.internal"}, want: "https://logs.example.com"},
+		{name: "forwarded by untrusted peer", remote: "203.0.113.7:5000",
+			headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"}, want: "http://example.com"},
+		{name: "unknown forwarded scheme", remote: "10.0.0.1:5000", tls: true,
+			headers: map[string]string{"X-Forwarded-Proto": "gopher"}, want: "https://example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if got := r.Origin(req); got != tt.want {
+				t.Errorf("Origin = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+)
+
+// Policies for log lines from superseded file generations
+const (
+	GenerationsKeep    = "keep"
+	GenerationsDelete  = "delete"
+	GenerationsArchive = "archive"
+)
+
+// GenerationCompactionEnabled reports whether OLD_GENERATIONS asks for
+// superseded generations to be deleted or archived
+func GenerationCompactionEnabled(cfg *config.Config) bool {
+	return cfg.OldGenerations == GenerationsDelete || cfg.OldGenerations == GenerationsArchive
+}
+
+// CompactGenerations deletes or archives log lines from file generations
+// that were superseded by a truncation, per OLD_GENERATIONS
+func CompactGenerations(ctx context.Context, cfg *config.Config, database *db.DB) error {
+	n, err := database.CompactGenerations(ctx, cfg.OldGenerations == GenerationsArchive)
+	if err != nil {
+		return fmt.Errorf("compact old log generations: %w", err)
+	}
+	if n > 0 {
+		log.Printf("[SCHEDULER] Compacted %d log lines from old generations (%s)", n, cfg.OldGenerations)
+	}
+	return nil
+}
+
+// VerifyArchive checks a sample of archive manifests against the archived
+// lines, logging each discrepancy it finds
+func VerifyArchive(ctx context.Context, cfg *config.Config, database *db.DB) error {
+	report, err := database.VerifyArchive(ctx, cfg.ArchiveVerifySample)
+	if err != nil {
+		return fmt.Errorf("verify archive: %w", err)
+	}
+	for _, d := range report.Discrepancies {
+		log.Printf("[SCHEDULER] Archive mismatch: %s", d)
+	}
+	if len(report.Discrepancies) > 0 {
+		return fmt.Errorf("%d of %d archived file generations don't match their manifest", len(report.Discrepancies), report.Checked)
+	}
+	return nil
+}
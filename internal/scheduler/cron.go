@@ -0,0 +1,151 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+
+	"github.com/robfig/cron/v3"
+)
+
+// reportTimeout bounds a single report execution including delivery
+const reportTimeout = 5 * time.Minute
+
+// CronRunner executes stored reports on their cron schedules
+type CronRunner struct {
+	cfg    *config.Config
+	db     *db.DB
+	mailer *Mailer
+	cron   *cron.Cron
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	entries map[int64]cron.EntryID
+}
+
+func NewCronRunner(cfg *config.Config, db *db.DB, clk clock.Clock) *CronRunner {
+	return &CronRunner{
+		cfg:     cfg,
+		db:      db,
+		mailer:  NewMailer(cfg),
+		cron:    cron.New(),
+		clock:   clk,
+		entries: make(map[int64]cron.EntryID),
+	}
+}
+
+// Start schedules every stored report and starts the cron loop
+func (r *CronRunner) Start(ctx context.Context) error {
+	reports, err := r.db.GetReports(ctx)
+	if err != nil {
+		return fmt.Errorf("load reports: %w", err)
+	}
+
+	for _, report := range reports {
+		if err := r.Schedule(report); err != nil {
+			log.Printf("[SCHEDULER] Skipping report %d: %v", report.ID, err)
+		}
+	}
+
+	r.cron.Start()
+	log.Printf("[SCHEDULER] Started with %d scheduled reports", len(r.entries))
+	return nil
+}
+
+// Stop halts the cron loop and waits for running jobs to finish
+func (r *CronRunner) Stop() {
+	<-r.cron.Stop().Done()
+}
+
+// Schedule registers (or re-registers) a report with the cron loop
+func (r *CronRunner) Schedule(report models.Report) error {
+	if err := ValidateSchedule(report.Schedule); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entryID, ok := r.entries[report.ID]; ok {
+		r.cron.Remove(entryID)
+		delete(r.entries, report.ID)
+	}
+
+	id := report.ID
+	entryID, err := r.cron.AddFunc(report.Schedule, func() { r.runScheduled(id) })
+	if err != nil {
+		return fmt.Errorf("schedule report %d: %w", id, err)
+	}
+	r.entries[id] = entryID
+
+	return nil
+}
+
+// Remove unregisters a report from the cron loop
+func (r *CronRunner) Remove(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entryID, ok := r.entries[id]; ok {
+		r.cron.Remove(entryID)
+		delete(r.entries, id)
+	}
+}
+
+// Run executes a report, formats the output and emails it to the recipients.
+// It reports whether the report was sent: reports that alert, such as
+// quiet_agents, aren't when they find nothing.
+func (r *CronRunner) Run(ctx context.Context, report *models.Report) (bool, error) {
+	result, err := executeReport(ctx, r.db, report, r.clock.Now())
+	if err != nil {
+		return false, fmt.Errorf("execute report: %w", err)
+	}
+	if result.skipEmpty && len(result.rows) == 0 {
+		log.Printf("[SCHEDULER] Report %d (%s) found nothing, not sent", report.ID, report.Name)
+		return false, nil
+	}
+
+	attachment, err := formatReport(report.Format, result)
+	if err != nil {
+		return false, fmt.Errorf("format report: %w", err)
+	}
+
+	if err := r.mailer.Send(report, attachment); err != nil {
+		return false, fmt.Errorf("send report: %w", err)
+	}
+
+	log.Printf("[SCHEDULER] Report %d (%s) sent to %d recipients",
+		report.ID, report.Name, len(report.RecipientEmails))
+	return true, nil
+}
+
+// runScheduled reloads the report so edits made since scheduling take effect
+func (r *CronRunner) runScheduled(id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	report, err := r.db.GetReport(ctx, id)
+	if err != nil {
+		log.Printf("[SCHEDULER] Error loading report %d: %v", id, err)
+		return
+	}
+
+	if _, err := r.Run(ctx, report); err != nil {
+		log.Printf("[SCHEDULER] Error running report %d: %v", id, err)
+	}
+}
+
+// ValidateSchedule checks that spec is a standard 5-field cron expression
+func ValidateSchedule(spec string) error {
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+	return nil
+}
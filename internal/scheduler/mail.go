@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// Mailer delivers report output over SMTP
+type Mailer struct {
+	addr string
+	from string
+}
+
+func NewMailer(cfg *config.Config) *Mailer {
+	return &Mailer{
+		addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		from: cfg.SMTPFrom,
+	}
+}
+
+// Send emails the report output as an attachment to every recipient
+func (m *Mailer) Send(report *models.Report, att *attachment) error {
+	if len(report.RecipientEmails) == 0 {
+		return fmt.Errorf("report %d has no recipients", report.ID)
+	}
+
+	msg, err := m.buildMessage(report, att)
+	if err != nil {
+		return fmt.Errorf("build message: %w", err)
+	}
+
+	if err := smtp.SendMail(m.addr, nil, m.from, report.RecipientEmails, msg); err != nil {
+		return fmt.Errorf("smtp send: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Mailer) buildMessage(report *models.Report, att *attachment) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	textPart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(textPart, "Report %q (%s) generated at %s.\r\n",
+		report.Name, report.Query, time.Now().UTC().Format(time.RFC3339))
+
+	filePart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {att.contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", att.filename)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64Lines(filePart, att.data); err != nil {
+		return nil, err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(report.RecipientEmails, ", "))
+	fmt.Fprintf(&msg, "Subject: Diagnostic report: %s\r\n", report.Name)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// writeBase64Lines encodes data wrapped at the 76 character limit from RFC 2045
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
@@ -0,0 +1,159 @@
+package scheduler
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// smtpDelivery is what the mock SMTP server received in one transaction
+type smtpDelivery struct {
+	from string
+	to   []string
+	data string
+}
+
+// mockSMTP accepts one message over plain SMTP, without extensions, and
+// returns its address and a channel receiving the delivery
+func mockSMTP(t *testing.T) (string, <-chan smtpDelivery) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	delivered := make(chan smtpDelivery, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+
+		var d smtpDelivery
+		tp.PrintfLine("220 mock ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				tp.PrintfLine("250 mock")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				d.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				tp.PrintfLine("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				d.to = append(d.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				tp.PrintfLine("250 OK")
+			case cmd == "DATA":
+				tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				data, err := io.ReadAll(tp.DotReader())
+				if err != nil {
+					return
+				}
+				d.data = string(data)
+				tp.PrintfLine("250 OK")
+			case cmd == "QUIT":
+				tp.PrintfLine("221 Bye")
+				delivered <- d
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), delivered
+}
+
+func TestMailerSendsReport(t *testing.T) {
+	addr, delivered := mockSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	m := NewMailer(&config.Config{SMTPHost: host, SMTPPort: port, SMTPFrom: "reports@example.com"})
+
+	report := &models.Report{ID: 7, Name: "Nightly errors", Query: "log_search", RecipientEmails: []string{"a@example.com", "b@example.com"}}
+	att, err := formatReport(FormatCSV, &reportResult{
+		columns: []string{"file", "line"},
+		rows:    [][]string{{"/var/log/app.log", strings.Repeat("error ", 30)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(report, att); err != nil {
+		t.Fatal(err)
+	}
+
+	d := <-delivered
+	if d.from != "reports@example.com" || strings.Join(d.to, ",") != "a@example.com,b@example.com" {
+		t.Fatalf("envelope from %q to %v", d.from, d.to)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(d.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Diagnostic report: Nightly errors" {
+		t.Errorf("subject = %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "a@example.com, b@example.com" {
+		t.Errorf("to = %q", got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q: %v", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+
+	text, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(text)
+	if !strings.Contains(string(body), `Report "Nightly errors" (log_search)`) {
+		t.Errorf("text part = %q", body)
+	}
+
+	file, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FileName() != "report.csv" || file.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("attachment %q of type %q", file.FileName(), file.Header.Get("Content-Type"))
+	}
+	encoded := bufio.NewScanner(file)
+	var csv strings.Builder
+	for encoded.Scan() {
+		if len(encoded.Text()) > 76 {
+			t.Errorf("base64 line of %d characters", len(encoded.Text()))
+		}
+		csv.WriteString(encoded.Text())
+	}
+	decoded, err := base64.StdEncoding.DecodeString(csv.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "file,line\n/var/log/app.log," + strings.Repeat("error ", 30) + "\n"; string(decoded) != want {
+		t.Errorf("attachment = %q, want %q", decoded, want)
+	}
+}
+
+func TestMailerRequiresRecipients(t *testing.T) {
+	m := NewMailer(&config.Config{SMTPHost: "127.0.0.1", SMTPPort: "1"})
+	if err := m.Send(&models.Report{ID: 1}, &attachment{}); err == nil {
+		t.Fatal("report without recipients sent")
+	}
+}
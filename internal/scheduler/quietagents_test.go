@@ -0,0 +1,133 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/jobs"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+func TestQuietAgentsReportParams(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, params := range []map[string]string{
+		{"window": "soon"},
+		{"window": "0s"},
+		{"window": "24h"},
+	} {
+		if _, err := runQuietAgents(ctx, nil, params, now); err == nil {
+			t.Errorf("params %v accepted", params)
+		}
+	}
+	if _, err := runQuietAgents(ctx, nil, map[string]string{"rate": "errors"}, now); !errors.Is(err, db.ErrInvalidQuery) {
+		t.Errorf("unknown rate = %v, want ErrInvalidQuery", err)
+	}
+}
+
+// TestQuietAgentAlert runs the agent_metrics job against a fake agent that
+// sends logs and then goes quiet, and the quiet_agents report only mails
+// once the agent was quiet for its window
+func TestQuietAgentAlert(t *testing.T) {
+	database := openTestDB(t, 0, "agent_metrics")
+	addr, delivered := mockSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	t.Setenv("DATABASE_URL", os.Getenv("TEST_DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPFrom = host, port, "alerts@example.com"
+
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tun := tunnel.NewHandler(cfg, database, clk)
+	t.Cleanup(tun.Close)
+	var sample jobs.Job
+	for _, j := range tun.Jobs() {
+		if j.Name == "agent_metrics" {
+			sample = j
+		}
+	}
+	if sample.Run == nil {
+		t.Fatal("no agent_metrics job")
+	}
+	ctx := context.Background()
+	minute := func() {
+		t.Helper()
+		clk.Advance(time.Minute)
+		if err := sample.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	go tun.HandleConnection(ctx, server)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := agent.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	payload, _ := json.Marshal([]models.LogEntry{{Filename: "/var/log/app.log", Line: "working", LineNum: 1, Timestamp: clk.Now()}})
+	if err := json.NewEncoder(agent).Encode(tunnel.Message{Type: tunnel.TypeLogData, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sampled each minute until the line shows up as activity
+	for i := 0; ; i++ {
+		if i == 10 {
+			t.Fatal("the agent's line never showed up in its metrics")
+		}
+		minute()
+		samples, err := database.GetAgentMetrics(ctx, "pipe", time.Time{}, clk.Now().Add(time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) > 0 && samples[len(samples)-1].LinesPerSecond > 0 {
+			break
+		}
+	}
+
+	runner := NewCronRunner(cfg, database, clk)
+	report := &models.Report{ID: 1, Name: "Quiet agents", Query: "quiet_agents", Format: FormatCSV, RecipientEmails: []string{"oncall@example.com"}}
+
+	// Quiet, but for less than the default 10 minute window
+	for i := 0; i < 9; i++ {
+		minute()
+	}
+	if sent, err := runner.Run(ctx, report); err != nil || sent {
+		t.Fatalf("report after 9 quiet minutes = %v %v, want not sent", sent, err)
+	}
+
+	minute()
+	result, err := executeReport(ctx, database, report, clk.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.rows) != 1 || result.rows[0][0] != "pipe" {
+		t.Fatalf("quiet agents after 10 minutes = %v, want the agent", result.rows)
+	}
+	if sent, err := runner.Run(ctx, report); err != nil || !sent {
+		t.Fatalf("report after 10 quiet minutes = %v %v, want sent", sent, err)
+	}
+	select {
+	case d := <-delivered:
+		if len(d.to) != 1 || d.to[0] != "oncall@example.com" {
+			t.Errorf("alert sent to %v", d.to)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert not delivered")
+	}
+}
@@ -0,0 +1,267 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// reportResult holds query output in both tabular (csv) and structured (json) form
+type reportResult struct {
+	columns []string
+	rows    [][]string
+	value   interface{}
+	// Not mailed when there are no rows, so the report works as an alert
+	skipEmpty bool
+}
+
+// queryFunc runs a report query as of now
+type queryFunc func(ctx context.Context, db *db.DB, params map[string]string, now time.Time) (*reportResult, error)
+
+var reportQueries = map[string]queryFunc{
+	"log_search":      runLogSearch,
+	"network_summary": runNetworkSummary,
+	"network_top":     runNetworkTop,
+	"quiet_agents":    runQuietAgents,
+}
+
+// ValidateQuery checks that name refers to a known report query
+func ValidateQuery(name string) error {
+	if _, ok := reportQueries[name]; !ok {
+		return fmt.Errorf("unknown report query: %s", name)
+	}
+	return nil
+}
+
+// ValidateFormat checks that format is a supported output format
+func ValidateFormat(format string) error {
+	if format != FormatCSV && format != FormatJSON {
+		return fmt.Errorf("unsupported report format: %s", format)
+	}
+	return nil
+}
+
+func executeReport(ctx context.Context, db *db.DB, report *models.Report, now time.Time) (*reportResult, error) {
+	run, ok := reportQueries[report.Query]
+	if !ok {
+		return nil, fmt.Errorf("unknown report query: %s", report.Query)
+	}
+	return run(ctx, db, report.Params, now)
+}
+
+type attachment struct {
+	filename    string
+	contentType string
+	data        []byte
+}
+
+func formatReport(format string, result *reportResult) (*attachment, error) {
+	switch format {
+	case FormatCSV:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(result.columns); err != nil {
+			return nil, err
+		}
+		if err := w.WriteAll(result.rows); err != nil {
+			return nil, err
+		}
+		return &attachment{filename: "report.csv", contentType: "text/csv", data: buf.Bytes()}, nil
+
+	case FormatJSON:
+		data, err := json.MarshalIndent(result.value, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return &attachment{filename: "report.json", contentType: "application/json", data: data}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported report format: %s", format)
+	}
+}
+
+// reportWindow returns the [start, end) range covered by a report run at now
+func reportWindow(params map[string]string, now time.Time) (time.Time, time.Time, error) {
+	window := 24 * time.Hour
+	if w := params["window"]; w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid window: %w", err)
+		}
+		window = d
+	}
+
+	return now.Add(-window), now, nil
+}
+
+func splitParam(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	var parts []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func runLogSearch(ctx context.Context, database *db.DB, params map[string]string, now time.Time) (*reportResult, error) {
+	start, end, err := reportWindow(params, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A search cut short by MAX_FILE_QUERY_ROWS would mail a partial export,
+	// so it is only delivered when the report asks for it with force
+	logs, truncated, err := database.SearchLogs(ctx, params["query"], splitParam(params["files"]), start, end)
+	if err != nil {
+		return nil, err
+	}
+	if truncated && params["force"] != "true" {
+		return nil, fmt.Errorf("%w: a file has more than MAX_FILE_QUERY_ROWS lines in the window; narrow the window, or set force to send the newest lines only",
+			db.ErrTooManyRows)
+	}
+
+	result := &reportResult{
+		columns: []string{"timestamp", "filename", "line_num", "level", "line"},
+		value:   logs,
+	}
+	for _, l := range logs {
+		result.rows = append(result.rows, []string{
+			l.Timestamp.Format(time.RFC3339), l.Filename,
+			strconv.Itoa(l.LineNum), l.Level, l.Line,
+		})
+	}
+
+	return result, nil
+}
+
+func runNetworkSummary(ctx context.Context, db *db.DB, params map[string]string, now time.Time) (*reportResult, error) {
+	start, end, err := reportWindow(params, now)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := db.GetNetworkPacketsWithStats(ctx, start, end, splitParam(params["protocols"]))
+	if err != nil {
+		return nil, err
+	}
+
+	// The packet list is too large for an email; keep only the aggregates
+	stats.Packets = nil
+
+	result := &reportResult{
+		columns: []string{"metric", "value"},
+		rows: [][]string{
+			{"packet_count", strconv.FormatInt(stats.PacketCount, 10)},
+			{"total_bytes", strconv.FormatInt(stats.TotalBytes, 10)},
+			{"avg_packet_size", strconv.FormatFloat(stats.AvgPacketSize, 'f', 2, 64)},
+			{"unique_sources", strconv.FormatInt(stats.UniqueSources, 10)},
+			{"unique_destinations", strconv.FormatInt(stats.UniqueDestinations, 10)},
+			{"protocol_count", strconv.FormatInt(stats.ProtocolCount, 10)},
+		},
+		value: stats,
+	}
+	for protocol, count := range stats.ProtocolStats {
+		result.rows = append(result.rows, []string{"protocol:" + protocol, strconv.FormatInt(count, 10)})
+	}
+
+	return result, nil
+}
+
+func runNetworkTop(ctx context.Context, db *db.DB, params map[string]string, now time.Time) (*reportResult, error) {
+	start, end, err := reportWindow(params, now)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := 10
+	if l := params["limit"]; l != "" {
+		if limit, err = strconv.Atoi(l); err != nil {
+			return nil, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+
+	stats, err := db.GetTopNetworkStats(ctx, start, end, splitParam(params["protocols"]), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &reportResult{
+		columns: []string{"category", "key", "packet_count"},
+		value:   stats,
+	}
+	for _, group := range []struct {
+		name   string
+		values map[string]int64
+	}{
+		{"source", stats.TopSources},
+		{"destination", stats.TopDestinations},
+		{"protocol", stats.TopProtocols},
+		{"port", stats.TopPorts},
+	} {
+		for key, count := range group.values {
+			result.rows = append(result.rows, []string{group.name, key, strconv.FormatInt(count, 10)})
+		}
+	}
+
+	return result, nil
+}
+
+// quietAgentsLookback is how far back an agent must have been sampled to be
+// reported as quiet, so agents retired long ago don't alert forever
+const quietAgentsLookback = 24 * time.Hour
+
+// runQuietAgents lists agents whose rate (lines, packets or bytes; default
+// lines) stayed at zero for the window (default 10m), and is only mailed
+// when it finds any
+func runQuietAgents(ctx context.Context, db *db.DB, params map[string]string, now time.Time) (*reportResult, error) {
+	window := 10 * time.Minute
+	if w := params["window"]; w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 || d >= quietAgentsLookback {
+			return nil, fmt.Errorf("invalid window: must be a positive duration under %v", quietAgentsLookback)
+		}
+		window = d
+	}
+	rate := params["rate"]
+	if rate == "" {
+		rate = "lines"
+	}
+
+	agents, err := db.QuietAgents(ctx, rate, now.Add(-quietAgentsLookback), now.Add(-window))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &reportResult{
+		columns:   []string{"agent_id", "last_active"},
+		value:     agents,
+		skipEmpty: true,
+	}
+	for _, a := range agents {
+		lastActive := ""
+		if a.LastActive != nil {
+			lastActive = a.LastActive.Format(time.RFC3339)
+		}
+		result.rows = append(result.rows, []string{a.AgentID, lastActive})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,84 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// openTestDB connects to the database TEST_DATABASE_URL names, migrating it,
+// with searches capped at maxFileRows lines per file, and empties the given
+// tables. Tests needing it are skipped when the variable isn't set.
+func openTestDB(tb testing.TB, maxFileRows int, tables ...string) *db.DB {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	defer conn.Close(ctx)
+	for _, table := range tables {
+		if _, err := conn.Exec(ctx, "TRUNCATE "+table+" CASCADE"); err != nil {
+			tb.Fatalf("truncate %s: %v", table, err)
+		}
+	}
+
+	d, err := db.New(ctx, &config.Config{
+		DatabaseURL:      url,
+		MaxFileQueryRows: maxFileRows,
+		InitialBackoff:   10 * time.Millisecond,
+		MaxBackoff:       100 * time.Millisecond,
+		FailoverTimeout:  time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	tb.Cleanup(d.Close)
+	return d
+}
+
+func TestLogSearchReportRefusesTruncatedExport(t *testing.T) {
+	database := openTestDB(t, 5, "files", "logs")
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	const path = "/var/log/runaway.log"
+	if err := database.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: "runaway.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	var logs []models.LogEntry
+	for i := 1; i <= 10; i++ {
+		logs = append(logs, models.LogEntry{Filename: path, Line: fmt.Sprintf("error %d", i), LineNum: i, Timestamp: now.Add(-time.Duration(i) * time.Minute)})
+	}
+	if err := database.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	params := map[string]string{"query": "error", "files": path, "window": "1h"}
+	if _, err := runLogSearch(ctx, database, params, now); !errors.Is(err, db.ErrTooManyRows) {
+		t.Fatalf("export of a file over the cap = %v, want ErrTooManyRows", err)
+	}
+
+	params["force"] = "true"
+	result, err := runLogSearch(ctx, database, params, now)
+	if err != nil {
+		t.Fatalf("forced export: %v", err)
+	}
+	if len(result.rows) != 5 {
+		t.Fatalf("forced export has %d rows, want the newest 5", len(result.rows))
+	}
+}
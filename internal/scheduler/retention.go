@@ -0,0 +1,123 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+)
+
+// RetentionPolicy decides how long log lines are kept. Levels without their
+// own window use Default; a zero window keeps lines forever.
+type RetentionPolicy struct {
+	Default time.Duration
+	Levels  map[string]time.Duration // Keyed by upper-case level
+}
+
+// Retention holds the current policy, which can be replaced at runtime
+type Retention struct {
+	mu     sync.RWMutex
+	policy RetentionPolicy
+	clock  clock.Clock
+}
+
+// NewRetention starts from the policy in the environment
+func NewRetention(cfg *config.Config, clk clock.Clock) *Retention {
+	return &Retention{
+		policy: RetentionPolicy{
+			Default: cfg.LogRetention,
+			Levels:  cfg.LogRetentionLevels,
+		},
+		clock: clk,
+	}
+}
+
+// Policy returns the current policy
+func (r *Retention) Policy() RetentionPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policy
+}
+
+// SetPolicy replaces the policy; it applies from the next retention pass
+func (r *Retention) SetPolicy(p RetentionPolicy) {
+	levels := make(map[string]time.Duration, len(p.Levels))
+	for level, d := range p.Levels {
+		levels[strings.ToUpper(level)] = d
+	}
+	p.Levels = levels
+
+	r.mu.Lock()
+	r.policy = p
+	r.mu.Unlock()
+}
+
+// cutoffs turns the policy and per-file overrides into deletion cutoffs
+// relative to now. Levels kept forever are listed in Keep, so the default
+// window doesn't apply to them.
+func (p RetentionPolicy) cutoffs(now time.Time, files map[string]time.Duration, held []string) db.RetentionCutoffs {
+	c := db.RetentionCutoffs{
+		Levels: make(map[string]time.Time, len(p.Levels)),
+		Files:  make(map[string]time.Time, len(files)),
+		Held:   held,
+	}
+	if p.Default > 0 {
+		c.Default = now.Add(-p.Default)
+	}
+	for level, d := range p.Levels {
+		if d > 0 {
+			c.Levels[level] = now.Add(-d)
+		} else {
+			c.Keep = append(c.Keep, level)
+		}
+	}
+	for file, d := range files {
+		c.Files[file] = now.Add(-d)
+	}
+	return c
+}
+
+// Cutoffs returns what a retention pass at now would delete, under the
+// current policy, per-file overrides and legal holds
+func (r *Retention) Cutoffs(ctx context.Context, database *db.DB, now time.Time) (db.RetentionCutoffs, error) {
+	files, err := database.GetFileRetentions(ctx)
+	if err != nil {
+		return db.RetentionCutoffs{}, err
+	}
+	held, err := database.GetHeldFiles(ctx)
+	if err != nil {
+		return db.RetentionCutoffs{}, err
+	}
+	return r.Policy().cutoffs(now, files, held), nil
+}
+
+// Apply deletes log lines past their retention window. The policy,
+// per-file overrides and legal holds are re-read on every pass, so changes
+// take effect without a restart.
+func (r *Retention) Apply(ctx context.Context, database *db.DB) error {
+	cutoffs, err := r.Cutoffs(ctx, database, r.clock.Now())
+	if err != nil {
+		return fmt.Errorf("load file retention overrides: %w", err)
+	}
+	if len(cutoffs.Held) > 0 {
+		log.Printf("[SCHEDULER] Retention skipped %d files on legal hold", len(cutoffs.Held))
+	}
+	if cutoffs.Default.IsZero() && len(cutoffs.Levels) == 0 && len(cutoffs.Files) == 0 {
+		return nil
+	}
+
+	n, err := database.DeleteExpiredLogs(ctx, cutoffs)
+	if err != nil {
+		return fmt.Errorf("delete expired logs: %w", err)
+	}
+	if n > 0 {
+		log.Printf("[SCHEDULER] Deleted %d log lines past retention", n)
+	}
+	return nil
+}
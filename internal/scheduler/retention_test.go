@@ -0,0 +1,131 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestRetentionMatrix(t *testing.T) {
+	database := openTestDB(t, 0, "files", "logs")
+	ctx := context.Background()
+	clk := clock.NewFake(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	now := clk.Now()
+
+	files := []struct {
+		name      string
+		retention time.Duration
+		hold      bool
+		kept      int
+	}{
+		// The default window and the DEBUG window apply
+		{"default.log", 0, false, 1},
+		// An override replaces every level rule for the file
+		{"audit.log", 365 * 24 * time.Hour, false, 3},
+		{"short.log", 24 * time.Hour, false, 2},
+		// A hold keeps everything, whatever the file's own window
+		{"held.log", 0, true, 4},
+		{"held-audit.log", 24 * time.Hour, true, 4},
+	}
+	var logs []models.LogEntry
+	for _, f := range files {
+		path := "/var/log/" + f.name
+		if err := database.SaveFiles(ctx, []models.FileNode{{Path: path, ParentPath: "/var/log", Name: f.name, ModTime: now, LastSeen: now}}); err != nil {
+			t.Fatal(err)
+		}
+		if f.retention > 0 {
+			if err := database.SetFileRetention(ctx, path, f.retention); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.hold {
+			if err := database.SetFileLegalHold(ctx, path, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, line := range []struct {
+			age   time.Duration
+			level string
+		}{
+			{time.Hour, "INFO"},
+			{time.Hour, "debug"},
+			{100 * time.Hour, "INFO"},
+			{400 * 24 * time.Hour, "INFO"},
+		} {
+			logs = append(logs, models.LogEntry{Filename: path, Line: "line", LineNum: i + 1, Timestamp: now.Add(-line.age), Level: line.level})
+		}
+	}
+	if err := database.SaveLogs(ctx, logs); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRetention(&config.Config{
+		LogRetention:       72 * time.Hour,
+		LogRetentionLevels: map[string]time.Duration{"DEBUG": 30 * time.Minute},
+	}, clk)
+	if err := r.Apply(ctx, database); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := pgx.Connect(ctx, os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	for _, f := range files {
+		var kept int
+		if err := conn.QueryRow(ctx, `SELECT count(*) FROM logs WHERE file_path = $1`, "/var/log/"+f.name).Scan(&kept); err != nil {
+			t.Fatal(err)
+		}
+		if kept != f.kept {
+			t.Errorf("%s: kept %d lines, want %d", f.name, kept, f.kept)
+		}
+	}
+
+	// Lifting the hold lets the file's own window apply on the next pass
+	if err := database.SetFileLegalHold(ctx, "/var/log/held-audit.log", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Apply(ctx, database); err != nil {
+		t.Fatal(err)
+	}
+	var kept int
+	if err := conn.QueryRow(ctx, `SELECT count(*) FROM logs WHERE file_path = '/var/log/held-audit.log'`).Scan(&kept); err != nil {
+		t.Fatal(err)
+	}
+	if kept != 2 {
+		t.Errorf("held-audit.log after the hold was lifted: kept %d lines, want 2", kept)
+	}
+}
+
+func TestRetentionCutoffs(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	p := RetentionPolicy{
+		Default: 72 * time.Hour,
+		Levels:  map[string]time.Duration{"DEBUG": time.Hour, "AUDIT": 0},
+	}
+	c := p.cutoffs(now, map[string]time.Duration{"/var/log/audit.log": 365 * 24 * time.Hour}, []string{"/var/log/held.log"})
+
+	if !c.Default.Equal(now.Add(-72 * time.Hour)) {
+		t.Errorf("default cutoff = %s", c.Default)
+	}
+	if !c.Levels["DEBUG"].Equal(now.Add(-time.Hour)) || len(c.Levels) != 1 {
+		t.Errorf("level cutoffs = %v, want DEBUG an hour back", c.Levels)
+	}
+	if len(c.Keep) != 1 || c.Keep[0] != "AUDIT" {
+		t.Errorf("kept levels = %v, want AUDIT", c.Keep)
+	}
+	if !c.Files["/var/log/audit.log"].Equal(now.Add(-365 * 24 * time.Hour)) {
+		t.Errorf("file cutoffs = %v", c.Files)
+	}
+	if len(c.Held) != 1 || c.Held[0] != "/var/log/held.log" {
+		t.Errorf("held files = %v", c.Held)
+	}
+}
@@ -0,0 +1,155 @@
+// Package selector parses the file selectors accepted wherever the API takes
+// files. A selector is one of:
+//
+//   - an exact path, such as /var/log/syslog
+//   - a prefix ending in a slash, selecting every file below it, such as
+//     /var/log/app/
+//   - a glob, where * matches any run of characters within a path
+//     component, ** any run across components, and ? one character other
+//     than a slash, such as /var/log/app/**.err
+//
+// A backslash makes the next character literal, so /tmp/a\*b is the exact
+// path /tmp/a*b and \\ is a backslash. Selectors are resolved against the
+// files table by the db package; this package only parses and matches them.
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxFiles bounds how many files a request's selectors may expand to
+const MaxFiles = 1000
+
+// Kind is the form of a selector
+type Kind int
+
+const (
+	Exact Kind = iota
+	Prefix
+	Glob
+)
+
+// Selector is a parsed file selector
+type Selector struct {
+	raw  string
+	kind Kind
+	// The exact path, the prefix including its trailing slash, or the
+	// literal part of a glob before its first wildcard, all unescaped
+	literal string
+	// Anchored regular expression matching the selected paths; set for globs
+	pattern string
+	re      *regexp.Regexp
+}
+
+// Parse parses one selector. A missing leading slash is added, as for paths,
+// so "/" is the prefix of every file.
+func Parse(s string) (Selector, error) {
+	raw := s
+	if strings.TrimSpace(s) == "" {
+		return Selector{}, errors.New("empty file selector")
+	}
+	if !strings.HasPrefix(s, "/") {
+		s = "/" + s
+	}
+
+	var (
+		literal  strings.Builder
+		pattern  strings.Builder
+		wildcard bool
+	)
+	pattern.WriteString("^")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(s) {
+				return Selector{}, fmt.Errorf("selector %q ends in an unfinished escape", raw)
+			}
+			i++
+			if !wildcard {
+				literal.WriteByte(s[i])
+			}
+			pattern.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		case c == '*' && i+1 < len(s) && s[i+1] == '*':
+			i++
+			wildcard = true
+			pattern.WriteString(".*")
+		case c == '*':
+			wildcard = true
+			pattern.WriteString("[^/]*")
+		case c == '?':
+			wildcard = true
+			pattern.WriteString("[^/]")
+		default:
+			if !wildcard {
+				literal.WriteByte(c)
+			}
+			pattern.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	pattern.WriteString("$")
+
+	sel := Selector{raw: raw, literal: literal.String()}
+	switch {
+	case wildcard:
+		sel.kind = Glob
+		sel.pattern = pattern.String()
+		sel.re = regexp.MustCompile(sel.pattern)
+	case strings.HasSuffix(sel.literal, "/"):
+		sel.kind = Prefix
+	default:
+		sel.kind = Exact
+	}
+	return sel, nil
+}
+
+// ParseAll parses selectors, reporting the first malformed one
+func ParseAll(selectors []string) ([]Selector, error) {
+	parsed := make([]Selector, 0, len(selectors))
+	for _, s := range selectors {
+		sel, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, sel)
+	}
+	return parsed, nil
+}
+
+func (s Selector) String() string { return s.raw }
+
+// Kind returns the form of the selector
+func (s Selector) Kind() Kind { return s.kind }
+
+// Literal returns the exact path, the prefix with its trailing slash, or the
+// literal start of a glob, which every selected path begins with
+func (s Selector) Literal() string { return s.literal }
+
+// Pattern returns an anchored regular expression for a glob, in syntax that
+// both Go and PostgreSQL accept; empty for other kinds
+func (s Selector) Pattern() string { return s.pattern }
+
+// Match reports whether path is selected
+func (s Selector) Match(path string) bool {
+	switch s.kind {
+	case Prefix:
+		return strings.HasPrefix(path, s.literal)
+	case Glob:
+		return s.re.MatchString(path)
+	default:
+		return path == s.literal
+	}
+}
+
+// AllExact reports whether every selector names an exact path
+func AllExact(selectors []Selector) bool {
+	for _, s := range selectors {
+		if s.kind != Exact {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package selector
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseKinds(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		kind    Kind
+		literal string
+	}{
+		{"/var/log/syslog", Exact, "/var/log/syslog"},
+		{"var/log/syslog", Exact, "/var/log/syslog"},
+		{"/var/log/app/", Prefix, "/var/log/app/"},
+		{"/", Prefix, "/"},
+		{"/var/log/app/*.err", Glob, "/var/log/app/"},
+		{"/var/log/**.err", Glob, "/var/log/"},
+		{"/var/log/app?.log", Glob, "/var/log/app"},
+		{"/var/*/app/", Glob, "/var/"},
+		// Escaped wildcards are literal characters
+		{`/tmp/a\*b`, Exact, "/tmp/a*b"},
+		{`/tmp/a\?b`, Exact, "/tmp/a?b"},
+		{`/tmp/a\\b`, Exact, `/tmp/a\b`},
+		{`/tmp/a\*/`, Prefix, "/tmp/a*/"},
+		{`/tmp/\*\*/*.log`, Glob, "/tmp/**/"},
+		{`/tmp/a\b`, Exact, "/tmp/ab"},
+	} {
+		sel, err := Parse(tc.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.in, err)
+			continue
+		}
+		if sel.Kind() != tc.kind || sel.Literal() != tc.literal {
+			t.Errorf("Parse(%q) = kind %d literal %q, want kind %d literal %q", tc.in, sel.Kind(), sel.Literal(), tc.kind, tc.literal)
+		}
+		if sel.String() != tc.in {
+			t.Errorf("Parse(%q).String() = %q", tc.in, sel.String())
+		}
+		if (sel.Pattern() != "") != (tc.kind == Glob) {
+			t.Errorf("Parse(%q).Pattern() = %q for kind %d", tc.in, sel.Pattern(), sel.Kind())
+		}
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	for _, in := range []string{"", "   ", `/tmp/a\`, `/tmp/a\\\`} {
+		if sel, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", in, sel)
+		}
+	}
+	if _, err := ParseAll([]string{"/var/log/a.log", `/tmp/\`}); err == nil {
+		t.Error("ParseAll with a malformed selector succeeded")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		sel   string
+		match []string
+		miss  []string
+	}{
+		{"/var/log/syslog",
+			[]string{"/var/log/syslog"},
+			[]string{"/var/log/syslog.1", "/var/log/sys", "/var/log/"}},
+		{"/var/log/app/",
+			[]string{"/var/log/app/a.log", "/var/log/app/deep/b.err"},
+			[]string{"/var/log/app", "/var/log/apps/a.log"}},
+		{"/var/log/app/*.err",
+			[]string{"/var/log/app/a.err", "/var/log/app/.err"},
+			[]string{"/var/log/app/deep/b.err", "/var/log/app/a.err.1", "/var/log/app/aerr"}},
+		{"/var/log/**.err",
+			[]string{"/var/log/a.err", "/var/log/app/deep/b.err"},
+			[]string{"/var/log/a.log", "/var/lib/a.err"}},
+		{"/var/log/app?.log",
+			[]string{"/var/log/app1.log", "/var/log/appX.log"},
+			[]string{"/var/log/app.log", "/var/log/app12.log", "/var/log/app/.log"}},
+		// Regular expression characters in paths are literal
+		{"/srv/a.b+c(1)/*.log",
+			[]string{"/srv/a.b+c(1)/x.log"},
+			[]string{"/srv/aXb+c(1)/x.log", "/srv/a.bbc1/x.log"}},
+		{"/srv/[ab]^$|{2}/*",
+			[]string{"/srv/[ab]^$|{2}/x"},
+			[]string{"/srv/a/x", "/srv/b^$|{2}/x"}},
+		// Escaped wildcards match only themselves
+		{`/tmp/\*/*.log`,
+			[]string{"/tmp/*/a.log"},
+			[]string{"/tmp/x/a.log"}},
+		{`/tmp/a\?b*`,
+			[]string{"/tmp/a?b", "/tmp/a?bc"},
+			[]string{"/tmp/axb"}},
+		{`/tmp/a\\*`,
+			[]string{`/tmp/a\`, `/tmp/a\b`},
+			[]string{"/tmp/ab"}},
+	} {
+		sel, err := Parse(tc.sel)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.sel, err)
+		}
+		for _, path := range tc.match {
+			if !sel.Match(path) {
+				t.Errorf("%q doesn't match %q", tc.sel, path)
+			}
+		}
+		for _, path := range tc.miss {
+			if sel.Match(path) {
+				t.Errorf("%q matches %q", tc.sel, path)
+			}
+		}
+	}
+}
+
+func TestPatternStartsWithLiteral(t *testing.T) {
+	// The db package narrows a glob's scan by its literal start, so
+	// everything the pattern matches must begin with it
+	paths := []string{"/var/log/app/x.err", "/tmp/a*b/c/d", "/srv/a.b/x", "/x"}
+	for _, in := range []string{"/var/log/app/*.err", `/tmp/a\*b/**`, "/srv/a.b/?", "/*"} {
+		sel, err := Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile(sel.Pattern())
+		matched := 0
+		for _, path := range paths {
+			if !re.MatchString(path) {
+				continue
+			}
+			matched++
+			if !strings.HasPrefix(path, sel.Literal()) {
+				t.Errorf("%q matches %q, which doesn't start with %q", in, path, sel.Literal())
+			}
+		}
+		if matched == 0 {
+			t.Errorf("%q matches none of %v", in, paths)
+		}
+	}
+}
+
+func TestAllExact(t *testing.T) {
+	exact, _ := ParseAll([]string{"/var/log/a.log", `/tmp/a\*b`})
+	if !AllExact(exact) {
+		t.Error("exact paths, one with an escaped wildcard, aren't all exact")
+	}
+	mixed, _ := ParseAll([]string{"/var/log/a.log", "/var/log/"})
+	if AllExact(mixed) {
+		t.Error("a prefix counts as exact")
+	}
+	if !AllExact(nil) {
+		t.Error("no selectors aren't all exact")
+	}
+}
@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+// AgentConfigPush carries an agent's config. It is sent after hello to agents
+// offering agent_config, and again whenever their profile changes. Agents
+// answer with an AgentConfigAck.
+type AgentConfigPush struct {
+	// The agent's ID, or "default" when it has no profile of its own
+	Profile string             `json:"profile"`
+	Version int64              `json:"version"`
+	Config  models.AgentConfig `json:"config"`
+}
+
+// AgentConfigAck reports the config version an agent applied, or why it
+// couldn't
+type AgentConfigAck struct {
+	Profile string `json:"profile"`
+	Version int64  `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// pushAgentConfig sends the agent its effective config, if there is one
+func (h *Handler) pushAgentConfig(ctx context.Context, agent *agentConn) bool {
+	profile, err := h.db.GetEffectiveAgentConfig(ctx, agent.id)
+	if errors.Is(err, db.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		log.Printf("[TUNNEL] Error loading config for %s: %v", agent.id, err)
+		return false
+	}
+
+	data, err := json.Marshal(AgentConfigPush{
+		Profile: profile.AgentID,
+		Version: profile.Version,
+		Config:  profile.Config,
+	})
+	if err != nil {
+		log.Printf("[TUNNEL] Error encoding config for %s: %v", agent.id, err)
+		return false
+	}
+	if err := agent.send(Message{Type: TypeAgentConfig, Payload: data}); err != nil {
+		log.Printf("[TUNNEL] Error pushing config to %s: %v", agent.id, err)
+		return false
+	}
+	return true
+}
+
+// PushAgentConfig re-sends the effective config to connected agents after
+// the profile of agentID changed. A change to the default profile reaches
+// every agent, since any may be using it. Returns how many connections
+// received a config.
+func (h *Handler) PushAgentConfig(ctx context.Context, agentID string) int {
+	h.agents.mu.RLock()
+	conns := make([]*agentConn, 0, len(h.agents.conns))
+	for a := range h.agents.conns {
+		if a.configurable.Load() && (agentID == models.DefaultAgentProfile || a.id == agentID) {
+			conns = append(conns, a)
+		}
+	}
+	h.agents.mu.RUnlock()
+
+	pushed := 0
+	for _, a := range conns {
+		if h.pushAgentConfig(ctx, a) {
+			pushed++
+		}
+	}
+	return pushed
+}
+
+// ConnectedAgentIDs returns the IDs of connected agents with their number of
+// open connections
+func (h *Handler) ConnectedAgentIDs() map[string]int {
+	h.agents.mu.RLock()
+	defer h.agents.mu.RUnlock()
+
+	ids := make(map[string]int, len(h.agents.conns))
+	for a := range h.agents.conns {
+		ids[a.id]++
+	}
+	return ids
+}
+
+func (h *Handler) handleAgentConfigAck(ctx context.Context, agent *agentConn, payload json.RawMessage) error {
+	var ack AgentConfigAck
+	if err := unmarshalPayload(payload, &ack); err != nil {
+		return err
+	}
+	if ack.Profile == "" || ack.Version <= 0 {
+		return fmt.Errorf("%w: config ack without profile or version", errMalformed)
+	}
+
+	if ack.Error != "" {
+		log.Printf("[TUNNEL] Agent %s failed to apply config %s v%d: %s", agent.id, ack.Profile, ack.Version, ack.Error)
+	}
+	return h.db.SaveAgentConfigAck(ctx, models.AgentConfigAck{
+		AgentID: agent.id,
+		Profile: ack.Profile,
+		Version: ack.Version,
+		Error:   ack.Error,
+	})
+}
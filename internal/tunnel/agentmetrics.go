@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// agentMetricsInterval is the resolution of stored agent metrics
+const agentMetricsInterval = time.Minute
+
+// agentIngest counts what each agent sent since the last agent_metrics
+// sample
+type agentIngest struct {
+	mu     sync.Mutex
+	counts map[string]*agentCounts
+	since  time.Time
+}
+
+type agentCounts struct {
+	lines   int64
+	packets int64
+	bytes   int64
+}
+
+func newAgentIngest(retention time.Duration, now time.Time) *agentIngest {
+	if retention <= 0 {
+		return nil
+	}
+	return &agentIngest{
+		counts: make(map[string]*agentCounts),
+		since:  now,
+	}
+}
+
+func (a *agentIngest) add(agentID string, lines, packets, bytes int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.counts[agentID]
+	if !ok {
+		c = &agentCounts{}
+		a.counts[agentID] = c
+	}
+	c.lines += int64(lines)
+	c.packets += int64(packets)
+	c.bytes += int64(bytes)
+}
+
+// take returns the counts since the previous call and how long they took
+// to collect, and starts counting afresh
+func (a *agentIngest) take(now time.Time) (map[string]*agentCounts, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counts, elapsed := a.counts, now.Sub(a.since)
+	a.counts = make(map[string]*agentCounts, len(counts))
+	a.since = now
+	return counts, elapsed
+}
+
+// sampleAgentMetricsJob stores each agent's average rates since the last
+// run. Connected agents that sent nothing get a zero sample, so a quiet
+// agent shows up as such rather than as a gap.
+func (h *Handler) sampleAgentMetricsJob(ctx context.Context) error {
+	now := h.clock.Now()
+	counts, elapsed := h.agentIngest.take(now)
+	for id := range h.ConnectedAgentIDs() {
+		if _, ok := counts[id]; !ok {
+			counts[id] = &agentCounts{}
+		}
+	}
+
+	seconds := elapsed.Seconds()
+	samples := make(map[string]models.AgentMetric, len(counts))
+	for id, c := range counts {
+		samples[id] = models.AgentMetric{
+			Time:             now,
+			LinesPerSecond:   float64(c.lines) / seconds,
+			PacketsPerSecond: float64(c.packets) / seconds,
+			BytesPerSecond:   float64(c.bytes) / seconds,
+		}
+	}
+
+	ctx, cancel := h.writeTimeout(ctx)
+	defer cancel()
+	if err := h.db.SaveAgentMetrics(ctx, samples); err != nil {
+		return fmt.Errorf("save agent metrics: %w", err)
+	}
+
+	deleted, err := h.db.DeleteAgentMetricsBefore(ctx, now.Add(-h.cfg.AgentMetricsRetention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("[TUNNEL] Deleted %d expired agent metric samples", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestAgentIngestTake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := newAgentIngest(time.Hour, start)
+	a.add("a", 10, 0, 100)
+	a.add("a", 5, 3, 50)
+	a.add("b", 0, 7, 0)
+
+	counts, elapsed := a.take(start.Add(time.Minute))
+	if elapsed != time.Minute {
+		t.Errorf("elapsed = %v, want 1m", elapsed)
+	}
+	if c := counts["a"]; c == nil || *c != (agentCounts{lines: 15, packets: 3, bytes: 150}) {
+		t.Errorf("counts of a = %+v, want 15 lines, 3 packets, 150 bytes", c)
+	}
+	if c := counts["b"]; c == nil || c.packets != 7 {
+		t.Errorf("counts of b = %+v, want 7 packets", c)
+	}
+
+	// Counting starts afresh from the last take
+	counts, elapsed = a.take(start.Add(90 * time.Second))
+	if len(counts) != 0 || elapsed != 30*time.Second {
+		t.Errorf("second take = %v over %v, want nothing over 30s", counts, elapsed)
+	}
+}
+
+func TestAgentIngestDisabled(t *testing.T) {
+	a := newAgentIngest(0, time.Now())
+	if a != nil {
+		t.Fatal("agent ingest counted with retention 0")
+	}
+	// Counting on a disabled one does nothing
+	a.add("a", 1, 1, 1)
+}
+
+// sampleAgentMetrics advances the clock a minute and runs the agent_metrics
+// job, as its schedule would
+func sampleAgentMetrics(t *testing.T, h *Handler) {
+	t.Helper()
+	h.clock.(*clock.Fake).Advance(agentMetricsInterval)
+	if err := h.sampleAgentMetricsJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentMetricsJob(t *testing.T) {
+	start := time.Now().UTC().Truncate(time.Minute).Add(-time.Hour)
+	h := newTestHandler(t, start, func(cfg *config.Config) {
+		cfg.AgentMetricsRetention = 3 * time.Minute
+	}, "agent_metrics")
+	conn, _ := connectAgent(t, h)
+
+	logs := make([]models.LogEntry, 120)
+	for i := range logs {
+		logs[i] = models.LogEntry{Filename: "/var/log/app.log", Line: "busy", LineNum: i + 1, Timestamp: start}
+	}
+	send(t, conn, TypeLogData, logs)
+	waitFor(t, "the lines to be counted", func() bool {
+		h.agentIngest.mu.Lock()
+		defer h.agentIngest.mu.Unlock()
+		c := h.agentIngest.counts["pipe"]
+		return c != nil && c.lines == 120
+	})
+
+	sampleAgentMetrics(t, h)
+	ctx := context.Background()
+	samples, err := h.db.GetAgentMetrics(ctx, "pipe", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].LinesPerSecond != 2 || samples[0].BytesPerSecond <= 0 || samples[0].PacketsPerSecond != 0 {
+		t.Fatalf("samples after a busy minute = %+v, want one at 2 lines/s", samples)
+	}
+	if !samples[0].Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("sample taken at %v, want %v", samples[0].Time, start.Add(time.Minute))
+	}
+
+	// The agent stays connected but sends nothing, and is sampled at zero;
+	// samples older than the retention are deleted as new ones come
+	for i := 0; i < 4; i++ {
+		sampleAgentMetrics(t, h)
+	}
+	samples, err = h.db.GetAgentMetrics(ctx, "pipe", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Those of the last 3 minutes and the one taken 3 minutes ago
+	if len(samples) != 4 || !samples[0].Time.Equal(start.Add(2*time.Minute)) {
+		t.Fatalf("samples with a 3 minute retention = %+v, want the 4 since %v", samples, start.Add(2*time.Minute))
+	}
+	for _, m := range samples {
+		if m != (models.AgentMetric{Time: m.Time}) {
+			t.Errorf("sample of a quiet agent = %+v, want zero rates", m)
+		}
+	}
+}
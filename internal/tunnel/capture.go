@@ -0,0 +1,473 @@
+package tunnel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/paths"
+)
+
+// Captures are gzipped JSON lines: a header naming the agent, then every
+// message the agent sent, as received
+const captureSuffix = ".jsonl.gz"
+
+var (
+	ErrCaptureDisabled   = errors.New("captures are disabled; set CAPTURE_DIR")
+	ErrCaptureActive     = errors.New("a capture of this agent is already running")
+	ErrAgentNotConnected = errors.New("agent not connected")
+)
+
+// Keys in a hello payload whose values are replaced before capture
+var captureSecretKey = regexp.MustCompile(`(?i)token|secret|password|passwd|credential|auth|key`)
+
+const captureRedacted = "REDACTED"
+
+// CaptureHeader is the first line of a capture
+type CaptureHeader struct {
+	AgentID   string    `json:"agent_id"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type captureHeaderLine struct {
+	Capture CaptureHeader `json:"capture"`
+}
+
+// CaptureInfo describes a capture file, and the running capture writing it
+// if there is one
+type CaptureInfo struct {
+	File     string    `json:"file"`
+	Bytes    int64     `json:"bytes"` // Compressed size on disk
+	Modified time.Time `json:"modified"`
+	Active   bool      `json:"active"`
+	// Set while active
+	AgentID   string     `json:"agent_id,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	MaxBytes  int64      `json:"max_bytes,omitempty"`
+	Written   int64      `json:"written,omitempty"` // Uncompressed bytes captured
+	Messages  int        `json:"messages,omitempty"`
+}
+
+// captureSession tees the messages of one agent's connections to a file
+// until its duration or size runs out
+type captureSession struct {
+	agentID  string
+	path     string
+	started  time.Time
+	until    time.Time
+	maxBytes int64
+	stop     func(reason string)
+
+	mu       sync.Mutex
+	file     *os.File
+	gz       *gzip.Writer
+	written  int64
+	messages int
+	closed   bool
+	timer    *time.Timer
+}
+
+type captureRegistry struct {
+	mu     sync.Mutex
+	active map[string]*captureSession // By agent ID
+}
+
+// record appends one message. It stops the capture once the size bound is
+// reached, dropping messages that arrive before it has; write errors stop it
+// too rather than failing the connection.
+func (s *captureSession) record(raw []byte) {
+	line := redactHello(raw)
+
+	s.mu.Lock()
+	if s.closed || s.written >= s.maxBytes {
+		s.mu.Unlock()
+		return
+	}
+	_, err := s.gz.Write(append(line, '\n'))
+	s.written += int64(len(line)) + 1
+	s.messages++
+	full := s.written >= s.maxBytes
+	s.mu.Unlock()
+
+	switch {
+	case err != nil:
+		go s.stop(fmt.Sprintf("write error: %v", err))
+	case full:
+		go s.stop("size limit reached")
+	}
+}
+
+// close finishes the file, reporting whether this call did so
+func (s *captureSession) close() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false, nil
+	}
+	s.closed = true
+	s.timer.Stop()
+	err := s.gz.Close()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return true, err
+}
+
+func (s *captureSession) info() CaptureInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	started, until := s.started, s.until
+	return CaptureInfo{
+		File:      filepath.Base(s.path),
+		Active:    !s.closed,
+		AgentID:   s.agentID,
+		StartedAt: &started,
+		Until:     &until,
+		MaxBytes:  s.maxBytes,
+		Written:   s.written,
+		Messages:  s.messages,
+	}
+}
+
+// redactHello replaces secret-looking values in a hello message. Other
+// messages are captured verbatim, as are messages that don't parse.
+func redactHello(raw []byte) []byte {
+	var msg Message
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Type != TypeHello {
+		return raw
+	}
+	var payload interface{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return raw
+	}
+	data, err := json.Marshal(redactSecrets(payload))
+	if err != nil {
+		return raw
+	}
+	msg.Payload = data
+	if out, err := json.Marshal(msg); err == nil {
+		return out
+	}
+	return raw
+}
+
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if captureSecretKey.MatchString(k) {
+				v[k] = captureRedacted
+			} else {
+				v[k] = redactSecrets(val)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactSecrets(v[i])
+		}
+	}
+	return v
+}
+
+// StartCapture tees every message from the agent's connections, current and
+// new, to a file under CAPTURE_DIR for up to d or maxBytes of messages
+func (h *Handler) StartCapture(agentID string, d time.Duration, maxBytes int64) (CaptureInfo, error) {
+	if h.cfg.CaptureDir == "" {
+		return CaptureInfo{}, ErrCaptureDisabled
+	}
+	if h.ConnectedAgentIDs()[agentID] == 0 {
+		return CaptureInfo{}, ErrAgentNotConnected
+	}
+
+	h.captures.mu.Lock()
+	defer h.captures.mu.Unlock()
+	if _, ok := h.captures.active[agentID]; ok {
+		return CaptureInfo{}, ErrCaptureActive
+	}
+
+	if err := os.MkdirAll(h.cfg.CaptureDir, 0o700); err != nil {
+		return CaptureInfo{}, fmt.Errorf("create capture directory: %w", err)
+	}
+	now := h.clock.Now()
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(agentID) + "-" + now.UTC().Format("20060102T150405Z") + captureSuffix
+	path := filepath.Join(h.cfg.CaptureDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return CaptureInfo{}, fmt.Errorf("create capture file: %w", err)
+	}
+
+	s := &captureSession{
+		agentID:  agentID,
+		path:     path,
+		started:  now,
+		until:    now.Add(d),
+		maxBytes: maxBytes,
+		file:     file,
+		gz:       gzip.NewWriter(file),
+	}
+	s.stop = func(reason string) { h.stopCapture(s, reason) }
+	header, _ := json.Marshal(captureHeaderLine{Capture: CaptureHeader{AgentID: agentID, StartedAt: now}})
+	if _, err := s.gz.Write(append(header, '\n')); err != nil {
+		file.Close()
+		os.Remove(path)
+		return CaptureInfo{}, fmt.Errorf("write capture header: %w", err)
+	}
+	s.timer = time.AfterFunc(d, func() { s.stop("duration reached") })
+
+	if h.captures.active == nil {
+		h.captures.active = make(map[string]*captureSession)
+	}
+	h.captures.active[agentID] = s
+
+	h.agents.mu.RLock()
+	for a := range h.agents.conns {
+		if a.id == agentID {
+			a.capture.Store(s)
+		}
+	}
+	h.agents.mu.RUnlock()
+
+	log.Printf("[TUNNEL] Capturing messages of %s to %s for up to %v or %d bytes", agentID, path, d, maxBytes)
+	return s.info(), nil
+}
+
+// StopCapture ends the running capture of an agent, reporting whether there
+// was one
+func (h *Handler) StopCapture(agentID string) (CaptureInfo, bool) {
+	h.captures.mu.Lock()
+	s, ok := h.captures.active[agentID]
+	h.captures.mu.Unlock()
+	if !ok {
+		return CaptureInfo{}, false
+	}
+	h.stopCapture(s, "stopped")
+	return s.info(), true
+}
+
+func (h *Handler) stopCapture(s *captureSession, reason string) {
+	h.captures.mu.Lock()
+	if h.captures.active[s.agentID] == s {
+		delete(h.captures.active, s.agentID)
+	}
+	h.captures.mu.Unlock()
+
+	h.agents.mu.RLock()
+	for a := range h.agents.conns {
+		a.capture.CompareAndSwap(s, nil)
+	}
+	h.agents.mu.RUnlock()
+
+	closed, err := s.close()
+	if err != nil {
+		log.Printf("[TUNNEL] Error closing capture %s: %v", s.path, err)
+	}
+	if !closed {
+		return
+	}
+	info := s.info()
+	log.Printf("[TUNNEL] Capture of %s ended (%s): %d messages, %d bytes", s.agentID, reason, info.Messages, info.Written)
+}
+
+// attachCapture makes a new connection of an agent being captured part of
+// the capture
+func (h *Handler) attachCapture(a *agentConn) {
+	h.captures.mu.Lock()
+	defer h.captures.mu.Unlock()
+	if s, ok := h.captures.active[a.id]; ok {
+		a.capture.Store(s)
+	}
+}
+
+// decodeMessage reads the next message, recording it first when the
+// agent is being captured
+func (h *Handler) decodeMessage(decoder *json.Decoder, a *agentConn, msg *Message) error {
+	s := a.capture.Load()
+	if s == nil {
+		return decoder.Decode(msg)
+	}
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	s.record(raw)
+	return json.Unmarshal(raw, msg)
+}
+
+// Captures lists the capture files, newest first
+func (h *Handler) Captures() ([]CaptureInfo, error) {
+	if h.cfg.CaptureDir == "" {
+		return nil, ErrCaptureDisabled
+	}
+	entries, err := os.ReadDir(h.cfg.CaptureDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []CaptureInfo{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list captures: %w", err)
+	}
+
+	active := make(map[string]*captureSession)
+	h.captures.mu.Lock()
+	for _, s := range h.captures.active {
+		active[filepath.Base(s.path)] = s
+	}
+	h.captures.mu.Unlock()
+
+	captures := []CaptureInfo{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), captureSuffix) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		info := CaptureInfo{File: e.Name()}
+		if s, ok := active[e.Name()]; ok {
+			info = s.info()
+		}
+		info.Bytes = fi.Size()
+		info.Modified = fi.ModTime()
+		captures = append(captures, info)
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].Modified.After(captures[j].Modified) })
+	return captures, nil
+}
+
+// CapturePath returns the path of a capture file by name, or false when
+// there is no such capture
+func (h *Handler) CapturePath(name string) (string, bool) {
+	if h.cfg.CaptureDir == "" || name != filepath.Base(name) || !strings.HasSuffix(name, captureSuffix) {
+		return "", false
+	}
+	path := filepath.Join(h.cfg.CaptureDir, name)
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return path, true
+}
+
+// cleanupCapturesJob deletes captures older than CAPTURE_RETENTION_HOURS
+func (h *Handler) cleanupCapturesJob(ctx context.Context) error {
+	captures, err := h.Captures()
+	if err != nil {
+		return err
+	}
+	cutoff := h.clock.Now().Add(-h.cfg.CaptureRetention)
+	removed := 0
+	for _, c := range captures {
+		if c.Active || c.Modified.After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(h.cfg.CaptureDir, c.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete capture %s: %w", c.File, err)
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("[TUNNEL] Deleted %d expired captures", removed)
+	}
+	return nil
+}
+
+// CaptureLineCounts returns how many log lines a capture holds per file, so
+// a runaway file can be noticed before replaying it. Malformed messages are
+// skipped, as replay would.
+func CaptureLineCounts(r io.Reader) (map[string]int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("open capture: %w", err)
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	var header captureHeaderLine
+	if err := decoder.Decode(&header); err != nil || header.Capture.AgentID == "" {
+		return nil, errors.New("not a capture: missing header")
+	}
+
+	counts := make(map[string]int)
+	for {
+		var msg Message
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return counts, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("read capture: %w", err)
+		}
+		if msg.Type != TypeLogData {
+			continue
+		}
+		var logs []struct {
+			Filename string `json:"filename"`
+		}
+		if json.Unmarshal(msg.Payload, &logs) != nil {
+			continue
+		}
+		for _, entry := range logs {
+			counts[paths.Normalize(entry.Filename)]++
+		}
+	}
+}
+
+// replayConn makes a replayed connection look like it came from the
+// captured agent, so its messages land on the same shard
+type replayConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c replayConn) RemoteAddr() net.Addr { return c.remote }
+
+// Replay feeds a capture through HandleConnection as if its agent had sent
+// it again, discarding what the server sends back. It returns once the
+// connection has processed every message; Close then stores what is
+// still batched.
+func (h *Handler) Replay(ctx context.Context, r io.Reader) (CaptureHeader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return CaptureHeader{}, fmt.Errorf("open capture: %w", err)
+	}
+	defer gz.Close()
+	br := bufio.NewReader(gz)
+
+	first, err := br.ReadBytes('\n')
+	if err != nil {
+		return CaptureHeader{}, fmt.Errorf("read capture header: %w", err)
+	}
+	var header captureHeaderLine
+	if err := json.Unmarshal(first, &header); err != nil || header.Capture.AgentID == "" {
+		return CaptureHeader{}, errors.New("not a capture: missing header")
+	}
+
+	// Messages must not race the initial file cache load
+	<-h.fileCacheLoaded
+
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(client, br)
+		client.Close()
+		copyErr <- err
+	}()
+
+	h.HandleConnection(ctx, replayConn{Conn: server, remote: hostAddr{network: "replay", host: header.Capture.AgentID}})
+	if err := <-copyErr; err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return header.Capture, fmt.Errorf("read capture: %w", err)
+	}
+	return header.Capture, nil
+}
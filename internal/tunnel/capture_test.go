@@ -0,0 +1,371 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// writeCapture returns a gzipped capture of the given messages
+func writeCapture(t *testing.T, msgs ...Message) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(captureHeaderLine{Capture: CaptureHeader{AgentID: "web-01", StartedAt: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func logDataMessage(t *testing.T, files ...string) Message {
+	t.Helper()
+	var logs []models.LogEntry
+	for i, f := range files {
+		logs = append(logs, models.LogEntry{Filename: f, Line: "x", LineNum: i + 1})
+	}
+	data, err := json.Marshal(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Message{Type: TypeLogData, Payload: data}
+}
+
+func TestCaptureLineCounts(t *testing.T) {
+	capture := writeCapture(t,
+		Message{Type: TypeHello, Payload: json.RawMessage(`{"capabilities": []}`)},
+		logDataMessage(t, "/var/log/a.log", "/var/log/a.log", "/var/log/b.log"),
+		Message{Type: TypeLogData, Payload: json.RawMessage(`"not a list"`)},
+		logDataMessage(t, "var/log/a.log"),
+	)
+
+	counts, err := CaptureLineCounts(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts["/var/log/a.log"] != 3 || counts["/var/log/b.log"] != 1 {
+		t.Fatalf("counts = %v, want a.log: 3, b.log: 1", counts)
+	}
+
+	if _, err := CaptureLineCounts(bytes.NewReader([]byte("plain text"))); err == nil {
+		t.Fatal("counted lines of something that isn't a capture")
+	}
+}
+
+func TestRedactHello(t *testing.T) {
+	hello := `{"type": "hello", "payload": {"capabilities": ["agent_config"], "token": "s3cret",
+		"upstream": {"Password": "hunter2", "host": "db"}, "api_keys": ["a", "b"]}}`
+	var msg Message
+	if err := json.Unmarshal(redactHello([]byte(hello)), &msg); err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(msg.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"capabilities": []interface{}{"agent_config"},
+		"token":        captureRedacted,
+		"upstream":     map[string]interface{}{"Password": captureRedacted, "host": "db"},
+		"api_keys":     captureRedacted,
+	}
+	if msg.Type != TypeHello || !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted hello = %s %v, want %v", msg.Type, got, want)
+	}
+
+	// Only hellos are rewritten, and only when they parse
+	for _, raw := range []string{
+		`{"type": "log_data", "payload": [{"filename": "/var/log/a.log", "line": "token=s3cret"}]}`,
+		`{"type": "hello", "payload": {"token": }`,
+	} {
+		if got := redactHello([]byte(raw)); string(got) != raw {
+			t.Errorf("%s rewritten to %s", raw, got)
+		}
+	}
+}
+
+// readCapture returns the header and message lines of a capture file
+func readCapture(t *testing.T, path string) (CaptureHeader, []Message) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(gz)
+	var header captureHeaderLine
+	var msgs []Message
+	for scanner.Scan() {
+		if header.Capture.AgentID == "" {
+			if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return header.Capture, msgs
+}
+
+func TestCaptureStopsAtSizeLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	clk := clock.NewFake(now)
+	h := &Handler{
+		cfg:    &config.Config{CaptureDir: dir},
+		clock:  clk,
+		agents: agentRegistry{conns: make(map[*agentConn]struct{})},
+	}
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	agent := newAgentConn(server, now)
+	h.agents.add(agent)
+	defer h.agents.remove(agent)
+
+	if _, err := h.StartCapture("web-02", time.Hour, 1000); !errors.Is(err, ErrAgentNotConnected) {
+		t.Errorf("capture of an unknown agent: %v, want ErrAgentNotConnected", err)
+	}
+	info, err := h.StartCapture(agent.id, time.Hour, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.StartCapture(agent.id, time.Hour, 1000); !errors.Is(err, ErrCaptureActive) {
+		t.Errorf("second capture of the agent: %v, want ErrCaptureActive", err)
+	}
+	if !info.Active || info.Until == nil || !info.Until.Equal(now.Add(time.Hour)) {
+		t.Errorf("capture = %+v, want active for an hour", info)
+	}
+
+	// Each message is about 100 bytes, so the capture ends within a dozen
+	var stream strings.Builder
+	stream.WriteString(`{"type": "hello", "payload": {"token": "s3cret"}}` + "\n")
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&stream, `{"type": "log_data", "payload": [{"filename": "/var/log/a.log", "line": "line %02d", "line_num": %d}]}`+"\n", i, i+1)
+	}
+	decoder := json.NewDecoder(strings.NewReader(stream.String()))
+	for i := 0; i < 51; i++ {
+		var msg Message
+		if err := h.decodeMessage(decoder, agent, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && msg.Type != TypeHello {
+			t.Fatalf("first message decoded as %s", msg.Type)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for agent.capture.Load() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("capture still running past its size limit")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	captures, err := h.Captures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) != 1 || captures[0].Active || captures[0].File != info.File {
+		t.Fatalf("captures = %+v, want the one finished capture", captures)
+	}
+	header, msgs := readCapture(t, filepath.Join(dir, info.File))
+	if header.AgentID != agent.id || !header.StartedAt.Equal(now) {
+		t.Errorf("header = %+v", header)
+	}
+	if len(msgs) < 2 || len(msgs) > 12 {
+		t.Fatalf("captured %d messages, want the size limit to end it", len(msgs))
+	}
+	if strings.Contains(string(msgs[0].Payload), "s3cret") {
+		t.Errorf("hello captured unredacted: %s", msgs[0].Payload)
+	}
+
+	// The agent can be captured again once the last capture ended
+	clk.Advance(time.Minute)
+	if _, err := h.StartCapture(agent.id, time.Hour, 1000); err != nil {
+		t.Errorf("capture after the last one ended: %v", err)
+	}
+	h.StopCapture(agent.id)
+}
+
+func TestCaptureFiles(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	h := &Handler{cfg: &config.Config{CaptureDir: dir, CaptureRetention: 24 * time.Hour}, clock: clock.NewFake(now)}
+
+	for name, age := range map[string]time.Duration{
+		"old" + captureSuffix:   48 * time.Hour,
+		"fresh" + captureSuffix: time.Hour,
+		"notes.txt":             48 * time.Hour,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := h.CapturePath("fresh" + captureSuffix); !ok {
+		t.Error("capture not found by name")
+	}
+	for _, name := range []string{"notes.txt", "../fresh" + captureSuffix, "missing" + captureSuffix, ""} {
+		if path, ok := h.CapturePath(name); ok {
+			t.Errorf("CapturePath(%q) = %s", name, path)
+		}
+	}
+
+	if err := h.cleanupCapturesJob(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if want := []string{"fresh" + captureSuffix, "notes.txt"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("after cleanup: %v, want %v", left, want)
+	}
+
+	disabled := &Handler{cfg: &config.Config{}}
+	if _, err := disabled.Captures(); !errors.Is(err, ErrCaptureDisabled) {
+		t.Errorf("captures without a directory: %v, want ErrCaptureDisabled", err)
+	}
+	if _, err := disabled.StartCapture("web-01", time.Hour, 1000); !errors.Is(err, ErrCaptureDisabled) {
+		t.Errorf("capture without a directory: %v, want ErrCaptureDisabled", err)
+	}
+}
+
+// databaseContents renders the stored files and log lines, leaving out
+// what differs between two ingests of the same messages
+func databaseContents(t *testing.T) []string {
+	t.Helper()
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, os.Getenv("TEST_DATABASE_URL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	var rows []string
+	for _, query := range []string{
+		`SELECT format('file %s %s %s %s %s %s %s', path, parent_path, is_directory, size, mod_time, generation, last_seen)
+		 FROM files ORDER BY path`,
+		`SELECT format('log %s %s %s %s %s %s', file_path, line_number, generation, timestamp, level, line)
+		 FROM logs ORDER BY file_path, generation, line_number`,
+	} {
+		r, err := conn.Query(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pgx.CollectRows(r, pgx.RowTo[string])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, got...)
+	}
+	return rows
+}
+
+func TestReplayedCaptureGivesIdenticalDatabase(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	h := newTestHandler(t, now, func(c *config.Config) { c.CaptureDir = dir }, "files")
+
+	agent, done := connectAgent(t, h)
+	send(t, agent, TypeHello, map[string]interface{}{"capabilities": []string{}, "token": "s3cret"})
+	deadline := time.Now().Add(time.Second)
+	for h.ConnectedAgentIDs()["pipe"] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("agent not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	info, err := h.StartCapture("pipe", time.Hour, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake agent session: a file list, then lines of two files
+	send(t, agent, TypeLogList, []models.FileNode{
+		{Path: "/var/log", ParentPath: "/var", Name: "log", IsDirectory: true, ModTime: now},
+		{Path: "/var/log/app.log", ParentPath: "/var/log", Name: "app.log", Size: 300, ModTime: now},
+		{Path: "/var/log/db.log", ParentPath: "/var/log", Name: "db.log", Size: 200, ModTime: now},
+	})
+	for batch := 0; batch < 3; batch++ {
+		var logs []models.LogEntry
+		for i := 1; i <= 10; i++ {
+			n := batch*10 + i
+			logs = append(logs,
+				models.LogEntry{Filename: "/var/log/app.log", Line: fmt.Sprintf("request %d served", n), LineNum: n, Timestamp: now.Add(time.Duration(n) * time.Second), Level: "INFO"},
+				models.LogEntry{Filename: "/var/log/db.log", Line: fmt.Sprintf("query %d slow", n), LineNum: n, Timestamp: now.Add(time.Duration(n) * time.Second), Level: "WARN"})
+		}
+		send(t, agent, TypeLogData, logs)
+	}
+	agent.Close()
+	<-done
+	h.StopCapture("pipe")
+	h.Close()
+
+	original := databaseContents(t)
+	if len(original) != 3+60 {
+		t.Fatalf("session stored %d rows, want 63:\n%s", len(original), strings.Join(original, "\n"))
+	}
+
+	// Replay into an emptied database
+	replayer := newTestHandler(t, now, nil, "files")
+	file, err := os.Open(filepath.Join(dir, info.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, err := replayer.Replay(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayer.Close()
+	if header.AgentID != "pipe" {
+		t.Errorf("replayed capture of %q, want pipe", header.AgentID)
+	}
+
+	if replayed := databaseContents(t); !reflect.DeepEqual(replayed, original) {
+		t.Errorf("replayed database differs:\n%s\nwant:\n%s", strings.Join(replayed, "\n"), strings.Join(original, "\n"))
+	}
+}
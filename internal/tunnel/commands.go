@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// commandWriteTimeout bounds how long a command write may block on a slow agent
+const commandWriteTimeout = 5 * time.Second
+
+// agentConn is the write side of an agent connection, used to push commands
+type agentConn struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	encoder *json.Encoder
+	// id identifies the agent for database sharding: the ID it registered
+	// with, or else its remote host. A registration changes it under the
+	// registry lock before any other message, see register.go.
+	id string
+	// host is the remote host the agent connected from
+	host      string
+	connected time.Time
+	// Set once the agent registered; guarded by the registry lock
+	registration *models.Agent
+	// Unix nanoseconds of the last message
+	lastSeen atomic.Int64
+	// Data messages processed so far, whose rows carry the agent's ID; only
+	// the connection's goroutine uses it
+	dataMessages int
+	// Set once the agent's hello offers agent_config
+	configurable atomic.Bool
+	// Set while the agent's messages are being captured
+	capture atomic.Pointer[captureSession]
+}
+
+func newAgentConn(conn net.Conn, now time.Time) *agentConn {
+	id := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(id); err == nil {
+		id = host
+	}
+	return &agentConn{conn: conn, encoder: json.NewEncoder(conn), id: id, host: id, connected: now}
+}
+
+func (a *agentConn) send(msg Message) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.conn.SetWriteDeadline(time.Now().Add(commandWriteTimeout)); err != nil {
+		return err
+	}
+	return a.encoder.Encode(msg)
+}
+
+type agentRegistry struct {
+	mu    sync.RWMutex
+	conns map[*agentConn]struct{}
+}
+
+func (r *agentRegistry) add(a *agentConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[a] = struct{}{}
+	activeConnections.Set(float64(len(r.conns)))
+}
+
+func (r *agentRegistry) remove(a *agentConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, a)
+	activeConnections.Set(float64(len(r.conns)))
+}
+
+// ScrapeCommand asks agents to (re)scrape a file
+type ScrapeCommand struct {
+	Path            string `json:"path"`
+	ForceDecompress bool   `json:"force_decompress,omitempty"`
+	MaxSize         int64  `json:"max_size,omitempty"`
+	// Lines up to this one are already stored; agents resume after it
+	AfterLine int `json:"after_line,omitempty"`
+}
+
+// SendCommand pushes a command to every connected agent and returns how many
+// accepted it. Agents that don't own the referenced file ignore the command.
+func (h *Handler) SendCommand(msgType MessageType, payload interface{}) (int, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("marshal command: %w", err)
+	}
+	msg := Message{Type: msgType, Payload: data}
+
+	h.agents.mu.RLock()
+	conns := make([]*agentConn, 0, len(h.agents.conns))
+	for a := range h.agents.conns {
+		conns = append(conns, a)
+	}
+	h.agents.mu.RUnlock()
+
+	sent := 0
+	for _, a := range conns {
+		if err := a.send(msg); err != nil {
+			log.Printf("[TUNNEL] Error sending %s command to %s: %v", msgType, a.conn.RemoteAddr(), err)
+			continue
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
+// ConnectedAgents returns the number of open agent connections
+func (h *Handler) ConnectedAgents() int {
+	h.agents.mu.RLock()
+	defer h.agents.mu.RUnlock()
+	return len(h.agents.conns)
+}
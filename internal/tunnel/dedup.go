@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/db"
+)
+
+// batchIDsSetting is the key under which recent batch ids survive restarts
+const batchIDsSetting = "network_batch_ids"
+
+// batchIDsPersistInterval is how often recent batch ids are saved. A batch
+// retried across a restart within this window may be stored twice.
+const batchIDsPersistInterval = 30 * time.Second
+
+// MetricsAck confirms a metrics batch, so agents can stop retrying it
+type MetricsAck struct {
+	BatchID string `json:"batch_id"`
+	// Set when the batch had already been received and was not stored again
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// contentBatchID identifies a batch sent without an id by its packets. A
+// retried batch carries the same packets with the same timestamps, while
+// distinct batches practically never do.
+func contentBatchID(packets []byte) string {
+	sum := sha256.Sum256(packets)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// batchDedup remembers the most recent committed batch ids of each agent,
+// and the batches received but still waiting in the network batch
+type batchDedup struct {
+	mu      sync.Mutex
+	size    int // Ids kept per agent; 0 disables deduplication
+	agents  map[string]*batchLRU
+	pending map[batchKey]struct{}
+	dirty   bool
+}
+
+type batchKey struct{ agentID, batchID string }
+
+// batchState is what claim found out about a batch
+type batchState int
+
+const (
+	batchNew batchState = iota
+	// Received before and waiting to be stored; acked once it is
+	batchPending
+	// Stored before
+	batchCommitted
+)
+
+// pendingBatch is a received batch whose packets wait in the network batch.
+// It is remembered and acked only once the flush holding it commits, so a
+// batch lost before then is accepted again when the agent retries it.
+type pendingBatch struct {
+	agent   *agentConn
+	agentID string
+	batchID string // Dedup key
+	ackID   string // The agent's batch_id, empty when it sent none
+}
+
+type batchLRU struct {
+	order *list.List // Most recent first
+	ids   map[string]*list.Element
+}
+
+func newBatchDedup(size int) *batchDedup {
+	return &batchDedup{size: size, agents: make(map[string]*batchLRU), pending: make(map[batchKey]struct{})}
+}
+
+func (d *batchDedup) lru(agentID string) *batchLRU {
+	l, ok := d.agents[agentID]
+	if !ok {
+		l = &batchLRU{order: list.New(), ids: make(map[string]*list.Element)}
+		d.agents[agentID] = l
+	}
+	return l
+}
+
+// claim reports whether batchID of agentID was stored or is waiting to be,
+// and marks a new one as waiting
+func (d *batchDedup) claim(agentID, batchID string) batchState {
+	if d.size <= 0 {
+		return batchNew
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.lru(agentID).ids[batchID]; ok {
+		d.agents[agentID].order.MoveToFront(e)
+		return batchCommitted
+	}
+	key := batchKey{agentID, batchID}
+	if _, ok := d.pending[key]; ok {
+		return batchPending
+	}
+	d.pending[key] = struct{}{}
+	return batchNew
+}
+
+// commit records a claimed batch as stored
+func (d *batchDedup) commit(agentID, batchID string) {
+	if d.size <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.pending, batchKey{agentID, batchID})
+	l := d.lru(agentID)
+	if _, ok := l.ids[batchID]; ok {
+		return
+	}
+	l.ids[batchID] = l.order.PushFront(batchID)
+	if l.order.Len() > d.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.ids, oldest.Value.(string))
+	}
+	d.dirty = true
+}
+
+// release drops a claimed batch that wasn't stored, so a retry of it is
+// accepted again
+func (d *batchDedup) release(agentID, batchID string) {
+	if d.size <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, batchKey{agentID, batchID})
+}
+
+// snapshot returns each agent's ids, most recent first, and whether they
+// changed since the last snapshot
+func (d *batchDedup) snapshot() (map[string][]string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make(map[string][]string, len(d.agents))
+	for agentID, l := range d.agents {
+		recent := make([]string, 0, l.order.Len())
+		for e := l.order.Front(); e != nil; e = e.Next() {
+			recent = append(recent, e.Value.(string))
+		}
+		ids[agentID] = recent
+	}
+
+	dirty := d.dirty
+	d.dirty = false
+	return ids, dirty
+}
+
+// restore adds previously saved ids behind any received since startup
+func (d *batchDedup) restore(saved map[string][]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for agentID, ids := range saved {
+		l := d.lru(agentID)
+		for _, id := range ids {
+			if l.order.Len() >= d.size {
+				break
+			}
+			if _, ok := l.ids[id]; !ok {
+				l.ids[id] = l.order.PushBack(id)
+			}
+		}
+	}
+}
+
+// loadBatchIDs restores the batch ids saved before the last shutdown
+func (h *Handler) loadBatchIDs() {
+	if h.dedup.size <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, 30*time.Second)
+	defer cancel()
+
+	var saved map[string][]string
+	err := h.db.GetSetting(ctx, batchIDsSetting, &saved)
+	if errors.Is(err, db.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("[TUNNEL] Error loading recent batch ids: %v", err)
+		return
+	}
+
+	h.dedup.restore(saved)
+	log.Printf("[TUNNEL] Restored recent batch ids of %d agents", len(saved))
+}
+
+// saveBatchIDs stores the recent batch ids if they changed
+func (h *Handler) saveBatchIDs(ctx context.Context) error {
+	ids, dirty := h.dedup.snapshot()
+	if !dirty {
+		return nil
+	}
+	if err := h.db.SetSetting(ctx, batchIDsSetting, ids); err != nil {
+		h.dedup.mu.Lock()
+		h.dedup.dirty = true
+		h.dedup.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// periodicBatchIDSave keeps the saved batch ids close to the in-memory ones
+func (h *Handler) periodicBatchIDSave() {
+	if h.dedup.size <= 0 {
+		return
+	}
+
+	ticker := h.clock.NewTicker(batchIDsPersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.shutdownCh:
+			return
+		case <-ticker.C():
+			if err := h.saveBatchIDs(h.ctx); err != nil {
+				log.Printf("[TUNNEL] Error saving recent batch ids: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatchDedupRetryAfterTimeout(t *testing.T) {
+	d := newBatchDedup(10)
+
+	if got := d.claim("a", "b1"); got != batchNew {
+		t.Fatalf("first claim = %v, want new", got)
+	}
+	// The agent timed out waiting for the ack and retries before the flush
+	if got := d.claim("a", "b1"); got != batchPending {
+		t.Fatalf("retry before commit = %v, want pending", got)
+	}
+
+	d.commit("a", "b1")
+	if got := d.claim("a", "b1"); got != batchCommitted {
+		t.Fatalf("retry after commit = %v, want committed", got)
+	}
+	// Other agents' batches with the same id are unrelated
+	if got := d.claim("b", "b1"); got != batchNew {
+		t.Fatalf("other agent's claim = %v, want new", got)
+	}
+}
+
+func TestBatchDedupReleasedBatchIsAcceptedAgain(t *testing.T) {
+	d := newBatchDedup(10)
+
+	d.claim("a", "b1")
+	// The flush holding the batch failed for good
+	d.release("a", "b1")
+	if got := d.claim("a", "b1"); got != batchNew {
+		t.Fatalf("retry of a lost batch = %v, want new", got)
+	}
+}
+
+func TestBatchDedupEvictsOldest(t *testing.T) {
+	d := newBatchDedup(2)
+
+	for _, id := range []string{"b1", "b2", "b3"} {
+		d.claim("a", id)
+		d.commit("a", id)
+	}
+	if got := d.claim("a", "b1"); got != batchNew {
+		t.Fatalf("evicted batch = %v, want new", got)
+	}
+	if got := d.claim("a", "b3"); got != batchCommitted {
+		t.Fatalf("recent batch = %v, want committed", got)
+	}
+}
+
+func TestBatchDedupRestartReplay(t *testing.T) {
+	before := newBatchDedup(10)
+	before.claim("a", "stored")
+	before.commit("a", "stored")
+	// Received but not yet stored when the server stopped
+	before.claim("a", "waiting")
+
+	saved, dirty := before.snapshot()
+	if !dirty {
+		t.Fatal("snapshot after a commit is not dirty")
+	}
+	if _, dirty := before.snapshot(); dirty {
+		t.Fatal("second snapshot is still dirty")
+	}
+
+	after := newBatchDedup(10)
+	after.restore(saved)
+	if got := after.claim("a", "stored"); got != batchCommitted {
+		t.Fatalf("replayed stored batch = %v, want committed", got)
+	}
+	if got := after.claim("a", "waiting"); got != batchNew {
+		t.Fatalf("replayed unstored batch = %v, want new", got)
+	}
+}
+
+func TestBatchDedupDisabled(t *testing.T) {
+	d := newBatchDedup(0)
+
+	d.claim("a", "b1")
+	d.commit("a", "b1")
+	if got := d.claim("a", "b1"); got != batchNew {
+		t.Fatalf("claim with deduplication disabled = %v, want new", got)
+	}
+}
+
+func TestConfirmBatchesAcksAfterCommit(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	h := &Handler{dedup: newBatchDedup(10)}
+	agent := newAgentConn(server, time.Now())
+	h.dedup.claim(agent.id, "b1")
+
+	acks := make(chan Message, 1)
+	go func() {
+		var msg Message
+		if err := json.NewDecoder(client).Decode(&msg); err == nil {
+			acks <- msg
+		}
+	}()
+
+	h.confirmBatches([]pendingBatch{{agent: agent, agentID: agent.id, batchID: "b1", ackID: "b1"}})
+
+	select {
+	case msg := <-acks:
+		var ack MetricsAck
+		if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != TypeMetricsAck || ack.BatchID != "b1" || ack.Duplicate {
+			t.Fatalf("ack = %s %+v, want metrics_ack for b1", msg.Type, ack)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ack sent")
+	}
+	if got := h.dedup.claim(agent.id, "b1"); got != batchCommitted {
+		t.Fatalf("confirmed batch = %v, want committed", got)
+	}
+}
@@ -0,0 +1,114 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"diagnostic-client/pkg/models"
+)
+
+// Writes of agent data never run under a connection's or request's context:
+// once data is received it is accepted, and a dropped agent or cancelled
+// caller mustn't abort its insert. Reads, such as the API's queries, keep
+// their caller's context and stop when it is cancelled.
+//
+// Writes run under one of three contexts:
+//   - Writes during operation, periodic or of data from a connection, are
+//     detached from their caller. They are cancelled once Close begins the
+//     final drain, and each is bounded by INGEST_WRITE_TIMEOUT_SECONDS.
+//   - The network flush job runs under the job scheduler's context, which
+//     is cancelled on shutdown before Close, with the same bound.
+//   - The final drain in Close gets its own context, bounded by
+//     SHUTDOWN_DRAIN_SECONDS.
+//
+// A write cut short by cancellation returns its data to a handler-owned
+// queue, which the final drain stores. A write that times out has failed.
+
+// errFlushDeferred reports a write cancelled with its data queued for the
+// final drain, so the data is still accepted
+var errFlushDeferred = errors.New("write cancelled; queued for shutdown drain")
+
+// errWriteTimeout is the cause of a detached write exceeding
+// INGEST_WRITE_TIMEOUT_SECONDS
+var errWriteTimeout = errors.New("ingest write timed out")
+
+// detach returns a context for a write carrying the values of ctx, such as
+// its trace, that is cancelled with the handler rather than with ctx
+func (h *Handler) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(h.ctx, cancel)
+
+	ctx, cancelTimeout := h.writeTimeout(ctx)
+	return ctx, func() {
+		cancelTimeout()
+		stop()
+		cancel()
+	}
+}
+
+// writeTimeout bounds a write by INGEST_WRITE_TIMEOUT_SECONDS
+func (h *Handler) writeTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.cfg.IngestWriteTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, h.cfg.IngestWriteTimeout, errWriteTimeout)
+}
+
+// cancelled reports whether err is the handler's lifetime or the caller's
+// context ending rather than a failed write. Exceeding the write timeout is
+// a failed write.
+func cancelled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil && !errors.Is(context.Cause(ctx), errWriteTimeout) &&
+		(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// requeueNetworkBatch puts a batch whose write was cancelled back in front
+// of the pending one
+func (h *Handler) requeueNetworkBatch(batch []models.NetworkPacket, samples []latencySample, pending []pendingBatch) {
+	h.batchMutex.Lock()
+	defer h.batchMutex.Unlock()
+	h.networkBatch = append(batch, h.networkBatch...)
+	h.batchSamples = append(samples, h.batchSamples...)
+	h.batchPending = append(pending, h.batchPending...)
+}
+
+// deferLogs queues processed log entries whose write was cancelled
+func (h *Handler) deferLogs(logs []models.LogEntry) {
+	h.deferredMu.Lock()
+	defer h.deferredMu.Unlock()
+	h.deferredLogs = append(h.deferredLogs, logs...)
+}
+
+// drain stores everything still held once background work has stopped
+func (h *Handler) drain(ctx context.Context) {
+	if err := h.flushNetworkBatch(ctx); err != nil {
+		h.batchMutex.Lock()
+		lost := len(h.networkBatch)
+		h.batchMutex.Unlock()
+		log.Printf("[TUNNEL] Error draining network batch, %d packets lost: %v", lost, err)
+	}
+
+	h.flushMultiline(ctx, true)
+
+	h.deferredMu.Lock()
+	logs := h.deferredLogs
+	h.deferredLogs = nil
+	h.deferredMu.Unlock()
+	if len(logs) > 0 {
+		err := h.db.SaveLogs(ctx, logs)
+		stored, unstored := h.splitStoredLogs(logs, err)
+		h.watermarks.advance(stored)
+		if err != nil {
+			log.Printf("[TUNNEL] Error draining log entries, %d lost: %v", len(unstored), err)
+		}
+	}
+
+	if err := h.saveWatermarks(ctx); err != nil {
+		log.Printf("[TUNNEL] Error saving ingest watermarks: %v", err)
+	}
+
+	if err := h.saveBatchIDs(ctx); err != nil {
+		log.Printf("[TUNNEL] Error saving recent batch ids: %v", err)
+	}
+}
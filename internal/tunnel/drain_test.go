@@ -0,0 +1,279 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+type traceKey struct{}
+
+func TestDetachOutlivesCaller(t *testing.T) {
+	h := &Handler{cfg: &config.Config{}}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	defer h.cancel()
+
+	caller, cancelCaller := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace"))
+	ctx, cancel := h.detach(caller)
+	defer cancel()
+
+	cancelCaller()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("detached write cancelled with its caller: %v", err)
+	}
+	if got := ctx.Value(traceKey{}); got != "trace" {
+		t.Errorf("detached value = %v, want the caller's", got)
+	}
+
+	h.cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("detached write not cancelled with the handler")
+	}
+	if !cancelled(ctx, fmt.Errorf("insert: %w", context.Canceled)) {
+		t.Error("handler cancellation not reported as cancelled")
+	}
+}
+
+func TestDetachWriteTimeoutIsAFailure(t *testing.T) {
+	h := &Handler{cfg: &config.Config{IngestWriteTimeout: 10 * time.Millisecond}}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	defer h.cancel()
+
+	ctx, cancel := h.detach(context.Background())
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("write timeout didn't expire")
+	}
+	if !errors.Is(context.Cause(ctx), errWriteTimeout) {
+		t.Errorf("cause = %v, want the write timeout", context.Cause(ctx))
+	}
+	if cancelled(ctx, context.DeadlineExceeded) {
+		t.Error("timed out write reported as cancelled, so it would be queued rather than failed")
+	}
+}
+
+func TestCancelled(t *testing.T) {
+	live := context.Background()
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"cancelled context and error", done, fmt.Errorf("save: %w", context.Canceled), true},
+		{"cancelled context, other error", done, errors.New("unique violation"), false},
+		{"live context, cancelled error", live, context.Canceled, false},
+		{"live context, deadline error", live, context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cancelled(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("cancelled = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequeueNetworkBatchKeepsOrder(t *testing.T) {
+	h := &Handler{networkBatch: []models.NetworkPacket{{SrcPort: 3}}}
+
+	h.requeueNetworkBatch([]models.NetworkPacket{{SrcPort: 1}, {SrcPort: 2}}, nil, []pendingBatch{{batchID: "b1"}})
+
+	if len(h.networkBatch) != 3 {
+		t.Fatalf("batch holds %d packets, want 3", len(h.networkBatch))
+	}
+	for i, p := range h.networkBatch {
+		if p.SrcPort != i+1 {
+			t.Errorf("packet %d has port %d, want %d", i, p.SrcPort, i+1)
+		}
+	}
+	if len(h.batchPending) != 1 || h.batchPending[0].batchID != "b1" {
+		t.Errorf("pending acks = %+v, want b1", h.batchPending)
+	}
+}
+
+// TestCancelledFlushIsStoredByDrain cuts a network flush short as Close does
+// and checks the packets are kept and then stored by the final drain
+func TestCancelledFlushIsStoredByDrain(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) { cfg.BatchSize = 1000 }, "network_packets")
+
+	packets := []models.NetworkPacket{
+		{Timestamp: now.Add(-2 * time.Second), Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", DstPort: 443, Length: 60},
+		{Timestamp: now.Add(-time.Second), Protocol: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.3", DstPort: 53, Length: 80},
+	}
+	h.batchMutex.Lock()
+	h.networkBatch = append(h.networkBatch, packets...)
+	h.batchMutex.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.flushNetworkBatch(ctx); !errors.Is(err, errFlushDeferred) {
+		t.Fatalf("cancelled flush = %v, want deferred", err)
+	}
+	h.batchMutex.Lock()
+	held := len(h.networkBatch)
+	h.batchMutex.Unlock()
+	if held != len(packets) {
+		t.Fatalf("%d packets held after the cancelled flush, want %d", held, len(packets))
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+
+	stored, err := h.db.GetNetworkPackets(context.Background(), now.Add(-time.Minute), now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(packets) {
+		t.Errorf("stored %d packets after the drain, want %d", len(stored), len(packets))
+	}
+}
+
+// TestLogsStoredAfterAgentDisconnects processes lines under a connection
+// context that is already cancelled, as when the agent drops mid-message
+func TestLogsStoredAfterAgentDisconnects(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files", "logs")
+	const path = "/var/log/dropped.log"
+	if err := h.db.SaveFiles(context.Background(), []models.FileNode{
+		{Path: path, ParentPath: "/var/log", Name: "dropped.log", Size: 100, ModTime: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	logs := []models.LogEntry{
+		{Filename: path, Line: "first", LineNum: 1, Timestamp: now.Add(-2 * time.Second)},
+		{Filename: path, Line: "second", LineNum: 2, Timestamp: now.Add(-time.Second)},
+	}
+	if err := h.processMessage(ctx, agent, Message{Type: TypeLogData, Payload: mustMarshal(t, logs)}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := h.db.GetLogs(context.Background(), path, "", 100, db.AllGenerations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != len(logs) {
+		t.Errorf("stored %d lines from the dropped connection, want %d", len(page.Entries), len(logs))
+	}
+}
+
+// TestDeferredLogsStoredByDrain cancels the handler's lifetime before a log
+// write, as Close does, and checks the drain stores the lines it queued
+func TestDeferredLogsStoredByDrain(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files", "logs")
+	const path = "/var/log/shutdown.log"
+	if err := h.db.SaveFiles(context.Background(), []models.FileNode{
+		{Path: path, ParentPath: "/var/log", Name: "shutdown.log", Size: 100, ModTime: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := h.detach(context.Background())
+	defer cancel()
+	h.cancel()
+
+	logs := []models.LogEntry{{Filename: path, Line: "last words", LineNum: 1, Timestamp: now.Add(-time.Second)}}
+	if err := h.storeLogs(ctx, logs); !errors.Is(err, errFlushDeferred) {
+		t.Fatalf("cancelled write = %v, want deferred", err)
+	}
+
+	h.Close()
+	page, err := h.db.GetLogs(context.Background(), path, "", 100, db.AllGenerations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 {
+		t.Errorf("stored %d deferred lines, want 1", len(page.Entries))
+	}
+}
+
+// TestFullBatchStoredAfterAgentDisconnects fills the network batch from a
+// connection whose context is already cancelled, so the flush it triggers
+// runs detached from it
+func TestFullBatchStoredAfterAgentDisconnects(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) { cfg.BatchSize = 2 }, "network_packets")
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	packets := []models.NetworkPacket{
+		{Timestamp: now.Add(-2 * time.Second), Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", DstPort: 443, Length: 60},
+		{Timestamp: now.Add(-time.Second), Protocol: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.3", DstPort: 53, Length: 80},
+	}
+	payload := mustMarshal(t, map[string]interface{}{"packets": packets})
+	if err := h.processMessage(ctx, agent, Message{Type: TypeMetrics, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := h.db.GetNetworkPackets(context.Background(), now.Add(-time.Minute), now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(packets) {
+		t.Errorf("stored %d packets from the dropped connection, want %d", len(stored), len(packets))
+	}
+}
+
+// TestDetachedWriteTimeoutFailsTheWrite lets a write outlast
+// INGEST_WRITE_TIMEOUT_SECONDS: it fails rather than waiting for the drain
+func TestDetachedWriteTimeoutFailsTheWrite(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) { cfg.IngestWriteTimeout = time.Nanosecond }, "files", "logs")
+
+	ctx, cancel := h.detach(context.Background())
+	defer cancel()
+	<-ctx.Done()
+
+	logs := []models.LogEntry{{Filename: "/var/log/slow.log", Line: "late", LineNum: 1, Timestamp: now}}
+	err := h.storeLogs(ctx, logs)
+	if err == nil || errors.Is(err, errFlushDeferred) {
+		t.Fatalf("timed out write = %v, want a failure", err)
+	}
+	h.deferredMu.Lock()
+	deferred := len(h.deferredLogs)
+	h.deferredMu.Unlock()
+	if deferred != 0 {
+		t.Errorf("%d timed out lines queued for the drain, want 0", deferred)
+	}
+}
@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"sync"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// fairScheduler shares the live packet stream among agents, so a loud agent
+// can't crowd quiet ones out of it. Packets are queued per agent and taken
+// in turns, weight packets per agent per turn. Under sampling, whatever an
+// agent's share leaves over waits for a later batch, up to a bounded number
+// of packets per agent; the oldest are dropped past it.
+type fairScheduler struct {
+	mu      sync.Mutex
+	weights map[string]int // nil gives every agent weight 1
+	limit   int
+	queues  map[string][]models.NetworkPacket
+	// Agents with queued packets, in serving order. It rotates after every
+	// batch, so no agent is always served first.
+	order   []string
+	queued  int
+	dropped int64
+}
+
+// newFairScheduler returns nil when STREAM_FAIRNESS is off
+func newFairScheduler(cfg *config.Config) *fairScheduler {
+	if cfg.StreamFairness == config.StreamFairnessOff {
+		return nil
+	}
+	f := &fairScheduler{
+		limit:  cfg.StreamAgentBuffer,
+		queues: make(map[string][]models.NetworkPacket),
+	}
+	if cfg.StreamFairness == config.StreamFairnessWeighted {
+		f.weights = cfg.StreamAgentWeights
+	}
+	return f
+}
+
+func (f *fairScheduler) weight(agent string) int {
+	if w, ok := f.weights[agent]; ok {
+		return w
+	}
+	return 1
+}
+
+// enqueue appends packets to their agents' queues
+func (f *fairScheduler) enqueue(batch []models.NetworkPacket) {
+	for _, p := range batch {
+		q, ok := f.queues[p.AgentID]
+		if !ok {
+			f.order = append(f.order, p.AgentID)
+		}
+		if len(q) >= f.limit {
+			q = q[1:]
+			f.dropped++
+			f.queued--
+		}
+		f.queues[p.AgentID] = append(q, p)
+		f.queued++
+	}
+}
+
+// schedule queues batch and returns up to budget queued packets, interleaved
+// by agent. A negative budget takes everything queued.
+func (f *fairScheduler) schedule(batch []models.NetworkPacket, budget int) []models.NetworkPacket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.enqueue(batch)
+	if budget < 0 || budget > f.queued {
+		budget = f.queued
+	}
+
+	out := make([]models.NetworkPacket, 0, budget)
+	for len(out) < budget {
+		for _, agent := range f.order {
+			if len(out) == budget {
+				break
+			}
+			q := f.queues[agent]
+			n := min(f.weight(agent), len(q), budget-len(out))
+			out = append(out, q[:n]...)
+			f.queues[agent] = q[n:]
+		}
+	}
+	f.queued -= len(out)
+	f.rotate()
+	return out
+}
+
+// rotate moves the first agent to the end of the serving order and forgets
+// agents with nothing queued
+func (f *fairScheduler) rotate() {
+	if len(f.order) == 0 {
+		return
+	}
+	rotated := append(f.order[1:len(f.order):len(f.order)], f.order[0])
+
+	f.order = f.order[:0]
+	for _, agent := range rotated {
+		if len(f.queues[agent]) == 0 {
+			delete(f.queues, agent)
+			continue
+		}
+		f.order = append(f.order, agent)
+	}
+}
+
+// stats returns the number of packets waiting for a later batch, and of
+// packets dropped so far
+func (f *fairScheduler) stats() (held int, dropped int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queued, f.dropped
+}
+
+// shed drops up to n waiting packets, oldest first from the longest queues,
+// and returns how many it dropped
+func (f *fairScheduler) shed(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dropped := 0
+	for dropped < n && f.queued > 0 {
+		longest := ""
+		for agent, q := range f.queues {
+			if longest == "" || len(q) > len(f.queues[longest]) {
+				longest = agent
+			}
+		}
+		q := f.queues[longest]
+		k := min(len(q), n-dropped, max(len(q)/2, 1))
+		f.queues[longest] = q[k:]
+		f.queued -= k
+		f.dropped += int64(k)
+		dropped += k
+	}
+	return dropped
+}
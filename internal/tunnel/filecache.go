@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"diagnostic-client/pkg/models"
+)
+
+// fileCacheShards splits the file cache so diffing a file list, which
+// scans every entry, only blocks lookups in the shard being scanned
+const fileCacheShards = 64
+
+// FileCache maintains an in-memory cache of the current file state, sharded
+// by path. Each shard is consistent on its own; a reader running alongside
+// a writer may see a change applied to some shards and not yet to others.
+type FileCache struct {
+	shards [fileCacheShards]fileCacheShard
+	count  atomic.Int64
+}
+
+type fileCacheShard struct {
+	mu    sync.RWMutex
+	files map[string]models.FileNode
+}
+
+func newFileCache() *FileCache {
+	c := &FileCache{}
+	for i := range c.shards {
+		c.shards[i].files = make(map[string]models.FileNode)
+	}
+	return c
+}
+
+// shardIndex picks the shard of path by its FNV-1a hash
+func shardIndex(path string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(path); i++ {
+		h ^= uint32(path[i])
+		h *= 16777619
+	}
+	return int(h % fileCacheShards)
+}
+
+func (c *FileCache) shard(path string) *fileCacheShard {
+	return &c.shards[shardIndex(path)]
+}
+
+// get returns the cached state of one file
+func (c *FileCache) get(path string) (models.FileNode, bool) {
+	s := c.shard(path)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[path]
+	return file, ok
+}
+
+func (c *FileCache) len() int {
+	return int(c.count.Load())
+}
+
+// each calls fn for every cached file, holding one shard's read lock at a
+// time. fn must not modify the cache.
+func (c *FileCache) each(fn func(file models.FileNode)) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for _, file := range s.files {
+			fn(file)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// eachUnder calls fn for prefix and every cached file below it, in no
+// particular order, until fn returns false. Prefixes match whole path
+// components, so /var/log doesn't match /var/logs.
+func (c *FileCache) eachUnder(prefix string, fn func(file models.FileNode) bool) {
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		for path, file := range s.files {
+			if path != prefix && !strings.HasPrefix(path, dir) {
+				continue
+			}
+			if !fn(file) {
+				s.mu.RUnlock()
+				return
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// replace swaps the whole cache for files
+func (c *FileCache) replace(files []models.FileNode) {
+	var fresh [fileCacheShards]map[string]models.FileNode
+	for i := range fresh {
+		fresh[i] = make(map[string]models.FileNode, len(files)/fileCacheShards)
+	}
+	for _, file := range files {
+		fresh[shardIndex(file.Path)][file.Path] = file
+	}
+
+	var count int64
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.files = fresh[i]
+		count += int64(len(s.files))
+		s.mu.Unlock()
+	}
+	c.count.Store(count)
+	fileCacheSize.Set(float64(count))
+}
+
+// apply removes deleted paths and stores the given files
+func (c *FileCache) apply(deleted []string, files ...[]models.FileNode) {
+	var delta int64
+	for _, path := range deleted {
+		s := c.shard(path)
+		s.mu.Lock()
+		if _, ok := s.files[path]; ok {
+			delete(s.files, path)
+			delta--
+		}
+		s.mu.Unlock()
+	}
+	for _, batch := range files {
+		for _, file := range batch {
+			s := c.shard(file.Path)
+			s.mu.Lock()
+			if _, ok := s.files[file.Path]; !ok {
+				delta++
+			}
+			s.files[file.Path] = file
+			s.mu.Unlock()
+		}
+	}
+	fileCacheSize.Set(float64(c.count.Add(delta)))
+}
+
+// CachedFile returns the file state last reported by agents, without a
+// database query
+func (h *Handler) CachedFile(path string) (models.FileNode, bool) {
+	return h.fileCache.get(path)
+}
+
+// CachedFilesUnder calls fn for path and each cached file below it, in no
+// particular order, until fn returns false
+func (h *Handler) CachedFilesUnder(path string, fn func(file models.FileNode) bool) {
+	h.fileCache.eachUnder(path, fn)
+}
@@ -0,0 +1,257 @@
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func cachedFiles(n int) []models.FileNode {
+	files := make([]models.FileNode, n)
+	for i := range files {
+		dir := fmt.Sprintf("/var/log/app%d", i%100)
+		name := fmt.Sprintf("file%d.log", i)
+		files[i] = models.FileNode{Path: dir + "/" + name, ParentPath: dir, Name: name, Size: int64(i)}
+	}
+	return files
+}
+
+func TestFileCacheApplyAndReplace(t *testing.T) {
+	c := newFileCache()
+	files := cachedFiles(1000)
+	c.replace(files)
+	if c.len() != len(files) {
+		t.Fatalf("len = %d after replace, want %d", c.len(), len(files))
+	}
+
+	updated := files[0]
+	updated.Size = 99999
+	added := models.FileNode{Path: "/var/log/new.log", ParentPath: "/var/log", Name: "new.log"}
+	c.apply([]string{files[1].Path, "/never/cached"}, []models.FileNode{updated}, []models.FileNode{added})
+
+	if c.len() != len(files) {
+		t.Errorf("len = %d after one deletion and one addition, want %d", c.len(), len(files))
+	}
+	if got, ok := c.get(updated.Path); !ok || got.Size != updated.Size {
+		t.Errorf("updated file = %+v, %v", got, ok)
+	}
+	if _, ok := c.get(files[1].Path); ok {
+		t.Error("deleted file still cached")
+	}
+	if _, ok := c.get(added.Path); !ok {
+		t.Error("added file not cached")
+	}
+
+	seen := 0
+	c.each(func(models.FileNode) { seen++ })
+	if seen != c.len() {
+		t.Errorf("each visited %d files, len is %d", seen, c.len())
+	}
+}
+
+func TestFileCacheEachUnder(t *testing.T) {
+	c := newFileCache()
+	c.replace([]models.FileNode{
+		{Path: "/var/log", IsDirectory: true},
+		{Path: "/var/log/a.log"},
+		{Path: "/var/log/nested/b.log"},
+		{Path: "/var/logs/c.log"},
+		{Path: "/var/log.old"},
+	})
+
+	var got []string
+	c.eachUnder("/var/log", func(file models.FileNode) bool {
+		got = append(got, file.Path)
+		return true
+	})
+	sort.Strings(got)
+	want := []string{"/var/log", "/var/log/a.log", "/var/log/nested/b.log"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("under /var/log = %v, want %v", got, want)
+	}
+
+	visited := 0
+	c.eachUnder("/", func(models.FileNode) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Errorf("visited %d files after fn returned false, want 2", visited)
+	}
+}
+
+func TestDetectFileChangesAcrossShards(t *testing.T) {
+	h := &Handler{fileCache: newFileCache()}
+	files := cachedFiles(500)
+	h.fileCache.replace(files)
+
+	next := append([]models.FileNode(nil), files[1:]...)
+	next[0].Size++
+	next = append(next, models.FileNode{Path: "/var/log/fresh.log", ParentPath: "/var/log", Name: "fresh.log"})
+
+	changes := h.detectFileChanges(next)
+	if len(changes.deleted) != 1 || changes.deleted[0] != files[0].Path {
+		t.Errorf("deleted = %v, want %s", changes.deleted, files[0].Path)
+	}
+	if len(changes.updated) != 1 || changes.updated[0].Path != next[0].Path {
+		t.Errorf("updated = %v, want %s", changes.updated, next[0].Path)
+	}
+	if len(changes.added) != 1 || changes.added[0].Path != "/var/log/fresh.log" {
+		t.Errorf("added = %v, want /var/log/fresh.log", changes.added)
+	}
+}
+
+// TestFileCacheLookupsDuringDiff runs lookups while a writer diffs and
+// applies file lists; run it with -race
+func TestFileCacheLookupsDuringDiff(t *testing.T) {
+	h := &Handler{fileCache: newFileCache()}
+	files := cachedFiles(5000)
+	h.fileCache.replace(files)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var lookups atomic.Int64
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, ok := h.CachedFile(files[i%len(files)].Path); !ok {
+					t.Errorf("lost %s during a diff", files[i%len(files)].Path)
+					return
+				}
+				lookups.Add(1)
+			}
+		}(r)
+	}
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for round := 0; time.Now().Before(deadline); round++ {
+		next := append([]models.FileNode(nil), files...)
+		next[round%len(next)].ModTime = time.Unix(int64(round), 0)
+		changes := h.detectFileChanges(next)
+		h.fileCache.apply(changes.deleted, changes.added, changes.updated)
+	}
+	close(stop)
+	wg.Wait()
+
+	if lookups.Load() == 0 {
+		t.Error("no lookup completed while diffing")
+	}
+}
+
+// singleLockCache is the file cache as it was before sharding, one map
+// behind one lock, kept as the baseline of the benchmarks
+type singleLockCache struct {
+	mu    sync.RWMutex
+	files map[string]models.FileNode
+}
+
+func (c *singleLockCache) get(path string) (models.FileNode, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	file, ok := c.files[path]
+	return file, ok
+}
+
+// update diffs files against the cache under the read lock, then applies
+// the changes under the write lock, as handleLogList did
+func (c *singleLockCache) update(files []models.FileNode) {
+	next := make(map[string]models.FileNode, len(files))
+	for _, file := range files {
+		next[file.Path] = file
+	}
+	var changed []models.FileNode
+	c.mu.RLock()
+	for path, existing := range c.files {
+		if file, ok := next[path]; ok && isFileChanged(existing, file) {
+			changed = append(changed, file)
+		}
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	for _, file := range changed {
+		c.files[file.Path] = file
+	}
+	c.mu.Unlock()
+}
+
+// benchmarkLookupsDuringDiff measures lookups while two agents' file lists
+// of 100k files are diffed and applied continuously. With one lock, a
+// writer waiting for one diff to finish its scan holds up every lookup.
+func benchmarkLookupsDuringDiff(b *testing.B, get func(string) (models.FileNode, bool), update func([]models.FileNode)) {
+	files := cachedFiles(100000)
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			next := append([]models.FileNode(nil), files...)
+			for round := w; ; round += 2 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				next[round%len(next)].ModTime = time.Unix(int64(round), 0)
+				update(next)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			get(files[i%len(files)].Path)
+			i += 7919
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	writers.Wait()
+}
+
+func BenchmarkFileCacheLookupsDuringDiff(b *testing.B) {
+	files := cachedFiles(100000)
+
+	b.Run("single lock", func(b *testing.B) {
+		c := &singleLockCache{files: make(map[string]models.FileNode, len(files))}
+		for _, file := range files {
+			c.files[file.Path] = file
+		}
+		benchmarkLookupsDuringDiff(b, c.get, c.update)
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		h := &Handler{fileCache: newFileCache()}
+		h.fileCache.replace(files)
+		benchmarkLookupsDuringDiff(b, h.fileCache.get, func(next []models.FileNode) {
+			changes := h.detectFileChanges(next)
+			h.fileCache.apply(changes.deleted, changes.added, changes.updated)
+		})
+	})
+}
+
+func BenchmarkDetectFileChanges(b *testing.B) {
+	files := cachedFiles(100000)
+	h := &Handler{fileCache: newFileCache()}
+	h.fileCache.replace(files)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.detectFileChanges(files)
+	}
+}
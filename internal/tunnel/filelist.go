@@ -0,0 +1,132 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// Compact file list encodings, offered to agents that send hello with
+// capCompactFileList
+const (
+	// Paths are front coded: each repeats the first prefix bytes of the
+	// path before it, and parent path and name are derived from the path
+	fileListPrefix = "prefix"
+	// data is a gzipped, base64 encoded file list in any other form
+	fileListGzip = "gzip"
+)
+
+// maxFileListBytes bounds a decompressed file list
+const maxFileListBytes = 256 << 20
+
+// compactFileList is a log_list payload in a compact encoding. A payload
+// that is a JSON array is a plain file list.
+type compactFileList struct {
+	Encoding string        `json:"encoding"`
+	Files    []compactFile `json:"files,omitempty"`
+	Data     string        `json:"data,omitempty"`
+}
+
+type compactFile struct {
+	Prefix      int    `json:"prefix,omitempty"`
+	Suffix      string `json:"suffix"`
+	IsDirectory bool   `json:"is_directory,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime     int64  `json:"mod_time,omitempty"` // Unix nanoseconds
+	IsGzipped   bool   `json:"is_gzipped,omitempty"`
+	IsScraped   bool   `json:"is_scraped,omitempty"`
+	ScrapeState string `json:"scrape_state,omitempty"`
+}
+
+// decodeFileList decodes a log_list payload in the plain or a compact form
+func decodeFileList(payload json.RawMessage) ([]models.FileNode, error) {
+	return decodeFileListIn(payload, true)
+}
+
+func decodeFileListIn(payload json.RawMessage, allowGzip bool) ([]models.FileNode, error) {
+	trimmed := bytes.TrimLeft(payload, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		var files []models.FileNode
+		err := unmarshalPayload(payload, &files)
+		return files, err
+	}
+
+	var list compactFileList
+	if err := unmarshalPayload(payload, &list); err != nil {
+		return nil, err
+	}
+
+	switch list.Encoding {
+	case fileListPrefix:
+		return decodePrefixFiles(list.Files)
+	case fileListGzip:
+		if !allowGzip {
+			return nil, fmt.Errorf("%w: nested gzip file list", errMalformed)
+		}
+		data, err := gunzipFileList(list.Data)
+		if err != nil {
+			return nil, err
+		}
+		return decodeFileListIn(data, false)
+	default:
+		return nil, fmt.Errorf("%w: unknown file list encoding %q", errMalformed, list.Encoding)
+	}
+}
+
+func decodePrefixFiles(compact []compactFile) ([]models.FileNode, error) {
+	files := make([]models.FileNode, 0, len(compact))
+	prev := ""
+	for i, c := range compact {
+		if c.Prefix < 0 || c.Prefix > len(prev) {
+			return nil, fmt.Errorf("%w: file %d repeats %d bytes of a %d byte path",
+				errMalformed, i, c.Prefix, len(prev))
+		}
+		p := prev[:c.Prefix] + c.Suffix
+		prev = p
+
+		file := models.FileNode{
+			Path:        p,
+			ParentPath:  paths.Parent(p),
+			Name:        path.Base(p),
+			IsDirectory: c.IsDirectory,
+			Size:        c.Size,
+			IsGzipped:   c.IsGzipped,
+			IsScraped:   c.IsScraped,
+			ScrapeState: c.ScrapeState,
+		}
+		if c.ModTime != 0 {
+			file.ModTime = time.Unix(0, c.ModTime).UTC()
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func gunzipFileList(data string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: file list data: %w", errMalformed, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: file list data: %w", errMalformed, err)
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(zr, maxFileListBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: file list data: %w", errMalformed, err)
+	}
+	if len(out) > maxFileListBytes {
+		return nil, fmt.Errorf("%w: file list exceeds %d MB decompressed", errMalformed, maxFileListBytes>>20)
+	}
+	return out, nil
+}
@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+func sampleFileList() []models.FileNode {
+	mod := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	return []models.FileNode{
+		{Path: "/var/log", ParentPath: "/var", Name: "log", IsDirectory: true, ModTime: mod},
+		{Path: "/var/log/app", ParentPath: "/var/log", Name: "app", IsDirectory: true},
+		{Path: "/var/log/app/app.log", ParentPath: "/var/log/app", Name: "app.log", Size: 4096, ModTime: mod, IsScraped: true, ScrapeState: "complete"},
+		{Path: "/var/log/app/app.log.1.gz", ParentPath: "/var/log/app", Name: "app.log.1.gz", Size: 512, ModTime: mod.Add(-time.Hour), IsGzipped: true},
+		{Path: "/var/log/syslog", ParentPath: "/var/log", Name: "syslog", Size: 1, ModTime: mod},
+	}
+}
+
+// encodePrefixFiles front codes files the way an agent does
+func encodePrefixFiles(files []models.FileNode) compactFileList {
+	list := compactFileList{Encoding: fileListPrefix}
+	prev := ""
+	for _, f := range files {
+		n := 0
+		for n < len(prev) && n < len(f.Path) && prev[n] == f.Path[n] {
+			n++
+		}
+		c := compactFile{
+			Prefix:      n,
+			Suffix:      f.Path[n:],
+			IsDirectory: f.IsDirectory,
+			Size:        f.Size,
+			IsGzipped:   f.IsGzipped,
+			IsScraped:   f.IsScraped,
+			ScrapeState: f.ScrapeState,
+		}
+		if !f.ModTime.IsZero() {
+			c.ModTime = f.ModTime.UnixNano()
+		}
+		list.Files = append(list.Files, c)
+		prev = f.Path
+	}
+	return list
+}
+
+func gzipFileList(t *testing.T, payload []byte) compactFileList {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compactFileList{Encoding: fileListGzip, Data: base64.StdEncoding.EncodeToString(buf.Bytes())}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeFileListRoundTrip(t *testing.T) {
+	want := sampleFileList()
+	plain := mustMarshal(t, want)
+	prefix := mustMarshal(t, encodePrefixFiles(want))
+
+	payloads := map[string][]byte{
+		"plain":       plain,
+		"prefix":      prefix,
+		"gzip plain":  mustMarshal(t, gzipFileList(t, plain)),
+		"gzip prefix": mustMarshal(t, gzipFileList(t, prefix)),
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			got, err := decodeFileList(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decoded\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+
+	if len(prefix) >= len(plain) {
+		t.Errorf("prefix form is %d bytes, plain is %d", len(prefix), len(plain))
+	}
+}
+
+func TestDecodeFileListRejectsMalformed(t *testing.T) {
+	nested := gzipFileList(t, mustMarshal(t, gzipFileList(t, []byte("[]"))))
+
+	payloads := map[string][]byte{
+		"negative prefix":  mustMarshal(t, compactFileList{Encoding: fileListPrefix, Files: []compactFile{{Prefix: -1, Suffix: "/a"}}}),
+		"prefix too long":  mustMarshal(t, compactFileList{Encoding: fileListPrefix, Files: []compactFile{{Suffix: "/a"}, {Prefix: 3, Suffix: "b"}}}),
+		"unknown encoding": mustMarshal(t, compactFileList{Encoding: "zstd"}),
+		"nested gzip":      mustMarshal(t, nested),
+		"bad base64":       mustMarshal(t, compactFileList{Encoding: fileListGzip, Data: "not base64!"}),
+		"not gzip":         mustMarshal(t, compactFileList{Encoding: fileListGzip, Data: base64.StdEncoding.EncodeToString([]byte("[]"))}),
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeFileList(payload); !errors.Is(err, errMalformed) {
+				t.Fatalf("err = %v, want malformed", err)
+			}
+		})
+	}
+}
+
+func TestHelloAcceptsCompactFileList(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	h := &Handler{}
+	agent := newAgentConn(server, time.Now())
+
+	replies := make(chan Message, 1)
+	go func() {
+		var msg Message
+		if err := json.NewDecoder(client).Decode(&msg); err == nil {
+			replies <- msg
+		}
+	}()
+
+	payload := mustMarshal(t, Hello{Capabilities: []string{capCompactFileList, "future_thing"}})
+	if err := h.handleHello(context.Background(), agent, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-replies:
+		var hello Hello
+		if err := json.Unmarshal(msg.Payload, &hello); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != TypeHello || !reflect.DeepEqual(hello.Capabilities, []string{capCompactFileList}) {
+			t.Fatalf("reply = %s %v, want hello with only %s", msg.Type, hello.Capabilities, capCompactFileList)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no hello reply")
+	}
+}
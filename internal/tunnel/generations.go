@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// FileTruncated is sent by agents that notice a log file was truncated, so
+// the server can start a new generation before the next file list arrives
+type FileTruncated struct {
+	Path string `json:"path"`
+}
+
+// carryGeneration copies the server-managed generation onto a file reported
+// by an agent, starting a new generation when the file shrank. A shrinking
+// file means it was truncated or replaced, so line numbers restart.
+func carryGeneration(existing models.FileNode, file *models.FileNode) {
+	file.Generation = existing.Generation
+	if !file.IsDirectory && file.Size < existing.Size {
+		file.Generation++
+		log.Printf("[TUNNEL] %s shrank from %d to %d bytes, starting generation %d",
+			file.Path, existing.Size, file.Size, file.Generation)
+	}
+}
+
+func (h *Handler) handleFileTruncated(ctx context.Context, payload json.RawMessage) error {
+	var msg FileTruncated
+	if err := unmarshalPayload(payload, &msg); err != nil {
+		return fmt.Errorf("unmarshal file truncation: %w", err)
+	}
+	msg.Path = paths.Normalize(msg.Path)
+
+	file, ok := h.fileCache.get(msg.Path)
+	if !ok {
+		return fmt.Errorf("truncation of unknown file %s", msg.Path)
+	}
+
+	// An entry held back for continuation lines belongs to the old generation
+	flushCtx, cancel := h.detach(ctx)
+	h.flushMultiline(flushCtx, true)
+	cancel()
+
+	file.Generation++
+	file.Size = 0
+	changes := &fileChanges{updated: []models.FileNode{file}}
+	if err := h.applyFileChanges(ctx, changes); err != nil {
+		return fmt.Errorf("apply file truncation: %w", err)
+	}
+
+	log.Printf("[TUNNEL] %s truncated by agent, starting generation %d", file.Path, file.Generation)
+	h.notifyFileChanges(changes)
+	return nil
+}
+
+// stampGenerations tags incoming lines with their file's current generation
+func (h *Handler) stampGenerations(logs []models.LogEntry) {
+	for i := range logs {
+		if file, ok := h.fileCache.get(logs[i].Filename); ok {
+			logs[i].Generation = file.Generation
+		}
+	}
+}
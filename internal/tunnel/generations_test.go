@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+func TestCarryGeneration(t *testing.T) {
+	existing := models.FileNode{Path: "/var/log/app.log", Size: 100, Generation: 3}
+	tests := []struct {
+		name string
+		file models.FileNode
+		want int
+	}{
+		{name: "grew", file: models.FileNode{Size: 150}, want: 3},
+		{name: "same size", file: models.FileNode{Size: 100}, want: 3},
+		{name: "shrank", file: models.FileNode{Size: 10}, want: 4},
+		{name: "emptied", file: models.FileNode{Size: 0}, want: 4},
+		{name: "directory", file: models.FileNode{IsDirectory: true, Size: 0}, want: 3},
+		{name: "agent's generation ignored", file: models.FileNode{Size: 150, Generation: 9}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tt.file
+			carryGeneration(existing, &file)
+			if file.Generation != tt.want {
+				t.Errorf("generation = %d, want %d", file.Generation, tt.want)
+			}
+		})
+	}
+}
+
+// TestTwoTruncationCycles restarts a file twice, once reported by the agent
+// and once inferred from the file shrinking, and checks that each run's
+// lines keep their own generation in pages, context and the live tail
+func TestTwoTruncationCycles(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files", "logs")
+	ctx := context.Background()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+
+	process := func(typ MessageType, payload interface{}) {
+		t.Helper()
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.processMessage(ctx, agent, Message{Type: typ, Payload: data}); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+	}
+	const path = "/var/log/cycle.log"
+	next := now.Add(-time.Hour)
+	writeRun := func(run string, lines int) {
+		t.Helper()
+		var logs []models.LogEntry
+		for i := 1; i <= lines; i++ {
+			next = next.Add(time.Second)
+			logs = append(logs, models.LogEntry{Filename: path, Line: fmt.Sprintf("%s run line %d", run, i), LineNum: i, Timestamp: next})
+		}
+		process(TypeLogData, logs)
+	}
+	file := models.FileNode{Path: path, ParentPath: "/var/log", Name: "cycle.log", Size: 300, ModTime: now.Add(-time.Hour)}
+	reportFile := func(size int64) {
+		t.Helper()
+		file.Size = size
+		file.ModTime = file.ModTime.Add(time.Second)
+		process(TypeLogList, []models.FileNode{file})
+	}
+
+	reportFile(300)
+	writeRun("first", 3)
+
+	// Reported by the agent
+	process(TypeFileTruncated, FileTruncated{Path: path})
+	reportFile(200)
+	writeRun("second", 2)
+
+	// Inferred from the file shrinking; the tail is open meanwhile
+	tail := h.SubscribeLogs(func(p string) bool { return p == path })
+	defer h.UnsubscribeLogs(tail)
+	reportFile(50)
+	writeRun("third", 2)
+
+	stored, err := h.db.GetFileByPath(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Generation != 2 {
+		t.Fatalf("generation after two truncations = %d, want 2", stored.Generation)
+	}
+
+	for i := 1; i <= 2; i++ {
+		select {
+		case entry := <-tail:
+			if entry.Generation != 2 || entry.LineNum != i || entry.Line != fmt.Sprintf("third run line %d", i) {
+				t.Errorf("tailed %+v, want line %d of generation 2", entry, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("line %d of the third run not tailed", i)
+		}
+	}
+
+	for _, tc := range []struct {
+		generation int
+		want       []string
+	}{
+		{0, []string{"first run line 3", "first run line 2", "first run line 1"}},
+		{1, []string{"second run line 2", "second run line 1"}},
+		{2, []string{"third run line 2", "third run line 1"}},
+	} {
+		page, err := h.db.GetLogs(ctx, path, "", 100, tc.generation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lineTexts(page.Entries); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("generation %d = %v, want %v", tc.generation, got, tc.want)
+		}
+	}
+	all, err := h.db.GetLogs(ctx, path, "", 100, db.AllGenerations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all.Entries) != 7 {
+		t.Fatalf("all generations hold %d lines, want 7", len(all.Entries))
+	}
+
+	// Line 2 of the first run, whose neighbours by line number are in
+	// every generation
+	var entry models.LogEntry
+	for _, e := range all.Entries {
+		if e.Line == "first run line 2" {
+			entry = e
+		}
+	}
+	before, after, err := h.db.GetLogContext(ctx, &entry, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(lineTexts(before)) != "[first run line 1]" || fmt.Sprint(lineTexts(after)) != "[first run line 3]" {
+		t.Errorf("context = %v before, %v after; want the first run's lines only", lineTexts(before), lineTexts(after))
+	}
+	before, after, err = h.db.GetLogContext(ctx, &entry, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before)+len(after) <= 2 {
+		t.Errorf("context across generations = %v before, %v after; want other runs' lines too", lineTexts(before), lineTexts(after))
+	}
+}
+
+func lineTexts(entries []models.LogEntry) []string {
+	texts := make([]string, len(entries))
+	for i, e := range entries {
+		texts[i] = e.Line
+	}
+	return texts
+}
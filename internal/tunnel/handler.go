@@ -3,15 +3,24 @@ package tunnel
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"diagnostic-client/internal/clock"
 	"diagnostic-client/internal/config"
 	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/jobs"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/tracing"
 	"diagnostic-client/pkg/models"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type MessageType string
@@ -20,63 +29,196 @@ const (
 	TypeMetrics MessageType = "metrics"
 	TypeLogList MessageType = "log_list"
 	TypeLogData MessageType = "log_data"
+	// Agents report a log file truncated in place, starting a new generation
+	TypeFileTruncated MessageType = "file_truncated"
+	// Sent by agents on connecting and answered by the server
+	TypeHello MessageType = "hello"
+	// Names the agent; only accepted as its first message
+	TypeRegister MessageType = "register"
+	// Agents report the config version they applied
+	TypeAgentConfigAck MessageType = "agent_config_ack"
+
+	// Commands sent from the server to agents
+	TypeScrape     MessageType = "scrape"
+	TypeMetricsAck MessageType = "metrics_ack"
+	// Sent by a read-only server before it closes the connection
+	TypeRedirect MessageType = "redirect"
+	// Pushes an agent's config, see AgentConfigPush
+	TypeAgentConfig MessageType = "agent_config"
 )
 
+// storedPrecision is the resolution of timestamptz columns. Timestamps are cut
+// to it on arrival so streamed, replayed and stored copies compare equal.
+const storedPrecision = time.Microsecond
+
 type Message struct {
 	Type    MessageType     `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
 
-// FileCache maintains an in-memory cache of the current file state
-type FileCache struct {
-	files map[string]models.FileNode
-	count int
-	mutex sync.RWMutex
-}
-
 type Handler struct {
 	cfg             *config.Config
 	db              *db.DB
-	networkStreamCh chan []models.NetworkPacket
-	logStreamCh     chan models.LogEntry
-	fileUpdateCh    chan models.FileNode
+	clock           clock.Clock
+	streams         streamSubscribers // Live streams of each websocket client, see streams.go
 	fileCache       *FileCache
+	ignore          *paths.Denylist
+	quarantine      deletionQuarantine
+	agents          agentRegistry
+	captures        captureRegistry
+	fileCacheLoaded chan struct{} // Closed once the initial file cache load is done
 
 	// Network packet batching
 	batchMutex    sync.Mutex
 	networkBatch  []models.NetworkPacket
+	batchSamples  []latencySample
+	batchPending  []pendingBatch // Batches to ack once the network batch commits
 	lastBatchTime time.Time
 
-	// Shutdown coordination
+	// Running average of streamed batch length, for memory accounting
+	avgStreamBatch int64
+
+	// Recently streamed batches, replayed to reconnecting clients
+	networkHistory *batchRing
+	// Consumers of stored network batches, see subscribers.go
+	subscribers networkSubscribers
+
+	// Downsampling of the raw packet stream under load
+	sampler *streamSampler
+
+	// Verbosity of the live streams; changes wake expireStreamPolicies
+	streamPolicy   atomic.Pointer[StreamPolicy]
+	streamPolicyCh chan struct{}
+
+	// Recently received metrics batches, so retries aren't stored twice
+	dedup *batchDedup
+
+	ingest  ingestCounters
+	latency *ingestLatency
+
+	// Packets with less payload are dropped before batching
+	minPayloadSize atomic.Int64
+
+	// Live packet and byte rates by arrival time
+	rates rateWindow
+
+	// Live agent message rates by type and agent
+	messageRates *messageRates
+
+	// Per-agent counts for the agent_metrics job; nil when disabled
+	agentIngest *agentIngest
+
+	// Shared copies of strings repeated across decoded entries
+	paths *internTable
+	names *internTable
+
+	// Commands awaiting their ingested results
+	ops *operationRegistry
+
+	// Reassembly of multi-line entries; nil when disabled
+	multiline *multilineJoiner
+
+	// Sampling of high-volume log files; nil when disabled
+	logSampler *logSampler
+
+	// Highest stored line per file
+	watermarks *ingestWatermarks
+
+	// Log entries whose write was cancelled, stored by the shutdown drain
+	deferredMu   sync.Mutex
+	deferredLogs []models.LogEntry
+
+	// Shutdown coordination. ctx is the handler's lifetime, see drain.go.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	workers      sync.WaitGroup
 	shutdownOnce sync.Once
 	shutdownCh   chan struct{}
 }
 
-func NewHandler(cfg *config.Config, db *db.DB) *Handler {
+func NewHandler(cfg *config.Config, db *db.DB, clk clock.Clock) *Handler {
 	h := &Handler{
 		cfg:             cfg,
 		db:              db,
-		networkStreamCh: make(chan []models.NetworkPacket, cfg.NetworkBufferSize),
-		logStreamCh:     make(chan models.LogEntry, cfg.LogBufferSize),
-		fileUpdateCh:    make(chan models.FileNode, 2000),
+		clock:           clk,
+		streamPolicyCh:  make(chan struct{}, 1),
+		ops:             newOperationRegistry(cfg.OperationTTL),
+		ignore:          paths.NewDenylist(cfg.IgnorePaths),
 		networkBatch:    make([]models.NetworkPacket, 0, cfg.BatchSize),
-		lastBatchTime:   time.Now(),
+		lastBatchTime:   clk.Now(),
+		networkHistory:  newBatchRing(cfg.NetworkReplayBatches),
+		sampler:         newStreamSampler(newFairScheduler(cfg)),
+		dedup:           newBatchDedup(cfg.NetworkDedupBatches),
+		latency:         newIngestLatency(),
+		messageRates:    newMessageRates(),
+		agentIngest:     newAgentIngest(cfg.AgentMetricsRetention, clk.Now()),
+		paths:           newInternTable(internPaths),
+		names:           newInternTable(internNames),
+		multiline:       newMultilineJoiner(cfg.MultilinePaths, cfg.MultilineStart, cfg.MaxLogLineLength),
+		logSampler:      newLogSampler(cfg.LogSampling, cfg.LogSamplingKeep),
 		shutdownCh:      make(chan struct{}),
-		fileCache: &FileCache{
-			files: make(map[string]models.FileNode),
+		fileCache:       newFileCache(),
+		fileCacheLoaded: make(chan struct{}),
+		watermarks:      newIngestWatermarks(),
+		agents: agentRegistry{
+			conns: make(map[*agentConn]struct{}),
 		},
+		subscribers: networkSubscribers{
+			subs: make(map[*NetworkSubscription]struct{}),
+		},
+		streams: newStreamSubscribers(cfg),
 	}
 
-	go h.initializeFileCache()
-	go h.periodicNetworkFlush()
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.minPayloadSize.Store(int64(cfg.MinPayloadSize))
+	policy := h.DefaultStreamPolicy()
+	h.streamPolicy.Store(&policy)
+
+	h.goWorker(h.initializeFileCache)
+	h.goWorker(h.sweepOperations)
+	h.goWorker(h.expireStreamPolicies)
+	// A read-only server ingests nothing, so it has nothing to store
+	if !cfg.ReadOnly {
+		h.goWorker(h.loadBatchIDs)
+		h.goWorker(h.periodicBatchIDSave)
+		h.goWorker(h.periodicMultilineFlush)
+		h.goWorker(h.periodicWatermarkSave)
+	}
 
 	return h
 }
 
+// goWorker runs fn in the background; Close waits for it before draining
+func (h *Handler) goWorker(fn func()) {
+	h.workers.Add(1)
+	go func() {
+		defer h.workers.Done()
+		fn()
+	}()
+}
+
 func (h *Handler) HandleConnection(ctx context.Context, conn net.Conn) {
+	if h.cfg.ReadOnly {
+		h.redirectAgent(conn)
+		return
+	}
+
 	log.Printf("[TUNNEL] New agent connection from %s", conn.RemoteAddr())
 	defer conn.Close()
 
+	if h.cfg.FlushOnDisconnect {
+		defer h.flushOnDisconnect(conn)
+	}
+
+	agent := newAgentConn(conn, h.clock.Now())
+	h.agents.add(agent)
+	defer h.agents.remove(agent)
+	defer h.saveLastSeen(agent)
+	h.attachCapture(agent)
+
+	errs := newMessageErrors(agent.id, h.cfg.MaxMalformedPerMinute, &h.ingest, h.clock.Now())
+	defer errs.summarize()
+
 	decoder := json.NewDecoder(conn)
 
 	for {
@@ -86,64 +228,152 @@ func (h *Handler) HandleConnection(ctx context.Context, conn net.Conn) {
 		case <-h.shutdownCh:
 			return
 		default:
+			// The deadline is pushed back after every message, so only a
+			// peer that stays silent for the whole window is dropped
+			if h.cfg.AgentIdleTimeout > 0 {
+				conn.SetReadDeadline(time.Now().Add(h.cfg.AgentIdleTimeout))
+			}
+
 			var msg Message
-			if err := decoder.Decode(&msg); err != nil {
-				if ctx.Err() == nil {
+			if err := h.decodeMessage(decoder, agent, &msg); err != nil {
+				// A well-formed JSON value of the wrong shape leaves the
+				// stream intact, so it only costs malformed budget
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					if errs.record(msg.Type, fmt.Errorf("%w: %w", errMalformed, err), h.clock.Now()) {
+						h.saveAgentEvent(agent, models.AgentEventProtocolError, errs.closeReason)
+						return
+					}
+					continue
+				}
+
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Printf("[TUNNEL] Closing idle agent connection from %s: no message in %v",
+						conn.RemoteAddr(), h.cfg.AgentIdleTimeout)
+				} else if ctx.Err() == nil {
 					log.Printf("[TUNNEL] Error decoding message: %v", err)
 				}
 				return
 			}
 
-			if err := h.processMessage(ctx, msg); err != nil {
-				log.Printf("[TUNNEL] Error processing message: %v", err)
+			if err := h.processMessage(ctx, agent, msg); err != nil {
+				if errs.record(msg.Type, err, h.clock.Now()) {
+					h.saveAgentEvent(agent, models.AgentEventProtocolError, errs.closeReason)
+					return
+				}
 			}
 		}
 	}
 }
 
-func (h *Handler) processMessage(ctx context.Context, msg Message) error {
+func (h *Handler) processMessage(ctx context.Context, agent *agentConn, msg Message) (err error) {
+	ctx, span := tracing.Start(ctx, "tunnel."+string(msg.Type),
+		attribute.String("agent.id", agent.id),
+		attribute.Int("message.bytes", len(msg.Payload)),
+	)
+	switch msg.Type {
+	case TypeRegister, TypeHello, TypeAgentConfigAck:
+	default:
+		agent.dataMessages++
+	}
+	agent.lastSeen.Store(h.clock.Now().UnixNano())
+	defer func() {
+		// Counted once handled, so a registration counts under its new ID
+		h.messageRates.add(h.clock.Now(), agent.id, msg.Type, len(msg.Payload))
+		h.agentIngest.add(agent.id, 0, 0, len(msg.Payload))
+		if errors.Is(err, errUnknownType) {
+			messagesReceived.WithLabelValues(unknownMessageType).Inc()
+		} else {
+			messagesReceived.WithLabelValues(string(msg.Type)).Inc()
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	switch msg.Type {
 	case TypeMetrics:
-		return h.handleMetrics(ctx, msg.Payload)
+		return h.handleMetrics(ctx, agent, msg.Payload)
 	case TypeLogList:
 		return h.handleFileList(ctx, msg.Payload)
 	case TypeLogData:
-		return h.handleLogData(ctx, msg.Payload)
+		return h.handleLogData(ctx, agent.id, msg.Payload)
+	case TypeFileTruncated:
+		return h.handleFileTruncated(ctx, msg.Payload)
+	case TypeRegister:
+		return h.handleRegister(ctx, agent, msg.Payload)
+	case TypeHello:
+		return h.handleHello(ctx, agent, msg.Payload)
+	case TypeAgentConfigAck:
+		return h.handleAgentConfigAck(ctx, agent, msg.Payload)
 	default:
-		return fmt.Errorf("unknown message type: %s", msg.Type)
+		return fmt.Errorf("%w: %s", errUnknownType, msg.Type)
 	}
 }
 
 // initializeFileCache loads the initial file state from the database
 func (h *Handler) initializeFileCache() {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer close(h.fileCacheLoaded)
+	ctx, cancel := context.WithTimeout(h.ctx, 30*time.Second)
 	defer cancel()
 
+	if err := h.ReloadFileCache(ctx); err != nil {
+		log.Printf("[TUNNEL] Error initializing file cache: %v", err)
+	}
+}
+
+// ReloadFileCache replaces the cached file state with the database's, for
+// when files were changed outside the tunnel, and removes ignored files
+func (h *Handler) ReloadFileCache(ctx context.Context) error {
 	files, err := h.db.GetAllFiles(ctx)
 	if err != nil {
-		log.Printf("[TUNNEL] Error initializing file cache: %v", err)
-		return
+		return err
 	}
 
-	h.fileCache.mutex.Lock()
-	defer h.fileCache.mutex.Unlock()
+	h.fileCache.replace(files)
 
-	for _, file := range files {
-		h.fileCache.files[file.Path] = file
+	marks, err := h.db.GetIngestWatermarks(ctx)
+	if err != nil {
+		return err
 	}
-	h.fileCache.count = len(files)
+	h.watermarks.restore(marks)
+
+	log.Printf("[TUNNEL] Loaded file cache with %d files", len(files))
 
-	log.Printf("[TUNNEL] Initialized file cache with %d files", len(files))
+	return h.purgeIgnoredFiles(ctx)
 }
 
 // handleFileList processes incoming file lists efficiently
 func (h *Handler) handleFileList(ctx context.Context, payload json.RawMessage) error {
-	var newFiles []models.FileNode
-	if err := json.Unmarshal(payload, &newFiles); err != nil {
+	newFiles, err := decodeFileList(payload)
+	if err != nil {
 		return fmt.Errorf("unmarshal file list: %w", err)
 	}
 
+	// Ignored files are dropped before diffing, so any still cached are
+	// deleted like files the agent stopped reporting
+	kept := newFiles[:0]
+	for _, file := range newFiles {
+		file.Path = h.paths.intern(paths.Normalize(file.Path))
+		file.ParentPath = h.paths.intern(paths.Parent(file.Path))
+		if h.ignore.Match(file.Path) {
+			continue
+		}
+		file.ScrapeState = scrapeState(file)
+		kept = append(kept, file)
+	}
+	newFiles = kept
+
+	// Lists are diffed and applied one at a time, so a held mass deletion
+	// is judged against the list that follows it
+	h.quarantine.mu.Lock()
+	defer h.quarantine.mu.Unlock()
+
 	changes := h.detectFileChanges(newFiles)
+	h.quarantineDeletions(changes)
 	if changes.isEmpty() {
 		return nil
 	}
@@ -180,9 +410,10 @@ func (h *Handler) detectFileChanges(newFiles []models.FileNode) *fileChanges {
 	}
 
 	// Find updates and deletions
-	h.fileCache.mutex.RLock()
-	for path, existingFile := range h.fileCache.files {
+	h.fileCache.each(func(existingFile models.FileNode) {
+		path := existingFile.Path
 		if newFile, exists := newFileMap[path]; exists {
+			carryGeneration(existingFile, &newFile)
 			if isFileChanged(existingFile, newFile) {
 				changes.updated = append(changes.updated, newFile)
 			}
@@ -190,8 +421,7 @@ func (h *Handler) detectFileChanges(newFiles []models.FileNode) *fileChanges {
 		} else {
 			changes.deleted = append(changes.deleted, path)
 		}
-	}
-	h.fileCache.mutex.RUnlock()
+	})
 
 	// Remaining files are new
 	for _, file := range newFileMap {
@@ -202,22 +432,28 @@ func (h *Handler) detectFileChanges(newFiles []models.FileNode) *fileChanges {
 }
 
 func (h *Handler) applyFileChanges(ctx context.Context, changes *fileChanges) error {
-	if len(changes.deleted) > 0 {
-		if err := h.db.DeleteFiles(ctx, changes.deleted); err != nil {
-			return fmt.Errorf("delete files: %w", err)
-		}
+	now := h.clock.Now()
+	for i := range changes.added {
+		changes.added[i].LastSeen = now
 	}
-
-	if len(changes.added) > 0 {
-		if err := h.db.SaveFiles(ctx, changes.added); err != nil {
-			return fmt.Errorf("save new files: %w", err)
-		}
+	for i := range changes.updated {
+		changes.updated[i].LastSeen = now
 	}
 
-	if len(changes.updated) > 0 {
-		if err := h.db.UpdateFiles(ctx, changes.updated); err != nil {
-			return fmt.Errorf("update files: %w", err)
-		}
+	drifted, err := h.db.ApplyFileChanges(ctx, db.FileChanges{
+		Deleted: changes.deleted,
+		Added:   changes.added,
+		Updated: changes.updated,
+	})
+	if err != nil {
+		return fmt.Errorf("apply file changes: %w", err)
+	}
+	h.watermarks.forget(changes.deleted)
+	if drifted > 0 {
+		// The cache had files the database doesn't, e.g. after a delete
+		// elsewhere; they were stored again rather than lost
+		log.Printf("[TUNNEL] %d updated files weren't stored; saved them", drifted)
+		h.ingest.filesDrifted.Add(drifted)
 	}
 
 	// Update cache
@@ -230,92 +466,230 @@ func (h *Handler) applyFileChanges(ctx context.Context, changes *fileChanges) er
 }
 
 func (h *Handler) updateFileCache(changes *fileChanges) {
-	h.fileCache.mutex.Lock()
-	defer h.fileCache.mutex.Unlock()
-
-	// Apply deletions
-	for _, path := range changes.deleted {
-		delete(h.fileCache.files, path)
-	}
-
-	// Apply additions and updates
-	for _, file := range append(changes.added, changes.updated...) {
-		h.fileCache.files[file.Path] = file
-	}
-
-	h.fileCache.count = len(h.fileCache.files)
+	h.fileCache.apply(changes.deleted, changes.added, changes.updated)
 }
 
 func (h *Handler) notifyFileChanges(changes *fileChanges) {
 	// Notify about new and updated files
 	for _, file := range append(changes.added, changes.updated...) {
-		select {
-		case h.fileUpdateCh <- file:
-		default:
-			// Skip notification if channel is full
-		}
+		h.streams.files.Publish(file)
 	}
 }
 
 // handleMetrics processes network metrics
-func (h *Handler) handleMetrics(ctx context.Context, payload json.RawMessage) error {
+func (h *Handler) handleMetrics(ctx context.Context, agent *agentConn, payload json.RawMessage) error {
 	var metrics struct {
-		Timestamp string                 `json:"timestamp"`
-		Packets   []models.NetworkPacket `json:"packets"`
+		Timestamp string `json:"timestamp"`
+		// Optional; agents set it to the same value when retrying a batch
+		BatchID string          `json:"batch_id"`
+		Packets json.RawMessage `json:"packets"`
 	}
-	if err := json.Unmarshal(payload, &metrics); err != nil {
+	if err := unmarshalPayload(payload, &metrics); err != nil {
 		return fmt.Errorf("unmarshal metrics: %w", err)
 	}
+	var packets []models.NetworkPacket
+	if len(metrics.Packets) > 0 {
+		if err := unmarshalPayload(metrics.Packets, &packets); err != nil {
+			return fmt.Errorf("unmarshal metrics: %w", err)
+		}
+	}
+	if len(packets) == 0 {
+		return nil
+	}
+
+	batchID := metrics.BatchID
+	if batchID == "" {
+		batchID = contentBatchID(metrics.Packets)
+	}
+	switch h.dedup.claim(agent.id, batchID) {
+	case batchCommitted:
+		h.ingest.duplicateBatches.Add(1)
+		h.ingest.duplicatePackets.Add(int64(len(packets)))
+		h.ackMetrics(agent, metrics.BatchID, true)
+		return nil
+	case batchPending:
+		// The first copy is acked once it is stored
+		h.ingest.duplicateBatches.Add(1)
+		h.ingest.duplicatePackets.Add(int64(len(packets)))
+		return nil
+	}
+
+	h.agentIngest.add(agent.id, 0, len(packets), 0)
+
+	// Filtered packets count as received for the ack, but aren't stored
+	if packets = h.filterPayloads(packets); len(packets) == 0 {
+		h.dedup.commit(agent.id, batchID)
+		h.ackMetrics(agent, metrics.BatchID, false)
+		return nil
+	}
+
+	for i := range packets {
+		packets[i].AgentID = agent.id
+		packets[i].Protocol = h.names.intern(packets[i].Protocol)
+		packets[i].TCPFlags = h.names.intern(packets[i].TCPFlags)
+		packets[i].Timestamp = packets[i].Timestamp.Truncate(storedPrecision)
+	}
+	now := h.clock.Now()
+	h.rates.add(now, packets)
+	sample := h.latency.sample(packets, now)
 
 	h.batchMutex.Lock()
-	h.networkBatch = append(h.networkBatch, metrics.Packets...)
+	h.networkBatch = append(h.networkBatch, packets...)
+	h.batchSamples = append(h.batchSamples, sample)
+	h.batchPending = append(h.batchPending, pendingBatch{agent: agent, agentID: agent.id, batchID: batchID, ackID: metrics.BatchID})
 	currentSize := len(h.networkBatch)
 	h.batchMutex.Unlock()
 
+	// The packets are accepted now, so losing the connection mustn't
+	// cancel their write. The batch is acked by the flush that stores it.
 	if currentSize >= h.cfg.BatchSize {
-		return h.flushNetworkBatch(ctx)
+		writeCtx, cancel := h.detach(ctx)
+		err := h.flushNetworkBatch(writeCtx)
+		cancel()
+		if err != nil && !errors.Is(err, errFlushDeferred) {
+			return err
+		}
 	}
 	return nil
 }
 
+// confirmBatches remembers and acks the batches of a stored network batch
+func (h *Handler) confirmBatches(pending []pendingBatch) {
+	for _, p := range pending {
+		h.dedup.commit(p.agentID, p.batchID)
+		h.ackMetrics(p.agent, p.ackID, false)
+	}
+}
+
+// releaseBatches forgets the batches of a lost network batch, so agents'
+// retries of them are stored
+func (h *Handler) releaseBatches(pending []pendingBatch) {
+	for _, p := range pending {
+		h.dedup.release(p.agentID, p.batchID)
+	}
+}
+
+// ackMetrics confirms a batch to agents that identify their batches; agents
+// that don't can't match an ack to a batch, so they get none
+func (h *Handler) ackMetrics(agent *agentConn, batchID string, duplicate bool) {
+	if batchID == "" {
+		return
+	}
+
+	payload, err := json.Marshal(MetricsAck{BatchID: batchID, Duplicate: duplicate})
+	if err != nil {
+		return
+	}
+	if err := agent.send(Message{Type: TypeMetricsAck, Payload: payload}); err != nil {
+		log.Printf("[TUNNEL] Error acking batch %s to %s: %v", batchID, agent.conn.RemoteAddr(), err)
+	}
+}
+
 // handleLogData processes log entries
-func (h *Handler) handleLogData(ctx context.Context, payload json.RawMessage) error {
+func (h *Handler) handleLogData(ctx context.Context, agentID string, payload json.RawMessage) error {
 	var logs []models.LogEntry
-	if err := json.Unmarshal(payload, &logs); err != nil {
+	if err := unmarshalPayload(payload, &logs); err != nil {
 		return fmt.Errorf("unmarshal logs: %w", err)
 	}
+	h.agentIngest.add(agentID, len(logs), 0, 0)
+	kept := logs[:0]
+	for _, entry := range logs {
+		entry.AgentID = agentID
+		entry.Filename = h.paths.intern(paths.Normalize(entry.Filename))
+		entry.Level = h.names.intern(entry.Level)
+		entry.Timestamp = entry.Timestamp.Truncate(storedPrecision)
+		if !h.ignore.Match(entry.Filename) {
+			kept = append(kept, entry)
+		}
+	}
+	logs = h.multiline.join(kept, h.clock.Now())
+	if len(logs) == 0 {
+		return nil
+	}
 
-	if err := h.db.SaveLogs(ctx, logs); err != nil {
-		return fmt.Errorf("save logs: %w", err)
+	// Like packets, received lines are written even if the agent goes away
+	ctx, cancel := h.detach(ctx)
+	defer cancel()
+	if err := h.storeLogs(ctx, logs); err != nil && !errors.Is(err, errFlushDeferred) {
+		return err
 	}
+	return nil
+}
+
+// storeLogs samples log entries, then saves and streams the rest
+func (h *Handler) storeLogs(ctx context.Context, logs []models.LogEntry) error {
+	h.stampGenerations(logs)
+	logs, skipped := h.watermarks.skip(logs)
+	h.ingest.linesAlreadyStored.Add(int64(skipped))
+
+	if logs = h.logSampler.sample(logs); len(logs) == 0 {
+		return nil
+	}
+	h.truncateLines(logs)
+
+	err := h.db.SaveLogs(ctx, logs)
+	// Shards that committed before a failure keep their lines, so they are
+	// handled as stored and only the rest is deferred or retried
+	stored, unstored := h.splitStoredLogs(logs, err)
+	h.watermarks.advance(stored)
+	h.observeOperations(stored)
 
 	// Stream logs to subscribers
+	for _, entry := range stored {
+		h.streams.logs.Publish(entry)
+	}
+
+	if err != nil {
+		if cancelled(ctx, err) {
+			h.deferLogs(unstored)
+			return fmt.Errorf("save logs: %w: %w", errFlushDeferred, err)
+		}
+		return fmt.Errorf("save logs: %w", err)
+	}
+	return nil
+}
+
+// splitStoredLogs separates the entries a SaveLogs returning err stored from
+// those it didn't
+func (h *Handler) splitStoredLogs(logs []models.LogEntry, err error) (stored, unstored []models.LogEntry) {
+	if err == nil {
+		return logs, nil
+	}
 	for _, entry := range logs {
-		select {
-		case h.logStreamCh <- entry:
-		default:
-			// Skip if channel is full
+		if h.db.Committed(entry.AgentID, err) {
+			stored = append(stored, entry)
+		} else {
+			unstored = append(unstored, entry)
 		}
 	}
+	return stored, unstored
+}
 
-	return nil
+// Jobs returns the handler's work for the job scheduler. The scheduler must
+// be stopped before Close.
+func (h *Handler) Jobs() []jobs.Job {
+	js := []jobs.Job{
+		{Name: "network_flush", Interval: h.cfg.NetworkFlushInterval, Run: h.flushNetworkJob},
+	}
+	if h.cfg.CaptureDir != "" {
+		js = append(js, jobs.Job{Name: "capture_cleanup", Interval: time.Hour, Run: h.cleanupCapturesJob})
+	}
+	if h.cfg.AgentMetricsRetention > 0 {
+		js = append(js, jobs.Job{Name: "agent_metrics", Interval: agentMetricsInterval, Run: h.sampleAgentMetricsJob})
+	}
+	return js
 }
 
-// periodicNetworkFlush ensures network batches are flushed periodically
-func (h *Handler) periodicNetworkFlush() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// flushNetworkJob stores the pending packet batch. A flush cut short by
+// shutdown is deferred to the final drain, which isn't a failure.
+func (h *Handler) flushNetworkJob(ctx context.Context) error {
+	ctx, cancel := h.writeTimeout(ctx)
+	defer cancel()
 
-	for {
-		select {
-		case <-h.shutdownCh:
-			return
-		case <-ticker.C:
-			if err := h.flushNetworkBatch(context.Background()); err != nil {
-				log.Printf("[TUNNEL] Error flushing network batch: %v", err)
-			}
-		}
+	if err := h.flushNetworkBatch(ctx); err != nil && !errors.Is(err, errFlushDeferred) {
+		return err
 	}
+	return nil
 }
 
 func (h *Handler) flushNetworkBatch(ctx context.Context) error {
@@ -325,55 +699,143 @@ func (h *Handler) flushNetworkBatch(ctx context.Context) error {
 		return nil
 	}
 
-	batch := h.networkBatch
+	batch, samples, pending := h.networkBatch, h.batchSamples, h.batchPending
 	h.networkBatch = make([]models.NetworkPacket, 0, h.cfg.BatchSize)
-	h.lastBatchTime = time.Now()
+	h.batchSamples = nil
+	h.batchPending = nil
+	h.lastBatchTime = h.clock.Now()
 	h.batchMutex.Unlock()
 
 	// Save to database
+	started := h.clock.Now()
 	if err := h.db.SaveNetworkPackets(ctx, batch); err != nil {
-		return fmt.Errorf("save network batch: %w", err)
+		// Agents whose shard committed before the failure are acked, so
+		// their retries are recognised as duplicates, and only the rest of
+		// the batch is kept or lost
+		batch, pending = h.splitStoredPackets(batch, pending, err)
+		if cancelled(ctx, err) {
+			h.requeueNetworkBatch(batch, samples, pending)
+			return fmt.Errorf("save network batch: %w: %w", errFlushDeferred, err)
+		}
+		// The database being away is worth retrying on the next flush; the
+		// memory budget sheds the batch if it grows too long meanwhile. A
+		// batch the database rejected would only fail again, so it is lost,
+		// and agents' retries of it are stored.
+		if db.Unavailable(err) {
+			h.requeueNetworkBatch(batch, samples, pending)
+			return fmt.Errorf("save network batch, kept for the next flush: %w", err)
+		}
+		h.releaseBatches(pending)
+		return fmt.Errorf("save network batch, %d packets lost: %w", len(batch), err)
 	}
+	h.latency.flushed(samples, started, h.clock.Now())
+	h.confirmBatches(pending)
+
+	h.publishNetworkBatch(batch)
 
 	// Stream to subscribers
-	select {
-	case h.networkStreamCh <- batch:
-	default:
-		log.Printf("[TUNNEL] Network stream channel full, dropped %d packets", len(batch))
-	}
+	h.streamNetworkBatch(batch)
 
 	return nil
 }
 
+// splitStoredPackets confirms the batches of agents whose packets a failed
+// SaveNetworkPackets stored and returns the packets and batches it didn't
+func (h *Handler) splitStoredPackets(batch []models.NetworkPacket, pending []pendingBatch, err error) ([]models.NetworkPacket, []pendingBatch) {
+	var unstored []models.NetworkPacket
+	for _, p := range batch {
+		if !h.db.Committed(p.AgentID, err) {
+			unstored = append(unstored, p)
+		}
+	}
+	var stored, unconfirmed []pendingBatch
+	for _, p := range pending {
+		if h.db.Committed(p.agentID, err) {
+			stored = append(stored, p)
+		} else {
+			unconfirmed = append(unconfirmed, p)
+		}
+	}
+	h.confirmBatches(stored)
+	return unstored, unconfirmed
+}
+
+// flushOnDisconnect persists pending packets as soon as an agent goes away
+// rather than waiting for the next tick. The batch is shared, so this also
+// flushes other agents' packets, which is harmless.
+func (h *Handler) flushOnDisconnect(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(h.ctx, 10*time.Second)
+	defer cancel()
+
+	if err := h.flushNetworkBatch(ctx); err != nil && !errors.Is(err, errFlushDeferred) {
+		log.Printf("[TUNNEL] Error flushing network batch on disconnect of %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
 // Helper functions
 func isFileChanged(a, b models.FileNode) bool {
 	return a.ModTime != b.ModTime ||
 		a.Size != b.Size ||
 		a.IsDirectory != b.IsDirectory ||
-		a.IsGzipped != b.IsGzipped
+		a.IsGzipped != b.IsGzipped ||
+		a.IsScraped != b.IsScraped ||
+		a.ScrapeState != b.ScrapeState ||
+		a.Generation != b.Generation
 }
 
-// Channel accessors
-func (h *Handler) NetworkStream() <-chan []models.NetworkPacket {
-	return h.networkStreamCh
+// scrapeStateAliases maps spellings used by older agents to canonical states
+var scrapeStateAliases = map[string]string{
+	"done":      models.ScrapeStateScraped,
+	"complete":  models.ScrapeStateScraped,
+	"pending":   models.ScrapeStatePendingDecompress,
+	"too_large": models.ScrapeStateSkippedTooLarge,
+	"skipped":   models.ScrapeStateSkippedTooLarge,
 }
 
-func (h *Handler) LogStream() <-chan models.LogEntry {
-	return h.logStreamCh
+// scrapeState maps the agent-reported state to a canonical one. Agents that
+// report no state get one derived from the flags; unknown states from newer
+// agents are kept verbatim.
+func scrapeState(f models.FileNode) string {
+	if f.ScrapeState != "" {
+		if canonical, ok := scrapeStateAliases[f.ScrapeState]; ok {
+			return canonical
+		}
+		return f.ScrapeState
+	}
+
+	switch {
+	case f.IsDirectory:
+		return ""
+	case f.IsScraped:
+		return models.ScrapeStateScraped
+	case f.IsGzipped:
+		return models.ScrapeStatePendingDecompress
+	default:
+		return ""
+	}
 }
 
-func (h *Handler) FileUpdates() <-chan models.FileNode {
-	return h.fileUpdateCh
+// NetworkSince returns recently streamed packets newer than t, oldest first.
+// Only the last NetworkReplayBatches batches are kept, so this is best-effort.
+func (h *Handler) NetworkSince(t time.Time) [][]models.NetworkPacket {
+	return h.networkHistory.since(t)
 }
 
 // Close handles graceful shutdown
 func (h *Handler) Close() {
 	h.shutdownOnce.Do(func() {
+		// Stop background work, cutting short any write in progress, then
+		// store what is left under a fresh deadline
 		close(h.shutdownCh)
-		_ = h.flushNetworkBatch(context.Background())
+		h.cancel()
+		h.workers.Wait()
+
+		if !h.cfg.ReadOnly {
+			ctx, cancel := context.WithTimeout(context.Background(), h.cfg.ShutdownDrainTimeout)
+			defer cancel()
+			h.drain(ctx)
+		}
 
-		close(h.networkStreamCh)
-		close(h.logStreamCh)
-		close(h.fileUpdateCh)
+		h.closeStreams()
 	})
 }
@@ -0,0 +1,342 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// openTestDB connects to the database TEST_DATABASE_URL names, migrating it,
+// and empties the given tables. Tests needing it are skipped when the
+// variable isn't set.
+func openTestDB(tb testing.TB, tables ...string) *db.DB {
+	tb.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		tb.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	defer conn.Close(ctx)
+	for _, table := range tables {
+		if _, err := conn.Exec(ctx, "TRUNCATE "+table+" CASCADE"); err != nil {
+			tb.Fatalf("truncate %s: %v", table, err)
+		}
+	}
+
+	d, err := db.New(ctx, &config.Config{
+		DatabaseURL:     url,
+		InitialBackoff:  10 * time.Millisecond,
+		MaxBackoff:      100 * time.Millisecond,
+		FailoverTimeout: time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("connect to test database: %v", err)
+	}
+	tb.Cleanup(d.Close)
+	return d
+}
+
+// newTestHandler returns a handler on the test database, with the
+// configuration loaded from the environment and then adjusted by configure,
+// and a fake clock at now
+func newTestHandler(t *testing.T, now time.Time, configure func(*config.Config), tables ...string) *Handler {
+	t.Helper()
+	database := openTestDB(t, tables...)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DatabaseURL = os.Getenv("TEST_DATABASE_URL")
+	if configure != nil {
+		configure(cfg)
+	}
+	h := NewHandler(cfg, database, clock.NewFake(now))
+	t.Cleanup(h.Close)
+	return h
+}
+
+// connectAgent runs a connection to h as the returned agent end, whose
+// incoming messages are discarded. The returned channel is closed when the
+// handler is done with the connection.
+func connectAgent(t *testing.T, h *Handler) (net.Conn, <-chan struct{}) {
+	t.Helper()
+	agent, server := net.Pipe()
+	t.Cleanup(func() { agent.Close() })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.HandleConnection(context.Background(), server)
+	}()
+	go io.Copy(io.Discard, agent)
+	return agent, done
+}
+
+// send writes one message as an agent would
+func send(t *testing.T, conn net.Conn, typ MessageType, payload interface{}) {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewEncoder(conn).Encode(Message{Type: typ, Payload: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// captureLog sends the standard logger's output to the returned buffer
+// until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestApplyFileChangesReconcilesDrift(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := &Handler{
+		db:         openTestDB(t, "files"),
+		clock:      clock.NewFake(now),
+		fileCache:  newFileCache(),
+		watermarks: newIngestWatermarks(),
+	}
+
+	// The cache has a file the database doesn't, e.g. deleted elsewhere
+	cached := models.FileNode{Path: "/var/log/app.log", ParentPath: "/var/log", Name: "app.log", Size: 1, ModTime: now}
+	h.fileCache.apply(nil, []models.FileNode{cached})
+
+	changed := cached
+	changed.Size = 2
+	changes := h.detectFileChanges([]models.FileNode{changed})
+	if len(changes.updated) != 1 {
+		t.Fatalf("detected changes = %+v, want one update", changes)
+	}
+
+	logs := captureLog(t)
+	if err := h.applyFileChanges(context.Background(), changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := h.ingest.filesDrifted.Load(); got != 1 {
+		t.Errorf("files drifted = %d, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "1 updated files weren't stored") {
+		t.Errorf("no reconciliation logged: %q", logs.String())
+	}
+	stored, err := h.db.GetFileByPath(context.Background(), cached.Path)
+	if err != nil {
+		t.Fatalf("drifted file wasn't stored: %v", err)
+	}
+	if stored.Size != 2 {
+		t.Errorf("stored size = %d, want 2", stored.Size)
+	}
+}
+
+func TestPartialBatchFlushedOnDisconnect(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, flush := range []bool{true, false} {
+		t.Run(fmt.Sprintf("flush on disconnect %v", flush), func(t *testing.T) {
+			h := newTestHandler(t, now, func(cfg *config.Config) {
+				cfg.FlushOnDisconnect = flush
+				cfg.BatchSize = 1000
+			}, "network_packets")
+
+			agent, done := connectAgent(t, h)
+			packets := []models.NetworkPacket{
+				{Timestamp: now.Add(-2 * time.Second), Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", DstPort: 443, Length: 60},
+				{Timestamp: now.Add(-time.Second), Protocol: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.3", DstPort: 53, Length: 80},
+			}
+			send(t, agent, TypeMetrics, map[string]interface{}{"packets": packets})
+			agent.Close()
+			<-done
+
+			stored, err := h.db.GetNetworkPackets(context.Background(), now.Add(-time.Minute), now, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if flush {
+				want = len(packets)
+			}
+			if len(stored) != want {
+				t.Errorf("stored %d packets after the disconnect, want %d", len(stored), want)
+			}
+		})
+	}
+}
+
+func TestScrapeState(t *testing.T) {
+	tests := []struct {
+		name string
+		file models.FileNode
+		want string
+	}{
+		{name: "plain file", file: models.FileNode{}, want: ""},
+		{name: "directory", file: models.FileNode{IsDirectory: true, IsGzipped: true}, want: ""},
+		{name: "gzipped, not scraped", file: models.FileNode{IsGzipped: true}, want: models.ScrapeStatePendingDecompress},
+		{name: "gzipped and scraped", file: models.FileNode{IsGzipped: true, IsScraped: true}, want: models.ScrapeStateScraped},
+		{name: "scraped", file: models.FileNode{IsScraped: true}, want: models.ScrapeStateScraped},
+		{name: "canonical state", file: models.FileNode{IsGzipped: true, ScrapeState: models.ScrapeStateSkippedTooLarge}, want: models.ScrapeStateSkippedTooLarge},
+		{name: "state wins over flags", file: models.FileNode{IsScraped: true, ScrapeState: models.ScrapeStatePendingDecompress}, want: models.ScrapeStatePendingDecompress},
+		{name: "older agent's done", file: models.FileNode{ScrapeState: "done"}, want: models.ScrapeStateScraped},
+		{name: "older agent's complete", file: models.FileNode{ScrapeState: "complete"}, want: models.ScrapeStateScraped},
+		{name: "older agent's pending", file: models.FileNode{ScrapeState: "pending"}, want: models.ScrapeStatePendingDecompress},
+		{name: "older agent's too_large", file: models.FileNode{ScrapeState: "too_large"}, want: models.ScrapeStateSkippedTooLarge},
+		{name: "older agent's skipped", file: models.FileNode{ScrapeState: "skipped"}, want: models.ScrapeStateSkippedTooLarge},
+		{name: "newer agent's state", file: models.FileNode{IsGzipped: true, ScrapeState: "decompressing_remotely"}, want: "decompressing_remotely"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scrapeState(tt.file); got != tt.want {
+				t.Errorf("scrapeState = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeStateTransitions(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files")
+	agent, done := connectAgent(t, h)
+
+	file := models.FileNode{Path: "/var/log/app.log.1.gz", ParentPath: "/var/log", Name: "app.log.1.gz", Size: 4096, ModTime: now, IsGzipped: true}
+	for _, step := range []struct {
+		reported string
+		want     string
+	}{
+		{reported: "", want: models.ScrapeStatePendingDecompress},
+		{reported: models.ScrapeStateSkippedTooLarge, want: models.ScrapeStateSkippedTooLarge},
+		{reported: "pending", want: models.ScrapeStatePendingDecompress},
+		{reported: "done", want: models.ScrapeStateScraped},
+		{reported: "archived_elsewhere", want: "archived_elsewhere"},
+	} {
+		file.ScrapeState = step.reported
+		file.ModTime = file.ModTime.Add(time.Second)
+		send(t, agent, TypeLogList, []models.FileNode{file})
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stored, err := h.db.GetFileByPath(context.Background(), file.Path)
+			if err == nil && stored.ScrapeState == step.want {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("after reporting %q: stored %+v (%v), want state %q", step.reported, stored, err, step.want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	agent.Close()
+	<-done
+}
+
+func TestUnusualPathsKeyCacheAndRows(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files", "logs")
+	ctx := context.Background()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+	process := func(typ MessageType, payload interface{}) {
+		t.Helper()
+		data, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.processMessage(ctx, agent, Message{Type: typ, Payload: data}); err != nil {
+			t.Fatalf("%s: %v", typ, err)
+		}
+	}
+
+	files := []struct{ reported, key, parent string }{
+		{"/var/log/my app/weird#file (1).log", "/var/log/my app/weird#file (1).log", "/var/log/my app"},
+		{"/var/log/журнал/ошибки.log", "/var/log/журнал/ошибки.log", "/var/log/журнал"},
+		// Agents on some platforms report paths without the leading slash
+		{"var/log/100%.log", "/var/log/100%.log", "/var/log"},
+	}
+	var list []models.FileNode
+	for _, f := range files {
+		list = append(list, models.FileNode{Path: f.reported, ParentPath: f.parent, Name: f.key[len(f.parent)+1:], ModTime: now})
+	}
+	process(TypeLogList, list)
+
+	tail := h.SubscribeLogs(func(p string) bool { return p == files[0].key })
+	defer h.UnsubscribeLogs(tail)
+	process(TypeLogData, []models.LogEntry{{Filename: files[0].reported, Line: "weird", LineNum: 1, Timestamp: now}})
+
+	for _, f := range files {
+		cached, ok := h.fileCache.get(f.key)
+		if !ok || cached.ParentPath != f.parent {
+			t.Errorf("%s: cached %+v (found %v), want parent %s", f.key, cached, ok, f.parent)
+		}
+		stored, err := h.db.GetFileByPath(ctx, f.key)
+		if err != nil || stored.Path != f.key {
+			t.Errorf("%s: stored %+v, %v", f.key, stored, err)
+		}
+	}
+	select {
+	case entry := <-tail:
+		if entry.Filename != files[0].key {
+			t.Errorf("tailed %q, want %q", entry.Filename, files[0].key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("line of the unusual path never reached its tail")
+	}
+}
+
+func TestPacketsMicrosecondsApartThroughIngest(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) {
+		cfg.FlushOnDisconnect = true
+		cfg.BatchSize = 1000
+	}, "network_packets")
+
+	agent, done := connectAgent(t, h)
+	start := now.Add(-time.Second)
+	packets := make([]models.NetworkPacket, 500)
+	for i := range packets {
+		// Nanoseconds below the stored precision are dropped on arrival
+		packets[i] = models.NetworkPacket{Timestamp: start.Add(time.Duration(i)*time.Microsecond + 300), Protocol: "UDP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: i, Length: 60}
+	}
+	send(t, agent, TypeMetrics, map[string]interface{}{"packets": packets})
+	agent.Close()
+	<-done
+
+	stored, err := h.db.GetNetworkPackets(context.Background(), start, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(packets) {
+		t.Fatalf("stored %d packets, want %d", len(stored), len(packets))
+	}
+	for i, p := range stored {
+		want := packets[len(packets)-1-i]
+		if !p.Timestamp.Equal(want.Timestamp.Truncate(time.Microsecond)) || p.SrcPort != want.SrcPort {
+			t.Fatalf("packet %d = %s port %d, want %s port %d", i, p.Timestamp.Format(time.RFC3339Nano), p.SrcPort,
+				want.Timestamp.Truncate(time.Microsecond).Format(time.RFC3339Nano), want.SrcPort)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+// Capabilities an agent may offer in hello. The server answers with those
+// it supports, and the agent uses only those.
+const (
+	// log_list payloads may use a compact encoding, see compactFileList
+	capCompactFileList = "compact_file_list"
+	// The agent applies agent_config pushes and acks them
+	capAgentConfig = "agent_config"
+)
+
+var serverCapabilities = map[string]bool{
+	capCompactFileList: true,
+	capAgentConfig:     true,
+}
+
+// Hello is exchanged when an agent connects: the agent lists what it can do
+// and the server replies with the subset it supports. Servers that predate
+// hello skip it as an unknown type and never reply, so agents should keep to
+// the plain protocol until they get an answer.
+type Hello struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+func (h *Handler) handleHello(ctx context.Context, agent *agentConn, payload json.RawMessage) error {
+	var hello Hello
+	if err := unmarshalPayload(payload, &hello); err != nil {
+		return err
+	}
+
+	accepted := []string{}
+	for _, c := range hello.Capabilities {
+		if serverCapabilities[c] {
+			accepted = append(accepted, c)
+		}
+	}
+
+	data, err := json.Marshal(Hello{Capabilities: accepted})
+	if err != nil {
+		return err
+	}
+	if err := agent.send(Message{Type: TypeHello, Payload: data}); err != nil {
+		log.Printf("[TUNNEL] Failed to answer hello from %s: %v", agent.id, err)
+		return nil
+	}
+
+	for _, c := range accepted {
+		if c == capAgentConfig {
+			agent.configurable.Store(true)
+			h.pushAgentConfig(ctx, agent)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"diagnostic-client/pkg/models"
+)
+
+// IgnorePaths returns the current file path denylist
+func (h *Handler) IgnorePaths() []string {
+	return h.ignore.Patterns()
+}
+
+// SetIgnorePaths replaces the file path denylist and removes files it now
+// hides
+func (h *Handler) SetIgnorePaths(ctx context.Context, patterns []string) error {
+	if err := h.ignore.Set(patterns); err != nil {
+		return err
+	}
+	return h.purgeIgnoredFiles(ctx)
+}
+
+// purgeIgnoredFiles deletes cached files matching the denylist, along with
+// their logs. A read-only server leaves that to the primary.
+func (h *Handler) purgeIgnoredFiles(ctx context.Context) error {
+	if h.cfg.ReadOnly {
+		return nil
+	}
+	changes := &fileChanges{}
+
+	h.fileCache.each(func(file models.FileNode) {
+		if h.ignore.Match(file.Path) {
+			changes.deleted = append(changes.deleted, file.Path)
+		}
+	})
+
+	if changes.isEmpty() {
+		return nil
+	}
+
+	if err := h.applyFileChanges(ctx, changes); err != nil {
+		return fmt.Errorf("delete ignored files: %w", err)
+	}
+	log.Printf("[TUNNEL] Removed %d ignored files", len(changes.deleted))
+	return nil
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"diagnostic-client/pkg/models"
+)
+
+// IngestStats counts adjustments made to agent data before it is stored
+type IngestStats struct {
+	LinesTruncated int64 `json:"lines_truncated"`
+	BytesTruncated int64 `json:"bytes_truncated"`
+	// Messages of a known type whose payload couldn't be decoded
+	MalformedMessages int64 `json:"malformed_messages"`
+	// Messages of a type this server doesn't handle, skipped
+	UnknownMessages int64 `json:"unknown_messages"`
+	// Connections closed for exceeding the malformed message budget
+	ProtocolDisconnects int64 `json:"protocol_disconnects"`
+	// Metrics batches received again, e.g. on a retry, and not stored twice
+	DuplicateBatches int64 `json:"duplicate_batches"`
+	DuplicatePackets int64 `json:"duplicate_packets"`
+	// Packets dropped for carrying less payload than the minimum
+	PacketsFiltered int64 `json:"packets_filtered"`
+	// Log lines at or below their file's stored line number, sent again
+	// after a restart or re-scrape, and not stored twice
+	LinesAlreadyStored int64 `json:"lines_already_stored"`
+	// Changed files the file cache had but the database didn't, stored again
+	FilesDrifted int64 `json:"files_drifted"`
+	// Log lines dropped by sampling rules, per file
+	LinesSampledOut map[string]int64 `json:"lines_sampled_out"`
+	// Packet latency per pipeline stage, in milliseconds
+	Latency map[string]LatencyStats `json:"latency"`
+}
+
+type ingestCounters struct {
+	linesTruncated      atomic.Int64
+	bytesTruncated      atomic.Int64
+	malformedMessages   atomic.Int64
+	unknownMessages     atomic.Int64
+	protocolDisconnects atomic.Int64
+	duplicateBatches    atomic.Int64
+	duplicatePackets    atomic.Int64
+	packetsFiltered     atomic.Int64
+	linesAlreadyStored  atomic.Int64
+	filesDrifted        atomic.Int64
+}
+
+// IngestStats returns the ingest counters since startup
+func (h *Handler) IngestStats() IngestStats {
+	return IngestStats{
+		LinesTruncated:      h.ingest.linesTruncated.Load(),
+		BytesTruncated:      h.ingest.bytesTruncated.Load(),
+		MalformedMessages:   h.ingest.malformedMessages.Load(),
+		UnknownMessages:     h.ingest.unknownMessages.Load(),
+		ProtocolDisconnects: h.ingest.protocolDisconnects.Load(),
+		DuplicateBatches:    h.ingest.duplicateBatches.Load(),
+		DuplicatePackets:    h.ingest.duplicatePackets.Load(),
+		PacketsFiltered:     h.ingest.packetsFiltered.Load(),
+		LinesAlreadyStored:  h.ingest.linesAlreadyStored.Load(),
+		FilesDrifted:        h.ingest.filesDrifted.Load(),
+		LinesSampledOut:     h.logSampler.linesSampledOut(),
+		Latency:             h.latency.stats(),
+	}
+}
+
+// MinPayloadSize returns the smallest payload a packet needs to be stored
+func (h *Handler) MinPayloadSize() int {
+	return int(h.minPayloadSize.Load())
+}
+
+// SetMinPayloadSize changes the minimum payload for packets received from
+// now on; 0 stores every packet
+func (h *Handler) SetMinPayloadSize(size int) {
+	h.minPayloadSize.Store(int64(size))
+}
+
+// filterPayloads drops packets carrying less payload than the minimum, such
+// as pure ACKs
+func (h *Handler) filterPayloads(packets []models.NetworkPacket) []models.NetworkPacket {
+	min := h.MinPayloadSize()
+	if min <= 0 {
+		return packets
+	}
+
+	kept := packets[:0]
+	for _, p := range packets {
+		if p.PayloadSize >= min {
+			kept = append(kept, p)
+		}
+	}
+	if dropped := len(packets) - len(kept); dropped > 0 {
+		h.ingest.packetsFiltered.Add(int64(dropped))
+	}
+	return kept
+}
+
+// truncateLines cuts lines longer than the configured maximum, marking them
+// so readers know the stored text is incomplete
+func (h *Handler) truncateLines(logs []models.LogEntry) {
+	max := h.cfg.MaxLogLineLength
+	if max <= 0 {
+		return
+	}
+
+	for i := range logs {
+		line, cut := truncateLine(logs[i].Line, max)
+		if cut == 0 {
+			continue
+		}
+		logs[i].Line = line
+		logs[i].Truncated = true
+		h.ingest.linesTruncated.Add(1)
+		h.ingest.bytesTruncated.Add(int64(cut))
+	}
+}
+
+// truncateLine shortens line to at most max bytes of content, backing off to
+// a rune boundary, and appends a marker. It returns the number of bytes cut.
+func truncateLine(line string, max int) (string, int) {
+	if len(line) <= max {
+		return line, 0
+	}
+
+	end := max
+	for end > 0 && !utf8.RuneStart(line[end]) {
+		end--
+	}
+
+	cut := len(line) - end
+	return line[:end] + fmt.Sprintf(" …[truncated %d bytes]", cut), cut
+}
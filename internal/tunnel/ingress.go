@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ingress delivers agent connections to a Server: the dedicated TCP
+// listener, or a WSIngress fed by the HTTP server. net.Listener satisfies it.
+type Ingress interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// Listen opens the dedicated agent port on AGENT_ADDR
+func Listen(ctx context.Context, cfg *config.Config) (Ingress, error) {
+	return listen(ctx, cfg)
+}
+
+// WSIngress accepts agents on the HTTP server, at /agent/ws, when
+// AGENT_ADDR is "shared". Each websocket message carries one protocol
+// message, so the connections it hands out read and write like the TCP ones.
+type WSIngress struct {
+	upgrader websocket.Upgrader
+	clientIP func(*http.Request) string
+	conns    chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewWSIngress creates the websocket ingress. clientIP resolves the agent
+// address, which identifies the agent, through trusted proxies.
+func NewWSIngress(clientIP func(*http.Request) string) *WSIngress {
+	return &WSIngress{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  64 << 10,
+			WriteBufferSize: 4 << 10,
+			// Agents aren't browsers; a request with an Origin is a page
+			// trying to pass itself off as one
+			CheckOrigin: func(r *http.Request) bool { return r.Header.Get("Origin") == "" },
+		},
+		clientIP: clientIP,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades an agent and hands the connection to the Server
+func (i *WSIngress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-i.done:
+		http.Error(w, "not accepting agents", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	ws, err := i.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[TUNNEL] Agent websocket upgrade failed: %v", err)
+		return
+	}
+	conn := &wsConn{ws: ws, remote: hostAddr{network: "ws", host: i.clientIP(r)}}
+
+	select {
+	case i.conns <- conn:
+	case <-i.done:
+		conn.Close()
+	}
+}
+
+func (i *WSIngress) Accept() (net.Conn, error) {
+	select {
+	case conn := <-i.conns:
+		return conn, nil
+	case <-i.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (i *WSIngress) Close() error {
+	i.once.Do(func() { close(i.done) })
+	return nil
+}
+
+func (i *WSIngress) Addr() net.Addr {
+	return hostAddr{network: "ws", host: "/agent/ws"}
+}
+
+// hostAddr is the address of a connection that didn't come from the TCP
+// listener. Its host is what newAgentConn takes as the agent ID of agents
+// that don't register.
+type hostAddr struct {
+	network string
+	host    string
+}
+
+func (a hostAddr) Network() string { return a.network }
+func (a hostAddr) String() string  { return net.JoinHostPort(a.host, "0") }
+
+// wsConn presents a websocket as a net.Conn: reads run across message
+// boundaries and each write is sent as one text message
+type wsConn struct {
+	ws     *websocket.Conn
+	remote net.Addr
+	r      io.Reader
+	wmu    sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.ws.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close says goodbye if it can, then drops the connection
+func (c *wsConn) Close() error {
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialIngress connects a fake agent to the ingress behind srv and returns
+// both ends of the connection
+func dialIngress(t *testing.T, srv *httptest.Server, ing *WSIngress) (*websocket.Conn, net.Conn) {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	conn, err := ing.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return ws, conn
+}
+
+func TestWSIngressCarriesProtocolMessages(t *testing.T) {
+	ing := NewWSIngress(func(*http.Request) string { return "10.0.0.7" })
+	srv := httptest.NewServer(ing)
+	defer srv.Close()
+	defer ing.Close()
+
+	ws, conn := dialIngress(t, srv, ing)
+	if id := newAgentConn(conn, time.Now()).id; id != "10.0.0.7" {
+		t.Errorf("agent ID = %q, want the client address", id)
+	}
+
+	// A message split over websocket messages and two in one
+	for _, part := range []string{
+		`{"type": "hello", "payload": {}}` + "\n",
+		`{"type": "log_`,
+		`data", "payload": []}` + "\n" + `{"type": "metrics", "payload": []}` + "\n",
+	} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := json.NewDecoder(conn)
+	for _, want := range []MessageType{TypeHello, TypeLogData, TypeMetrics} {
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != want {
+			t.Errorf("read %s, want %s", msg.Type, want)
+		}
+	}
+
+	// Each write reaches the agent as one message
+	agent := newAgentConn(conn, time.Now())
+	if err := agent.send(Message{Type: TypeScrape, Payload: json.RawMessage(`{"path": "/var/log/a.log"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != TypeScrape {
+		t.Errorf("agent received %s, want one scrape message", data)
+	}
+
+	// A normal close reads as the end of the stream
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	var rest Message
+	if err := decoder.Decode(&rest); !errors.Is(err, io.EOF) {
+		t.Errorf("read after close: %v, want EOF", err)
+	}
+}
+
+func TestWSIngressRefusesBrowsersAndAfterClose(t *testing.T) {
+	ing := NewWSIngress(func(*http.Request) string { return "10.0.0.7" })
+	srv := httptest.NewServer(ing)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil {
+		t.Fatal("page with an Origin connected as an agent")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("browser upgrade response = %v, want 403", resp)
+	}
+
+	ing.Close()
+	if _, err := ing.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close: %v, want net.ErrClosed", err)
+	}
+	_, resp, err = websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("upgrade after Close = %v, %v; want 503", resp, err)
+	}
+}
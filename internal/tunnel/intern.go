@@ -0,0 +1,51 @@
+package tunnel
+
+import "sync"
+
+// Sizes of the intern tables. Each holds up to twice its size, see
+// internTable.
+const (
+	internPaths = 1 << 16
+	internNames = 1 << 10 // Protocols, TCP flags and levels
+)
+
+// internTable makes equal strings share one backing array, so the same
+// path or protocol repeated across millions of decoded entries is stored
+// once. It keeps two generations: when the current one fills up it becomes
+// the previous one and the old previous one is dropped, so memory stays
+// bounded while strings still in use survive by being promoted on lookup.
+type internTable struct {
+	mu       sync.Mutex
+	max      int
+	current  map[string]string
+	previous map[string]string
+}
+
+func newInternTable(max int) *internTable {
+	return &internTable{max: max, current: make(map[string]string)}
+}
+
+// intern returns the shared copy of s, adding s if there is none
+func (t *internTable) intern(s string) string {
+	if s == "" {
+		return s
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if shared, ok := t.current[s]; ok {
+		return shared
+	}
+	shared, ok := t.previous[s]
+	if !ok {
+		shared = s
+	}
+
+	if len(t.current) >= t.max {
+		t.previous = t.current
+		t.current = make(map[string]string, t.max)
+	}
+	t.current[shared] = shared
+	return shared
+}
@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"diagnostic-client/pkg/models"
+)
+
+func TestInternSharesBackingArray(t *testing.T) {
+	table := newInternTable(8)
+	a := strings.Repeat("/var/log/app.log", 1)
+	b := string([]byte("/var/log/app.log"))
+	if unsafe.StringData(a) == unsafe.StringData(b) {
+		t.Fatal("test strings already share storage")
+	}
+
+	ia, ib := table.intern(a), table.intern(b)
+	if ia != a || ib != b || unsafe.StringData(ia) != unsafe.StringData(ib) {
+		t.Error("equal strings interned to different storage")
+	}
+	if table.intern("") != "" {
+		t.Error("empty string not returned as is")
+	}
+}
+
+func TestInternIsBounded(t *testing.T) {
+	const max = 100
+	table := newInternTable(max)
+	hot := table.intern("/var/log/hot.log")
+
+	for i := 0; i < 50*max; i++ {
+		table.intern(fmt.Sprintf("/var/log/%d.log", i))
+		// A string still in use is promoted before its generation is dropped
+		if i%(max/2) == 0 {
+			if got := table.intern(string([]byte("/var/log/hot.log"))); unsafe.StringData(got) != unsafe.StringData(hot) {
+				t.Fatalf("hot string lost its shared copy after %d others", i)
+			}
+		}
+		if n := len(table.current) + len(table.previous); n > 2*max {
+			t.Fatalf("table holds %d strings, over twice its size %d", n, max)
+		}
+	}
+	if _, ok := table.current["/var/log/0.log"]; ok {
+		t.Error("long unused string still held")
+	}
+	if _, ok := table.previous["/var/log/0.log"]; ok {
+		t.Error("long unused string still held")
+	}
+}
+
+// logBatches encodes lines as log_data payloads spread over files, each
+// with a long, realistic path
+func logBatches(lines, files, batch int) [][]byte {
+	var batches [][]byte
+	for start := 0; start < lines; start += batch {
+		logs := make([]models.LogEntry, 0, batch)
+		for i := start; i < start+batch && i < lines; i++ {
+			logs = append(logs, models.LogEntry{
+				Filename: fmt.Sprintf("/var/log/containers/service-%03d/application-current.log", i%files),
+				Line:     "GET /",
+				LineNum:  i,
+				Level:    "INFO",
+			})
+		}
+		data, _ := json.Marshal(logs)
+		batches = append(batches, data)
+	}
+	return batches
+}
+
+// decodeRetained decodes the batches as handleLogData does, interning with
+// tables unless they are nil, and returns the heap bytes the decoded
+// entries keep alive
+func decodeRetained(tb testing.TB, batches [][]byte, paths, names *internTable) int64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	var kept []models.LogEntry
+	for _, data := range batches {
+		var logs []models.LogEntry
+		if err := json.Unmarshal(data, &logs); err != nil {
+			tb.Fatal(err)
+		}
+		if paths != nil {
+			for i := range logs {
+				logs[i].Filename = paths.intern(logs[i].Filename)
+				logs[i].Level = names.intern(logs[i].Level)
+			}
+		}
+		kept = append(kept, logs...)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// The input must not be collected in between either
+	runtime.KeepAlive(kept)
+	runtime.KeepAlive(batches)
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
+
+func TestInterningReducesRetainedMemory(t *testing.T) {
+	const lines = 100_000
+	batches := logBatches(lines, 200, 1000)
+
+	plain := decodeRetained(t, batches, nil, nil)
+	interned := decodeRetained(t, batches, newInternTable(internPaths), newInternTable(internNames))
+
+	// Each line drops its own copy of a 55-byte path, a 64-byte allocation
+	saved := (plain - interned) / lines
+	t.Logf("retained %d B/line plain, %d B/line interned", plain/lines, interned/lines)
+	if saved < 48 {
+		t.Errorf("interning saved %d B/line, want at least 48", saved)
+	}
+}
+
+// BenchmarkInternedIngest decodes 1M lines across 200 files, reporting the
+// heap each line keeps alive with and without interning
+func BenchmarkInternedIngest(b *testing.B) {
+	batches := logBatches(1_000_000, 200, 1000)
+	for _, intern := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%v", intern), func(b *testing.B) {
+			b.ReportAllocs()
+			var retained int64
+			for i := 0; i < b.N; i++ {
+				var paths, names *internTable
+				if intern {
+					paths, names = newInternTable(internPaths), newInternTable(internNames)
+				}
+				retained = decodeRetained(b, batches, paths, names)
+			}
+			b.ReportMetric(float64(retained)/1_000_000, "retained-B/line")
+		})
+	}
+}
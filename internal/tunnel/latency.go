@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// Stages of the packet ingest pipeline whose latency is tracked
+const (
+	stageReceive  = "receive"    // Capture on the agent to decoded on the server
+	stageBatch    = "batch"      // Decoded to the start of the batch flush
+	stageCommit   = "commit"     // Flush start to database commit
+	stageEndToEnd = "end_to_end" // Capture to commit and hand-off to the live streams
+)
+
+// recentLatencies is how many samples per stage the percentiles cover
+const recentLatencies = 512
+
+// latencyBucketsMs are the upper bounds of the latency histogram buckets
+var latencyBucketsMs = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// LatencyBucket counts samples at or below LeMs, cumulatively
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms"`
+	Count int64   `json:"count"`
+}
+
+// LatencyStats summarizes one pipeline stage. Buckets and totals cover all
+// samples since startup; the percentiles only the most recent ones.
+type LatencyStats struct {
+	Count   int64           `json:"count"`
+	SumMs   float64         `json:"sum_ms"`
+	P50Ms   float64         `json:"p50_ms"`
+	P95Ms   float64         `json:"p95_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+type latencyHistogram struct {
+	counts []int64 // Per bucket, plus one for samples above the last bound
+	count  int64
+	sum    time.Duration
+	recent [recentLatencies]time.Duration
+	next   int
+}
+
+func (l *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(latencyBucketsMs, ms)
+	l.counts[i]++
+	l.count++
+	l.sum += d
+	l.recent[l.next%recentLatencies] = d
+	l.next++
+}
+
+func (l *latencyHistogram) stats() LatencyStats {
+	s := LatencyStats{
+		Count:   l.count,
+		SumMs:   float64(l.sum) / float64(time.Millisecond),
+		Buckets: make([]LatencyBucket, len(latencyBucketsMs)),
+	}
+
+	var cumulative int64
+	for i, le := range latencyBucketsMs {
+		cumulative += l.counts[i]
+		s.Buckets[i] = LatencyBucket{LeMs: le, Count: cumulative}
+	}
+
+	n := l.next
+	if n > recentLatencies {
+		n = recentLatencies
+	}
+	if n > 0 {
+		recent := append([]time.Duration(nil), l.recent[:n]...)
+		sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+		s.P50Ms = float64(recent[n*50/100]) / float64(time.Millisecond)
+		s.P95Ms = float64(recent[n*95/100]) / float64(time.Millisecond)
+	}
+	return s
+}
+
+// latencySample follows one packet of a metrics message through the
+// pipeline. Only one packet per message is measured, so the cost doesn't
+// grow with batch size.
+type latencySample struct {
+	captured time.Time
+	received time.Time
+}
+
+// ingestLatency tracks packet latency per pipeline stage. Agents don't
+// report their clock, so skew isn't corrected; latencies an agent clock
+// running ahead would make negative are counted as zero.
+type ingestLatency struct {
+	mu     sync.Mutex
+	stages map[string]*latencyHistogram
+}
+
+func newIngestLatency() *ingestLatency {
+	l := &ingestLatency{stages: make(map[string]*latencyHistogram)}
+	for _, stage := range []string{stageReceive, stageBatch, stageCommit, stageEndToEnd} {
+		l.stages[stage] = &latencyHistogram{counts: make([]int64, len(latencyBucketsMs)+1)}
+	}
+	return l
+}
+
+func (l *ingestLatency) observe(stage string, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	l.mu.Lock()
+	l.stages[stage].observe(d)
+	l.mu.Unlock()
+}
+
+// sample measures the receive stage of a decoded message and returns the
+// sample to carry to the flush
+func (l *ingestLatency) sample(packets []models.NetworkPacket, now time.Time) latencySample {
+	s := latencySample{captured: packets[len(packets)-1].Timestamp, received: now}
+	l.observe(stageReceive, now.Sub(s.captured))
+	return s
+}
+
+// flushed measures the remaining stages of the samples in a committed batch
+func (l *ingestLatency) flushed(samples []latencySample, started, committed time.Time) {
+	if len(samples) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range samples {
+		l.stages[stageBatch].observe(max(started.Sub(s.received), 0))
+		l.stages[stageEndToEnd].observe(max(committed.Sub(s.captured), 0))
+	}
+	l.stages[stageCommit].observe(max(committed.Sub(started), 0))
+}
+
+func (l *ingestLatency) stats() map[string]LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make(map[string]LatencyStats, len(l.stages))
+	for stage, h := range l.stages {
+		stats[stage] = h.stats()
+	}
+	return stats
+}
+
+// endToEnd returns the current end-to-end p50 and p95 in milliseconds
+func (l *ingestLatency) endToEnd() (float64, float64) {
+	s := func() LatencyStats {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.stages[stageEndToEnd].stats()
+	}()
+	return s.P50Ms, s.P95Ms
+}
+
+// IngestLatency returns packet latency per pipeline stage
+func (h *Handler) IngestLatency() map[string]LatencyStats {
+	return h.latency.stats()
+}
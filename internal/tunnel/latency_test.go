@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestIngestLatencyStages(t *testing.T) {
+	l := newIngestLatency()
+	captured := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var samples []latencySample
+	for i := 0; i < 10; i++ {
+		// Older packets of a message don't count; the newest one is sampled
+		packets := []models.NetworkPacket{{Timestamp: captured.Add(-time.Hour)}, {Timestamp: captured}}
+		samples = append(samples, l.sample(packets, captured.Add(200*time.Millisecond)))
+	}
+	l.flushed(samples, captured.Add(time.Second), captured.Add(1300*time.Millisecond))
+
+	stats := l.stats()
+	for stage, want := range map[string]struct {
+		count int64
+		p50   float64
+	}{
+		stageReceive:  {10, 200},
+		stageBatch:    {10, 800},
+		stageCommit:   {1, 300},
+		stageEndToEnd: {10, 1300},
+	} {
+		s := stats[stage]
+		if s.Count != want.count || s.P50Ms != want.p50 || s.P95Ms != want.p50 {
+			t.Errorf("%s: %d samples, p50 %vms, p95 %vms; want %d at %vms", stage, s.Count, s.P50Ms, s.P95Ms, want.count, want.p50)
+		}
+	}
+
+	// Cumulative buckets: 1300ms is above 1000 and within 2500
+	e2e := stats[stageEndToEnd]
+	for _, b := range e2e.Buckets {
+		want := int64(0)
+		if b.LeMs >= 2500 {
+			want = 10
+		}
+		if b.Count != want {
+			t.Errorf("end to end bucket le %v = %d, want %d", b.LeMs, b.Count, want)
+		}
+	}
+	if p50, p95 := l.endToEnd(); p50 != 1300 || p95 != 1300 {
+		t.Errorf("endToEnd = %v, %v; want 1300, 1300", p50, p95)
+	}
+}
+
+func TestIngestLatencyAgentClockAhead(t *testing.T) {
+	l := newIngestLatency()
+	now := time.Now()
+	l.sample([]models.NetworkPacket{{Timestamp: now.Add(time.Minute)}}, now)
+
+	if s := l.stats()[stageReceive]; s.Count != 1 || s.SumMs != 0 || s.Buckets[0].Count != 1 {
+		t.Errorf("receive stats = %+v, want one sample counted as zero", s)
+	}
+}
+
+func TestIngestLatencyRecentPercentiles(t *testing.T) {
+	l := newIngestLatency()
+	for i := 0; i < recentLatencies; i++ {
+		l.observe(stageCommit, time.Second)
+	}
+	for i := 0; i < recentLatencies/2; i++ {
+		l.observe(stageCommit, 10*time.Millisecond)
+	}
+
+	s := l.stats()[stageCommit]
+	if s.Count != recentLatencies*3/2 {
+		t.Errorf("count = %d, want every sample", s.Count)
+	}
+	// Half of the recent window is fast now
+	if s.P50Ms != 1000 || s.P95Ms != 1000 {
+		t.Errorf("p50 %v, p95 %v; want 1000, 1000", s.P50Ms, s.P95Ms)
+	}
+	for i := 0; i < recentLatencies; i++ {
+		l.observe(stageCommit, 10*time.Millisecond)
+	}
+	if s := l.stats()[stageCommit]; s.P95Ms != 10 {
+		t.Errorf("p95 after the slow samples aged out = %v, want 10", s.P95Ms)
+	}
+}
+
+// TestIngestLatencyThroughFakeAgent sends packets captured three seconds
+// before the server's clock and checks the reported latencies
+func TestIngestLatencyThroughFakeAgent(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) {
+		cfg.FlushOnDisconnect = true
+		cfg.BatchSize = 1000
+	}, "network_packets")
+
+	agent, done := connectAgent(t, h)
+	for i := 0; i < 5; i++ {
+		packets := []models.NetworkPacket{{Timestamp: now.Add(-3 * time.Second), Protocol: "TCP", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: i, Length: 60}}
+		send(t, agent, TypeMetrics, map[string]interface{}{"packets": packets})
+	}
+	agent.Close()
+	<-done
+
+	stats := h.IngestLatency()
+	for _, stage := range []string{stageReceive, stageEndToEnd} {
+		s := stats[stage]
+		if s.Count != 5 {
+			t.Errorf("%s: %d samples, want 5", stage, s.Count)
+		}
+		if s.P50Ms < 2500 || s.P95Ms > 4000 {
+			t.Errorf("%s: p50 %vms, p95 %vms; want about 3000ms", stage, s.P50Ms, s.P95Ms)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"diagnostic-client/internal/config"
+)
+
+// listen opens the agent listener. Go already binds with SO_REUSEADDR on
+// Unix, so a restarted server can rebind while connections of the old one
+// sit in TIME_WAIT. AGENT_REUSE_PORT additionally lets a new process bind
+// while the old one still listens, for overlapping redeploys, and
+// AGENT_LISTEN_BACKLOG raises the queue of connections not yet accepted
+// so reconnect storms aren't refused. With AGENT_TLS_CERT_FILE set, agents
+// must connect over TLS; the handshake runs on the connection's first read.
+func listen(ctx context.Context, cfg *config.Config) (net.Listener, error) {
+	tlsCfg, err := agentTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// handleConnection only sees a *tls.Conn over TLS and can't set the
+	// keepalive period itself, so accepted sockets start with it.
+	lc := net.ListenConfig{KeepAlive: 30 * time.Second}
+	if cfg.AgentReusePort {
+		lc.Control = reusePort
+	}
+
+	l, err := lc.Listen(ctx, "tcp", cfg.AgentAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AgentListenBacklog > 0 {
+		if err := setBacklog(l, cfg.AgentListenBacklog); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("set listen backlog: %w", err)
+		}
+	}
+	if tlsCfg != nil {
+		l = tls.NewListener(l, tlsCfg)
+	}
+	return l, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("AGENT_REUSE_PORT is only supported on Linux")
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return errors.New("AGENT_LISTEN_BACKLOG is only supported on Linux")
+}
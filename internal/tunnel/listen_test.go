@@ -0,0 +1,88 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"diagnostic-client/internal/config"
+)
+
+// TestListenRebindsAfterClose closes a listener whose accepted connection
+// the server closed first, leaving it in TIME_WAIT, and binds the same
+// address again straight away, as a restarted server does
+func TestListenRebindsAfterClose(t *testing.T) {
+	for _, tc := range []struct {
+		reusePort bool
+		backlog   int
+	}{
+		{false, 0},
+		{true, 0},
+		{false, 4096},
+	} {
+		t.Run(fmt.Sprintf("reuse port %v backlog %d", tc.reusePort, tc.backlog), func(t *testing.T) {
+			if (tc.reusePort || tc.backlog > 0) && runtime.GOOS != "linux" {
+				t.Skip("only supported on Linux")
+			}
+			cfg := &config.Config{AgentAddr: "127.0.0.1:0", AgentReusePort: tc.reusePort, AgentListenBacklog: tc.backlog}
+
+			l, err := listen(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.AgentAddr = l.Addr().String()
+
+			client, err := net.Dial("tcp", cfg.AgentAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			l.Close()
+
+			l, err = listen(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("rebind %s after close: %v", cfg.AgentAddr, err)
+			}
+			defer l.Close()
+
+			again, err := net.Dial("tcp", cfg.AgentAddr)
+			if err != nil {
+				t.Fatalf("connect to the new listener: %v", err)
+			}
+			again.Close()
+		})
+	}
+}
+
+func TestListenReusePortOverlaps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("AGENT_REUSE_PORT is only supported on Linux")
+	}
+	cfg := &config.Config{AgentAddr: "127.0.0.1:0", AgentReusePort: true}
+	old, err := listen(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	// The new process binds while the old one still listens
+	cfg.AgentAddr = old.Addr().String()
+	next, err := listen(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("bind alongside the old listener: %v", err)
+	}
+	next.Close()
+
+	cfg.AgentReusePort = false
+	if l, err := listen(context.Background(), cfg); err == nil {
+		l.Close()
+		t.Fatal("bound a listening address without AGENT_REUSE_PORT")
+	}
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"regexp"
+	"sync"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// logSampler stores only a fraction of the lines of high-volume files.
+// Lines matching the keep pattern are always stored and don't advance the
+// count. Each file's rule is resolved once, so the per-line cost is a map
+// lookup and, for sampled files, one regexp match.
+type logSampler struct {
+	rules []logSamplingRule
+	keep  *regexp.Regexp // nil keeps nothing unconditionally
+
+	mu         sync.Mutex
+	factors    map[string]int // Resolved keep-1-in-N per file; 1 is unsampled
+	counters   map[string]uint64
+	sampledOut map[string]int64
+}
+
+type logSamplingRule struct {
+	match *paths.Denylist // Used as a plain path matcher
+	n     int
+}
+
+// newLogSampler returns nil when there are no rules. The rules and keep
+// pattern were validated with the configuration.
+func newLogSampler(rules []config.SamplingRule, keep string) *logSampler {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	s := &logSampler{
+		factors:    make(map[string]int),
+		counters:   make(map[string]uint64),
+		sampledOut: make(map[string]int64),
+	}
+	for _, r := range rules {
+		s.rules = append(s.rules, logSamplingRule{
+			match: paths.NewDenylist([]string{r.Pattern}),
+			n:     r.KeepOneIn,
+		})
+	}
+	if keep != "" {
+		s.keep = regexp.MustCompile(keep)
+	}
+	return s
+}
+
+// factor returns N when only 1 in N lines of file are stored. The caller
+// must hold the lock.
+func (s *logSampler) factor(file string) int {
+	if n, ok := s.factors[file]; ok {
+		return n
+	}
+
+	n := 1
+	for _, r := range s.rules {
+		if r.match.Match(file) {
+			n = r.n
+			break
+		}
+	}
+	s.factors[file] = n
+	return n
+}
+
+// sample drops the lines of sampled files that aren't kept, counting them
+func (s *logSampler) sample(logs []models.LogEntry) []models.LogEntry {
+	if s == nil {
+		return logs
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := logs[:0]
+	for _, entry := range logs {
+		n := s.factor(entry.Filename)
+		if n <= 1 || (s.keep != nil && s.keep.MatchString(entry.Line)) {
+			kept = append(kept, entry)
+			continue
+		}
+
+		if s.counters[entry.Filename]%uint64(n) == 0 {
+			kept = append(kept, entry)
+		} else {
+			s.sampledOut[entry.Filename]++
+		}
+		s.counters[entry.Filename]++
+	}
+	return kept
+}
+
+// LogSampling returns N when only 1 in N lines of file are stored, or 1
+func (h *Handler) LogSampling(file string) int {
+	s := h.logSampler
+	if s == nil {
+		return 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.factor(file)
+}
+
+// linesSampledOut returns the lines dropped by sampling, per file
+func (s *logSampler) linesSampledOut() map[string]int64 {
+	out := make(map[string]int64)
+	if s == nil {
+		return out
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for file, n := range s.sampledOut {
+		out[file] = n
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"fmt"
+	"testing"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestLogSamplingRulePrecedence(t *testing.T) {
+	s := newLogSampler([]config.SamplingRule{
+		{Pattern: "/var/log/nginx/access.log.1", KeepOneIn: 2},
+		{Pattern: "/var/log/nginx/access.log*", KeepOneIn: 10},
+		{Pattern: "/var/log/nginx", KeepOneIn: 5},
+		{Pattern: "/var/log/nginx/access.log", KeepOneIn: 100},
+	}, "")
+	h := &Handler{logSampler: s}
+
+	for file, want := range map[string]int{
+		// The first matching rule applies, however specific later ones are
+		"/var/log/nginx/access.log.1": 2,
+		"/var/log/nginx/access.log":   10,
+		"/var/log/nginx/access.log.2": 10,
+		"/var/log/nginx/error.log":    5,
+		"/var/log/nginx/old/x.log":    5,
+		"/var/log/nginxish.log":       1,
+		"/var/log/syslog":             1,
+	} {
+		if got := h.LogSampling(file); got != want {
+			t.Errorf("%s: keep 1 in %d, want 1 in %d", file, got, want)
+		}
+	}
+
+	if got := (&Handler{}).LogSampling("/var/log/nginx/access.log"); got != 1 {
+		t.Errorf("without rules: keep 1 in %d, want 1", got)
+	}
+}
+
+func TestLogSamplingKeepsOneInN(t *testing.T) {
+	s := newLogSampler([]config.SamplingRule{{Pattern: "/var/log/access.log", KeepOneIn: 10}}, "")
+
+	var kept int
+	for batch := 0; batch < 7; batch++ {
+		var logs []models.LogEntry
+		for i := 0; i < 13; i++ {
+			logs = append(logs,
+				models.LogEntry{Filename: "/var/log/access.log", Line: "GET /"},
+				models.LogEntry{Filename: "/var/log/app.log", Line: "unsampled"})
+		}
+		for _, e := range s.sample(logs) {
+			if e.Filename == "/var/log/access.log" {
+				kept++
+			}
+		}
+	}
+	// 91 lines across batches, keeping the 1st, 11th, ... 91st
+	if kept != 10 {
+		t.Errorf("kept %d of 91 sampled lines, want 10", kept)
+	}
+	out := s.linesSampledOut()
+	if out["/var/log/access.log"] != 81 || out["/var/log/app.log"] != 0 {
+		t.Errorf("sampled out = %v, want 81 lines of access.log only", out)
+	}
+}
+
+func TestLogSamplingKeepOverride(t *testing.T) {
+	s := newLogSampler([]config.SamplingRule{{Pattern: "/var/log/access.log", KeepOneIn: 100}}, `ERROR|\s5\d\d\s`)
+
+	var logs []models.LogEntry
+	for i := 0; i < 200; i++ {
+		line := fmt.Sprintf("GET /page/%d 200", i)
+		switch i % 50 {
+		case 7:
+			line = fmt.Sprintf("GET /page/%d 503 upstream", i)
+		case 9:
+			line = "ERROR upstream timed out"
+		}
+		logs = append(logs, models.LogEntry{Filename: "/var/log/access.log", Line: line, LineNum: i + 1})
+	}
+
+	kept := s.sample(logs)
+	var matching, ordinary int
+	for _, e := range kept {
+		if e.LineNum%50 == 8 || e.LineNum%50 == 10 {
+			matching++
+		} else {
+			ordinary++
+		}
+	}
+	// Every kept-pattern line survives, and they don't advance the 1 in 100
+	// count of the rest: 192 ordinary lines keep the 1st and 101st
+	if matching != 8 || ordinary != 2 {
+		t.Errorf("kept %d matching and %d ordinary lines, want 8 and 2", matching, ordinary)
+	}
+	if out := s.linesSampledOut()["/var/log/access.log"]; out != 190 {
+		t.Errorf("sampled out %d lines, want 190", out)
+	}
+}
+
+func TestLogSamplingDisabled(t *testing.T) {
+	s := newLogSampler(nil, "ERROR")
+	logs := []models.LogEntry{{Filename: "/var/log/a.log"}, {Filename: "/var/log/b.log"}}
+	if got := s.sample(logs); len(got) != 2 {
+		t.Errorf("kept %d of 2 lines without rules", len(got))
+	}
+	if out := s.linesSampledOut(); len(out) != 0 {
+		t.Errorf("sampled out = %v without rules", out)
+	}
+}
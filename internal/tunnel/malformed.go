@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// After the first malformed message in a window, only every Nth is logged
+	malformedLogEvery = 100
+	malformedWindow   = time.Minute
+)
+
+var (
+	// errMalformed marks a message of a known type whose payload can't be decoded
+	errMalformed = errors.New("malformed payload")
+	// errUnknownType marks a message type this server doesn't handle, as sent
+	// by agents newer than the server; such messages are skipped
+	errUnknownType = errors.New("unknown message type")
+)
+
+// unmarshalPayload decodes a message payload, marking failures as malformed
+func unmarshalPayload(payload json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("%w: %w", errMalformed, err)
+	}
+	return nil
+}
+
+// messageErrors accounts for failed messages on one agent connection, so a
+// buggy agent can't flood the log: malformed messages are logged first and
+// then every malformedLogEvery, with a summary of the rest per window.
+type messageErrors struct {
+	agent    string
+	limit    int // Malformed messages allowed per window; 0 is unlimited
+	counters *ingestCounters
+
+	windowStart time.Time
+	malformed   int
+	suppressed  int
+	unknown     map[MessageType]bool
+	// Why the connection is to be closed, once record says so
+	closeReason string
+}
+
+func newMessageErrors(agent string, limit int, counters *ingestCounters, now time.Time) *messageErrors {
+	return &messageErrors{
+		agent:       agent,
+		limit:       limit,
+		counters:    counters,
+		windowStart: now,
+		unknown:     make(map[MessageType]bool),
+	}
+}
+
+// record handles a message that failed with err and reports whether the
+// connection has exceeded its malformed message budget and should be closed
+func (m *messageErrors) record(msgType MessageType, err error, now time.Time) bool {
+	switch {
+	case errors.Is(err, errUnknownType):
+		m.counters.unknownMessages.Add(1)
+		if !m.unknown[msgType] {
+			m.unknown[msgType] = true
+			log.Printf("[TUNNEL] Ignoring unknown message type %q from %s (logged once per connection)", msgType, m.agent)
+		}
+		return false
+
+	case errors.Is(err, errMalformed):
+		m.counters.malformedMessages.Add(1)
+		if now.Sub(m.windowStart) >= malformedWindow {
+			m.summarize()
+			m.windowStart = now
+			m.malformed = 0
+		}
+
+		m.malformed++
+		if m.malformed == 1 || m.malformed%malformedLogEvery == 0 {
+			log.Printf("[TUNNEL] Malformed %s message from %s (%d this window): %v", msgType, m.agent, m.malformed, err)
+		} else {
+			m.suppressed++
+		}
+
+		if m.limit > 0 && m.malformed > m.limit {
+			m.summarize()
+			m.counters.protocolDisconnects.Add(1)
+			m.closeReason = fmt.Sprintf("more than %d malformed messages in %v, the last a %s message: %v",
+				m.limit, malformedWindow, msgType, err)
+			log.Printf("[TUNNEL] Closing agent connection from %s: protocol error: %s", m.agent, m.closeReason)
+			return true
+		}
+		return false
+
+	default:
+		log.Printf("[TUNNEL] Error processing message: %v", err)
+		return false
+	}
+}
+
+// summarize logs how many malformed messages went unlogged in this window
+func (m *messageErrors) summarize() {
+	if m.suppressed > 0 {
+		log.Printf("[TUNNEL] %d more malformed messages from %s not logged", m.suppressed, m.agent)
+		m.suppressed = 0
+	}
+}
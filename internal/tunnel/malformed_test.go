@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestMessageErrorsClosesOverLimit(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	now := time.Now()
+	counters := &ingestCounters{}
+	m := newMessageErrors("web-01", 2, counters, now)
+
+	bad := fmt.Errorf("%w: unexpected end of JSON input", errMalformed)
+	for i := 0; i < 2; i++ {
+		if m.record(TypeLogData, bad, now) {
+			t.Fatalf("message %d closed the connection within the limit", i+1)
+		}
+	}
+	if m.record(TypeLogData, errUnknownType, now) {
+		t.Fatal("unknown message type closed the connection")
+	}
+	if m.closeReason != "" {
+		t.Fatalf("close reason %q before the limit", m.closeReason)
+	}
+
+	if !m.record(TypeLogData, bad, now) {
+		t.Fatal("message over the limit kept the connection")
+	}
+	if !strings.Contains(m.closeReason, "more than 2 malformed messages") || !strings.Contains(m.closeReason, "unexpected end of JSON input") {
+		t.Fatalf("close reason = %q", m.closeReason)
+	}
+	if got := counters.protocolDisconnects.Load(); got != 1 {
+		t.Fatalf("protocol disconnects = %d, want 1", got)
+	}
+}
+
+func TestMessageErrorsWindowResets(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	now := time.Now()
+	m := newMessageErrors("web-01", 1, &ingestCounters{}, now)
+
+	bad := fmt.Errorf("%w: bad", errMalformed)
+	m.record(TypeLogData, bad, now)
+	if m.record(TypeLogData, bad, now.Add(malformedWindow)) {
+		t.Fatal("malformed message in a new window closed the connection")
+	}
+}
+
+func TestMessageErrorsLogVolumeIsBounded(t *testing.T) {
+	logs := captureLog(t)
+
+	now := time.Now()
+	m := newMessageErrors("web-01", 0, &ingestCounters{}, now)
+	bad := fmt.Errorf("%w: bad", errMalformed)
+	for i := 0; i < 1000; i++ {
+		m.record(TypeLogData, bad, now)
+		m.record("future_type", errUnknownType, now)
+	}
+	// The first and every 100th malformed message, and one line for the
+	// unknown type
+	if lines := strings.Count(logs.String(), "\n"); lines != 12 {
+		t.Fatalf("logged %d lines for 2000 failed messages, want 12:\n%s", lines, logs)
+	}
+
+	logs.Reset()
+	m.record(TypeLogData, bad, now.Add(malformedWindow))
+	if !strings.Contains(logs.String(), "989 more malformed messages from web-01 not logged") {
+		t.Fatalf("new window logged %q, want a summary of the suppressed messages", logs)
+	}
+}
+
+func sendRaw(t *testing.T, conn net.Conn, typ MessageType, payload string) {
+	t.Helper()
+	if err := json.NewEncoder(conn).Encode(Message{Type: typ, Payload: json.RawMessage(payload)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMalformedMessagesDisconnectAgent(t *testing.T) {
+	logs := captureLog(t)
+	h := newTestHandler(t, time.Now(), func(cfg *config.Config) {
+		cfg.MaxMalformedPerMinute = 50
+	}, "agent_events")
+
+	agent, done := connectAgent(t, h)
+	// Unknown types are tolerated however many arrive
+	for i := 0; i < 200; i++ {
+		sendRaw(t, agent, "future_type", `{}`)
+	}
+	for i := 0; i < 51; i++ {
+		sendRaw(t, agent, TypeLogData, `{"not": "an array"}`)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection kept open past the malformed message limit")
+	}
+
+	// First malformed message, the summary, the close and the unknown type,
+	// plus connection lifecycle lines
+	if lines := strings.Count(logs.String(), "\n"); lines > 20 {
+		t.Errorf("logged %d lines for 251 failed messages:\n%s", lines, logs)
+	}
+
+	events, err := h.db.GetLatestAgentEvents(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, list := range events {
+		for _, e := range list {
+			if e.Kind == models.AgentEventProtocolError && strings.Contains(e.Detail, "more than 50 malformed messages") {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("agent events = %+v, want the protocol error", events)
+	}
+}
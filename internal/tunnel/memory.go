@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"log"
+	"sync/atomic"
+
+	"diagnostic-client/internal/membudget"
+	"diagnostic-client/pkg/models"
+)
+
+// Rough per-item sizes used for memory accounting, including struct, string
+// headers and typical string contents.
+const (
+	estimatedPacketBytes   = 256
+	estimatedLogEntryBytes = 256
+	estimatedFileNodeBytes = 256
+)
+
+// Shed priorities: stream queues feeding websocket clients go first, then the
+// pending network batch (which is flushed early rather than dropped). Stream
+// queues count and shed across every client's subscription.
+const (
+	priorityFileUpdates = iota
+	priorityLogStream
+	priorityNetworkStream
+	priorityNetworkReplay
+	priorityNetworkBatch
+	priorityFileCache
+)
+
+// MemoryComponents returns the handler's buffers for registration with a
+// memory budget
+func (h *Handler) MemoryComponents() []membudget.Component {
+	return []membudget.Component{
+		&fileUpdatesMemory{h},
+		&logStreamMemory{h},
+		&networkStreamMemory{h},
+		&networkReplayMemory{h},
+		&networkBatchMemory{h},
+		&fileCacheMemory{h},
+	}
+}
+
+type fileUpdatesMemory struct{ h *Handler }
+
+func (m *fileUpdatesMemory) Name() string  { return "file_updates" }
+func (m *fileUpdatesMemory) Priority() int { return priorityFileUpdates }
+
+func (m *fileUpdatesMemory) BytesHeld() int64 {
+	queued, _ := m.h.streams.files.Queued()
+	return int64(queued) * estimatedFileNodeBytes
+}
+
+func (m *fileUpdatesMemory) Shed(target int64) int64 {
+	var released int64
+	m.h.streams.files.Shed(func(models.FileNode) bool {
+		released += estimatedFileNodeBytes
+		return released < target
+	})
+	return released
+}
+
+type logStreamMemory struct{ h *Handler }
+
+func (m *logStreamMemory) Name() string  { return "log_stream" }
+func (m *logStreamMemory) Priority() int { return priorityLogStream }
+
+func (m *logStreamMemory) BytesHeld() int64 {
+	queued, _ := m.h.streams.logs.Queued()
+	return int64(queued) * estimatedLogEntryBytes
+}
+
+func (m *logStreamMemory) Shed(target int64) int64 {
+	var released int64
+	m.h.streams.logs.Shed(func(entry models.LogEntry) bool {
+		released += estimatedLogEntryBytes + int64(len(entry.Line))
+		return released < target
+	})
+	return released
+}
+
+type networkStreamMemory struct{ h *Handler }
+
+func (m *networkStreamMemory) Name() string  { return "network_stream" }
+func (m *networkStreamMemory) Priority() int { return priorityNetworkStream }
+
+// BytesHeld can't see inside queued batches, so it uses the running average
+// batch length recorded at flush time. Packets held back by fair scheduling
+// count too.
+func (m *networkStreamMemory) BytesHeld() int64 {
+	queued, _ := m.h.streams.network.Queued()
+	held := int64(queued) * atomic.LoadInt64(&m.h.avgStreamBatch)
+	if fair := m.h.sampler.fair; fair != nil {
+		n, _ := fair.stats()
+		held += int64(n)
+	}
+	return held * estimatedPacketBytes
+}
+
+func (m *networkStreamMemory) Shed(target int64) int64 {
+	var released int64
+	m.h.streams.network.Shed(func(batch []models.NetworkPacket) bool {
+		released += int64(len(batch)) * estimatedPacketBytes
+		return released < target
+	})
+	if fair := m.h.sampler.fair; fair != nil && released < target {
+		released += int64(fair.shed(int((target-released)/estimatedPacketBytes)+1)) * estimatedPacketBytes
+	}
+	return released
+}
+
+type networkReplayMemory struct{ h *Handler }
+
+func (m *networkReplayMemory) Name() string  { return "network_replay" }
+func (m *networkReplayMemory) Priority() int { return priorityNetworkReplay }
+
+func (m *networkReplayMemory) BytesHeld() int64 {
+	return int64(m.h.networkHistory.packets()) * estimatedPacketBytes
+}
+
+func (m *networkReplayMemory) Shed(target int64) int64 {
+	var released int64
+	for released < target {
+		n := m.h.networkHistory.dropOldest(1)
+		if n == 0 {
+			return released
+		}
+		released += int64(n) * estimatedPacketBytes
+	}
+	return released
+}
+
+type networkBatchMemory struct{ h *Handler }
+
+func (m *networkBatchMemory) Name() string  { return "network_batch" }
+func (m *networkBatchMemory) Priority() int { return priorityNetworkBatch }
+
+func (m *networkBatchMemory) BytesHeld() int64 {
+	m.h.batchMutex.Lock()
+	defer m.h.batchMutex.Unlock()
+	return int64(len(m.h.networkBatch)) * estimatedPacketBytes
+}
+
+// Shed flushes the pending batch to the database early instead of dropping it
+func (m *networkBatchMemory) Shed(target int64) int64 {
+	held := m.BytesHeld()
+	if held == 0 {
+		return 0
+	}
+
+	ctx, cancel := m.h.detach(m.h.ctx)
+	defer cancel()
+
+	if err := m.h.flushNetworkBatch(ctx); err != nil {
+		log.Printf("[TUNNEL] Error flushing network batch under memory pressure: %v", err)
+		return 0
+	}
+	return held
+}
+
+type fileCacheMemory struct{ h *Handler }
+
+func (m *fileCacheMemory) Name() string  { return "file_cache" }
+func (m *fileCacheMemory) Priority() int { return priorityFileCache }
+
+func (m *fileCacheMemory) BytesHeld() int64 {
+	return int64(m.h.fileCache.len()) * estimatedFileNodeBytes
+}
+
+// Shed is a no-op: the cache is the source of truth for change detection
+func (m *fileCacheMemory) Shed(target int64) int64 {
+	return 0
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesReceived  = promauto.NewCounterVec(prometheus.CounterOpts{Name: "tunnel_messages_received_total", Help: "Agent messages processed, by type; types the server doesn't know count as unknown."}, []string{"type"})
+	activeConnections = promauto.NewGauge(prometheus.GaugeOpts{Name: "tunnel_active_connections", Help: "Open agent connections."})
+	fileCacheSize     = promauto.NewGauge(prometheus.GaugeOpts{Name: "file_cache_size", Help: "Files in the in-memory file cache."})
+)
+
+func init() {
+	// Agent-sent types are exported at zero until the first arrives
+	for _, t := range []MessageType{TypeMetrics, TypeLogList, TypeLogData, TypeFileTruncated, TypeHello, TypeRegister, TypeAgentConfigAck, unknownMessageType} {
+		messagesReceived.WithLabelValues(string(t))
+	}
+}
+
+// ingestCounterDescs describe the IngestStats counters, which a Handler
+// keeps itself, so they are collected from it on each scrape
+var ingestCounterDescs = []struct {
+	desc  *prometheus.Desc
+	value func(IngestStats) int64
+}{
+	{prometheus.NewDesc("tunnel_lines_truncated_total", "Log lines cut to the maximum line length.", nil, nil), func(s IngestStats) int64 { return s.LinesTruncated }},
+	{prometheus.NewDesc("tunnel_bytes_truncated_total", "Bytes cut from log lines over the maximum line length.", nil, nil), func(s IngestStats) int64 { return s.BytesTruncated }},
+	{prometheus.NewDesc("tunnel_malformed_messages_total", "Agent messages of a known type whose payload couldn't be decoded.", nil, nil), func(s IngestStats) int64 { return s.MalformedMessages }},
+	{prometheus.NewDesc("tunnel_unknown_messages_total", "Agent messages of a type the server doesn't handle.", nil, nil), func(s IngestStats) int64 { return s.UnknownMessages }},
+	{prometheus.NewDesc("tunnel_protocol_disconnects_total", "Agent connections closed for too many malformed messages.", nil, nil), func(s IngestStats) int64 { return s.ProtocolDisconnects }},
+	{prometheus.NewDesc("tunnel_duplicate_batches_total", "Metrics batches received again and not stored twice.", nil, nil), func(s IngestStats) int64 { return s.DuplicateBatches }},
+	{prometheus.NewDesc("tunnel_duplicate_packets_total", "Packets of duplicate metrics batches.", nil, nil), func(s IngestStats) int64 { return s.DuplicatePackets }},
+	{prometheus.NewDesc("tunnel_packets_filtered_total", "Packets dropped for carrying less payload than the minimum.", nil, nil), func(s IngestStats) int64 { return s.PacketsFiltered }},
+	{prometheus.NewDesc("tunnel_lines_already_stored_total", "Log lines sent again and not stored twice.", nil, nil), func(s IngestStats) int64 { return s.LinesAlreadyStored }},
+	{prometheus.NewDesc("tunnel_files_drifted_total", "Changed files the file cache had but the database didn't.", nil, nil), func(s IngestStats) int64 { return s.FilesDrifted }},
+}
+
+var ingestLatencyDesc = prometheus.NewDesc("tunnel_ingest_latency_seconds", "Packet latency per ingest pipeline stage, sampled once per metrics message.", []string{"stage"}, nil)
+
+// ingestCollector exports a Handler's ingest counters and latency histograms
+type ingestCollector struct {
+	h *Handler
+}
+
+// Collector returns a Prometheus collector of the handler's ingest counters
+// and per-stage packet latency
+func (h *Handler) Collector() prometheus.Collector {
+	return ingestCollector{h: h}
+}
+
+func (c ingestCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range ingestCounterDescs {
+		ch <- m.desc
+	}
+	ch <- ingestLatencyDesc
+}
+
+func (c ingestCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.h.IngestStats()
+	for _, m := range ingestCounterDescs {
+		ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(m.value(stats)))
+	}
+
+	for stage, l := range stats.Latency {
+		buckets := make(map[float64]uint64, len(l.Buckets))
+		for _, b := range l.Buckets {
+			buckets[b.LeMs*float64(time.Millisecond)/float64(time.Second)] = uint64(b.Count)
+		}
+		ch <- prometheus.MustNewConstHistogram(ingestLatencyDesc, uint64(l.Count), l.SumMs/1000, buckets, stage)
+	}
+}
@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestCollectorExportsIngestStats(t *testing.T) {
+	h := &Handler{latency: newIngestLatency()}
+	h.ingest.malformedMessages.Add(3)
+	h.latency.observe(stageReceive, 20*time.Millisecond)
+	h.latency.observe(stageReceive, 2*time.Second)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(h.Collector())
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"tunnel_malformed_messages_total 3",
+		"tunnel_protocol_disconnects_total 0",
+		`tunnel_ingest_latency_seconds_bucket{stage="receive",le="0.025"} 1`,
+		`tunnel_ingest_latency_seconds_bucket{stage="receive",le="2.5"} 2`,
+		`tunnel_ingest_latency_seconds_count{stage="receive"} 2`,
+		`tunnel_ingest_latency_seconds_sum{stage="receive"} 2.02`,
+		`tunnel_ingest_latency_seconds_count{stage="end_to_end"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape lacks %q", want)
+		}
+	}
+}
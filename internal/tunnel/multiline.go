@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// multilineHold is how long the last entry of a file waits for
+// continuation lines from the agent's next message before it is stored
+const multilineHold = 2 * time.Second
+
+// multilineJoiner reassembles logical entries, such as stack traces, that
+// agents report as one LogEntry per physical line. Lines of matching files
+// that don't match the start pattern are appended to the entry before them.
+// The last entry of each file is held back briefly, since its continuation
+// may arrive in the next message.
+type multilineJoiner struct {
+	files   *paths.Denylist // Used as a plain path matcher
+	start   *regexp.Regexp
+	maxLine int // Continuations stop being appended past this length; 0 is unlimited
+
+	mu      sync.Mutex
+	pending map[multilineKey]*pendingEntry
+}
+
+type multilineKey struct {
+	agentID, file string
+}
+
+type pendingEntry struct {
+	entry    models.LogEntry
+	received time.Time
+}
+
+// newMultilineJoiner returns nil when no files are configured. The start
+// pattern was validated with the configuration.
+func newMultilineJoiner(files []string, start string, maxLine int) *multilineJoiner {
+	if len(files) == 0 {
+		return nil
+	}
+	return &multilineJoiner{
+		files:   paths.NewDenylist(files),
+		start:   regexp.MustCompile(start),
+		maxLine: maxLine,
+		pending: make(map[multilineKey]*pendingEntry),
+	}
+}
+
+// join folds continuation lines into their entries and returns the entries
+// ready to store, including held-back ones completed by this message. Logs
+// must be in file order, as agents send them.
+func (j *multilineJoiner) join(logs []models.LogEntry, now time.Time) []models.LogEntry {
+	if j == nil {
+		return logs
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ready := make([]models.LogEntry, 0, len(logs))
+	for _, entry := range logs {
+		if !j.files.Match(entry.Filename) {
+			ready = append(ready, entry)
+			continue
+		}
+
+		key := multilineKey{entry.AgentID, entry.Filename}
+		prev, ok := j.pending[key]
+		if ok && !j.start.MatchString(entry.Line) {
+			if j.maxLine <= 0 || len(prev.entry.Line) < j.maxLine {
+				prev.entry.Line += "\n" + entry.Line
+			}
+			continue
+		}
+
+		if ok {
+			ready = append(ready, prev.entry)
+		}
+		j.pending[key] = &pendingEntry{entry: entry, received: now}
+	}
+	return ready
+}
+
+// expired removes and returns held-back entries older than multilineHold,
+// or all of them when all is set
+func (j *multilineJoiner) expired(now time.Time, all bool) []models.LogEntry {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var ready []models.LogEntry
+	for key, p := range j.pending {
+		if all || now.Sub(p.received) >= multilineHold {
+			ready = append(ready, p.entry)
+			delete(j.pending, key)
+		}
+	}
+	return ready
+}
+
+// periodicMultilineFlush stores held-back entries once no continuation
+// followed them in time
+func (h *Handler) periodicMultilineFlush() {
+	if h.multiline == nil {
+		return
+	}
+
+	ticker := h.clock.NewTicker(multilineHold / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.shutdownCh:
+			return
+		case <-ticker.C():
+			ctx, cancel := h.detach(h.ctx)
+			h.flushMultiline(ctx, false)
+			cancel()
+		}
+	}
+}
+
+// flushMultiline stores expired held-back entries, or all of them
+func (h *Handler) flushMultiline(ctx context.Context, all bool) {
+	logs := h.multiline.expired(h.clock.Now(), all)
+	if len(logs) == 0 {
+		return
+	}
+
+	if err := h.storeLogs(ctx, logs); err != nil && !errors.Is(err, errFlushDeferred) {
+		log.Printf("[TUNNEL] Error storing held-back log entries: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+const (
+	// An ingesting operation completes once its file has been quiet this long
+	operationSettle = 2 * time.Second
+	// A pending operation times out if no lines arrive within this long
+	operationTimeout = 2 * time.Minute
+)
+
+// operationRegistry tracks commands whose effect shows up later as ingested
+// data, so clients can wait for a scrape instead of polling blindly. It is
+// in memory only: operations expire after a TTL and are lost on restart.
+type operationRegistry struct {
+	mu  sync.Mutex
+	ops map[string]*models.Operation
+	ttl time.Duration
+}
+
+func newOperationRegistry(ttl time.Duration) *operationRegistry {
+	return &operationRegistry{ops: make(map[string]*models.Operation), ttl: ttl}
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// StartOperation registers a pending operation waiting for lines from path
+func (h *Handler) StartOperation(kind, path string, agents int) models.Operation {
+	now := h.clock.Now()
+	op := &models.Operation{
+		ID:        newOperationID(),
+		Kind:      kind,
+		Path:      path,
+		State:     models.OperationPending,
+		Agents:    agents,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	h.ops.mu.Lock()
+	h.ops.ops[op.ID] = op
+	h.ops.mu.Unlock()
+
+	h.publishOperation(*op)
+	return *op
+}
+
+// Operation returns the current state of an operation, or false once it has
+// expired or if it never existed
+func (h *Handler) Operation(id string) (models.Operation, bool) {
+	h.ops.mu.Lock()
+	defer h.ops.mu.Unlock()
+
+	op, ok := h.ops.ops[id]
+	if !ok {
+		return models.Operation{}, false
+	}
+	return *op, true
+}
+
+// observeOperations attributes a stored log batch to the operations waiting
+// on its files
+func (h *Handler) observeOperations(logs []models.LogEntry) {
+	lines := make(map[string]int64)
+	for _, l := range logs {
+		lines[l.Filename]++
+	}
+
+	var changed []models.Operation
+	now := h.clock.Now()
+
+	h.ops.mu.Lock()
+	for _, op := range h.ops.ops {
+		n, ok := lines[op.Path]
+		if !ok || op.State == models.OperationComplete || op.State == models.OperationTimedOut {
+			continue
+		}
+		if op.State == models.OperationPending {
+			op.State = models.OperationIngesting
+			changed = append(changed, *op)
+		}
+		op.Batches++
+		op.Lines += n
+		op.UpdatedAt = now
+	}
+	h.ops.mu.Unlock()
+
+	for _, op := range changed {
+		h.publishOperation(op)
+	}
+}
+
+// sweepOperations completes operations whose file went quiet, times out those
+// that never saw data and forgets expired ones
+func (h *Handler) sweepOperations() {
+	ticker := h.clock.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.shutdownCh:
+			return
+		case now := <-ticker.C():
+			var changed []models.Operation
+
+			h.ops.mu.Lock()
+			for id, op := range h.ops.ops {
+				switch {
+				case op.State == models.OperationIngesting && now.Sub(op.UpdatedAt) >= operationSettle:
+					op.State = models.OperationComplete
+				case op.State == models.OperationPending && now.Sub(op.CreatedAt) >= operationTimeout:
+					op.State = models.OperationTimedOut
+				default:
+					if now.Sub(op.CreatedAt) >= h.ops.ttl {
+						delete(h.ops.ops, id)
+					}
+					continue
+				}
+				op.UpdatedAt = now
+				changed = append(changed, *op)
+			}
+			h.ops.mu.Unlock()
+
+			for _, op := range changed {
+				h.publishOperation(op)
+			}
+		}
+	}
+}
+
+// publishOperation streams an operation's state; clients that miss it can
+// still poll the operation
+func (h *Handler) publishOperation(op models.Operation) {
+	h.streams.operations.Publish(op)
+}
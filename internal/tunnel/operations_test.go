@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// advanceUntil steps the clock by the sweep interval until cond holds. A
+// tick sent while the sweeper is still busy is dropped, so each step waits a
+// little for the sweep before taking the next one
+func advanceUntil(t *testing.T, clk *clock.Fake, limit time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for elapsed := time.Duration(0); ; elapsed += 500 * time.Millisecond {
+		for i := 0; i < 20; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if elapsed > limit {
+			t.Fatalf("%s: not reached after %v", what, elapsed)
+		}
+		clk.Advance(500 * time.Millisecond)
+	}
+}
+
+func TestOperationLifecycle(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	cfg := &config.Config{NetworkBufferSize: 4, LogBufferSize: 4}
+	h := &Handler{clock: clk, ops: newOperationRegistry(10 * time.Minute), streams: newStreamSubscribers(cfg), shutdownCh: make(chan struct{})}
+	sub := h.SubscribeStreams(func(string) bool { return false })
+	defer sub.Close()
+	go h.sweepOperations()
+	defer close(h.shutdownCh)
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	scrape := h.StartOperation("scrape", "/var/log/app.log", 2)
+	quiet := h.StartOperation("scrape", "/var/log/quiet.log", 1)
+	if scrape.State != models.OperationPending || scrape.Agents != 2 {
+		t.Fatalf("started operation = %+v, want pending for 2 agents", scrape)
+	}
+
+	state := func(id string) string {
+		op, _ := h.Operation(id)
+		return op.State
+	}
+
+	clk.Advance(time.Second)
+	h.observeOperations([]models.LogEntry{{Filename: "/var/log/app.log"}, {Filename: "/var/log/app.log"}, {Filename: "/var/log/other.log"}})
+	clk.Advance(time.Second)
+	h.observeOperations([]models.LogEntry{{Filename: "/var/log/app.log"}})
+	lastBatch := clk.Now()
+	op, _ := h.Operation(scrape.ID)
+	if op.State != models.OperationIngesting || op.Batches != 2 || op.Lines != 3 {
+		t.Fatalf("after two batches = %+v, want ingesting with 2 batches of 3 lines", op)
+	}
+
+	advanceUntil(t, clk, time.Minute, "scrape complete", func() bool { return state(scrape.ID) == models.OperationComplete })
+	op, _ = h.Operation(scrape.ID)
+	if settled := op.UpdatedAt.Sub(lastBatch); settled < operationSettle {
+		t.Errorf("completed %v after the last batch, want at least %v", settled, operationSettle)
+	}
+	// Lines after completion don't reopen it
+	h.observeOperations([]models.LogEntry{{Filename: "/var/log/app.log"}})
+	if op, _ := h.Operation(scrape.ID); op.State != models.OperationComplete || op.Lines != 3 {
+		t.Errorf("after a late batch = %+v, want complete with 3 lines", op)
+	}
+
+	// Skip to just before the timeout
+	clk.Advance(start.Add(operationTimeout - 5*time.Second).Sub(clk.Now()))
+	advanceUntil(t, clk, time.Minute, "quiet timed out", func() bool { return state(quiet.ID) == models.OperationTimedOut })
+	if waited := clk.Now().Sub(start); waited < operationTimeout {
+		t.Errorf("timed out after %v, want at least %v", waited, operationTimeout)
+	}
+
+	clk.Advance(start.Add(10*time.Minute - 5*time.Second).Sub(clk.Now()))
+	advanceUntil(t, clk, time.Minute, "operations expired", func() bool {
+		_, scraped := h.Operation(scrape.ID)
+		_, timedOut := h.Operation(quiet.ID)
+		return !scraped && !timedOut
+	})
+	if expired := clk.Now().Sub(start); expired < 10*time.Minute {
+		t.Errorf("expired after %v, want at least the 10m TTL", expired)
+	}
+
+	var states []string
+	for len(sub.Operations()) > 0 {
+		op := <-sub.Operations()
+		if op.ID == scrape.ID {
+			states = append(states, op.State)
+		}
+	}
+	want := []string{models.OperationPending, models.OperationIngesting, models.OperationComplete}
+	if len(states) != len(want) {
+		t.Fatalf("streamed states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("streamed states %v, want %v", states, want)
+		}
+	}
+}
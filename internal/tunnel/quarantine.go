@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// massDeletionMinFiles keeps the fraction threshold from holding deletions
+// in small trees, where a few removed files are a large share
+const massDeletionMinFiles = 10
+
+// massDeletionSample is how many of the held paths announcements list
+const massDeletionSample = 20
+
+// Mass deletion states
+const (
+	MassDeletionPending   = "pending"
+	MassDeletionApplied   = "applied"
+	MassDeletionCancelled = "cancelled"
+)
+
+// MassDeletion describes deletions held back because a single file list
+// dropped an unusual number of files, typically a glitched scan
+type MassDeletion struct {
+	State      string    `json:"state"`
+	Count      int       `json:"count"`
+	KnownFiles int       `json:"known_files"`
+	Sample     []string  `json:"sample"`
+	HeldAt     time.Time `json:"held_at"`
+}
+
+// deletionQuarantine holds at most one mass deletion until the next file
+// list confirms it or an admin resolves it
+type deletionQuarantine struct {
+	mu      sync.Mutex
+	paths   map[string]struct{}
+	pending *MassDeletion
+}
+
+// isMassDeletion reports whether deleting n of known files needs confirming
+func (h *Handler) isMassDeletion(n, known int) bool {
+	if h.cfg.MassDeleteCount > 0 && n > h.cfg.MassDeleteCount {
+		return true
+	}
+	return h.cfg.MassDeleteFraction > 0 && n > massDeletionMinFiles &&
+		float64(n) > h.cfg.MassDeleteFraction*float64(known)
+}
+
+// quarantineDeletions decides which deletions of a file list go ahead. A
+// held mass deletion goes ahead for the files this list still lacks and is
+// dropped for files that reappeared. Otherwise, an unusually large deletion
+// is held for one more list and announced. The caller must hold the
+// quarantine lock.
+func (h *Handler) quarantineDeletions(changes *fileChanges) {
+	q := &h.quarantine
+
+	if q.pending != nil {
+		confirmed := 0
+		for _, path := range changes.deleted {
+			if _, ok := q.paths[path]; ok {
+				confirmed++
+			}
+		}
+		held := q.pending
+		q.pending, q.paths = nil, nil
+
+		log.Printf("[TUNNEL] Mass deletion of %d files confirmed for %d by the next file list", held.Count, confirmed)
+		held.State = MassDeletionApplied
+		if confirmed == 0 {
+			held.State = MassDeletionCancelled
+		}
+		held.Count = confirmed
+		h.publishMassDeletion(*held)
+		// Confirmed and new deletions alike go ahead; the held set was the
+		// unusual part
+		return
+	}
+
+	known := h.fileCache.len()
+
+	if !h.isMassDeletion(len(changes.deleted), known) {
+		return
+	}
+
+	q.paths = make(map[string]struct{}, len(changes.deleted))
+	for _, path := range changes.deleted {
+		q.paths[path] = struct{}{}
+	}
+	sample := append([]string{}, changes.deleted...)
+	sort.Strings(sample)
+	if len(sample) > massDeletionSample {
+		sample = sample[:massDeletionSample]
+	}
+	q.pending = &MassDeletion{
+		State:      MassDeletionPending,
+		Count:      len(changes.deleted),
+		KnownFiles: known,
+		Sample:     sample,
+		HeldAt:     h.clock.Now(),
+	}
+
+	log.Printf("[TUNNEL] Holding deletion of %d of %d files until the next file list confirms it",
+		len(changes.deleted), known)
+	h.publishMassDeletion(*q.pending)
+	changes.deleted = changes.deleted[:0]
+}
+
+// PendingMassDeletion returns the held mass deletion, if any
+func (h *Handler) PendingMassDeletion() *MassDeletion {
+	q := &h.quarantine
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == nil {
+		return nil
+	}
+	pending := *q.pending
+	return &pending
+}
+
+// ResolveMassDeletion applies or cancels the held mass deletion right away.
+// Cancelled files stay until a later file list drops them again. It returns
+// nil when nothing is held.
+func (h *Handler) ResolveMassDeletion(ctx context.Context, apply bool) (*MassDeletion, error) {
+	q := &h.quarantine
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending == nil {
+		return nil, nil
+	}
+	held := *q.pending
+
+	if apply {
+		changes := &fileChanges{}
+		for path := range q.paths {
+			if _, ok := h.fileCache.get(path); ok {
+				changes.deleted = append(changes.deleted, path)
+			}
+		}
+
+		if !changes.isEmpty() {
+			if err := h.applyFileChanges(ctx, changes); err != nil {
+				return nil, fmt.Errorf("apply held deletion: %w", err)
+			}
+		}
+		held.State = MassDeletionApplied
+		held.Count = len(changes.deleted)
+	} else {
+		held.State = MassDeletionCancelled
+	}
+
+	q.pending, q.paths = nil, nil
+	log.Printf("[TUNNEL] Mass deletion %s by admin", held.State)
+	h.publishMassDeletion(held)
+	return &held, nil
+}
+
+func (h *Handler) publishMassDeletion(d MassDeletion) {
+	h.streams.deletions.Publish(d)
+}
@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// quarantineFiles returns n files under /data
+func quarantineFiles(n int) []models.FileNode {
+	files := make([]models.FileNode, n)
+	for i := range files {
+		name := fmt.Sprintf("%03d.log", i)
+		files[i] = models.FileNode{Path: "/data/" + name, ParentPath: "/data", Name: name}
+	}
+	return files
+}
+
+func deletedPaths(files []models.FileNode) []string {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+func TestIsMassDeletion(t *testing.T) {
+	h := &Handler{cfg: &config.Config{MassDeleteCount: 1000, MassDeleteFraction: 0.5}}
+	for _, tc := range []struct {
+		n, known int
+		want     bool
+	}{
+		{1001, 100000, true},
+		{1000, 100000, false},
+		{60, 100, true},
+		{50, 100, false},
+		// Small trees aren't held on the fraction alone
+		{massDeletionMinFiles, massDeletionMinFiles, false},
+		{massDeletionMinFiles + 1, massDeletionMinFiles + 2, true},
+	} {
+		if got := h.isMassDeletion(tc.n, tc.known); got != tc.want {
+			t.Errorf("%d of %d files: held %v, want %v", tc.n, tc.known, got, tc.want)
+		}
+	}
+
+	h.cfg = &config.Config{}
+	if h.isMassDeletion(100000, 100000) {
+		t.Error("held with both thresholds disabled")
+	}
+}
+
+func newQuarantineHandler(t *testing.T, known int) (*Handler, *StreamSubscription) {
+	t.Helper()
+	cfg := &config.Config{MassDeleteCount: 1000, MassDeleteFraction: 0.5, NetworkBufferSize: 4, LogBufferSize: 4}
+	h := &Handler{cfg: cfg, clock: clock.NewFake(time.Now()), fileCache: newFileCache(), streams: newStreamSubscribers(cfg)}
+	h.fileCache.replace(quarantineFiles(known))
+	sub := h.SubscribeStreams(func(string) bool { return false })
+	t.Cleanup(sub.Close)
+	return h, sub
+}
+
+func nextDeletion(t *testing.T, sub *StreamSubscription) MassDeletion {
+	t.Helper()
+	select {
+	case d := <-sub.MassDeletions():
+		return d
+	default:
+		t.Fatal("no mass deletion announced")
+		return MassDeletion{}
+	}
+}
+
+func TestGlitchScanThenRecovery(t *testing.T) {
+	h, sub := newQuarantineHandler(t, 100)
+	files := quarantineFiles(100)
+
+	// The glitched scan only found 3 files
+	glitch := &fileChanges{deleted: deletedPaths(files[3:])}
+	h.quarantineDeletions(glitch)
+	if len(glitch.deleted) != 0 {
+		t.Fatalf("glitch scan deleted %d files, want them held", len(glitch.deleted))
+	}
+	d := nextDeletion(t, sub)
+	if d.State != MassDeletionPending || d.Count != 97 || d.KnownFiles != 100 || len(d.Sample) != massDeletionSample || d.Sample[0] != "/data/003.log" {
+		t.Errorf("announced %+v, want 97 of 100 files pending with a sorted sample", d)
+	}
+	if p := h.PendingMassDeletion(); p == nil || p.Count != 97 {
+		t.Errorf("pending = %+v, want the held deletion", p)
+	}
+
+	// The next scan finds everything again
+	recovery := &fileChanges{}
+	h.quarantineDeletions(recovery)
+	if len(recovery.deleted) != 0 {
+		t.Fatalf("recovery scan deleted %v", recovery.deleted)
+	}
+	if d := nextDeletion(t, sub); d.State != MassDeletionCancelled || d.Count != 0 {
+		t.Errorf("announced %+v, want the deletion cancelled", d)
+	}
+	if p := h.PendingMassDeletion(); p != nil {
+		t.Errorf("still pending: %+v", p)
+	}
+}
+
+func TestMassDeletionConfirmedByNextList(t *testing.T) {
+	h, sub := newQuarantineHandler(t, 100)
+	files := quarantineFiles(100)
+
+	h.quarantineDeletions(&fileChanges{deleted: deletedPaths(files[20:])})
+	nextDeletion(t, sub)
+
+	// Ten of the files came back; the rest are gone for good
+	confirm := &fileChanges{deleted: deletedPaths(files[30:])}
+	h.quarantineDeletions(confirm)
+	if len(confirm.deleted) != 70 {
+		t.Errorf("confirming list deletes %d files, want 70", len(confirm.deleted))
+	}
+	if d := nextDeletion(t, sub); d.State != MassDeletionApplied || d.Count != 70 {
+		t.Errorf("announced %+v, want 70 deletions applied", d)
+	}
+}
+
+func TestSmallDeletionsGoAhead(t *testing.T) {
+	h, sub := newQuarantineHandler(t, 100)
+	files := quarantineFiles(100)
+
+	changes := &fileChanges{deleted: deletedPaths(files[:5])}
+	h.quarantineDeletions(changes)
+	if len(changes.deleted) != 5 || h.PendingMassDeletion() != nil {
+		t.Errorf("small deletion: %d deleted, pending %+v; want 5 and none", len(changes.deleted), h.PendingMassDeletion())
+	}
+	select {
+	case d := <-sub.MassDeletions():
+		t.Errorf("announced %+v for a small deletion", d)
+	default:
+	}
+}
+
+func TestCancelMassDeletion(t *testing.T) {
+	h, sub := newQuarantineHandler(t, 100)
+	h.quarantineDeletions(&fileChanges{deleted: deletedPaths(quarantineFiles(100))})
+	nextDeletion(t, sub)
+
+	d, err := h.ResolveMassDeletion(context.Background(), false)
+	if err != nil || d == nil || d.State != MassDeletionCancelled {
+		t.Fatalf("cancel = %+v, %v", d, err)
+	}
+	if d := nextDeletion(t, sub); d.State != MassDeletionCancelled {
+		t.Errorf("announced %+v, want cancelled", d)
+	}
+	if h.fileCache.len() != 100 {
+		t.Errorf("cache holds %d files after the cancel, want 100", h.fileCache.len())
+	}
+	if d, err := h.ResolveMassDeletion(context.Background(), true); d != nil || err != nil {
+		t.Errorf("resolve with nothing held = %+v, %v", d, err)
+	}
+}
+
+// TestGlitchScanDeletesNothing runs the glitch and recovery scans through
+// the file list handler and checks no rows were deleted
+func TestGlitchScanDeletesNothing(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, func(cfg *config.Config) {
+		cfg.MassDeleteCount = 1000
+		cfg.MassDeleteFraction = 0.5
+	}, "files")
+	ctx := context.Background()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+	list := func(files []models.FileNode) {
+		t.Helper()
+		data, err := json.Marshal(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.processMessage(ctx, agent, Message{Type: TypeLogList, Payload: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() int {
+		t.Helper()
+		files, err := h.db.GetAllFiles(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+
+	files := quarantineFiles(100)
+	for i := range files {
+		files[i].ModTime = now
+	}
+	list(files)
+	list(files[:2])
+	if n := stored(); n != 100 {
+		t.Fatalf("%d files stored after the glitch scan, want 100", n)
+	}
+	if p := h.PendingMassDeletion(); p == nil || p.Count != 98 {
+		t.Fatalf("pending = %+v, want 98 files held", p)
+	}
+	list(files)
+	if n := stored(); n != 100 {
+		t.Errorf("%d files stored after the recovery scan, want 100", n)
+	}
+	if p := h.PendingMassDeletion(); p != nil {
+		t.Errorf("still pending after recovery: %+v", p)
+	}
+
+	// A real deletion is held once and then applied
+	list(files[:2])
+	list(files[:2])
+	if n := stored(); n != 2 {
+		t.Errorf("%d files stored after a confirmed deletion, want 2", n)
+	}
+}
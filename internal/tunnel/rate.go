@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// rateWindowSeconds is how far back the in-memory packet rate can look
+const rateWindowSeconds = 300
+
+// rateWindow counts ingested packets and bytes in one-second buckets by
+// arrival time, so live rates can be read without querying the database
+type rateWindow struct {
+	mu      sync.Mutex
+	seconds [rateWindowSeconds]int64 // Unix second each bucket currently holds
+	packets [rateWindowSeconds]int64
+	bytes   [rateWindowSeconds]int64
+}
+
+func (w *rateWindow) add(now time.Time, packets []models.NetworkPacket) {
+	sec := now.Unix()
+	i := sec % rateWindowSeconds
+
+	var bytes int64
+	for _, p := range packets {
+		bytes += int64(p.Length)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seconds[i] != sec {
+		w.seconds[i] = sec
+		w.packets[i] = 0
+		w.bytes[i] = 0
+	}
+	w.packets[i] += int64(len(packets))
+	w.bytes[i] += bytes
+}
+
+// rate averages the complete seconds in the window ending before now; the
+// current second is still filling and would drag the rate down
+func (w *rateWindow) rate(now time.Time, window time.Duration) models.PacketRate {
+	n := int64(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if n > rateWindowSeconds-1 {
+		n = rateWindowSeconds - 1
+	}
+
+	end := now.Unix()
+	var packets, bytes int64
+
+	w.mu.Lock()
+	for sec := end - n; sec < end; sec++ {
+		i := sec % rateWindowSeconds
+		if w.seconds[i] == sec {
+			packets += w.packets[i]
+			bytes += w.bytes[i]
+		}
+	}
+	w.mu.Unlock()
+
+	return models.PacketRate{
+		Start:            time.Unix(end-n, 0).UTC(),
+		End:              time.Unix(end, 0).UTC(),
+		PacketsPerSecond: float64(packets) / float64(n),
+		BytesPerSecond:   float64(bytes) / float64(n),
+	}
+}
+
+// PacketRate returns the ingest rate over the last window (up to five
+// minutes) from memory
+func (h *Handler) PacketRate(window time.Duration) models.PacketRate {
+	return h.rates.rate(h.clock.Now(), window)
+}
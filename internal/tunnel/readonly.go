@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+)
+
+// Redirect tells an agent that connected to a read-only server where the
+// primary is. Agents that don't know the message see the connection close.
+type Redirect struct {
+	Reason string `json:"reason"`
+	// Agent address of the primary; empty when not configured
+	Addr string `json:"addr,omitempty"`
+}
+
+// redirectAgent answers a connection to a read-only server with a redirect
+// and closes it, without reading anything the agent sent
+func (h *Handler) redirectAgent(conn net.Conn) {
+	defer conn.Close()
+
+	data, err := json.Marshal(Redirect{Reason: "read_only", Addr: h.cfg.PrimaryAgentAddr})
+	if err != nil {
+		log.Printf("[TUNNEL] Error encoding redirect: %v", err)
+		return
+	}
+	if err := newAgentConn(conn, h.clock.Now()).send(Message{Type: TypeRedirect, Payload: data}); err != nil {
+		log.Printf("[TUNNEL] Error redirecting agent %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("[TUNNEL] Redirected agent %s to the primary at %s", conn.RemoteAddr(), h.cfg.PrimaryAgentAddr)
+}
@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+)
+
+func TestReadOnlyRedirectsAgents(t *testing.T) {
+	h := &Handler{
+		cfg:   &config.Config{ReadOnly: true, PrimaryAgentAddr: "primary.example:8081"},
+		clock: clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	agent, server := net.Pipe()
+	defer agent.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.HandleConnection(context.Background(), server)
+	}()
+
+	agent.SetReadDeadline(time.Now().Add(time.Second))
+	var msg Message
+	if err := json.NewDecoder(agent).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	var redirect Redirect
+	if err := json.Unmarshal(msg.Payload, &redirect); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != TypeRedirect || redirect.Reason != "read_only" || redirect.Addr != "primary.example:8081" {
+		t.Errorf("got %s %+v, want a redirect to the primary", msg.Type, redirect)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed after the redirect")
+	}
+	if _, err := agent.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after the redirect")
+	}
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// maxRegisteredIDLength matches the longest agent ID the API accepts
+const maxRegisteredIDLength = 255
+
+// Register names an agent. Agents send it before any data, though possibly
+// after hello; its ID then replaces the remote host as the agent's ID, so
+// its logs and packets are attributed to it wherever it connects from. ID
+// defaults to Hostname. Agents that don't register keep their remote host
+// as ID.
+type Register struct {
+	ID       string `json:"id,omitempty"`
+	Hostname string `json:"hostname"`
+	Version  string `json:"version,omitempty"`
+}
+
+func (h *Handler) handleRegister(ctx context.Context, agent *agentConn, payload json.RawMessage) error {
+	if agent.registration != nil {
+		return fmt.Errorf("%w: agent already registered as %s", errMalformed, agent.id)
+	}
+	// Earlier data was already stored under the old ID
+	if agent.dataMessages > 0 {
+		return fmt.Errorf("%w: register must precede data messages", errMalformed)
+	}
+
+	var reg Register
+	if err := unmarshalPayload(payload, &reg); err != nil {
+		return err
+	}
+	id := reg.ID
+	if id == "" {
+		id = reg.Hostname
+	}
+	if id == "" || len(id) > maxRegisteredIDLength || strings.Contains(id, "/") || id == models.DefaultAgentProfile {
+		return fmt.Errorf("%w: invalid agent ID %q", errMalformed, id)
+	}
+
+	now := h.clock.Now()
+	registration := &models.Agent{
+		ID:          id,
+		Hostname:    reg.Hostname,
+		IPAddress:   agent.host,
+		Version:     reg.Version,
+		ConnectedAt: agent.connected,
+		LastSeenAt:  now,
+	}
+	h.agents.mu.Lock()
+	agent.id = id
+	agent.registration = registration
+	h.agents.mu.Unlock()
+
+	// A capture follows the agent ID, so one of the remote host ends here
+	agent.capture.Store(nil)
+	h.attachCapture(agent)
+
+	log.Printf("[TUNNEL] Agent %s registered as %s (hostname %q, version %q)", agent.host, id, reg.Hostname, reg.Version)
+	if err := h.db.UpsertAgent(ctx, *registration); err != nil {
+		return err
+	}
+
+	// A hello before registering was answered with the remote host's config
+	if agent.configurable.Load() {
+		h.pushAgentConfig(ctx, agent)
+	}
+	return nil
+}
+
+// saveLastSeen stores when a registered agent last sent a message, once it
+// disconnects
+func (h *Handler) saveLastSeen(agent *agentConn) {
+	a, ok := agent.snapshot()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, 10*time.Second)
+	defer cancel()
+	if err := h.db.UpsertAgent(ctx, a); err != nil {
+		log.Printf("[TUNNEL] Error storing last seen time of %s: %v", a.ID, err)
+	}
+}
+
+// saveAgentEvent records why the agent's connection is being dropped
+func (h *Handler) saveAgentEvent(agent *agentConn, kind, detail string) {
+	ctx, cancel := context.WithTimeout(h.ctx, 10*time.Second)
+	defer cancel()
+	err := h.db.SaveAgentEvent(ctx, models.AgentEvent{AgentID: agent.id, Time: h.clock.Now(), Kind: kind, Detail: detail})
+	if err != nil {
+		log.Printf("[TUNNEL] Error storing %s event of %s: %v", kind, agent.id, err)
+	}
+}
+
+// snapshot returns the agent's registration with its last seen time, and
+// whether it registered. Callers hold the registry lock or run on the
+// connection's goroutine, the only one that registers.
+func (a *agentConn) snapshot() (models.Agent, bool) {
+	if a.registration == nil {
+		return models.Agent{}, false
+	}
+	reg := *a.registration
+	if seen := a.lastSeen.Load(); seen != 0 {
+		reg.LastSeenAt = time.Unix(0, seen)
+	}
+	return reg, true
+}
+
+// RegisteredAgents lists the registrations of connected agents, with the
+// time of their last message. An agent connected more than once is listed
+// with its latest connection.
+func (h *Handler) RegisteredAgents() []models.Agent {
+	h.agents.mu.RLock()
+	defer h.agents.mu.RUnlock()
+
+	latest := make(map[string]models.Agent)
+	for conn := range h.agents.conns {
+		a, ok := conn.snapshot()
+		if !ok {
+			continue
+		}
+		if prev, ok := latest[a.ID]; !ok || a.ConnectedAt.After(prev.ConnectedAt) {
+			latest[a.ID] = a
+		}
+	}
+
+	list := make([]models.Agent, 0, len(latest))
+	for _, a := range latest {
+		list = append(list, a)
+	}
+	return list
+}
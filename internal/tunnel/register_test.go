@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/pkg/models"
+)
+
+func TestRegisterRejected(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	h := &Handler{clock: clock.NewFake(time.Now())}
+	payload := json.RawMessage(`{"id": "web-01"}`)
+
+	afterData := newAgentConn(server, time.Now())
+	afterData.dataMessages = 1
+	if err := h.handleRegister(context.Background(), afterData, payload); !errors.Is(err, errMalformed) {
+		t.Errorf("register after data = %v, want malformed", err)
+	}
+
+	again := newAgentConn(server, time.Now())
+	again.registration = &models.Agent{ID: "web-01"}
+	if err := h.handleRegister(context.Background(), again, payload); !errors.Is(err, errMalformed) {
+		t.Errorf("second register = %v, want malformed", err)
+	}
+}
+
+func TestRegisterAfterHelloPushesRegisteredConfig(t *testing.T) {
+	database := openTestDB(t, "agents", "agent_configs")
+	ctx := context.Background()
+	if _, err := database.PutAgentConfig(ctx, "web-01", models.AgentConfig{ScanPaths: []string{"/srv/web"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	h := &Handler{
+		db:     database,
+		clock:  clock.NewFake(time.Now()),
+		agents: agentRegistry{conns: make(map[*agentConn]struct{})},
+	}
+	h.captures.active = make(map[string]*captureSession)
+	agent := newAgentConn(server, time.Now())
+
+	msgs := make(chan Message, 4)
+	go func() {
+		decoder := json.NewDecoder(client)
+		for {
+			var msg Message
+			if err := decoder.Decode(&msg); err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	if err := h.handleHello(ctx, agent, json.RawMessage(`{"capabilities": ["agent_config"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-msgs; msg.Type != TypeHello {
+		t.Fatalf("reply to hello = %s, want hello", msg.Type)
+	}
+	if err := h.handleRegister(ctx, agent, json.RawMessage(`{"id": "web-01"}`)); err != nil {
+		t.Fatalf("register after hello: %v", err)
+	}
+	if agent.id != "web-01" {
+		t.Fatalf("agent ID = %q, want web-01", agent.id)
+	}
+
+	select {
+	case msg := <-msgs:
+		var push AgentConfigPush
+		if err := json.Unmarshal(msg.Payload, &push); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != TypeAgentConfig || push.Profile != "web-01" {
+			t.Fatalf("pushed %s for profile %q, want agent_config for web-01", msg.Type, push.Profile)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no config pushed after registering")
+	}
+}
@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// batchRing keeps the most recently streamed network batches so reconnecting
+// clients can catch up. It is best-effort: it lives in memory, holds a fixed
+// number of batches, and is lost on restart.
+type batchRing struct {
+	mu      sync.RWMutex
+	batches [][]models.NetworkPacket
+	seqs    []uint64 // Sequence number of each slot's batch
+	seq     uint64   // Sequence number of the newest batch
+	next    int
+	full    bool
+}
+
+func newBatchRing(size int) *batchRing {
+	if size < 1 {
+		size = 1
+	}
+	return &batchRing{
+		batches: make([][]models.NetworkPacket, size),
+		seqs:    make([]uint64, size),
+		// Sequence numbers start from the clock, so those of a restarted
+		// server are higher than any it handed out before and a client
+		// resuming from one of those sees a gap
+		seq: uint64(time.Now().UnixMilli()) * 1000,
+	}
+}
+
+// add buffers a batch and returns its sequence number
+func (r *batchRing) add(batch []models.NetworkPacket) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.seq++
+	r.batches[r.next] = batch
+	r.seqs[r.next] = r.seq
+	r.next = (r.next + 1) % len(r.batches)
+	if r.next == 0 {
+		r.full = true
+	}
+	return r.seq
+}
+
+// after returns, oldest first, the buffered batches following sequence
+// number seq, and whether none in between were lost: evicted, shed, or from
+// before a restart
+func (r *batchRing) after(seq uint64) ([]NetworkBatch, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var result []NetworkBatch
+	r.eachSeq(func(s uint64, batch []models.NetworkPacket) {
+		if s > seq {
+			result = append(result, NetworkBatch{Seq: s, Packets: batch})
+		}
+	})
+	if len(result) == 0 {
+		return nil, seq == r.seq
+	}
+	return result, result[0].Seq == seq+1
+}
+
+// since returns, oldest first, the buffered packets with a timestamp after t,
+// grouped in their original batches
+func (r *batchRing) since(t time.Time) [][]models.NetworkPacket {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var result [][]models.NetworkPacket
+	r.each(func(batch []models.NetworkPacket) {
+		var newer []models.NetworkPacket
+		for _, p := range batch {
+			if p.Timestamp.After(t) {
+				newer = append(newer, p)
+			}
+		}
+		if len(newer) > 0 {
+			result = append(result, newer)
+		}
+	})
+	return result
+}
+
+// packets returns the number of packets currently buffered
+func (r *batchRing) packets() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	r.each(func(batch []models.NetworkPacket) { n += len(batch) })
+	return n
+}
+
+// dropOldest discards up to n of the oldest batches, returning the number of
+// packets released
+func (r *batchRing) dropOldest(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start := 0
+	if r.full {
+		start = r.next
+	}
+
+	released := 0
+	for i := 0; i < len(r.batches) && n > 0; i++ {
+		idx := (start + i) % len(r.batches)
+		if r.batches[idx] != nil {
+			released += len(r.batches[idx])
+			r.batches[idx] = nil
+			n--
+		}
+	}
+	return released
+}
+
+// each visits buffered batches oldest first; the caller must hold the lock
+func (r *batchRing) each(fn func([]models.NetworkPacket)) {
+	r.eachSeq(func(_ uint64, batch []models.NetworkPacket) { fn(batch) })
+}
+
+// eachSeq is each with the sequence numbers of the batches
+func (r *batchRing) eachSeq(fn func(uint64, []models.NetworkPacket)) {
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.batches)
+	}
+
+	for i := 0; i < count; i++ {
+		idx := (start + i) % len(r.batches)
+		if batch := r.batches[idx]; batch != nil {
+			fn(r.seqs[idx], batch)
+		}
+	}
+}
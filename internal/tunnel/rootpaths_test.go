@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// fileTree reads the stored tree under path down to depth
+func fileTree(t *testing.T, h *Handler, path string, depth int) []models.FileNode {
+	t.Helper()
+	var tree []models.FileNode
+	err := h.db.StreamFileTree(context.Background(), path, depth, db.FileOrder{}, func(chunk []models.FileNode) error {
+		tree = append(tree, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// TestRootChildrenFromEveryAgentVariant sends root-level files the ways
+// agents have reported them over time. Each must be stored with the
+// canonical parent_path "/" and appear in the root of the tree.
+func TestRootChildrenFromEveryAgentVariant(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	h := newTestHandler(t, now, nil, "files")
+	ctx := context.Background()
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	agent := newAgentConn(server, now)
+
+	// Raw JSON, since some agents left parent_path out altogether
+	list := `[
+		{"path": "/empty.log", "parent_path": "", "name": "empty.log", "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "/slash.log", "parent_path": "/", "name": "slash.log", "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "/dot.log", "parent_path": ".", "name": "dot.log", "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "/missing.log", "name": "missing.log", "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "relative.log", "parent_path": "", "name": "relative.log", "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "/var", "parent_path": "", "name": "var", "is_directory": true, "mod_time": "2024-01-01T00:00:00Z"},
+		{"path": "/var/nested.log", "parent_path": "var", "name": "nested.log", "mod_time": "2024-01-01T00:00:00Z"}
+	]`
+	if err := h.processMessage(ctx, agent, Message{Type: TypeLogList, Payload: json.RawMessage(list)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"/empty.log":      "/",
+		"/slash.log":      "/",
+		"/dot.log":        "/",
+		"/missing.log":    "/",
+		"/relative.log":   "/",
+		"/var":            "/",
+		"/var/nested.log": "/var",
+	}
+	checkTree := func(stage string) {
+		t.Helper()
+		parents := make(map[string]string)
+		for _, f := range fileTree(t, h, "/", 2) {
+			parents[f.Path] = f.ParentPath
+		}
+		for path, parent := range want {
+			got, ok := parents[path]
+			if !ok {
+				t.Errorf("%s: %s missing from the tree", stage, path)
+				continue
+			}
+			if got != parent {
+				t.Errorf("%s: %s has parent_path %q, want %q", stage, path, got, parent)
+			}
+			if cached, _ := h.CachedFile(path); cached.ParentPath != parent {
+				t.Errorf("%s: %s cached with parent_path %q, want %q", stage, path, cached.ParentPath, parent)
+			}
+		}
+	}
+	checkTree("plain list")
+
+	// A newer agent sends the same files prefix coded, and one more
+	var plain []models.FileNode
+	if err := json.Unmarshal([]byte(list), &plain); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range plain {
+		names = append(names, paths.Normalize(f.Path))
+	}
+	names = append(names, "/compact.log")
+	sort.Strings(names)
+	compact := compactFileList{Encoding: fileListPrefix}
+	for _, p := range names {
+		compact.Files = append(compact.Files, compactFile{Suffix: p, IsDirectory: p == "/var", ModTime: now.UnixNano()})
+	}
+	if err := h.processMessage(ctx, agent, Message{Type: TypeLogList, Payload: mustMarshal(t, compact)}); err != nil {
+		t.Fatal(err)
+	}
+	want["/compact.log"] = "/"
+	checkTree("prefix-coded list")
+}
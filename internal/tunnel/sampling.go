@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// maxSamplingFactor caps how aggressively the raw packet stream is thinned
+const maxSamplingFactor = 64
+
+// StreamQuality announces the sampling applied to the raw packet stream
+type StreamQuality struct {
+	SamplingFactor int `json:"sampling_factor"`
+	QueueDepth     int `json:"queue_depth"`
+	QueueCapacity  int `json:"queue_capacity"`
+	// Current end-to-end ingest latency of packets, capture to commit
+	LatencyP50Ms float64 `json:"latency_p50_ms"`
+	LatencyP95Ms float64 `json:"latency_p95_ms"`
+	// Set under fair scheduling: packets waiting for a later batch, and
+	// packets dropped from full agent buffers so far
+	HeldPackets    int   `json:"held_packets,omitempty"`
+	DroppedPackets int64 `json:"dropped_packets,omitempty"`
+	// Stream policy in effect, see /api/admin/stream-policy
+	Policy StreamPolicy `json:"policy"`
+}
+
+// streamSampler thins the raw packet stream deterministically under load:
+// every Nth packet is kept, with N derived from the stream queue depth.
+type streamSampler struct {
+	mu      sync.Mutex
+	factor  int
+	counter uint64
+
+	// Shares the kept packets among agents; nil keeps every Nth packet
+	// regardless of agent
+	fair *fairScheduler
+}
+
+func newStreamSampler(fair *fairScheduler) *streamSampler {
+	return &streamSampler{
+		factor: 1,
+		fair:   fair,
+	}
+}
+
+// samplingFactor maps queue fill to a keep-1-in-N factor: no sampling below
+// half full, then doubling for every further 10% of fill
+func samplingFactor(depth, capacity int) int {
+	if capacity == 0 {
+		return 1
+	}
+
+	fill := depth * 100 / capacity
+	if fill < 50 {
+		return 1
+	}
+
+	factor := 2 << ((fill - 50) / 10)
+	if factor > maxSamplingFactor {
+		factor = maxSamplingFactor
+	}
+	return factor
+}
+
+// sample keeps every nth packet, continuing the count across batches so the
+// selection doesn't depend on how packets were batched
+func (s *streamSampler) sample(batch []models.NetworkPacket, n int) []models.NetworkPacket {
+	if n <= 1 {
+		return batch
+	}
+
+	kept := make([]models.NetworkPacket, 0, len(batch)/n+1)
+	for _, p := range batch {
+		if s.counter%uint64(n) == 0 {
+			kept = append(kept, p)
+		}
+		s.counter++
+	}
+	return kept
+}
+
+// summarize totals a batch per second
+func summarize(batch []models.NetworkPacket) map[int64]*models.NetworkSummary {
+	summaries := make(map[int64]*models.NetworkSummary)
+	for _, p := range batch {
+		second := p.Timestamp.Truncate(time.Second)
+		key := second.Unix()
+
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &models.NetworkSummary{
+				Timestamp: second,
+				Protocols: make(map[string]int64),
+			}
+			summaries[key] = summary
+		}
+
+		summary.PacketCount++
+		summary.TotalBytes += int64(p.Length)
+		summary.Protocols[p.Protocol]++
+	}
+	return summaries
+}
+
+// streamNetworkBatch publishes a persisted batch to the live streams. The
+// per-second summary covers every packet and is never dropped; the raw packet
+// stream is downsampled when its queue backs up, or down to the policy's
+// sampling floor, and skipped when the policy turns it off.
+func (h *Handler) streamNetworkBatch(batch []models.NetworkPacket) {
+	if avg := atomic.LoadInt64(&h.avgStreamBatch); avg == 0 {
+		atomic.StoreInt64(&h.avgStreamBatch, int64(len(batch)))
+	} else {
+		atomic.StoreInt64(&h.avgStreamBatch, (avg*7+int64(len(batch)))/8)
+	}
+
+	s := h.sampler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.publishSummaries(summarize(batch))
+
+	policy := h.StreamPolicy().Network
+	if !policy.RawPackets {
+		return
+	}
+
+	depth, capacity := h.networkStreamDepth()
+	factor := max(samplingFactor(depth, capacity), policy.SamplingFloor)
+	if factor != s.factor {
+		s.factor = factor
+		log.Printf("[TUNNEL] Network stream sampling factor now 1/%d (queue %d/%d)", factor, depth, capacity)
+		h.publishQuality(StreamQuality{
+			SamplingFactor: factor,
+			QueueDepth:     depth,
+			QueueCapacity:  capacity,
+		})
+	}
+
+	var sampled []models.NetworkPacket
+	if s.fair != nil {
+		// The sampling factor sets how many packets go out; the scheduler
+		// picks which, taking from each agent in turn
+		budget := -1
+		if factor > 1 {
+			budget = (len(batch) + factor - 1) / factor
+		}
+		sampled = s.fair.schedule(batch, budget)
+	} else {
+		sampled = s.sample(batch, factor)
+	}
+	if len(sampled) == 0 {
+		return
+	}
+
+	if missed := h.streams.network.Publish(sampled); missed > 0 {
+		log.Printf("[TUNNEL] Network stream full for %d clients, dropped %d packets", missed, len(sampled))
+	}
+}
+
+func (h *Handler) publishQuality(q StreamQuality) {
+	q.LatencyP50Ms, q.LatencyP95Ms = h.latency.endToEnd()
+	q.Policy = h.StreamPolicy()
+	if fair := h.sampler.fair; fair != nil {
+		q.HeldPackets, q.DroppedPackets = fair.stats()
+	}
+	// Clients that miss it get a newer one when the factor changes again
+	h.streams.quality.Publish(q)
+}
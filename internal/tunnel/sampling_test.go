@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func TestSamplingFactor(t *testing.T) {
+	tests := []struct {
+		depth, capacity, want int
+	}{
+		{0, 0, 1},
+		{0, 100, 1},
+		{49, 100, 1},
+		{50, 100, 2},
+		{59, 100, 2},
+		{60, 100, 4},
+		{75, 100, 8},
+		{90, 100, 32},
+		{100, 100, maxSamplingFactor},
+	}
+	for _, tt := range tests {
+		if got := samplingFactor(tt.depth, tt.capacity); got != tt.want {
+			t.Errorf("samplingFactor(%d, %d) = %d, want %d", tt.depth, tt.capacity, got, tt.want)
+		}
+	}
+}
+
+func TestSampleCountsAcrossBatches(t *testing.T) {
+	s := newStreamSampler(nil)
+	batch := make([]models.NetworkPacket, 3)
+	for i := range batch {
+		batch[i].SrcPort = i
+	}
+
+	// Every 2nd of 3+3 packets, whatever the batching
+	first := s.sample(batch, 2)
+	second := s.sample(batch, 2)
+	if len(first) != 2 || len(second) != 1 || second[0].SrcPort != 1 {
+		t.Fatalf("kept %v then %v, want 2 packets then the second", first, second)
+	}
+	if got := s.sample(batch, 1); len(got) != len(batch) {
+		t.Fatalf("factor 1 kept %d of %d packets", len(got), len(batch))
+	}
+}
+
+// TestDownsamplingUnderLoad pushes bursts through a client that stops
+// reading: raw packets are sampled once its queue backs up and not once it
+// catches up, while every packet is counted in the summaries it receives.
+func TestDownsamplingUnderLoad(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	cfg := &config.Config{NetworkBufferSize: 16, LogBufferSize: 4, StreamRawPackets: true}
+	h := &Handler{cfg: cfg, streams: newStreamSubscribers(cfg), sampler: newStreamSampler(nil), latency: newIngestLatency()}
+	policy := h.DefaultStreamPolicy()
+	h.streamPolicy.Store(&policy)
+
+	client := h.SubscribeStreams(func(string) bool { return true })
+	defer client.Close()
+
+	const (
+		batches      = 2000 // Twice the summary buffer, one second each
+		batchPackets = 10
+	)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	push := func(second int) {
+		batch := make([]models.NetworkPacket, batchPackets)
+		for i := range batch {
+			batch[i] = models.NetworkPacket{Timestamp: start.Add(time.Duration(second) * time.Second), Protocol: "TCP", Length: 100}
+		}
+		h.streamNetworkBatch(batch)
+	}
+
+	var factors []int
+	readQuality := func() {
+		for {
+			select {
+			case q := <-client.Quality():
+				factors = append(factors, q.SamplingFactor)
+			default:
+				return
+			}
+		}
+	}
+
+	// The burst, with the client reading only quality messages
+	for i := 0; i < batches; i++ {
+		push(i)
+		readQuality()
+	}
+	if len(factors) == 0 || factors[len(factors)-1] != maxSamplingFactor {
+		t.Fatalf("sampling factors during the burst = %v, want rising to %d", factors, maxSamplingFactor)
+	}
+	raw := 0
+	for len(client.Network()) > 0 {
+		raw += len(<-client.Network())
+	}
+	if raw >= batches*batchPackets/2 {
+		t.Errorf("client got %d raw packets of %d, want them sampled", raw, batches*batchPackets)
+	}
+
+	// The client caught up
+	push(batches)
+	readQuality()
+	if factors[len(factors)-1] != 1 {
+		t.Errorf("sampling factor after catching up = %d, want 1", factors[len(factors)-1])
+	}
+	if got := len(<-client.Network()); got != batchPackets {
+		t.Errorf("got %d raw packets of a batch after catching up, want all %d", got, batchPackets)
+	}
+
+	// Summaries held back while the client's buffer was full follow as it reads
+	var packets int64
+	seconds := make(map[time.Time]bool)
+	for len(seconds) < batches+1 {
+		select {
+		case s := <-client.Summaries():
+			packets += s.PacketCount
+			seconds[s.Timestamp] = true
+		default:
+			if len(client.Summaries()) == 0 {
+				h.streamNetworkBatch(nil)
+				if len(client.Summaries()) == 0 {
+					t.Fatalf("summaries of %d seconds delivered, want %d", len(seconds), batches+1)
+				}
+			}
+		}
+	}
+	if want := int64((batches + 1) * batchPackets); packets != want {
+		t.Errorf("summaries counted %d packets, want %d", packets, want)
+	}
+}
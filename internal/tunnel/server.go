@@ -11,10 +11,12 @@ import (
 	"diagnostic-client/internal/config"
 )
 
+// Server accepts agent connections from an ingress and runs each through
+// the handler, tracking them so shutdown can close and wait for all
 type Server struct {
 	cfg      *config.Config
 	handler  *Handler
-	listener net.Listener
+	listener Ingress
 
 	// Connection management
 	activeConns sync.WaitGroup
@@ -26,26 +28,20 @@ type Server struct {
 	shutdownOnce sync.Once
 }
 
-func NewServer(cfg *config.Config, handler *Handler) (*Server, error) {
-	// Create TCP listener
-	listener, err := net.Listen("tcp", cfg.AgentAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %w", err)
-	}
-
-	server := &Server{
+// NewServer serves the agents that arrive through ingress; shutting the
+// server down closes it
+func NewServer(cfg *config.Config, handler *Handler, ingress Ingress) *Server {
+	return &Server{
 		cfg:         cfg,
 		handler:     handler,
-		listener:    listener,
+		listener:    ingress,
 		connections: make(map[net.Conn]struct{}),
 		shutdownCh:  make(chan struct{}),
 	}
-
-	return server, nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
-	log.Printf("[TUNNEL] Server listening on %s", s.cfg.AgentAddr)
+	log.Printf("[TUNNEL] Server listening on %s", s.listener.Addr())
 
 	// Create error channel for accept loop
 	acceptErrors := make(chan error, 1)
@@ -0,0 +1,122 @@
+//go:build soak
+
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/membudget"
+	"diagnostic-client/pkg/models"
+)
+
+// TestSoakMemoryCeiling runs fake agents sending packets as fast as the
+// server takes them, with a websocket client that never reads, and checks
+// that the accounted memory stays under the ceiling. It runs for
+// SOAK_DURATION (default 3m):
+//
+//	TEST_DATABASE_URL=... go test -tags soak -run Soak -timeout 30m ./internal/tunnel
+func TestSoakMemoryCeiling(t *testing.T) {
+	duration := 3 * time.Minute
+	if s := os.Getenv("SOAK_DURATION"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatalf("SOAK_DURATION: %v", err)
+		}
+		duration = d
+	}
+	const (
+		agents       = 20
+		batchPackets = 200
+		ceiling      = 16 << 20
+	)
+
+	database := openTestDB(t, "network_packets")
+	t.Setenv("DATABASE_URL", os.Getenv("TEST_DATABASE_URL"))
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.MemoryCeiling = ceiling
+	h := NewHandler(cfg, database, clock.Real{})
+	defer h.Close()
+
+	budget := membudget.New(cfg.MemoryCeiling)
+	for _, c := range h.MemoryComponents() {
+		budget.Register(c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	go budget.Run(ctx, 100*time.Millisecond)
+
+	// A websocket client that stopped reading
+	slow := h.SubscribeStreams(func(string) bool { return true })
+	defer slow.Close()
+
+	var wg sync.WaitGroup
+	var sent [agents]int
+	for i := 0; i < agents; i++ {
+		agent, server := net.Pipe()
+		go h.HandleConnection(ctx, server)
+		go io.Copy(io.Discard, agent)
+
+		wg.Add(1)
+		go func(i int, agent net.Conn) {
+			defer wg.Done()
+			defer agent.Close()
+			encoder := json.NewEncoder(agent)
+			for batch := 0; ctx.Err() == nil; batch++ {
+				packets := make([]models.NetworkPacket, batchPackets)
+				for j := range packets {
+					packets[j] = models.NetworkPacket{
+						Timestamp: time.Now(), Protocol: "TCP",
+						SrcIP: fmt.Sprintf("10.0.%d.1", i), DstIP: "10.0.0.2",
+						SrcPort: 40000 + j, DstPort: 443, Length: 1500, PayloadSize: 1448,
+					}
+				}
+				payload, _ := json.Marshal(map[string]interface{}{"batch_id": fmt.Sprintf("%d-%d", i, batch), "packets": packets})
+				if err := encoder.Encode(Message{Type: TypeMetrics, Payload: payload}); err != nil {
+					return
+				}
+				sent[i] += batchPackets
+			}
+		}(i, agent)
+	}
+
+	var peak int64
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			if used := budget.Used(); used > peak {
+				peak = used
+				if used > ceiling {
+					t.Errorf("accounted memory %d bytes over the %d byte ceiling", used, int64(ceiling))
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range sent {
+		total += n
+	}
+	var shed int64
+	for _, c := range budget.Stats().Components {
+		shed += c.ShedEvents
+	}
+	t.Logf("%d packets from %d agents in %v; peak accounted memory %d of %d bytes; %d shed actions",
+		total, agents, duration, peak, int64(ceiling), shed)
+}
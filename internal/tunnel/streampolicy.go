@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"log"
+	"time"
+
+	"diagnostic-client/internal/clock"
+)
+
+// StreamPolicy sets how verbose the live websocket streams are. It starts
+// from the configuration, can be changed at runtime and, when given a TTL,
+// reverts to the configured policy once it expires.
+type StreamPolicy struct {
+	Network     NetworkStreamPolicy    `json:"network"`
+	Logs        LogStreamPolicy        `json:"logs"`
+	FileUpdates FileUpdateStreamPolicy `json:"file_updates"`
+	// When the policy reverts to the configured one; nil when it doesn't
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type NetworkStreamPolicy struct {
+	// Off streams only the per-second summaries
+	RawPackets bool `json:"raw_packets"`
+	// The raw stream keeps at most 1 in N packets, however idle its queue
+	SamplingFloor int `json:"sampling_floor"`
+}
+
+type LogStreamPolicy struct {
+	// How long log lines are collected into one logs message; 0 sends
+	// every line on its own
+	BatchWindowMs int `json:"batch_window_ms"`
+}
+
+type FileUpdateStreamPolicy struct {
+	// How long file updates past the rate budget are collected into one
+	// batch; 0 sends every update on its own
+	CoalesceWindowMs int `json:"coalesce_window_ms"`
+}
+
+func (p LogStreamPolicy) BatchWindow() time.Duration {
+	return time.Duration(p.BatchWindowMs) * time.Millisecond
+}
+
+func (p FileUpdateStreamPolicy) CoalesceWindow() time.Duration {
+	return time.Duration(p.CoalesceWindowMs) * time.Millisecond
+}
+
+// DefaultStreamPolicy returns the configured stream policy
+func (h *Handler) DefaultStreamPolicy() StreamPolicy {
+	return StreamPolicy{
+		Network: NetworkStreamPolicy{
+			RawPackets:    h.cfg.StreamRawPackets,
+			SamplingFloor: h.cfg.StreamSamplingFloor,
+		},
+		Logs: LogStreamPolicy{
+			BatchWindowMs: int(h.cfg.LogStreamWindow / time.Millisecond),
+		},
+		FileUpdates: FileUpdateStreamPolicy{
+			CoalesceWindowMs: int(h.cfg.FileUpdateWindow / time.Millisecond),
+		},
+	}
+}
+
+// StreamPolicy returns the stream policy in effect
+func (h *Handler) StreamPolicy() StreamPolicy {
+	return *h.streamPolicy.Load()
+}
+
+// SetStreamPolicy applies p to the live streams immediately, for ttl or,
+// when ttl is 0, until changed again. Clients are told through
+// stream_quality.
+func (h *Handler) SetStreamPolicy(p StreamPolicy, ttl time.Duration) StreamPolicy {
+	p.ExpiresAt = nil
+	if ttl > 0 {
+		expiry := h.clock.Now().Add(ttl)
+		p.ExpiresAt = &expiry
+	}
+	h.streamPolicy.Store(&p)
+	h.streamPolicyChanged()
+	return p
+}
+
+// ResetStreamPolicy goes back to the configured stream policy
+func (h *Handler) ResetStreamPolicy() StreamPolicy {
+	p := h.DefaultStreamPolicy()
+	h.streamPolicy.Store(&p)
+	h.streamPolicyChanged()
+	return p
+}
+
+func (h *Handler) streamPolicyChanged() {
+	select {
+	case h.streamPolicyCh <- struct{}{}:
+	default:
+		// The expiry worker hasn't picked up the previous change yet
+	}
+	h.announceStreamPolicy()
+}
+
+// expireStreamPolicies reverts a policy set with a TTL once it expires
+func (h *Handler) expireStreamPolicies() {
+	for {
+		current := h.streamPolicy.Load()
+		var (
+			timer  clock.Timer
+			expiry <-chan time.Time
+		)
+		if current.ExpiresAt != nil {
+			timer = h.clock.NewTimer(current.ExpiresAt.Sub(h.clock.Now()))
+			expiry = timer.C()
+		}
+
+		select {
+		case <-h.shutdownCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-h.streamPolicyCh:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-expiry:
+			// Unless it was replaced in the meantime
+			p := h.DefaultStreamPolicy()
+			if h.streamPolicy.CompareAndSwap(current, &p) {
+				log.Printf("[TUNNEL] Stream policy expired, back to configured %+v", p)
+				h.announceStreamPolicy()
+			}
+		}
+	}
+}
+
+// announceStreamPolicy sends a stream_quality update with the new policy
+// and the sampling factor it results in
+func (h *Handler) announceStreamPolicy() {
+	s := h.sampler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depth, capacity := h.networkStreamDepth()
+	s.factor = max(samplingFactor(depth, capacity), h.StreamPolicy().Network.SamplingFloor)
+	h.publishQuality(StreamQuality{
+		SamplingFactor: s.factor,
+		QueueDepth:     depth,
+		QueueCapacity:  capacity,
+	})
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+// newPolicyHandler returns a handler with just the live streams and the
+// stream policy, running the expiry worker on clk
+func newPolicyHandler(t *testing.T, cfg *config.Config, clk clock.Clock) *Handler {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	h := &Handler{
+		cfg:            cfg,
+		clock:          clk,
+		streams:        newStreamSubscribers(cfg),
+		sampler:        newStreamSampler(nil),
+		latency:        newIngestLatency(),
+		streamPolicyCh: make(chan struct{}, 1),
+		shutdownCh:     make(chan struct{}),
+	}
+	policy := h.DefaultStreamPolicy()
+	h.streamPolicy.Store(&policy)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.expireStreamPolicies()
+	}()
+	t.Cleanup(func() {
+		close(h.shutdownCh)
+		<-done
+	})
+	return h
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func packetBatch(n int) []models.NetworkPacket {
+	batch := make([]models.NetworkPacket, n)
+	for i := range batch {
+		batch[i] = models.NetworkPacket{Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Protocol: "TCP", SrcPort: i, Length: 100}
+	}
+	return batch
+}
+
+// lastQuality drains the client's quality announcements, returning the latest
+func lastQuality(t *testing.T, client *StreamSubscription) StreamQuality {
+	t.Helper()
+	var (
+		q   StreamQuality
+		got bool
+	)
+	for {
+		select {
+		case q = <-client.Quality():
+			got = true
+		default:
+			if !got {
+				t.Fatal("no stream_quality announced")
+			}
+			return q
+		}
+	}
+}
+
+func TestStreamPolicyFlipsMidStream(t *testing.T) {
+	cfg := &config.Config{NetworkBufferSize: 16, LogBufferSize: 4, StreamRawPackets: true, StreamSamplingFloor: 1}
+	h := newPolicyHandler(t, cfg, clock.Real{})
+
+	// The same subscription throughout, as a connected client keeps
+	client := h.SubscribeStreams(func(string) bool { return true })
+	defer client.Close()
+
+	h.streamNetworkBatch(packetBatch(8))
+	if got := len(<-client.Network()); got != 8 {
+		t.Fatalf("raw packets with the configured policy = %d, want 8", got)
+	}
+	<-client.Summaries()
+
+	off := h.StreamPolicy()
+	off.Network.RawPackets = false
+	h.SetStreamPolicy(off, 0)
+	if q := lastQuality(t, client); q.Policy.Network.RawPackets {
+		t.Errorf("announced policy %+v, want raw packets off", q.Policy)
+	}
+	h.streamNetworkBatch(packetBatch(8))
+	if s := <-client.Summaries(); s.PacketCount != 8 {
+		t.Errorf("summary with raw packets off counted %d packets, want 8", s.PacketCount)
+	}
+	if len(client.Network()) != 0 {
+		t.Error("raw packets streamed with the policy turning them off")
+	}
+
+	floor := h.StreamPolicy()
+	floor.Network.RawPackets = true
+	floor.Network.SamplingFloor = 4
+	h.SetStreamPolicy(floor, 0)
+	if q := lastQuality(t, client); q.SamplingFactor != 4 || q.Policy.Network.SamplingFloor != 4 {
+		t.Errorf("announced factor %d and policy %+v, want the floor of 4", q.SamplingFactor, q.Policy)
+	}
+	h.streamNetworkBatch(packetBatch(8))
+	if got := len(<-client.Network()); got != 2 {
+		t.Errorf("raw packets with a sampling floor of 4 = %d of 8, want 2", got)
+	}
+}
+
+func TestStreamPolicyExpires(t *testing.T) {
+	cfg := &config.Config{NetworkBufferSize: 16, LogBufferSize: 4, StreamRawPackets: true, StreamSamplingFloor: 1, LogStreamWindow: 100 * time.Millisecond}
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := newPolicyHandler(t, cfg, clk)
+	client := h.SubscribeStreams(func(string) bool { return true })
+	defer client.Close()
+
+	p := h.StreamPolicy()
+	p.Network.RawPackets = false
+	p.Logs.BatchWindowMs = 2000
+	set := h.SetStreamPolicy(p, time.Minute)
+	if set.ExpiresAt == nil || !set.ExpiresAt.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("expires at %v, want a minute from now", set.ExpiresAt)
+	}
+	lastQuality(t, client)
+	waitFor(t, "the expiry timer", func() bool { return clk.Waiters() == 1 })
+
+	clk.Advance(59 * time.Second)
+	if h.StreamPolicy().ExpiresAt == nil {
+		t.Fatal("policy reverted before its TTL")
+	}
+	clk.Advance(time.Second)
+	waitFor(t, "the policy to revert", func() bool { return h.StreamPolicy().ExpiresAt == nil })
+
+	if got, want := h.StreamPolicy(), h.DefaultStreamPolicy(); got != want {
+		t.Errorf("policy after expiry = %+v, want the configured %+v", got, want)
+	}
+	waitFor(t, "the announcement", func() bool { return len(client.Quality()) > 0 })
+	if q := lastQuality(t, client); !q.Policy.Network.RawPackets || q.Policy.Logs.BatchWindowMs != 100 {
+		t.Errorf("announced policy after expiry %+v, want the configured one", q.Policy)
+	}
+}
+
+func TestReplacedStreamPolicyDoesNotExpire(t *testing.T) {
+	cfg := &config.Config{NetworkBufferSize: 16, LogBufferSize: 4, StreamSamplingFloor: 1}
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := newPolicyHandler(t, cfg, clk)
+
+	p := h.StreamPolicy()
+	p.Network.SamplingFloor = 8
+	h.SetStreamPolicy(p, time.Minute)
+	waitFor(t, "the expiry timer", func() bool { return clk.Waiters() == 1 })
+
+	// Replaced by one without a TTL before the first expires
+	p.Network.SamplingFloor = 16
+	h.SetStreamPolicy(p, 0)
+	waitFor(t, "the expiry timer to stop", func() bool { return clk.Waiters() == 0 })
+
+	clk.Advance(time.Hour)
+	if got := h.StreamPolicy().Network.SamplingFloor; got != 16 {
+		t.Errorf("sampling floor an hour later = %d, want the replacement's 16", got)
+	}
+
+	h.ResetStreamPolicy()
+	if got, want := h.StreamPolicy(), h.DefaultStreamPolicy(); got != want {
+		t.Errorf("policy after reset = %+v, want the configured %+v", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/pubsub"
+	"diagnostic-client/pkg/models"
+)
+
+// Buffers of each live stream subscription, beyond the configured network
+// and log buffers
+const (
+	summaryStreamBuffer   = 1024
+	qualityStreamBuffer   = 16
+	fileUpdateBuffer      = 256
+	operationStreamBuffer = 256
+	massDeletionBuffer    = 16
+)
+
+// StreamSubscription receives its own copy of the live streams, typically
+// for one websocket client. A subscriber whose buffer is full misses
+// messages instead of holding up ingest or other subscribers; per-second
+// network summaries are never missed, but merged until they fit.
+type StreamSubscription struct {
+	h          *Handler
+	network    <-chan []models.NetworkPacket
+	summaries  chan models.NetworkSummary
+	quality    <-chan StreamQuality
+	logs       <-chan models.LogEntry
+	files      <-chan models.FileNode
+	operations <-chan models.Operation
+	deletions  <-chan MassDeletion
+	closed     chan struct{}
+
+	// Per-second summaries not yet accepted by summaries, guarded by the
+	// sampler lock
+	pendingSummaries map[int64]*models.NetworkSummary
+}
+
+// Network delivers stored packets, sampled under load per the stream policy
+func (s *StreamSubscription) Network() <-chan []models.NetworkPacket { return s.network }
+
+// Summaries delivers per-second totals over all packets, unaffected by raw
+// stream sampling
+func (s *StreamSubscription) Summaries() <-chan models.NetworkSummary { return s.summaries }
+
+// Quality announces changes to the raw packet stream sampling factor and the
+// stream policy
+func (s *StreamSubscription) Quality() <-chan StreamQuality { return s.quality }
+
+// Logs delivers stored log lines
+func (s *StreamSubscription) Logs() <-chan models.LogEntry { return s.logs }
+
+// FileUpdates delivers new and changed files
+func (s *StreamSubscription) FileUpdates() <-chan models.FileNode { return s.files }
+
+// Operations delivers operation state changes
+func (s *StreamSubscription) Operations() <-chan models.Operation { return s.operations }
+
+// MassDeletions delivers held mass deletions and their resolution
+func (s *StreamSubscription) MassDeletions() <-chan MassDeletion { return s.deletions }
+
+// Closed is closed when the handler shuts down, as are the stream channels;
+// nothing is delivered after it
+func (s *StreamSubscription) Closed() <-chan struct{} { return s.closed }
+
+// Close ends the subscription
+func (s *StreamSubscription) Close() {
+	streams := &s.h.streams
+	streams.mu.Lock()
+	delete(streams.subs, s)
+	streams.mu.Unlock()
+
+	streams.network.Unsubscribe(s.network)
+	streams.quality.Unsubscribe(s.quality)
+	streams.logs.Unsubscribe(s.logs)
+	streams.files.Unsubscribe(s.files)
+	streams.operations.Unsubscribe(s.operations)
+	streams.deletions.Unsubscribe(s.deletions)
+}
+
+// streamSubscribers holds a broker per live stream. Summaries are merged
+// rather than dropped when a subscriber falls behind, so they are sent to
+// the registered subscriptions directly.
+type streamSubscribers struct {
+	network    *pubsub.Broker[[]models.NetworkPacket]
+	quality    *pubsub.Broker[StreamQuality]
+	logs       *pubsub.Broker[models.LogEntry]
+	files      *pubsub.Broker[models.FileNode]
+	operations *pubsub.Broker[models.Operation]
+	deletions  *pubsub.Broker[MassDeletion]
+
+	mu   sync.RWMutex
+	subs map[*StreamSubscription]struct{}
+	done bool // Set on shutdown
+}
+
+func newStreamSubscribers(cfg *config.Config) streamSubscribers {
+	return streamSubscribers{
+		network:    pubsub.NewBroker[[]models.NetworkPacket](cfg.NetworkBufferSize),
+		quality:    pubsub.NewBroker[StreamQuality](qualityStreamBuffer),
+		logs:       pubsub.NewBroker[models.LogEntry](cfg.LogBufferSize),
+		files:      pubsub.NewBroker[models.FileNode](fileUpdateBuffer),
+		operations: pubsub.NewBroker[models.Operation](operationStreamBuffer),
+		deletions:  pubsub.NewBroker[MassDeletion](massDeletionBuffer),
+		subs:       make(map[*StreamSubscription]struct{}),
+	}
+}
+
+// SubscribeStreams subscribes to the live streams, receiving the log lines
+// of the files matchLog accepts. matchLog runs as lines are published and
+// must not block.
+func (h *Handler) SubscribeStreams(matchLog func(path string) bool) *StreamSubscription {
+	sub := &StreamSubscription{
+		h:                h,
+		network:          h.streams.network.Subscribe(),
+		summaries:        make(chan models.NetworkSummary, summaryStreamBuffer),
+		quality:          h.streams.quality.Subscribe(),
+		logs:             h.streams.logs.SubscribeFunc(func(entry models.LogEntry) bool { return matchLog(entry.Filename) }),
+		files:            h.streams.files.Subscribe(),
+		operations:       h.streams.operations.Subscribe(),
+		deletions:        h.streams.deletions.Subscribe(),
+		closed:           make(chan struct{}),
+		pendingSummaries: make(map[int64]*models.NetworkSummary),
+	}
+	h.streams.add(sub)
+	return sub
+}
+
+// SubscribeLogs subscribes to the stored log lines of the files match
+// accepts, for clients that want no other stream. match runs as lines are
+// published and must not block. The channel is closed by UnsubscribeLogs
+// and on shutdown.
+func (h *Handler) SubscribeLogs(match func(path string) bool) <-chan models.LogEntry {
+	return h.streams.logs.SubscribeFunc(func(entry models.LogEntry) bool {
+		return match(entry.Filename)
+	})
+}
+
+// UnsubscribeLogs ends a subscription from SubscribeLogs
+func (h *Handler) UnsubscribeLogs(lines <-chan models.LogEntry) {
+	h.streams.logs.Unsubscribe(lines)
+}
+
+// add registers a subscription, or closes it when shut down already
+func (s *streamSubscribers) add(sub *StreamSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		close(sub.closed)
+		return
+	}
+	s.subs[sub] = struct{}{}
+}
+
+// closeStreams ends every subscription on shutdown
+func (h *Handler) closeStreams() {
+	h.streams.mu.Lock()
+	h.streams.done = true
+	for sub := range h.streams.subs {
+		close(sub.closed)
+		delete(h.streams.subs, sub)
+	}
+	h.streams.mu.Unlock()
+
+	h.streams.network.Close()
+	h.streams.quality.Close()
+	h.streams.logs.Close()
+	h.streams.files.Close()
+	h.streams.operations.Close()
+	h.streams.deletions.Close()
+}
+
+// eachStream calls fn with every subscription
+func (h *Handler) eachStream(fn func(*StreamSubscription)) {
+	h.streams.mu.RLock()
+	defer h.streams.mu.RUnlock()
+
+	for sub := range h.streams.subs {
+		fn(sub)
+	}
+}
+
+// networkStreamDepth returns the fullest subscriber's network queue and its
+// capacity; sampling follows the slowest client
+func (h *Handler) networkStreamDepth() (depth, capacity int) {
+	_, depth = h.streams.network.Queued()
+	return depth, h.streams.network.Capacity()
+}
+
+// publishSummaries hands each subscriber the summaries of a batch. Those
+// that don't fit stay pending for the subscriber, merged with later packets
+// for the same second, and are sent oldest first. The caller must hold the
+// sampler lock.
+func (h *Handler) publishSummaries(summaries map[int64]*models.NetworkSummary) {
+	h.eachStream(func(sub *StreamSubscription) {
+		for key, s := range summaries {
+			mergeSummary(sub.pendingSummaries, key, s)
+		}
+
+		keys := make([]int64, 0, len(sub.pendingSummaries))
+		for k := range sub.pendingSummaries {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+		for _, k := range keys {
+			select {
+			case sub.summaries <- *sub.pendingSummaries[k]:
+				delete(sub.pendingSummaries, k)
+			default:
+				return
+			}
+		}
+	})
+}
+
+// mergeSummary adds s to the summary for its second in pending, copying it
+// so subscribers never share one
+func mergeSummary(pending map[int64]*models.NetworkSummary, key int64, s *models.NetworkSummary) {
+	summary, ok := pending[key]
+	if !ok {
+		summary = &models.NetworkSummary{
+			Timestamp: s.Timestamp,
+			Protocols: make(map[string]int64, len(s.Protocols)),
+		}
+		pending[key] = summary
+	}
+
+	summary.PacketCount += s.PacketCount
+	summary.TotalBytes += s.TotalBytes
+	for protocol, n := range s.Protocols {
+		summary.Protocols[protocol] += n
+	}
+}
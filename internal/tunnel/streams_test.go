@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"testing"
+
+	"diagnostic-client/internal/config"
+	"diagnostic-client/pkg/models"
+)
+
+func newStreamingHandler() *Handler {
+	return &Handler{streams: newStreamSubscribers(&config.Config{NetworkBufferSize: 4, LogBufferSize: 4})}
+}
+
+func TestSubscribeLogsFiltersBeforeDelivery(t *testing.T) {
+	h := newStreamingHandler()
+	lines := h.SubscribeLogs(func(path string) bool { return path == "/var/log/app.log" })
+	defer h.UnsubscribeLogs(lines)
+
+	for _, file := range []string{"/var/log/other.log", "/var/log/app.log", "/var/log/other.log"} {
+		h.streams.logs.Publish(models.LogEntry{Filename: file})
+	}
+
+	if got := <-lines; got.Filename != "/var/log/app.log" {
+		t.Fatalf("got line of %s, want /var/log/app.log", got.Filename)
+	}
+	if len(lines) != 0 {
+		t.Errorf("%d lines of other files delivered", len(lines))
+	}
+}
+
+func TestStreamsCloseOnShutdown(t *testing.T) {
+	h := newStreamingHandler()
+	sub := h.SubscribeStreams(func(string) bool { return true })
+	lines := h.SubscribeLogs(func(string) bool { return true })
+
+	h.closeStreams()
+
+	if _, ok := <-lines; ok {
+		t.Error("log subscription open after shutdown")
+	}
+	if _, ok := <-sub.Logs(); ok {
+		t.Error("stream subscription open after shutdown")
+	}
+	select {
+	case <-sub.Closed():
+	default:
+		t.Error("Closed not closed after shutdown")
+	}
+	// Ending a subscription after shutdown is harmless
+	sub.Close()
+	h.UnsubscribeLogs(lines)
+
+	if _, ok := <-h.SubscribeStreams(func(string) bool { return true }).Network(); ok {
+		t.Error("subscription after shutdown is open")
+	}
+}
+
+func TestStreamsFanOutToEverySubscriber(t *testing.T) {
+	h := newStreamingHandler()
+	all := func(string) bool { return true }
+	first, second := h.SubscribeStreams(all), h.SubscribeStreams(all)
+	defer first.Close()
+	defer second.Close()
+
+	h.streams.logs.Publish(models.LogEntry{Filename: "/var/log/app.log", Line: "hello"})
+
+	for i, sub := range []*StreamSubscription{first, second} {
+		if got := <-sub.Logs(); got.Line != "hello" {
+			t.Errorf("subscriber %d got %q, want hello", i, got.Line)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"log"
+	"sync"
+
+	"diagnostic-client/pkg/models"
+)
+
+// Flushed batches a subscriber may fall behind by before it is evicted
+const networkSubscriberBuffer = 16
+
+// NetworkBatch is a stored batch of packets and its position in the stream
+// of flushed batches
+type NetworkBatch struct {
+	Seq     uint64
+	Packets []models.NetworkPacket
+}
+
+// NetworkSubscription receives every network batch once it is stored. A
+// subscriber that doesn't keep up is evicted rather than slowing ingest down.
+type NetworkSubscription struct {
+	h       *Handler
+	ch      chan NetworkBatch
+	evicted chan struct{}
+}
+
+// Batches delivers stored batches in order
+func (s *NetworkSubscription) Batches() <-chan NetworkBatch {
+	return s.ch
+}
+
+// Evicted is closed when the subscriber fell too far behind, or on
+// shutdown; no more batches are delivered after it
+func (s *NetworkSubscription) Evicted() <-chan struct{} {
+	return s.evicted
+}
+
+// Close ends the subscription
+func (s *NetworkSubscription) Close() {
+	s.h.subscribers.mu.Lock()
+	defer s.h.subscribers.mu.Unlock()
+	delete(s.h.subscribers.subs, s)
+}
+
+type networkSubscribers struct {
+	mu   sync.Mutex
+	subs map[*NetworkSubscription]struct{}
+}
+
+// SubscribeNetwork subscribes to stored network batches. With resume, the
+// buffered batches after sequence number after are returned as backlog, and
+// complete reports whether none in between were lost; the subscription
+// continues right after the backlog.
+func (h *Handler) SubscribeNetwork(after uint64, resume bool) (sub *NetworkSubscription, backlog []NetworkBatch, complete bool) {
+	h.subscribers.mu.Lock()
+	defer h.subscribers.mu.Unlock()
+
+	complete = true
+	if resume {
+		backlog, complete = h.networkHistory.after(after)
+	}
+
+	sub = &NetworkSubscription{
+		h:       h,
+		ch:      make(chan NetworkBatch, networkSubscriberBuffer),
+		evicted: make(chan struct{}),
+	}
+	h.subscribers.subs[sub] = struct{}{}
+	return sub, backlog, complete
+}
+
+// publishNetworkBatch buffers a stored batch for replay and hands it to the
+// subscribers. Both happen under the subscriber lock, so a subscription
+// sees each batch exactly once, in its backlog or its channel.
+func (h *Handler) publishNetworkBatch(batch []models.NetworkPacket) {
+	h.subscribers.mu.Lock()
+	defer h.subscribers.mu.Unlock()
+
+	seq := h.networkHistory.add(batch)
+	for sub := range h.subscribers.subs {
+		select {
+		case sub.ch <- NetworkBatch{Seq: seq, Packets: batch}:
+		default:
+			log.Printf("[TUNNEL] Evicting network subscriber %d batches behind", len(sub.ch))
+			close(sub.evicted)
+			delete(h.subscribers.subs, sub)
+		}
+	}
+}
+
+// CloseNetworkSubscriptions evicts every subscriber, so long-lived streams
+// end when the server shuts down
+func (h *Handler) CloseNetworkSubscriptions() {
+	h.subscribers.mu.Lock()
+	defer h.subscribers.mu.Unlock()
+
+	for sub := range h.subscribers.subs {
+		close(sub.evicted)
+		delete(h.subscribers.subs, sub)
+	}
+}
@@ -0,0 +1,165 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// unknownMessageType groups message types this server doesn't handle, so
+// arbitrary type names can't grow the counters
+const unknownMessageType = "unknown"
+
+// MessageRate is the average message and payload byte rate of one message
+// type or agent
+type MessageRate struct {
+	Name              string  `json:"name"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+}
+
+// Throughput breaks the agent message rate down by type and by agent
+type Throughput struct {
+	Start   time.Time     `json:"start"`
+	End     time.Time     `json:"end"`
+	Total   MessageRate   `json:"total"`
+	ByType  []MessageRate `json:"by_type"`
+	ByAgent []MessageRate `json:"by_agent"`
+}
+
+// messageCounter counts messages and bytes in one-second buckets, like
+// rateWindow does for packets
+type messageCounter struct {
+	seconds  [rateWindowSeconds]int64
+	messages [rateWindowSeconds]int64
+	bytes    [rateWindowSeconds]int64
+	last     int64 // Newest second counted, for evicting idle agents
+}
+
+func (c *messageCounter) add(sec int64, bytes int) {
+	i := sec % rateWindowSeconds
+	if c.seconds[i] != sec {
+		c.seconds[i] = sec
+		c.messages[i] = 0
+		c.bytes[i] = 0
+	}
+	c.messages[i]++
+	c.bytes[i] += int64(bytes)
+	c.last = sec
+}
+
+// sum totals the complete seconds from start up to end
+func (c *messageCounter) sum(start, end int64) (int64, int64) {
+	var messages, bytes int64
+	for sec := start; sec < end; sec++ {
+		i := sec % rateWindowSeconds
+		if c.seconds[i] == sec {
+			messages += c.messages[i]
+			bytes += c.bytes[i]
+		}
+	}
+	return messages, bytes
+}
+
+// messageRates counts decoded agent messages by type and by agent
+type messageRates struct {
+	mu      sync.Mutex
+	byType  map[MessageType]*messageCounter
+	byAgent map[string]*messageCounter
+}
+
+func newMessageRates() *messageRates {
+	return &messageRates{
+		byType:  make(map[MessageType]*messageCounter),
+		byAgent: make(map[string]*messageCounter),
+	}
+}
+
+func (m *messageRates) add(now time.Time, agentID string, msgType MessageType, bytes int) {
+	switch msgType {
+	case TypeMetrics, TypeLogList, TypeLogData, TypeFileTruncated:
+	default:
+		msgType = unknownMessageType
+	}
+	sec := now.Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byType, ok := m.byType[msgType]
+	if !ok {
+		byType = &messageCounter{}
+		m.byType[msgType] = byType
+	}
+	byType.add(sec, bytes)
+
+	byAgent, ok := m.byAgent[agentID]
+	if !ok {
+		byAgent = &messageCounter{}
+		m.byAgent[agentID] = byAgent
+	}
+	byAgent.add(sec, bytes)
+}
+
+// rates averages the complete seconds in the window ending before now
+func (m *messageRates) rates(now time.Time, window time.Duration) Throughput {
+	n := int64(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	if n > rateWindowSeconds-1 {
+		n = rateWindowSeconds - 1
+	}
+	end := now.Unix()
+	start := end - n
+
+	rate := func(name string, c *messageCounter) MessageRate {
+		messages, bytes := c.sum(start, end)
+		return MessageRate{
+			Name:              name,
+			MessagesPerSecond: float64(messages) / float64(n),
+			BytesPerSecond:    float64(bytes) / float64(n),
+		}
+	}
+
+	t := Throughput{
+		Start:   time.Unix(start, 0).UTC(),
+		End:     time.Unix(end, 0).UTC(),
+		Total:   MessageRate{Name: "total"},
+		ByType:  []MessageRate{},
+		ByAgent: []MessageRate{},
+	}
+
+	m.mu.Lock()
+	for msgType, c := range m.byType {
+		r := rate(string(msgType), c)
+		t.ByType = append(t.ByType, r)
+		t.Total.MessagesPerSecond += r.MessagesPerSecond
+		t.Total.BytesPerSecond += r.BytesPerSecond
+	}
+	for agentID, c := range m.byAgent {
+		// Agents idle for the whole in-memory window are forgotten
+		if c.last <= end-rateWindowSeconds {
+			delete(m.byAgent, agentID)
+			continue
+		}
+		t.ByAgent = append(t.ByAgent, rate(agentID, c))
+	}
+	m.mu.Unlock()
+
+	for _, rates := range [][]MessageRate{t.ByType, t.ByAgent} {
+		sort.Slice(rates, func(i, j int) bool {
+			if rates[i].BytesPerSecond != rates[j].BytesPerSecond {
+				return rates[i].BytesPerSecond > rates[j].BytesPerSecond
+			}
+			return rates[i].Name < rates[j].Name
+		})
+	}
+	return t
+}
+
+// MessageThroughput returns agent message rates over the last window (up to
+// five minutes) by type and by agent
+func (h *Handler) MessageThroughput(window time.Duration) Throughput {
+	return h.messageRates.rates(h.clock.Now(), window)
+}
@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/config"
+)
+
+// testCert is a certificate with its key, signed by parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// files writes the certificate and key as PEM files, returning their paths
+func (c *testCert) files(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveOnce accepts one connection on l and returns what the server read
+// from it, or the error that stopped the read
+func serveOnce(l net.Listener) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			result <- err
+			return
+		}
+		if string(buf) != "hello" {
+			result <- io.ErrUnexpectedEOF
+			return
+		}
+		result <- nil
+	}()
+	return result
+}
+
+func TestListenPlain(t *testing.T) {
+	l, err := listen(context.Background(), &config.Config{AgentAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	served := serveOnce(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if err := <-served; err != nil {
+		t.Errorf("plain agent: %v", err)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	ca := newTestCert(t, "agents CA", nil, true)
+	server := newTestCert(t, "diagnostic server", ca, false)
+	certFile, keyFile := server.files(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	l, err := listen(context.Background(), &config.Config{AgentAddr: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	served := serveOnce(l)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("TLS agent: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	if err := <-served; err != nil {
+		t.Errorf("TLS agent: %v", err)
+	}
+	conn.Close()
+
+	// A plain agent never gets its data read
+	served = serveOnce(l)
+	plain, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write([]byte("hello"))
+	if err := <-served; err == nil {
+		t.Error("plain agent accepted on the TLS port")
+	}
+}
+
+func TestListenMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "agents CA", nil, true)
+	server := newTestCert(t, "diagnostic server", ca, false)
+	certFile, keyFile := server.files(t)
+	caFile, _ := ca.files(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	l, err := listen(context.Background(), &config.Config{AgentAddr: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	other := newTestCert(t, "other CA", nil, true)
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"signed certificate", []tls.Certificate{newTestCert(t, "agent", ca, false).tlsCertificate()}, true},
+		{"no certificate", nil, false},
+		{"certificate of another CA", []tls.Certificate{newTestCert(t, "agent", other, false).tlsCertificate()}, false},
+	}
+	for _, tt := range tests {
+		served := serveOnce(l)
+		// With TLS 1.3 the client finishes its handshake before the server
+		// checks its certificate, so the server side decides
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: tt.certs})
+		if err == nil {
+			conn.Write([]byte("hello"))
+		}
+		if err := <-served; (err == nil) != tt.ok {
+			t.Errorf("%s: served = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestAgentTLSConfigErrors(t *testing.T) {
+	ca := newTestCert(t, "agents CA", nil, true)
+	certFile, keyFile := newTestCert(t, "diagnostic server", ca, false).files(t)
+	_, otherKey := newTestCert(t, "other", nil, false).files(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsCfg, err := agentTLSConfig(&config.Config{}); tlsCfg != nil || err != nil {
+		t.Errorf("without TLS = %v, %v, want nil", tlsCfg, err)
+	}
+	for name, cfg := range map[string]*config.Config{
+		"missing certificate": {TLSCertFile: filepath.Join(t.TempDir(), "none.pem"), TLSKeyFile: keyFile},
+		"mismatched key":      {TLSCertFile: certFile, TLSKeyFile: otherKey},
+		"missing CA":          {TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: filepath.Join(t.TempDir(), "none.pem")},
+		"CA without PEM":      {TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: notPEM},
+	} {
+		if _, err := agentTLSConfig(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"diagnostic-client/pkg/models"
+)
+
+// maxReportedDiscrepancies caps each list of a FileCacheReport
+const maxReportedDiscrepancies = 1000
+
+// FileCacheReport lists where the file cache and the files table disagree
+type FileCacheReport struct {
+	CheckedAt   time.Time `json:"checked_at"`
+	DBFiles     int       `json:"db_files"`
+	CachedFiles int       `json:"cached_files"`
+	// Paths cached but not stored, and stored but not cached
+	OnlyInCache []string `json:"only_in_cache"`
+	OnlyInDB    []string `json:"only_in_db"`
+	// Paths in both whose metadata differs
+	Differing []FileDiscrepancy `json:"differing"`
+	// A list was cut at maxReportedDiscrepancies
+	Truncated bool `json:"truncated"`
+	// The cache was reloaded from the database after the check
+	Repaired bool `json:"repaired"`
+}
+
+// FileDiscrepancy is a file whose cached and stored states differ
+type FileDiscrepancy struct {
+	Path   string          `json:"path"`
+	Fields []string        `json:"fields"`
+	Cached models.FileNode `json:"cached"`
+	Stored models.FileNode `json:"stored"`
+}
+
+// Consistent reports whether no discrepancy was found
+func (r *FileCacheReport) Consistent() bool {
+	return len(r.OnlyInCache) == 0 && len(r.OnlyInDB) == 0 && len(r.Differing) == 0
+}
+
+// fileDifferences names the fields of the stored file that differ from the
+// cached one. Modification times are compared at storedPrecision, since the
+// cache keeps what agents sent; LastSeen is skipped as the cache sets it
+// before the row is written.
+func fileDifferences(cached, stored models.FileNode) []string {
+	var fields []string
+	if cached.ParentPath != stored.ParentPath {
+		fields = append(fields, "parent_path")
+	}
+	if cached.Name != stored.Name {
+		fields = append(fields, "name")
+	}
+	if cached.IsDirectory != stored.IsDirectory {
+		fields = append(fields, "is_directory")
+	}
+	if cached.Size != stored.Size {
+		fields = append(fields, "size")
+	}
+	if !cached.ModTime.Truncate(storedPrecision).Equal(stored.ModTime.Truncate(storedPrecision)) {
+		fields = append(fields, "mod_time")
+	}
+	if cached.IsGzipped != stored.IsGzipped {
+		fields = append(fields, "is_gzipped")
+	}
+	if cached.IsScraped != stored.IsScraped {
+		fields = append(fields, "is_scraped")
+	}
+	if cached.ScrapeState != stored.ScrapeState {
+		fields = append(fields, "scrape_state")
+	}
+	if cached.Generation != stored.Generation {
+		fields = append(fields, "generation")
+	}
+	return fields
+}
+
+// VerifyFileCache compares the file cache with a fresh read of the files
+// table and, with repair, reloads the cache from the table when they
+// disagree.
+//
+// File lists keep being applied during the check: the cache is scanned one
+// shard at a time, like detectFileChanges does. A list applied between the
+// database read and the scan would show up as a discrepancy, so candidates
+// are read again from both sides and only those that still disagree are
+// reported.
+func (h *Handler) VerifyFileCache(ctx context.Context, repair bool) (*FileCacheReport, error) {
+	stored, err := h.db.GetAllFiles(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read files: %w", err)
+	}
+
+	report := &FileCacheReport{
+		CheckedAt:   h.clock.Now().UTC(),
+		DBFiles:     len(stored),
+		OnlyInCache: []string{},
+		OnlyInDB:    []string{},
+		Differing:   []FileDiscrepancy{},
+	}
+
+	storedByPath := make(map[string]models.FileNode, len(stored))
+	for _, f := range stored {
+		storedByPath[f.Path] = f
+	}
+	var suspects []string
+	h.fileCache.each(func(cached models.FileNode) {
+		report.CachedFiles++
+		if s, ok := storedByPath[cached.Path]; !ok || len(fileDifferences(cached, s)) > 0 {
+			suspects = append(suspects, cached.Path)
+		}
+		delete(storedByPath, cached.Path)
+	})
+	for path := range storedByPath {
+		suspects = append(suspects, path)
+	}
+
+	if len(suspects) > 0 {
+		if err := h.recheckFiles(ctx, suspects, report); err != nil {
+			return nil, err
+		}
+	}
+
+	if !report.Consistent() {
+		log.Printf("[TUNNEL] File cache check: %d only cached, %d only stored, %d differing",
+			len(report.OnlyInCache), len(report.OnlyInDB), len(report.Differing))
+		if repair {
+			if err := h.ReloadFileCache(ctx); err != nil {
+				return nil, fmt.Errorf("reload file cache: %w", err)
+			}
+			report.Repaired = true
+		}
+	}
+	return report, nil
+}
+
+// recheckFiles reads the suspect paths again from the database and the cache
+// and records those that still disagree
+func (h *Handler) recheckFiles(ctx context.Context, suspects []string, report *FileCacheReport) error {
+	stored, err := h.db.GetFilesByPaths(ctx, suspects)
+	if err != nil {
+		return fmt.Errorf("recheck files: %w", err)
+	}
+	storedByPath := make(map[string]models.FileNode, len(stored))
+	for _, f := range stored {
+		storedByPath[f.Path] = f
+	}
+
+	for _, path := range suspects {
+		s, inDB := storedByPath[path]
+		c, inCache := h.fileCache.get(path)
+
+		switch {
+		case inCache && !inDB:
+			report.OnlyInCache, report.Truncated = appendCapped(report.OnlyInCache, path, report.Truncated)
+		case inDB && !inCache:
+			report.OnlyInDB, report.Truncated = appendCapped(report.OnlyInDB, path, report.Truncated)
+		case inDB && inCache:
+			if fields := fileDifferences(c, s); len(fields) > 0 {
+				report.Differing, report.Truncated = appendCapped(report.Differing,
+					FileDiscrepancy{Path: path, Fields: fields, Cached: c, Stored: s}, report.Truncated)
+			}
+		}
+	}
+	return nil
+}
+
+func appendCapped[T any](list []T, v T, truncated bool) ([]T, bool) {
+	if len(list) >= maxReportedDiscrepancies {
+		return list, true
+	}
+	return append(list, v), truncated
+}
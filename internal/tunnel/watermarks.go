@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+// watermarkPersistInterval is how often advanced watermarks are saved. Lines
+// stored in the unsaved window may be stored again after a crash, but a
+// watermark is only advanced past stored lines, so none are skipped.
+const watermarkPersistInterval = 5 * time.Second
+
+// ingestWatermarks tracks the highest line number stored per file, so lines
+// agents send again after a restart or re-scrape are counted and dropped
+// instead of stored twice. Lines without a line number are always stored.
+type ingestWatermarks struct {
+	mu    sync.Mutex
+	marks map[string]db.IngestWatermark
+	dirty map[string]bool
+}
+
+func newIngestWatermarks() *ingestWatermarks {
+	return &ingestWatermarks{
+		marks: make(map[string]db.IngestWatermark),
+		dirty: make(map[string]bool),
+	}
+}
+
+func (w *ingestWatermarks) get(path string) (db.IngestWatermark, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, ok := w.marks[path]
+	return m, ok
+}
+
+// stored reports whether entry is at or below its file's watermark. A newer
+// generation than the watermark's means the file was truncated and starts
+// over, so its lines are new.
+func (w *ingestWatermarks) stored(entry models.LogEntry) bool {
+	if entry.LineNum <= 0 {
+		return false
+	}
+	m, ok := w.marks[entry.Filename]
+	return ok && entry.Generation == m.Generation && entry.LineNum <= m.Line
+}
+
+// skip removes lines that are already stored, returning how many
+func (w *ingestWatermarks) skip(logs []models.LogEntry) ([]models.LogEntry, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kept := logs[:0]
+	for _, entry := range logs {
+		if !w.stored(entry) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, len(logs) - len(kept)
+}
+
+// advance raises watermarks past lines that were stored
+func (w *ingestWatermarks) advance(logs []models.LogEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, entry := range logs {
+		if entry.LineNum <= 0 {
+			continue
+		}
+		m, ok := w.marks[entry.Filename]
+		if ok && (entry.Generation < m.Generation ||
+			entry.Generation == m.Generation && entry.LineNum <= m.Line) {
+			continue
+		}
+		w.marks[entry.Filename] = db.IngestWatermark{Generation: entry.Generation, Line: entry.LineNum}
+		w.dirty[entry.Filename] = true
+	}
+}
+
+func (w *ingestWatermarks) forget(paths []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, path := range paths {
+		delete(w.marks, path)
+		delete(w.dirty, path)
+	}
+}
+
+func (w *ingestWatermarks) restore(marks map[string]db.IngestWatermark) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.marks = marks
+	w.dirty = make(map[string]bool)
+}
+
+// takeDirty returns the watermarks changed since the last call
+func (w *ingestWatermarks) takeDirty() map[string]db.IngestWatermark {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := make(map[string]db.IngestWatermark, len(w.dirty))
+	for path := range w.dirty {
+		changed[path] = w.marks[path]
+	}
+	w.dirty = make(map[string]bool)
+	return changed
+}
+
+func (w *ingestWatermarks) markDirty(paths map[string]db.IngestWatermark) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path := range paths {
+		if _, ok := w.marks[path]; ok {
+			w.dirty[path] = true
+		}
+	}
+}
+
+// IngestWatermark returns the highest line number stored for a file and its
+// generation; false when none is known
+func (h *Handler) IngestWatermark(path string) (db.IngestWatermark, bool) {
+	return h.watermarks.get(path)
+}
+
+// saveWatermarks stores the watermarks advanced since the last save
+func (h *Handler) saveWatermarks(ctx context.Context) error {
+	changed := h.watermarks.takeDirty()
+	if err := h.db.SaveIngestWatermarks(ctx, changed); err != nil {
+		h.watermarks.markDirty(changed)
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) periodicWatermarkSave() {
+	ticker := h.clock.NewTicker(watermarkPersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.shutdownCh:
+			return
+		case <-ticker.C():
+			if err := h.saveWatermarks(h.ctx); err != nil {
+				log.Printf("[TUNNEL] Error saving ingest watermarks: %v", err)
+			}
+		}
+	}
+}
+
+// IngestedLine returns the highest line number stored for the given
+// generation of a file, or 0 if none is, so a scrape can resume after it
+func (h *Handler) IngestedLine(path string, generation int) int {
+	m, ok := h.watermarks.get(path)
+	if !ok || m.Generation != generation {
+		return 0
+	}
+	return m.Line
+}
@@ -0,0 +1,155 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+)
+
+func TestIngestWatermarksSkipStoredLines(t *testing.T) {
+	w := newIngestWatermarks()
+	line := func(n, generation int) models.LogEntry {
+		return models.LogEntry{Filename: "/a.log", LineNum: n, Generation: generation}
+	}
+
+	w.advance([]models.LogEntry{line(1, 0), line(3, 0), line(2, 0)})
+	if m, _ := w.get("/a.log"); m != (db.IngestWatermark{Line: 3}) {
+		t.Fatalf("watermark = %+v, want line 3", m)
+	}
+
+	kept, skipped := w.skip([]models.LogEntry{line(2, 0), line(3, 0), line(4, 0), line(0, 0), line(1, 1)})
+	if skipped != 2 {
+		t.Errorf("skipped %d lines, want 2", skipped)
+	}
+	var got []string
+	for _, e := range kept {
+		got = append(got, fmt.Sprintf("%d/%d", e.Generation, e.LineNum))
+	}
+	// Lines without a number are always kept, as are a newer generation's
+	if want := "[0/4 0/0 1/1]"; fmt.Sprint(got) != want {
+		t.Errorf("kept %v, want %s", got, want)
+	}
+
+	// An older generation's lines don't move the watermark back
+	w.advance([]models.LogEntry{line(1, 1)})
+	w.advance([]models.LogEntry{line(50, 0)})
+	if m, _ := w.get("/a.log"); m != (db.IngestWatermark{Generation: 1, Line: 1}) {
+		t.Errorf("watermark = %+v, want generation 1 line 1", m)
+	}
+}
+
+func TestIngestWatermarksDirtyTracking(t *testing.T) {
+	w := newIngestWatermarks()
+	w.advance([]models.LogEntry{{Filename: "/a.log", LineNum: 5}, {Filename: "/b.log", LineNum: 7}})
+
+	changed := w.takeDirty()
+	if len(changed) != 2 {
+		t.Fatalf("%d dirty watermarks, want 2", len(changed))
+	}
+	if again := w.takeDirty(); len(again) != 0 {
+		t.Errorf("%d dirty after taking them, want 0", len(again))
+	}
+
+	// A failed save marks them again, except for files deleted meanwhile
+	w.forget([]string{"/b.log"})
+	w.markDirty(changed)
+	if again := w.takeDirty(); len(again) != 1 || again["/a.log"].Line != 5 {
+		t.Errorf("dirty after a failed save = %v, want /a.log at 5", again)
+	}
+}
+
+func TestIngestedLine(t *testing.T) {
+	h := &Handler{watermarks: newIngestWatermarks()}
+	h.watermarks.restore(map[string]db.IngestWatermark{"/a.log": {Generation: 2, Line: 40}})
+
+	if got := h.IngestedLine("/a.log", 2); got != 40 {
+		t.Errorf("current generation resumes after line %d, want 40", got)
+	}
+	if got := h.IngestedLine("/a.log", 3); got != 0 {
+		t.Errorf("a newer generation resumes after line %d, want 0", got)
+	}
+	if got := h.IngestedLine("/b.log", 0); got != 0 {
+		t.Errorf("an unknown file resumes after line %d, want 0", got)
+	}
+}
+
+// TestRestartMidFileResumes stores the first half of a file, restarts the
+// handler on the same database, and has the agent send the whole file
+// again, as after a deploy. Every line must be stored exactly once.
+func TestRestartMidFileResumes(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	before := newTestHandler(t, now, nil, "files", "logs")
+	ctx := context.Background()
+	const path = "/var/log/resume.log"
+	file := models.FileNode{Path: path, ParentPath: "/var/log", Name: "resume.log", Size: 5000, ModTime: now.Add(-time.Minute)}
+
+	agentSends := func(h *Handler, messages ...Message) {
+		t.Helper()
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		go io.Copy(io.Discard, client)
+		agent := newAgentConn(server, now)
+		for _, msg := range messages {
+			if err := h.processMessage(ctx, agent, msg); err != nil {
+				t.Fatalf("%s: %v", msg.Type, err)
+			}
+		}
+	}
+	lines := func(from, to int) Message {
+		var logs []models.LogEntry
+		for i := from; i <= to; i++ {
+			logs = append(logs, models.LogEntry{Filename: path, Line: fmt.Sprintf("line %d", i), LineNum: i, Timestamp: now.Add(time.Duration(i-200) * time.Second)})
+		}
+		data, err := json.Marshal(logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Message{Type: TypeLogData, Payload: data}
+	}
+	fileList := Message{Type: TypeLogList, Payload: mustMarshal(t, []models.FileNode{file})}
+
+	agentSends(before, fileList, lines(1, 50))
+	// Close saves the watermarks, as a deploy's graceful stop does
+	before.Close()
+
+	after := NewHandler(before.cfg, before.db, clock.NewFake(now))
+	t.Cleanup(after.Close)
+	if err := after.ReloadFileCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.IngestedLine(path, 0); got != 50 {
+		t.Fatalf("scrape after the restart resumes after line %d, want 50", got)
+	}
+
+	// The agent doesn't know how far the server got and starts over
+	agentSends(after, fileList, lines(1, 100))
+
+	if got := after.ingest.linesAlreadyStored.Load(); got != 50 {
+		t.Errorf("%d lines counted as already stored, want 50", got)
+	}
+	page, err := after.db.GetLogs(ctx, path, "", 1000, db.AllGenerations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]int)
+	for _, e := range page.Entries {
+		seen[e.LineNum]++
+	}
+	for i := 1; i <= 100; i++ {
+		if seen[i] != 1 {
+			t.Errorf("line %d stored %d times, want once", i, seen[i])
+		}
+	}
+	if len(page.Entries) != 100 {
+		t.Errorf("stored %d lines, want 100", len(page.Entries))
+	}
+}
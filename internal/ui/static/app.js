@@ -0,0 +1,184 @@
+// Minimal dashboard over the public REST and WebSocket APIs. Kept dependency
+// and build free on purpose; see README "Web UI".
+(function () {
+  'use strict';
+
+  const $ = (id) => document.getElementById(id);
+  const maxLines = 1000;
+  const samples = [];
+  let annotations = [];
+  let currentFile = null;
+  let ws = null;
+  let apiKey = localStorage.getItem('apiKey') || '';
+
+  // Asks for an API key once the server rejects the stored one
+  async function getJSON(url) {
+    let res = await fetch(url, { headers: authHeaders() });
+    if (res.status === 401) {
+      apiKey = window.prompt('API key') || '';
+      localStorage.setItem('apiKey', apiKey);
+      res = await fetch(url, { headers: authHeaders() });
+    }
+    if (!res.ok) throw new Error(res.status + ' ' + (await res.text()));
+    return res.json();
+  }
+
+  async function openDir(path) {
+    $('tree-path').textContent = path;
+    const files = await getJSON('/api/files?depth=1&path=' + encodeURIComponent(path));
+    const list = $('files');
+    list.replaceChildren();
+    if (path !== '/') {
+      const parent = path.slice(0, path.lastIndexOf('/')) || '/';
+      list.append(item('..', 'dir', () => openDir(parent)));
+    }
+    files
+      .filter((f) => f.path !== path)
+      .sort((a, b) => (b.is_directory - a.is_directory) || a.name.localeCompare(b.name))
+      .forEach((f) => list.append(item(f.name, f.is_directory ? 'dir' : 'file',
+        () => (f.is_directory ? openDir(f.path) : openFile(f.path)))));
+  }
+
+  function item(label, cls, onClick) {
+    const li = document.createElement('li');
+    li.textContent = label;
+    li.className = cls;
+    li.onclick = () => onClick().catch(showError);
+    return li;
+  }
+
+  async function openFile(path) {
+    currentFile = path;
+    $('log-file').textContent = path;
+    $('log').replaceChildren();
+    const page = await getJSON('/api/logs?limit=200&file=' + encodeURIComponent(path));
+    page.entries.reverse().forEach(appendLog);
+    send('view_file', path);
+  }
+
+  function appendLog(entry) {
+    const pre = $('log');
+    const line = document.createElement('div');
+    line.className = entry.level || '';
+    line.textContent = entry.line_num + '  ' + entry.line;
+    pre.append(line);
+    while (pre.childElementCount > maxLines) pre.firstChild.remove();
+    if ($('follow').checked) pre.lastChild.scrollIntoView({ block: 'end' });
+  }
+
+  function authHeaders() {
+    return apiKey ? { Authorization: 'Bearer ' + apiKey } : {};
+  }
+
+  function send(type, payload) {
+    if (ws && ws.readyState === WebSocket.OPEN) ws.send(JSON.stringify({ type, payload }));
+  }
+
+  function connect() {
+    const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const query = apiKey ? '?api_key=' + encodeURIComponent(apiKey) : '';
+    ws = new WebSocket(proto + '//' + location.host + '/ws' + query);
+    ws.onopen = () => {
+      $('status').textContent = 'live';
+      if (currentFile) send('view_file', currentFile);
+    };
+    ws.onclose = () => {
+      $('status').textContent = 'disconnected, retrying…';
+      setTimeout(connect, 2000);
+    };
+    ws.onmessage = (ev) => {
+      const msg = JSON.parse(ev.data);
+      if (msg.type === 'log' && msg.payload.filename === currentFile) {
+        appendLog(msg.payload);
+      } else if (msg.type === 'network_summary') {
+        samples.push({ t: Date.now(), v: msg.payload.packet_count });
+        if (samples.length > 120) samples.shift();
+        drawChart();
+      }
+    };
+  }
+
+  function drawChart() {
+    const canvas = $('chart');
+    const ctx = canvas.getContext('2d');
+    const max = Math.max(1, ...samples.map((s) => s.v));
+    const step = canvas.width / 120;
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+    drawAnnotations(ctx, canvas, step);
+    ctx.strokeStyle = '#0366d6';
+    ctx.beginPath();
+    samples.forEach((s, i) => {
+      const y = canvas.height - (s.v / max) * (canvas.height - 10);
+      i ? ctx.lineTo(i * step, y) : ctx.moveTo(0, y);
+    });
+    ctx.stroke();
+    ctx.fillStyle = '#666';
+    ctx.fillText(max + ' pkt/s', 4, 12);
+  }
+
+  // Marks annotations falling within the sampled period as dashed lines
+  function drawAnnotations(ctx, canvas, step) {
+    if (samples.length < 2) return;
+    const first = samples[0].t;
+    const span = samples[samples.length - 1].t - first;
+    ctx.save();
+    ctx.strokeStyle = '#a60';
+    ctx.fillStyle = '#a60';
+    ctx.setLineDash([4, 3]);
+    annotations.forEach((a) => {
+      const t = Date.parse(a.timestamp);
+      if (t < first || t > first + span) return;
+      const x = ((t - first) / span) * (samples.length - 1) * step;
+      ctx.beginPath();
+      ctx.moveTo(x, 0);
+      ctx.lineTo(x, canvas.height);
+      ctx.stroke();
+      ctx.fillText(a.text, x + 3, canvas.height - 4);
+    });
+    ctx.restore();
+  }
+
+  async function pollAnnotations() {
+    try {
+      const start = new Date(Date.now() - 3600 * 1000).toISOString();
+      annotations = await getJSON('/api/annotations?start=' + encodeURIComponent(start));
+      drawChart();
+    } catch (err) {
+      annotations = [];
+    }
+  }
+
+  async function pollRate() {
+    try {
+      const rate = await getJSON('/api/network/pps');
+      $('rate').textContent = Math.round(rate.packets_per_second) + ' pkt/s, ' +
+        Math.round(rate.bytes_per_second / 1024) + ' KiB/s';
+    } catch (err) {
+      $('rate').textContent = '';
+    }
+  }
+
+  async function pollAgents() {
+    try {
+      const since = new Date(Date.now() - 24 * 3600 * 1000).toISOString();
+      const agents = await getJSON('/api/agents/summary?since=' + encodeURIComponent(since));
+      $('agents').textContent = agents.connected + ' agents connected, ' +
+        agents.reported + ' reported in 24h';
+    } catch (err) {
+      $('agents').textContent = '';
+    }
+  }
+
+  function showError(err) {
+    $('status').textContent = String(err);
+  }
+
+  openDir('/').catch(showError);
+  connect();
+  pollRate();
+  setInterval(pollRate, 5000);
+  pollAgents();
+  setInterval(pollAgents, 60000);
+  pollAnnotations();
+  setInterval(pollAnnotations, 60000);
+})();
@@ -0,0 +1,83 @@
+// Package ui serves the small dashboard embedded in the binary. It only
+// uses the public REST and WebSocket APIs, so it needs no server state.
+package ui
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var static embed.FS
+
+// asset is an embedded file with a content hash for conditional requests
+type asset struct {
+	name string
+	data []byte
+	etag string
+}
+
+// Handler serves the embedded UI. Unknown paths fall back to index.html so
+// client-side routes survive a reload, except under /api/ and /ws, which get
+// a plain 404 instead of being shadowed by the page.
+func Handler() http.Handler {
+	assets := make(map[string]asset)
+	err := fs.WalkDir(static, "static", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := static.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		urlPath := strings.TrimPrefix(name, "static")
+		assets[urlPath] = asset{
+			name: path.Base(name),
+			data: data,
+			etag: `"` + hex.EncodeToString(sum[:8]) + `"`,
+		}
+		return nil
+	})
+	if err != nil {
+		// The files are compiled in, so this only fails on a broken build
+		panic("ui: reading embedded assets: " + err.Error())
+	}
+	index := assets["/index.html"]
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIPath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		a, ok := assets[r.URL.Path]
+		if !ok || a.name == "index.html" {
+			// The page is revalidated on every load so a new binary's
+			// assets are picked up immediately
+			a = index
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+		w.Header().Set("ETag", a.etag)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.data))
+	})
+}
+
+func isAPIPath(p string) bool {
+	return p == "/api" || strings.HasPrefix(p, "/api/") || p == "/ws" || strings.HasPrefix(p, "/ws/")
+}
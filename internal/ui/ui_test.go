@@ -0,0 +1,109 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(h http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestServesIndexAndAssets(t *testing.T) {
+	h := Handler()
+
+	for _, tc := range []struct {
+		target, contentType, cacheControl, body string
+	}{
+		{"/", "text/html", "no-cache", "<title>Diagnostic Client</title>"},
+		{"/index.html", "text/html", "no-cache", "<title>Diagnostic Client</title>"},
+		{"/app.js", "javascript", "public, max-age=3600", ""},
+		{"/app.css", "text/css", "public, max-age=3600", ""},
+	} {
+		w := serve(h, http.MethodGet, tc.target, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", tc.target, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, tc.contentType) {
+			t.Errorf("%s: content type %q, want %s", tc.target, ct, tc.contentType)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != tc.cacheControl {
+			t.Errorf("%s: cache control %q, want %q", tc.target, cc, tc.cacheControl)
+		}
+		if w.Header().Get("ETag") == "" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: headers %v, want an ETag and nosniff", tc.target, w.Header())
+		}
+		if !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("%s: body lacks %q", tc.target, tc.body)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	h := Handler()
+
+	for _, target := range []string{"/", "/app.js"} {
+		etag := serve(h, http.MethodGet, target, nil).Header().Get("ETag")
+		w := serve(h, http.MethodGet, target, http.Header{"If-None-Match": {etag}})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: revalidation status %d with %d bytes, want 304 and no body", target, w.Code, w.Body.Len())
+		}
+		w = serve(h, http.MethodGet, target, http.Header{"If-None-Match": {`"stale"`}})
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: stale revalidation status %d, want 200", target, w.Code)
+		}
+	}
+	if serve(h, http.MethodGet, "/", nil).Header().Get("ETag") == serve(h, http.MethodGet, "/app.js", nil).Header().Get("ETag") {
+		t.Error("index and script share an ETag")
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	h := Handler()
+	index := serve(h, http.MethodGet, "/", nil).Body.String()
+
+	// Client-side routes get the page, revalidated like the index
+	for _, target := range []string{"/files/var/log/syslog", "/agents", "/logs?file=/var/log/app.log", "/apiary"} {
+		w := serve(h, http.MethodGet, target, nil)
+		if w.Code != http.StatusOK || w.Body.String() != index {
+			t.Errorf("%s: status %d, want the index page", target, w.Code)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+			t.Errorf("%s: cache control %q, want no-cache", target, cc)
+		}
+	}
+
+	// Unknown API paths are not shadowed by the page
+	for _, target := range []string{"/api", "/api/", "/api/unknown", "/api/files/missing", "/ws", "/ws/extra"} {
+		w := serve(h, http.MethodGet, target, nil)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "<html") {
+			t.Errorf("%s: status %d %q, want a plain 404", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	h := Handler()
+
+	if w := serve(h, http.MethodHead, "/app.js", nil); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d with %d bytes, want 200 and no body", w.Code, w.Body.Len())
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		if w := serve(h, method, "/", nil); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status %d, want 405", method, w.Code)
+		}
+	}
+	// API paths are answered before the method check
+	if w := serve(h, http.MethodPost, "/api/unknown", nil); w.Code != http.StatusNotFound {
+		t.Errorf("POST to an unknown API path: status %d, want 404", w.Code)
+	}
+}
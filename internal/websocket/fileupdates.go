@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/pkg/models"
+)
+
+// Isolated file updates are sent right away while the token bucket has
+// tokens; beyond that they are batched
+const (
+	fileUpdateBurst = 20
+	fileUpdateRate  = 10 // Tokens per second
+)
+
+// fileUpdateCoalescer smooths one client's file_update messages. Updates
+// within budget go out as they arrive. Past it, updates are collected for a
+// window, the latest per path winning, and sent as one file_updates batch,
+// or as a tree_invalidate hint when so many changed that refetching the
+// tree is cheaper, such as during an agent's first scan.
+type fileUpdateCoalescer struct {
+	window     time.Duration // 0 sends every update on its own; follows the stream policy
+	invalidate int           // Batches of at least this many files become tree_invalidate; 0 never
+
+	tokens  float64
+	refill  time.Time
+	pending map[string]models.FileNode
+	order   []string // Paths of pending in arrival order
+	timer   clock.Timer
+	clock   clock.Clock
+}
+
+func newFileUpdateCoalescer(window time.Duration, invalidate int, clk clock.Clock) *fileUpdateCoalescer {
+	return &fileUpdateCoalescer{
+		window:     window,
+		invalidate: invalidate,
+		tokens:     fileUpdateBurst,
+		refill:     clk.Now(),
+		pending:    make(map[string]models.FileNode),
+		clock:      clk,
+	}
+}
+
+// add takes an update and returns a message to send now, if any
+func (c *fileUpdateCoalescer) add(file models.FileNode, now time.Time) (wsMessage, bool) {
+	if c.window <= 0 {
+		if len(c.pending) == 0 {
+			return fileUpdateMessage(file), true
+		}
+		// Batching was just turned off; send what was collected with it,
+		// so the update doesn't overtake an older one for the same path
+		c.collect(file)
+		return c.flush(), true
+	}
+
+	c.tokens = min(fileUpdateBurst, c.tokens+now.Sub(c.refill).Seconds()*fileUpdateRate)
+	c.refill = now
+	if len(c.pending) == 0 && c.tokens >= 1 {
+		c.tokens--
+		return fileUpdateMessage(file), true
+	}
+
+	c.collect(file)
+	if c.timer == nil {
+		c.timer = c.clock.NewTimer(c.window)
+	}
+	return wsMessage{}, false
+}
+
+func (c *fileUpdateCoalescer) collect(file models.FileNode) {
+	if _, ok := c.pending[file.Path]; !ok {
+		c.order = append(c.order, file.Path)
+	}
+	c.pending[file.Path] = file
+}
+
+// due fires when the pending updates should be flushed; nil when none are
+func (c *fileUpdateCoalescer) due() <-chan time.Time {
+	if c.timer == nil {
+		return nil
+	}
+	return c.timer.C()
+}
+
+// flush returns the message for the pending updates and clears them
+func (c *fileUpdateCoalescer) flush() wsMessage {
+	c.stop()
+	c.timer = nil
+	files := make([]models.FileNode, 0, len(c.order))
+	for _, path := range c.order {
+		files = append(files, c.pending[path])
+	}
+	c.pending = make(map[string]models.FileNode)
+	c.order = nil
+
+	if c.invalidate > 0 && len(files) >= c.invalidate {
+		return wsMessage{
+			Type: "tree_invalidate",
+			Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+				"prefix": commonDir(files),
+				"count":  len(files),
+			})),
+		}
+	}
+	if len(files) == 1 {
+		return fileUpdateMessage(files[0])
+	}
+	return wsMessage{
+		Type:    "file_updates",
+		Payload: json.RawMessage(mustMarshal(files)),
+	}
+}
+
+func (c *fileUpdateCoalescer) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+func fileUpdateMessage(file models.FileNode) wsMessage {
+	return wsMessage{
+		Type:    "file_update",
+		Payload: json.RawMessage(mustMarshal(file)),
+	}
+}
+
+// commonDir returns the deepest directory holding every file
+func commonDir(files []models.FileNode) string {
+	dir := paths.Parent(files[0].Path)
+	for _, file := range files {
+		for dir != "/" && file.Path != dir && !strings.HasPrefix(file.Path, dir+"/") {
+			dir = paths.Parent(dir)
+		}
+	}
+	return dir
+}
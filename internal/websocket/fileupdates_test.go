@@ -0,0 +1,206 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/pkg/models"
+)
+
+func updatedFile(path string, size int64) models.FileNode {
+	return models.FileNode{Path: path, Size: size}
+}
+
+// sendBurst spends the coalescer's whole token budget on distinct files
+func sendBurst(t *testing.T, c *fileUpdateCoalescer, now time.Time) {
+	t.Helper()
+	for i := 0; i < fileUpdateBurst; i++ {
+		if _, ok := c.add(updatedFile(fmt.Sprintf("/burst/%d.log", i), 1), now); !ok {
+			t.Fatalf("update %d within the burst was held back", i)
+		}
+	}
+}
+
+func TestFileUpdatesWithinBudgetGoOutAtOnce(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 0, clk)
+
+	msg, ok := c.add(updatedFile("/var/log/a.log", 1), clk.Now())
+	if !ok || msg.Type != "file_update" {
+		t.Fatalf("isolated update = %v %s, want a file_update now", ok, msg.Type)
+	}
+	if c.due() != nil {
+		t.Error("a timer runs with nothing pending")
+	}
+}
+
+func TestFileUpdatesPastBudgetAreCoalesced(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 0, clk)
+	now := clk.Now()
+	sendBurst(t, c, now)
+
+	for _, file := range []models.FileNode{
+		updatedFile("/var/log/b.log", 1),
+		updatedFile("/var/log/a.log", 1),
+		updatedFile("/var/log/b.log", 2),
+		updatedFile("/var/log/b.log", 3),
+	} {
+		if _, ok := c.add(file, now); ok {
+			t.Fatalf("update of %s past the budget went out at once", file.Path)
+		}
+	}
+
+	due := c.due()
+	if due == nil {
+		t.Fatal("no flush scheduled for pending updates")
+	}
+	clk.Advance(499 * time.Millisecond)
+	select {
+	case <-due:
+		t.Fatal("flushed before the window ended")
+	default:
+	}
+	clk.Advance(time.Millisecond)
+	select {
+	case <-due:
+	case <-time.After(time.Second):
+		t.Fatal("not flushed when the window ended")
+	}
+
+	msg := c.flush()
+	if msg.Type != "file_updates" {
+		t.Fatalf("flushed %s, want file_updates", msg.Type)
+	}
+	var files []models.FileNode
+	if err := json.Unmarshal(msg.Payload, &files); err != nil {
+		t.Fatal(err)
+	}
+	// One entry per path in order of first arrival, with the latest state
+	got := fmt.Sprint(files[0].Path, files[0].Size, files[1].Path, files[1].Size)
+	if len(files) != 2 || got != fmt.Sprint("/var/log/b.log", 3, "/var/log/a.log", 1) {
+		t.Errorf("batch = %+v, want b.log at 3 then a.log at 1", files)
+	}
+	if c.due() != nil {
+		t.Error("timer left after the flush")
+	}
+}
+
+func TestFileUpdatesRefillWithTime(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 0, clk)
+	now := clk.Now()
+	sendBurst(t, c, now)
+
+	if _, ok := c.add(updatedFile("/var/log/a.log", 1), now); ok {
+		t.Fatal("update past the budget went out at once")
+	}
+	c.flush()
+
+	// A tenth of a second later one token has come back
+	if _, ok := c.add(updatedFile("/var/log/a.log", 2), now.Add(time.Second/fileUpdateRate)); !ok {
+		t.Error("isolated update after the refill was held back")
+	}
+}
+
+func TestFileUpdatesSingleCollectedUpdate(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 0, clk)
+	sendBurst(t, c, clk.Now())
+	c.add(updatedFile("/var/log/a.log", 1), clk.Now())
+
+	if msg := c.flush(); msg.Type != "file_update" {
+		t.Errorf("one collected update flushed as %s, want file_update", msg.Type)
+	}
+}
+
+func TestFileUpdatesBurstBecomesTreeInvalidate(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 100, clk)
+	now := clk.Now()
+	sendBurst(t, c, now)
+
+	// An agent's first scan of a big tree
+	for i := 0; i < 150; i++ {
+		c.add(updatedFile(fmt.Sprintf("/srv/app/logs/%d/app.log", i%30), int64(i)), now)
+		c.add(updatedFile(fmt.Sprintf("/srv/app/data/%d.log", i), 1), now)
+	}
+
+	msg := c.flush()
+	if msg.Type != "tree_invalidate" {
+		t.Fatalf("flushed %s, want tree_invalidate", msg.Type)
+	}
+	var hint struct {
+		Prefix string `json:"prefix"`
+		Count  int    `json:"count"`
+	}
+	if err := json.Unmarshal(msg.Payload, &hint); err != nil {
+		t.Fatal(err)
+	}
+	if hint.Prefix != "/srv/app" || hint.Count != 180 {
+		t.Errorf("hint = %+v, want /srv/app with 180 files", hint)
+	}
+
+	// Below the threshold a batch is sent as such
+	sendBurst(t, c, now.Add(time.Hour))
+	for i := 0; i < 99; i++ {
+		c.add(updatedFile(fmt.Sprintf("/srv/app/data/%d.log", i), 2), now.Add(time.Hour))
+	}
+	if msg := c.flush(); msg.Type != "file_updates" {
+		t.Errorf("99 updates flushed as %s, want file_updates", msg.Type)
+	}
+}
+
+func TestFileUpdatesWithoutWindow(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c := newFileUpdateCoalescer(500*time.Millisecond, 0, clk)
+	now := clk.Now()
+	sendBurst(t, c, now)
+	c.add(updatedFile("/var/log/a.log", 1), now)
+	c.add(updatedFile("/var/log/b.log", 1), now)
+
+	// The stream policy turns batching off while updates are pending
+	c.window = 0
+	msg, ok := c.add(updatedFile("/var/log/a.log", 2), now)
+	if !ok || msg.Type != "file_updates" {
+		t.Fatalf("first update without a window = %v %s, want the pending batch", ok, msg.Type)
+	}
+	var files []models.FileNode
+	if err := json.Unmarshal(msg.Payload, &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Path != "/var/log/a.log" || files[0].Size != 2 {
+		t.Errorf("batch = %+v, want a.log at its latest size and b.log", files)
+	}
+
+	for i := 0; i < 3*fileUpdateBurst; i++ {
+		if msg, ok := c.add(updatedFile("/var/log/a.log", int64(i)), now); !ok || msg.Type != "file_update" {
+			t.Fatalf("update %d without a window = %v %s, want a file_update now", i, ok, msg.Type)
+		}
+	}
+}
+
+func TestCommonDir(t *testing.T) {
+	for _, tc := range []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"/var/log/a.log"}, "/var/log"},
+		{[]string{"/var/log/a.log", "/var/log/b.log"}, "/var/log"},
+		{[]string{"/var/log/app/a.log", "/var/log/b.log"}, "/var/log"},
+		{[]string{"/var/log/a.log", "/var/logs/b.log"}, "/var"},
+		{[]string{"/var/log/a.log", "/srv/b.log"}, "/"},
+		{[]string{"/var/log", "/var/log/a.log"}, "/var"},
+	} {
+		var files []models.FileNode
+		for _, p := range tc.paths {
+			files = append(files, models.FileNode{Path: p})
+		}
+		if got := commonDir(files); got != tc.want {
+			t.Errorf("commonDir(%v) = %q, want %q", tc.paths, got, tc.want)
+		}
+	}
+}
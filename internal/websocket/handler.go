@@ -3,71 +3,132 @@ package websocket
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"diagnostic-client/internal/clock"
 	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/paths"
+	"diagnostic-client/internal/realip"
 	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // In production, configure this properly
-	},
-}
-
 type Handler struct {
-	cfg    *config.Config
-	tunnel *tunnel.Handler
-	// Map to track which file each client is viewing
-	viewers map[*websocket.Conn]string
-	mu      sync.RWMutex
+	cfg      *config.Config
+	tunnel   *tunnel.Handler
+	db       *db.DB
+	proxies  *realip.Resolver
+	clock    clock.Clock
+	upgrader websocket.Upgrader
+	// Files whose log lines each client receives
+	viewers map[*websocket.Conn]map[string]struct{}
+	// Running log replay of each client, if any
+	replays map[*websocket.Conn]*replay
+	// Live speed of clients that changed it, see speed.go
+	speeds map[*websocket.Conn]float64
+	mu     sync.RWMutex
 }
 
-func NewHandler(cfg *config.Config, tunnel *tunnel.Handler) *Handler {
-	return &Handler{
+func NewHandler(cfg *config.Config, tunnel *tunnel.Handler, db *db.DB, proxies *realip.Resolver, clk clock.Clock) *Handler {
+	h := &Handler{
 		cfg:     cfg,
 		tunnel:  tunnel,
-		viewers: make(map[*websocket.Conn]string),
+		db:      db,
+		proxies: proxies,
+		clock:   clk,
+		viewers: make(map[*websocket.Conn]map[string]struct{}),
+		replays: make(map[*websocket.Conn]*replay),
+		speeds:  make(map[*websocket.Conn]float64),
+	}
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     h.checkOrigin,
+	}
+	return h
+}
+
+// checkOrigin accepts any origin unless ALLOWED_ORIGINS is set, in which case
+// only those origins and the server's own are accepted. The server's origin
+// is taken from trusted proxy headers so it matches what browsers see behind
+// a TLS-terminating ingress.
+func (h *Handler) checkOrigin(r *http.Request) bool {
+	if len(h.cfg.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || strings.EqualFold(origin, h.proxies.Origin(r)) {
+		return true
+	}
+	for _, allowed := range h.cfg.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
 	}
+
+	log.Printf("WebSocket origin %s rejected for %s", origin, h.proxies.ClientIP(r))
+	return false
 }
 
+// maxViewedFiles caps a connection's subscription set; a read-only server
+// polls the database for each file
+const maxViewedFiles = 20
+
 type wsMessage struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
 
 func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade failed: %v", err)
 		return
 	}
 
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+
 	// Start handler goroutines
 	ctx, cancel := context.WithCancel(r.Context())
 	defer func() {
 		cancel()
+		h.stopReplay(conn)
 		h.mu.Lock()
 		delete(h.viewers, conn)
+		delete(h.speeds, conn)
 		h.mu.Unlock()
 		conn.Close()
 	}()
 
+	if err := h.sendSnapshot(ctx, conn); err != nil {
+		log.Printf("WebSocket snapshot failed: %v", err)
+		return
+	}
+
+	// Replies to client requests are written by writePump, since the
+	// connection supports only one concurrent writer
+	replies := make(chan wsMessage, 16)
+
 	// Handle client messages
-	go h.readPump(ctx, conn)
+	go h.readPump(ctx, conn, replies)
 
 	// Handle data streams
-	h.writePump(ctx, conn)
+	h.writePump(ctx, conn, replies)
 }
 
-func (h *Handler) readPump(ctx context.Context, conn *websocket.Conn) {
+func (h *Handler) readPump(ctx context.Context, conn *websocket.Conn, replies chan<- wsMessage) {
 	for {
 		var msg wsMessage
 		err := conn.ReadJSON(&msg)
@@ -82,68 +143,402 @@ func (h *Handler) readPump(ctx context.Context, conn *websocket.Conn) {
 		case "view_file":
 			var filePath string
 			if err := json.Unmarshal(msg.Payload, &filePath); err != nil {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, "invalid payload"))
 				continue
 			}
+			if strings.TrimSpace(filePath) == "" {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, "empty file path"))
+				continue
+			}
+			filePath = paths.Normalize(filePath)
 			h.mu.Lock()
-			h.viewers[conn] = filePath
+			h.viewers[conn] = map[string]struct{}{filePath: {}}
 			h.mu.Unlock()
+			h.reply(ctx, replies, h.subscribed(conn, []string{filePath}))
+
+		case "view_files":
+			var files []string
+			if err := json.Unmarshal(msg.Payload, &files); err != nil {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, "invalid payload"))
+				continue
+			}
+			accepted, err := h.viewFiles(conn, files)
+			if err != nil {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, err.Error()))
+				continue
+			}
+			h.reply(ctx, replies, h.subscribed(conn, accepted))
+
+		case "unview_file":
+			var filePath string
+			if err := json.Unmarshal(msg.Payload, &filePath); err != nil {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, "invalid payload"))
+				continue
+			}
+			filePath = paths.Normalize(filePath)
+			if !h.unviewFile(conn, filePath) {
+				h.reply(ctx, replies, h.subscriptionError(conn, msg.Type, "not subscribed: "+filePath))
+				continue
+			}
+			h.reply(ctx, replies, h.subscribed(conn, []string{filePath}))
+
+		case "get_file_info":
+			var filePath string
+			if err := json.Unmarshal(msg.Payload, &filePath); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, "invalid payload"))
+				continue
+			}
+			h.reply(ctx, replies, h.fileInfo(ctx, paths.Normalize(filePath)))
+
+		case "resume_network":
+			var lastSeen time.Time
+			if err := json.Unmarshal(msg.Payload, &lastSeen); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, "invalid timestamp"))
+				continue
+			}
+			chunks := packetChunker{size: h.cfg.StreamBatchSize}
+			for _, batch := range h.tunnel.NetworkSince(lastSeen) {
+				chunks.add(batch)
+				for len(chunks.pending) > 0 {
+					h.reply(ctx, replies, chunks.next())
+				}
+			}
+
+		case "replay":
+			var req replayRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, "invalid payload"))
+				continue
+			}
+			if err := req.validate(); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, err.Error()))
+				continue
+			}
+			h.startReplay(ctx, conn, replies, req)
+
+		case "stop_replay":
+			if !h.stopReplay(conn) {
+				h.reply(ctx, replies, errorMessage(msg.Type, "no replay running"))
+			}
 
 		case "speed_control":
 			var speed float64
 			if err := json.Unmarshal(msg.Payload, &speed); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, "invalid speed"))
+				continue
+			}
+			// The speed applies to the running replay, or else to the
+			// live stream
+			if h.replaying(conn) {
+				if err := validReplaySpeed(speed); err != nil {
+					h.reply(ctx, replies, errorMessage(msg.Type, err.Error()))
+				} else if !h.setReplaySpeed(conn, speed) {
+					h.reply(ctx, replies, errorMessage(msg.Type, "no replay running"))
+				}
 				continue
 			}
-			// Store speed preference for this connection
-			// Implementation depends on your rate limiting strategy
+			if err := validLiveSpeed(speed); err != nil {
+				h.reply(ctx, replies, errorMessage(msg.Type, err.Error()))
+				continue
+			}
+			h.setLiveSpeed(conn, speed)
+		}
+	}
+}
+
+// fileInfo looks up the current metadata of a file for a get_file_info request
+func (h *Handler) fileInfo(ctx context.Context, filePath string) wsMessage {
+	file, err := h.db.GetFileByPath(ctx, filePath)
+	if errors.Is(err, db.ErrNotFound) {
+		return errorMessage("get_file_info", "file not found: "+filePath)
+	}
+	if err != nil {
+		log.Printf("WebSocket file info lookup failed: %v", err)
+		return errorMessage("get_file_info", "file lookup failed")
+	}
+
+	return wsMessage{
+		Type:    "file_info",
+		Payload: json.RawMessage(mustMarshal(file)),
+	}
+}
+
+// reply queues a message for writePump, giving up if the connection closes
+func (h *Handler) reply(ctx context.Context, replies chan<- wsMessage, msg wsMessage) {
+	select {
+	case replies <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// subscriptions returns the files whose log lines conn receives
+func (h *Handler) subscriptions(conn *websocket.Conn) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	files := make([]string, 0, len(h.viewers[conn]))
+	for file := range h.viewers[conn] {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// viewFiles adds files to the connection's subscription set, all or none,
+// and returns the normalized paths
+func (h *Handler) viewFiles(conn *websocket.Conn, files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no files")
+	}
+	accepted := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.TrimSpace(file) == "" {
+			return nil, errors.New("empty file path")
+		}
+		accepted = append(accepted, paths.Normalize(file))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	viewed := h.viewers[conn]
+	added := 0
+	for _, file := range accepted {
+		if _, ok := viewed[file]; !ok {
+			added++
 		}
 	}
+	if len(viewed)+added > maxViewedFiles {
+		return nil, fmt.Errorf("at most %d files can be viewed at once", maxViewedFiles)
+	}
+	if viewed == nil {
+		viewed = make(map[string]struct{}, len(accepted))
+		h.viewers[conn] = viewed
+	}
+	for _, file := range accepted {
+		viewed[file] = struct{}{}
+	}
+	return accepted, nil
 }
 
-func (h *Handler) writePump(ctx context.Context, conn *websocket.Conn) {
+// unviewFile removes a file from the connection's subscription set,
+// reporting whether it was in it
+func (h *Handler) unviewFile(conn *websocket.Conn, file string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	viewed := h.viewers[conn]
+	if _, ok := viewed[file]; !ok {
+		return false
+	}
+	delete(viewed, file)
+	if len(viewed) == 0 {
+		delete(h.viewers, conn)
+	}
+	return true
+}
+
+// viewing reports whether the connection receives the file's log lines
+func (h *Handler) viewing(conn *websocket.Conn, file string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.viewers[conn][file]
+	return ok
+}
+
+// subscribed acknowledges accepted files along with the resulting
+// subscription set, so clients can reconcile their view
+func (h *Handler) subscribed(conn *websocket.Conn, accepted []string) wsMessage {
+	return wsMessage{
+		Type: "subscribed",
+		Payload: json.RawMessage(mustMarshal(map[string][]string{
+			"accepted": accepted,
+			"files":    h.subscriptions(conn),
+		})),
+	}
+}
+
+// subscriptionError rejects a subscription request, which leaves the
+// subscription set unchanged
+func (h *Handler) subscriptionError(conn *websocket.Conn, request, reason string) wsMessage {
+	return wsMessage{
+		Type: "subscription_error",
+		Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+			"request": request,
+			"error":   reason,
+			"files":   h.subscriptions(conn),
+		})),
+	}
+}
+
+func errorMessage(request, reason string) wsMessage {
+	return wsMessage{
+		Type: "error",
+		Payload: json.RawMessage(mustMarshal(map[string]string{
+			"request": request,
+			"error":   reason,
+		})),
+	}
+}
+
+func (h *Handler) writePump(ctx context.Context, conn *websocket.Conn, replies <-chan wsMessage) {
 	// Create ticker for network updates
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := h.clock.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
+	// Each client gets its own copy of the live streams, with the lines
+	// of the files it views
+	streams := h.tunnel.SubscribeStreams(func(path string) bool { return h.viewing(conn, path) })
+	defer streams.Close()
+
+	// Batching follows the stream policy, which can change mid-stream
+	updates := newFileUpdateCoalescer(h.tunnel.StreamPolicy().FileUpdates.CoalesceWindow(), h.cfg.FileUpdateInvalidateCount, h.clock)
+	defer updates.stop()
+	logs := logBatcher{clock: h.clock}
+	defer logs.stop()
+	packets := newPacketChunker(h.cfg.StreamBatchSize, h.clock)
+	defer packets.stop()
+
+	// A read-only server streams log lines by polling the database
+	var (
+		poll   <-chan time.Time
+		poller logPoller
+	)
+	if h.cfg.ReadOnly {
+		pollTicker := h.clock.NewTicker(h.cfg.ReadOnlyPollInterval)
+		defer pollTicker.Stop()
+		poll = pollTicker.C()
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
-		case packets := <-h.tunnel.NetworkStream():
+		case <-streams.Closed():
+			return
+
+		case msg := <-replies:
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+
+		case batch, ok := <-packets.accept(streams.Network()):
+			if !ok {
+				return
+			}
+			packets.setSpeed(h.liveSpeed(conn))
+			packets.add(batch)
+
+		case <-packets.ready():
+			if err := conn.WriteJSON(packets.next()); err != nil {
+				return
+			}
+
+		case summary := <-streams.Summaries():
 			err := conn.WriteJSON(wsMessage{
-				Type:    "network",
-				Payload: json.RawMessage(mustMarshal(packets)),
+				Type:    "network_summary",
+				Payload: json.RawMessage(mustMarshal(summary)),
 			})
 			if err != nil {
 				return
 			}
 
-		case log := <-h.tunnel.LogStream():
-			// Check if client is viewing this file
-			h.mu.RLock()
-			viewingFile := h.viewers[conn]
-			h.mu.RUnlock()
+		case quality, ok := <-streams.Quality():
+			if !ok {
+				return
+			}
+			err := conn.WriteJSON(wsMessage{
+				Type:    "stream_quality",
+				Payload: json.RawMessage(mustMarshal(quality)),
+			})
+			if err != nil {
+				return
+			}
 
-			if viewingFile == log.Filename {
+		case entry, ok := <-streams.Logs():
+			if !ok {
+				return
+			}
+			window := liveLogWindow(h.tunnel.StreamPolicy().Logs.BatchWindow(), h.liveSpeed(conn))
+			msg, ok := logs.add(entry, window)
+			if !ok {
+				continue
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+
+		case <-logs.due():
+			if err := conn.WriteJSON(logs.flush()); err != nil {
+				return
+			}
+
+		case <-poll:
+			logs, err := h.pollLogs(ctx, conn, &poller)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("WebSocket log poll failed: %v", err)
+				}
+				continue
+			}
+			for _, entry := range logs {
 				err := conn.WriteJSON(wsMessage{
 					Type:    "log",
-					Payload: json.RawMessage(mustMarshal(log)),
+					Payload: json.RawMessage(mustMarshal(entry)),
 				})
 				if err != nil {
 					return
 				}
 			}
 
-		case file := <-h.tunnel.FileUpdates():
+		case op, ok := <-streams.Operations():
+			if !ok {
+				return
+			}
 			err := conn.WriteJSON(wsMessage{
-				Type:    "file_update",
-				Payload: json.RawMessage(mustMarshal(file)),
+				Type:    "operation_update",
+				Payload: json.RawMessage(mustMarshal(op)),
 			})
 			if err != nil {
 				return
 			}
 
-		case <-ticker.C:
+		case file, ok := <-streams.FileUpdates():
+			if !ok {
+				return
+			}
+			updates.window = h.tunnel.StreamPolicy().FileUpdates.CoalesceWindow()
+			msg, ok := updates.add(file, h.clock.Now())
+			if !ok {
+				continue
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+
+		case <-updates.due():
+			if err := conn.WriteJSON(updates.flush()); err != nil {
+				return
+			}
+
+		case deletion, ok := <-streams.MassDeletions():
+			if !ok {
+				return
+			}
+			msgType := "mass_deletion_resolved"
+			if deletion.State == tunnel.MassDeletionPending {
+				msgType = "mass_deletion_pending"
+			}
+			err := conn.WriteJSON(wsMessage{
+				Type:    msgType,
+				Payload: json.RawMessage(mustMarshal(deletion)),
+			})
+			if err != nil {
+				return
+			}
+
+		case <-ticker.C():
 			// Send ping to keep connection alive
 			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
@@ -152,6 +547,28 @@ func (h *Handler) writePump(ctx context.Context, conn *websocket.Conn) {
 	}
 }
 
+// sendSnapshot sends the pinned view of the file tree when pins are
+// configured, so the client can render its top level without a REST call.
+// Pins that can't be read leave the snapshot without roots rather than
+// costing the client its live updates.
+func (h *Handler) sendSnapshot(ctx context.Context, conn *websocket.Conn) error {
+	roots, err := h.db.GetPinnedRoots(ctx, h.cfg.PinnedPaths)
+	if err != nil {
+		log.Printf("WebSocket snapshot sent without pinned roots: %v", err)
+		roots = []models.PinnedRoot{}
+	} else if len(roots) == 0 {
+		return nil
+	}
+
+	return conn.WriteJSON(wsMessage{
+		Type: "file_snapshot",
+		Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+			"view":  "pinned",
+			"roots": roots,
+		})),
+	})
+}
+
 // Helper function to handle JSON marshaling
 func mustMarshal(v interface{}) []byte {
 	data, err := json.Marshal(v)
@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/config"
+	"diagnostic-client/internal/db"
+	"diagnostic-client/internal/realip"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+// newTestServer serves websocket clients from a live tunnel on the database
+// TEST_DATABASE_URL names, migrated on connect. Tests needing it are
+// skipped when the variable isn't set.
+func newTestServer(t *testing.T) (*httptest.Server, *tunnel.Handler) {
+	t.Helper()
+	srv, tun, _ := newConfiguredServer(t, nil)
+	return srv, tun
+}
+
+// newConfiguredServer is newTestServer with the configuration adjusted by
+// configure, also returning the database
+func newConfiguredServer(t *testing.T, configure func(*config.Config)) (*httptest.Server, *tunnel.Handler, *db.DB) {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("connect to test database: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "TRUNCATE files, logs CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("DATABASE_URL", url)
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	d, err := db.New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(d.Close)
+	tun := tunnel.NewHandler(cfg, d, clock.Real{})
+	t.Cleanup(tun.Close)
+
+	srv := httptest.NewServer(http.HandlerFunc(NewHandler(cfg, tun, d, realip.New(nil), clock.Real{}).ServeWS))
+	t.Cleanup(srv.Close)
+	return srv, tun, d
+}
+
+// dialViewer connects a client viewing file and waits for the subscription
+func dialViewer(t *testing.T, srv *httptest.Server, file string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteJSON(wsMessage{Type: "view_file", Payload: json.RawMessage(mustMarshal(file))}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "subscribed")
+	return conn
+}
+
+// readUntil returns the first message of one of the types
+func readUntil(t *testing.T, conn *websocket.Conn, types ...string) wsMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %v: %v", types, err)
+		}
+		for _, typ := range types {
+			if msg.Type == typ {
+				return msg
+			}
+		}
+	}
+}
+
+func TestLogLinesReachEveryViewer(t *testing.T) {
+	srv, tun := newTestServer(t)
+	const file = "/var/log/fanout.log"
+	viewers := []*websocket.Conn{dialViewer(t, srv, file), dialViewer(t, srv, file)}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.HandleConnection(ctx, server)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := agent.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	now := time.Now().UTC()
+	send := func(typ tunnel.MessageType, payload interface{}) {
+		if err := json.NewEncoder(agent).Encode(tunnel.Message{Type: typ, Payload: mustMarshal(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(tunnel.TypeLogList, []models.FileNode{{Path: file, ParentPath: "/var/log", Name: "fanout.log", ModTime: now}})
+	send(tunnel.TypeLogData, []models.LogEntry{{Filename: file, Line: "to everyone", LineNum: 1, Timestamp: now}})
+
+	for i, conn := range viewers {
+		msg := readUntil(t, conn, "log", "logs")
+		if !strings.Contains(string(msg.Payload), "to everyone") {
+			t.Errorf("viewer %d got %s %s, want the line", i, msg.Type, msg.Payload)
+		}
+	}
+}
+
+func TestUnusualPathsReachViewers(t *testing.T) {
+	srv, tun := newTestServer(t)
+	files := []string{"/var/log/my app/weird#file (1).log", "/var/log/журнал/ошибки.log"}
+	viewers := []*websocket.Conn{dialViewer(t, srv, files[0]), dialViewer(t, srv, files[1])}
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.HandleConnection(ctx, server)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := agent.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	now := time.Now().UTC()
+	send := func(typ tunnel.MessageType, payload interface{}) {
+		if err := json.NewEncoder(agent).Encode(tunnel.Message{Type: typ, Payload: mustMarshal(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(tunnel.TypeLogList, []models.FileNode{
+		{Path: files[0], ParentPath: "/var/log/my app", Name: "weird#file (1).log", ModTime: now},
+		{Path: files[1], ParentPath: "/var/log/журнал", Name: "ошибки.log", ModTime: now},
+	})
+	send(tunnel.TypeLogData, []models.LogEntry{
+		{Filename: files[0], Line: "weird line", LineNum: 1, Timestamp: now},
+		{Filename: files[1], Line: "строка", LineNum: 1, Timestamp: now},
+	})
+
+	for i, want := range []string{"weird line", "строка"} {
+		msg := readUntil(t, viewers[i], "log", "logs")
+		if !strings.Contains(string(msg.Payload), want) {
+			t.Errorf("viewer of %s got %s %s, want %q", files[i], msg.Type, msg.Payload, want)
+		}
+	}
+
+	// The stored file is found under the exact bytes the viewer sent
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := viewers[0].WriteJSON(wsMessage{Type: "get_file_info", Payload: mustMarshal(files[0])}); err != nil {
+			t.Fatal(err)
+		}
+		msg := readUntil(t, viewers[0], "file_info", "error")
+		if msg.Type == "file_info" {
+			if !strings.Contains(string(msg.Payload), "weird#file (1).log") {
+				t.Errorf("file info = %s, want the file", msg.Payload)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file info = %s, want the file", msg.Payload)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestReadOnlyStreamsByPolling serves a viewer from a read-only server,
+// which has no agents, while rows are inserted into its database as a
+// replica receives them
+func TestReadOnlyStreamsByPolling(t *testing.T) {
+	srv, _, d := newConfiguredServer(t, func(cfg *config.Config) {
+		cfg.ReadOnly = true
+		cfg.ReadOnlyPollInterval = 50 * time.Millisecond
+	})
+	ctx := context.Background()
+	const file = "/var/log/replica.log"
+	now := time.Now().UTC()
+	if err := d.SaveFiles(ctx, []models.FileNode{{Path: file, ParentPath: "/var/log", Name: "replica.log", ModTime: now}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveLogs(ctx, []models.LogEntry{{Filename: file, Line: "stored before viewing", LineNum: 1, Timestamp: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := dialViewer(t, srv, file)
+	// The first poll places the viewer's cursor past the stored lines
+	time.Sleep(200 * time.Millisecond)
+
+	for i, line := range []string{"first new line", "second new line"} {
+		entry := models.LogEntry{Filename: file, Line: line, LineNum: i + 2, Timestamp: now.Add(time.Duration(i+1) * time.Second)}
+		if err := d.SaveLogs(ctx, []models.LogEntry{entry}); err != nil {
+			t.Fatal(err)
+		}
+		msg := readUntil(t, viewer, "log")
+		var got models.LogEntry
+		if err := json.Unmarshal(msg.Payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Line != line {
+			t.Fatalf("polled %q, want %q", got.Line, line)
+		}
+	}
+}
+
+func TestSnapshotWithoutPinsKeepsConnection(t *testing.T) {
+	srv, _, d := newConfiguredServer(t, func(cfg *config.Config) {
+		cfg.PinnedPaths = []string{"/var/log"}
+	})
+	// Pins can't be read from a closed database
+	d.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := readUntil(t, conn, "file_snapshot")
+	var snapshot struct {
+		View  string            `json:"view"`
+		Roots []json.RawMessage `json:"roots"`
+	}
+	if err := json.Unmarshal(msg.Payload, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.View != "pinned" || snapshot.Roots == nil || len(snapshot.Roots) != 0 {
+		t.Errorf("snapshot = %s, want the pinned view with no roots", msg.Payload)
+	}
+
+	// The connection still answers requests
+	if err := conn.WriteJSON(wsMessage{Type: "get_file_info", Payload: json.RawMessage(mustMarshal("/var/log/app.log"))}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "error")
+}
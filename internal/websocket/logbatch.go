@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"encoding/json"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/pkg/models"
+)
+
+// logBatcher collects one client's log lines for the stream policy's batch
+// window and sends them as one logs message, an array of log payloads
+type logBatcher struct {
+	pending []models.LogEntry
+	timer   clock.Timer
+	clock   clock.Clock
+}
+
+// add takes a line and returns a message to send now, if any
+func (b *logBatcher) add(entry models.LogEntry, window time.Duration) (wsMessage, bool) {
+	if window <= 0 {
+		if len(b.pending) == 0 {
+			return logMessage(entry), true
+		}
+		// Batching was just turned off; keep the lines in order
+		b.pending = append(b.pending, entry)
+		return b.flush(), true
+	}
+
+	b.pending = append(b.pending, entry)
+	if b.timer == nil {
+		b.timer = b.clock.NewTimer(window)
+	}
+	return wsMessage{}, false
+}
+
+// due fires when the pending lines should be sent; nil when none are
+func (b *logBatcher) due() <-chan time.Time {
+	if b.timer == nil {
+		return nil
+	}
+	return b.timer.C()
+}
+
+// flush returns the message for the pending lines and clears them
+func (b *logBatcher) flush() wsMessage {
+	b.stop()
+	b.timer = nil
+	entries := b.pending
+	b.pending = nil
+
+	if len(entries) == 1 {
+		return logMessage(entries[0])
+	}
+	return wsMessage{
+		Type:    "logs",
+		Payload: json.RawMessage(mustMarshal(entries)),
+	}
+}
+
+func (b *logBatcher) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+func logMessage(entry models.LogEntry) wsMessage {
+	return wsMessage{
+		Type:    "log",
+		Payload: json.RawMessage(mustMarshal(entry)),
+	}
+}
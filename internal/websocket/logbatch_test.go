@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/internal/tunnel"
+	"diagnostic-client/pkg/models"
+)
+
+func logLine(n int) models.LogEntry {
+	return models.LogEntry{Filename: "/var/log/app.log", Line: "line", LineNum: n}
+}
+
+func batchedLines(t *testing.T, msg wsMessage) []int {
+	t.Helper()
+	var nums []int
+	switch msg.Type {
+	case "log":
+		var entry models.LogEntry
+		if err := json.Unmarshal(msg.Payload, &entry); err != nil {
+			t.Fatal(err)
+		}
+		nums = append(nums, entry.LineNum)
+	case "logs":
+		var entries []models.LogEntry
+		if err := json.Unmarshal(msg.Payload, &entries); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			nums = append(nums, e.LineNum)
+		}
+	default:
+		t.Fatalf("message type %q, want log or logs", msg.Type)
+	}
+	return nums
+}
+
+func TestLogBatcherCollectsWindow(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := logBatcher{clock: clk}
+	defer b.stop()
+
+	for i := 1; i <= 3; i++ {
+		if _, ok := b.add(logLine(i), 200*time.Millisecond); ok {
+			t.Fatalf("line %d went out within the window", i)
+		}
+	}
+	due := b.due()
+	if due == nil {
+		t.Fatal("no flush scheduled for pending lines")
+	}
+	clk.Advance(200 * time.Millisecond)
+	select {
+	case <-due:
+	default:
+		t.Fatal("flush not due at the end of the window")
+	}
+
+	msg := b.flush()
+	if got := batchedLines(t, msg); msg.Type != "logs" || len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("flushed %s %v, want logs with lines 1-3 in order", msg.Type, got)
+	}
+	if b.due() != nil {
+		t.Error("a timer runs with nothing pending")
+	}
+}
+
+func TestLogBatcherSingleLine(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := logBatcher{clock: clk}
+
+	b.add(logLine(1), time.Second)
+	if msg := b.flush(); msg.Type != "log" {
+		t.Errorf("one batched line sent as %s, want log", msg.Type)
+	}
+	// Without a window every line goes out on its own
+	if msg, ok := b.add(logLine(2), 0); !ok || msg.Type != "log" {
+		t.Errorf("unbatched line = %v %s, want a log now", ok, msg.Type)
+	}
+}
+
+func TestLogBatcherTurnedOffMidBatch(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := logBatcher{clock: clk}
+
+	b.add(logLine(1), time.Second)
+	b.add(logLine(2), time.Second)
+	// The policy turned batching off; the pending lines go out first
+	msg, ok := b.add(logLine(3), 0)
+	if !ok {
+		t.Fatal("line held back with batching off")
+	}
+	if got := batchedLines(t, msg); len(got) != 3 || got[0] != 1 || got[2] != 3 {
+		t.Errorf("sent %v, want lines 1-3 in order", got)
+	}
+	if b.due() != nil {
+		t.Error("the old window's timer still runs")
+	}
+}
+
+// TestLogBatchWindowChangesMidStream changes the log batch window while a
+// viewer stays connected, and the viewer's lines follow the new policy
+func TestLogBatchWindowChangesMidStream(t *testing.T) {
+	srv, tun := newTestServer(t)
+	const file = "/var/log/policy.log"
+	viewer := dialViewer(t, srv, file)
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tun.HandleConnection(ctx, server)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := agent.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	now := time.Now().UTC()
+	send := func(typ tunnel.MessageType, payload interface{}) {
+		if err := json.NewEncoder(agent).Encode(tunnel.Message{Type: typ, Payload: mustMarshal(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := func(from, to int) []models.LogEntry {
+		var entries []models.LogEntry
+		for i := from; i <= to; i++ {
+			entries = append(entries, models.LogEntry{Filename: file, Line: "policy", LineNum: i, Timestamp: now})
+		}
+		return entries
+	}
+	send(tunnel.TypeLogList, []models.FileNode{{Path: file, ParentPath: "/var/log", Name: "policy.log", ModTime: now}})
+
+	p := tun.StreamPolicy()
+	p.Logs.BatchWindowMs = 0
+	tun.SetStreamPolicy(p, 0)
+	send(tunnel.TypeLogData, lines(1, 3))
+	for want := 1; want <= 3; want++ {
+		msg := readUntil(t, viewer, "log", "logs")
+		if got := batchedLines(t, msg); msg.Type != "log" || got[0] != want {
+			t.Fatalf("unbatched stream sent %s %v, want log line %d", msg.Type, got, want)
+		}
+	}
+
+	p.Logs.BatchWindowMs = 500
+	tun.SetStreamPolicy(p, 0)
+	send(tunnel.TypeLogData, lines(4, 6))
+	var got []int
+	for len(got) < 3 {
+		msg := readUntil(t, viewer, "log", "logs")
+		if msg.Type != "logs" {
+			t.Fatalf("batched stream sent %s, want logs", msg.Type)
+		}
+		got = append(got, batchedLines(t, msg)...)
+	}
+	if got[0] != 4 || got[len(got)-1] != 6 {
+		t.Errorf("batched lines %v, want 4-6", got)
+	}
+}
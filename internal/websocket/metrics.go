@@ -0,0 +1,8 @@
+package websocket
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var activeConnections = promauto.NewGauge(prometheus.GaugeOpts{Name: "websocket_active_connections", Help: "Open websocket client connections."})
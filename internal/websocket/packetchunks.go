@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+
+	"diagnostic-client/internal/clock"
+	"diagnostic-client/pkg/models"
+)
+
+// readyNow is always ready to receive from, for select cases that should
+// fire as soon as the loop gets to them
+var readyNow = func() chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+// packetChunker splits the packet batches of one client's network stream
+// into network messages of up to StreamBatchSize packets. Chunks are sent
+// one per pass of the write loop, so replies and pings aren't held up
+// behind a large batch. Below real-time speed, chunks are paced and grow
+// to carry the packets that arrive meanwhile.
+type packetChunker struct {
+	base    int // StreamBatchSize
+	size    int
+	pending []models.NetworkPacket
+
+	speed    float64
+	pace     time.Duration // Zero sends chunks as fast as the loop allows
+	clock    clock.Clock
+	timer    clock.Timer
+	lastSent time.Time
+}
+
+func newPacketChunker(size int, clk clock.Clock) *packetChunker {
+	return &packetChunker{base: size, size: size, speed: 1, clock: clk}
+}
+
+// setSpeed applies the client's live speed. Above 1, chunks grow so a
+// backlog drains in fewer messages; below it, messages are paced at that
+// fraction of the real-time rate and chunks grow to match.
+func (c *packetChunker) setSpeed(speed float64) {
+	if speed == c.speed {
+		return
+	}
+	c.speed = speed
+	c.stop()
+	c.timer = nil
+
+	if speed < 1 {
+		c.size = int(math.Ceil(float64(c.base) / speed))
+		c.pace = time.Duration(float64(liveMessageInterval) / speed)
+	} else {
+		c.size = int(math.Ceil(float64(c.base) * speed))
+		c.pace = 0
+	}
+}
+
+// accept returns the stream to take the next batch from; nil while a full
+// chunk is pending, so a slow client leaves batches queued in its
+// subscription, where the tunnel's sampling sees them
+func (c *packetChunker) accept(stream <-chan []models.NetworkPacket) <-chan []models.NetworkPacket {
+	if len(c.pending) >= c.size {
+		return nil
+	}
+	return stream
+}
+
+func (c *packetChunker) add(packets []models.NetworkPacket) {
+	if len(c.pending) == 0 {
+		c.pending = packets
+		return
+	}
+	// Batches are shared with other clients, so never append in place
+	c.pending = append(c.pending[:len(c.pending):len(c.pending)], packets...)
+}
+
+// ready fires when a chunk may be sent; nil when none is pending
+func (c *packetChunker) ready() <-chan time.Time {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	if c.pace == 0 {
+		return readyNow
+	}
+	if c.timer == nil {
+		wait := c.lastSent.Add(c.pace).Sub(c.clock.Now())
+		if wait <= 0 {
+			return readyNow
+		}
+		c.timer = c.clock.NewTimer(wait)
+	}
+	return c.timer.C()
+}
+
+// next returns the message for the next chunk and removes it
+func (c *packetChunker) next() wsMessage {
+	c.stop()
+	c.timer = nil
+	if c.clock != nil {
+		c.lastSent = c.clock.Now()
+	}
+
+	n := len(c.pending)
+	if c.size > 0 && n > c.size {
+		n = c.size
+	}
+	chunk := c.pending[:n]
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+
+	return wsMessage{
+		Type:    "network",
+		Payload: json.RawMessage(mustMarshal(chunk)),
+	}
+}
+
+func (c *packetChunker) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"diagnostic-client/internal/db"
+	"diagnostic-client/pkg/models"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Lines one poll sends per shard; the rest follow on the next poll
+	maxPolledLines = 1000
+	pollTimeout    = 5 * time.Second
+)
+
+// logPoller follows a connection's viewed files through the database, for
+// read-only servers, whose in-process log stream carries nothing since no
+// agents connect to them
+type logPoller struct {
+	cursors map[string]db.TailCursor
+}
+
+// pollLogs returns the lines of the viewed files stored since the last poll.
+// A newly viewed file starts from lines stored from then on. A failed poll
+// is retried whole, so it may send lines of some files again.
+func (h *Handler) pollLogs(ctx context.Context, conn *websocket.Conn, p *logPoller) ([]models.LogEntry, error) {
+	files := h.subscriptions(conn)
+	if len(files) == 0 {
+		p.cursors = nil
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+
+	cursors := make(map[string]db.TailCursor, len(files))
+	var logs []models.LogEntry
+	for _, file := range files {
+		cursor, ok := p.cursors[file]
+		if !ok {
+			now, err := h.db.TailCursorNow(ctx)
+			if err != nil {
+				return nil, err
+			}
+			cursors[file] = now
+			continue
+		}
+
+		lines, next, err := h.db.GetLogsAfter(ctx, file, cursor, maxPolledLines)
+		if err != nil {
+			return nil, err
+		}
+		cursors[file] = next
+		logs = append(logs, lines...)
+	}
+	p.cursors = cursors
+	return logs, nil
+}
@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"diagnostic-client/internal/paths"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bounds on a replay, so one client can't hold a large range in memory or a
+// connection open for days
+const (
+	maxReplayWindow = 24 * time.Hour
+	maxReplayLines  = 10000
+	minReplaySpeed  = 0.1
+	maxReplaySpeed  = 1000.0
+	// Quiet periods in the range are shortened to this, after scaling
+	maxReplayGap = 10 * time.Second
+)
+
+type replayRequest struct {
+	File  string    `json:"file"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Playback speed; 2 plays twice as fast as the lines arrived. Default: 1
+	Speed float64 `json:"speed"`
+}
+
+// replay is a connection's running playback of past log lines
+type replay struct {
+	cancel context.CancelFunc
+	speed  atomic.Uint64 // math.Float64bits of the speed
+}
+
+func (rp *replay) setSpeed(speed float64) { rp.speed.Store(math.Float64bits(speed)) }
+func (rp *replay) getSpeed() float64      { return math.Float64frombits(rp.speed.Load()) }
+
+func validReplaySpeed(speed float64) error {
+	if speed < minReplaySpeed || speed > maxReplaySpeed {
+		return fmt.Errorf("speed must be between %g and %g", minReplaySpeed, maxReplaySpeed)
+	}
+	return nil
+}
+
+func (req *replayRequest) validate() error {
+	if strings.TrimSpace(req.File) == "" {
+		return errors.New("empty file path")
+	}
+	req.File = paths.Normalize(req.File)
+	if req.Start.IsZero() || req.End.IsZero() {
+		return errors.New("start and end are required")
+	}
+	if !req.End.After(req.Start) {
+		return errors.New("end must be after start")
+	}
+	if req.End.Sub(req.Start) > maxReplayWindow {
+		return fmt.Errorf("range must be at most %v", maxReplayWindow)
+	}
+	if req.Speed == 0 {
+		req.Speed = 1
+	}
+	return validReplaySpeed(req.Speed)
+}
+
+// startReplay replaces the connection's replay, if any, with a new one
+func (h *Handler) startReplay(ctx context.Context, conn *websocket.Conn, replies chan<- wsMessage, req replayRequest) {
+	replayCtx, cancel := context.WithCancel(ctx)
+	rp := &replay{cancel: cancel}
+	rp.setSpeed(req.Speed)
+
+	h.mu.Lock()
+	if previous := h.replays[conn]; previous != nil {
+		previous.cancel()
+	}
+	h.replays[conn] = rp
+	h.mu.Unlock()
+
+	go h.runReplay(ctx, replayCtx, conn, replies, rp, req)
+}
+
+// stopReplay cancels the connection's replay and reports whether one was
+// running
+func (h *Handler) stopReplay(conn *websocket.Conn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rp := h.replays[conn]
+	if rp == nil {
+		return false
+	}
+	rp.cancel()
+	delete(h.replays, conn)
+	return true
+}
+
+// replaying reports whether the connection runs a replay
+func (h *Handler) replaying(conn *websocket.Conn) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.replays[conn] != nil
+}
+
+// setReplaySpeed changes the speed of the connection's replay from the next
+// line on
+func (h *Handler) setReplaySpeed(conn *websocket.Conn, speed float64) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rp := h.replays[conn]
+	if rp == nil {
+		return false
+	}
+	rp.setSpeed(speed)
+	return true
+}
+
+// runReplay sends the range's lines as replay_log messages, spaced by their
+// original gaps divided by the speed, then replay_done. Messages are queued
+// for writePump like other replies.
+func (h *Handler) runReplay(connCtx, ctx context.Context, conn *websocket.Conn, replies chan<- wsMessage, rp *replay, req replayRequest) {
+	defer func() {
+		rp.cancel()
+		h.mu.Lock()
+		if h.replays[conn] == rp {
+			delete(h.replays, conn)
+		}
+		h.mu.Unlock()
+	}()
+
+	logs, truncated, err := h.db.GetLogsBetween(ctx, req.File, req.Start, req.End, maxReplayLines)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("WebSocket replay of %s failed: %v", req.File, err)
+			h.reply(connCtx, replies, errorMessage("replay", "loading log lines failed"))
+		}
+		return
+	}
+
+	h.reply(ctx, replies, wsMessage{
+		Type: "replay_started",
+		Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+			"file":      req.File,
+			"start":     req.Start,
+			"end":       req.End,
+			"speed":     req.Speed,
+			"lines":     len(logs),
+			"truncated": truncated,
+		})),
+	})
+
+	sent := 0
+	for i, entry := range logs {
+		if i > 0 {
+			wait := time.Duration(float64(entry.Timestamp.Sub(logs[i-1].Timestamp)) / rp.getSpeed())
+			if wait > maxReplayGap {
+				wait = maxReplayGap
+			}
+			if wait > 0 {
+				timer := h.clock.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+				case <-timer.C():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		h.reply(ctx, replies, wsMessage{
+			Type:    "replay_log",
+			Payload: json.RawMessage(mustMarshal(entry)),
+		})
+		sent++
+	}
+
+	h.reply(connCtx, replies, wsMessage{
+		Type: "replay_done",
+		Payload: json.RawMessage(mustMarshal(map[string]interface{}{
+			"file":    req.File,
+			"sent":    sent,
+			"stopped": sent < len(logs),
+		})),
+	})
+}
@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Bounds on the live speed of a connection's network and log messages
+const (
+	minLiveSpeed = 0.1
+	maxLiveSpeed = 10.0
+	// Spacing of network messages at real-time speed, matching the 10
+	// messages a second StreamBatchSize is derived for
+	liveMessageInterval = 100 * time.Millisecond
+)
+
+func validLiveSpeed(speed float64) error {
+	if speed < minLiveSpeed || speed > maxLiveSpeed {
+		return fmt.Errorf("speed must be between %g and %g", minLiveSpeed, maxLiveSpeed)
+	}
+	return nil
+}
+
+// setLiveSpeed changes how fast the connection's live messages are sent
+func (h *Handler) setLiveSpeed(conn *websocket.Conn, speed float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if speed == 1 {
+		delete(h.speeds, conn)
+		return
+	}
+	h.speeds[conn] = speed
+}
+
+// liveSpeed returns the connection's live speed; 1 is real time
+func (h *Handler) liveSpeed(conn *websocket.Conn) float64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if speed, ok := h.speeds[conn]; ok {
+		return speed
+	}
+	return 1
+}
+
+// liveLogWindow scales the log batch window of the stream policy by the live
+// speed. Below real-time speed lines are batched for at least the network
+// message interval, scaled, even when the policy doesn't batch them.
+func liveLogWindow(window time.Duration, speed float64) time.Duration {
+	if speed < 1 {
+		window = max(window, liveMessageInterval)
+	}
+	return time.Duration(float64(window) / speed)
+}
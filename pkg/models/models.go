@@ -1,6 +1,17 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
+
+// Scrape states reported for files. Agents may report other states, which
+// are stored verbatim.
+const (
+	ScrapeStatePendingDecompress = "pending_decompress"
+	ScrapeStateScraped           = "scraped"
+	ScrapeStateSkippedTooLarge   = "skipped_too_large"
+)
 
 type FileNode struct {
 	Path        string    `json:"path"`
@@ -11,15 +22,70 @@ type FileNode struct {
 	ModTime     time.Time `json:"mod_time"`
 	IsGzipped   bool      `json:"is_gzipped"`
 	IsScraped   bool      `json:"is_scraped"`
+	ScrapeState string    `json:"scrape_state,omitempty"`
+	// Generation is bumped by the server each time the file is truncated and
+	// restarts from line 1; agents need not send it
+	Generation int `json:"generation"`
+	// LastSeen is set by the server when an agent reports the file as new or
+	// changed
+	LastSeen time.Time `json:"last_seen"`
+	// Sampling is N when only 1 in N of the file's log lines is stored. Set
+	// by the server from LOG_SAMPLING; omitted for unsampled files.
+	Sampling int `json:"sampling,omitempty"`
+	// LogCount is the number of stored log lines of the file, set only for
+	// files when the tree is requested with log counts
+	LogCount *int64 `json:"log_count,omitempty"`
+}
+
+// PinnedRoot is a virtual top-level tree entry. Pins for paths no agent has
+// reported yet are returned with Exists false and zero counts.
+type PinnedRoot struct {
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	Exists      bool   `json:"exists"`
+	IsDirectory bool   `json:"is_directory"`
+	FileCount   int64  `json:"file_count"`
+	TotalSize   int64  `json:"total_size"`
 }
 
 type LogEntry struct {
-	ID        int64     `json:"-"`
-	Filename  string    `json:"filename"`
-	Line      string    `json:"line"`
-	LineNum   int       `json:"line_num"`
-	Timestamp time.Time `json:"timestamp"`
-	Level     string    `json:"level"`
+	ID         int64     `json:"id,omitempty"`
+	Filename   string    `json:"filename"`
+	Line       string    `json:"line"`
+	LineNum    int       `json:"line_num"`
+	Timestamp  time.Time `json:"timestamp"`
+	Level      string    `json:"level"`
+	Truncated  bool      `json:"truncated,omitempty"` // Line was cut to the configured maximum length
+	Generation int       `json:"generation"`          // Generation of the file the line was read from
+	AgentID    string    `json:"agent_id,omitempty"`  // Set by the tunnel; picks the database shard
+}
+
+// LogPage is one page of a file's log entries, newest first. NextCursor
+// requests the following page and is set when HasMore is.
+type LogPage struct {
+	Entries    []LogEntry `json:"entries"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	HasMore    bool       `json:"has_more"`
+}
+
+// LogContext is a single log entry with the lines surrounding it
+type LogContext struct {
+	Entry  LogEntry   `json:"entry"`
+	Before []LogEntry `json:"before"`
+	After  []LogEntry `json:"after"`
+}
+
+// StaleLogFile is a file whose most recent log line is older than a threshold
+type StaleLogFile struct {
+	Path      string    `json:"path"`
+	LastLogAt time.Time `json:"last_log_at"`
+}
+
+// StaleLogFiles groups files that stopped logging separately from files that
+// never produced any log lines
+type StaleLogFiles struct {
+	Stale       []StaleLogFile `json:"stale"`
+	NeverLogged []string       `json:"never_logged"`
 }
 
 type NetworkPacket struct {
@@ -32,6 +98,89 @@ type NetworkPacket struct {
 	Length      int       `json:"length"`
 	PayloadSize int       `json:"payload_size"`
 	TCPFlags    string    `json:"tcp_flags,omitempty"`
+	AgentID     string    `json:"agent_id,omitempty"` // Set by the tunnel; picks the database shard
+}
+
+// NetworkSummary aggregates all packets captured within one second
+type NetworkSummary struct {
+	Timestamp   time.Time        `json:"timestamp"`
+	PacketCount int64            `json:"packet_count"`
+	TotalBytes  int64            `json:"total_bytes"`
+	Protocols   map[string]int64 `json:"protocols"`
+}
+
+// Operation states
+const (
+	OperationPending   = "pending"
+	OperationIngesting = "ingesting"
+	OperationComplete  = "complete"
+	OperationTimedOut  = "timed_out"
+)
+
+// Operation tracks a command until the data it asked for has been ingested
+type Operation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Path      string    `json:"path"`
+	State     string    `json:"state"`
+	Agents    int       `json:"agents"`
+	Batches   int       `json:"batches"`
+	Lines     int64     `json:"lines"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PacketRate is the average packet and byte rate over a time window
+type PacketRate struct {
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	PacketsPerSecond float64   `json:"packets_per_second"`
+	BytesPerSecond   float64   `json:"bytes_per_second"`
+	// Per-agent rates, when grouped by agent. A flow between two agents'
+	// hosts is captured by both, so the totals above count it twice.
+	Agents []AgentPacketRate `json:"agents,omitempty"`
+}
+
+// AgentPacketRate is the packet and byte rate captured by one agent
+type AgentPacketRate struct {
+	AgentID          string  `json:"agent_id"`
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+}
+
+// NetworkFlow aggregates the packets of one 5-tuple
+type NetworkFlow struct {
+	Protocol  string    `json:"protocol"`
+	SrcIP     string    `json:"src_ip"`
+	SrcPort   int       `json:"src_port"`
+	DstIP     string    `json:"dst_ip"`
+	DstPort   int       `json:"dst_port"`
+	Packets   int64     `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Capturing agent, when grouped by agent
+	AgentID string `json:"agent_id,omitempty"`
+	// Agents that captured the flow, when combined across agents
+	ObservedBy []string `json:"observed_by,omitempty"`
+}
+
+// FileErrorCount is the number of error-level lines logged by one file
+type FileErrorCount struct {
+	Path   string `json:"path"`
+	Errors int64  `json:"errors"`
+}
+
+// MinuteCount is the number of log lines in the minute starting at Minute
+type MinuteCount struct {
+	Minute time.Time `json:"minute"`
+	Lines  int64     `json:"lines"`
+}
+
+// PeriodTotal is the total of a metric in the bucket starting at Start
+type PeriodTotal struct {
+	Start time.Time `json:"start"`
+	Total int64     `json:"total"`
 }
 
 type NetworkStats struct {
@@ -51,3 +200,118 @@ type TopNetworkStats struct {
 	TopProtocols    map[string]int64 `json:"top_protocols"`
 	TopPorts        map[string]int64 `json:"top_ports"`
 }
+
+type Report struct {
+	ID              int64             `json:"id"`
+	Name            string            `json:"name"`
+	Query           string            `json:"query"`
+	Params          map[string]string `json:"params,omitempty"`
+	Schedule        string            `json:"schedule"`
+	RecipientEmails []string          `json:"recipient_emails"`
+	Format          string            `json:"format"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+// Annotation marks a point in time, such as a deploy, to show on charts
+type Annotation struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+	Tags      []string  `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DefaultAgentProfile names the agent config used by agents without their own
+const DefaultAgentProfile = "default"
+
+// AgentConfig is agent-side configuration managed centrally and pushed to
+// agents through the tunnel
+type AgentConfig struct {
+	// Paths or globs the agent scans for log files
+	ScanPaths []string `json:"scan_paths"`
+	// Time between scans; 0 leaves the agent's default
+	ScanIntervalSeconds int `json:"scan_interval_seconds,omitempty"`
+	// BPF filter for packet capture; empty captures everything
+	CaptureFilter string `json:"capture_filter,omitempty"`
+}
+
+// AgentConfigProfile is a stored AgentConfig. AgentID is an agent's ID, or
+// DefaultAgentProfile.
+type AgentConfigProfile struct {
+	AgentID   string      `json:"agent_id"`
+	Version   int64       `json:"version"`
+	Config    AgentConfig `json:"config"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// Agent is the identity an agent registered with on its latest connection.
+// IPAddress is the remote host it connected from.
+type Agent struct {
+	ID          string    `json:"id"`
+	Hostname    string    `json:"hostname"`
+	IPAddress   string    `json:"ip_address"`
+	Version     string    `json:"version,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// Kinds of AgentEvent
+const (
+	// The connection was closed for sending too many malformed messages
+	AgentEventProtocolError = "protocol_error"
+)
+
+// AgentEvent records why the server dropped an agent's connection
+type AgentEvent struct {
+	AgentID string    `json:"agent_id"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// AgentConfigAck records the config version an agent reported applying
+type AgentConfigAck struct {
+	AgentID string    `json:"agent_id"`
+	Profile string    `json:"profile"`
+	Version int64     `json:"version"`
+	Error   string    `json:"error,omitempty"`
+	AckedAt time.Time `json:"acked_at"`
+}
+
+// QueryPlan is an EXPLAIN plan captured for a slow query
+type QueryPlan struct {
+	ID         int64           `json:"id"`
+	QueryName  string          `json:"query_name"`
+	Params     json.RawMessage `json:"params"`
+	DurationMs float64         `json:"duration_ms"`
+	Plan       string          `json:"plan"`
+	CapturedAt time.Time       `json:"captured_at"`
+}
+
+// AgentMetric is an agent's average ingest rate over one minute, as
+// recorded by the agent_metrics job
+type AgentMetric struct {
+	Time             time.Time `json:"time"`
+	LinesPerSecond   float64   `json:"lines_per_second"`
+	PacketsPerSecond float64   `json:"packets_per_second"`
+	BytesPerSecond   float64   `json:"bytes_per_second"`
+}
+
+// LogColumnStats summarizes a file's current generation so a log view can
+// choose which columns to show. Shares and lengths come from a sample of
+// the newest lines.
+type LogColumnStats struct {
+	Path       string `json:"path"`
+	Generation int    `json:"generation"`
+	// Highest stored line number, for sizing the line number gutter
+	MaxLineNumber int      `json:"max_line_number"`
+	Levels        []string `json:"levels"`
+	// Timestamps of the first stored line and the newest sampled one; nil
+	// when the generation has no lines
+	MinTimestamp  *time.Time `json:"min_timestamp"`
+	MaxTimestamp  *time.Time `json:"max_timestamp"`
+	SampledLines  int        `json:"sampled_lines"`
+	JSONShare     float64    `json:"json_share"`
+	DurationShare float64    `json:"duration_share"`
+	AvgLineLength float64    `json:"avg_line_length"`
+}